@@ -6,6 +6,9 @@
 set -e
 echo "" > coverage.txt
 
+# the server binary that the integration tests of the integration package run
+go build -o coredhcp.bin ./cmds/coredhcp
+
 for d in $(go list ./... | grep -v vendor); do
     go test -race -coverprofile=profile.out -covermode=atomic $d
     if [ -f profile.out ]; then
@@ -16,9 +19,11 @@ for d in $(go list ./... | grep -v vendor); do
     go test -c -tags=integration -race -coverprofile=profile.out -covermode=atomic $d
     testbin="./$(basename $d).test"
     # only run it if it was built - i.e. if there are integ tests
-    test -x "${testbin}" && sudo "./${testbin}"
+    test -x "${testbin}" && sudo COREDHCP_BIN="$(pwd)/coredhcp.bin" "./${testbin}"
     if [ -f profile.out ]; then
         cat profile.out >> coverage.txt
         rm profile.out
     fi
 done
+
+rm -f coredhcp.bin
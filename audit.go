@@ -0,0 +1,182 @@
+package coredhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/metadata"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// AuditEntry is a single lease decision in the audit log.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// Version is either 4 or 6.
+	Version int    `json:"version"`
+	Peer    string `json:"peer"`
+	// Client is the client hardware address for DHCPv4, and the client DUID
+	// for DHCPv6.
+	Client  string `json:"client"`
+	Request string `json:"request"`
+	// Decision is the message type of the response, or `drop` if the
+	// request was not answered.
+	Decision  string   `json:"decision"`
+	Addresses []string `json:"addresses,omitempty"`
+	// Relay is the link address of the relay agent the request came
+	// through, if any.
+	Relay string `json:"relay,omitempty"`
+	// Plugin is the plugin that interrupted the handler chain, if any.
+	Plugin string `json:"plugin,omitempty"`
+	// Labels are the labels of the server and of the pool of the client.
+	Labels config.Labels `json:"labels,omitempty"`
+}
+
+// AuditAction is an administrative action in the audit log, e.g. disabling a
+// plugin through the management API.
+type AuditAction struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Principal is the authenticated client that took the action, if any.
+	Principal string `json:"principal,omitempty"`
+	Plugin    string `json:"plugin,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// AuditLog writes every lease decision, one JSON-encoded AuditEntry per line,
+// and the administrative actions, as AuditAction lines, to an append-only file
+// or to syslog. It is safe for concurrent use.
+type AuditLog struct {
+	lock sync.Mutex
+	w    io.WriteCloser
+}
+
+// NewAuditLog opens an audit log. The target is either a file name, which is
+// opened for appending, or `syslog://<facility>` (e.g. `syslog://local4`) to
+// send the entries to the local syslog daemon.
+func NewAuditLog(target string) (*AuditLog, error) {
+	if strings.HasPrefix(target, "syslog://") {
+		w, err := openAuditSyslog(strings.TrimPrefix(target, "syslog://"))
+		if err != nil {
+			return nil, err
+		}
+		return &AuditLog{w: w}, nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{w: f}, nil
+}
+
+func (a *AuditLog) write(entry interface{}) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode audit entry: %v", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Printf("Failed to write audit entry: %v", err)
+	}
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.w.Close()
+}
+
+// newAuditEntry6 returns the AuditEntry describing the decision taken for a
+// DHCPv6 request. resp can be nil.
+func newAuditEntry6(peer net.Addr, req, resp dhcpv6.DHCPv6, plugin string) (*AuditEntry, error) {
+	entry := AuditEntry{Time: time.Now(), Version: 6, Peer: peer.String(), Decision: "drop", Plugin: plugin}
+	if relay, ok := req.(*dhcpv6.DHCPv6Relay); ok {
+		entry.Relay = relay.LinkAddr().String()
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decapsulate request: %v", err)
+	}
+	entry.Request = msg.Type().String()
+	if opt, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId); ok {
+		entry.Client = opt.Cid.String()
+	}
+	if resp != nil {
+		if msg, err = dhcputil.InnerMessage6(resp); err != nil {
+			return nil, fmt.Errorf("cannot decapsulate response: %v", err)
+		}
+		entry.Decision = msg.Type().String()
+		for _, addr := range dhcputil.IAAddresses6(msg) {
+			entry.Addresses = append(entry.Addresses, addr.IPv6Addr.String())
+		}
+	}
+	entry.Labels = auditLabels(true, &entry)
+	return &entry, nil
+}
+
+// newAuditEntry4 is like newAuditEntry6, but for DHCPv4 requests.
+func newAuditEntry4(peer net.Addr, req, resp *dhcpv4.DHCPv4, plugin string) *AuditEntry {
+	entry := AuditEntry{
+		Time:     time.Now(),
+		Version:  4,
+		Peer:     peer.String(),
+		Client:   req.ClientHWAddr.String(),
+		Request:  req.MessageType().String(),
+		Decision: "drop",
+		Plugin:   plugin,
+	}
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		entry.Relay = req.GatewayIPAddr.String()
+	}
+	if resp != nil {
+		entry.Decision = resp.MessageType().String()
+		if resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified() {
+			entry.Addresses = []string{resp.YourIPAddr.String()}
+		}
+	}
+	entry.Labels = auditLabels(false, &entry)
+	return &entry
+}
+
+// auditLabels returns the labels of an entry, from its first address, or else
+// from its relay.
+func auditLabels(v6 bool, entry *AuditEntry) config.Labels {
+	var ip net.IP
+	if len(entry.Addresses) > 0 {
+		ip = net.ParseIP(entry.Addresses[0])
+	} else if entry.Relay != "" {
+		ip = net.ParseIP(entry.Relay)
+	}
+	return metadata.OfServer(v6, ip)
+}
+
+// Log6 records the decision taken for a DHCPv6 request. resp can be nil.
+func (a *AuditLog) Log6(peer net.Addr, req, resp dhcpv6.DHCPv6, plugin string) {
+	entry, err := newAuditEntry6(peer, req, resp, plugin)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	a.write(entry)
+}
+
+// Log4 records the decision taken for a DHCPv4 request. resp can be nil.
+func (a *AuditLog) Log4(peer net.Addr, req, resp *dhcpv4.DHCPv4, plugin string) {
+	a.write(newAuditEntry4(peer, req, resp, plugin))
+}
+
+// LogAction records an administrative action.
+func (a *AuditLog) LogAction(action *AuditAction) {
+	a.write(action)
+}
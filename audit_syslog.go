@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package coredhcp
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"daemon": syslog.LOG_DAEMON,
+	"auth":   syslog.LOG_AUTH,
+	"local0": syslog.LOG_LOCAL0,
+	"local1": syslog.LOG_LOCAL1,
+	"local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4,
+	"local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6,
+	"local7": syslog.LOG_LOCAL7,
+}
+
+// openAuditSyslog returns a writer to the local syslog daemon, with a facility.
+func openAuditSyslog(name string) (io.WriteCloser, error) {
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility `%s`", name)
+	}
+	return syslog.New(facility|syslog.LOG_INFO, "coredhcp-audit")
+}
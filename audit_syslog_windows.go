@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package coredhcp
+
+import (
+	"errors"
+	"io"
+)
+
+// openAuditSyslog fails: there is no local syslog daemon on Windows.
+func openAuditSyslog(name string) (io.WriteCloser, error) {
+	return nil, errors.New("the syslog audit log is not supported on Windows, use a file")
+}
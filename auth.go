@@ -0,0 +1,76 @@
+package coredhcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// NewAuth returns the TLS configuration and the authorizer of a management
+// listener. Both are nil if the configuration is.
+func NewAuth(ac *config.AuthConfig) (*tls.Config, management.Authorizer, error) {
+	if ac == nil {
+		return nil, nil, nil
+	}
+	var conf *tls.Config
+	if ac.TLS() {
+		cert, err := tls.LoadX509KeyPair(ac.Cert, ac.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		conf = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if ac.ClientCA != "" {
+			pem, err := ioutil.ReadFile(ac.ClientCA)
+			if err != nil {
+				return nil, nil, err
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, nil, errors.New("no CA certificate in " + ac.ClientCA)
+			}
+			conf.ClientCAs = pool
+			// the clients without certificate can still use a token
+			conf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	var auths management.Authorizers
+	if len(ac.Clients) > 0 {
+		clients, err := principals(ac.Clients)
+		if err != nil {
+			return nil, nil, err
+		}
+		auths = append(auths, management.NewCertAuthorizer(clients))
+	}
+	if len(ac.Tokens) > 0 {
+		byName, err := principals(ac.Tokens)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokens := make(map[string]*management.Principal, len(ac.Tokens))
+		for _, p := range ac.Tokens {
+			tokens[p.Token] = byName[p.Name]
+		}
+		auths = append(auths, management.NewTokenAuthorizer(tokens))
+	}
+	if len(auths) == 0 {
+		return conf, nil, nil
+	}
+	return conf, auths, nil
+}
+
+// principals returns the principals of a configuration, by name.
+func principals(pcs []*config.PrincipalConfig) (map[string]*management.Principal, error) {
+	ret := make(map[string]*management.Principal, len(pcs))
+	for _, pc := range pcs {
+		role, err := management.ParseRole(pc.Role)
+		if err != nil {
+			return nil, err
+		}
+		ret[pc.Name] = &management.Principal{Name: pc.Name, Role: role}
+	}
+	return ret, nil
+}
@@ -0,0 +1,59 @@
+package coredhcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// RestoreResult is the response of the restore endpoint.
+type RestoreResult struct {
+	Leases int `json:"leases"`
+	Hosts  int `json:"hosts"`
+}
+
+// registerBackupHandlers registers the backup endpoints of the lease store:
+// GET /leases/backup returns a snapshot of the store, consistent even while
+// the server is running, and POST /leases/restore replaces the content of the
+// store with the snapshot in the body. See `coredhcpctl`. Both need the admin
+// role, since a snapshot holds the data of all the clients.
+func registerBackupHandlers(m *management.Server, store leases.Store) {
+	m.HandleFunc("/leases/backup", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		snap, err := leases.TakeSnapshot(store)
+		if err != nil {
+			management.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="leases-%s.json"`, snap.Created.UTC().Format("20060102T150405Z")))
+		management.WriteJSON(w, http.StatusOK, snap)
+	})
+	m.Require("/leases/backup", management.RoleAdmin)
+	m.HandleFunc("/leases/restore", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var snap leases.Snapshot
+		if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+			management.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := leases.RestoreSnapshot(store, &snap); err != nil {
+			management.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("Restored %d leases and %d hosts from the snapshot of %s via the management API",
+			len(snap.Leases), len(snap.Hosts), snap.Created.Format(time.RFC3339))
+		management.WriteJSON(w, http.StatusOK, RestoreResult{Leases: len(snap.Leases), Hosts: len(snap.Hosts)})
+	})
+}
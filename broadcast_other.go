@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package coredhcp
+
+import (
+	"net"
+)
+
+// replyPeer4 returns the address to send a DHCPv4 reply to. Only Windows needs
+// to rewrite the broadcast replies, see broadcast_windows.go.
+func replyPeer4(conn net.PacketConn, peer net.Addr) net.Addr {
+	return peer
+}
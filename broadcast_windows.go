@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package coredhcp
+
+import (
+	"net"
+)
+
+// replyPeer4 returns the address to send a DHCPv4 reply to. Windows sends the
+// packets to the limited broadcast address out of the single interface picked
+// by the routing table, which on multi-homed hosts is not necessarily the one
+// of the listener. The broadcast replies of the listeners bound to an address
+// are sent to the directed broadcast address of its subnet instead, which
+// leaves through the interface of the subnet.
+func replyPeer4(conn net.PacketConn, peer net.Addr) net.Addr {
+	ua, ok := peer.(*net.UDPAddr)
+	if !ok || !ua.IP.Equal(net.IPv4bcast) {
+		return peer
+	}
+	local, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok || local.IP.To4() == nil || local.IP.IsUnspecified() {
+		return peer
+	}
+	if bcast := directedBroadcast(local.IP.To4()); bcast != nil {
+		return &net.UDPAddr{IP: bcast, Port: ua.Port}
+	}
+	return peer
+}
+
+// directedBroadcast returns the broadcast address of the subnet of a local
+// IPv4 address, or nil if no interface has it.
+func directedBroadcast(ip net.IP) net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.Equal(ip) || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ip[i] | ^ipnet.Mask[i]
+		}
+		return bcast
+	}
+	return nil
+}
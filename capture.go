@@ -0,0 +1,134 @@
+package coredhcp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/pcap"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// CaptureFilter selects the transactions to capture. Empty fields match
+// every transaction.
+type CaptureFilter struct {
+	MAC net.HardwareAddr
+	// MessageTypes lists the names of the request or response message types
+	// to capture, e.g. `solicit` or `discover`. Matching is case-insensitive.
+	MessageTypes []string
+}
+
+func (f *CaptureFilter) matchType(types ...string) bool {
+	if len(f.MessageTypes) == 0 {
+		return true
+	}
+	for _, want := range f.MessageTypes {
+		for _, t := range types {
+			if strings.EqualFold(want, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *CaptureFilter) matchMAC(mac net.HardwareAddr) bool {
+	return f.MAC == nil || (mac != nil && mac.String() == f.MAC.String())
+}
+
+// Capture mirrors the matching requests and responses to a rotating pcap file,
+// for a limited duration.
+type Capture struct {
+	Filter CaptureFilter
+	Until  time.Time
+
+	closeOnce sync.Once
+	w         *pcap.RotatingWriter
+}
+
+// NewCapture creates a Capture that writes to the specified file for the
+// specified duration. The file is rotated when it reaches maxSize bytes, and
+// at most maxFiles rotated files are kept.
+func NewCapture(filename string, filter CaptureFilter, duration time.Duration, maxSize int64, maxFiles int) (*Capture, error) {
+	w, err := pcap.NewRotatingWriter(filename, maxSize, maxFiles)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Capturing traffic to %s for %v", filename, duration)
+	return &Capture{Filter: filter, Until: time.Now().Add(duration), w: w}, nil
+}
+
+// Active returns true if the capture has not expired yet. The capture file is
+// closed the first time Active returns false.
+func (c *Capture) Active() bool {
+	if time.Now().Before(c.Until) {
+		return true
+	}
+	c.closeOnce.Do(func() {
+		log.Printf("Capture to %s ended", c.w.Name)
+		if err := c.w.Close(); err != nil {
+			log.Printf("Failed to close capture file: %v", err)
+		}
+	})
+	return false
+}
+
+func (c *Capture) write(conn net.PacketConn, peer net.Addr, req, resp []byte) {
+	local, ok1 := conn.LocalAddr().(*net.UDPAddr)
+	remote, ok2 := peer.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return
+	}
+	now := time.Now()
+	if err := c.w.WriteUDP(now, remote, local, req); err != nil {
+		log.Printf("Failed to capture request: %v", err)
+	}
+	if resp != nil {
+		if err := c.w.WriteUDP(now, local, remote, resp); err != nil {
+			log.Printf("Failed to capture response: %v", err)
+		}
+	}
+}
+
+// Capture6 writes a DHCPv6 transaction to the capture file if it matches the
+// filter.
+func (c *Capture) Capture6(conn net.PacketConn, peer net.Addr, req, resp dhcpv6.DHCPv6) {
+	if !c.Active() {
+		return
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	types := []string{req.Type().String()}
+	if resp != nil {
+		types = append(types, resp.Type().String())
+	}
+	if !c.Filter.matchMAC(mac) || !c.Filter.matchType(types...) {
+		return
+	}
+	var respBytes []byte
+	if resp != nil {
+		respBytes = resp.ToBytes()
+	}
+	c.write(conn, peer, req.ToBytes(), respBytes)
+}
+
+// Capture4 is like Capture6, but for DHCPv4 transactions.
+func (c *Capture) Capture4(conn net.PacketConn, peer net.Addr, req, resp *dhcpv4.DHCPv4) {
+	if !c.Active() {
+		return
+	}
+	types := []string{req.MessageType().String()}
+	if resp != nil {
+		types = append(types, resp.MessageType().String())
+	}
+	if !c.Filter.matchMAC(req.ClientHWAddr) || !c.Filter.matchType(types...) {
+		return
+	}
+	var respBytes []byte
+	if resp != nil {
+		respBytes = dhcputil.Encode4(resp)
+	}
+	c.write(conn, peer, req.ToBytes(), respBytes)
+}
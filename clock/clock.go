@@ -0,0 +1,151 @@
+// Package clock abstracts the time of the lease lifetimes and expiries, so
+// that they can run on a fake clock: tests fast-forward it deterministically
+// instead of sleeping, and it can be frozen, e.g. to debug the expiry of a
+// lease.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time, and ticks.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a ticker sending the time on its channel every d,
+	// which must be positive.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the interface of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Default is the clock of the server. It is the real clock, unless replaced
+// before the server starts.
+var Default Clock = Real{}
+
+// Now returns the time of the Default clock.
+func Now() time.Time {
+	return Default.Now()
+}
+
+// Since returns the time elapsed since t on the Default clock.
+func Since(t time.Time) time.Duration {
+	return Default.Now().Sub(t)
+}
+
+// Until returns the duration until t on the Default clock.
+func Until(t time.Time) time.Duration {
+	return t.Sub(Default.Now())
+}
+
+// Real is the clock of the time package.
+type Real struct{}
+
+// Now implements Clock.
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// NewTicker implements Clock.
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.t.C }
+func (t realTicker) Stop()               { t.t.Stop() }
+
+// Fake is a clock that only moves when it is advanced, or set. Its tickers
+// tick when their time comes, as with time.Ticker the ticks that are not
+// received are dropped. It is safe for concurrent use.
+type Fake struct {
+	lock    sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+}
+
+// NewFake returns a fake clock, frozen at t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+// NewTicker implements Clock.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	t := &fakeTicker{clock: f, c: make(chan time.Time, 1), period: d, next: f.now.Add(d)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, ticking the tickers on the way, in
+// time order. Concurrent advances add up.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.set(f.now.Add(d))
+}
+
+// Set moves the clock to t, ticking the tickers whose time came, in time
+// order. Setting it back in time does not tick.
+func (f *Fake) Set(t time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.set(t)
+}
+
+// set is Set. The lock must be held.
+func (f *Fake) set(t time.Time) {
+	for {
+		sort.Slice(f.tickers, func(i, j int) bool { return f.tickers[i].next.Before(f.tickers[j].next) })
+		if len(f.tickers) == 0 || f.tickers[0].next.After(t) {
+			break
+		}
+		next := f.tickers[0]
+		f.now = next.next
+		select {
+		case next.c <- f.now:
+		default:
+		}
+		next.next = next.next.Add(next.period)
+	}
+	f.now = t
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+
+func (t *fakeTicker) Stop() {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	for i, ft := range t.clock.tickers {
+		if ft == t {
+			t.clock.tickers = append(t.clock.tickers[:i], t.clock.tickers[i+1:]...)
+			return
+		}
+	}
+}
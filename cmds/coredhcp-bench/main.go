@@ -0,0 +1,290 @@
+package main
+
+/*
+ * Load-testing client: simulates many concurrent DHCPv6 (SARR) or DHCPv4
+ * (DORA) clients against a server, and reports latency percentiles and
+ * failure counts. With -store, it benchmarks the in-memory lease store
+ * instead, with one binding per flow.
+ */
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+var log = logger.GetLogger()
+
+var (
+	flagServer  = flag.String("server", "[::1]:547", "Address of the server to test")
+	flagV4      = flag.Bool("4", false, "Run DHCPv4 DORA flows instead of DHCPv6 SARR flows")
+	flagClients = flag.Int("clients", 100, "Number of concurrent clients")
+	flagFlows   = flag.Int("flows", 10, "Number of flows each client runs")
+	flagRenews  = flag.Int("renews", 0, "Number of renews each client sends after every flow")
+	flagTimeout = flag.Duration("timeout", 3*time.Second, "Timeout of each exchange")
+	flagStore   = flag.Bool("store", false, "Benchmark the in-memory lease store instead of a server, with one binding per flow")
+	flagBaseMAC = flag.String("base-mac", "02:00:00:00:00:00", "Hardware address of the first client, the others are incremented from it")
+)
+
+// result holds the outcome of a single request/response exchange.
+type result struct {
+	phase   string
+	latency time.Duration
+	err     error
+}
+
+// client is a simulated client with its own socket and hardware address.
+type client struct {
+	conn *net.UDPConn
+	mac  net.HardwareAddr
+}
+
+// exchange sends a packet to the server and waits for a single response.
+func (c *client) exchange(req []byte) ([]byte, time.Duration, error) {
+	start := time.Now()
+	if err := c.conn.SetDeadline(start.Add(*flagTimeout)); err != nil {
+		return nil, 0, err
+	}
+	if _, err := c.conn.Write(req); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf[:n], time.Since(start), nil
+}
+
+// flow6 runs a SOLICIT/ADVERTISE/REQUEST/REPLY flow, followed by the
+// configured number of RENEWs.
+func (c *client) flow6(results chan<- result) {
+	duid := dhcpv6.Duid{
+		Type:          dhcpv6.DUID_LL,
+		HwType:        iana.HwTypeEthernet,
+		LinkLayerAddr: c.mac,
+	}
+	solicit, err := dhcpv6.NewSolicitWithCID(duid)
+	if err != nil {
+		results <- result{phase: "solicit", err: err}
+		return
+	}
+	data, latency, err := c.exchange(solicit.ToBytes())
+	if err == nil {
+		_, err = expect6(data, dhcpv6.MessageTypeAdvertise)
+	}
+	results <- result{phase: "solicit", latency: latency, err: err}
+	if err != nil {
+		return
+	}
+	adv, _ := dhcpv6.FromBytes(data)
+	request, err := dhcpv6.NewRequestFromAdvertise(adv)
+	if err != nil {
+		results <- result{phase: "request", err: err}
+		return
+	}
+	for i := 0; i <= *flagRenews; i++ {
+		phase := "request"
+		if i > 0 {
+			phase = "renew"
+			if msg, ok := request.(*dhcpv6.DHCPv6Message); ok {
+				msg.SetMessage(dhcpv6.MessageTypeRenew)
+			}
+		}
+		data, latency, err := c.exchange(request.ToBytes())
+		if err == nil {
+			_, err = expect6(data, dhcpv6.MessageTypeReply)
+		}
+		results <- result{phase: phase, latency: latency, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func expect6(data []byte, mt dhcpv6.MessageType) (dhcpv6.DHCPv6, error) {
+	d, err := dhcpv6.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if d.Type() != mt {
+		return nil, fmt.Errorf("expected %v, got %v", mt, d.Type())
+	}
+	return d, nil
+}
+
+// flow4 runs a DISCOVER/OFFER/REQUEST/ACK flow, followed by the configured
+// number of RENEWs.
+func (c *client) flow4(results chan<- result) {
+	discover, err := dhcpv4.NewDiscovery(c.mac)
+	if err != nil {
+		results <- result{phase: "discover", err: err}
+		return
+	}
+	data, latency, err := c.exchange(discover.ToBytes())
+	var offer *dhcpv4.DHCPv4
+	if err == nil {
+		offer, err = expect4(data, dhcpv4.MessageTypeOffer)
+	}
+	results <- result{phase: "discover", latency: latency, err: err}
+	if err != nil {
+		return
+	}
+	for i := 0; i <= *flagRenews; i++ {
+		phase := "request"
+		request, err := dhcpv4.NewRequestFromOffer(offer)
+		if err != nil {
+			results <- result{phase: phase, err: err}
+			return
+		}
+		if i > 0 {
+			// RFC 2131: a RENEWING client fills ciaddr and omits
+			// server identifier and requested IP address.
+			phase = "renew"
+			request.ClientIPAddr = offer.YourIPAddr
+			delete(request.Options, dhcpv4.OptionServerIdentifier.Code())
+			delete(request.Options, dhcpv4.OptionRequestedIPAddress.Code())
+		}
+		data, latency, err := c.exchange(request.ToBytes())
+		if err == nil {
+			_, err = expect4(data, dhcpv4.MessageTypeAck)
+		}
+		results <- result{phase: phase, latency: latency, err: err}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func expect4(data []byte, mt dhcpv4.MessageType) (*dhcpv4.DHCPv4, error) {
+	d, err := dhcpv4.FromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+	if d.MessageType() != mt {
+		return nil, fmt.Errorf("expected %v, got %v", mt, d.MessageType())
+	}
+	return d, nil
+}
+
+// nthMAC returns the base hardware address incremented by n.
+func nthMAC(base net.HardwareAddr, n int) net.HardwareAddr {
+	mac := make(net.HardwareAddr, len(base))
+	copy(mac, base)
+	if len(mac) < 4 {
+		return mac
+	}
+	tail := mac[len(mac)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+uint32(n))
+	return mac
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(len(sorted)-1) * p)
+	return sorted[idx]
+}
+
+func main() {
+	flag.Parse()
+	if *flagClients < 1 || *flagFlows < 1 || *flagRenews < 0 {
+		log.Fatal(errors.New("-clients and -flows must be positive, -renews cannot be negative"))
+	}
+	base, err := net.ParseMAC(*flagBaseMAC)
+	if err != nil {
+		log.Fatal(err)
+	}
+	results := make(chan result, *flagClients)
+	var wg sync.WaitGroup
+	start := time.Now()
+	if *flagStore {
+		store := leases.NewMemoryStore()
+		for i := 0; i < *flagClients; i++ {
+			mac := nthMAC(base, i)
+			first := i * *flagFlows
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < *flagFlows; j++ {
+					storeFlow(store, mac, nthIP(first+j), results)
+				}
+			}()
+		}
+	} else {
+		server, err := net.ResolveUDPAddr("udp", *flagServer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i := 0; i < *flagClients; i++ {
+			conn, err := net.DialUDP("udp", nil, server)
+			if err != nil {
+				log.Fatal(err)
+			}
+			c := client{conn: conn, mac: nthMAC(base, i)}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer c.conn.Close()
+				for j := 0; j < *flagFlows; j++ {
+					if *flagV4 {
+						c.flow4(results)
+					} else {
+						c.flow6(results)
+					}
+				}
+			}()
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		latencies = make(map[string][]time.Duration)
+		failures  = make(map[string]int)
+		errs      = make(map[string]int)
+		phases    []string
+	)
+	for r := range results {
+		if _, ok := latencies[r.phase]; !ok {
+			phases = append(phases, r.phase)
+			latencies[r.phase] = nil
+		}
+		if r.err != nil {
+			failures[r.phase]++
+			errs[r.err.Error()]++
+			continue
+		}
+		latencies[r.phase] = append(latencies[r.phase], r.latency)
+	}
+	elapsed := time.Since(start)
+
+	fmt.Printf("%d clients, %d flows each, %d renews per flow, completed in %v\n", *flagClients, *flagFlows, *flagRenews, elapsed)
+	fmt.Printf("%-10s %8s %8s %12s %12s %12s %12s\n", "phase", "ok", "failed", "p50", "p90", "p99", "max")
+	for _, phase := range phases {
+		l := latencies[phase]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%-10s %8d %8d %12v %12v %12v %12v\n", phase, len(l), failures[phase],
+			percentile(l, 0.5), percentile(l, 0.9), percentile(l, 0.99), percentile(l, 1))
+	}
+	if len(errs) > 0 {
+		fmt.Println("errors:")
+		for e, count := range errs {
+			fmt.Printf("  %6d %s\n", count, e)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// nthIP returns the n-th address of fd00::/96, or of 10.0.0.0/8 with -4, for
+// the bindings of the store benchmark.
+func nthIP(n int) net.IP {
+	if *flagV4 {
+		ip := net.IPv4(10, 0, 0, 0).To4()
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(ip)+uint32(n))
+		return ip
+	}
+	ip := net.ParseIP("fd00::")
+	binary.BigEndian.PutUint32(ip[12:], uint32(n))
+	return ip
+}
+
+// storeFlow binds an address to a client in the store, then renews it the
+// configured number of times and looks it up, like the server does when
+// handling the flows of the network benchmark.
+func storeFlow(store leases.Store, mac net.HardwareAddr, ip net.IP, results chan<- result) {
+	now := time.Now()
+	lease := leases.Lease{IP: ip, HWAddr: mac, Starts: now, Ends: now.Add(time.Hour)}
+	start := time.Now()
+	err := leases.Claim(store, &lease)
+	results <- result{phase: "claim", latency: time.Since(start), err: err}
+	if err != nil {
+		return
+	}
+	for i := 0; i < *flagRenews; i++ {
+		lease.Ends = time.Now().Add(time.Hour)
+		start = time.Now()
+		err = store.PutLease(&lease)
+		results <- result{phase: "renew", latency: time.Since(start), err: err}
+	}
+	start = time.Now()
+	_, err = store.Lease(ip)
+	results <- result{phase: "lookup", latency: time.Since(start), err: err}
+}
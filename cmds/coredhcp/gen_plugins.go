@@ -0,0 +1,119 @@
+//go:build ignore
+// +build ignore
+
+// gen_plugins reads plugin.cfg and writes one plugin_<name>.go file per plugin,
+// which imports its package, so that it registers itself, unless the build is
+// a minimal one without the `with_<name>` tag. The generated files of the
+// plugins removed from plugin.cfg are deleted. Run it with `go generate`.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	cfgFile = "plugin.cfg"
+	// internalPrefix is the import path of the plugins of this repository.
+	internalPrefix = "github.com/coredhcp/coredhcp/plugins/"
+	header         = "// Code generated by gen_plugins.go from plugin.cfg. DO NOT EDIT.\n"
+)
+
+// pluginName is the syntax of the names, which are part of the file names and
+// of the build tags.
+var pluginName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+type plugin struct {
+	name, pkg string
+}
+
+// parseCfg parses the `<name>:<package>` lines of a plugin list. Empty lines
+// and lines starting with `#` are ignored.
+func parseCfg(data []byte) ([]plugin, error) {
+	var (
+		plugins []plugin
+		seen    = make(map[string]bool)
+		lineno  int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) != 2 || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expected `<name>:<package>`", cfgFile, lineno)
+		}
+		p := plugin{name: strings.TrimSpace(fields[0]), pkg: strings.TrimSpace(fields[1])}
+		if !pluginName.MatchString(p.name) {
+			return nil, fmt.Errorf("%s:%d: invalid name `%s`, must be lowercase letters, digits and underscores", cfgFile, lineno, p.name)
+		}
+		if seen[p.name] {
+			return nil, fmt.Errorf("%s:%d: duplicate plugin `%s`", cfgFile, lineno, p.name)
+		}
+		seen[p.name] = true
+		// an external package path starts with a domain
+		if !strings.Contains(strings.SplitN(p.pkg, "/", 2)[0], ".") {
+			p.pkg = internalPrefix + p.pkg
+		}
+		plugins = append(plugins, p)
+	}
+	return plugins, scanner.Err()
+}
+
+func (p *plugin) source() []byte {
+	return []byte(fmt.Sprintf(`%s
+//go:build !minimal || with_%s
+// +build !minimal with_%s
+
+package main
+
+import (
+	_ "%s"
+)
+`, header, p.name, p.name, p.pkg))
+}
+
+func main() {
+	data, err := ioutil.ReadFile(cfgFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	plugins, err := parseCfg(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	wanted := make(map[string]bool)
+	for _, p := range plugins {
+		name := "plugin_" + p.name + ".go"
+		wanted[name] = true
+		if err := ioutil.WriteFile(name, p.source(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// remove the files of the plugins that are no longer listed
+	files, err := filepath.Glob("plugin_*.go")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, name := range files {
+		if wanted[name] {
+			continue
+		}
+		if data, err := ioutil.ReadFile(name); err == nil && bytes.HasPrefix(data, []byte(header)) {
+			if err := os.Remove(name); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	log.Printf("Generated the registration of %d plugins", len(plugins))
+}
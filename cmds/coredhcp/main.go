@@ -1,13 +1,46 @@
+// The plugins are wired in by the plugin_<name>.go files, generated from
+// plugin.cfg.
+//go:generate go run gen_plugins.go
+
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/coredhcp/coredhcp"
 	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/kea"
+	"github.com/coredhcp/coredhcp/leases"
 	"github.com/coredhcp/coredhcp/logger"
-	_ "github.com/coredhcp/coredhcp/plugins/file"
-	_ "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/coredhcp/coredhcp/omapi"
+	"github.com/coredhcp/coredhcp/snmp"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/coredhcp/coredhcp/tracing"
+)
+
+var (
+	flagConfig = flag.String("conf", "", "Path to the configuration file. If empty, search for `config.{yml,json,toml}` in the default locations")
+	flagFormat = flag.String("format", "", "Format of the configuration file (yml, json or toml). If empty, detect it from the file extension")
+	flagRecord = flag.String("record", "", "Record every request and its response to this journal file, see the `replay` command")
+	flagAudit  = flag.String("audit", "", "Append every lease decision to this audit log file, or send it to syslog with `syslog://<facility>`")
+	// remote configuration
+	flagRemoteProvider = flag.String("remote-provider", "", "Load the configuration from a remote key/value store (etcd or consul)")
+	flagRemoteEndpoint = flag.String("remote-endpoint", "", "Endpoint of the remote key/value store, e.g. http://127.0.0.1:4001")
+	flagRemotePath     = flag.String("remote-path", "/coredhcp/config", "Key of the configuration in the remote key/value store")
+	flagRemoteWatch    = flag.Duration("remote-watch", 30*time.Second, "Interval between checks for remote configuration changes. 0 disables watching")
+	// on-demand packet capture
+	flagCapture         = flag.String("capture", "", "Mirror the matching traffic to this pcap file")
+	flagCaptureMAC      = flag.String("capture-mac", "", "Only capture the traffic of this hardware address")
+	flagCaptureTypes    = flag.String("capture-types", "", "Only capture these comma-separated message types, e.g. solicit,request")
+	flagCaptureDuration = flag.Duration("capture-duration", 10*time.Minute, "Stop capturing after this time")
+	flagCaptureSize     = flag.Int64("capture-max-size", 10*1024*1024, "Rotate the capture file when it reaches this size in bytes")
+	flagCaptureFiles    = flag.Int("capture-max-files", 5, "Number of rotated capture files to keep")
 )
 
 // Application variables
@@ -16,18 +49,189 @@ var (
 	AppVersion = "v0.1"
 )
 
+// commands maps the name of a sub-command to its implementation. Without a
+// sub-command, the server is started.
+var commands = map[string]func(args []string) error{
+	"simulate": simulate,
+	"replay":   replay,
+}
+
+// setupLogging adds the logging backends specified in the configuration.
+func setupLogging(lc *config.LoggerConfig) error {
+	if fc := lc.File; fc != nil {
+		logger.SetRotatingFile(fc.Path, fc.MaxSize, fc.MaxAge, fc.MaxBackups, fc.Compress)
+	}
+	if sc := lc.Syslog; sc != nil {
+		hook, err := logger.NewSyslogHook(sc.Network, sc.Address, sc.Facility, &tls.Config{InsecureSkipVerify: sc.TLSSkipVerify})
+		if err != nil {
+			return err
+		}
+		logger.GetLogger().AddHook(hook)
+	}
+	return nil
+}
+
+// loadConfig loads the configuration from the source selected by the flags.
+func loadConfig() (*config.Config, error) {
+	if *flagRemoteProvider != "" {
+		return config.LoadRemote(*flagRemoteProvider, *flagRemoteEndpoint, *flagRemotePath, *flagFormat)
+	} else if *flagConfig != "" {
+		return config.LoadFile(*flagConfig, *flagFormat)
+	}
+	return config.Load()
+}
+
 func main() {
 	logger := logger.GetLogger()
-	config, err := config.Load()
-	if err != nil {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				logger.Fatal(err)
+			}
+			return
+		}
+	}
+	flag.Parse()
+	if ok, err := runService(serve); ok {
+		if err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+	if err := serve(nil); err != nil {
 		logger.Fatal(err)
 	}
-	server := coredhcp.NewServer(config)
+}
+
+// serve runs the server until it fails or, if stop is not nil, until stop is
+// closed.
+func serve(stop <-chan struct{}) error {
+	logger := logger.GetLogger()
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if err := setupLogging(conf.Logger); err != nil {
+		return err
+	}
+	if tc := conf.Tracing; tc != nil {
+		shutdown, err := tracing.Setup(tc.Endpoint, tc.Insecure, tc.SampleRatio)
+		if err != nil {
+			return err
+		}
+		defer shutdown()
+	}
+	store, err := openLeaseStore(conf.Leases)
+	if err != nil {
+		return err
+	}
+	if store != nil {
+		logger.Printf("Using the %s lease store", conf.Leases.Backend)
+		leases.Default = store
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+	}
+	server := coredhcp.NewServer(conf)
+	if sc := conf.SNMP; sc != nil {
+		root := snmp.DefaultRoot
+		if sc.Root != "" {
+			if root, err = snmp.ParseOID(sc.Root); err != nil {
+				return err
+			}
+		}
+		agent := snmp.NewSubagent(sc.AgentX, root, snmp.Concat(
+			snmp.StatsVariables(stats.Default, root),
+			snmp.LeaseVariables(leases.Default, server.Pools, root),
+		))
+		go agent.Run(30 * time.Second)
+	}
+	if *flagRecord != "" {
+		recorder, err := coredhcp.NewRecorder(*flagRecord)
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		server.Recorder = recorder
+	}
+	if *flagAudit != "" {
+		auditLog, err := coredhcp.NewAuditLog(*flagAudit)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		server.AuditLog = auditLog
+	}
+	if *flagCapture != "" {
+		var filter coredhcp.CaptureFilter
+		if *flagCaptureMAC != "" {
+			if filter.MAC, err = net.ParseMAC(*flagCaptureMAC); err != nil {
+				return err
+			}
+		}
+		if *flagCaptureTypes != "" {
+			filter.MessageTypes = strings.Split(*flagCaptureTypes, ",")
+		}
+		capture, err := coredhcp.NewCapture(*flagCapture, filter, *flagCaptureDuration, *flagCaptureSize, *flagCaptureFiles)
+		if err != nil {
+			return err
+		}
+		server.Capture = capture
+	}
 	if err := server.Start(); err != nil {
-		logger.Fatal(err)
+		return err
+	}
+	if oc := conf.OMAPI; oc != nil {
+		var key *omapi.Key
+		if oc.KeyName != "" {
+			key = &omapi.Key{Name: oc.KeyName, Secret: oc.KeySecret}
+		}
+		omapiServer := omapi.NewServer(oc.Listen, leases.Default, key)
+		if err := omapiServer.Start(); err != nil {
+			return err
+		}
+		defer omapiServer.Close()
+	}
+	if kc := conf.Kea; kc != nil {
+		api := kea.NewAPI(leases.Default, stats.Default, func() error {
+			nc, err := loadConfig()
+			if err != nil {
+				return err
+			}
+			return server.Reload(nc)
+		})
+		if kc.Listen != "" {
+			if api.TLS, api.Auth, err = coredhcp.NewAuth(kc.Auth); err != nil {
+				return err
+			}
+			if err := api.ListenHTTP(kc.Listen); err != nil {
+				return err
+			}
+		}
+		if kc.Socket != "" {
+			if err := api.ListenUnix(kc.Socket); err != nil {
+				return err
+			}
+		}
+		defer api.Close()
+	}
+	if *flagRemoteProvider != "" && *flagRemoteWatch > 0 {
+		go conf.WatchRemote(*flagRemoteWatch, func(nc *config.Config) {
+			if err := server.Reload(nc); err != nil {
+				logger.Printf("Failed to reload configuration: %v", err)
+			}
+		})
+	}
+	if stop != nil {
+		go func() {
+			<-stop
+			logger.Print("Stopping")
+			server.Stop()
+		}()
 	}
 	if err := server.Wait(); err != nil {
 		logger.Print(err)
 	}
 	time.Sleep(time.Second)
+	return nil
 }
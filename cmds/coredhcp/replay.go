@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/coredhcp/coredhcp"
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// replay implements the `replay` sub-command: it runs the requests recorded
+// in a journal through the plugins of a candidate configuration, and reports
+// the responses that differ from the recorded ones.
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		conf    = fs.String("conf", "", "Path to the candidate configuration file. If empty, search the default locations")
+		format  = fs.String("format", "", "Format of the configuration file. If empty, detect it from the file extension")
+		journal = fs.String("journal", "", "Path to the journal recorded with -record")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *journal == "" {
+		return fmt.Errorf("replay: -journal is required")
+	}
+	f, err := os.Open(*journal)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	records, err := coredhcp.ReadJournal(f)
+	if err != nil {
+		return err
+	}
+	var c *config.Config
+	if *conf != "" {
+		c, err = config.LoadFile(*conf, *format)
+	} else {
+		c, err = config.Load()
+	}
+	if err != nil {
+		return err
+	}
+	server := coredhcp.NewServer(c)
+	// like for simulate, the plugins are not committed, so that replaying
+	// next to the running server does not bind its ports nor start the
+	// background tasks of the candidate configuration
+	if _, err := server.LoadPlugins(c); err != nil {
+		return err
+	}
+
+	differ := 0
+	for idx, rec := range records {
+		res, err := server.Replay(rec)
+		if err != nil {
+			fmt.Printf("#%d %s DHCPv%d from %s: cannot replay: %v\n", idx, rec.Time, rec.Version, rec.Peer, err)
+			differ++
+			continue
+		}
+		if !res.Differs() {
+			continue
+		}
+		differ++
+		switch {
+		case res.WasDropped && !res.IsDropped:
+			fmt.Printf("#%d %s DHCPv%d from %s: was dropped, now answered\n", idx, rec.Time, rec.Version, rec.Peer)
+		case !res.WasDropped && res.IsDropped:
+			fmt.Printf("#%d %s DHCPv%d from %s: was answered, now dropped\n", idx, rec.Time, rec.Version, rec.Peer)
+		default:
+			fmt.Printf("#%d %s DHCPv%d from %s: options changed: %v\n", idx, rec.Time, rec.Version, rec.Peer, res.Changed)
+		}
+	}
+	fmt.Printf("%d of %d responses differ\n", differ, len(records))
+	if differ > 0 {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// runService runs the server as a service of the platform, if it was started
+// by the service manager, and returns whether it did. Only Windows services
+// are supported: elsewhere, the init system runs the server as a normal
+// process.
+func runService(serve func(stop <-chan struct{}) error) (bool, error) {
+	return false, nil
+}
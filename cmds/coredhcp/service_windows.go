@@ -0,0 +1,141 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/coredhcp/coredhcp/logger"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service, and the source of its
+// events in the event log.
+const serviceName = "coredhcp"
+
+func init() {
+	commands["service"] = serviceCommand
+}
+
+// service is the control handler of the Windows service.
+type service struct {
+	serve func(stop <-chan struct{}) error
+}
+
+// Execute implements svc.Handler: it runs the server until it fails, or until
+// the service manager stops it or the system shuts down.
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	log := logger.GetLogger()
+	status <- svc.Status{State: svc.StartPending}
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() { done <- s.serve(stop) }()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Errorf("Service failed: %v", err)
+				return false, 1
+			}
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				// the wait hint is in milliseconds
+				status <- svc.Status{State: svc.StopPending, WaitHint: 10000}
+				close(stop)
+				if err := <-done; err != nil {
+					log.Errorf("Service failed: %v", err)
+				}
+				return false, 0
+			default:
+				log.Printf("Unexpected service control request %d", req.Cmd)
+			}
+		}
+	}
+}
+
+// runService runs the server as a Windows service if it was started by the
+// service manager, logging to the event log, and returns whether it did.
+func runService(serve func(stop <-chan struct{}) error) (bool, error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		return true, fmt.Errorf("cannot tell whether running as a service: %v", err)
+	}
+	if interactive {
+		return false, nil
+	}
+	hook, err := logger.NewEventLogHook(serviceName)
+	if err != nil {
+		return true, err
+	}
+	logger.GetLogger().AddHook(hook)
+	return true, svc.Run(serviceName, &service{serve: serve})
+}
+
+// serviceCommand manages the Windows service: `install` registers it with the
+// following arguments, e.g. `-conf C:\coredhcp\config.yml`, and its event log
+// source, `remove` unregisters them, and `start` and `stop` start and stop it.
+func serviceCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("service: need one of install, remove, start or stop")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("service: cannot connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if exe, err = filepath.Abs(exe); err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: AppName,
+			Description: "DHCPv6 and DHCPv4 server",
+			StartType:   mgr.StartAutomatic,
+		}, args[1:]...)
+		if err != nil {
+			return fmt.Errorf("service: cannot install: %v", err)
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			s.Delete()
+			return fmt.Errorf("service: cannot install the event log source: %v", err)
+		}
+		return nil
+	case "remove", "start", "stop":
+	default:
+		return fmt.Errorf("service: unknown command `%s`", args[0])
+	}
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service: not installed: %v", err)
+	}
+	defer s.Close()
+	switch args[0] {
+	case "remove":
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		return eventlog.Remove(serviceName)
+	case "start":
+		return s.Start()
+	default:
+		_, err := s.Control(svc.Stop)
+		return err
+	}
+}
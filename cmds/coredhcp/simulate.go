@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp"
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// simulate implements the `simulate` sub-command: it builds a synthetic
+// DISCOVER or SOLICIT, runs it through the configured plugins without sending
+// anything, and prints the resulting response and what each plugin did. With
+// -peer, it first verifies the split scope with the configuration of the peer
+// server.
+func simulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var (
+		conf        = fs.String("conf", "", "Path to the configuration file. If empty, search the default locations")
+		format      = fs.String("format", "", "Format of the configuration file. If empty, detect it from the file extension")
+		macString   = fs.String("mac", "00:11:22:33:44:55", "Hardware address of the simulated client")
+		vendorClass = fs.String("vendor-class", "", "Vendor class of the simulated client")
+		v4          = fs.Bool("4", false, "Simulate a DHCPv4 DISCOVER instead of a DHCPv6 SOLICIT")
+		peer        = fs.String("peer", "", "Path to the configuration file of the peer server of a split scope, to verify the split")
+	)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	mac, err := net.ParseMAC(*macString)
+	if err != nil {
+		return err
+	}
+	var c *config.Config
+	if *conf != "" {
+		c, err = config.LoadFile(*conf, *format)
+	} else {
+		c, err = config.Load()
+	}
+	if err != nil {
+		return err
+	}
+	if *peer != "" {
+		pc, err := config.LoadFile(*peer, *format)
+		if err != nil {
+			return err
+		}
+		if err := checkSplit(c, pc); err != nil {
+			return err
+		}
+	}
+	server := coredhcp.NewServer(c)
+	// the plugins are loaded but not committed: their listeners and
+	// background tasks are not started
+	if _, err := server.LoadPlugins(c); err != nil {
+		return err
+	}
+
+	var steps []coredhcp.SimulationStep
+	if *v4 {
+		var modifiers []dhcpv4.Modifier
+		if *vendorClass != "" {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(*vendorClass)))
+		}
+		req, err := dhcpv4.NewDiscovery(mac, modifiers...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request:\n%s\n", req.Summary())
+		var resp *dhcpv4.DHCPv4
+		resp, steps = server.Simulate4(req)
+		if resp != nil {
+			fmt.Printf("Response:\n%s\n", resp.Summary())
+		} else {
+			fmt.Println("Response: none, the request is dropped")
+		}
+	} else {
+		var modifiers []dhcpv6.Modifier
+		if *vendorClass != "" {
+			modifiers = append(modifiers, withVendorClass6(*vendorClass))
+		}
+		duid := dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LL,
+			HwType:        iana.HwTypeEthernet,
+			LinkLayerAddr: mac,
+		}
+		req, err := dhcpv6.NewSolicitWithCID(duid, modifiers...)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request:\n%s\n", req.Summary())
+		var resp dhcpv6.DHCPv6
+		resp, steps = server.Simulate6(req)
+		if resp != nil {
+			fmt.Printf("Response:\n%s\n", resp.Summary())
+		} else {
+			fmt.Println("Response: none, the request is dropped")
+		}
+	}
+	fmt.Println("Plugins:")
+	for _, step := range steps {
+		fmt.Printf("  %s\n", step)
+	}
+	return nil
+}
+
+// checkSplit prints the pools of the subnets of two servers sharing a split
+// scope, and returns an error if their split is inconsistent.
+func checkSplit(local, peer *config.Config) error {
+	failed := false
+	for _, pair := range []struct {
+		name        string
+		local, peer *config.ServerConfig
+	}{
+		{"DHCPv6", local.Server6, peer.Server6},
+		{"DHCPv4", local.Server4, peer.Server4},
+	} {
+		if pair.local == nil || pair.peer == nil || pair.local.Options == nil || pair.peer.Options == nil {
+			continue
+		}
+		fmt.Printf("%s split scope:\n", pair.name)
+		for _, n := range pair.local.Options.Networks {
+			for _, s := range n.Subnets {
+				if s.Split != nil {
+					fmt.Printf("  %s: range %s, %s, serving %s\n", s.Prefix, s.Range, s.Split, s.Pool())
+				}
+			}
+		}
+		for _, problem := range config.CheckSplit(pair.local.Options, pair.peer.Options) {
+			fmt.Printf("  error: %v\n", problem)
+			failed = true
+		}
+	}
+	if failed {
+		return errors.New("inconsistent split scope")
+	}
+	return nil
+}
+
+// withVendorClass6 adds a vendor class option with a zero enterprise number and
+// a single vendor class data item.
+func withVendorClass6(vendorClass string) dhcpv6.Modifier {
+	return func(d dhcpv6.DHCPv6) dhcpv6.DHCPv6 {
+		data := make([]byte, 6, 6+len(vendorClass))
+		binary.BigEndian.PutUint16(data[4:], uint16(len(vendorClass)))
+		data = append(data, vendorClass...)
+		d.AddOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionVendorClass, OptionData: data})
+		return d
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// openLeaseStore opens the lease store of the configured backend, buffered by
+// a journal if configured. It returns nil for the in-memory store, which is the
+// default.
+func openLeaseStore(lc *config.LeasesConfig) (leases.Store, error) {
+	if lc == nil {
+		return nil, nil
+	}
+	policy, err := leases.ParseSyncPolicy(lc.Sync)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Backend == "file" {
+		return leases.OpenFileStore(lc.Directory, policy, lc.SyncInterval)
+	}
+	store, err := openBackend(lc)
+	if err != nil || store == nil || lc.Journal == "" {
+		return store, err
+	}
+	return leases.NewBufferedStore(store, leases.BufferedOptions{
+		Journal:       lc.Journal,
+		Sync:          policy,
+		SyncInterval:  lc.SyncInterval,
+		BatchSize:     lc.BatchSize,
+		FlushInterval: lc.FlushInterval,
+		MaxPending:    lc.MaxPending,
+	})
+}
+
+// backends maps the names of the database backends compiled in to their
+// openers, see the `with_<backend>` build tags.
+var backends = make(map[string]func(lc *config.LeasesConfig) (leases.Store, error))
+
+// openBackend opens the lease store of the configured backend.
+func openBackend(lc *config.LeasesConfig) (leases.Store, error) {
+	if lc.Backend == "memory" {
+		return nil, nil
+	}
+	open, ok := backends[lc.Backend]
+	if !ok {
+		return nil, fmt.Errorf("the %s lease store is not compiled in, build with the `with_%s` tag", lc.Backend, lc.Backend)
+	}
+	return open(lc)
+}
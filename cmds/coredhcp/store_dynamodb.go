@@ -0,0 +1,21 @@
+//go:build !minimal || with_dynamodb
+// +build !minimal with_dynamodb
+
+package main
+
+import (
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/leases/dynamodb"
+)
+
+func init() {
+	backends["dynamodb"] = func(lc *config.LeasesConfig) (leases.Store, error) {
+		return dynamodb.Open(dynamodb.Options{
+			Table:     lc.DynamoDB.Table,
+			Region:    lc.DynamoDB.Region,
+			Endpoint:  lc.DynamoDB.Endpoint,
+			Retention: lc.Retention,
+		})
+	}
+}
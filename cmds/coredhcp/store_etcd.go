@@ -0,0 +1,22 @@
+//go:build !minimal || with_etcd
+// +build !minimal with_etcd
+
+package main
+
+import (
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/leases/etcd"
+)
+
+func init() {
+	backends["etcd"] = func(lc *config.LeasesConfig) (leases.Store, error) {
+		return etcd.Open(etcd.Options{
+			Endpoints: lc.Etcd.Endpoints,
+			Prefix:    lc.Etcd.Prefix,
+			Username:  lc.Etcd.Username,
+			Password:  lc.Etcd.Password,
+			Retention: lc.Retention,
+		})
+	}
+}
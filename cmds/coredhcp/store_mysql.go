@@ -0,0 +1,20 @@
+//go:build !minimal || with_mysql
+// +build !minimal with_mysql
+
+package main
+
+import (
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/leases/mysql"
+)
+
+func init() {
+	backends["mysql"] = func(lc *config.LeasesConfig) (leases.Store, error) {
+		return mysql.Open(lc.MySQL.DSN, mysql.Options{
+			MaxOpenConns:    lc.MySQL.MaxOpenConns,
+			MaxIdleConns:    lc.MySQL.MaxIdleConns,
+			ConnMaxLifetime: lc.MySQL.ConnMaxLifetime,
+		})
+	}
+}
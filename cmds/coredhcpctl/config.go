@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// configCommand prints a configuration in canonical YAML: the one of the
+// server, or of a local file with `-conf`, e.g. to normalize it before review.
+// With `-effective`, the defaults are filled in.
+func configCommand(c *http.Client, args []string) error {
+	if len(args) == 0 || args[0] != "show" {
+		return errors.New("config: need the show command")
+	}
+	fs := flag.NewFlagSet("config show", flag.ExitOnError)
+	var (
+		effective = fs.Bool("effective", false, "Fill in the defaults of the settings that are not set")
+		conf      = fs.String("conf", "", "Show this configuration file instead of the one of the server")
+		format    = fs.String("format", "", "Format of the configuration file. If empty, detect it from the file extension")
+	)
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	var data []byte
+	if *conf != "" {
+		cfg, err := config.LoadFile(*conf, *format)
+		if err != nil {
+			return err
+		}
+		if data, err = cfg.Marshal(*effective); err != nil {
+			return err
+		}
+	} else {
+		resp, err := c.Get(fmt.Sprintf("%s/config?effective=%t", *flagServer, *effective))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkResponse(resp); err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(resp.Body); err != nil {
+			return err
+		}
+	}
+	_, err := os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,196 @@
+package main
+
+/*
+ * Command-line client of the management API of a running server.
+ */
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+var (
+	flagServer  = flag.String("server", "http://localhost:8053", "URL of the management listener of the server")
+	flagTimeout = flag.Duration("timeout", time.Minute, "Timeout of the requests")
+	flagToken   = flag.String("token-file", "", "File of the bearer token, or the COREDHCP_TOKEN environment variable")
+	flagCA      = flag.String("ca", "", "File of the CA certificates of the server, instead of the system ones")
+	flagCert    = flag.String("cert", "", "File of the client certificate")
+	flagKey     = flag.String("key", "", "File of the key of the client certificate")
+)
+
+// tokenTransport adds the bearer token to the requests.
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t *tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(r)
+}
+
+// newClient returns the HTTP client of the management API, with the TLS
+// settings and the token of the flags.
+func newClient() (*http.Client, error) {
+	conf := &tls.Config{}
+	if *flagCA != "" {
+		pem, err := ioutil.ReadFile(*flagCA)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate in %s", *flagCA)
+		}
+	}
+	if *flagCert != "" {
+		cert, err := tls.LoadX509KeyPair(*flagCert, *flagKey)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: conf, Proxy: http.ProxyFromEnvironment}
+	token := os.Getenv("COREDHCP_TOKEN")
+	if *flagToken != "" {
+		data, err := ioutil.ReadFile(*flagToken)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		transport = &tokenTransport{token: token, next: transport}
+	}
+	return &http.Client{Timeout: *flagTimeout, Transport: transport}, nil
+}
+
+// commands maps the name of a sub-command to its implementation.
+var commands = map[string]func(c *http.Client, args []string) error{
+	"backup":  backup,
+	"restore": restore,
+	"config":  configCommand,
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] backup|restore <file> | config show [-effective] [-conf <file>]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// checkResponse returns the error of a failed management API response.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Error != "" {
+		return fmt.Errorf("%s: %s", resp.Status, body.Error)
+	}
+	return errors.New(resp.Status)
+}
+
+// backup writes a snapshot of the lease store of the server to a file. The
+// file is replaced atomically, so that an interrupted backup does not destroy
+// the previous one.
+func backup(c *http.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("backup: need the name of the backup file")
+	}
+	resp, err := c.Get(*flagServer + "/leases/backup")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(args[0]), ".coredhcp-backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	var snap leases.Snapshot
+	if err := json.NewDecoder(io.TeeReader(resp.Body, tmp)).Decode(&snap); err != nil {
+		tmp.Close()
+		return fmt.Errorf("backup: malformed snapshot: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), args[0]); err != nil {
+		return err
+	}
+	log.Printf("Saved %d leases and %d hosts to %s", len(snap.Leases), len(snap.Hosts), args[0])
+	return nil
+}
+
+// restore replaces the content of the lease store of the server with a
+// backup file.
+func restore(c *http.Client, args []string) error {
+	if len(args) != 1 {
+		return errors.New("restore: need the name of the backup file")
+	}
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	var snap leases.Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("restore: malformed backup file: %v", err)
+	}
+	resp, err := c.Post(*flagServer+"/leases/restore", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	log.Printf("Restored %d leases and %d hosts from the backup of %s", len(snap.Leases), len(snap.Hosts), snap.Created.Format(time.RFC3339))
+	return nil
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	c, err := newClient()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd(c, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// AuthConfig holds the TLS and authentication settings of a management
+// listener. Without tokens and clients, all the requests are allowed.
+type AuthConfig struct {
+	// Cert and Key are the files of the certificate of the TLS listener,
+	// and ClientCA, if not empty, the file of the CA certificates that
+	// sign the client certificates, which are then required.
+	Cert     string
+	Key      string
+	ClientCA string
+	// Tokens are the principals authenticated by bearer token.
+	Tokens []*PrincipalConfig
+	// Clients are the principals authenticated by the common name of
+	// their client certificate.
+	Clients []*PrincipalConfig
+}
+
+// PrincipalConfig is a client of a management listener.
+type PrincipalConfig struct {
+	Name string
+	// Token is the bearer token of the principal, if authenticated by
+	// token.
+	Token string
+	// Role is `read-only` or `admin`.
+	Role string
+}
+
+// TLS returns whether the listener uses TLS.
+func (ac *AuthConfig) TLS() bool {
+	return ac != nil && ac.Cert != ""
+}
+
+// parseAuthConfig parses the TLS and authentication settings of the given
+// section, for example:
+//
+//	management:
+//	    tls:
+//	        cert: /etc/coredhcp/management.pem
+//	        key: /etc/coredhcp/management.key
+//	        client-ca: /etc/coredhcp/clients-ca.pem
+//	    tokens:
+//	        - name: grafana
+//	          token-file: /etc/coredhcp/grafana.token
+//	          role: read-only
+//	    clients:
+//	        - name: stork.example.com
+//	          role: admin
+//
+// It returns nil if there are no such settings.
+func (c *Config) parseAuthConfig(section string) (*AuthConfig, error) {
+	if c.v.Get(section+".tls") == nil && c.v.Get(section+".tokens") == nil && c.v.Get(section+".clients") == nil {
+		return nil, nil
+	}
+	ac := AuthConfig{
+		Cert:     c.v.GetString(section + ".tls.cert"),
+		Key:      c.v.GetString(section + ".tls.key"),
+		ClientCA: c.v.GetString(section + ".tls.client-ca"),
+	}
+	if c.v.Get(section+".tls") != nil && (ac.Cert == "" || ac.Key == "") {
+		return nil, ConfigErrorFromString("%s: TLS needs a `cert` and a `key`", section)
+	}
+	var err error
+	if ac.Tokens, err = parsePrincipals(section, "tokens", c.v.Get(section+".tokens")); err != nil {
+		return nil, err
+	}
+	if ac.Clients, err = parsePrincipals(section, "clients", c.v.Get(section+".clients")); err != nil {
+		return nil, err
+	}
+	if len(ac.Clients) > 0 && ac.ClientCA == "" {
+		return nil, ConfigErrorFromString("%s: client certificates need a `tls.client-ca`", section)
+	}
+	return &ac, nil
+}
+
+// parsePrincipals parses the `tokens` or `clients` list of a section.
+func parsePrincipals(section, key string, v interface{}) ([]*PrincipalConfig, error) {
+	if v == nil {
+		return nil, nil
+	}
+	var ret []*PrincipalConfig
+	for idx, item := range cast.ToSlice(v) {
+		m := cast.ToStringMapString(item)
+		p := PrincipalConfig{Name: m["name"], Role: m["role"]}
+		if p.Name == "" {
+			return nil, ConfigErrorFromString("%s: %s #%d has no `name`", section, key, idx)
+		}
+		switch p.Role {
+		case "read-only", "admin":
+		default:
+			return nil, ConfigErrorFromString("%s: %s %s: invalid role `%s`, must be read-only or admin", section, key, p.Name, p.Role)
+		}
+		if key == "tokens" {
+			p.Token = m["token"]
+			if file := m["token-file"]; file != "" {
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					return nil, ConfigErrorFromString("%s: token of %s: %v", section, p.Name, err)
+				}
+				p.Token = strings.TrimSpace(string(data))
+			}
+			if p.Token == "" {
+				return nil, ConfigErrorFromString("%s: %s has no `token` or `token-file`", section, p.Name)
+			}
+		}
+		ret = append(ret, &p)
+	}
+	return ret, nil
+}
@@ -1,10 +1,13 @@
 package config
 
 import (
-	"errors"
+	"bytes"
 	"net"
+	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/spf13/cast"
@@ -15,9 +18,39 @@ var log = logger.GetLogger()
 
 // Config holds the DHCPv6/v4 server configuration
 type Config struct {
-	v       *viper.Viper
-	Server6 *ServerConfig
-	Server4 *ServerConfig
+	v *viper.Viper
+	// references holds the values of the settings that refer to secrets,
+	// before they were resolved, by key.
+	references map[string]interface{}
+	// remote is the remote provider the configuration was loaded from, if
+	// any, and remoteSettings the settings read from it, which WatchRemote
+	// compares to the ones it polls.
+	remote         *remoteSource
+	remoteSettings map[string]interface{}
+	Server6        *ServerConfig
+	Server4        *ServerConfig
+	Logger         *LoggerConfig
+	// Tracing is nil if tracing is disabled.
+	Tracing *TracingConfig
+	// Management is nil if the management listener is disabled.
+	Management *ManagementConfig
+	// SNMP is nil if the SNMP subagent is disabled.
+	SNMP *SNMPConfig
+	// OMAPI is nil if the OMAPI listener is disabled.
+	OMAPI *OMAPIConfig
+	// Kea is nil if the Kea-compatible command API is disabled.
+	Kea *KeaConfig
+	// Leases is nil if the lease store is kept in memory, with the default
+	// maintenance policy, which keeps the lease history forever.
+	Leases *LeasesConfig
+	// Watchdog is nil if the detection of rogue servers is disabled.
+	Watchdog *WatchdogConfig
+	// Shedding is nil if the load shedding is disabled.
+	Shedding *SheddingConfig
+	// Quarantine is never nil once the configuration is parsed.
+	Quarantine *QuarantineConfig
+	// Features holds the feature flags, by name.
+	Features Features
 }
 
 // New returns a new initialized instance of a Config object
@@ -30,6 +63,38 @@ func New() *Config {
 type ServerConfig struct {
 	Listener *net.UDPAddr
 	Plugins  []*PluginConfig
+	Options  *OptionLevels
+	// Overload enables the DHCPv4 option overloading, which moves the
+	// options of the responses that exceed the maximum message size of the
+	// client to the file and sname fields.
+	Overload bool
+	// MTU is the MTU of the DHCPv4 interface, which limits the size of the
+	// responses, or 0 if it is unknown.
+	MTU int
+	// TrustedRelays and TrustedInterfaces, if either is not empty, restrict
+	// the relayed requests, i.e. with a giaddr for DHCPv4 or in a
+	// Relay-forward for DHCPv6, to the ones sent by a trusted relay or
+	// received from a host on the link of a trusted interface.
+	TrustedRelays     []*net.IPNet
+	TrustedInterfaces []string
+	// Limits holds the resource limits of the plugins, by name.
+	Limits map[string]*PluginLimits
+	// Deadline, if not zero, is the time budget of the plugin chain for a
+	// request: the chain is abandoned when it is exceeded, and the request
+	// is answered from the last response to the client not older than
+	// StaleTTL, if any, or else dropped.
+	Deadline time.Duration
+	StaleTTL time.Duration
+	// FeatureGates maps the names of plugins to the feature flags that
+	// enable them: the plugins are skipped for the other clients.
+	FeatureGates map[string]string
+	// DumpOptions is the name of the feature flag of the clients whose
+	// requests and responses are logged with their decoded options, or
+	// empty.
+	DumpOptions string
+	// Labels are the metadata of the server, attached to its metrics, logs
+	// and events, see LabelsOf.
+	Labels Labels
 }
 
 // PluginConfig holds the configuration of a plugin
@@ -38,12 +103,16 @@ type PluginConfig struct {
 	Args []string
 }
 
+// SupportedFormats lists the configuration file formats that can be loaded.
+var SupportedFormats = []string{"yml", "yaml", "json", "toml"}
+
 // Load reads a configuration file and returns a Config object, or an error if
-// any.
+// any. The file is named `config` and searched in the current directory,
+// `$HOME/.coredhcp/` and `/etc/coredhcp/`, and its format is detected from the
+// file extension.
 func Load() (*Config, error) {
 	log.Print("Loading configuration")
 	c := New()
-	c.v.SetConfigType("yml")
 	c.v.SetConfigName("config")
 	c.v.AddConfigPath(".")
 	c.v.AddConfigPath("$HOME/.coredhcp/")
@@ -51,29 +120,204 @@ func Load() (*Config, error) {
 	if err := c.v.ReadInConfig(); err != nil {
 		return nil, err
 	}
-	if err := c.parseV6Config(); err != nil {
+	if err := c.parse(); err != nil {
 		return nil, err
 	}
-	if err := c.parseV4Config(); err != nil {
+	return c, nil
+}
+
+// LoadFile reads the specified configuration file and returns a Config
+// object, or an error if any. If format is empty, it is detected from the file
+// extension, otherwise it must be one of SupportedFormats. Files ending in
+// TemplateExt are rendered as Go templates before being parsed, see
+// HostFacts for the available data.
+func LoadFile(filename, format string) (*Config, error) {
+	log.Printf("Loading configuration from %s", filename)
+	isTemplate := strings.HasSuffix(filename, TemplateExt)
+	if format == "" {
+		format = strings.TrimPrefix(filepath.Ext(strings.TrimSuffix(filename, TemplateExt)), ".")
+	}
+	format = strings.ToLower(format)
+	if !isSupportedFormat(format) {
+		return nil, ConfigErrorFromString("unsupported config format `%s`, must be one of %v", format, SupportedFormats)
+	}
+	c := New()
+	c.v.SetConfigType(format)
+	if isTemplate {
+		data, err := renderTemplate(filename)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.v.ReadConfig(bytes.NewReader(data)); err != nil {
+			return nil, err
+		}
+	} else {
+		c.v.SetConfigFile(filename)
+		if err := c.v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.parse(); err != nil {
 		return nil, err
 	}
-	if c.Server6 == nil && c.Server4 == nil {
-		return nil, ConfigErrorFromString("need at least one valid config for DHCPv6 or DHCPv4")
+	return c, nil
+}
+
+// SupportedRemoteProviders lists the key/value stores the configuration can be
+// loaded from.
+var SupportedRemoteProviders = []string{"etcd", "consul"}
+
+// LoadRemote reads the configuration stored at the given path on an etcd or
+// Consul server, and returns a Config object, or an error if any. If format is
+// empty, the configuration is expected to be in YAML.
+func LoadRemote(provider, endpoint, path, format string) (*Config, error) {
+	if !remoteSupported {
+		return nil, ConfigErrorFromString("remote configuration is not compiled in, build with the `with_remote` tag")
+	}
+	log.Printf("Loading configuration from %s %s at %s", provider, endpoint, path)
+	if format == "" {
+		format = "yml"
+	}
+	format = strings.ToLower(format)
+	if !isSupportedFormat(format) {
+		return nil, ConfigErrorFromString("unsupported config format `%s`, must be one of %v", format, SupportedFormats)
+	}
+	src := &remoteSource{provider: provider, endpoint: endpoint, path: path, format: format}
+	v, err := src.read()
+	if err != nil {
+		return nil, err
+	}
+	// the settings are copied before the secrets are resolved into them
+	c := &Config{v: v, remote: src, remoteSettings: v.AllSettings()}
+	if err := c.parse(); err != nil {
+		return nil, err
 	}
 	return c, nil
 }
 
-func parsePlugins(pluginList []interface{}) ([]*PluginConfig, error) {
+// remoteSource is the remote provider a configuration was loaded from.
+type remoteSource struct {
+	provider, endpoint, path, format string
+}
+
+// read reads the configuration from the remote provider into a new viper
+// instance.
+func (r *remoteSource) read() (*viper.Viper, error) {
+	v := viper.New()
+	if err := v.AddRemoteProvider(r.provider, r.endpoint, r.path); err != nil {
+		return nil, ConfigErrorFromError(err)
+	}
+	v.SetConfigType(r.format)
+	if err := v.ReadRemoteConfig(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WatchRemote polls the remote provider the configuration was loaded from
+// every `interval`, and calls `onChange` with a new Config object every time the
+// remote configuration changes. Each change is read and parsed into a new
+// Config object, so the running one is never modified. Invalid configurations
+// are logged and ignored. WatchRemote never returns, so it should be run in
+// its own goroutine, and only on Config objects returned by LoadRemote.
+func (c *Config) WatchRemote(interval time.Duration, onChange func(*Config)) {
+	if c.remote == nil {
+		log.Print("Not watching a configuration that was not loaded from a remote provider")
+		return
+	}
+	current := c.remoteSettings
+	for {
+		time.Sleep(interval)
+		v, err := c.remote.read()
+		if err != nil {
+			log.Printf("Failed to read remote configuration: %v", err)
+			continue
+		}
+		settings := v.AllSettings()
+		if reflect.DeepEqual(current, settings) {
+			continue
+		}
+		current = settings
+		log.Print("Remote configuration changed")
+		nc := &Config{v: v, remote: c.remote, remoteSettings: settings}
+		if err := nc.parse(); err != nil {
+			log.Printf("Ignoring invalid remote configuration: %v", err)
+			continue
+		}
+		onChange(nc)
+	}
+}
+
+func isSupportedFormat(format string) bool {
+	for _, f := range SupportedFormats {
+		if format == f {
+			return true
+		}
+	}
+	return false
+}
+
+// parse populates the Config object from the configuration read by viper.
+func (c *Config) parse() error {
+	if err := c.resolveSecrets(); err != nil {
+		return err
+	}
+	if err := c.parseLoggerConfig(); err != nil {
+		return err
+	}
+	if err := c.parseTracingConfig(); err != nil {
+		return err
+	}
+	if err := c.parseManagementConfig(); err != nil {
+		return err
+	}
+	if err := c.parseSNMPConfig(); err != nil {
+		return err
+	}
+	if err := c.parseOMAPIConfig(); err != nil {
+		return err
+	}
+	if err := c.parseKeaConfig(); err != nil {
+		return err
+	}
+	if err := c.parseLeasesConfig(); err != nil {
+		return err
+	}
+	if err := c.parseWatchdogConfig(); err != nil {
+		return err
+	}
+	if err := c.parseSheddingConfig(); err != nil {
+		return err
+	}
+	if err := c.parseQuarantineConfig(); err != nil {
+		return err
+	}
+	if err := c.parseFeatures(); err != nil {
+		return err
+	}
+	if err := c.parseV6Config(); err != nil {
+		return err
+	}
+	if err := c.parseV4Config(); err != nil {
+		return err
+	}
+	if c.Server6 == nil && c.Server4 == nil {
+		return ConfigErrorFromString("need at least one valid config for DHCPv6 or DHCPv4")
+	}
+	return nil
+}
+
+func parsePlugins(proto string, pluginList []interface{}) ([]*PluginConfig, error) {
 	plugins := make([]*PluginConfig, 0)
 	for idx, val := range pluginList {
 		conf := cast.ToStringMap(val)
 		if conf == nil {
-			return nil, ConfigErrorFromString("dhcpv6: plugin #%d is not a string map", idx)
+			return nil, ConfigErrorFromString("%s: plugin #%d is not a string map", proto, idx)
 		}
 		// make sure that only one item is specified, since it's a
 		// map name -> args
 		if len(conf) != 1 {
-			return nil, ConfigErrorFromString("dhcpv6: exactly one plugin per item can be specified")
+			return nil, ConfigErrorFromString("%s: exactly one plugin per item can be specified", proto)
 		}
 		var (
 			name string
@@ -90,27 +334,34 @@ func parsePlugins(pluginList []interface{}) ([]*PluginConfig, error) {
 	return plugins, nil
 }
 
-func (c *Config) parseV6Config() error {
-	if exists := c.v.Get("server6"); exists == nil {
-		// it is valid to have no DHCPv6 configuration defined, so no
-		// server and no error are returned
-		return nil
+// parseServerConfig parses the `server6` or `server4` section, depending on
+// whether v6 is true or not. It returns a nil ServerConfig if the section does
+// not exist.
+func (c *Config) parseServerConfig(v6 bool) (*ServerConfig, error) {
+	section, proto := "server4", "dhcpv4"
+	if v6 {
+		section, proto = "server6", "dhcpv6"
 	}
-	addr := c.v.GetString("server6.listen")
+	if exists := c.v.Get(section); exists == nil {
+		// it is valid to have no configuration defined for a protocol,
+		// so no server and no error are returned
+		return nil, nil
+	}
+	addr := c.v.GetString(section + ".listen")
 	if addr == "" {
-		return ConfigErrorFromString("dhcpv6: missing `server6.listen` directive")
+		return nil, ConfigErrorFromString("%s: missing `%s.listen` directive", proto, section)
 	}
 	ipStr, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return ConfigErrorFromString("dhcpv6: %v", err)
+		return nil, ConfigErrorFromString("%s: %v", proto, err)
 	}
 	ip := net.ParseIP(ipStr)
-	if ip.To4() != nil {
-		return ConfigErrorFromString("dhcpv6: missing or invalid `listen` address")
+	if ip == nil || (ip.To4() != nil) == v6 {
+		return nil, ConfigErrorFromString("%s: missing or invalid `listen` address", proto)
 	}
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		return ConfigErrorFromString("dhcpv6: invalid `listen` port")
+		return nil, ConfigErrorFromString("%s: invalid `listen` port", proto)
 	}
 	listener := net.UDPAddr{
 		IP:   ip,
@@ -120,26 +371,124 @@ func (c *Config) parseV6Config() error {
 		Listener: &listener,
 		Plugins:  nil,
 	}
+	if !v6 {
+		sc.Overload = c.v.GetBool(section + ".overload")
+		sc.MTU = c.v.GetInt(section + ".mtu")
+		if sc.MTU == 0 {
+			sc.MTU = interfaceMTU(ip)
+		} else if sc.MTU < minMTU4 {
+			return nil, ConfigErrorFromString("%s: invalid `mtu` %d, must be at least %d", proto, sc.MTU, minMTU4)
+		}
+	}
+	if sc.TrustedRelays, err = parsePrefixes(c.v.GetStringSlice(section + ".trusted-relays")); err != nil {
+		return nil, ConfigErrorFromString("%s: invalid `trusted-relays`: %v", proto, err)
+	}
+	sc.TrustedInterfaces = c.v.GetStringSlice(section + ".trusted-interfaces")
+	if sc.Labels, err = parseLabels(c.v.Get(section + ".labels")); err != nil {
+		return nil, err
+	}
+	sc.Deadline = c.v.GetDuration(section + ".deadline")
+	sc.StaleTTL = c.v.GetDuration(section + ".stale-ttl")
+	if sc.Deadline < 0 || sc.StaleTTL < 0 {
+		return nil, ConfigErrorFromString("%s: `deadline` and `stale-ttl` cannot be negative", proto)
+	}
 	// load plugins
-	pluginList := cast.ToSlice(c.v.Get("server6.plugins"))
+	pluginList := cast.ToSlice(c.v.Get(section + ".plugins"))
 	if pluginList == nil {
-		return ConfigErrorFromString("dhcpv6: invalid plugins section, not a list")
+		return nil, ConfigErrorFromString("%s: invalid plugins section, not a list", proto)
 	}
-	plugins, err := parsePlugins(pluginList)
+	plugins, err := parsePlugins(proto, pluginList)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	for _, p := range plugins {
-		log.Printf("DHCPv6: found plugin `%s` with %d args: %v", p.Name, len(p.Args), p.Args)
+		log.Printf("%s: found plugin `%s` with %d args: %v", proto, p.Name, len(p.Args), p.Args)
 	}
 	sc.Plugins = plugins
-	c.Server6 = &sc
+	if sc.Limits, err = c.parsePluginLimits(section, proto, plugins); err != nil {
+		return nil, err
+	}
+	if sc.FeatureGates, err = c.parseFeatureGates(section, proto, plugins); err != nil {
+		return nil, err
+	}
+	if sc.DumpOptions = c.v.GetString(section + ".dump-options"); sc.DumpOptions != "" {
+		if _, ok := c.Features[sc.DumpOptions]; !ok {
+			return nil, ConfigErrorFromString("%s: unknown feature flag `%s` of `dump-options`", proto, sc.DumpOptions)
+		}
+	}
+	if sc.Options, err = c.parseOptionLevels(section); err != nil {
+		return nil, err
+	}
+	if err := validateOverrides(proto, sc.Options, plugins); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+// parsePrefixes parses a list of prefixes, or of addresses, which are
+// prefixes of a single address.
+func parsePrefixes(list []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, s := range list {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 128
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+			ret = append(ret, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, prefix)
+	}
+	return ret, nil
+}
+
+// minMTU4 is the minimum MTU of a DHCPv4 interface, as the clients must be
+// able to receive 576-byte messages.
+const minMTU4 = 576
+
+// interfaceMTU returns the MTU of the interface that has the given address,
+// or 0 if there is none, e.g. for the unspecified address.
+func interfaceMTU(ip net.IP) int {
+	if ip.IsUnspecified() {
+		return 0
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.MTU
+			}
+		}
+	}
+	return 0
+}
+
+func (c *Config) parseV6Config() error {
+	sc, err := c.parseServerConfig(true)
+	if err != nil {
+		return err
+	}
+	c.Server6 = sc
 	return nil
 }
 
 func (c *Config) parseV4Config() error {
-	if exists := c.v.Get("server4"); exists != nil {
-		return errors.New("DHCPv4 config parser not implemented yet")
+	sc, err := c.parseServerConfig(false)
+	if err != nil {
+		return err
 	}
+	c.Server4 = sc
 	return nil
 }
@@ -0,0 +1,412 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// Change is a difference between two configurations.
+type Change struct {
+	// Kind is the kind of the change, e.g. `plugin-added` or `pool-changed`,
+	// see Diff.
+	Kind string `json:"kind"`
+	// Key is the dotted path of what changed, e.g. `server4.plugins.dns` or
+	// `server4.pools.10.0.0.0/24.range`.
+	Key string      `json:"key"`
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old == nil:
+		return fmt.Sprintf("%s %s: %v", c.Kind, c.Key, c.New)
+	case c.New == nil:
+		return fmt.Sprintf("%s %s: %v", c.Kind, c.Key, c.Old)
+	}
+	return fmt.Sprintf("%s %s: %v -> %v", c.Kind, c.Key, c.Old, c.New)
+}
+
+// redacted replaces the values of the sensitive settings in the changes.
+const redacted = "<redacted>"
+
+// sensitiveWords are the words of the keys of the sensitive settings, e.g.
+// `management.auth.password` or `omapi.key-secret`.
+var sensitiveWords = []string{"secret", "password", "token", "dsn"}
+
+// Diff returns the changes from a configuration to another one, in a
+// stable order. For each server, it reports:
+//   - the plugins added, removed, reordered, or whose arguments changed, with
+//     the `plugin-added`, `plugin-removed`, `plugins-reordered` and
+//     `plugin-changed` kinds, with the values of the sensitive arguments,
+//     e.g. `key=` or `password=`, redacted,
+//   - the pools added, removed, or whose range, split, relays or network
+//     changed, by subnet prefix, with the `pool-added`, `pool-removed` and
+//     `pool-changed` kinds,
+//   - the options added, removed or changed at every level, with the
+//     `option-added`, `option-removed` and `option-changed` kinds.
+//
+// The other settings are reported with the `setting-added`,
+// `setting-removed` and `setting-changed` kinds, with the values of the
+// sensitive ones redacted. Either configuration can be nil.
+func Diff(from, to *Config) []Change {
+	var changes []Change
+	fs, ts := diffSettings(from), diffSettings(to)
+	for _, section := range []string{"server6", "server4"} {
+		changes = append(changes, diffPlugins(section, lookupSetting(fs, section+".plugins"), lookupSetting(ts, section+".plugins"))...)
+		fl, tl := serverLevels(from, section), serverLevels(to, section)
+		changes = append(changes, diffPools(section, fl, tl)...)
+		changes = append(changes, diffLevels(section, fl, tl)...)
+	}
+	// the option levels and the plugins are reported above
+	for _, settings := range []map[string]interface{}{fs, ts} {
+		delete(settings, "options")
+		for _, section := range []string{"server6", "server4"} {
+			if m, ok := settings[section].(map[string]interface{}); ok {
+				for _, key := range []string{"plugins", "options", "networks", "classes", "hosts"} {
+					delete(m, key)
+				}
+			}
+		}
+	}
+	of, nf := make(map[string]interface{}), make(map[string]interface{})
+	flattenSettings("", fs, of)
+	flattenSettings("", ts, nf)
+	for _, key := range unionKeys(of, nf) {
+		ov, oldOK := of[key]
+		nv, newOK := nf[key]
+		if oldOK && newOK && reflect.DeepEqual(ov, nv) {
+			continue
+		}
+		if sensitive(key) {
+			if oldOK {
+				ov = redacted
+			}
+			if newOK {
+				nv = redacted
+			}
+		}
+		switch {
+		case !oldOK:
+			changes = append(changes, Change{Kind: "setting-added", Key: key, New: nv})
+		case !newOK:
+			changes = append(changes, Change{Kind: "setting-removed", Key: key, Old: ov})
+		default:
+			changes = append(changes, Change{Kind: "setting-changed", Key: key, Old: ov, New: nv})
+		}
+	}
+	return changes
+}
+
+// diffSettings returns the settings of a configuration, which can be nil.
+func diffSettings(c *Config) map[string]interface{} {
+	if c == nil {
+		return make(map[string]interface{})
+	}
+	return c.Settings(false)
+}
+
+// serverLevels returns the option definitions of a server of a configuration,
+// which can be nil, or empty ones.
+func serverLevels(c *Config, section string) *OptionLevels {
+	var sc *ServerConfig
+	if c != nil {
+		if section == "server6" {
+			sc = c.Server6
+		} else {
+			sc = c.Server4
+		}
+	}
+	if sc == nil || sc.Options == nil {
+		return &OptionLevels{}
+	}
+	return sc.Options
+}
+
+// flattenSettings adds the settings to flat, by dotted key. The lists are
+// kept whole.
+func flattenSettings(prefix string, settings map[string]interface{}, flat map[string]interface{}) {
+	for k, v := range settings {
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			flattenSettings(prefix+k+".", m, flat)
+			continue
+		}
+		flat[prefix+k] = v
+	}
+}
+
+func sensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range sensitiveWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// unionKeys returns the keys of two maps, sorted.
+func unionKeys(a, b map[string]interface{}) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redactArgs returns the arguments of a plugin with the values of the
+// sensitive ones redacted, e.g. `key=<redacted>` for `key=1,0a1b...` or
+// `password=<redacted>` for `password=hunter2`.
+func redactArgs(args string) string {
+	fields := strings.Fields(args)
+	for i, f := range fields {
+		k := strings.SplitN(f, "=", 2)[0]
+		if len(k) < len(f) && (strings.EqualFold(k, "key") || sensitive(k)) {
+			fields[i] = k + "=" + redacted
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+type pluginEntry struct {
+	name, args string
+}
+
+// pluginEntries returns the plugins of a canonical plugin list, see
+// canonicalPlugins. The repeated plugins are numbered, e.g. `file#2`.
+func pluginEntries(list interface{}) []pluginEntry {
+	var (
+		ret  []pluginEntry
+		seen = make(map[string]int)
+	)
+	for _, item := range cast.ToSlice(list) {
+		for name, args := range cast.ToStringMap(item) {
+			seen[name]++
+			if seen[name] > 1 {
+				name = fmt.Sprintf("%s#%d", name, seen[name])
+			}
+			ret = append(ret, pluginEntry{name: name, args: cast.ToString(args)})
+		}
+	}
+	return ret
+}
+
+// diffPlugins returns the changes between two canonical plugin lists of a
+// server.
+func diffPlugins(section string, from, to interface{}) []Change {
+	var changes []Change
+	oe, ne := pluginEntries(from), pluginEntries(to)
+	oargs, nargs := make(map[string]string), make(map[string]string)
+	for _, p := range oe {
+		oargs[p.name] = p.args
+	}
+	for _, p := range ne {
+		nargs[p.name] = p.args
+	}
+	// the relative order of the plugins in both chains
+	var oorder, norder []string
+	for _, p := range oe {
+		args, ok := nargs[p.name]
+		if !ok {
+			changes = append(changes, Change{Kind: "plugin-removed", Key: section + ".plugins." + p.name, Old: redactArgs(p.args)})
+			continue
+		}
+		oorder = append(oorder, p.name)
+		if args != p.args {
+			changes = append(changes, Change{Kind: "plugin-changed", Key: section + ".plugins." + p.name, Old: redactArgs(p.args), New: redactArgs(args)})
+		}
+	}
+	for _, p := range ne {
+		if _, ok := oargs[p.name]; !ok {
+			changes = append(changes, Change{Kind: "plugin-added", Key: section + ".plugins." + p.name, New: redactArgs(p.args)})
+			continue
+		}
+		norder = append(norder, p.name)
+	}
+	if !reflect.DeepEqual(oorder, norder) {
+		changes = append(changes, Change{Kind: "plugins-reordered", Key: section + ".plugins", Old: strings.Join(oorder, ","), New: strings.Join(norder, ",")})
+	}
+	return changes
+}
+
+type pool struct {
+	network string
+	subnet  *SubnetConfig
+}
+
+// pools returns the subnets of the option levels, by prefix.
+func pools(l *OptionLevels) map[string]pool {
+	ret := make(map[string]pool)
+	for _, network := range l.Networks {
+		for _, subnet := range network.Subnets {
+			ret[subnet.Prefix.String()] = pool{network: network.Name, subnet: subnet}
+		}
+	}
+	return ret
+}
+
+// attributes returns the attributes of a pool that are compared, printed.
+func (p pool) attributes() map[string]string {
+	attrs := map[string]string{"network": p.network}
+	if p.subnet.Name != "" {
+		attrs["name"] = p.subnet.Name
+	}
+	if p.subnet.Range != nil {
+		attrs["range"] = p.subnet.Range.String()
+	}
+	if p.subnet.Split != nil {
+		attrs["split"] = p.subnet.Split.String()
+	}
+	if len(p.subnet.Relays) > 0 {
+		attrs["relays"] = joinPrefixes(p.subnet.Relays)
+	}
+	return attrs
+}
+
+func joinPrefixes(prefixes []*net.IPNet) string {
+	s := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// diffPools returns the pools added, removed and changed between two option
+// levels of a server, and the changes of their options.
+func diffPools(section string, from, to *OptionLevels) []Change {
+	var changes []Change
+	op, np := pools(from), pools(to)
+	prefixes := make([]string, 0, len(op)+len(np))
+	for prefix := range op {
+		prefixes = append(prefixes, prefix)
+	}
+	for prefix := range np {
+		if _, ok := op[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		key := section + ".pools." + prefix
+		o, oldOK := op[prefix]
+		n, newOK := np[prefix]
+		switch {
+		case !oldOK:
+			changes = append(changes, Change{Kind: "pool-added", Key: key, New: n.attributes()})
+		case !newOK:
+			changes = append(changes, Change{Kind: "pool-removed", Key: key, Old: o.attributes()})
+		default:
+			oa, na := o.attributes(), n.attributes()
+			for _, attr := range []string{"network", "range", "split", "relays"} {
+				if oa[attr] != na[attr] {
+					changes = append(changes, Change{Kind: "pool-changed", Key: key + "." + attr, Old: emptyNil(oa[attr]), New: emptyNil(na[attr])})
+				}
+			}
+		}
+		var oo, no Options
+		if oldOK {
+			oo = o.subnet.Options
+		}
+		if newOK {
+			no = n.subnet.Options
+		}
+		changes = append(changes, diffOptions(key+".options", oo, no)...)
+	}
+	return changes
+}
+
+// emptyNil returns nil for an empty attribute, so that it is left out of the
+// change.
+func emptyNil(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// diffLevels returns the options changed between two option levels of a
+// server, except the ones of the subnets, see diffPools.
+func diffLevels(section string, from, to *OptionLevels) []Change {
+	changes := diffOptions(section+".options", from.Global, to.Global)
+	networks := make(map[string][2]Options)
+	for _, network := range from.Networks {
+		networks[network.Name] = [2]Options{network.Options, nil}
+	}
+	for _, network := range to.Networks {
+		networks[network.Name] = [2]Options{networks[network.Name][0], network.Options}
+	}
+	changes = append(changes, diffOptionMaps(section+".networks", ".options", networks)...)
+	classes := make(map[string][2]Options)
+	for name, opts := range from.Classes {
+		classes[name] = [2]Options{opts, nil}
+	}
+	for name, opts := range to.Classes {
+		classes[name] = [2]Options{classes[name][0], opts}
+	}
+	changes = append(changes, diffOptionMaps(section+".classes", "", classes)...)
+	hosts := make(map[string][2]Options)
+	for mac, opts := range from.Hosts {
+		hosts[mac] = [2]Options{opts, nil}
+	}
+	for mac, opts := range to.Hosts {
+		hosts[mac] = [2]Options{hosts[mac][0], opts}
+	}
+	return append(changes, diffOptionMaps(section+".hosts", "", hosts)...)
+}
+
+// diffOptionMaps returns the changes of the old and new options of the
+// networks, classes or hosts, by name. The suffix is appended to the key of
+// each name.
+func diffOptionMaps(prefix, suffix string, pairs map[string][2]Options) []Change {
+	names := make([]string, 0, len(pairs))
+	for name := range pairs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var changes []Change
+	for _, name := range names {
+		changes = append(changes, diffOptions(prefix+"."+name+suffix, pairs[name][0], pairs[name][1])...)
+	}
+	return changes
+}
+
+// diffOptions returns the options added, removed and changed between two
+// option sets, either of which can be nil.
+func diffOptions(prefix string, from, to Options) []Change {
+	names := make([]string, 0, len(from)+len(to))
+	for name := range from {
+		names = append(names, name)
+	}
+	for name := range to {
+		if _, ok := from[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var changes []Change
+	for _, name := range names {
+		ov, oldOK := from[name]
+		nv, newOK := to[name]
+		key := prefix + "." + name
+		switch {
+		case !oldOK:
+			changes = append(changes, Change{Kind: "option-added", Key: key, New: strings.Join(nv, ",")})
+		case !newOK:
+			changes = append(changes, Change{Kind: "option-removed", Key: key, Old: strings.Join(ov, ",")})
+		case !reflect.DeepEqual(ov, nv):
+			changes = append(changes, Change{Kind: "option-changed", Key: key, Old: strings.Join(ov, ","), New: strings.Join(nv, ",")})
+		}
+	}
+	return changes
+}
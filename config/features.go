@@ -0,0 +1,132 @@
+package config
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// FeatureFlag is a flag that enables a new behavior for a part of the clients
+// only, to roll it out in stages: the clients of the hosts and classes of the
+// flag, and a stable share of the other clients.
+type FeatureFlag struct {
+	Name string
+	// Percent is the share of the clients the flag is enabled for, from 0 to
+	// 100, chosen by a hash of the flag name and of the client identifier.
+	Percent float64
+	Classes []string
+	// Hosts are the hardware addresses of DHCPv4 clients and the DUIDs of
+	// DHCPv6 clients, in hex, the flag is enabled for.
+	Hosts []string
+}
+
+// Features maps the names of the feature flags to their definitions.
+type Features map[string]*FeatureFlag
+
+// Enabled returns whether a flag is enabled for a client, identified by its
+// hardware address for DHCPv4 or its DUID in hex for DHCPv6, in some classes.
+func (f *FeatureFlag) Enabled(client string, classes []string) bool {
+	for _, h := range f.Hosts {
+		if h == client {
+			return true
+		}
+	}
+	for _, want := range f.Classes {
+		for _, class := range classes {
+			if want == class {
+				return true
+			}
+		}
+	}
+	if f.Percent >= 100 {
+		return true
+	}
+	if f.Percent <= 0 || client == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(f.Name + "/" + client))
+	return float64(h.Sum32()%10000) < f.Percent*100
+}
+
+// normalizeHost returns a host of a feature flag in the form of the client
+// identifiers, or an empty string if it is neither a hardware address nor a
+// DUID.
+func normalizeHost(host string) string {
+	if mac, err := net.ParseMAC(host); err == nil {
+		return mac.String()
+	}
+	duid := strings.ToLower(strings.Replace(host, ":", "", -1))
+	if _, err := hex.DecodeString(duid); err != nil || duid == "" {
+		return ""
+	}
+	return duid
+}
+
+// parseFeatures parses the optional `features` section, for example:
+//
+//	features:
+//	    strict-options:
+//	        percent: 10
+//	        classes: [lab]
+//	        hosts: ['00:11:22:33:44:55', '00:01:00:01:2a:3b:4c:5d:00:11:22:33:44:55']
+//
+// A hardware address of 6 bytes, as above, is taken as a hardware address
+// rather than as a DUID.
+func (c *Config) parseFeatures() error {
+	section := cast.ToStringMap(c.v.Get("features"))
+	if len(section) == 0 {
+		return nil
+	}
+	c.Features = make(Features, len(section))
+	for name := range section {
+		key := "features." + name
+		f := FeatureFlag{
+			Name:    name,
+			Percent: c.v.GetFloat64(key + ".percent"),
+			Classes: c.v.GetStringSlice(key + ".classes"),
+		}
+		if f.Percent < 0 || f.Percent > 100 {
+			return ConfigErrorFromString("features: invalid percent %v of `%s`, must be between 0 and 100", f.Percent, name)
+		}
+		for _, host := range c.v.GetStringSlice(key + ".hosts") {
+			h := normalizeHost(host)
+			if h == "" {
+				return ConfigErrorFromString("features: invalid host `%s` of `%s`, must be a hardware address or a DUID", host, name)
+			}
+			f.Hosts = append(f.Hosts, h)
+		}
+		c.Features[name] = &f
+	}
+	return nil
+}
+
+// parseFeatureGates parses the optional `feature-gates` section of a server,
+// which maps the names of its plugins to the feature flags that enable them,
+// for example:
+//
+//	server4:
+//	    feature-gates:
+//	        prl: strict-options
+func (c *Config) parseFeatureGates(section, proto string, plugins []*PluginConfig) (map[string]string, error) {
+	gates := c.v.GetStringMapString(section + ".feature-gates")
+	if len(gates) == 0 {
+		return nil, nil
+	}
+	for name, flag := range gates {
+		found := false
+		for _, p := range plugins {
+			found = found || p.Name == name
+		}
+		if !found {
+			return nil, ConfigErrorFromString("%s: feature gate of `%s`, which is not in the plugins", proto, name)
+		}
+		if _, ok := c.Features[flag]; !ok {
+			return nil, ConfigErrorFromString("%s: unknown feature flag `%s` of `%s`", proto, flag, name)
+		}
+	}
+	return gates, nil
+}
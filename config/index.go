@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net"
+	"sort"
+)
+
+// indexEntry is a subnet of the index, with its shared network.
+type indexEntry struct {
+	network *NetworkConfig
+	subnet  *SubnetConfig
+}
+
+// prefixIndex maps prefixes to subnets, for the longest prefix match of an
+// address: it holds the prefixes by length, and a lookup masks the address
+// with each length, from the longest, so that it costs one map access per
+// distinct length rather than a scan of all the prefixes.
+type prefixIndex struct {
+	lengths  []int
+	prefixes map[string]indexEntry
+}
+
+func indexKey(ip net.IP, ones, bits int) string {
+	return string(ip.Mask(net.CIDRMask(ones, bits)))
+}
+
+// add adds a prefix, unless it is already in the index: the first subnet
+// declared with a prefix keeps it.
+func (idx *prefixIndex) add(prefix *net.IPNet, e indexEntry) {
+	ones, bits := prefix.Mask.Size()
+	ip := prefix.IP.To4()
+	if ip == nil || bits != 8*net.IPv4len {
+		ip, ones = prefix.IP.To16(), ones+(8*net.IPv6len-bits)
+		bits = 8 * net.IPv6len
+	}
+	key := indexKey(ip, ones, bits)
+	if _, ok := idx.prefixes[key]; ok {
+		return
+	}
+	idx.prefixes[key] = e
+	for _, l := range idx.lengths {
+		if l == ones {
+			return
+		}
+	}
+	idx.lengths = append(idx.lengths, ones)
+	sort.Sort(sort.Reverse(sort.IntSlice(idx.lengths)))
+}
+
+func (idx *prefixIndex) lookup(ip net.IP) (indexEntry, bool) {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	} else {
+		ip = ip.To16()
+	}
+	for _, ones := range idx.lengths {
+		if ones > bits {
+			continue
+		}
+		if e, ok := idx.prefixes[indexKey(ip, ones, bits)]; ok {
+			return e, true
+		}
+	}
+	return indexEntry{}, false
+}
+
+// subnetIndex indexes the subnets of the option levels by prefix, by relay
+// prefix and by name.
+type subnetIndex struct {
+	prefixes prefixIndex
+	relays   prefixIndex
+	names    map[string]indexEntry
+}
+
+func newSubnetIndex(networks []*NetworkConfig) *subnetIndex {
+	idx := subnetIndex{
+		prefixes: prefixIndex{prefixes: make(map[string]indexEntry)},
+		relays:   prefixIndex{prefixes: make(map[string]indexEntry)},
+		names:    make(map[string]indexEntry),
+	}
+	for _, n := range networks {
+		for _, s := range n.Subnets {
+			e := indexEntry{network: n, subnet: s}
+			idx.prefixes.add(s.Prefix, e)
+			for _, relay := range s.Relays {
+				idx.relays.add(relay, e)
+			}
+			if s.Name != "" {
+				idx.names[s.Name] = e
+			}
+		}
+	}
+	return &idx
+}
@@ -0,0 +1,41 @@
+package config
+
+// KeaConfig holds the configuration of the Kea-compatible command API. At
+// least one of the two transports must be enabled.
+type KeaConfig struct {
+	// Listen is the TCP address of the HTTP listener, compatible with the
+	// Kea Control Agent, e.g. `localhost:8000`.
+	Listen string
+	// Socket is the path of the UNIX command socket, compatible with the
+	// Kea servers.
+	Socket string
+	// Auth is nil if the HTTP listener uses neither TLS nor
+	// authentication. The UNIX socket is protected by its permissions.
+	Auth *AuthConfig
+}
+
+// parseKeaConfig parses the optional `kea` section, for example:
+//
+//	kea:
+//	    listen: 'localhost:8000'
+//	    socket: /run/coredhcp/kea.sock
+//
+// and the TLS and authentication settings of parseAuthConfig.
+func (c *Config) parseKeaConfig() error {
+	if c.v.Get("kea") == nil {
+		return nil
+	}
+	kc := KeaConfig{
+		Listen: c.v.GetString("kea.listen"),
+		Socket: c.v.GetString("kea.socket"),
+	}
+	if kc.Listen == "" && kc.Socket == "" {
+		return ConfigErrorFromString("kea: need a `kea.listen` or `kea.socket` directive")
+	}
+	var err error
+	if kc.Auth, err = c.parseAuthConfig("kea"); err != nil {
+		return err
+	}
+	c.Kea = &kc
+	return nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"net"
+	"regexp"
+	"sort"
+
+	"github.com/spf13/cast"
+)
+
+// Labels are arbitrary key/value metadata of a server, a shared network or a
+// subnet, e.g. the site, the rack or the zone, which are attached to the
+// metrics, the logs and the events.
+type Labels map[string]string
+
+// labelName is the syntax of the label keys, the one of the Prometheus label
+// names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Inherit returns new Labels with all the labels of the parent, overridden by
+// the ones defined in l.
+func (l Labels) Inherit(parent Labels) Labels {
+	ret := make(Labels, len(parent)+len(l))
+	for k, v := range parent {
+		ret[k] = v
+	}
+	for k, v := range l {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Pairs returns the labels as alternating keys and values, sorted by key, as
+// taken by the stats package.
+func (l Labels) Pairs() []string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		ret = append(ret, k, l[k])
+	}
+	return ret
+}
+
+// With returns alternating keys and values, the given ones followed by the
+// labels whose keys they do not have, e.g. to add the labels of a pool to the
+// labels of a metric.
+func (l Labels) With(pairs ...string) []string {
+	own := make(map[string]bool, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		own[pairs[i]] = true
+	}
+	ret := append([]string(nil), pairs...)
+	labels := l.Pairs()
+	for i := 0; i+1 < len(labels); i += 2 {
+		if !own[labels[i]] {
+			ret = append(ret, labels[i], labels[i+1])
+		}
+	}
+	return ret
+}
+
+// parseLabels parses a map of label keys to values.
+func parseLabels(val interface{}) (Labels, error) {
+	if val == nil {
+		return Labels{}, nil
+	}
+	m, err := cast.ToStringMapStringE(val)
+	if err != nil {
+		return nil, ConfigErrorFromString("labels: not a string map: %v", err)
+	}
+	labels := make(Labels, len(m))
+	for k, v := range m {
+		if !labelName.MatchString(k) {
+			return nil, ConfigErrorFromString("labels: invalid key `%s`, must be letters, digits and underscores", k)
+		}
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// LabelsOf returns the labels of the server, overridden by the ones of the
+// shared network and of the subnet of an address, if any.
+func (sc *ServerConfig) LabelsOf(ip net.IP) Labels {
+	labels := Labels{}.Inherit(sc.Labels)
+	if sc.Options == nil {
+		return labels
+	}
+	if n, s := sc.Options.Subnet(ip); s != nil {
+		labels = s.Labels.Inherit(n.Labels.Inherit(labels))
+	}
+	return labels
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// LeasesConfig holds the configuration of the lease store.
+type LeasesConfig struct {
+	// Retention is how long the expired and released leases are kept, as
+	// the lease history, before they are deleted. 0 keeps them forever.
+	Retention time.Duration
+	// CompactInterval is the interval between the maintenance runs, which
+	// delete the leases past their retention and compact the stores that
+	// support it.
+	CompactInterval time.Duration
+	// ExpiryJitter is the maximum random delay of the expiry hooks of each
+	// lease, and ExpiryCatchUp how far back the leases that expired before
+	// the start of the server are fired.
+	ExpiryJitter  time.Duration
+	ExpiryCatchUp time.Duration
+	// Backend is the name of the store backend: `memory`, the default,
+	// `file`, `mysql`, `dynamodb` or `etcd`.
+	Backend string
+	// Directory is the directory of the `file` backend.
+	Directory string
+	// MySQL is the configuration of the `mysql` backend.
+	MySQL *MySQLConfig
+	// DynamoDB is the configuration of the `dynamodb` backend.
+	DynamoDB *DynamoDBConfig
+	// Etcd is the configuration of the `etcd` backend.
+	Etcd *EtcdConfig
+	// Journal, if not empty, is the path of the local journal of a
+	// buffered store: the changes are written to the journal, and to the
+	// backend in batches of BatchSize changes or every FlushInterval.
+	Journal       string
+	BatchSize     int
+	FlushInterval time.Duration
+	// MaxPending is the number of changes waiting for the backend beyond
+	// which the changes fail, 0 for no limit.
+	MaxPending int
+	// Sync is the sync policy of the journal, or of the log of the `file`
+	// backend: `always`, `interval` or `never`, and SyncInterval the
+	// interval of the `interval` policy.
+	Sync         string
+	SyncInterval time.Duration
+}
+
+// MySQLConfig holds the configuration of the MySQL/MariaDB lease store.
+type MySQLConfig struct {
+	// DSN is the data source name of the database, e.g.
+	// `coredhcp:secret@tcp(db.example.com:3306)/coredhcp`.
+	DSN string
+	// MaxOpenConns and MaxIdleConns limit the connections of the pool, and
+	// ConnMaxLifetime is how long a connection is reused, 0 for ever.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// parseLeasesConfig parses the optional `leases` section, for example:
+//
+//	leases:
+//	    retention: 720h
+//	    compact-interval: 1h
+//	    expiry-jitter: 30s
+//	    expiry-catch-up: 1h
+//	    journal: /var/lib/coredhcp/leases.journal
+//	    sync: interval
+//	    sync-interval: 1s
+//	    batch-size: 100
+//	    flush-interval: 1s
+//	    backend: mysql
+//	    mysql:
+//	        dsn: 'coredhcp:secret@tcp(db.example.com:3306)/coredhcp'
+//	        max-open-conns: 10
+//	        max-idle-conns: 2
+//	        conn-max-lifetime: 1h
+func (c *Config) parseLeasesConfig() error {
+	if c.v.Get("leases") == nil {
+		return nil
+	}
+	lc := LeasesConfig{
+		Retention:       c.v.GetDuration("leases.retention"),
+		CompactInterval: time.Hour,
+		ExpiryJitter:    c.v.GetDuration("leases.expiry-jitter"),
+		ExpiryCatchUp:   time.Hour,
+	}
+	if c.v.IsSet("leases.compact-interval") {
+		lc.CompactInterval = c.v.GetDuration("leases.compact-interval")
+	}
+	if c.v.IsSet("leases.expiry-catch-up") {
+		lc.ExpiryCatchUp = c.v.GetDuration("leases.expiry-catch-up")
+	}
+	if lc.ExpiryJitter < 0 || lc.ExpiryCatchUp < 0 {
+		return ConfigErrorFromString("leases: expiry jitter and catch-up cannot be negative")
+	}
+	if lc.Retention < 0 {
+		return ConfigErrorFromString("leases: retention cannot be negative")
+	}
+	if lc.CompactInterval <= 0 {
+		return ConfigErrorFromString("leases: compact interval must be positive")
+	}
+	if err := c.parseJournalConfig(&lc); err != nil {
+		return err
+	}
+	switch lc.Backend = c.v.GetString("leases.backend"); lc.Backend {
+	case "", "memory":
+		lc.Backend = "memory"
+	case "file":
+		if lc.Directory = c.v.GetString("leases.directory"); lc.Directory == "" {
+			return ConfigErrorFromString("leases: need a `leases.directory` directive")
+		}
+	case "mysql":
+		mc, err := c.parseMySQLConfig()
+		if err != nil {
+			return err
+		}
+		lc.MySQL = mc
+	case "dynamodb":
+		dc, err := c.parseDynamoDBConfig()
+		if err != nil {
+			return err
+		}
+		lc.DynamoDB = dc
+	case "etcd":
+		ec, err := c.parseEtcdConfig()
+		if err != nil {
+			return err
+		}
+		lc.Etcd = ec
+	default:
+		return ConfigErrorFromString("leases: unknown backend `%s`", lc.Backend)
+	}
+	if lc.Journal != "" && (lc.Backend == "memory" || lc.Backend == "file") {
+		return ConfigErrorFromString("leases: a journal needs a database backend")
+	}
+	c.Leases = &lc
+	return nil
+}
+
+// parseJournalConfig parses the settings of the journal of a buffered store.
+func (c *Config) parseJournalConfig(lc *LeasesConfig) error {
+	lc.Journal = c.v.GetString("leases.journal")
+	lc.BatchSize = 100
+	lc.FlushInterval = time.Second
+	lc.MaxPending = 100000
+	lc.Sync = "interval"
+	lc.SyncInterval = time.Second
+	if c.v.IsSet("leases.batch-size") {
+		lc.BatchSize = c.v.GetInt("leases.batch-size")
+	}
+	if c.v.IsSet("leases.flush-interval") {
+		lc.FlushInterval = c.v.GetDuration("leases.flush-interval")
+	}
+	if c.v.IsSet("leases.max-pending") {
+		lc.MaxPending = c.v.GetInt("leases.max-pending")
+	}
+	if c.v.IsSet("leases.sync") {
+		lc.Sync = c.v.GetString("leases.sync")
+	}
+	if c.v.IsSet("leases.sync-interval") {
+		lc.SyncInterval = c.v.GetDuration("leases.sync-interval")
+	}
+	switch lc.Sync {
+	case "always", "interval", "never":
+	default:
+		return ConfigErrorFromString("leases: unknown sync policy `%s`, must be always, interval or never", lc.Sync)
+	}
+	if lc.BatchSize <= 0 || lc.FlushInterval <= 0 || lc.SyncInterval <= 0 {
+		return ConfigErrorFromString("leases: the batch size, flush interval and sync interval must be positive")
+	}
+	if lc.MaxPending < 0 {
+		return ConfigErrorFromString("leases: max-pending must not be negative")
+	}
+	return nil
+}
+
+// parseMySQLConfig parses the `leases.mysql` section.
+func (c *Config) parseMySQLConfig() (*MySQLConfig, error) {
+	mc := MySQLConfig{
+		DSN:             c.v.GetString("leases.mysql.dsn"),
+		MaxOpenConns:    10,
+		MaxIdleConns:    2,
+		ConnMaxLifetime: c.v.GetDuration("leases.mysql.conn-max-lifetime"),
+	}
+	if mc.DSN == "" {
+		return nil, ConfigErrorFromString("leases: need a `leases.mysql.dsn` directive")
+	}
+	if c.v.IsSet("leases.mysql.max-open-conns") {
+		mc.MaxOpenConns = c.v.GetInt("leases.mysql.max-open-conns")
+	}
+	if c.v.IsSet("leases.mysql.max-idle-conns") {
+		mc.MaxIdleConns = c.v.GetInt("leases.mysql.max-idle-conns")
+	}
+	if mc.MaxOpenConns <= 0 || mc.MaxIdleConns < 0 || mc.MaxIdleConns > mc.MaxOpenConns {
+		return nil, ConfigErrorFromString("leases: need 0 <= max-idle-conns <= max-open-conns, and max-open-conns > 0")
+	}
+	if mc.ConnMaxLifetime < 0 {
+		return nil, ConfigErrorFromString("leases: connection lifetime cannot be negative")
+	}
+	return &mc, nil
+}
+
+// DynamoDBConfig holds the configuration of the DynamoDB lease store. The
+// credentials come from the default AWS provider chain.
+type DynamoDBConfig struct {
+	Table  string
+	Region string
+	// Endpoint overrides the endpoint of the service, if not empty.
+	Endpoint string
+}
+
+// parseDynamoDBConfig parses the `leases.dynamodb` section, for example:
+//
+//	leases:
+//	    backend: dynamodb
+//	    dynamodb:
+//	        table: coredhcp-leases
+//	        region: eu-west-1
+func (c *Config) parseDynamoDBConfig() (*DynamoDBConfig, error) {
+	dc := DynamoDBConfig{
+		Table:    c.v.GetString("leases.dynamodb.table"),
+		Region:   c.v.GetString("leases.dynamodb.region"),
+		Endpoint: c.v.GetString("leases.dynamodb.endpoint"),
+	}
+	if dc.Table == "" {
+		return nil, ConfigErrorFromString("leases: need a `leases.dynamodb.table` directive")
+	}
+	return &dc, nil
+}
+
+// EtcdConfig holds the configuration of the etcd lease store.
+type EtcdConfig struct {
+	Endpoints []string
+	// Prefix is the prefix of the keys of the store, `/coredhcp` by
+	// default.
+	Prefix   string
+	Username string
+	Password string
+}
+
+// parseEtcdConfig parses the `leases.etcd` section, for example:
+//
+//	leases:
+//	    backend: etcd
+//	    etcd:
+//	        endpoints: [etcd1:2379, etcd2:2379, etcd3:2379]
+//	        prefix: /coredhcp/site1
+func (c *Config) parseEtcdConfig() (*EtcdConfig, error) {
+	ec := EtcdConfig{
+		Endpoints: c.v.GetStringSlice("leases.etcd.endpoints"),
+		Prefix:    c.v.GetString("leases.etcd.prefix"),
+		Username:  c.v.GetString("leases.etcd.username"),
+		Password:  c.v.GetString("leases.etcd.password"),
+	}
+	if len(ec.Endpoints) == 0 {
+		return nil, ConfigErrorFromString("leases: need a `leases.etcd.endpoints` directive")
+	}
+	if ec.Prefix == "" {
+		ec.Prefix = "/coredhcp"
+	}
+	if !strings.HasPrefix(ec.Prefix, "/") {
+		return nil, ConfigErrorFromString("leases: etcd prefix `%s` must start with /", ec.Prefix)
+	}
+	return &ec, nil
+}
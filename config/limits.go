@@ -0,0 +1,76 @@
+package config
+
+import "time"
+
+// PluginLimits holds the resource limits of a plugin, so that a hung or slow
+// backend of the plugin cannot stall the whole chain.
+type PluginLimits struct {
+	// Timeout, if not zero, is the maximum duration of a call of the
+	// plugin.
+	Timeout time.Duration
+	// Concurrency, if not zero, is the maximum number of calls of the
+	// plugin in flight, including the calls that timed out but did not
+	// return yet.
+	Concurrency int
+	// Failures, if not zero, is the number of consecutive failures, i.e.
+	// timeouts or calls refused by the concurrency cap, that open the
+	// circuit: the plugin is then skipped for Cooldown, before one call is
+	// tried again.
+	Failures int
+	Cooldown time.Duration
+	// Drop selects the fallback verdict when the plugin is skipped: drop
+	// the request, or else continue the chain without the plugin.
+	Drop bool
+}
+
+// parsePluginLimits parses the optional `limits` section of a server, which
+// maps the names of its plugins to their limits, for example:
+//
+//	server6:
+//	    plugins:
+//	        - file: leases.txt
+//	    limits:
+//	        file:
+//	            timeout: 200ms
+//	            concurrency: 16
+//	            failures: 5
+//	            cooldown: 30s
+//	            fallback: continue
+func (c *Config) parsePluginLimits(section, proto string, plugins []*PluginConfig) (map[string]*PluginLimits, error) {
+	limits := c.v.GetStringMap(section + ".limits")
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	ret := make(map[string]*PluginLimits, len(limits))
+	for name := range limits {
+		found := false
+		for _, p := range plugins {
+			found = found || p.Name == name
+		}
+		if !found {
+			return nil, ConfigErrorFromString("%s: limits of `%s`, which is not in the plugins", proto, name)
+		}
+		key := section + ".limits." + name
+		l := PluginLimits{
+			Timeout:     c.v.GetDuration(key + ".timeout"),
+			Concurrency: c.v.GetInt(key + ".concurrency"),
+			Failures:    c.v.GetInt(key + ".failures"),
+			Cooldown:    c.v.GetDuration(key + ".cooldown"),
+		}
+		switch fallback := c.v.GetString(key + ".fallback"); fallback {
+		case "", "continue":
+		case "drop":
+			l.Drop = true
+		default:
+			return nil, ConfigErrorFromString("%s: invalid fallback `%s` of `%s`, must be continue or drop", proto, fallback, name)
+		}
+		if l.Timeout < 0 || l.Concurrency < 0 || l.Failures < 0 || l.Cooldown < 0 {
+			return nil, ConfigErrorFromString("%s: the limits of `%s` cannot be negative", proto, name)
+		}
+		if l.Failures > 0 && l.Cooldown == 0 {
+			l.Cooldown = 30 * time.Second
+		}
+		ret[name] = &l
+	}
+	return ret, nil
+}
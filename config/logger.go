@@ -0,0 +1,95 @@
+package config
+
+import (
+	"net/url"
+	"strings"
+)
+
+// LoggerConfig holds the configuration of the logging backends.
+type LoggerConfig struct {
+	// Syslog is nil if logs are not sent to syslog.
+	Syslog *SyslogConfig
+	// File is nil if logs are not written to a file.
+	File *FileLogConfig
+}
+
+// FileLogConfig holds the configuration of the file logging backend. Files
+// are rotated when they reach MaxSize megabytes, and rotated files are removed
+// when older than MaxAge days or when there are more than MaxBackups of them.
+// Zero values disable the respective limit, except MaxSize which defaults to
+// 100 megabytes.
+type FileLogConfig struct {
+	Path       string
+	MaxSize    int
+	MaxAge     int
+	MaxBackups int
+	Compress   bool
+}
+
+// SyslogConfig holds the configuration of the syslog logging backend.
+type SyslogConfig struct {
+	// Network is one of udp, tcp, tls, unix or unixgram.
+	Network  string
+	Address  string
+	Facility string
+	// TLSSkipVerify disables the verification of the collector certificate.
+	TLSSkipVerify bool
+}
+
+// parseLoggerConfig parses the `logger` section, for example:
+//
+//	logger:
+//	    syslog:
+//	        address: tls://syslog.example.org:6514
+//	        facility: local4
+//	    file:
+//	        path: /var/log/coredhcp.log
+//	        max_size: 10
+//	        max_backups: 5
+//
+// The address scheme selects the transport. Use `unixgram:///dev/log` for the
+// local syslog daemon.
+func (c *Config) parseLoggerConfig() error {
+	lc := LoggerConfig{}
+	if c.v.Get("logger.syslog") != nil {
+		addr := c.v.GetString("logger.syslog.address")
+		if addr == "" {
+			addr = "unixgram:///dev/log"
+		}
+		u, err := url.Parse(addr)
+		if err != nil {
+			return ConfigErrorFromString("logger: invalid syslog address: %v", err)
+		}
+		sc := SyslogConfig{
+			Network:       strings.ToLower(u.Scheme),
+			Address:       u.Host,
+			Facility:      c.v.GetString("logger.syslog.facility"),
+			TLSSkipVerify: c.v.GetBool("logger.syslog.tls_skip_verify"),
+		}
+		if sc.Network == "unix" || sc.Network == "unixgram" {
+			sc.Address = u.Path
+		}
+		if sc.Facility == "" {
+			sc.Facility = "daemon"
+		}
+		lc.Syslog = &sc
+	}
+	if c.v.Get("logger.file") != nil {
+		fc := FileLogConfig{
+			Path:       c.v.GetString("logger.file.path"),
+			MaxSize:    c.v.GetInt("logger.file.max_size"),
+			MaxAge:     c.v.GetInt("logger.file.max_age"),
+			MaxBackups: c.v.GetInt("logger.file.max_backups"),
+			Compress:   c.v.GetBool("logger.file.compress"),
+		}
+		if fc.Path == "" {
+			return ConfigErrorFromString("logger: missing `logger.file.path` directive")
+		}
+		if fc.MaxSize < 0 || fc.MaxAge < 0 || fc.MaxBackups < 0 {
+			return ConfigErrorFromString("logger: file rotation limits cannot be negative")
+		}
+		lc.File = &fc
+	}
+	c.Logger = &lc
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import "time"
+
+// ManagementConfig holds the configuration of the management HTTP listener.
+type ManagementConfig struct {
+	// Listen is the TCP address to listen on, e.g. `localhost:8053`.
+	Listen string
+	// HistorySize is the number of transactions kept in the history of each
+	// client. 0 disables the client history.
+	HistorySize int
+	// HistoryClients is the maximum number of clients with a history. When
+	// it is reached, the least recently seen client is forgotten.
+	HistoryClients int
+	// ReservationTTL is the default time after which the pre-reservations
+	// made with the management API are removed if unused.
+	ReservationTTL time.Duration
+	// Auth is nil if the listener uses neither TLS nor authentication.
+	Auth *AuthConfig
+}
+
+// parseManagementConfig parses the optional `management` section, for
+// example:
+//
+//	management:
+//	    listen: 'localhost:8053'
+//	    history-size: 20
+//	    history-clients: 10000
+//	    reservation-ttl: 24h
+//
+// and the TLS and authentication settings of parseAuthConfig.
+func (c *Config) parseManagementConfig() error {
+	if c.v.Get("management") == nil {
+		return nil
+	}
+	mc := ManagementConfig{
+		Listen:         c.v.GetString("management.listen"),
+		HistorySize:    20,
+		HistoryClients: 10000,
+		ReservationTTL: 24 * time.Hour,
+	}
+	if mc.Listen == "" {
+		return ConfigErrorFromString("management: missing `management.listen` directive")
+	}
+	if c.v.IsSet("management.history-size") {
+		mc.HistorySize = c.v.GetInt("management.history-size")
+	}
+	if c.v.IsSet("management.history-clients") {
+		mc.HistoryClients = c.v.GetInt("management.history-clients")
+	}
+	if mc.HistorySize < 0 || mc.HistoryClients < 0 {
+		return ConfigErrorFromString("management: history size and clients cannot be negative")
+	}
+	if c.v.IsSet("management.reservation-ttl") {
+		mc.ReservationTTL = c.v.GetDuration("management.reservation-ttl")
+		if mc.ReservationTTL <= 0 {
+			return ConfigErrorFromString("management: reservation TTL must be positive")
+		}
+	}
+	var err error
+	if mc.Auth, err = c.parseAuthConfig("management"); err != nil {
+		return err
+	}
+	c.Management = &mc
+	return nil
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v2"
+)
+
+// Settings returns the settings of the configuration as nested maps, by
+// lowercase key, with the plugin lists in their canonical form and with the
+// references to the secrets rather than the secrets. If effective is true,
+// the defaults applied when parsing the configuration are filled in, e.g.
+// the maximum sizes of the client history of the management listener. The
+// settings can be modified, and loaded back with FromSettings.
+func (c *Config) Settings(effective bool) map[string]interface{} {
+	settings := normalizeSettings(c.v.AllSettings()).(map[string]interface{})
+	for key, raw := range c.references {
+		setSetting(settings, key, normalizeSettings(raw))
+	}
+	for _, section := range []string{"server6", "server4"} {
+		if list := lookupSetting(settings, section+".plugins"); list != nil {
+			setSetting(settings, section+".plugins", canonicalPlugins(list))
+		}
+	}
+	if effective {
+		c.fillDefaults(settings)
+	}
+	return settings
+}
+
+// Marshal returns the canonical YAML encoding of the configuration, with the
+// keys sorted, see Settings. LoadBytes loads it back.
+func (c *Config) Marshal(effective bool) ([]byte, error) {
+	return yaml.Marshal(c.Settings(effective))
+}
+
+// LoadBytes parses a configuration in one of SupportedFormats, e.g. the
+// output of Marshal, and returns a Config object, or an error if any.
+func LoadBytes(data []byte, format string) (*Config, error) {
+	format = strings.ToLower(format)
+	if !isSupportedFormat(format) {
+		return nil, ConfigErrorFromString("unsupported config format `%s`, must be one of %v", format, SupportedFormats)
+	}
+	c := New()
+	c.v.SetConfigType(format)
+	if err := c.v.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := c.parse(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FromSettings parses the settings returned by Settings, once modified, and
+// returns a Config object, or an error if they are not valid.
+func FromSettings(settings map[string]interface{}) (*Config, error) {
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return nil, ConfigErrorFromError(err)
+	}
+	return LoadBytes(data, "yml")
+}
+
+// normalizeSettings returns a copy of the settings with all the maps keyed by
+// string and all the lists of type []interface{}, whatever the format they
+// were decoded from, e.g. the maps decoded from YAML are keyed by interface{}.
+func normalizeSettings(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			ret[k] = normalizeSettings(item)
+		}
+		return ret
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(t))
+		for k, item := range t {
+			ret[fmt.Sprint(k)] = normalizeSettings(item)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(t))
+		for i, item := range t {
+			ret[i] = normalizeSettings(item)
+		}
+		return ret
+	case []map[string]interface{}:
+		// the arrays of tables of TOML
+		ret := make([]interface{}, len(t))
+		for i, item := range t {
+			ret[i] = normalizeSettings(item)
+		}
+		return ret
+	}
+	return v
+}
+
+// lookupSetting returns the setting of a dotted key, or nil if it is not set.
+func lookupSetting(settings map[string]interface{}, key string) interface{} {
+	var v interface{} = settings
+	for _, part := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[part]
+	}
+	return v
+}
+
+// setSetting sets the setting of a dotted key, creating the intermediate
+// sections if needed.
+func setSetting(settings map[string]interface{}, key string, value interface{}) {
+	parts := strings.Split(key, ".")
+	m := settings
+	for _, part := range parts[:len(parts)-1] {
+		sub, ok := m[part].(map[string]interface{})
+		if !ok {
+			sub = make(map[string]interface{})
+			m[part] = sub
+		}
+		m = sub
+	}
+	m[parts[len(parts)-1]] = value
+}
+
+// canonicalPlugins returns a plugin list with one `<name>: <args>` map per
+// plugin, the arguments separated by single spaces, as parsed by
+// parsePlugins. Malformed items are kept as is.
+func canonicalPlugins(list interface{}) interface{} {
+	items, ok := list.([]interface{})
+	if !ok {
+		return list
+	}
+	ret := make([]interface{}, len(items))
+	for i, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok || len(m) != 1 {
+			ret[i] = item
+			continue
+		}
+		for name, args := range m {
+			ret[i] = map[string]interface{}{name: strings.Join(strings.Fields(cast.ToString(args)), " ")}
+		}
+	}
+	return ret
+}
+
+// setDefault sets a setting that is not set.
+func setDefault(settings map[string]interface{}, key string, value interface{}) {
+	if lookupSetting(settings, key) == nil {
+		setSetting(settings, key, value)
+	}
+}
+
+// duration returns the canonical encoding of a duration, e.g. `1h` rather
+// than `1h0m0s`.
+func duration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// fillDefaults sets the settings that are not set to the values that were
+// used when parsing them. The secrets are never filled in.
+func (c *Config) fillDefaults(settings map[string]interface{}) {
+	for section, sc := range map[string]*ServerConfig{"server6": c.Server6, "server4": c.Server4} {
+		if sc == nil {
+			continue
+		}
+		setSetting(settings, section+".listen", sc.Listener.String())
+		setDefault(settings, section+".deadline", duration(sc.Deadline))
+		setDefault(settings, section+".stale-ttl", duration(sc.StaleTTL))
+		if section == "server4" {
+			setDefault(settings, section+".overload", sc.Overload)
+			setDefault(settings, section+".mtu", sc.MTU)
+		}
+	}
+	if c.Logger != nil && c.Logger.Syslog != nil {
+		sc := c.Logger.Syslog
+		// for the unix sockets, the address is an absolute path
+		setDefault(settings, "logger.syslog.address", sc.Network+"://"+sc.Address)
+		setDefault(settings, "logger.syslog.facility", sc.Facility)
+	}
+	if tc := c.Tracing; tc != nil {
+		setDefault(settings, "tracing.sample_ratio", tc.SampleRatio)
+	}
+	if mc := c.Management; mc != nil {
+		setDefault(settings, "management.history-size", mc.HistorySize)
+		setDefault(settings, "management.history-clients", mc.HistoryClients)
+		setDefault(settings, "management.reservation-ttl", duration(mc.ReservationTTL))
+	}
+	if sc := c.SNMP; sc != nil {
+		setDefault(settings, "snmp.agentx", sc.AgentX)
+	}
+	if lc := c.Leases; lc != nil {
+		setDefault(settings, "leases.backend", lc.Backend)
+		setDefault(settings, "leases.retention", duration(lc.Retention))
+		setDefault(settings, "leases.compact-interval", duration(lc.CompactInterval))
+		setDefault(settings, "leases.expiry-jitter", duration(lc.ExpiryJitter))
+		setDefault(settings, "leases.expiry-catch-up", duration(lc.ExpiryCatchUp))
+	}
+	if sc := c.Shedding; sc != nil {
+		setDefault(settings, "load-shedding.high", sc.High)
+		setDefault(settings, "load-shedding.prefix4", sc.Prefix4)
+		setDefault(settings, "load-shedding.prefix6", sc.Prefix6)
+	}
+	if qc := c.Quarantine; qc != nil {
+		setDefault(settings, "quarantine.samples", qc.Samples)
+		setDefault(settings, "quarantine.log-interval", duration(qc.LogInterval))
+		setDefault(settings, "quarantine.max-size", qc.MaxSize)
+		setDefault(settings, "quarantine.max-files", qc.MaxFiles)
+	}
+}
@@ -0,0 +1,46 @@
+package config
+
+import "encoding/base64"
+
+// OMAPIConfig holds the configuration of the OMAPI listener.
+type OMAPIConfig struct {
+	// Listen is the TCP address to listen on, e.g. `localhost:7911`.
+	Listen string
+	// KeyName and KeySecret are the name and the shared secret of the
+	// HMAC-MD5 key clients must authenticate with. If KeyName is empty,
+	// clients are not authenticated.
+	KeyName   string
+	KeySecret []byte
+}
+
+// parseOMAPIConfig parses the optional `omapi` section, for example:
+//
+//	omapi:
+//	    listen: 'localhost:7911'
+//	    key:
+//	        name: omapi_key
+//	        secret: "<base64 secret>"
+func (c *Config) parseOMAPIConfig() error {
+	if c.v.Get("omapi") == nil {
+		return nil
+	}
+	oc := OMAPIConfig{
+		Listen:  c.v.GetString("omapi.listen"),
+		KeyName: c.v.GetString("omapi.key.name"),
+	}
+	if oc.Listen == "" {
+		return ConfigErrorFromString("omapi: missing `omapi.listen` directive")
+	}
+	if oc.KeyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(c.v.GetString("omapi.key.secret"))
+		if err != nil {
+			return ConfigErrorFromString("omapi: invalid key secret: %v", err)
+		}
+		if len(secret) == 0 {
+			return ConfigErrorFromString("omapi: missing `omapi.key.secret` directive")
+		}
+		oc.KeySecret = secret
+	}
+	c.OMAPI = &oc
+	return nil
+}
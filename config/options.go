@@ -0,0 +1,257 @@
+package config
+
+import (
+	"net"
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// Options maps an option name (e.g. `dns`, `ntp`, `domain`) to its values.
+type Options map[string][]string
+
+// Inherit returns a new Options object with all the options of the parent,
+// overridden by the ones defined in o.
+func (o Options) Inherit(parent Options) Options {
+	ret := make(Options, len(parent)+len(o))
+	for k, v := range parent {
+		ret[k] = v
+	}
+	for k, v := range o {
+		ret[k] = v
+	}
+	return ret
+}
+
+// NetworkConfig holds the options of a shared network, and the subnets that
+// are part of it.
+type NetworkConfig struct {
+	Name    string
+	Options Options
+	// Labels override the labels of the server for the clients of the
+	// network.
+	Labels Labels
+	// Plugins overrides the arguments of plugins of the chain for the
+	// clients of the network.
+	Plugins PluginOverrides
+	Subnets []*SubnetConfig
+}
+
+// SubnetConfig holds the options of a subnet.
+type SubnetConfig struct {
+	Prefix *net.IPNet
+	// Name names the pool of the subnet, e.g. for the relays mapped to it,
+	// and is unique among the subnets of the server if not empty.
+	Name    string
+	Options Options
+	// Labels override the labels of the network for the clients of the
+	// subnet.
+	Labels Labels
+	// Plugins overrides the arguments of plugins of the chain for the
+	// clients of the subnet, on top of the overrides of its network.
+	Plugins PluginOverrides
+	// Relays are the prefixes of the relays that serve the subnet from
+	// outside of it, e.g. with a loopback address as giaddr or link-address.
+	Relays []*net.IPNet
+	// Range is the range of dynamic addresses of the subnet, if any.
+	Range *AddressRange
+	// Split is the share of Range served by this server, when the range is
+	// split with another server, or nil if it serves the whole range.
+	Split *Split
+}
+
+// OptionLevels holds the option definitions of a server, from the most generic
+// to the most specific level. Options defined at a more specific level override
+// the same options defined at the levels above it, in the following order:
+// global → shared network → subnet → class → host.
+type OptionLevels struct {
+	Global   Options
+	Networks []*NetworkConfig
+	// Classes maps a client class name to its options.
+	Classes map[string]Options
+	// Hosts maps a client hardware address to its options.
+	Hosts map[string]Options
+
+	// index indexes the subnets of Networks. It is built once they are
+	// parsed, and nil if there is none.
+	index *subnetIndex
+}
+
+// Subnet returns the subnet of a client with the given IP address, or of its
+// relay, and its shared network, or nil if there is none. The subnet with the
+// longest prefix that contains the address is chosen first, and then the
+// subnet with the longest relay prefix that contains it. Among the subnets
+// declared with the same prefix, the first one is chosen.
+func (l *OptionLevels) Subnet(ip net.IP) (*NetworkConfig, *SubnetConfig) {
+	if ip == nil || l.index == nil {
+		return nil, nil
+	}
+	if e, ok := l.index.prefixes.lookup(ip); ok {
+		return e.network, e.subnet
+	}
+	if e, ok := l.index.relays.lookup(ip); ok {
+		return e.network, e.subnet
+	}
+	return nil, nil
+}
+
+// SubnetByName returns the subnet with the given pool name, and its shared
+// network, or nil if there is none.
+func (l *OptionLevels) SubnetByName(name string) (*NetworkConfig, *SubnetConfig) {
+	if l.index == nil {
+		return nil, nil
+	}
+	e := l.index.names[name]
+	return e.network, e.subnet
+}
+
+// Resolve returns the options that apply to a client with the given IP
+// address, classes and hardware address. Any of them can be nil or empty, in
+// which case the corresponding level is skipped. When a client is in several
+// classes, the later ones take precedence.
+func (l *OptionLevels) Resolve(ip net.IP, classes []string, hwaddr net.HardwareAddr) Options {
+	opts := Options{}.Inherit(l.Global)
+	if n, s := l.Subnet(ip); s != nil {
+		opts = s.Options.Inherit(n.Options.Inherit(opts))
+	}
+	for _, class := range classes {
+		opts = l.Classes[class].Inherit(opts)
+	}
+	if hwaddr != nil {
+		opts = l.Hosts[hwaddr.String()].Inherit(opts)
+	}
+	return opts
+}
+
+// parseOptions parses a map of option names to space-separated values.
+func parseOptions(val interface{}) (Options, error) {
+	if val == nil {
+		return Options{}, nil
+	}
+	m, err := cast.ToStringMapE(val)
+	if err != nil {
+		return nil, ConfigErrorFromString("options: not a string map: %v", err)
+	}
+	opts := make(Options, len(m))
+	for k, v := range m {
+		// not to turn a mapping, e.g. options nested under `options`, into
+		// an empty option
+		str, err := cast.ToStringE(v)
+		if err != nil {
+			return nil, ConfigErrorFromString("options: the value of `%s` is not a scalar", k)
+		}
+		opts[strings.ToLower(k)] = strings.Fields(str)
+	}
+	return opts, nil
+}
+
+// parseOptionLevels parses the option definitions found under `prefix` (e.g.
+// `server6`), inheriting the global ones from the top-level `options` section.
+func (c *Config) parseOptionLevels(prefix string) (*OptionLevels, error) {
+	global, err := parseOptions(c.v.Get("options"))
+	if err != nil {
+		return nil, err
+	}
+	server, err := parseOptions(c.v.Get(prefix + ".options"))
+	if err != nil {
+		return nil, err
+	}
+	levels := OptionLevels{
+		Global:  server.Inherit(global),
+		Classes: make(map[string]Options),
+		Hosts:   make(map[string]Options),
+	}
+	names := make(map[string]*SubnetConfig)
+	for idx, val := range cast.ToSlice(c.v.Get(prefix + ".networks")) {
+		nc := cast.ToStringMap(val)
+		network := NetworkConfig{Name: cast.ToString(nc["name"])}
+		if network.Options, err = parseOptions(nc["options"]); err != nil {
+			return nil, err
+		}
+		if network.Plugins, err = parsePluginOverrides(nc["plugins"]); err != nil {
+			return nil, err
+		}
+		if network.Labels, err = parseLabels(nc["labels"]); err != nil {
+			return nil, err
+		}
+		for _, sval := range cast.ToSlice(nc["subnets"]) {
+			sc := cast.ToStringMap(sval)
+			_, ipnet, err := net.ParseCIDR(cast.ToString(sc["prefix"]))
+			if err != nil {
+				return nil, ConfigErrorFromString("network #%d: invalid subnet prefix: %v", idx, err)
+			}
+			subnet := SubnetConfig{Prefix: ipnet, Name: cast.ToString(sc["name"])}
+			if other, ok := names[subnet.Name]; ok && subnet.Name != "" {
+				return nil, ConfigErrorFromString("network #%d: subnet %s: name %s already used by subnet %s", idx, ipnet, subnet.Name, other.Prefix)
+			}
+			names[subnet.Name] = &subnet
+			if subnet.Options, err = parseOptions(sc["options"]); err != nil {
+				return nil, err
+			}
+			if subnet.Plugins, err = parsePluginOverrides(sc["plugins"]); err != nil {
+				return nil, err
+			}
+			if subnet.Labels, err = parseLabels(sc["labels"]); err != nil {
+				return nil, err
+			}
+			for _, r := range cast.ToStringSlice(sc["relays"]) {
+				_, relay, err := net.ParseCIDR(r)
+				if err != nil {
+					return nil, ConfigErrorFromString("network #%d: subnet %s: invalid relay prefix: %v", idx, ipnet, err)
+				}
+				subnet.Relays = append(subnet.Relays, relay)
+			}
+			if r := cast.ToString(sc["range"]); r != "" {
+				if subnet.Range, err = parseRange(r, ipnet); err != nil {
+					return nil, ConfigErrorFromString("network #%d: subnet %s: %v", idx, ipnet, err)
+				}
+			}
+			if split := cast.ToString(sc["split"]); split != "" {
+				if subnet.Range == nil {
+					return nil, ConfigErrorFromString("network #%d: subnet %s: split without a range", idx, ipnet)
+				}
+				if subnet.Split, err = parseSplit(split); err != nil {
+					return nil, ConfigErrorFromString("network #%d: subnet %s: %v", idx, ipnet, err)
+				}
+			}
+			network.Subnets = append(network.Subnets, &subnet)
+		}
+		levels.Networks = append(levels.Networks, &network)
+	}
+	if err := validatePools(levels.Networks); err != nil {
+		return nil, err
+	}
+	// the relays mapped to the subnets by pool name, rather than on the
+	// subnets
+	for idx, val := range cast.ToSlice(c.v.Get(prefix + ".relays")) {
+		rc := cast.ToStringMap(val)
+		_, relay, err := net.ParseCIDR(cast.ToString(rc["prefix"]))
+		if err != nil {
+			return nil, ConfigErrorFromString("relay #%d: invalid relay prefix: %v", idx, err)
+		}
+		name := cast.ToString(rc["pool"])
+		subnet, ok := names[name]
+		if !ok || name == "" {
+			return nil, ConfigErrorFromString("relay #%d: no subnet named `%s`", idx, name)
+		}
+		subnet.Relays = append(subnet.Relays, relay)
+	}
+	if len(levels.Networks) > 0 {
+		levels.index = newSubnetIndex(levels.Networks)
+	}
+	for name, val := range cast.ToStringMap(c.v.Get(prefix + ".classes")) {
+		if levels.Classes[name], err = parseOptions(val); err != nil {
+			return nil, err
+		}
+	}
+	for mac, val := range cast.ToStringMap(c.v.Get(prefix + ".hosts")) {
+		hwaddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, ConfigErrorFromString("hosts: malformed hardware address: %s", mac)
+		}
+		if levels.Hosts[hwaddr.String()], err = parseOptions(val); err != nil {
+			return nil, err
+		}
+	}
+	return &levels, nil
+}
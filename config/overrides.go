@@ -0,0 +1,110 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/spf13/cast"
+)
+
+// PluginOverrides maps the name of a plugin to the arguments that override
+// its arguments in the chain, for the clients of a network or subnet.
+type PluginOverrides map[string][]string
+
+// Inherit returns a new PluginOverrides object with the overrides of the
+// parent, merged with the ones defined in o, see MergeArgs.
+func (o PluginOverrides) Inherit(parent PluginOverrides) PluginOverrides {
+	ret := make(PluginOverrides, len(parent)+len(o))
+	for name, args := range parent {
+		ret[name] = args
+	}
+	for name, args := range o {
+		ret[name] = MergeArgs(ret[name], args)
+	}
+	return ret
+}
+
+// MergeArgs returns the arguments of a plugin overridden by others: the
+// overrides `key=value` replace all the arguments with the same key, or are
+// appended, and the positional overrides, without `=`, replace all the
+// positional arguments, and come first.
+func MergeArgs(args, overrides []string) []string {
+	var positional []string
+	keyed := make(map[string][]string)
+	for _, o := range overrides {
+		if i := strings.Index(o, "="); i > 0 {
+			keyed[o[:i]] = append(keyed[o[:i]], o)
+		} else {
+			positional = append(positional, o)
+		}
+	}
+	ret := positional
+	replaced := make(map[string]bool)
+	for _, a := range args {
+		i := strings.Index(a, "=")
+		switch {
+		case i <= 0:
+			if positional == nil {
+				ret = append(ret, a)
+			}
+		case keyed[a[:i]] != nil:
+			if !replaced[a[:i]] {
+				ret = append(ret, keyed[a[:i]]...)
+				replaced[a[:i]] = true
+			}
+		default:
+			ret = append(ret, a)
+		}
+	}
+	for _, o := range overrides {
+		if i := strings.Index(o, "="); i > 0 && !replaced[o[:i]] {
+			ret = append(ret, keyed[o[:i]]...)
+			replaced[o[:i]] = true
+		}
+	}
+	return ret
+}
+
+// parsePluginOverrides parses a map of plugin names to space-separated
+// arguments.
+func parsePluginOverrides(val interface{}) (PluginOverrides, error) {
+	if val == nil {
+		return nil, nil
+	}
+	m, err := cast.ToStringMapE(val)
+	if err != nil {
+		return nil, ConfigErrorFromString("plugins: not a string map: %v", err)
+	}
+	ret := make(PluginOverrides, len(m))
+	for name, v := range m {
+		ret[name] = strings.Fields(cast.ToString(v))
+	}
+	return ret, nil
+}
+
+// validateOverrides checks that the plugins overridden in the networks and
+// subnets are in the chain.
+func validateOverrides(proto string, levels *OptionLevels, plugins []*PluginConfig) error {
+	known := make(map[string]bool, len(plugins))
+	for _, p := range plugins {
+		known[p.Name] = true
+	}
+	check := func(where string, o PluginOverrides) error {
+		for name := range o {
+			if !known[name] {
+				return ConfigErrorFromString("%s: %s overrides the plugin `%s`, which is not in the chain", proto, where, name)
+			}
+		}
+		return nil
+	}
+	for _, n := range levels.Networks {
+		if err := check("network "+n.Name, n.Plugins); err != nil {
+			return err
+		}
+		for _, s := range n.Subnets {
+			if err := check("subnet "+s.Prefix.String(), s.Plugins); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
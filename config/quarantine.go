@@ -0,0 +1,77 @@
+package config
+
+import "time"
+
+// The defaults of the quarantine of the non-conforming packets.
+const (
+	DefaultQuarantineSamples     = 4
+	DefaultQuarantineLogInterval = time.Minute
+)
+
+// QuarantineConfig holds the configuration of the quarantine of the
+// malformed or non-conforming packets, which are counted and sampled by
+// source instead of being logged one by one.
+type QuarantineConfig struct {
+	// Samples is the number of last packets kept by source.
+	Samples int
+	// LogInterval is the minimum interval between two log lines about the
+	// packets of a source.
+	LogInterval time.Duration
+	// HexDump, if not empty, is a file the packets are appended to, in hex.
+	HexDump string
+	// Pcap, if not empty, is a pcap file the packets are written to. It is
+	// rotated when it reaches MaxSize bytes, and at most MaxFiles rotated
+	// files are kept.
+	Pcap     string
+	MaxSize  int64
+	MaxFiles int
+}
+
+// parseQuarantineConfig parses the optional `quarantine` section, for
+// example:
+//
+//	quarantine:
+//	    samples: 8
+//	    log-interval: 5m
+//	    hex-dump: /var/log/coredhcp/quarantine.txt
+//	    pcap: /var/log/coredhcp/quarantine.pcap
+//	    max-size: 10485760
+//	    max-files: 5
+//
+// The quarantine is always enabled: without the section, the packets are
+// counted, sampled and logged with the defaults, but not dumped.
+func (c *Config) parseQuarantineConfig() error {
+	qc := QuarantineConfig{
+		Samples:     DefaultQuarantineSamples,
+		LogInterval: DefaultQuarantineLogInterval,
+		MaxSize:     10 * 1024 * 1024,
+		MaxFiles:    5,
+	}
+	if c.v.Get("quarantine") != nil {
+		if c.v.IsSet("quarantine.samples") {
+			qc.Samples = c.v.GetInt("quarantine.samples")
+		}
+		if c.v.IsSet("quarantine.log-interval") {
+			qc.LogInterval = c.v.GetDuration("quarantine.log-interval")
+		}
+		if c.v.IsSet("quarantine.max-size") {
+			qc.MaxSize = c.v.GetInt64("quarantine.max-size")
+		}
+		if c.v.IsSet("quarantine.max-files") {
+			qc.MaxFiles = c.v.GetInt("quarantine.max-files")
+		}
+		qc.HexDump = c.v.GetString("quarantine.hex-dump")
+		qc.Pcap = c.v.GetString("quarantine.pcap")
+	}
+	if qc.Samples < 0 {
+		return ConfigErrorFromString("quarantine: the number of samples cannot be negative")
+	}
+	if qc.LogInterval < 0 {
+		return ConfigErrorFromString("quarantine: the log interval cannot be negative")
+	}
+	if qc.MaxSize <= 0 || qc.MaxFiles < 0 {
+		return ConfigErrorFromString("quarantine: invalid `max-size` or `max-files`")
+	}
+	c.Quarantine = &qc
+	return nil
+}
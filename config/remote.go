@@ -0,0 +1,12 @@
+//go:build !minimal || with_remote
+// +build !minimal with_remote
+
+package config
+
+import (
+	// enable viper's etcd and consul remote providers
+	_ "github.com/spf13/viper/remote"
+)
+
+// remoteSupported is whether LoadRemote is available.
+const remoteSupported = true
@@ -0,0 +1,9 @@
+//go:build minimal && !with_remote
+// +build minimal,!with_remote
+
+package config
+
+// remoteSupported is whether LoadRemote is available. The remote providers,
+// and their etcd and Consul clients, are left out of the minimal builds without
+// the `with_remote` tag.
+const remoteSupported = false
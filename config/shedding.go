@@ -0,0 +1,61 @@
+package config
+
+// SheddingConfig holds the configuration of the load shedding, which drops
+// requests adaptively when the aggregate request rate of an ingress source,
+// i.e. a relayed subnet or a listener, is too high.
+type SheddingConfig struct {
+	// Low is the rate, in requests per second, from which the requests of
+	// new clients, the DISCOVERs and SOLICITs, start to be dropped, with a
+	// probability increasing up to High.
+	Low float64
+	// High is the rate from which all the requests of new clients are
+	// dropped, and the requests of the existing clients, e.g. the renewals,
+	// start to be dropped, with a probability increasing up to twice High.
+	High float64
+	// Prefix4 and Prefix6 are the prefix lengths of the subnets of the
+	// relays whose rates are tracked.
+	Prefix4 int
+	Prefix6 int
+}
+
+// parseSheddingConfig parses the optional `load-shedding` section, for
+// example:
+//
+//	load-shedding:
+//	    low: 100
+//	    high: 500
+//	    prefix4: 24
+//	    prefix6: 64
+func (c *Config) parseSheddingConfig() error {
+	if c.v.Get("load-shedding") == nil {
+		return nil
+	}
+	sc := SheddingConfig{
+		Low:     c.v.GetFloat64("load-shedding.low"),
+		High:    c.v.GetFloat64("load-shedding.high"),
+		Prefix4: c.v.GetInt("load-shedding.prefix4"),
+		Prefix6: c.v.GetInt("load-shedding.prefix6"),
+	}
+	if sc.Low <= 0 {
+		return ConfigErrorFromString("load-shedding: missing or invalid `low` rate")
+	}
+	if sc.High == 0 {
+		sc.High = 5 * sc.Low
+	} else if sc.High < sc.Low {
+		return ConfigErrorFromString("load-shedding: the `high` rate %v cannot be lower than the `low` rate %v", sc.High, sc.Low)
+	}
+	if sc.Prefix4 == 0 {
+		sc.Prefix4 = 24
+	}
+	if sc.Prefix6 == 0 {
+		sc.Prefix6 = 64
+	}
+	if sc.Prefix4 < 0 || sc.Prefix4 > 32 {
+		return ConfigErrorFromString("load-shedding: invalid `prefix4` %d", sc.Prefix4)
+	}
+	if sc.Prefix6 < 0 || sc.Prefix6 > 128 {
+		return ConfigErrorFromString("load-shedding: invalid `prefix6` %d", sc.Prefix6)
+	}
+	c.Shedding = &sc
+	return nil
+}
@@ -0,0 +1,31 @@
+package config
+
+// SNMPConfig holds the configuration of the SNMP AgentX subagent.
+type SNMPConfig struct {
+	// AgentX is the address of the AgentX master agent, e.g.
+	// `unix:///var/agentx/master` or `tcp://localhost:705`.
+	AgentX string
+	// Root is the root OID of the exposed variables. If empty, the default
+	// root is used.
+	Root string
+}
+
+// parseSNMPConfig parses the optional `snmp` section, for example:
+//
+//	snmp:
+//	    agentx: unix:///var/agentx/master
+//	    root: 1.3.6.1.4.1.8072.9999.67
+func (c *Config) parseSNMPConfig() error {
+	if c.v.Get("snmp") == nil {
+		return nil
+	}
+	sc := SNMPConfig{
+		AgentX: c.v.GetString("snmp.agentx"),
+		Root:   c.v.GetString("snmp.root"),
+	}
+	if sc.AgentX == "" {
+		sc.AgentX = "unix:///var/agentx/master"
+	}
+	c.SNMP = &sc
+	return nil
+}
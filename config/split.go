@@ -0,0 +1,218 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AddressRange is an inclusive range of IPv4 or IPv6 addresses.
+type AddressRange struct {
+	Start net.IP
+	End   net.IP
+}
+
+func (r *AddressRange) String() string {
+	return fmt.Sprintf("%s-%s", r.Start, r.End)
+}
+
+// Overlaps returns whether two ranges have addresses in common.
+func (r *AddressRange) Overlaps(o *AddressRange) bool {
+	return len(r.Start) == len(o.Start) && bytes.Compare(r.Start, o.End) <= 0 && bytes.Compare(o.Start, r.End) <= 0
+}
+
+// Contains returns whether an address is in the range.
+func (r *AddressRange) Contains(ip net.IP) bool {
+	ip = normalizeIP(ip, len(r.Start))
+	return ip != nil && bytes.Compare(r.Start, ip) <= 0 && bytes.Compare(ip, r.End) <= 0
+}
+
+// Size returns the number of addresses in the range.
+func (r *AddressRange) Size() *big.Int {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(r.End), new(big.Int).SetBytes(r.Start))
+	return size.Add(size, big.NewInt(1))
+}
+
+// At returns the address at an offset from the start of the range, which must
+// be less than its size.
+func (r *AddressRange) At(offset *big.Int) net.IP {
+	return offsetIP(r.Start, offset)
+}
+
+// normalizeIP returns the 4 or 16-byte representation of an address.
+func normalizeIP(ip net.IP, length int) net.IP {
+	if length == net.IPv4len {
+		return ip.To4()
+	}
+	return ip.To16()
+}
+
+// offsetIP returns the address at the given offset from the start of a range.
+func offsetIP(start net.IP, offset *big.Int) net.IP {
+	n := new(big.Int).Add(new(big.Int).SetBytes(start), offset).Bytes()
+	ip := make(net.IP, len(start))
+	copy(ip[len(ip)-len(n):], n)
+	return ip
+}
+
+// parseRange parses a range of the form `<start>-<end>`, within a prefix.
+func parseRange(s string, prefix *net.IPNet) (*AddressRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("malformed range `%s`, must be <start>-<end>", s)
+	}
+	var r AddressRange
+	for i, b := range bounds {
+		ip := net.ParseIP(strings.TrimSpace(b))
+		if ip == nil {
+			return nil, fmt.Errorf("malformed address `%s` in range `%s`", b, s)
+		}
+		if !prefix.Contains(ip) {
+			return nil, fmt.Errorf("range `%s` is not in %s", s, prefix)
+		}
+		if ip = normalizeIP(ip, len(prefix.IP)); i == 0 {
+			r.Start = ip
+		} else {
+			r.End = ip
+		}
+	}
+	if bytes.Compare(r.Start, r.End) > 0 {
+		return nil, fmt.Errorf("range `%s` ends before it starts", s)
+	}
+	return &r, nil
+}
+
+// Split is the share of the range of a subnet served by one of the two
+// servers of a split scope: the lower part of the range for one of them, the
+// upper part for the other.
+type Split struct {
+	Upper   bool
+	Percent int
+}
+
+func (s *Split) String() string {
+	if s.Upper {
+		return fmt.Sprintf("upper %d%%", s.Percent)
+	}
+	return fmt.Sprintf("lower %d%%", s.Percent)
+}
+
+// parseSplit parses a split of the form `lower <percent>%` or
+// `upper <percent>%`.
+func parseSplit(s string) (*Split, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 || (fields[0] != "lower" && fields[0] != "upper") {
+		return nil, fmt.Errorf("malformed split `%s`, must be lower|upper <percent>%%", s)
+	}
+	percent, err := strconv.Atoi(strings.TrimSuffix(fields[1], "%"))
+	if err != nil || percent < 1 || percent > 99 {
+		return nil, fmt.Errorf("invalid percentage in split `%s`, must be between 1%% and 99%%", s)
+	}
+	return &Split{Upper: fields[0] == "upper", Percent: percent}, nil
+}
+
+// Apply returns the share of a range described by the split. The lower p% and
+// the upper (100-p)% of a range are always complementary: the boundary is
+// rounded down so that both servers agree on it.
+func (s *Split) Apply(r *AddressRange) *AddressRange {
+	size := r.Size()
+	lowerPercent := s.Percent
+	if s.Upper {
+		lowerPercent = 100 - s.Percent
+	}
+	lower := new(big.Int).Mul(size, big.NewInt(int64(lowerPercent)))
+	lower.Div(lower, big.NewInt(100))
+	if s.Upper {
+		if lower.Cmp(size) == 0 {
+			return nil
+		}
+		return &AddressRange{Start: offsetIP(r.Start, lower), End: r.End}
+	}
+	if lower.Sign() == 0 {
+		return nil
+	}
+	return &AddressRange{Start: r.Start, End: offsetIP(r.Start, lower.Sub(lower, big.NewInt(1)))}
+}
+
+// Pool returns the addresses of the subnet served by the server: its whole
+// range, or the share of it given by its split. It is nil if the subnet has no
+// range or if its share is empty.
+func (s *SubnetConfig) Pool() *AddressRange {
+	if s.Range == nil || s.Split == nil {
+		return s.Range
+	}
+	return s.Split.Apply(s.Range)
+}
+
+// validatePools checks that the pools of the subnets do not overlap.
+func validatePools(networks []*NetworkConfig) error {
+	var subnets []*SubnetConfig
+	for _, n := range networks {
+		for _, s := range n.Subnets {
+			pool := s.Pool()
+			if pool == nil {
+				if s.Range != nil {
+					return ConfigErrorFromString("subnet %s: split %s of range %s is empty", s.Prefix, s.Split, s.Range)
+				}
+				continue
+			}
+			for _, other := range subnets {
+				if pool.Overlaps(other.Pool()) {
+					return ConfigErrorFromString("subnet %s: range %s overlaps with range %s of subnet %s", s.Prefix, pool, other.Pool(), other.Prefix)
+				}
+			}
+			subnets = append(subnets, s)
+		}
+	}
+	return nil
+}
+
+// CheckSplit verifies the split scope of two servers, given their option
+// levels, and returns the problems found: every split subnet of either server
+// must be defined by the other with the same range and the complementary
+// split, so that the two pools cover the range without overlapping.
+func CheckSplit(local, peer *OptionLevels) []error {
+	var problems []error
+	find := func(levels *OptionLevels, prefix *net.IPNet) *SubnetConfig {
+		for _, n := range levels.Networks {
+			for _, s := range n.Subnets {
+				if s.Prefix.String() == prefix.String() {
+					return s
+				}
+			}
+		}
+		return nil
+	}
+	check := func(a, b *OptionLevels, name string, reverse bool) {
+		for _, n := range a.Networks {
+			for _, s := range n.Subnets {
+				if s.Split == nil {
+					continue
+				}
+				o := find(b, s.Prefix)
+				switch {
+				case o == nil || o.Range == nil:
+					problems = append(problems, fmt.Errorf("subnet %s: split %s, but no range on the %s server", s.Prefix, s.Split, name))
+				case o.Split == nil:
+					problems = append(problems, fmt.Errorf("subnet %s: split %s, but the %s server serves the whole range", s.Prefix, s.Split, name))
+				case reverse:
+					// the subnets split on both servers are checked once
+				case o.Range.String() != s.Range.String():
+					problems = append(problems, fmt.Errorf("subnet %s: range %s, but %s on the %s server", s.Prefix, s.Range, o.Range, name))
+				case o.Split.Upper == s.Split.Upper || o.Split.Percent+s.Split.Percent != 100:
+					problems = append(problems, fmt.Errorf("subnet %s: split %s is not complementary to split %s of the %s server", s.Prefix, s.Split, o.Split, name))
+				default:
+					if p, q := s.Pool(), o.Pool(); p != nil && q != nil && p.Overlaps(q) {
+						problems = append(problems, fmt.Errorf("subnet %s: pool %s overlaps with pool %s of the %s server", s.Prefix, p, q, name))
+					}
+				}
+			}
+		}
+	}
+	check(local, peer, "peer", false)
+	check(peer, local, "local", true)
+	return problems
+}
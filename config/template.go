@@ -0,0 +1,87 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig"
+)
+
+// TemplateExt is the file extension of configuration templates. A file named
+// `config.yml.tmpl` is rendered as a template, and the result is parsed as YAML.
+const TemplateExt = ".tmpl"
+
+// HostFacts holds information about the host that is made available to
+// configuration templates.
+type HostFacts struct {
+	// Hostname is the host name reported by the kernel.
+	Hostname string
+	// Interfaces maps interface names to the IP addresses configured on
+	// them, without prefix length.
+	Interfaces map[string][]string
+	// Env maps environment variable names to their values.
+	Env map[string]string
+}
+
+// GetHostFacts collects the HostFacts of the local host.
+func GetHostFacts() (*HostFacts, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	facts := HostFacts{
+		Hostname:   hostname,
+		Interfaces: make(map[string][]string),
+		Env:        make(map[string]string),
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP.String())
+			}
+		}
+		facts.Interfaces[iface.Name] = ips
+	}
+	for _, kv := range os.Environ() {
+		tokens := strings.SplitN(kv, "=", 2)
+		if len(tokens) == 2 {
+			facts.Env[tokens[0]] = tokens[1]
+		}
+	}
+	return &facts, nil
+}
+
+// renderTemplate reads the template file and renders it with the sprig
+// functions and the local host facts.
+func renderTemplate(filename string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filename).Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, ConfigErrorFromError(err)
+	}
+	facts, err := GetHostFacts()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, facts); err != nil {
+		return nil, ConfigErrorFromError(err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,40 @@
+package config
+
+// TracingConfig holds the configuration of the OpenTelemetry tracing of the
+// request handling.
+type TracingConfig struct {
+	// Endpoint is the address of the OTLP/gRPC collector.
+	Endpoint string
+	Insecure bool
+	// SampleRatio is the ratio of transactions that are traced, between 0
+	// and 1.
+	SampleRatio float64
+}
+
+// parseTracingConfig parses the optional `tracing` section, for example:
+//
+//	tracing:
+//	    endpoint: localhost:4317
+//	    insecure: true
+//	    sample_ratio: 0.1
+func (c *Config) parseTracingConfig() error {
+	if c.v.Get("tracing") == nil {
+		return nil
+	}
+	tc := TracingConfig{
+		Endpoint:    c.v.GetString("tracing.endpoint"),
+		Insecure:    c.v.GetBool("tracing.insecure"),
+		SampleRatio: 1,
+	}
+	if tc.Endpoint == "" {
+		return ConfigErrorFromString("tracing: missing `tracing.endpoint` directive")
+	}
+	if c.v.Get("tracing.sample_ratio") != nil {
+		tc.SampleRatio = c.v.GetFloat64("tracing.sample_ratio")
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		return ConfigErrorFromString("tracing: `sample_ratio` must be between 0 and 1")
+	}
+	c.Tracing = &tc
+	return nil
+}
@@ -0,0 +1,362 @@
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultPrefix is the prefix of the configuration values fetched from
+// HashiCorp Vault, e.g. `vault:secret/data/coredhcp/mysql#password` for
+// the `password` field of the secret at `secret/data/coredhcp/mysql`.
+const VaultPrefix = "vault:"
+
+// vaultRef matches the references to Vault in the configuration values: whole
+// values, or words of the arguments of the plugins.
+var vaultRef = regexp.MustCompile(`(^|\s)` + VaultPrefix + `\S+`)
+
+// vaultRenewInterval is the interval between the checks of the token and of
+// the leases of the secrets, which are renewed when half of their TTL is
+// left.
+const vaultRenewInterval = time.Minute
+
+// vaultSecret is a secret read from Vault.
+type vaultSecret struct {
+	data      map[string]interface{}
+	leaseID   string
+	renewable bool
+	// expires is zero for the secrets without lease, e.g. of the KV store
+	expires time.Time
+	ttl     time.Duration
+}
+
+// vaultClient reads the secrets from Vault, caches them, and renews its
+// token and their leases.
+type vaultClient struct {
+	addr   string
+	token  string
+	client *http.Client
+
+	lock    sync.Mutex
+	secrets map[string]*vaultSecret
+	// tokenExpires is zero for the tokens that do not expire
+	tokenExpires time.Time
+	tokenTTL     time.Duration
+	renewing     bool
+}
+
+// vault is the client shared by the configurations, so that a reload reuses
+// the secrets and leases fetched before.
+var (
+	vaultLock sync.Mutex
+	vault     *vaultClient
+)
+
+// getVault returns the Vault client, configured by the `vault` section, for
+// example:
+//
+//	vault:
+//	    address: https://vault.example.com:8200
+//	    token-file: /run/secrets/vault-token
+//	    ca-cert: /etc/coredhcp/vault-ca.pem
+//
+// or by the VAULT_ADDR, VAULT_TOKEN and VAULT_CACERT environment variables.
+func (c *Config) getVault() (*vaultClient, error) {
+	vaultLock.Lock()
+	defer vaultLock.Unlock()
+	if vault != nil {
+		return vault, nil
+	}
+	addr := c.v.GetString("vault.address")
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if file := c.v.GetString("vault.token-file"); file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if addr == "" || token == "" {
+		return nil, errors.New("need the address and the token of Vault, in the `vault` section or the VAULT_ADDR and VAULT_TOKEN variables")
+	}
+	conf := &tls.Config{}
+	ca := c.v.GetString("vault.ca-cert")
+	if ca == "" {
+		ca = os.Getenv("VAULT_CACERT")
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificate in %s", ca)
+		}
+	}
+	vc := vaultClient{
+		addr:    strings.TrimSuffix(addr, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{TLSClientConfig: conf}},
+		secrets: make(map[string]*vaultSecret),
+	}
+	if err := vc.lookupToken(); err != nil {
+		return nil, err
+	}
+	vault = &vc
+	return vault, nil
+}
+
+// do sends a request to the Vault API, and decodes the response into v.
+func (vc *vaultClient) do(method, path string, body, v interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, vc.addr+"/v1/"+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", vc.token)
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("vault: %s %s: %s %s", method, path, resp.Status, strings.Join(e.Errors, ", "))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// lookupToken reads the TTL of the token.
+func (vc *vaultClient) lookupToken() error {
+	var resp struct {
+		Data struct {
+			TTL       int64 `json:"ttl"`
+			Renewable bool  `json:"renewable"`
+		} `json:"data"`
+	}
+	if err := vc.do(http.MethodGet, "auth/token/lookup-self", nil, &resp); err != nil {
+		return err
+	}
+	vc.lock.Lock()
+	defer vc.lock.Unlock()
+	vc.tokenExpires, vc.tokenTTL = time.Time{}, 0
+	if resp.Data.TTL > 0 && resp.Data.Renewable {
+		vc.tokenTTL = time.Duration(resp.Data.TTL) * time.Second
+		vc.tokenExpires = time.Now().Add(vc.tokenTTL)
+	}
+	return nil
+}
+
+// secret returns the secret at a path, from the cache if its lease is not
+// expired.
+func (vc *vaultClient) secret(path string) (*vaultSecret, error) {
+	now := time.Now()
+	vc.lock.Lock()
+	s, ok := vc.secrets[path]
+	vc.lock.Unlock()
+	if ok && (s.expires.IsZero() || now.Before(s.expires)) {
+		return s, nil
+	}
+	var resp struct {
+		LeaseID       string                 `json:"lease_id"`
+		Renewable     bool                   `json:"renewable"`
+		LeaseDuration int64                  `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := vc.do(http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	s = &vaultSecret{data: resp.Data, leaseID: resp.LeaseID, renewable: resp.Renewable}
+	// the version 2 of the KV store nests the fields
+	if inner, ok := resp.Data["data"].(map[string]interface{}); ok {
+		if _, ok := resp.Data["metadata"]; ok {
+			s.data = inner
+		}
+	}
+	if resp.LeaseID != "" && resp.LeaseDuration > 0 {
+		s.ttl = time.Duration(resp.LeaseDuration) * time.Second
+		s.expires = now.Add(s.ttl)
+	}
+	vc.lock.Lock()
+	vc.secrets[path] = s
+	start := !vc.renewing && (s.renewable || !vc.tokenExpires.IsZero())
+	if start {
+		vc.renewing = true
+	}
+	vc.lock.Unlock()
+	if start {
+		go vc.renew()
+	}
+	return s, nil
+}
+
+// resolve returns the value of a `vault:<path>#<field>` reference.
+func (vc *vaultClient) resolve(ref string) (string, error) {
+	ref = strings.TrimPrefix(ref, VaultPrefix)
+	sep := strings.LastIndex(ref, "#")
+	if sep < 0 {
+		return "", fmt.Errorf("vault: missing `#<field>` in the reference `%s`", ref)
+	}
+	path, field := ref[:sep], ref[sep+1:]
+	s, err := vc.secret(path)
+	if err != nil {
+		return "", err
+	}
+	v, ok := s.data[field]
+	if !ok {
+		return "", fmt.Errorf("vault: no field `%s` in the secret `%s`", field, path)
+	}
+	return fmt.Sprint(v), nil
+}
+
+// renew renews the token and the leases of the secrets when half of their
+// TTL is left, forever. The secrets whose lease cannot be renewed anymore are
+// fetched again by the next reload of the configuration.
+func (vc *vaultClient) renew() {
+	for now := range time.Tick(vaultRenewInterval) {
+		vc.lock.Lock()
+		renewToken := !vc.tokenExpires.IsZero() && vc.tokenExpires.Sub(now) < vc.tokenTTL/2
+		var leases []*vaultSecret
+		for _, s := range vc.secrets {
+			if s.renewable && !s.expires.IsZero() && now.Before(s.expires) && s.expires.Sub(now) < s.ttl/2 {
+				leases = append(leases, s)
+			}
+		}
+		vc.lock.Unlock()
+		if renewToken {
+			var resp struct{}
+			if err := vc.do(http.MethodPost, "auth/token/renew-self", struct{}{}, &resp); err != nil {
+				log.Printf("vault: cannot renew the token: %v", err)
+			} else if err := vc.lookupToken(); err != nil {
+				log.Printf("vault: cannot read the TTL of the token: %v", err)
+			}
+		}
+		for _, s := range leases {
+			var resp struct {
+				LeaseDuration int64 `json:"lease_duration"`
+				Renewable     bool  `json:"renewable"`
+			}
+			err := vc.do(http.MethodPut, "sys/leases/renew", map[string]string{"lease_id": s.leaseID}, &resp)
+			if err != nil {
+				log.Printf("vault: cannot renew the lease %s: %v", s.leaseID, err)
+				continue
+			}
+			vc.lock.Lock()
+			s.renewable = resp.Renewable
+			s.ttl = time.Duration(resp.LeaseDuration) * time.Second
+			s.expires = now.Add(s.ttl)
+			vc.lock.Unlock()
+			if !resp.Renewable {
+				log.Printf("vault: the lease %s reached its maximum TTL, its secret is fetched again on the next reload", s.leaseID)
+			}
+		}
+	}
+}
+
+// resolveSecrets replaces the references to Vault in the configuration values
+// with the secrets, including in lists and maps, e.g. of tokens, and in the
+// arguments of the plugins.
+func (c *Config) resolveSecrets() error {
+	var vc *vaultClient
+	var walk func(v interface{}) (interface{}, bool, error)
+	walk = func(v interface{}) (interface{}, bool, error) {
+		switch t := v.(type) {
+		case string:
+			if !vaultRef.MatchString(t) {
+				return v, false, nil
+			}
+			if vc == nil {
+				var err error
+				if vc, err = c.getVault(); err != nil {
+					return nil, false, err
+				}
+			}
+			var err error
+			s := vaultRef.ReplaceAllStringFunc(t, func(ref string) string {
+				// keep the separator before the reference
+				sep := strings.Index(ref, VaultPrefix)
+				secret, rerr := vc.resolve(ref[sep:])
+				if rerr != nil && err == nil {
+					err = rerr
+				}
+				return ref[:sep] + secret
+			})
+			if err != nil {
+				return nil, false, err
+			}
+			return s, true, nil
+		case []interface{}:
+			changed := false
+			ret := make([]interface{}, len(t))
+			for i, item := range t {
+				r, ch, err := walk(item)
+				if err != nil {
+					return nil, false, err
+				}
+				ret[i], changed = r, changed || ch
+			}
+			return ret, changed, nil
+		case map[string]interface{}:
+			changed := false
+			ret := make(map[string]interface{}, len(t))
+			for k, item := range t {
+				r, ch, err := walk(item)
+				if err != nil {
+					return nil, false, err
+				}
+				ret[k], changed = r, changed || ch
+			}
+			return ret, changed, nil
+		case map[interface{}]interface{}:
+			changed := false
+			ret := make(map[interface{}]interface{}, len(t))
+			for k, item := range t {
+				r, ch, err := walk(item)
+				if err != nil {
+					return nil, false, err
+				}
+				ret[k], changed = r, changed || ch
+			}
+			return ret, changed, nil
+		}
+		return v, false, nil
+	}
+	for _, key := range c.v.AllKeys() {
+		raw := c.v.Get(key)
+		v, changed, err := walk(raw)
+		if err != nil {
+			return ConfigErrorFromString("%s: %v", key, err)
+		}
+		if changed {
+			if c.references == nil {
+				c.references = make(map[string]interface{})
+			}
+			c.references[key] = raw
+			c.v.Set(key, v)
+		}
+	}
+	return nil
+}
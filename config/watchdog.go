@@ -0,0 +1,58 @@
+package config
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"time"
+)
+
+// WatchdogConfig holds the configuration of the detection of rogue DHCP
+// servers on the local segments.
+type WatchdogConfig struct {
+	// Trusted4 are the DHCPv4 server identifiers of the other legitimate
+	// servers, e.g. a HA peer. The addresses of this host are always
+	// trusted.
+	Trusted4 []net.IP
+	// Trusted6 are the DUIDs of the other legitimate DHCPv6 servers, in
+	// hex. The DUID of this server is always trusted.
+	Trusted6 []string
+	// ProbeInterval, if not zero, is the interval between the DISCOVER and
+	// SOLICIT probes that make the servers answer, since their OFFERs and
+	// ADVERTISEs to other clients are not always seen.
+	ProbeInterval time.Duration
+	// Interfaces are the interfaces the SOLICIT probes are sent on.
+	Interfaces []string
+}
+
+// parseWatchdogConfig parses the optional `watchdog` section, for example:
+//
+//	watchdog:
+//	    trusted: [192.0.2.2, '00:01:00:01:2a:3b:4c:5d:00:11:22:33:44:55']
+//	    probe-interval: 5m
+//	    interfaces: [eth0]
+func (c *Config) parseWatchdogConfig() error {
+	if c.v.Get("watchdog") == nil {
+		return nil
+	}
+	wc := WatchdogConfig{
+		ProbeInterval: c.v.GetDuration("watchdog.probe-interval"),
+		Interfaces:    c.v.GetStringSlice("watchdog.interfaces"),
+	}
+	for _, id := range c.v.GetStringSlice("watchdog.trusted") {
+		if ip := net.ParseIP(id); ip != nil && ip.To4() != nil {
+			wc.Trusted4 = append(wc.Trusted4, ip.To4())
+			continue
+		}
+		duid := strings.ToLower(strings.Replace(id, ":", "", -1))
+		if _, err := hex.DecodeString(duid); err != nil || duid == "" {
+			return ConfigErrorFromString("watchdog: invalid trusted server identifier `%s`, must be an IPv4 address or a DUID", id)
+		}
+		wc.Trusted6 = append(wc.Trusted6, duid)
+	}
+	if wc.ProbeInterval < 0 {
+		return ConfigErrorFromString("watchdog: probe interval cannot be negative")
+	}
+	c.Watchdog = &wc
+	return nil
+}
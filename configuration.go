@@ -0,0 +1,80 @@
+package coredhcp
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// Pools returns the subnets with a range of dynamic addresses of the running
+// configuration, of DHCPv6 and then of DHCPv4, in the order of the
+// configuration.
+func (s *Server) Pools() []*config.SubnetConfig {
+	s.handlersLock.RLock()
+	conf := s.Config
+	s.handlersLock.RUnlock()
+	var pools []*config.SubnetConfig
+	for _, sc := range []*config.ServerConfig{conf.Server6, conf.Server4} {
+		if sc == nil || sc.Options == nil {
+			continue
+		}
+		for _, network := range sc.Options.Networks {
+			for _, subnet := range network.Subnets {
+				if subnet.Range != nil {
+					pools = append(pools, subnet)
+				}
+			}
+		}
+	}
+	return pools
+}
+
+// registerConfigHandlers registers the endpoint of the running configuration,
+// in canonical YAML, with the defaults filled in if `effective` is true. The
+// configuration can hold secrets, so it requires the admin role. It also
+// registers the endpoint of the report of the last reload, see Reload.
+func (s *Server) registerConfigHandlers(m *management.Server) {
+	m.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		effective := false
+		if v := r.URL.Query().Get("effective"); v != "" {
+			var err error
+			if effective, err = strconv.ParseBool(v); err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		s.handlersLock.RLock()
+		conf := s.Config
+		s.handlersLock.RUnlock()
+		data, err := conf.Marshal(effective)
+		if err != nil {
+			management.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(data)
+	})
+	m.Require("/config", management.RoleAdmin)
+	m.HandleFunc("/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		report := s.LastReload()
+		if report == nil {
+			management.WriteError(w, http.StatusNotFound, errors.New("the configuration was not reloaded"))
+			return
+		}
+		management.WriteJSON(w, http.StatusOK, report)
+	})
+	m.Require("/config/reload", management.RoleAdmin)
+}
@@ -1,15 +1,26 @@
 package coredhcp
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dualstack"
 	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
 	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/metadata"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/sirupsen/logrus"
 )
 
 var log = logger.GetLogger()
@@ -17,35 +28,110 @@ var log = logger.GetLogger()
 // Server is a CoreDHCP server structure that holds information about
 // DHCPv6 and DHCPv4 servers, and their respective handlers.
 type Server struct {
-	Handlers6 []handler.Handler6
-	Handlers4 []handler.Handler4
-	Config    *config.Config
-	Server6   *dhcpv6.Server
-	Server4   *dhcpv4.Server
-	errors    chan error
+	// abandoned is the number of chains that exceeded their deadline and
+	// are still running, used atomically. It comes first for its 64-bit
+	// alignment.
+	abandoned int64
+	// handlersLock protects Handlers6, Handlers4 and Config, which can be
+	// replaced at runtime by Reload.
+	handlersLock sync.RWMutex
+	Handlers6    []handler.Handler6
+	Handlers4    []handler.Handler4
+	// names6 and names4 hold the plugin names of each handler, in the same
+	// order as Handlers6 and Handlers4.
+	names6 []string
+	names4 []string
+	Config *config.Config
+	// listener6 and listener4 are the DHCPv6 and DHCPv4 listeners, if
+	// configured. They are created by Start.
+	listener6 *listener
+	listener4 *listener
+	// Recorder, if not nil, records every request and its response.
+	Recorder *Recorder
+	// Capture, if not nil, mirrors the matching traffic to a pcap file.
+	Capture *Capture
+	// AuditLog, if not nil, records every lease decision.
+	AuditLog *AuditLog
+	// History, if not nil, keeps the last transactions of each client. It is
+	// created by Start if the management listener is enabled.
+	History *History
+	// Quarantine, if not nil, keeps the non-conforming requests. It is
+	// created by Start.
+	Quarantine *Quarantine
+	// Watchdog, if not nil, detects the rogue DHCP servers. It is created
+	// by Start if enabled in the configuration.
+	Watchdog *Watchdog
+	// Management is the management HTTP server, if enabled in the
+	// configuration. It is created by Start.
+	Management *management.Server
+	// loaded holds the plugins loaded by LoadPlugins.
+	loaded []*plugins.Plugin
+	// loadLock serializes the loading and the commit of the plugins by
+	// Start and Reload.
+	loadLock sync.Mutex
+	// statusLock protects listeners, which maps the name of each listener
+	// to nil if it is running, or to the reason why it is not.
+	statusLock sync.Mutex
+	listeners  map[string]error
+	errors     chan error
+	// shedder drops requests when the load shedding is enabled.
+	shedder loadShedder
+	// toggles holds the plugins disabled at runtime.
+	toggles pluginToggles
+	// stale keeps the last responses, to answer the requests whose chain
+	// exceeds its deadline.
+	stale staleCache
+	// reloadLock protects lastReload, the report of the last reload, if
+	// any.
+	reloadLock sync.Mutex
+	lastReload *ReloadReport
+}
+
+// ReloadReport is the outcome of a reload of the configuration.
+type ReloadReport struct {
+	Time time.Time `json:"time"`
+	// Error is the reason why the reload failed, if it did. The changes
+	// are the ones that were rejected.
+	Error string `json:"error,omitempty"`
+	// Restart is true if the listeners changed, which takes a restart.
+	Restart bool            `json:"restart,omitempty"`
+	Changes []config.Change `json:"changes"`
 }
 
 // LoadPlugins reads a Config object and loads the plugins as specified in the
 // `plugins` section, in order. For a plugin to be available, it must have been
 // previously registered with plugins.RegisterPlugin. This is normally done at
 // plugin import time.
+// The side effects of the plugins, e.g. their listeners or their background
+// tasks, are staged until the configuration is committed by Start, Reload or
+// Embed, so that a configuration can be loaded to be checked without them.
 func (s *Server) LoadPlugins(conf *config.Config) ([]*plugins.Plugin, error) {
 	log.Print("Loading plugins...")
 	loadedPlugins := make([]*plugins.Plugin, 0)
+	discardPlugins()
 
-	if conf.Server4 != nil {
-		return nil, errors.New("plugin loading for DHCPv4 not implemented yet")
-	}
-	// load v6 plugins
-	if conf.Server6 == nil {
-		return nil, errors.New("no configuration found for DHCPv6 server")
+	if conf.Server6 == nil && conf.Server4 == nil {
+		return nil, errors.New("no configuration found for either DHCPv6 or DHCPv4 server")
 	}
 	// now load the plugins. We need to call its setup function with
 	// the arguments extracted above. The setup function is mapped in
 	// plugins.RegisteredPlugins .
-	for _, pluginConf := range conf.Server6.Plugins {
-		if plugin, ok := plugins.RegisteredPlugins[pluginConf.Name]; ok {
-			log.Printf("Loading plugin `%s`", pluginConf.Name)
+	if err := validateChain("dhcpv6", conf.Server6); err != nil {
+		return nil, err
+	}
+	if err := validateChain("dhcpv4", conf.Server4); err != nil {
+		return nil, err
+	}
+	if conf.Server6 != nil {
+		for _, pluginConf := range conf.Server6.Plugins {
+			plugin, ok := plugins.RegisteredPlugins[pluginConf.Name]
+			if !ok {
+				return nil, config.ConfigErrorFromString("unknown plugin `%s`", pluginConf.Name)
+			}
+			if plugin.Setup6 == nil {
+				return nil, config.ConfigErrorFromString("plugin `%s` does not support DHCPv6", pluginConf.Name)
+			}
+			log.Printf("Loading plugin `%s` for DHCPv6", pluginConf.Name)
 			h6, err := plugin.Setup6(pluginConf.Args...)
 			if err != nil {
 				return nil, err
@@ -54,82 +140,583 @@ func (s *Server) LoadPlugins(conf *config.Config) ([]*plugins.Plugin, error) {
 			if h6 == nil {
 				return nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s", pluginConf.Name)
 			}
+			if h6, err = overrideHandler6(conf.Server6, pluginConf, plugin, h6); err != nil {
+				return nil, err
+			}
+			if limits := conf.Server6.Limits[pluginConf.Name]; limits != nil {
+				h6 = sandbox6(pluginConf.Name, h6, limits)
+			}
 			s.Handlers6 = append(s.Handlers6, h6)
-			//s.Handlers4 = append(s.Handlers4, h4)
-		} else {
-			return nil, config.ConfigErrorFromString("unknown plugin `%s`", pluginConf.Name)
+			s.names6 = append(s.names6, pluginConf.Name)
+		}
+	}
+	if conf.Server4 != nil {
+		for _, pluginConf := range conf.Server4.Plugins {
+			plugin, ok := plugins.RegisteredPlugins[pluginConf.Name]
+			if !ok {
+				return nil, config.ConfigErrorFromString("unknown plugin `%s`", pluginConf.Name)
+			}
+			if plugin.Setup4 == nil {
+				return nil, config.ConfigErrorFromString("plugin `%s` does not support DHCPv4", pluginConf.Name)
+			}
+			log.Printf("Loading plugin `%s` for DHCPv4", pluginConf.Name)
+			h4, err := plugin.Setup4(pluginConf.Args...)
+			if err != nil {
+				return nil, err
+			}
+			loadedPlugins = append(loadedPlugins, plugin)
+			if h4 == nil {
+				return nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s", pluginConf.Name)
+			}
+			if h4, err = overrideHandler4(conf.Server4, pluginConf, plugin, h4); err != nil {
+				return nil, err
+			}
+			if limits := conf.Server4.Limits[pluginConf.Name]; limits != nil {
+				h4 = sandbox4(pluginConf.Name, h4, limits)
+			}
+			s.Handlers4 = append(s.Handlers4, h4)
+			s.names4 = append(s.names4, pluginConf.Name)
 		}
 	}
 
+	s.loaded = append(s.loaded, loadedPlugins...)
 	return loadedPlugins, nil
 }
 
+// discardPlugins drops the side effects staged by the plugins and not
+// committed.
+func discardPlugins() {
+	for _, plugin := range plugins.RegisteredPlugins {
+		if plugin.Discard != nil {
+			plugin.Discard()
+		}
+	}
+}
+
+// commitPlugins applies the side effects staged by the plugins, once the
+// configuration they were loaded for is in use. The registered plugins that
+// are not loaded stop theirs. The plugins are committed in the order of their
+// names.
+func commitPlugins(loaded []*plugins.Plugin) {
+	names := make([]string, 0, len(plugins.RegisteredPlugins))
+	for name, plugin := range plugins.RegisteredPlugins {
+		if plugin.Commit != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		plugin := plugins.RegisteredPlugins[name]
+		in := false
+		for _, p := range loaded {
+			if p == plugin {
+				in = true
+				break
+			}
+		}
+		plugin.Commit(in)
+	}
+}
+
+// Reload loads the plugins from a new configuration and atomically replaces
+// the running handlers with them. If loading fails, the running handlers are
+// left untouched. Listener changes are not applied, and require a restart.
+// The changes from the running configuration are logged, and reported by
+// LastReload.
+func (s *Server) Reload(conf *config.Config) error {
+	log.Print("Reloading configuration")
+	s.handlersLock.RLock()
+	report := ReloadReport{
+		Time:    time.Now(),
+		Restart: !sameListener(s.Config.Server6, conf.Server6) || !sameListener(s.Config.Server4, conf.Server4),
+		Changes: config.Diff(s.Config, conf),
+	}
+	s.handlersLock.RUnlock()
+	s.loadLock.Lock()
+	defer s.loadLock.Unlock()
+	var tmp Server
+	if _, err := tmp.LoadPlugins(conf); err != nil {
+		report.Error = err.Error()
+		s.setLastReload(&report)
+		return err
+	}
+	s.handlersLock.Lock()
+	for _, change := range report.Changes {
+		log.WithFields(logrus.Fields{"kind": change.Kind, "key": change.Key}).Printf("Configuration change: %s", change)
+	}
+	log.Printf("Reloaded configuration with %d changes", len(report.Changes))
+	if report.Restart {
+		log.Print("Listener configuration changed, restart the server to apply it")
+	}
+	s.setLastReload(&report)
+	s.Handlers6 = tmp.Handlers6
+	s.Handlers4 = tmp.Handlers4
+	s.names6 = tmp.names6
+	s.names4 = tmp.names4
+	s.loaded = tmp.loaded
+	s.Config = conf
+	metadata.Set(conf.Server6, conf.Server4)
+	s.handlersLock.Unlock()
+	// the plugins are committed out of the lock of the handlers, as they
+	// can take a while, e.g. to bind their listeners
+	commitPlugins(tmp.loaded)
+	return nil
+}
+
+func (s *Server) setLastReload(report *ReloadReport) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.lastReload = report
+}
+
+// LastReload returns the report of the last reload, or nil if the
+// configuration was not reloaded.
+func (s *Server) LastReload() *ReloadReport {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	return s.lastReload
+}
+
+// validateChain checks the order of the plugins of a server configuration,
+// which can be nil, against their constraints.
+func validateChain(proto string, sc *config.ServerConfig) error {
+	if sc == nil {
+		return nil
+	}
+	names := make([]string, 0, len(sc.Plugins))
+	for _, p := range sc.Plugins {
+		names = append(names, p.Name)
+	}
+	if err := plugins.ValidateChain(names); err != nil {
+		return config.ConfigErrorFromString("%s: %v", proto, err)
+	}
+	return nil
+}
+
+func sameListener(a, b *config.ServerConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Listener.String() == b.Listener.String()
+}
+
+// optionLevels returns the option definitions of a server configuration,
+// which can be nil.
+func optionLevels(sc *config.ServerConfig) *config.OptionLevels {
+	if sc == nil {
+		return nil
+	}
+	return sc.Options
+}
+
+// chainSkips holds what decides which plugins a chain skips: the plugins
+// disabled at runtime, and the feature gates of the server.
+type chainSkips struct {
+	toggles map[string]*DisabledPlugin
+	gates   map[string]string
+	now     time.Time
+}
+
+type chainSkipsKey struct{}
+
+// withSkips returns a context for a chain that skips the plugins disabled at
+// runtime, and the ones gated by a feature flag disabled for the client.
+func (s *Server) withSkips(ctx context.Context, gates map[string]string) context.Context {
+	return context.WithValue(ctx, chainSkipsKey{}, &chainSkips{toggles: s.toggles.get(), gates: gates, now: time.Now()})
+}
+
+// skipPlugin returns whether a chain run with the context returned by
+// withSkips skips a plugin.
+func skipPlugin(ctx context.Context, name string) bool {
+	sk, ok := ctx.Value(chainSkipsKey{}).(*chainSkips)
+	if !ok {
+		return false
+	}
+	return disabled(sk.toggles, name, sk.now) || gated(ctx, sk.gates, name)
+}
+
+// chain6 runs the DHCPv6 handlers on a request, and returns the response and
+// the name of the plugin that interrupted the chain, if any.
+func (s *Server) chain6(ctx context.Context, req dhcpv6.DHCPv6) (resp dhcpv6.DHCPv6, stopper string) {
+	var stop bool
+	s.handlersLock.RLock()
+	handlers, names := s.Handlers6, s.names6
+	ctx = handler.NewContext(ctx, optionLevels(s.Config.Server6))
+	ctx = handler.WithFeatures(ctx, s.Config.Features, featureClient6(req))
+	ctx = s.withSkips(ctx, featureGates(s.Config.Server6))
+	dump := dumpFlag(s.Config.Server6)
+	s.handlersLock.RUnlock()
+	// dumped at the end of the chain, once the classes of the client are known
+	defer func() {
+		dumpOptions6(ctx, dump, "request", req)
+		dumpOptions6(ctx, dump, "response", resp)
+	}()
+	for idx, handler := range handlers {
+		if skipPlugin(ctx, names[idx]) {
+			continue
+		}
+		pctx, pspan := startPluginSpan(ctx, names[idx])
+		resp, stop = handler(pctx, req, resp)
+		pspan.End()
+		if stop {
+			return resp, names[idx]
+		}
+	}
+	return resp, ""
+}
+
+// chain4 is like chain6, but runs the DHCPv4 handlers.
+func (s *Server) chain4(ctx context.Context, req *dhcpv4.DHCPv4) (resp *dhcpv4.DHCPv4, stopper string) {
+	var stop bool
+	s.handlersLock.RLock()
+	handlers, names := s.Handlers4, s.names4
+	ctx = handler.NewContext(ctx, optionLevels(s.Config.Server4))
+	ctx = handler.WithFeatures(ctx, s.Config.Features, featureClient4(req))
+	ctx = s.withSkips(ctx, featureGates(s.Config.Server4))
+	dump := dumpFlag(s.Config.Server4)
+	s.handlersLock.RUnlock()
+	// dumped at the end of the chain, once the classes of the client are known
+	defer func() {
+		dumpOptions4(ctx, dump, "request", req)
+		dumpOptions4(ctx, dump, "response", resp)
+	}()
+	prepareRequest4(ctx, req)
+	for idx, handler := range handlers {
+		if skipPlugin(ctx, names[idx]) {
+			continue
+		}
+		pctx, pspan := startPluginSpan(ctx, names[idx])
+		resp, stop = handler(pctx, req, resp)
+		pspan.End()
+		if stop {
+			return resp, names[idx]
+		}
+	}
+	return resp, ""
+}
+
+// prepareRequest4 processes a DHCPv4 request before it is run through the
+// handlers, by chain4 and Simulate4: the options overloaded in the sname and
+// file fields are moved to the options.
+func prepareRequest4(ctx context.Context, req *dhcpv4.DHCPv4) {
+	if err := dhcputil.Unoverload4(req); err != nil {
+		logger.FromContext(ctx).Printf("Ignoring overloaded options: %v", err)
+	}
+}
+
+// encode4 returns the wire encoding of a response to a DHCPv4 request, sized
+// for the client and the interface: the options are overloaded if it is
+// enabled, and trimmed if the response is still too large.
+func (s *Server) encode4(ctx context.Context, req, resp *dhcpv4.DHCPv4) []byte {
+	var (
+		overload bool
+		mtu      int
+	)
+	s.handlersLock.RLock()
+	if sc := s.Config.Server4; sc != nil {
+		overload, mtu = sc.Overload, sc.MTU
+	}
+	s.handlersLock.RUnlock()
+	b, trimmed := dhcputil.Fit4(req, resp, dhcputil.MaxMessageSize4(req, mtu), overload)
+	if len(trimmed) > 0 {
+		logger.FromContext(ctx).Printf("Response too large for the client, left out options %v", trimmed)
+	}
+	// signed last, once the encoding is final
+	if err := handler.Sign(ctx, b); err != nil {
+		logger.FromContext(ctx).Printf("Cannot sign the response: %v", err)
+	}
+	return b
+}
+
 // MainHandler6 runs for every received DHCPv6 packet. It will run every
 // registered handler in sequence, and reply with the resulting response.
 // It will not reply if the resulting response is `nil`.
 func (s *Server) MainHandler6(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6) {
+	s.serve6(conn, peer, req, nil)
+}
+
+// serve6 is MainHandler6, and returns whether the request was passed over:
+// the plugin chain ran to its end without a response, rather than the request
+// being answered, or dropped on purpose, e.g. shed, quarantined or refused by
+// a plugin that stopped the chain. packet is the request as received, or nil
+// if unknown.
+func (s *Server) serve6(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6, packet []byte) bool {
 	var (
 		resp dhcpv6.DHCPv6
-		stop bool
+		// stopper is the name of the plugin that interrupted the chain,
+		// if any
+		stopper string
+		passed  bool
 	)
-	for _, handler := range s.Handlers6 {
-		resp, stop = handler(req, resp)
-		if stop {
-			break
-		}
+	if s.shed6(conn, peer, req) {
+		// dropped before any work, not to let a flood load the server
+		return false
 	}
-	if resp != nil {
-		if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
-			log.Printf("conn.Write to %v failed: %v", peer, err)
-		}
+	ctx, span := startTransaction6(peer, req)
+	defer span.End()
+	ctx = logger.WithCorrelationID(ctx, correlationID6(req))
+	ctx = handler.WithConn(handler.WithPeer(ctx, peer), conn)
+	ctx = handler.WithPacket(ctx, packet)
+	ctx = logger.WithLabels(ctx, metadata.OfServer(true, dhcputil.LinkAddress6(req)))
+	log := logger.FromContext(ctx)
+	if reason := s.checkRelay6(peer, req); reason != "" {
+		s.quarantine(ctx, "6", conn, peer, reason, received(ctx, req))
+	} else if query, ok := dhcpv4Query(req); ok {
+		resp, stopper = s.handleDHCPv4Query(ctx, conn, peer, req, query)
+	} else if reason := validateRequest6(req); reason != "" {
+		s.quarantine(ctx, "6", conn, peer, reason, received(ctx, req))
+	} else if forOtherServer6(req) {
+		discard(ctx, "6", conn)
 	} else {
+		resp, stopper = s.boundedChain6(ctx, req)
+		passed = resp == nil && stopper == ""
+		if reason := validateResponse6(req, resp); reason != "" {
+			reject(ctx, "6", conn, reason)
+			resp = nil
+		}
+		s.add4o6Server(req, resp)
+	}
+	endTransaction6(span, resp, stopper)
+	if s.Recorder != nil {
+		s.Recorder.Record6(peer, req, resp)
+	}
+	if s.AuditLog != nil {
+		s.AuditLog.Log6(peer, req, resp, stopper)
+	}
+	if s.History != nil {
+		s.History.Add6(peer, req, resp, stopper)
+	}
+	if s.Capture != nil {
+		s.Capture.Capture6(conn, peer, req, resp)
+	}
+	count6(conn, req, resp, metadata.OfServer(true, handler.Address6(ctx, req, resp)))
+	if resp == nil {
 		log.Print("Dropping request because response is nil")
+		return passed
+	}
+	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		log.Printf("conn.Write to %v failed: %v", peer, err)
 	}
+	return false
 }
 
 // MainHandler4 is like MainHandler6, but for DHCPv4 packets.
-func (s *Server) MainHandler4(conn net.PacketConn, peer net.Addr, d *dhcpv4.DHCPv4) {
-	log.Print(d.Summary())
+func (s *Server) MainHandler4(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	s.serve4(conn, peer, req, nil)
+}
+
+// broadcastPeer4 returns the address to send the reply to a request from
+// 0.0.0.0, of a client that has no address yet: the limited broadcast
+// address, on the port of the client.
+func broadcastPeer4(peer net.Addr) net.Addr {
+	if ua, ok := peer.(*net.UDPAddr); ok && ua.IP.IsUnspecified() {
+		return &net.UDPAddr{IP: net.IPv4bcast, Port: ua.Port}
+	}
+	return peer
+}
+
+// serve4 is like serve6, but for DHCPv4 packets.
+func (s *Server) serve4(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4, packet []byte) bool {
+	if s.shed4(conn, peer, req) {
+		return false
+	}
+	ctx, span := startTransaction4(peer, req)
+	defer span.End()
+	ctx = logger.WithCorrelationID(ctx, correlationID4(req))
+	ctx = handler.WithConn(handler.WithPeer(ctx, peer), conn)
+	ctx = handler.WithSigner(handler.WithPacket(ctx, packet))
+	ctx = logger.WithLabels(ctx, metadata.OfServer(false, handler.Address4(ctx, req, nil)))
+	log := logger.FromContext(ctx)
+	var (
+		resp    *dhcpv4.DHCPv4
+		stopper string
+		passed  bool
+	)
+	if reason := s.checkRelay4(peer, req); reason != "" {
+		s.quarantine(ctx, "4", conn, peer, reason, received(ctx, req))
+	} else if reason := validateRequest4(req); reason != "" {
+		s.quarantine(ctx, "4", conn, peer, reason, received(ctx, req))
+	} else if forOtherServer4(req) {
+		discard(ctx, "4", conn)
+	} else {
+		resp, stopper = s.boundedChain4(ctx, req)
+		passed = resp == nil && stopper == ""
+		if reason := validateResponse4(req, resp); reason != "" {
+			reject(ctx, "4", conn, reason)
+			resp = nil
+		}
+	}
+	endTransaction4(span, resp, stopper)
+	if s.Recorder != nil {
+		s.Recorder.Record4(peer, req, resp)
+	}
+	if s.AuditLog != nil {
+		s.AuditLog.Log4(peer, req, resp, stopper)
+	}
+	if s.History != nil {
+		s.History.Add4(peer, req, resp, stopper)
+	}
+	if s.Capture != nil {
+		s.Capture.Capture4(conn, peer, req, resp)
+	}
+	count4(conn, req, resp, metadata.OfServer(false, handler.Address4(ctx, req, resp)))
+	if resp == nil {
+		log.Print("Dropping request because response is nil")
+		return passed
+	}
+	data := s.encode4(ctx, req, resp)
+	sent, err := sendRaw4(req, resp, data)
+	if err != nil {
+		log.Printf("Raw reply to %v failed, broadcasting it: %v", req.ClientHWAddr, err)
+	}
+	if !sent {
+		if _, err := conn.WriteTo(data, replyPeer4(conn, broadcastPeer4(peer))); err != nil {
+			log.Printf("conn.Write to %v failed: %v", peer, err)
+		}
+	}
+	return false
 }
 
 // Start will start the server asynchronously. See `Wait` to wait until
 // the execution ends.
 func (s *Server) Start() error {
-	_, err := s.LoadPlugins(s.Config)
+	metadata.Set(s.Config.Server6, s.Config.Server4)
+	s.loadLock.Lock()
+	loaded, err := s.LoadPlugins(s.Config)
+	if err == nil {
+		commitPlugins(loaded)
+	}
+	s.loadLock.Unlock()
 	if err != nil {
 		return err
 	}
 
+	// the history and the quarantine are created before the listeners,
+	// which use them
+	if qc := s.Config.Quarantine; qc != nil {
+		if s.Quarantine, err = NewQuarantine(qc); err != nil {
+			return err
+		}
+	}
+	if mc := s.Config.Management; mc != nil && mc.HistorySize > 0 {
+		s.History = NewHistory(mc.HistorySize, mc.HistoryClients)
+	}
+
 	// listen
 	if s.Config.Server6 != nil {
 		log.Printf("Starting DHCPv6 listener on %v", s.Config.Server6.Listener)
-		s.Server6 = dhcpv6.NewServer(*s.Config.Server6.Listener, s.MainHandler6)
+		if s.listener6, err = listen("udp6", s.Config.Server6.Listener); err != nil {
+			return err
+		}
+		s.setListenerStatus("dhcpv6", nil)
 		go func() {
-			s.errors <- s.Server6.ActivateAndServe()
+			err := s.listener6.serve(s.handlePacket6)
+			s.setListenerStatus("dhcpv6", fmt.Errorf("listener stopped: %v", err))
+			s.errors <- err
 		}()
 	}
 
 	if s.Config.Server4 != nil {
-		log.Printf("Starting DHCPv4 listener on %v", s.Config.Server6.Listener)
-		s.Server4 = dhcpv4.NewServer(*s.Config.Server4.Listener, s.MainHandler4)
+		log.Printf("Starting DHCPv4 listener on %v", s.Config.Server4.Listener)
+		if s.listener4, err = listen("udp4", s.Config.Server4.Listener); err != nil {
+			return err
+		}
+		s.setListenerStatus("dhcpv4", nil)
 		go func() {
-			s.errors <- s.Server4.ActivateAndServe()
+			err := s.listener4.serve(s.handlePacket4)
+			s.setListenerStatus("dhcpv4", fmt.Errorf("listener stopped: %v", err))
+			s.errors <- err
 		}()
 	}
 
+	if lc := s.Config.Leases; lc != nil {
+		go leases.Maintain(leases.Default, lc.Retention, lc.CompactInterval)
+		go leases.NewExpiryScheduler(leases.Default, lc.ExpiryJitter, lc.ExpiryCatchUp).Run()
+	}
+
+	if wc := s.Config.Watchdog; wc != nil {
+		s.Watchdog = NewWatchdog(wc)
+		s.Watchdog.Start()
+	}
+
+	if s.Config.Management != nil {
+		s.Management = management.NewServer(s.Config.Management.Listen)
+		if s.Management.TLS, s.Management.Auth, err = NewAuth(s.Config.Management.Auth); err != nil {
+			return err
+		}
+		s.Management.OnAction = s.logAction
+		s.registerHealthHandlers(s.Management)
+		registerStatisticsHandlers(s.Management)
+		s.registerPluginHandlers(s.Management)
+		s.registerConfigHandlers(s.Management)
+		if s.History != nil {
+			registerHistoryHandlers(s.Management, s.History)
+		}
+		registerReservationHandlers(s.Management, leases.Default, s.Config.Management.ReservationTTL)
+		registerLeaseHandlers(s.Management, leases.Default)
+		registerDualStackHandlers(s.Management, dualstack.Default, leases.Default)
+		if s.Watchdog != nil {
+			registerWatchdogHandlers(s.Management, s.Watchdog)
+		}
+		if s.Quarantine != nil {
+			registerQuarantineHandlers(s.Management, s.Quarantine)
+		}
+		registerBackupHandlers(s.Management, leases.Default)
+		go runReservationSweeper(leases.Default)
+		s.registerPluginEndpoints(s.Management)
+		if err := s.Management.Start(s.errors); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // Wait waits until the end of the execution of the server.
 func (s *Server) Wait() error {
 	log.Print("Waiting")
-	if s.Server6 != nil {
-		s.Server6.Close()
+	err := <-s.errors
+	if s.listener6 != nil {
+		s.listener6.Close()
+	}
+	if s.listener4 != nil {
+		s.listener4.Close()
 	}
-	if s.Server4 != nil {
-		s.Server4.Close()
+	if s.Management != nil {
+		s.Management.Close()
+	}
+	if s.Quarantine != nil {
+		s.Quarantine.Close()
+	}
+	return err
+}
+
+// Stop makes Wait return, e.g. when the service manager stops the server.
+func (s *Server) Stop() {
+	select {
+	case s.errors <- nil:
+	default:
+	}
+}
+
+// registerPluginEndpoints registers the management endpoints of the loaded
+// plugins. Plugins loaded by a later Reload do not get their endpoints until
+// the server is restarted.
+func (s *Server) registerPluginEndpoints(m *management.Server) {
+	s.handlersLock.RLock()
+	loaded := s.loaded
+	s.handlersLock.RUnlock()
+	registered := make(map[string]bool)
+	for _, plugin := range loaded {
+		if registered[plugin.Name] {
+			// plugins loaded for both protocols are registered once
+			continue
+		}
+		registered[plugin.Name] = true
+		for pattern, h := range plugin.Endpoints {
+			m.Handle(pattern, h)
+		}
 	}
-	return <-s.errors
 }
 
 // NewServer creates a Server instance with the provided configuration.
@@ -0,0 +1,37 @@
+package coredhcp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// correlationID6 derives a short correlation ID from the transaction ID and
+// the client ID of a DHCPv6 request, so that the retransmissions of a request
+// get the same ID.
+func correlationID6(req dhcpv6.DHCPv6) string {
+	h := fnv.New32a()
+	if msg, err := dhcputil.InnerMessage6(req); err == nil {
+		if m, ok := msg.(*dhcpv6.DHCPv6Message); ok {
+			var xid [4]byte
+			binary.BigEndian.PutUint32(xid[:], m.TransactionID())
+			h.Write(xid[:])
+		}
+		if opt := msg.GetOneOption(dhcpv6.OptionClientID); opt != nil {
+			h.Write(opt.ToBytes())
+		}
+	}
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// correlationID4 is like correlationID6, but for DHCPv4 requests.
+func correlationID4(req *dhcpv4.DHCPv4) string {
+	h := fnv.New32a()
+	h.Write(req.TransactionID[:])
+	h.Write(req.ClientHWAddr)
+	return fmt.Sprintf("%08x", h.Sum32())
+}
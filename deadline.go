@@ -0,0 +1,279 @@
+package coredhcp
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// statDeadline counts the transactions whose chain exceeded its deadline,
+// with the `version` and `answer` labels: `stale` if the request was answered
+// from a cached response, or `none`.
+const statDeadline = "dhcp_deadline_exceeded_total"
+
+// stopperDeadline is the stopper of the transactions whose chain exceeded
+// its deadline.
+const stopperDeadline = "deadline"
+
+// staleEntries is the maximum number of responses kept for the stale answers.
+const staleEntries = 65536
+
+// maxAbandoned is the number of abandoned chains still running beyond which
+// no chain is started, and the requests are answered from the stale responses
+// or dropped, so that the plugins that ignore their context cannot pile up
+// goroutines during an overload.
+const maxAbandoned = 1024
+
+// staleCache keeps the last response to each client and request type, to
+// answer the requests whose chain exceeds its deadline. The zero value is
+// ready to use.
+type staleCache struct {
+	lock    sync.Mutex
+	entries map[string]staleEntry
+}
+
+type staleEntry struct {
+	stored time.Time
+	// resp is a *dhcpv4.DHCPv4, or the inner message of a DHCPv6 response
+	resp interface{}
+}
+
+func (c *staleCache) put(key string, resp interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]staleEntry)
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= staleEntries {
+		// make room by evicting an arbitrary entry
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = staleEntry{stored: time.Now(), resp: resp}
+}
+
+// get returns the response stored under a key, if not older than ttl.
+func (c *staleCache) get(key string, ttl time.Duration) interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Since(e.stored) > ttl {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.resp
+}
+
+// bounded runs a chain in its own goroutine, and returns whether it completed
+// before ctx is done. A chain that did not is abandoned, and counted until it
+// returns.
+func (s *Server) bounded(ctx context.Context, chain func()) bool {
+	if n := atomic.LoadInt64(&s.abandoned); n >= maxAbandoned {
+		logger.FromContext(ctx).Printf("%d abandoned plugin chains still running, not starting another one", n)
+		return false
+	}
+	// state is 0 while the chain runs, then 1 if it completed in time, or 2
+	// if it was abandoned
+	var state int32
+	done := make(chan struct{})
+	go func() {
+		chain()
+		if !atomic.CompareAndSwapInt32(&state, 0, 1) {
+			atomic.AddInt64(&s.abandoned, -1)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+	}
+	if !atomic.CompareAndSwapInt32(&state, 0, 2) {
+		// the chain completed meanwhile
+		<-done
+		return true
+	}
+	atomic.AddInt64(&s.abandoned, 1)
+	return false
+}
+
+// staleKey6 returns the key of the stale answers to a DHCPv6 request: the
+// client, its link and the request type, or an empty string if it has no
+// client identifier.
+func staleKey6(req dhcpv6.DHCPv6) string {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return ""
+	}
+	duid := duid6(msg.GetOneOption(dhcpv6.OptionClientID))
+	if duid == nil {
+		return ""
+	}
+	return fmt.Sprintf("6/%s/%s/%s", hex.EncodeToString(duid), dhcputil.LinkAddress6(req), msg.Type())
+}
+
+// boundedChain6 runs the DHCPv6 chain within the deadline of the server, if
+// any. The chain runs on a copy of the request, and is abandoned if it does
+// not complete in time: the request is then answered from the last response
+// of the same type to the client on the same link, with the transaction ID of
+// the request. The responses of the abandoned chains, which may have changed
+// the leases, replace the cached ones when they complete.
+func (s *Server) boundedChain6(ctx context.Context, req dhcpv6.DHCPv6) (dhcpv6.DHCPv6, string) {
+	s.handlersLock.RLock()
+	sc := s.Config.Server6
+	s.handlersLock.RUnlock()
+	if sc == nil || sc.Deadline == 0 {
+		return s.chain6(ctx, req)
+	}
+	deadline, staleTTL := sc.Deadline, sc.StaleTTL
+	creq, err := clone6(req)
+	if err != nil {
+		return s.chain6(ctx, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	key := staleKey6(req)
+	var (
+		resp    dhcpv6.DHCPv6
+		stopper string
+	)
+	if s.bounded(ctx, func() {
+		r, st := s.chain6(ctx, creq)
+		if staleTTL > 0 && key != "" && r != nil {
+			if inner, err := dhcputil.InnerMessage6(r); err == nil {
+				s.stale.put(key, inner)
+			}
+		}
+		resp, stopper = r, st
+	}) {
+		return resp, stopper
+	}
+	if staleTTL > 0 && key != "" {
+		if cached, ok := s.stale.get(key, staleTTL).(dhcpv6.DHCPv6); ok {
+			if resp := staleAnswer6(req, cached); resp != nil {
+				stats.Inc(statDeadline, "version", "6", "answer", "stale")
+				logger.FromContext(ctx).Printf("Plugin chain exceeded its deadline of %v, answering from the last response", deadline)
+				return resp, stopperDeadline
+			}
+		}
+	}
+	stats.Inc(statDeadline, "version", "6", "answer", "none")
+	logger.FromContext(ctx).Printf("Plugin chain exceeded its deadline of %v, dropping the request", deadline)
+	return nil, stopperDeadline
+}
+
+// staleAnswer6 adapts a cached DHCPv6 response to a request, or returns nil.
+func staleAnswer6(req, cached dhcpv6.DHCPv6) dhcpv6.DHCPv6 {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return nil
+	}
+	m, ok := msg.(*dhcpv6.DHCPv6Message)
+	if !ok {
+		return nil
+	}
+	c, err := clone6(cached)
+	if err != nil {
+		return nil
+	}
+	resp, ok := c.(*dhcpv6.DHCPv6Message)
+	if !ok {
+		return nil
+	}
+	resp.SetTransactionID(m.TransactionID())
+	if !req.IsRelay() {
+		return resp
+	}
+	relayed, err := dhcpv6.NewRelayReplFromRelayForw(req, resp)
+	if err != nil {
+		return nil
+	}
+	return relayed
+}
+
+// boundedChain4 is like boundedChain6, for DHCPv4.
+func (s *Server) boundedChain4(ctx context.Context, req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, string) {
+	s.handlersLock.RLock()
+	sc := s.Config.Server4
+	s.handlersLock.RUnlock()
+	if sc == nil || sc.Deadline == 0 {
+		return s.chain4(ctx, req)
+	}
+	deadline, staleTTL := sc.Deadline, sc.StaleTTL
+	creq, err := clone4(req)
+	if err != nil {
+		return s.chain4(ctx, req)
+	}
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	// the clients are keyed by relay too, since the answers depend on it
+	key := fmt.Sprintf("4/%s/%s/%s", req.ClientHWAddr, req.GatewayIPAddr, req.MessageType())
+	var (
+		resp    *dhcpv4.DHCPv4
+		stopper string
+	)
+	if s.bounded(ctx, func() {
+		r, st := s.chain4(ctx, creq)
+		if staleTTL > 0 && r != nil {
+			s.stale.put(key, r)
+		}
+		resp, stopper = r, st
+	}) {
+		return resp, stopper
+	}
+	if staleTTL > 0 {
+		if cached, ok := s.stale.get(key, staleTTL).(*dhcpv4.DHCPv4); ok {
+			if resp := staleAnswer4(req, cached); resp != nil {
+				stats.Inc(statDeadline, "version", "4", "answer", "stale")
+				logger.FromContext(ctx).Printf("Plugin chain exceeded its deadline of %v, answering from the last response", deadline)
+				return resp, stopperDeadline
+			}
+		}
+	}
+	stats.Inc(statDeadline, "version", "4", "answer", "none")
+	logger.FromContext(ctx).Printf("Plugin chain exceeded its deadline of %v, dropping the request", deadline)
+	return nil, stopperDeadline
+}
+
+// staleAnswer4 adapts a cached DHCPv4 response to a request, or returns nil.
+// The fields that the relays and the client set in the request are copied
+// from it, and an ACK is only sent again for the address the client asks
+// for.
+func staleAnswer4(req, cached *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	resp, err := clone4(cached)
+	if err != nil || resp == nil {
+		return nil
+	}
+	if req.MessageType() == dhcpv4.MessageTypeRequest && resp.MessageType() == dhcpv4.MessageTypeAck {
+		want := req.RequestedIPAddress()
+		if want == nil || want.IsUnspecified() {
+			want = req.ClientIPAddr
+		}
+		if !want.Equal(resp.YourIPAddr) {
+			return nil
+		}
+	}
+	resp.TransactionID = req.TransactionID
+	resp.GatewayIPAddr = req.GatewayIPAddr
+	resp.Flags = req.Flags
+	if info := req.GetOneOption(dhcpv4.OptionRelayAgentInformation); info != nil {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	} else {
+		resp.Options.Del(dhcpv4.OptionRelayAgentInformation)
+	}
+	return resp
+}
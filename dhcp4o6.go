@@ -0,0 +1,121 @@
+package coredhcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// DHCPv4-over-DHCPv6 (RFC 7341) message types and options
+const (
+	MessageTypeDHCPv4Query    dhcpv6.MessageType = 20
+	MessageTypeDHCPv4Response dhcpv6.MessageType = 21
+	OptionDHCPv4Msg           dhcpv6.OptionCode  = 87
+	OptionDHCP4oDHCP6Server   dhcpv6.OptionCode  = 88
+)
+
+// dhcpv4Query returns the innermost message of a DHCPv6 packet if it is a
+// DHCPv4-query.
+func dhcpv4Query(req dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || msg.Type() != MessageTypeDHCPv4Query {
+		return nil, false
+	}
+	return msg, true
+}
+
+// handleDHCPv4Query runs the DHCPv4 message encapsulated in a DHCPv4-query
+// through the same validation and bounded DHCPv4 chain as the messages of the
+// DHCPv4 listener, and returns the DHCPv4-response encapsulating the reply,
+// relayed back if the query was relayed, and the name of the plugin that
+// interrupted the chain, if any. It returns a nil response if the query is
+// malformed, shed or rejected, or the DHCPv4 handlers did not reply.
+func (s *Server) handleDHCPv4Query(ctx context.Context, conn net.PacketConn, peer net.Addr, req, query dhcpv6.DHCPv6) (dhcpv6.DHCPv6, string) {
+	log := logger.FromContext(ctx)
+	opt, ok := query.GetOneOption(OptionDHCPv4Msg).(*dhcpv6.OptionGeneric)
+	if !ok {
+		s.quarantine(ctx, "4", conn, peer, rejectMalformed, received(ctx, req))
+		return nil, ""
+	}
+	req4, err := dhcpv4.FromBytes(opt.OptionData)
+	if err != nil {
+		log.Printf("DHCPv4-over-DHCPv6: malformed DHCPv4 message: %v", err)
+		s.quarantine(ctx, "4", conn, peer, rejectMalformed, opt.OptionData)
+		return nil, ""
+	}
+	if s.shed4(conn, peer, req4) {
+		return nil, ""
+	}
+	if reason := validateRequest4(req4); reason != "" {
+		s.quarantine(ctx, "4", conn, peer, reason, opt.OptionData)
+		return nil, ""
+	}
+	if forOtherServer4(req4) {
+		discard(ctx, "4", conn)
+		return nil, ""
+	}
+	// the DHCPv4 message, as received, and not the DHCPv4-query
+	ctx = handler.WithSigner(handler.WithPacket(ctx, opt.OptionData))
+	resp4, stopper := s.boundedChain4(ctx, req4)
+	if reason := validateResponse4(req4, resp4); reason != "" {
+		reject(ctx, "4", conn, reason)
+		return nil, stopper
+	}
+	if resp4 == nil {
+		return nil, stopper
+	}
+	resp, err := dhcpv6.NewMessage()
+	if err != nil {
+		log.Printf("DHCPv4-over-DHCPv6: %v", err)
+		return nil, stopper
+	}
+	msg := resp.(*dhcpv6.DHCPv6Message)
+	msg.SetMessage(MessageTypeDHCPv4Response)
+	// the flags of the response are all reserved
+	msg.SetTransactionID(0)
+	msg.SetOptions([]dhcpv6.Option{&dhcpv6.OptionGeneric{OptionCode: OptionDHCPv4Msg, OptionData: s.encode4(ctx, req4, resp4)}})
+	if !req.IsRelay() {
+		return msg, stopper
+	}
+	relayed, err := dhcpv6.NewRelayReplFromRelayForw(req, msg)
+	if err != nil {
+		log.Printf("DHCPv4-over-DHCPv6: cannot relay the response: %v", err)
+		return nil, stopper
+	}
+	return relayed, stopper
+}
+
+// add4o6Server adds the DHCP 4o6 Server Address option (RFC 7341, section 8)
+// to a DHCPv6 response if the client requested it, and the DHCPv4 server is
+// configured, i.e. DHCPv4-queries are served. It holds the address of the
+// DHCPv6 listener if it is a unicast one, or else no address, for the clients
+// to send their queries to All_DHCP_Relay_Agents_and_Servers.
+func (s *Server) add4o6Server(req, resp dhcpv6.DHCPv6) {
+	if resp == nil {
+		return
+	}
+	s.handlersLock.RLock()
+	sc6, sc4 := s.Config.Server6, s.Config.Server4
+	s.handlersLock.RUnlock()
+	if sc4 == nil {
+		return
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || !dhcputil.Requested6(msg, OptionDHCP4oDHCP6Server) {
+		return
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return
+	}
+	var addrs []byte
+	if sc6 != nil && sc6.Listener != nil && sc6.Listener.IP.IsGlobalUnicast() && sc6.Listener.IP.To4() == nil {
+		addrs = append(addrs, sc6.Listener.IP.To16()...)
+	}
+	reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionDHCP4oDHCP6Server, OptionData: addrs})
+}
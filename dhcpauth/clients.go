@@ -0,0 +1,138 @@
+package dhcpauth
+
+import (
+	"container/list"
+	"crypto/rand"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+)
+
+// DefaultClientTTL is how long a client is kept when its response has no
+// lease time, e.g. a Reply to an Information-request.
+const DefaultClientTTL = 24 * time.Hour
+
+// MaxClients is the number of clients kept by a Clients registry: the least
+// recently seen ones are evicted beyond it.
+const MaxClients = 65536
+
+// ErrUnknownClient is returned by Clients.Send for a client that never got a
+// key, either because it did not get a lease or because it does not support
+// the authentication, or whose lease expired.
+var ErrUnknownClient = errors.New("unknown or incapable client")
+
+// NewKey returns a random key, or nonce, for a client.
+func NewKey() ([]byte, error) {
+	key := make([]byte, DigestSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Client is a client that can be sent the server-initiated messages, i.e.
+// DHCPFORCERENEW and Reconfigure, signed with its key.
+type Client struct {
+	// ID identifies the client in the registry, e.g. its hardware address
+	// or DUID.
+	ID   string
+	IP   net.IP
+	Key  []byte
+	Conn net.PacketConn
+	// Expires is when the lease of the client expires, after which it is
+	// forgotten.
+	Expires time.Time
+	// Data holds the protocol-specific state of the client.
+	Data interface{}
+}
+
+// Clients is the registry of the clients given a key, shared by the plugins
+// sending server-initiated messages. It holds at most MaxClients clients, and
+// forgets the ones whose lease expired. The zero value is not usable, see
+// NewClients.
+type Clients struct {
+	lock sync.Mutex
+	// order holds the clients, the most recently added first, and byID
+	// indexes its elements.
+	order *list.List
+	byID  map[string]*list.Element
+	max   int
+}
+
+// NewClients returns an empty registry holding at most max clients.
+func NewClients(max int) *Clients {
+	return &Clients{order: list.New(), byID: make(map[string]*list.Element), max: max}
+}
+
+// Add adds a client, or replaces the one with the same ID.
+func (c *Clients) Add(client *Client) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.byID[client.ID]; ok {
+		e.Value = client
+		c.order.MoveToFront(e)
+		return
+	}
+	c.byID[client.ID] = c.order.PushFront(client)
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *Clients) remove(e *list.Element) {
+	c.order.Remove(e)
+	delete(c.byID, e.Value.(*Client).ID)
+}
+
+// targets returns the client with an ID, or all the clients if id is empty,
+// once the expired ones are removed.
+func (c *Clients) targets(id string) []*Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := clock.Now()
+	if id != "" {
+		e, ok := c.byID[id]
+		if !ok {
+			return nil
+		}
+		if client := e.Value.(*Client); !now.After(client.Expires) {
+			return []*Client{client}
+		}
+		c.remove(e)
+		return nil
+	}
+	var targets []*Client
+	for e := c.order.Front(); e != nil; {
+		next := e.Next()
+		if client := e.Value.(*Client); now.After(client.Expires) {
+			c.remove(e)
+		} else {
+			targets = append(targets, client)
+		}
+		e = next
+	}
+	return targets
+}
+
+// Send calls send for the client with an ID, or for all the known clients if
+// id is empty, and returns the number of successful calls and the last error.
+// It returns ErrUnknownClient if there is no client with the ID.
+func (c *Clients) Send(id string, send func(*Client) error) (int, error) {
+	targets := c.targets(id)
+	if id != "" && len(targets) == 0 {
+		return 0, ErrUnknownClient
+	}
+	sent := 0
+	var err error
+	for _, client := range targets {
+		if serr := send(client); serr != nil {
+			err = serr
+			continue
+		}
+		sent++
+	}
+	return sent, err
+}
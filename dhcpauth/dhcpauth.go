@@ -0,0 +1,205 @@
+// Package dhcpauth implements the authentication option shared by DHCPv4 (RFC
+// 3118) and DHCPv6 (RFC 8415), and the HMAC-MD5 digests used by its protocols.
+package dhcpauth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// OptionAuthentication4 is the DHCPv4 authentication option code.
+const OptionAuthentication4 = dhcpv4.GenericOptionCode(90)
+
+// Authentication protocols
+const (
+	ProtocolConfigurationToken = 0
+	ProtocolDelayed            = 1
+	// ProtocolReconfigureKey is the Reconfigure Key Authentication Protocol
+	// of DHCPv6, and ProtocolForcerenewNonce the Forcerenew Nonce
+	// Authentication of DHCPv4 (RFC 6704). They share the same number.
+	ProtocolReconfigureKey  = 3
+	ProtocolForcerenewNonce = 3
+)
+
+// AlgorithmHMACMD5 is the HMAC-MD5 algorithm of the delayed authentication
+// and reconfigure key protocols.
+const AlgorithmHMACMD5 = 1
+
+// RDMMonotonic is the replay detection method using a monotonically
+// increasing counter.
+const RDMMonotonic = 0
+
+// DigestSize is the size of an HMAC-MD5 digest.
+const DigestSize = md5.Size
+
+// headerSize is the size of the fixed part of the option.
+const headerSize = 11
+
+// Option is an authentication option.
+type Option struct {
+	Protocol  uint8
+	Algorithm uint8
+	RDM       uint8
+	// Replay is the replay detection value.
+	Replay uint64
+	// Info is the protocol-specific authentication information.
+	Info []byte
+}
+
+// Parse parses the payload of an authentication option.
+func Parse(data []byte) (*Option, error) {
+	if len(data) < headerSize {
+		return nil, errors.New("authentication option too short")
+	}
+	return &Option{
+		Protocol:  data[0],
+		Algorithm: data[1],
+		RDM:       data[2],
+		Replay:    binary.BigEndian.Uint64(data[3:]),
+		Info:      append([]byte(nil), data[headerSize:]...),
+	}, nil
+}
+
+// ToBytes returns the payload of the option.
+func (o *Option) ToBytes() []byte {
+	b := make([]byte, headerSize, headerSize+len(o.Info))
+	b[0], b[1], b[2] = o.Protocol, o.Algorithm, o.RDM
+	binary.BigEndian.PutUint64(b[3:], o.Replay)
+	return append(b, o.Info...)
+}
+
+// HMACMD5 returns the HMAC-MD5 digest of a message.
+func HMACMD5(key, msg []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
+
+// The fields of a DHCPv4 packet involved in its digest
+const (
+	offsetHops    = 3
+	offsetGiaddr  = 24
+	offsetSname   = 44
+	offsetFile    = 108
+	offsetCookie  = 236
+	offsetOptions = 240
+)
+
+// option4 returns the offset and length of the payload of the first instance
+// of an option in a DHCPv4 packet, looking into the overloaded file and sname
+// fields as well (RFC 2132, section 9.3).
+func option4(packet []byte, code byte) (int, int, error) {
+	if len(packet) < offsetOptions {
+		return 0, 0, errors.New("DHCPv4 packet too short")
+	}
+	var overload byte
+	scan := func(start, end int) (int, int, bool) {
+		for i := start; i < end; {
+			switch packet[i] {
+			case 0:
+				i++
+				continue
+			case 255:
+				return 0, 0, false
+			}
+			if i+1 >= end || i+2+int(packet[i+1]) > end {
+				return 0, 0, false
+			}
+			length := int(packet[i+1])
+			if packet[i] == code {
+				return i + 2, length, true
+			}
+			if packet[i] == byte(dhcpv4.OptionOptionOverload) && length == 1 {
+				overload = packet[i+2]
+			}
+			i += 2 + length
+		}
+		return 0, 0, false
+	}
+	if off, n, ok := scan(offsetOptions, len(packet)); ok {
+		return off, n, nil
+	}
+	// the file field first, as per RFC 2131, section 4.1
+	if overload&1 != 0 {
+		if off, n, ok := scan(offsetFile, offsetCookie); ok {
+			return off, n, nil
+		}
+	}
+	if overload&2 != 0 {
+		if off, n, ok := scan(offsetSname, offsetFile); ok {
+			return off, n, nil
+		}
+	}
+	return 0, 0, errors.New("no authentication option")
+}
+
+// digest4 returns the HMAC-MD5 digest of a DHCPv4 packet, as defined by RFC
+// 3118: it is computed over the packet with the hops and giaddr fields set
+// to zero, and the digest of its authentication option, the last DigestSize
+// bytes of the authentication information, set to zero. It also returns the
+// offset of the digest in the packet, which is not modified.
+func digest4(key, packet []byte) ([]byte, int, error) {
+	off, n, err := option4(packet, byte(OptionAuthentication4))
+	if err != nil {
+		return nil, 0, err
+	}
+	if n < headerSize+DigestSize {
+		return nil, 0, errors.New("authentication information too short for a digest")
+	}
+	tmp := append([]byte(nil), packet...)
+	tmp[offsetHops] = 0
+	copy(tmp[offsetGiaddr:offsetGiaddr+net.IPv4len], net.IPv4zero.To4())
+	at := off + n - DigestSize
+	copy(tmp[at:at+DigestSize], make([]byte, DigestSize))
+	return HMACMD5(key, tmp), at, nil
+}
+
+// Verify4 checks the digest of the authentication option of a DHCPv4 packet,
+// as received, see digest4.
+func Verify4(key, packet []byte) error {
+	digest, at, err := digest4(key, packet)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(digest, packet[at:at+DigestSize]) {
+		return errors.New("invalid digest")
+	}
+	return nil
+}
+
+// Sign4 sets the digest of the authentication option of an encoded DHCPv4
+// packet, in place, see digest4. It must be the last change to the packet.
+func Sign4(key, packet []byte) error {
+	digest, at, err := digest4(key, packet)
+	if err != nil {
+		return err
+	}
+	copy(packet[at:], digest)
+	return nil
+}
+
+var (
+	replayLock sync.Mutex
+	lastReplay uint64
+)
+
+// NextReplay returns the next value of the replay detection counter of the
+// server. It is derived from the time, so that it keeps increasing across
+// restarts, and strictly increases between calls.
+func NextReplay() uint64 {
+	replayLock.Lock()
+	defer replayLock.Unlock()
+	now := uint64(time.Now().UnixNano())
+	if now <= lastReplay {
+		now = lastReplay + 1
+	}
+	lastReplay = now
+	return now
+}
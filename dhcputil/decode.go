@@ -0,0 +1,197 @@
+package dhcputil
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// DecodedOption is an option of a message, decoded for the logs.
+type DecodedOption struct {
+	Code int
+	// Name is in lowercase, with dashes, e.g. `router` or `client-id`.
+	Name  string
+	Value string
+	// Hex is the payload of the option, in hex.
+	Hex string
+}
+
+// Key returns the key of the option in structured logs, e.g. `opt3-router`.
+func (o *DecodedOption) Key() string {
+	return fmt.Sprintf("opt%d-%s", o.Code, o.Name)
+}
+
+// kinds of DHCPv4 option values
+const (
+	kindHex = iota
+	kindIPs
+	kindString
+	kindSeconds
+	kindUint8
+	kindUint16
+	kindMessageType
+	kindCodes
+	kindSuboptions
+)
+
+type optionInfo4 struct {
+	name string
+	kind int
+}
+
+// options4 are the names and kinds of the common DHCPv4 options. The other
+// options are named by their code and dumped in hex.
+var options4 = map[uint8]optionInfo4{
+	1:   {"subnet-mask", kindIPs},
+	2:   {"time-offset", kindSeconds},
+	3:   {"router", kindIPs},
+	4:   {"time-server", kindIPs},
+	6:   {"dns", kindIPs},
+	12:  {"hostname", kindString},
+	15:  {"domain-name", kindString},
+	26:  {"interface-mtu", kindUint16},
+	28:  {"broadcast-address", kindIPs},
+	42:  {"ntp-servers", kindIPs},
+	43:  {"vendor-specific", kindHex},
+	50:  {"requested-address", kindIPs},
+	51:  {"lease-time", kindSeconds},
+	52:  {"overload", kindUint8},
+	53:  {"message-type", kindMessageType},
+	54:  {"server-id", kindIPs},
+	55:  {"parameter-request-list", kindCodes},
+	56:  {"message", kindString},
+	57:  {"max-message-size", kindUint16},
+	58:  {"renewal-time", kindSeconds},
+	59:  {"rebinding-time", kindSeconds},
+	60:  {"vendor-class-id", kindString},
+	61:  {"client-id", kindHex},
+	66:  {"tftp-server-name", kindString},
+	67:  {"bootfile-name", kindString},
+	77:  {"user-class", kindHex},
+	81:  {"client-fqdn", kindHex},
+	82:  {"relay-agent-information", kindSuboptions},
+	93:  {"client-architecture", kindUint16},
+	108: {"ipv6-only-preferred", kindSeconds},
+	118: {"subnet-selection", kindIPs},
+	119: {"domain-search", kindHex},
+	121: {"classless-static-route", kindHex},
+	145: {"forcerenew-nonce-capable", kindHex},
+}
+
+// printable returns whether a value can be logged as a string.
+func printable(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeValue4 returns the decoded value of a DHCPv4 option of a kind, or its
+// payload in hex if it does not have the expected size.
+func decodeValue4(kind int, b []byte) string {
+	switch {
+	case kind == kindIPs && len(b) > 0 && len(b)%4 == 0:
+		ips := make([]string, 0, len(b)/4)
+		for i := 0; i < len(b); i += 4 {
+			ips = append(ips, net.IP(b[i:i+4]).String())
+		}
+		return strings.Join(ips, ",")
+	case kind == kindString && printable(b):
+		return fmt.Sprintf("%q", b)
+	case kind == kindSeconds && len(b) == 4:
+		return (time.Duration(binary.BigEndian.Uint32(b)) * time.Second).String()
+	case kind == kindUint8 && len(b) == 1:
+		return fmt.Sprint(b[0])
+	case kind == kindUint16 && len(b) == 2:
+		return fmt.Sprint(binary.BigEndian.Uint16(b))
+	case kind == kindMessageType && len(b) == 1:
+		return dhcpv4.MessageType(b[0]).String()
+	case kind == kindCodes:
+		names := make([]string, 0, len(b))
+		for _, c := range b {
+			names = append(names, optionName4(c))
+		}
+		return strings.Join(names, ",")
+	case kind == kindSuboptions:
+		var subs []string
+		for len(b) >= 2 && len(b) >= 2+int(b[1]) {
+			subs = append(subs, fmt.Sprintf("%d:%x", b[0], b[2:2+int(b[1])]))
+			b = b[2+int(b[1]):]
+		}
+		if len(b) == 0 {
+			return strings.Join(subs, ",")
+		}
+	}
+	return hex.EncodeToString(b)
+}
+
+// optionName4 returns the name of a DHCPv4 option.
+func optionName4(code uint8) string {
+	if info, ok := options4[code]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("option-%d", code)
+}
+
+// DecodeOptions4 returns the decoded options of a DHCPv4 message, by code.
+func DecodeOptions4(opts dhcpv4.Options) []DecodedOption {
+	ret := make([]DecodedOption, 0, len(opts))
+	for _, code := range OptionCodes4(opts) {
+		data := opts[code]
+		ret = append(ret, DecodedOption{
+			Code:  int(code),
+			Name:  optionName4(code),
+			Value: decodeValue4(options4[code].kind, data),
+			Hex:   hex.EncodeToString(data),
+		})
+	}
+	return ret
+}
+
+// optionName6 returns the name of a DHCPv6 option, from the one of the dhcpv6
+// package, e.g. `Client Identifier` becomes `client-identifier`.
+func optionName6(code dhcpv6.OptionCode) string {
+	name := strings.ToLower(code.String())
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '-'
+	}, name)
+	name = strings.Trim(name, "-")
+	for strings.Contains(name, "--") {
+		name = strings.Replace(name, "--", "-", -1)
+	}
+	if name == "" || strings.HasPrefix(name, "unknown") {
+		return fmt.Sprintf("option-%d", code)
+	}
+	return name
+}
+
+// DecodeOptions6 returns the decoded options of a DHCPv6 message or relay
+// message, in the order of the message. The values are the ones printed by the
+// dhcpv6 package. The relay messages are left out of the relays.
+func DecodeOptions6(msg dhcpv6.DHCPv6) []DecodedOption {
+	opts := msg.Options()
+	ret := make([]DecodedOption, 0, len(opts))
+	for _, opt := range opts {
+		if opt.Code() == dhcpv6.OptionRelayMsg {
+			continue
+		}
+		ret = append(ret, DecodedOption{
+			Code:  int(opt.Code()),
+			Name:  optionName6(opt.Code()),
+			Value: opt.String(),
+			Hex:   hex.EncodeToString(OptionData6(opt)),
+		})
+	}
+	return ret
+}
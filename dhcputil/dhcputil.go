@@ -0,0 +1,147 @@
+// Package dhcputil holds the helpers used by the server and the plugins to
+// inspect DHCP packets.
+package dhcputil
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// InnerMessage6 returns the innermost non-relay message of a DHCPv6 packet.
+func InnerMessage6(d dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	for d.IsRelay() {
+		inner, err := dhcpv6.DecapsulateRelay(d)
+		if err != nil {
+			return nil, err
+		}
+		d = inner
+	}
+	return d, nil
+}
+
+// innermostRelay6 returns the relay closest to the client of a DHCPv6 packet,
+// or nil if the packet was not relayed.
+func innermostRelay6(d dhcpv6.DHCPv6) *dhcpv6.DHCPv6Relay {
+	var ret *dhcpv6.DHCPv6Relay
+	for d.IsRelay() {
+		if relay, ok := d.(*dhcpv6.DHCPv6Relay); ok {
+			ret = relay
+		}
+		inner, err := dhcpv6.DecapsulateRelay(d)
+		if err != nil {
+			break
+		}
+		d = inner
+	}
+	return ret
+}
+
+// LinkAddress6 returns the link address of the relay closest to the client,
+// which identifies the link of the client, or nil if the packet was not
+// relayed.
+func LinkAddress6(d dhcpv6.DHCPv6) net.IP {
+	if relay := innermostRelay6(d); relay != nil {
+		return relay.LinkAddr()
+	}
+	return nil
+}
+
+// PeerAddress6 returns the address of the client as seen by the relay closest
+// to it, or nil if the packet was not relayed.
+func PeerAddress6(d dhcpv6.DHCPv6) net.IP {
+	if relay := innermostRelay6(d); relay != nil {
+		return relay.PeerAddr()
+	}
+	return nil
+}
+
+// RelayOption6 returns the payload of an option added by the relay closest to
+// the client, e.g. its Remote-ID or Interface-ID, or nil if the packet was not
+// relayed or the relay did not add it.
+func RelayOption6(d dhcpv6.DHCPv6, code dhcpv6.OptionCode) []byte {
+	relay := innermostRelay6(d)
+	if relay == nil {
+		return nil
+	}
+	opt := relay.GetOneOption(code)
+	if opt == nil {
+		return nil
+	}
+	return OptionData6(opt)
+}
+
+// Requested6 returns whether the client requested an option in the Option
+// Request Option of a message.
+func Requested6(msg dhcpv6.DHCPv6, code dhcpv6.OptionCode) bool {
+	oro, ok := msg.GetOneOption(dhcpv6.OptionORO).(*dhcpv6.OptRequestedOption)
+	if !ok {
+		return false
+	}
+	for _, c := range oro.RequestedOptions() {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// OptionData6 returns the payload of a DHCPv6 option, whether the library
+// decoded it or not.
+func OptionData6(opt dhcpv6.Option) []byte {
+	if g, ok := opt.(*dhcpv6.OptionGeneric); ok {
+		return g.OptionData
+	}
+	// the encoding of the decoded options starts with the code and length
+	b := opt.ToBytes()
+	if len(b) < 4 {
+		return nil
+	}
+	return b[4:]
+}
+
+// Instances6 splits the payload of the DHCPv6 options made of instances
+// preceded by their 16-bit length, such as the user class and vendor class
+// options. It returns nil if the payload is malformed.
+func Instances6(data []byte) [][]byte {
+	var ret [][]byte
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil
+		}
+		length := int(data[0])<<8 | int(data[1])
+		if len(data) < 2+length {
+			return nil
+		}
+		ret = append(ret, data[2:2+length])
+		data = data[2+length:]
+	}
+	return ret
+}
+
+// IAAddresses6 returns the addresses of the IA_NAs of a DHCPv6 message, in
+// order, including the ones with a zero valid lifetime, i.e. released or
+// revoked.
+func IAAddresses6(msg dhcpv6.DHCPv6) []*dhcpv6.OptIAAddress {
+	var ret []*dhcpv6.OptIAAddress
+	for _, opt := range msg.GetOption(dhcpv6.OptionIANA) {
+		iana, ok := opt.(*dhcpv6.OptIANA)
+		if !ok {
+			continue
+		}
+		for _, iaopt := range iana.Options {
+			if addr, ok := iaopt.(*dhcpv6.OptIAAddress); ok {
+				ret = append(ret, addr)
+			}
+		}
+	}
+	return ret
+}
+
+// FirstAddress6 returns the first IA_NA address of a DHCPv6 message, or nil.
+func FirstAddress6(msg dhcpv6.DHCPv6) net.IP {
+	if addrs := IAAddresses6(msg); len(addrs) > 0 {
+		return addrs[0].IPv6Addr
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package dhcputil
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Nak4 returns a DHCPNAK answering a DHCPREQUEST, with the server identifier,
+// if not nil, and a message for the client. The relay agent information of the
+// request, if any, is echoed (RFC 3046), as the chains usually stop at the
+// DHCPNAK, before the plugins that echo it.
+func Nak4(req *dhcpv4.DHCPv4, serverID net.IP, message string) (*dhcpv4.DHCPv4, error) {
+	nak, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeNak))
+	if err != nil {
+		return nil, err
+	}
+	// DHCPNAKs only carry the server identifier, a message and the relay
+	// agent information
+	nak.Options = make(dhcpv4.Options)
+	nak.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeNak))
+	if serverID != nil {
+		nak.UpdateOption(dhcpv4.OptServerIdentifier(serverID))
+	}
+	nak.UpdateOption(dhcpv4.OptMessage(message))
+	if info := req.Options.Get(dhcpv4.OptionRelayAgentInformation); info != nil {
+		nak.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, info))
+	}
+	nak.YourIPAddr = net.IPv4zero
+	nak.ClientIPAddr = net.IPv4zero
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		// the relay broadcasts the DHCPNAK on the link of the client
+		nak.SetBroadcast()
+	}
+	return nak, nil
+}
@@ -0,0 +1,313 @@
+package dhcputil
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// DHCPv4 option codes with a special meaning in the encoding
+const (
+	optionPad = 0
+	optionEnd = 255
+)
+
+const (
+	// headerSize4 is the size of the fixed part of a DHCPv4 message,
+	// including the magic cookie.
+	headerSize4 = 240
+	// minSize4 is the minimum size of a BOOTP message, which some relays and
+	// clients still expect.
+	minSize4 = 300
+	// maxOptionSize4 is the maximum size of the value of a single instance
+	// of an option.
+	maxOptionSize4 = 255
+	// MinMaxMessageSize4 is the size of the messages that all the clients
+	// must accept, as per RFC 2131, including the IP and UDP headers.
+	MinMaxMessageSize4 = 576
+	// ipUDPHeaderSize4 is the size of the IPv4 and UDP headers of a message
+	// without IP options.
+	ipUDPHeaderSize4 = 28
+)
+
+// Offsets and sizes of the sname and file fields, which can hold options when
+// the Option Overload option is set.
+const (
+	snameOffset4 = 44
+	snameSize4   = 64
+	fileOffset4  = 108
+	fileSize4    = 128
+)
+
+// Values of the Option Overload option (RFC 2132)
+const (
+	overloadFile  = 1
+	overloadSname = 2
+	overloadBoth  = 3
+)
+
+// ParseOptions4 parses a sequence of DHCPv4 options, up to the End option, and
+// adds them to opts. As per RFC 3396, the values of the options that appear
+// several times, including in previous calls, are concatenated.
+func ParseOptions4(data []byte, opts dhcpv4.Options) error {
+	for len(data) > 0 {
+		code := data[0]
+		switch code {
+		case optionPad:
+			data = data[1:]
+			continue
+		case optionEnd:
+			return nil
+		}
+		if len(data) < 2 {
+			return errors.New("truncated option header")
+		}
+		length := int(data[1])
+		if len(data) < 2+length {
+			return fmt.Errorf("truncated option %d", code)
+		}
+		opts[code] = append(opts[code], data[2:2+length]...)
+		data = data[2+length:]
+	}
+	return nil
+}
+
+// AppendOption4 appends the encoding of an option to b. As per RFC 3396,
+// values longer than 255 bytes are split into consecutive instances of the
+// option.
+func AppendOption4(b []byte, code uint8, value []byte) []byte {
+	for {
+		n := len(value)
+		if n > maxOptionSize4 {
+			n = maxOptionSize4
+		}
+		b = append(b, code, byte(n))
+		b = append(b, value[:n]...)
+		if value = value[n:]; len(value) == 0 {
+			return b
+		}
+	}
+}
+
+// OptionCodes4 returns the codes of the options, in ascending order.
+func OptionCodes4(opts dhcpv4.Options) []uint8 {
+	codes := make([]uint8, 0, len(opts))
+	for code := range opts {
+		if code != optionPad && code != optionEnd {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+// Encode4 returns the wire encoding of a DHCPv4 message. Unlike ToBytes, it
+// supports options longer than 255 bytes, which it splits as per RFC 3396, so
+// that large sets of classless static routes (option 121) or vendor-specific
+// information (option 43) can be expressed.
+func Encode4(msg *dhcpv4.DHCPv4) []byte {
+	b := make([]byte, 0, minSize4)
+	b = append(b, msg.ToBytes()[:headerSize4]...)
+	for _, code := range OptionCodes4(msg.Options) {
+		b = AppendOption4(b, code, msg.Options[code])
+	}
+	b = append(b, optionEnd)
+	for len(b) < minSize4 {
+		b = append(b, optionPad)
+	}
+	return b
+}
+
+// Unoverload4 moves the options that a request carries in its file and sname
+// fields, as indicated by the Option Overload option (option 52), to its
+// options, and clears the fields. Options that appear in several fields are
+// concatenated as per RFC 3396, in the order of the options, file and sname
+// fields. It does nothing for messages without the Option Overload option.
+func Unoverload4(msg *dhcpv4.DHCPv4) error {
+	data := msg.GetOneOption(dhcpv4.OptionOptionOverload)
+	if data == nil {
+		return nil
+	}
+	if len(data) != 1 || data[0] < overloadFile || data[0] > overloadBoth {
+		return fmt.Errorf("invalid Option Overload value %v", data)
+	}
+	opts := make(dhcpv4.Options)
+	if data[0]&overloadFile != 0 {
+		if err := ParseOptions4([]byte(msg.BootFileName), opts); err != nil {
+			return fmt.Errorf("file field: %v", err)
+		}
+	}
+	if data[0]&overloadSname != 0 {
+		if err := ParseOptions4([]byte(msg.ServerHostName), opts); err != nil {
+			return fmt.Errorf("sname field: %v", err)
+		}
+	}
+	delete(msg.Options, dhcpv4.OptionOptionOverload.Code())
+	for code, value := range opts {
+		msg.Options[code] = append(msg.Options[code], value...)
+	}
+	if data[0]&overloadFile != 0 {
+		msg.BootFileName = ""
+	}
+	if data[0]&overloadSname != 0 {
+		msg.ServerHostName = ""
+	}
+	return nil
+}
+
+// MaxMessageSize4 returns the maximum size of the DHCP payload of a message
+// that the client that sent req accepts, from its Maximum DHCP Message Size
+// option (option 57) or else the minimum size that all the clients accept. If
+// mtu is not 0, the size is also limited to what fits in a packet of the
+// interface, as clients do not necessarily reassemble fragmented packets.
+func MaxMessageSize4(req *dhcpv4.DHCPv4, mtu int) int {
+	size := MinMaxMessageSize4
+	if s, err := req.MaxMessageSize(); err == nil && int(s) > size {
+		size = int(s)
+	}
+	if mtu != 0 && mtu < size {
+		size = mtu
+	}
+	return size - ipUDPHeaderSize4
+}
+
+// EncodeOverload4 is like Encode4, but if the message is larger than maxSize
+// bytes, it moves the options that do not fit in the options field to the file
+// and then the sname fields, when they are unused, and sets the Option
+// Overload option accordingly (RFC 2131). The options are moved whole, so the
+// result can still be larger than maxSize, if the options do not fit in the
+// three fields.
+func EncodeOverload4(msg *dhcpv4.DHCPv4, maxSize int) []byte {
+	b := Encode4(msg)
+	if len(b) <= maxSize || msg.BootFileName != "" {
+		return b
+	}
+	// the options field ends with the Option Overload option and End
+	capacity := maxSize - headerSize4 - 3 - 1
+	var main, file, sname []byte
+	for _, code := range OptionCodes4(msg.Options) {
+		if code == dhcpv4.OptionOptionOverload.Code() {
+			continue
+		}
+		opt := AppendOption4(nil, code, msg.Options[code])
+		switch {
+		case file == nil && len(main)+len(opt) <= capacity:
+			main = append(main, opt...)
+		case sname == nil && len(file)+len(opt) < fileSize4:
+			file = append(file, opt...)
+		case msg.ServerHostName == "" && len(sname)+len(opt) < snameSize4:
+			sname = append(sname, opt...)
+		default:
+			// the option does not fit in any field
+			return b
+		}
+	}
+	overload := byte(overloadFile)
+	if sname != nil {
+		overload = overloadBoth
+	}
+	b = b[:headerSize4]
+	copy(b[fileOffset4:fileOffset4+fileSize4], append(file, optionEnd))
+	if sname != nil {
+		copy(b[snameOffset4:snameOffset4+snameSize4], append(sname, optionEnd))
+	}
+	b = append(b, main...)
+	b = append(b, dhcpv4.OptionOptionOverload.Code(), 1, overload)
+	b = append(b, optionEnd)
+	for len(b) < minSize4 {
+		b = append(b, optionPad)
+	}
+	return b
+}
+
+// essentialOptions4 are the options that are never trimmed from a response,
+// as the client cannot use the response without them.
+var essentialOptions4 = map[uint8]bool{
+	dhcpv4.OptionSubnetMask.Code():            true,
+	dhcpv4.OptionIPAddressLeaseTime.Code():    true,
+	dhcpv4.OptionDHCPMessageType.Code():       true,
+	dhcpv4.OptionServerIdentifier.Code():      true,
+	dhcpv4.OptionRenewTimeValue.Code():        true,
+	dhcpv4.OptionRebindingTimeValue.Code():    true,
+	dhcpv4.OptionRelayAgentInformation.Code(): true,
+}
+
+// trimOrder4 returns the codes of the options of resp that can be trimmed, in
+// the order they should be: first the options that the client did not
+// request, by descending code, then the requested ones, from the last of the
+// Parameter Request List.
+func trimOrder4(req, resp *dhcpv4.DHCPv4) []uint8 {
+	rank := make(map[uint8]int)
+	for i, code := range req.ParameterRequestList() {
+		rank[code.Code()] = i + 1
+	}
+	var codes []uint8
+	for code := range resp.Options {
+		if !essentialOptions4[code] && code != dhcpv4.OptionOptionOverload.Code() {
+			codes = append(codes, code)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		ri, rj := rank[codes[i]], rank[codes[j]]
+		if (ri == 0) != (rj == 0) {
+			return ri == 0
+		}
+		if ri != rj {
+			return ri > rj
+		}
+		return codes[i] > codes[j]
+	})
+	return codes
+}
+
+// Fit4 returns the wire encoding of a response that fits in maxSize bytes,
+// overloading the options if overload is true, and else or if it is not
+// enough, leaving out options as ordered by trimOrder4. It also returns the
+// codes of the options left out, if any. The response itself is unchanged.
+func Fit4(req, resp *dhcpv4.DHCPv4, maxSize int, overload bool) ([]byte, []uint8) {
+	encode := Encode4
+	if overload {
+		encode = func(msg *dhcpv4.DHCPv4) []byte { return EncodeOverload4(msg, maxSize) }
+	}
+	b := encode(resp)
+	if len(b) <= maxSize {
+		return b, nil
+	}
+	msg := *resp
+	msg.Options = make(dhcpv4.Options, len(resp.Options))
+	for code, value := range resp.Options {
+		msg.Options[code] = value
+	}
+	var trimmed []uint8
+	for _, code := range trimOrder4(req, resp) {
+		delete(msg.Options, code)
+		trimmed = append(trimmed, code)
+		if b = encode(&msg); len(b) <= maxSize {
+			break
+		}
+	}
+	return b, trimmed
+}
+
+// UserClasses4 returns the instances of the user class option (option 77) of
+// a DHCPv4 request. The option is encoded as per RFC 3004, as instances
+// preceded by their length, but some clients such as iPXE and Windows send a
+// single plain string, which is returned as is.
+func UserClasses4(req *dhcpv4.DHCPv4) [][]byte {
+	data := req.GetOneOption(dhcpv4.OptionUserClassInformation)
+	if len(data) == 0 {
+		return nil
+	}
+	var ret [][]byte
+	for rest := data; len(rest) > 0; {
+		length := int(rest[0])
+		if length == 0 || len(rest) < 1+length {
+			return [][]byte{data}
+		}
+		ret = append(ret, rest[1:1+length])
+		rest = rest[1+length:]
+	}
+	return ret
+}
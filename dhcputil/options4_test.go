@@ -0,0 +1,334 @@
+package dhcputil
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// decode4 returns the options of the wire encoding of a DHCPv4 message,
+// including the ones of the file and sname fields if it is overloaded.
+func decode4(t *testing.T, b []byte) dhcpv4.Options {
+	t.Helper()
+	if len(b) < minSize4 {
+		t.Fatalf("message of %d bytes, shorter than %d", len(b), minSize4)
+	}
+	opts := make(dhcpv4.Options)
+	if err := ParseOptions4(b[headerSize4:], opts); err != nil {
+		t.Fatalf("options field: %v", err)
+	}
+	overload := opts[dhcpv4.OptionOptionOverload.Code()]
+	if overload == nil {
+		return opts
+	}
+	delete(opts, dhcpv4.OptionOptionOverload.Code())
+	if overload[0]&overloadFile != 0 {
+		if err := ParseOptions4(b[fileOffset4:fileOffset4+fileSize4], opts); err != nil {
+			t.Fatalf("file field: %v", err)
+		}
+	}
+	if overload[0]&overloadSname != 0 {
+		if err := ParseOptions4(b[snameOffset4:snameOffset4+snameSize4], opts); err != nil {
+			t.Fatalf("sname field: %v", err)
+		}
+	}
+	return opts
+}
+
+// sameOptions4 fails the test if the options differ.
+func sameOptions4(t *testing.T, got, want dhcpv4.Options) {
+	t.Helper()
+	if !reflect.DeepEqual(OptionCodes4(got), OptionCodes4(want)) {
+		t.Fatalf("got the options %v, want %v", OptionCodes4(got), OptionCodes4(want))
+	}
+	for code, value := range want {
+		if !bytes.Equal(got[code], value) {
+			t.Errorf("option %d: got %d bytes, want %d", code, len(got[code]), len(value))
+		}
+	}
+}
+
+// filled returns n bytes of a value that differs at every byte.
+func filled(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	return b
+}
+
+func newMessage4(t *testing.T, opts ...dhcpv4.Option) *dhcpv4.DHCPv4 {
+	t.Helper()
+	msg, err := dhcpv4.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opt := range opts {
+		msg.UpdateOption(opt)
+	}
+	return msg
+}
+
+func TestAppendOption4(t *testing.T) {
+	for _, tt := range []struct {
+		length    int
+		instances int
+	}{
+		{0, 1},
+		{1, 1},
+		{255, 1},
+		{256, 2},
+		{510, 2},
+		{600, 3},
+	} {
+		value := filled(tt.length)
+		b := AppendOption4(nil, 121, value)
+		if len(b) != tt.length+2*tt.instances {
+			t.Errorf("%d bytes: got an encoding of %d bytes, want %d", tt.length, len(b), tt.length+2*tt.instances)
+			continue
+		}
+		opts := make(dhcpv4.Options)
+		if err := ParseOptions4(b, opts); err != nil {
+			t.Errorf("%d bytes: %v", tt.length, err)
+			continue
+		}
+		if !bytes.Equal(opts[121], value) {
+			t.Errorf("%d bytes: got %v, want %v", tt.length, opts[121], value)
+		}
+	}
+}
+
+func TestParseOptions4Truncated(t *testing.T) {
+	for _, data := range [][]byte{
+		{121},
+		{121, 4, 1, 2},
+	} {
+		if err := ParseOptions4(data, make(dhcpv4.Options)); err == nil {
+			t.Errorf("%v: no error", data)
+		}
+	}
+}
+
+func TestEncode4LongOptions(t *testing.T) {
+	msg := newMessage4(t,
+		dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, filled(255)),
+		dhcpv4.OptGeneric(dhcpv4.OptionClasslessStaticRoute, filled(600)),
+	)
+	b := Encode4(msg)
+	if !bytes.Equal(b[:headerSize4], msg.ToBytes()[:headerSize4]) {
+		t.Error("the header differs from the one of ToBytes")
+	}
+	if b[len(b)-1] != optionEnd && b[len(b)-1] != optionPad {
+		t.Errorf("the message ends with %d", b[len(b)-1])
+	}
+	sameOptions4(t, decode4(t, b), msg.Options)
+}
+
+func TestEncode4Padding(t *testing.T) {
+	msg := newMessage4(t, dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	if b := Encode4(msg); len(b) != minSize4 {
+		t.Errorf("got %d bytes, want %d", len(b), minSize4)
+	}
+}
+
+func TestEncodeOverload4(t *testing.T) {
+	msg := newMessage4(t,
+		dhcpv4.OptSubnetMask(net.CIDRMask(24, 32)),
+		dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(200), filled(100)),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(201), filled(100)),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(202), filled(100)),
+		dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(203), filled(50)),
+	)
+	maxSize := MinMaxMessageSize4 - ipUDPHeaderSize4
+	if len(Encode4(msg)) <= maxSize {
+		t.Fatal("the message fits without the overload")
+	}
+	b := EncodeOverload4(msg, maxSize)
+	if len(b) > maxSize {
+		t.Errorf("got %d bytes, want at most %d", len(b), maxSize)
+	}
+	opts := make(dhcpv4.Options)
+	if err := ParseOptions4(b[headerSize4:], opts); err != nil {
+		t.Fatal(err)
+	}
+	// 202 goes to the file field, and 203 to the sname one
+	if got := opts[dhcpv4.OptionOptionOverload.Code()]; !bytes.Equal(got, []byte{overloadBoth}) {
+		t.Errorf("got the Option Overload %v, want %d", got, overloadBoth)
+	}
+	for _, code := range []uint8{202, 203} {
+		if _, ok := opts[code]; ok {
+			t.Errorf("option %d is in the options field", code)
+		}
+	}
+	sameOptions4(t, decode4(t, b), msg.Options)
+}
+
+func TestEncodeOverload4UsedFile(t *testing.T) {
+	msg := newMessage4(t, dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(200), filled(400)))
+	msg.BootFileName = "pxelinux.0"
+	b := EncodeOverload4(msg, MinMaxMessageSize4-ipUDPHeaderSize4)
+	if !bytes.Equal(b, Encode4(msg)) {
+		t.Error("the options of a message with a boot file name were overloaded")
+	}
+}
+
+func TestUnoverload4(t *testing.T) {
+	file := AppendOption4(nil, 200, []byte("cd"))
+	file = AppendOption4(file, 201, []byte("file"))
+	sname := AppendOption4(nil, 202, []byte("sname"))
+	for _, tt := range []struct {
+		name     string
+		overload byte
+		want     dhcpv4.Options
+		file     string
+		sname    string
+	}{
+		{
+			name:     "file",
+			overload: overloadFile,
+			want:     dhcpv4.Options{200: []byte("abcd"), 201: []byte("file")},
+			sname:    string(append(sname, optionEnd)),
+		},
+		{
+			name:     "sname",
+			overload: overloadSname,
+			want:     dhcpv4.Options{200: []byte("ab"), 202: []byte("sname")},
+			file:     string(append(file, optionEnd)),
+		},
+		{
+			name:     "both",
+			overload: overloadBoth,
+			want:     dhcpv4.Options{200: []byte("abcd"), 201: []byte("file"), 202: []byte("sname")},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := newMessage4(t,
+				dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(200), []byte("ab")),
+				dhcpv4.OptGeneric(dhcpv4.OptionOptionOverload, []byte{tt.overload}),
+			)
+			msg.BootFileName = string(append(file, optionEnd))
+			msg.ServerHostName = string(append(sname, optionEnd))
+			if err := Unoverload4(msg); err != nil {
+				t.Fatal(err)
+			}
+			sameOptions4(t, msg.Options, tt.want)
+			if msg.BootFileName != tt.file {
+				t.Errorf("got the file %q, want %q", msg.BootFileName, tt.file)
+			}
+			if msg.ServerHostName != tt.sname {
+				t.Errorf("got the sname %q, want %q", msg.ServerHostName, tt.sname)
+			}
+		})
+	}
+}
+
+func TestUnoverload4Invalid(t *testing.T) {
+	for _, value := range [][]byte{{0}, {4}, {1, 2}} {
+		msg := newMessage4(t, dhcpv4.OptGeneric(dhcpv4.OptionOptionOverload, value))
+		if err := Unoverload4(msg); err == nil {
+			t.Errorf("%v: no error", value)
+		}
+	}
+}
+
+func TestMaxMessageSize4(t *testing.T) {
+	for _, tt := range []struct {
+		option uint16
+		mtu    int
+		want   int
+	}{
+		{0, 0, 548},
+		{0, 1500, 548},
+		{400, 0, 548},
+		{1500, 0, 1472},
+		{1500, 1400, 1372},
+		{9000, 1500, 1472},
+	} {
+		req := newMessage4(t)
+		if tt.option != 0 {
+			req.UpdateOption(dhcpv4.OptMaxMessageSize(tt.option))
+		}
+		if got := MaxMessageSize4(req, tt.mtu); got != tt.want {
+			t.Errorf("option %d, MTU %d: got %d, want %d", tt.option, tt.mtu, got, tt.want)
+		}
+	}
+}
+
+// fitMessages4 returns a request for the router, DNS and domain options, and
+// a response of 595 bytes with the essential options, the requested ones and
+// two that were not requested.
+func fitMessages4(t *testing.T) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	req := newMessage4(t,
+		dhcpv4.OptMessageType(dhcpv4.MessageTypeDiscover),
+		dhcpv4.OptParameterRequestList(dhcpv4.OptionRouter, dhcpv4.OptionDomainNameServer, dhcpv4.OptionDomainName),
+		dhcpv4.OptMaxMessageSize(1500),
+	)
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.IPv4(192, 0, 2, 1))),
+		dhcpv4.WithOption(dhcpv4.OptIPAddressLeaseTime(time.Hour)),
+		dhcpv4.WithOption(dhcpv4.OptSubnetMask(net.CIDRMask(24, 32))),
+		dhcpv4.WithOption(dhcpv4.OptRouter(net.IPv4(192, 0, 2, 1))),
+		dhcpv4.WithOption(dhcpv4.OptDNS(net.IPv4(192, 0, 2, 53), net.IPv4(192, 0, 2, 54))),
+		dhcpv4.WithOption(dhcpv4.OptDomainName("example.org")),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(200), filled(250))),
+		dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(201), filled(50))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req, resp
+}
+
+func TestTrimOrder4(t *testing.T) {
+	req, resp := fitMessages4(t)
+	want := []uint8{201, 200, dhcpv4.OptionDomainName.Code(), dhcpv4.OptionDomainNameServer.Code(), dhcpv4.OptionRouter.Code()}
+	if got := trimOrder4(req, resp); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestFit4(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		mtu      int
+		overload bool
+		trimmed  []uint8
+	}{
+		// the response fits in the 1500 bytes the client accepts
+		{name: "option", mtu: 0, trimmed: nil},
+		// 576 bytes, the minimum size that the clients accept
+		{name: "576", mtu: MinMaxMessageSize4, trimmed: []uint8{201}},
+		{name: "576-overload", mtu: MinMaxMessageSize4, overload: true, trimmed: nil},
+		{name: "mtu", mtu: 500, trimmed: []uint8{201, 200}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := fitMessages4(t)
+			maxSize := MaxMessageSize4(req, tt.mtu)
+			b, trimmed := Fit4(req, resp, maxSize, tt.overload)
+			if len(b) > maxSize {
+				t.Errorf("got %d bytes, want at most %d", len(b), maxSize)
+			}
+			if !reflect.DeepEqual(trimmed, tt.trimmed) {
+				t.Errorf("got the trimmed options %v, want %v", trimmed, tt.trimmed)
+			}
+			want := make(dhcpv4.Options)
+			for code, value := range resp.Options {
+				want[code] = value
+			}
+			for _, code := range tt.trimmed {
+				if _, ok := resp.Options[code]; !ok {
+					t.Errorf("option %d was removed from the response", code)
+				}
+				delete(want, code)
+			}
+			sameOptions4(t, decode4(t, b), want)
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package dhcputil
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// The transaction IDs of the messages initiated by the server are random, from
+// crypto/rand, so that an off-path attacker cannot predict them to spoof the
+// replies of the clients.
+
+// TransactionID4 returns a random DHCPv4 transaction ID.
+func TransactionID4() (dhcpv4.TransactionID, error) {
+	var xid dhcpv4.TransactionID
+	_, err := rand.Read(xid[:])
+	return xid, err
+}
+
+// TransactionID6 returns a random DHCPv6 transaction ID, of 24 bits.
+func TransactionID6() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[1:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
@@ -0,0 +1,32 @@
+// Package dnsname encodes domain names in the DNS wire format (RFC 1035,
+// section 3.1), as used by the DHCP options carrying domain names.
+package dnsname
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Encode returns the concatenated wire format of the given domain names, each
+// as a sequence of length-prefixed labels terminated by the root label. Names
+// are not compressed.
+func Encode(names ...string) ([]byte, error) {
+	var buf []byte
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		if len(name) > 253 {
+			return nil, fmt.Errorf("domain name too long: %s", name)
+		}
+		if name != "" {
+			for _, label := range strings.Split(name, ".") {
+				if len(label) == 0 || len(label) > 63 {
+					return nil, fmt.Errorf("invalid label in domain name: %s", name)
+				}
+				buf = append(buf, byte(len(label)))
+				buf = append(buf, label...)
+			}
+		}
+		buf = append(buf, 0)
+	}
+	return buf, nil
+}
@@ -0,0 +1,59 @@
+package coredhcp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dualstack"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// registerDualStackHandlers registers the dual-stack view endpoint: GET
+// /dualstack returns the hosts correlated by the dualstack plugin with their
+// DHCPv4 and DHCPv6 leases, and GET /dualstack?hw-address=<mac>,
+// ?duid=<hex> or ?fqdn=<name> the host with that identity in either protocol.
+func registerDualStackHandlers(m *management.Server, table *dualstack.Table, store leases.Store) {
+	m.HandleFunc("/dualstack", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var host *dualstack.Host
+		q := r.URL.Query()
+		switch {
+		case q.Get("hw-address") != "":
+			hwaddr, err := net.ParseMAC(q.Get("hw-address"))
+			if err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			host = table.ByHWAddr(hwaddr)
+		case q.Get("duid") != "":
+			host = table.ByDUID(strings.Replace(q.Get("duid"), ":", "", -1))
+		case q.Get("fqdn") != "":
+			host = table.ByFQDN(q.Get("fqdn"))
+		default:
+			views, err := dualstack.Views(store, table.Hosts())
+			if err != nil {
+				management.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			management.WriteJSON(w, http.StatusOK, views)
+			return
+		}
+		if host == nil {
+			management.WriteError(w, http.StatusNotFound, errors.New("unknown host"))
+			return
+		}
+		views, err := dualstack.Views(store, []*dualstack.Host{host})
+		if err != nil {
+			management.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		management.WriteJSON(w, http.StatusOK, views[0])
+	})
+}
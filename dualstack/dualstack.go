@@ -0,0 +1,354 @@
+// Package dualstack correlates the DHCPv4 and DHCPv6 identities of the hosts,
+// from the hardware addresses the DHCPv6 clients expose in their DUIDs or
+// through their relays, the DUIDs the DHCPv4 clients send in their client
+// identifiers (RFC 4361), and their fully qualified domain names. It gives a
+// single view of each host across both protocols to the events, the
+// management interfaces and the DNS registration.
+package dualstack
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// DefaultTTL is the time after which the hosts not seen in either protocol
+// are forgotten.
+const DefaultTTL = 7 * 24 * time.Hour
+
+// sweepInterval is the minimum interval between the removals of the hosts not
+// seen for the TTL.
+const sweepInterval = time.Minute
+
+// Host is the identity of a host across both protocols.
+type Host struct {
+	HWAddr net.HardwareAddr `json:"hw-address,omitempty"`
+	// DUIDs are in hex, like the client identifiers of the DHCPv6 leases.
+	DUIDs []string `json:"duids,omitempty"`
+	FQDN  string   `json:"fqdn,omitempty"`
+	// Seen4 and Seen6 are the last times the host was seen in each
+	// protocol, zero if never.
+	Seen4 time.Time `json:"seen4,omitempty"`
+	Seen6 time.Time `json:"seen6,omitempty"`
+}
+
+// DualStack returns whether the host was seen in both protocols.
+func (h *Host) DualStack() bool {
+	return !h.Seen4.IsZero() && !h.Seen6.IsZero()
+}
+
+func (h *Host) lastSeen() time.Time {
+	if h.Seen4.After(h.Seen6) {
+		return h.Seen4
+	}
+	return h.Seen6
+}
+
+func copyHost(h *Host) *Host {
+	c := *h
+	c.DUIDs = append([]string(nil), h.DUIDs...)
+	return &c
+}
+
+// Table holds the hosts, indexed by hardware address, DUID and FQDN. It is
+// safe for concurrent use.
+type Table struct {
+	ttl time.Duration
+
+	lock   sync.RWMutex
+	byHW   map[string]*Host
+	byDUID map[string]*Host
+	byFQDN map[string]*Host
+	swept  time.Time
+}
+
+// NewTable returns an empty Table, forgetting the hosts not seen for ttl.
+func NewTable(ttl time.Duration) *Table {
+	return &Table{
+		ttl:    ttl,
+		byHW:   make(map[string]*Host),
+		byDUID: make(map[string]*Host),
+		byFQDN: make(map[string]*Host),
+	}
+}
+
+// Default is the table shared by the plugins and the management interfaces.
+var Default = NewTable(DefaultTTL)
+
+// normalizeFQDN returns a name in the form used by the index, lowercased and
+// without the root label.
+func normalizeFQDN(fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(fqdn, "."))
+}
+
+// Learn4 records that a DHCPv4 client was seen, with its hardware address, the
+// DUID of its RFC 4361 client identifier if any, and its FQDN if known, and
+// returns the correlated host.
+func (t *Table) Learn4(hwaddr net.HardwareAddr, duid, fqdn string, now time.Time) *Host {
+	return t.learn(hwaddr, duid, fqdn, now, false)
+}
+
+// Learn6 is like Learn4, but for a DHCPv6 client, with its DUID and the
+// hardware address extracted from it or from its relay, if any.
+func (t *Table) Learn6(duid string, hwaddr net.HardwareAddr, fqdn string, now time.Time) *Host {
+	return t.learn(hwaddr, duid, fqdn, now, true)
+}
+
+func (t *Table) learn(hwaddr net.HardwareAddr, duid, fqdn string, now time.Time, v6 bool) *Host {
+	fqdn = normalizeFQDN(fqdn)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if now.Sub(t.swept) > sweepInterval {
+		t.sweep(now)
+	}
+	// the identities of the request select the hosts they belong to, which
+	// are merged: the hardware address and the DUID are stronger than the
+	// name, which only links hosts that are not linked otherwise
+	var h *Host
+	for _, found := range []*Host{t.byHW[hwaddr.String()], t.byDUID[duid]} {
+		if found == nil || found == h {
+			continue
+		}
+		if h == nil {
+			h = found
+		} else {
+			t.merge(h, found)
+		}
+	}
+	if fqdn != "" {
+		if found := t.byFQDN[fqdn]; found != nil && found != h {
+			if h == nil {
+				h = found
+			} else if compatible(h, found) {
+				t.merge(h, found)
+			}
+		}
+	}
+	if h == nil {
+		h = &Host{}
+	}
+	if len(hwaddr) > 0 && h.HWAddr == nil {
+		h.HWAddr = append(net.HardwareAddr(nil), hwaddr...)
+	}
+	if duid != "" && !contains(h.DUIDs, duid) {
+		h.DUIDs = append(h.DUIDs, duid)
+	}
+	if fqdn != "" && fqdn != h.FQDN {
+		if t.byFQDN[h.FQDN] == h {
+			delete(t.byFQDN, h.FQDN)
+		}
+		h.FQDN = fqdn
+	}
+	if v6 {
+		h.Seen6 = now
+	} else {
+		h.Seen4 = now
+	}
+	t.index(h)
+	return copyHost(h)
+}
+
+// compatible returns whether two hosts linked by their name can be the same
+// host, i.e. do not have different hardware addresses.
+func compatible(a, b *Host) bool {
+	return a.HWAddr == nil || b.HWAddr == nil || bytes.Equal(a.HWAddr, b.HWAddr)
+}
+
+// merge merges the host src into dst, and removes it from the indexes.
+func (t *Table) merge(dst, src *Host) {
+	t.unindex(src)
+	if dst.HWAddr == nil {
+		dst.HWAddr = src.HWAddr
+	}
+	for _, duid := range src.DUIDs {
+		if !contains(dst.DUIDs, duid) {
+			dst.DUIDs = append(dst.DUIDs, duid)
+		}
+	}
+	if dst.FQDN == "" {
+		dst.FQDN = src.FQDN
+	}
+	if src.Seen4.After(dst.Seen4) {
+		dst.Seen4 = src.Seen4
+	}
+	if src.Seen6.After(dst.Seen6) {
+		dst.Seen6 = src.Seen6
+	}
+}
+
+func (t *Table) index(h *Host) {
+	if h.HWAddr != nil {
+		t.byHW[h.HWAddr.String()] = h
+	}
+	for _, duid := range h.DUIDs {
+		t.byDUID[duid] = h
+	}
+	if h.FQDN != "" {
+		t.byFQDN[h.FQDN] = h
+	}
+}
+
+func (t *Table) unindex(h *Host) {
+	if h.HWAddr != nil && t.byHW[h.HWAddr.String()] == h {
+		delete(t.byHW, h.HWAddr.String())
+	}
+	for _, duid := range h.DUIDs {
+		if t.byDUID[duid] == h {
+			delete(t.byDUID, duid)
+		}
+	}
+	if h.FQDN != "" && t.byFQDN[h.FQDN] == h {
+		delete(t.byFQDN, h.FQDN)
+	}
+}
+
+// sweep removes the hosts not seen for the TTL. The lock must be held.
+func (t *Table) sweep(now time.Time) {
+	t.swept = now
+	for _, index := range []map[string]*Host{t.byHW, t.byDUID, t.byFQDN} {
+		for _, h := range index {
+			if now.Sub(h.lastSeen()) > t.ttl {
+				t.unindex(h)
+			}
+		}
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ByHWAddr returns the host with a hardware address, or nil.
+func (t *Table) ByHWAddr(hwaddr net.HardwareAddr) *Host {
+	return t.get(t.byHW, hwaddr.String())
+}
+
+// ByDUID returns the host with a DUID, in hex, or nil.
+func (t *Table) ByDUID(duid string) *Host {
+	return t.get(t.byDUID, strings.ToLower(duid))
+}
+
+// ByFQDN returns the host with a FQDN, or nil.
+func (t *Table) ByFQDN(fqdn string) *Host {
+	return t.get(t.byFQDN, normalizeFQDN(fqdn))
+}
+
+func (t *Table) get(index map[string]*Host, key string) *Host {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	if h, ok := index[key]; ok {
+		return copyHost(h)
+	}
+	return nil
+}
+
+// Lookup returns the host of a lease, by its hardware address or, for the
+// DHCPv6 leases, its DUID, or nil.
+func (t *Table) Lookup(l *leases.Lease) *Host {
+	if l.HWAddr != nil {
+		if h := t.ByHWAddr(l.HWAddr); h != nil {
+			return h
+		}
+	}
+	if l.ClientID != "" && l.IP.To4() == nil {
+		return t.ByDUID(l.ClientID)
+	}
+	return nil
+}
+
+// Hosts returns all the hosts, the dual-stack ones first, then by FQDN and
+// hardware address.
+func (t *Table) Hosts() []*Host {
+	t.lock.RLock()
+	seen := make(map[*Host]bool)
+	var ret []*Host
+	for _, index := range []map[string]*Host{t.byHW, t.byDUID, t.byFQDN} {
+		for _, h := range index {
+			if !seen[h] {
+				seen[h] = true
+				ret = append(ret, copyHost(h))
+			}
+		}
+	}
+	t.lock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		a, b := ret[i], ret[j]
+		if a.DualStack() != b.DualStack() {
+			return a.DualStack()
+		}
+		if a.FQDN != b.FQDN {
+			return a.FQDN < b.FQDN
+		}
+		return a.HWAddr.String() < b.HWAddr.String()
+	})
+	return ret
+}
+
+// View is a host with its leases in both protocols.
+type View struct {
+	*Host
+	Leases4 []*leases.Lease `json:"leases4"`
+	Leases6 []*leases.Lease `json:"leases6"`
+}
+
+// Views returns the hosts with their leases in a store, which is scanned
+// once: the views are indexed by hardware address and DUID, and each lease is
+// added to the views of its identities.
+func Views(store leases.Store, hosts []*Host) ([]*View, error) {
+	all, err := store.Leases()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*View, 0, len(hosts))
+	byHW := make(map[string][]*View)
+	byDUID := make(map[string][]*View)
+	for _, h := range hosts {
+		v := &View{Host: h, Leases4: []*leases.Lease{}, Leases6: []*leases.Lease{}}
+		ret = append(ret, v)
+		if h.HWAddr != nil {
+			byHW[string(h.HWAddr)] = append(byHW[string(h.HWAddr)], v)
+		}
+		for _, duid := range h.DUIDs {
+			byDUID[duid] = append(byDUID[duid], v)
+		}
+	}
+	for _, l := range all {
+		if l.IP.To4() != nil {
+			for _, v := range byHW[string(l.HWAddr)] {
+				v.Leases4 = append(v.Leases4, l)
+			}
+			continue
+		}
+		// a DHCPv6 lease belongs to the hosts of its DUID and of its
+		// hardware address, once each
+		matched := byDUID[l.ClientID]
+		for _, v := range byHW[string(l.HWAddr)] {
+			if !containsView(matched, v) {
+				matched = append(matched[:len(matched):len(matched)], v)
+			}
+		}
+		for _, v := range matched {
+			v.Leases6 = append(v.Leases6, l)
+		}
+	}
+	return ret, nil
+}
+
+func containsView(views []*View, v *View) bool {
+	for _, found := range views {
+		if found == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package coredhcp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/sirupsen/logrus"
+)
+
+// dumpFlag returns the feature flag of the clients whose options are dumped,
+// of a server configuration which can be nil.
+func dumpFlag(sc *config.ServerConfig) string {
+	if sc == nil {
+		return ""
+	}
+	return sc.DumpOptions
+}
+
+// addOptions adds the decoded options to the fields of a log entry, with a
+// prefix.
+func addOptions(fields logrus.Fields, prefix string, opts []dhcputil.DecodedOption) {
+	for _, o := range opts {
+		value := o.Hex
+		if o.Value != o.Hex {
+			value = fmt.Sprintf("%s [%s]", o.Value, o.Hex)
+		}
+		fields[prefix+o.Key()] = value
+	}
+}
+
+// dumpOptions6 logs the decoded options of a DHCPv6 message, and of the
+// relays it went through, if the feature flag of the dump is enabled for the
+// client of the transaction. The relay options are prefixed with the hop,
+// from the server, e.g. `relay0-`.
+func dumpOptions6(ctx context.Context, flag, direction string, d dhcpv6.DHCPv6) {
+	if flag == "" || d == nil || !handler.Feature(ctx, flag) {
+		return
+	}
+	fields := logrus.Fields{}
+	for hop := 0; d.IsRelay(); hop++ {
+		addOptions(fields, fmt.Sprintf("relay%d-", hop), dhcputil.DecodeOptions6(d))
+		inner, err := dhcpv6.DecapsulateRelay(d)
+		if err != nil {
+			return
+		}
+		d = inner
+	}
+	addOptions(fields, "", dhcputil.DecodeOptions6(d))
+	logger.FromContext(ctx).WithFields(fields).Printf("Decoded DHCPv6 %s %s", direction, d.Type())
+}
+
+// dumpOptions4 is like dumpOptions6, for a DHCPv4 message, whose header
+// addresses are logged along with the options.
+func dumpOptions4(ctx context.Context, flag, direction string, d *dhcpv4.DHCPv4) {
+	if flag == "" || d == nil || !handler.Feature(ctx, flag) {
+		return
+	}
+	fields := logrus.Fields{
+		"chaddr": d.ClientHWAddr.String(),
+		"ciaddr": d.ClientIPAddr.String(),
+		"yiaddr": d.YourIPAddr.String(),
+		"giaddr": d.GatewayIPAddr.String(),
+	}
+	addOptions(fields, "", dhcputil.DecodeOptions4(d.Options))
+	logger.FromContext(ctx).WithFields(fields).Printf("Decoded DHCPv4 %s %s", direction, d.MessageType())
+}
@@ -0,0 +1,52 @@
+package coredhcp
+
+import (
+	"net"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/metadata"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Embed loads the plugins of a configuration into a Server that does not
+// listen, for the programs that already serve DHCP with the dhcpv6 and dhcpv4
+// packages: they serve the plugin chains with their own dhcpv6.Server and
+// dhcpv4.Server, see Handler6 and Handler4. The listeners, the management API
+// and the lease maintenance of the configuration are left to the caller.
+func Embed(conf *config.Config) (*Server, error) {
+	s := NewServer(conf)
+	metadata.Set(conf.Server6, conf.Server4)
+	loaded, err := s.LoadPlugins(conf)
+	if err != nil {
+		return nil, err
+	}
+	commitPlugins(loaded)
+	return s, nil
+}
+
+// Handler6 returns the DHCPv6 plugin chain as a dhcpv6.Handler, for
+// dhcpv6.NewServer. The requests the chain passes over, i.e. that it runs to
+// its end without a response, are passed to next, if not nil, e.g. the
+// handler the program used so far, so that it can move to the plugins one
+// client class or one message type at a time. The requests dropped on purpose,
+// e.g. by a plugin stopping the chain, shed or quarantined, are not:
+//
+//	server := dhcpv6.NewServer(addr, s.Handler6(legacyHandler))
+func (s *Server) Handler6(next dhcpv6.Handler) dhcpv6.Handler {
+	return func(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6) {
+		if s.serve6(conn, peer, req, nil) && next != nil {
+			next(conn, peer, req)
+		}
+	}
+}
+
+// Handler4 is like Handler6, but returns the DHCPv4 plugin chain as a
+// dhcpv4.Handler.
+func (s *Server) Handler4(next dhcpv4.Handler) dhcpv4.Handler {
+	return func(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+		if s.serve4(conn, peer, req, nil) && next != nil {
+			next(conn, peer, req)
+		}
+	}
+}
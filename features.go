@@ -0,0 +1,48 @@
+package coredhcp
+
+import (
+	"context"
+	"encoding/hex"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// featureClient6 returns the identifier of the client of a DHCPv6 request the
+// feature flags are evaluated for: its DUID, in hex.
+func featureClient6(req dhcpv6.DHCPv6) string {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return ""
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(cid.Cid.ToBytes())
+}
+
+// featureClient4 is like featureClient6, but returns the hardware address of
+// the client of a DHCPv4 request.
+func featureClient4(req *dhcpv4.DHCPv4) string {
+	return req.ClientHWAddr.String()
+}
+
+// gated returns whether a plugin is skipped because the feature flag that
+// gates it is disabled for the client of the transaction.
+func gated(ctx context.Context, gates map[string]string, name string) bool {
+	flag, ok := gates[name]
+	return ok && !handler.Feature(ctx, flag)
+}
+
+// featureGates returns the feature gates of a server configuration, which can
+// be nil.
+func featureGates(sc *config.ServerConfig) map[string]string {
+	if sc == nil {
+		return nil
+	}
+	return sc.FeatureGates
+}
@@ -0,0 +1,88 @@
+//go:build gofuzz
+// +build gofuzz
+
+package coredhcp
+
+// Fuzzing targets for go-fuzz (https://github.com/dvyukov/go-fuzz). Build and
+// run them with:
+//
+//   go-fuzz-build -func Fuzz6 github.com/coredhcp/coredhcp
+//   go-fuzz -bin coredhcp-fuzz.zip -workdir fuzz6
+//
+// or with `go-fuzz-build -libfuzzer` to use them with libFuzzer.
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/plugins"
+	// plugins exercised by the fuzzing targets
+	_ "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// discardConn is a net.PacketConn that drops everything it is asked to send.
+type discardConn struct{}
+
+func (discardConn) ReadFrom(b []byte) (int, net.Addr, error) { return 0, nil, nil }
+func (discardConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var (
+	fuzzServer     *Server
+	fuzzServerOnce sync.Once
+	fuzzPeer       = &net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 546}
+)
+
+// getFuzzServer returns a Server with a handler chain that behaves like a
+// typical configuration.
+func getFuzzServer() *Server {
+	fuzzServerOnce.Do(func() {
+		fuzzServer = NewServer(config.New())
+		h6, err := plugins.RegisteredPlugins["server_id"].Setup6("LL", "00:de:ad:be:ef:00")
+		if err != nil {
+			panic(err)
+		}
+		fuzzServer.Handlers6 = append(fuzzServer.Handlers6, h6)
+		fuzzServer.names6 = append(fuzzServer.names6, "server_id")
+	})
+	return fuzzServer
+}
+
+// Fuzz6 feeds the data to the DHCPv6 packet handling path, including relayed
+// messages.
+func Fuzz6(data []byte) int {
+	req, err := dhcpv6.FromBytes(data)
+	if err != nil {
+		return 0
+	}
+	_ = req.Summary()
+	if req.IsRelay() {
+		if _, err := dhcpv6.DecapsulateRelay(req); err != nil {
+			return 0
+		}
+	}
+	getFuzzServer().MainHandler6(discardConn{}, fuzzPeer, req)
+	return 1
+}
+
+// Fuzz4 feeds the data to the DHCPv4 packet handling path, including the
+// parsing of all the options.
+func Fuzz4(data []byte) int {
+	req, err := dhcpv4.FromBytes(data)
+	if err != nil {
+		return 0
+	}
+	_ = req.Summary()
+	getFuzzServer().MainHandler4(discardConn{}, &net.UDPAddr{IP: net.IPv4bcast, Port: 68}, req)
+	return 1
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// features are the feature flags of a transaction, and the identifier of its
+// client they are evaluated for.
+type features struct {
+	flags  config.Features
+	client string
+}
+
+// WithFeatures returns a copy of ctx carrying the feature flags of the
+// server, evaluated for a client identified by its hardware address for
+// DHCPv4 or its DUID in hex for DHCPv6.
+func WithFeatures(ctx context.Context, flags config.Features, client string) context.Context {
+	return context.WithValue(ctx, featuresKey, &features{flags: flags, client: client})
+}
+
+// Feature returns whether a feature flag is enabled for the client of the
+// transaction, given the classes it was assigned to so far. Unknown flags are
+// disabled, so plugins can check flags which are not configured.
+func Feature(ctx context.Context, name string) bool {
+	f, _ := ctx.Value(featuresKey).(*features)
+	if f == nil {
+		return false
+	}
+	flag, ok := f.flags[name]
+	if !ok {
+		return false
+	}
+	return flag.Enabled(f.client, Classes(ctx))
+}
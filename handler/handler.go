@@ -1,6 +1,8 @@
 package handler
 
 import (
+	"context"
+
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/dhcpv6"
 )
@@ -13,7 +15,9 @@ import (
 // the result will be returned by the handler.
 // If the returned boolean is false, the returned packet may be nil or
 // invalid.
-type Handler6 func(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool)
+// The context is specific to the transaction: it carries its correlation ID
+// (see logger.FromContext) and its tracing span.
+type Handler6 func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool)
 
 // Handler4 behaves like Handler6, but for DHCPv4 packets.
-type Handler4 func(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
+type Handler4 func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
@@ -0,0 +1,375 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+type contextKey int
+
+const (
+	stateKey contextKey = iota
+	peerKey
+	connKey
+	featuresKey
+	packetKey
+	signerKey
+)
+
+// WithPeer returns a copy of ctx carrying the address the request was
+// received from.
+func WithPeer(ctx context.Context, peer net.Addr) context.Context {
+	return context.WithValue(ctx, peerKey, peer)
+}
+
+// Peer returns the address the request of the transaction was received from,
+// i.e. the client or its relay, or nil if unknown.
+func Peer(ctx context.Context) net.Addr {
+	peer, _ := ctx.Value(peerKey).(net.Addr)
+	return peer
+}
+
+// WithConn returns a copy of ctx carrying the connection the request was
+// received on.
+func WithConn(ctx context.Context, conn net.PacketConn) context.Context {
+	return context.WithValue(ctx, connKey, conn)
+}
+
+// Conn returns the connection the request of the transaction was received
+// on, e.g. for plugins sending server-initiated messages, or nil if unknown.
+func Conn(ctx context.Context) net.PacketConn {
+	conn, _ := ctx.Value(connKey).(net.PacketConn)
+	return conn
+}
+
+// WithPacket returns a copy of ctx carrying the request as received, which can
+// be nil.
+func WithPacket(ctx context.Context, packet []byte) context.Context {
+	return context.WithValue(ctx, packetKey, packet)
+}
+
+// Packet returns the request of the transaction as received on the wire,
+// e.g. to verify a digest over it, or nil if unknown, e.g. if the server is
+// embedded and gets the requests already parsed. It must not be modified.
+func Packet(ctx context.Context) []byte {
+	packet, _ := ctx.Value(packetKey).([]byte)
+	return packet
+}
+
+// Signer signs the final encoding of a response, in place.
+type Signer func(packet []byte) error
+
+// signerSlot holds the Signer of a transaction.
+type signerSlot struct {
+	lock   sync.Mutex
+	signer Signer
+}
+
+// WithSigner returns a copy of ctx where the plugins can set the Signer of
+// the response, see SetSigner.
+func WithSigner(ctx context.Context) context.Context {
+	return context.WithValue(ctx, signerKey, &signerSlot{})
+}
+
+// SetSigner sets the Signer of the response of the transaction, which the
+// server runs as the very last step of its encoding, once the options are
+// overloaded or trimmed to fit. It does nothing if the response is not sent,
+// e.g. when simulating the chain.
+func SetSigner(ctx context.Context, signer Signer) {
+	slot, ok := ctx.Value(signerKey).(*signerSlot)
+	if !ok {
+		return
+	}
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	slot.signer = signer
+}
+
+// Sign runs the Signer of the transaction on the encoding of its response, if
+// there is one.
+func Sign(ctx context.Context, packet []byte) error {
+	slot, ok := ctx.Value(signerKey).(*signerSlot)
+	if !ok {
+		return nil
+	}
+	slot.lock.Lock()
+	signer := slot.signer
+	slot.lock.Unlock()
+	if signer == nil {
+		return nil
+	}
+	return signer(packet)
+}
+
+// State is the per-transaction state shared by the plugins of a chain: the
+// classes the client was assigned to by the classification plugins, and the
+// option definitions of the server, which plugins resolve for the client.
+type State struct {
+	lock     sync.Mutex
+	classes  []string
+	levels   *config.OptionLevels
+	link     net.IP
+	hostname string
+	values   map[string]interface{}
+}
+
+// NewContext returns a copy of ctx carrying a new State, with the given
+// option definitions, which can be nil.
+func NewContext(ctx context.Context, levels *config.OptionLevels) context.Context {
+	return context.WithValue(ctx, stateKey, &State{levels: levels})
+}
+
+func stateFrom(ctx context.Context) *State {
+	state, _ := ctx.Value(stateKey).(*State)
+	return state
+}
+
+// Fork returns a copy of ctx carrying a copy of its State, and a function
+// that copies the State of the fork back, e.g. for a call of a plugin that
+// may be abandoned: its changes are only seen by the chain once committed.
+func Fork(ctx context.Context) (context.Context, func()) {
+	state := stateFrom(ctx)
+	if state == nil {
+		return ctx, func() {}
+	}
+	state.lock.Lock()
+	fork := State{
+		classes:  append([]string(nil), state.classes...),
+		levels:   state.levels,
+		link:     state.link,
+		hostname: state.hostname,
+	}
+	if state.values != nil {
+		fork.values = make(map[string]interface{}, len(state.values))
+		for k, v := range state.values {
+			fork.values[k] = v
+		}
+	}
+	state.lock.Unlock()
+	commit := func() {
+		fork.lock.Lock()
+		defer fork.lock.Unlock()
+		state.lock.Lock()
+		defer state.lock.Unlock()
+		state.classes, state.link, state.hostname, state.values = fork.classes, fork.link, fork.hostname, fork.values
+	}
+	return context.WithValue(ctx, stateKey, &fork), commit
+}
+
+// AddClass assigns the client of the transaction to a class. Classes added
+// later take precedence when resolving options.
+func AddClass(ctx context.Context, class string) {
+	state := stateFrom(ctx)
+	if state == nil {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, c := range state.classes {
+		if c == class {
+			return
+		}
+	}
+	state.classes = append(state.classes, class)
+}
+
+// Classes returns the classes the client of the transaction was assigned to.
+func Classes(ctx context.Context) []string {
+	state := stateFrom(ctx)
+	if state == nil {
+		return nil
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return append([]string(nil), state.classes...)
+}
+
+// InClass returns whether the client of the transaction is in a class.
+func InClass(ctx context.Context, class string) bool {
+	for _, c := range Classes(ctx) {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// SetValue stores a value in the state of the transaction, for the later
+// plugins of the chain. Keys should be prefixed with the name of the plugin.
+func SetValue(ctx context.Context, key string, value interface{}) {
+	state := stateFrom(ctx)
+	if state == nil {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if state.values == nil {
+		state.values = make(map[string]interface{})
+	}
+	state.values[key] = value
+}
+
+// Value returns a value stored by SetValue, or nil.
+func Value(ctx context.Context, key string) interface{} {
+	state := stateFrom(ctx)
+	if state == nil {
+		return nil
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.values[key]
+}
+
+// SetLinkAddress selects the link of the client of the transaction, e.g. from
+// the link selection options of a trusted relay, overriding the address of the
+// relay for the choice of the subnet.
+func SetLinkAddress(ctx context.Context, ip net.IP) {
+	state := stateFrom(ctx)
+	if state == nil {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.link = ip
+}
+
+// LinkAddress returns the address set by SetLinkAddress, or nil.
+func LinkAddress(ctx context.Context) net.IP {
+	state := stateFrom(ctx)
+	if state == nil {
+		return nil
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.link
+}
+
+// SetHostname sets the host name of the client of the transaction, as sent by
+// it or chosen by the plugins, for the plugins that store it on the lease or
+// register it in the DNS.
+func SetHostname(ctx context.Context, name string) {
+	state := stateFrom(ctx)
+	if state == nil {
+		return
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.hostname = name
+}
+
+// Hostname returns the host name set by SetHostname, or an empty string.
+func Hostname(ctx context.Context) string {
+	state := stateFrom(ctx)
+	if state == nil {
+		return ""
+	}
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.hostname
+}
+
+// Address4 returns the address that identifies the subnet of a DHCPv4 client:
+// the address assigned to it in the response, if any, or else its current
+// address, or else the address of its link, as set by SetLinkAddress or as the
+// address of its relay. It returns nil if there is none.
+func Address4(ctx context.Context, req, resp *dhcpv4.DHCPv4) net.IP {
+	var candidates []net.IP
+	if resp != nil {
+		candidates = append(candidates, resp.YourIPAddr)
+	}
+	candidates = append(candidates, req.ClientIPAddr, LinkAddress(ctx), req.GatewayIPAddr)
+	for _, ip := range candidates {
+		if ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return nil
+}
+
+// Address6 is like Address4, but for DHCPv6 clients: the first address
+// assigned to the client in the response, or else the first prefix delegated
+// to it, so that a subnet can select the clients of a pool of addresses or of
+// delegated prefixes, or else the address of its link.
+func Address6(ctx context.Context, req, resp dhcpv6.DHCPv6) net.IP {
+	if ip := assigned6(resp); ip != nil {
+		return ip
+	}
+	if ip := LinkAddress(ctx); ip != nil {
+		return ip
+	}
+	return dhcputil.LinkAddress6(req)
+}
+
+// assigned6 returns the first address assigned in a DHCPv6 response, or else
+// the first delegated prefix, or nil.
+func assigned6(resp dhcpv6.DHCPv6) net.IP {
+	if resp == nil {
+		return nil
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range dhcputil.IAAddresses6(reply) {
+		if addr.ValidLifetime > 0 {
+			return addr.IPv6Addr
+		}
+	}
+	for _, opt := range reply.GetOption(dhcpv6.OptionIAPD) {
+		ia, ok := opt.(*dhcpv6.OptIAForPrefixDelegation)
+		if !ok {
+			continue
+		}
+		for _, iaopt := range ia.Options {
+			if p, ok := iaopt.(*dhcpv6.OptIAPrefix); ok && p.ValidLifetime > 0 {
+				return p.Prefix()
+			}
+		}
+	}
+	return nil
+}
+
+// Subnet returns the subnet of the client of the transaction, given its
+// address or the address of its relay, and its shared network, or nil if
+// there is none. See config.OptionLevels.Subnet.
+func Subnet(ctx context.Context, ip net.IP) (*config.NetworkConfig, *config.SubnetConfig) {
+	state := stateFrom(ctx)
+	if state == nil || state.levels == nil {
+		return nil, nil
+	}
+	return state.levels.Subnet(ip)
+}
+
+// Options resolves the option definitions of the server for the client of the
+// transaction, given its address (which selects the subnet) and its hardware
+// address, which can be nil. See config.OptionLevels.
+func Options(ctx context.Context, ip net.IP, hwaddr net.HardwareAddr) config.Options {
+	state := stateFrom(ctx)
+	if state == nil || state.levels == nil {
+		return config.Options{}
+	}
+	return state.levels.Resolve(ip, Classes(ctx), hwaddr)
+}
+
+// Override overrides a setting of a plugin with the definition of an option
+// among opts, as resolved by Options. If the option is defined, it calls set
+// with its values, none if the definition is empty, in which case set
+// disables the setting, and returns the error of set. If the option is not
+// defined, the setting keeps its default and Override returns nil.
+func Override(opts config.Options, name string, set func(values []string) error) error {
+	values, ok := opts[name]
+	if !ok {
+		return nil
+	}
+	if err := set(values); err != nil {
+		return fmt.Errorf("invalid %s option: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package coredhcp
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// HealthReport is the response of the health and readiness endpoints. Checks
+// maps the name of each check to `ok`, or to the reason of its failure.
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (s *Server) setListenerStatus(name string, err error) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if s.listeners == nil {
+		s.listeners = make(map[string]error)
+	}
+	s.listeners[name] = err
+}
+
+// storePingTimeout is how long the readiness check waits for the lease store.
+const storePingTimeout = 2 * time.Second
+
+// healthChecks runs the health checks, and returns their result. Listener
+// checks are always run, the checks of the plugins and of the connectivity
+// of the lease store only if withPlugins is true.
+func (s *Server) healthChecks(withPlugins bool) map[string]error {
+	checks := make(map[string]error)
+	s.statusLock.Lock()
+	for name, err := range s.listeners {
+		checks["listener/"+name] = err
+	}
+	s.statusLock.Unlock()
+	if !withPlugins {
+		return checks
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storePingTimeout)
+	checks["store"] = leases.Ping(ctx, leases.Default)
+	cancel()
+	s.handlersLock.RLock()
+	loaded := s.loaded
+	s.handlersLock.RUnlock()
+	for _, plugin := range loaded {
+		if plugin.Health == nil {
+			continue
+		}
+		if _, ok := checks["plugin/"+plugin.Name]; ok {
+			// plugins loaded for both protocols are checked once
+			continue
+		}
+		checks["plugin/"+plugin.Name] = plugin.Health()
+	}
+	return checks
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]error) {
+	report := HealthReport{Status: "ok", Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			report.Checks[name] = err.Error()
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		} else {
+			report.Checks[name] = "ok"
+		}
+	}
+	management.WriteJSON(w, status, &report)
+}
+
+// registerHealthHandlers registers the health and readiness endpoints:
+// /healthz reports whether the listeners are running, and /readyz whether the
+// server is ready to serve requests, i.e. the listeners are running, the lease
+// store is reachable and all the plugins report themselves as healthy.
+func (s *Server) registerHealthHandlers(m *management.Server) {
+	m.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.healthChecks(false))
+	})
+	m.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, s.healthChecks(true))
+	})
+	// the probes of the orchestrators are not authenticated
+	m.Require("/healthz", management.RoleNone)
+	m.Require("/readyz", management.RoleNone)
+}
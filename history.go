@@ -0,0 +1,140 @@
+package coredhcp
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// History keeps the last transactions of each client, so that the management
+// API can tell what a client asked for and what it got. Both the number of
+// transactions per client and the number of clients are bounded. It is safe
+// for concurrent use.
+type History struct {
+	lock       sync.Mutex
+	size       int
+	maxClients int
+	// clients maps a client identifier to its element in lru, whose value
+	// is a *clientHistory. The front of lru is the most recently seen
+	// client.
+	clients map[string]*list.Element
+	lru     *list.List
+}
+
+type clientHistory struct {
+	client  string
+	entries []*AuditEntry
+}
+
+// NewHistory returns a History keeping up to size transactions for each of
+// up to maxClients clients.
+func NewHistory(size, maxClients int) *History {
+	return &History{
+		size:       size,
+		maxClients: maxClients,
+		clients:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// normalizeClient returns the key used to store the history of a client, so
+// that lookups are case-insensitive.
+func normalizeClient(client string) string {
+	return strings.ToLower(client)
+}
+
+func (h *History) add(entry *AuditEntry) {
+	if entry.Client == "" {
+		return
+	}
+	key := normalizeClient(entry.Client)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var ch *clientHistory
+	if elem, ok := h.clients[key]; ok {
+		h.lru.MoveToFront(elem)
+		ch = elem.Value.(*clientHistory)
+	} else {
+		if h.maxClients > 0 && h.lru.Len() >= h.maxClients {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.clients, oldest.Value.(*clientHistory).client)
+		}
+		ch = &clientHistory{client: key}
+		h.clients[key] = h.lru.PushFront(ch)
+	}
+	ch.entries = append(ch.entries, entry)
+	if len(ch.entries) > h.size {
+		ch.entries = ch.entries[len(ch.entries)-h.size:]
+	}
+}
+
+// Add6 adds a DHCPv6 transaction to the history of its client, identified by
+// its DUID. resp can be nil.
+func (h *History) Add6(peer net.Addr, req, resp dhcpv6.DHCPv6, plugin string) {
+	entry, err := newAuditEntry6(peer, req, resp, plugin)
+	if err != nil {
+		log.Printf("history: %v", err)
+		return
+	}
+	h.add(entry)
+}
+
+// Add4 adds a DHCPv4 transaction to the history of its client, identified by
+// its hardware address. resp can be nil.
+func (h *History) Add4(peer net.Addr, req, resp *dhcpv4.DHCPv4, plugin string) {
+	h.add(newAuditEntry4(peer, req, resp, plugin))
+}
+
+// Get returns the transactions of a client that happened at or after since,
+// oldest first.
+func (h *History) Get(client string, since time.Time) []*AuditEntry {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	elem, ok := h.clients[normalizeClient(client)]
+	if !ok {
+		return nil
+	}
+	var entries []*AuditEntry
+	for _, entry := range elem.Value.(*clientHistory).entries {
+		if !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// registerHistoryHandlers registers the client history endpoint:
+// GET /history?client=<id>[&since=<RFC 3339 time>] returns the transactions
+// of a client, identified by its hardware address for DHCPv4 or its DUID for
+// DHCPv6.
+func registerHistoryHandlers(m *management.Server, h *History) {
+	m.HandleFunc("/history", func(w http.ResponseWriter, r *http.Request) {
+		client := r.URL.Query().Get("client")
+		if client == "" {
+			management.WriteError(w, http.StatusBadRequest, errors.New("missing `client` parameter"))
+			return
+		}
+		var since time.Time
+		if value := r.URL.Query().Get("since"); value != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, value); err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		entries := h.Get(client, since)
+		if entries == nil {
+			entries = []*AuditEntry{}
+		}
+		management.WriteJSON(w, http.StatusOK, entries)
+	})
+}
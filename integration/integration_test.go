@@ -0,0 +1,99 @@
+//go:build integration && linux
+// +build integration,linux
+
+package integration
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// The scenarios run the CoreDHCP binary in $COREDHCP_BIN, and are skipped if
+// it is not set, e.g.
+//
+//	$ go test -c -tags=integration ./integration
+//	$ sudo COREDHCP_BIN=$(pwd)/coredhcp ./integration.test
+
+const config6 = `
+server6:
+    listen: '[::]:547'
+    plugins:
+        - server_id: LL 00:de:ad:be:ef:00
+        - file: "leases.txt"
+`
+
+const leases6 = "{mac} 2001:db8::100\n"
+
+const config4 = `
+server4:
+    listen: '0.0.0.0:67'
+    plugins:
+        - server_id: 10.0.0.1
+        - file: "leases.txt"
+`
+
+const leases4 = "{mac} 10.0.0.100\n"
+
+// exchange6Env is set by insomniacslk6 to the interface on which the test
+// binary, re-executed in the client namespace, runs a DHCPv6 exchange.
+const exchange6Env = "COREDHCP_EXCHANGE6"
+
+func TestMain(m *testing.M) {
+	if iface := os.Getenv(exchange6Env); iface != "" {
+		exchange6(iface)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func exchange6(iface string) {
+	c := dhcpv6.NewClient()
+	conv, err := c.Exchange(iface)
+	for _, m := range conv {
+		log.Print(m.Summary())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// insomniacslk6 re-executes the test binary in the client namespace to run a
+// DHCPv6 exchange with the insomniacslk/dhcp client.
+func insomniacslk6(p *Pair, iface string) *exec.Cmd {
+	cmd := p.ClientCommand(os.Args[0])
+	cmd.Env = append(os.Environ(), exchange6Env+"="+iface)
+	return cmd
+}
+
+func TestScenarios(t *testing.T) {
+	bin := os.Getenv("COREDHCP_BIN")
+	if bin == "" {
+		t.Skip("COREDHCP_BIN is not set")
+	}
+	scenarios := []struct {
+		Scenario
+		// command is the client program, which the scenario needs
+		command string
+	}{
+		{Scenario{Name: "insomniacslk-v6", Config: config6, Leases: leases6, Client: insomniacslk6}, ""},
+		{Scenario{Name: "dhclient-v6", Config: config6, Leases: leases6, Client: Dhclient6}, "dhclient"},
+		{Scenario{Name: "dhclient-v4", Config: config4, Leases: leases4, ServerIP4: "10.0.0.1/24", Client: Dhclient4}, "dhclient"},
+		{Scenario{Name: "udhcpc-v4", Config: config4, Leases: leases4, ServerIP4: "10.0.0.1/24", Client: Udhcpc}, "udhcpc"},
+	}
+	for _, s := range scenarios {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			if s.command != "" {
+				if _, err := exec.LookPath(s.command); err != nil {
+					t.Skipf("%s is not installed", s.command)
+				}
+			}
+			if err := s.Run(bin); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
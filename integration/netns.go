@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+// Package integration provides helpers to run end-to-end tests of CoreDHCP
+// inside pairs of Linux network namespaces, connected by a veth pair. All the
+// functions in this package require root privileges and the `ip` command from
+// iproute2.
+package integration
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+// Pair is a pair of network namespaces, one for the server and one for the
+// client, connected by a veth pair.
+type Pair struct {
+	// ServerNS and ClientNS are the names of the namespaces.
+	ServerNS, ClientNS string
+	// ServerIface and ClientIface are the names of the veth interfaces in
+	// their respective namespaces.
+	ServerIface, ClientIface string
+	// ClientMAC is the hardware address of the client interface.
+	ClientMAC net.HardwareAddr
+}
+
+func ip(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// NewPair creates the namespaces `<name>-srv` and `<name>-cli`, connects them
+// with a veth pair, and brings the interfaces up. The server interface gets
+// the specified IPv6 and IPv4 addresses, in CIDR notation, if not empty. The
+// client interface gets the specified hardware address, and no IP address.
+// The caller is responsible for calling Close.
+func NewPair(name string, clientMAC net.HardwareAddr, serverIP6, serverIP4 string) (*Pair, error) {
+	p := Pair{
+		ServerNS:    name + "-srv",
+		ClientNS:    name + "-cli",
+		ServerIface: name + "-s",
+		ClientIface: name + "-c",
+		ClientMAC:   clientMAC,
+	}
+	steps := [][]string{
+		{"netns", "add", p.ServerNS},
+		{"netns", "add", p.ClientNS},
+	}
+	for _, ns := range []string{p.ServerNS, p.ClientNS} {
+		// duplicate address detection only slows down the tests, and leaves
+		// the link-local addresses tentative, which dhclient cannot bind to.
+		// The interfaces get the defaults of the namespace they are moved
+		// to, so these go first.
+		steps = append(steps,
+			[]string{"netns", "exec", ns, "sysctl", "-q", "-w", "net.ipv6.conf.all.accept_dad=0"},
+			[]string{"netns", "exec", ns, "sysctl", "-q", "-w", "net.ipv6.conf.default.accept_dad=0"},
+			[]string{"-n", ns, "link", "set", "lo", "up"},
+		)
+	}
+	steps = append(steps,
+		[]string{"link", "add", p.ServerIface, "type", "veth", "peer", "name", p.ClientIface},
+		[]string{"link", "set", p.ServerIface, "netns", p.ServerNS},
+		[]string{"link", "set", p.ClientIface, "netns", p.ClientNS},
+		[]string{"-n", p.ClientNS, "link", "set", p.ClientIface, "address", clientMAC.String()},
+		// the server listens on the unspecified address, which only gets the
+		// SOLICITs of the groups joined on the interface
+		[]string{"-n", p.ServerNS, "addr", "add", "ff02::1:2/128", "dev", p.ServerIface, "autojoin"},
+	)
+	if serverIP6 != "" {
+		steps = append(steps, []string{"-n", p.ServerNS, "addr", "add", serverIP6, "dev", p.ServerIface, "nodad"})
+	}
+	if serverIP4 != "" {
+		steps = append(steps, []string{"-n", p.ServerNS, "addr", "add", serverIP4, "dev", p.ServerIface})
+	}
+	steps = append(steps,
+		[]string{"-n", p.ServerNS, "link", "set", p.ServerIface, "up"},
+		[]string{"-n", p.ClientNS, "link", "set", p.ClientIface, "up"},
+	)
+	if serverIP4 != "" {
+		// without a default route, the broadcast replies are unroutable
+		steps = append(steps, []string{"-n", p.ServerNS, "route", "add", "255.255.255.255/32", "dev", p.ServerIface})
+	}
+	for _, step := range steps {
+		if err := ip(step...); err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+	log.Printf("integration: created namespaces %s and %s", p.ServerNS, p.ClientNS)
+	return &p, nil
+}
+
+// Close deletes the namespaces, and with them the veth pair.
+func (p *Pair) Close() {
+	for _, ns := range []string{p.ServerNS, p.ClientNS} {
+		if err := ip("netns", "del", ns); err != nil {
+			log.Printf("integration: %v", err)
+		}
+	}
+}
+
+// ServerCommand returns a command that runs in the server namespace.
+func (p *Pair) ServerCommand(name string, args ...string) *exec.Cmd {
+	return nsCommand(p.ServerNS, name, args...)
+}
+
+// ClientCommand returns a command that runs in the client namespace.
+func (p *Pair) ClientCommand(name string, args ...string) *exec.Cmd {
+	return nsCommand(p.ClientNS, name, args...)
+}
+
+func nsCommand(ns, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command("ip", append([]string{"netns", "exec", ns, name}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
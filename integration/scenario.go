@@ -0,0 +1,122 @@
+//go:build linux
+// +build linux
+
+package integration
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Client builds the command that runs a DHCP client on the given interface,
+// inside the client namespace of the pair. The client must exit with status 0
+// if and only if it obtained a lease.
+type Client func(p *Pair, iface string) *exec.Cmd
+
+// Scenario describes an end-to-end lease acquisition test.
+type Scenario struct {
+	Name string
+	// Config is the CoreDHCP configuration, in YAML. The string `{iface}` is
+	// replaced with the name of the server interface.
+	Config string
+	// Leases is written to `leases.txt` next to the configuration, for the
+	// `file` plugin. The string `{mac}` is replaced with the client hardware
+	// address.
+	Leases string
+	// ServerIP6 and ServerIP4 are assigned to the server interface, in CIDR
+	// notation, if not empty.
+	ServerIP6, ServerIP4 string
+	Client               Client
+	// Timeout is how long the client has to obtain a lease, 10 seconds if
+	// zero.
+	Timeout time.Duration
+}
+
+// clientMAC is the hardware address of the client interface in every
+// scenario.
+var clientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0xc0, 0xff, 0xee}
+
+// Run runs the scenario: it creates a namespace pair, starts the CoreDHCP
+// binary in the server namespace, and runs the client in the client namespace.
+// It returns an error if the client failed or timed out.
+func (s *Scenario) Run(coredhcpBinary string) error {
+	dir, err := ioutil.TempDir("", "coredhcp-integ")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := NewPair("cdhcp", clientMAC, s.ServerIP6, s.ServerIP4)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+
+	conf := strings.Replace(s.Config, "{iface}", p.ServerIface, -1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.yml"), []byte(conf), 0644); err != nil {
+		return err
+	}
+	leases := strings.Replace(s.Leases, "{mac}", clientMAC.String(), -1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "leases.txt"), []byte(leases), 0644); err != nil {
+		return err
+	}
+
+	server := p.ServerCommand(coredhcpBinary, "-conf", filepath.Join(dir, "config.yml"))
+	server.Dir = dir
+	if err := server.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = server.Process.Kill()
+		_ = server.Wait()
+	}()
+	// give the server some time to set up its listeners
+	time.Sleep(time.Second)
+
+	client := s.Client(p, p.ClientIface)
+	client.Dir = dir
+	if err := client.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Wait()
+	}()
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: client failed: %v", s.Name, err)
+		}
+		return nil
+	case <-time.After(timeout):
+		_ = client.Process.Kill()
+		return errors.New(s.Name + ": client timed out")
+	}
+}
+
+// Dhclient6 runs ISC dhclient in DHCPv6 mode, trying only once, with a DUID
+// of the hardware address, which the `file` plugin can match.
+func Dhclient6(p *Pair, iface string) *exec.Cmd {
+	return p.ClientCommand("dhclient", "-6", "-1", "-v", "-D", "LL", "-lf", "dhclient6.leases", "-pf", "dhclient6.pid", iface)
+}
+
+// Dhclient4 runs ISC dhclient in DHCPv4 mode, trying only once.
+func Dhclient4(p *Pair, iface string) *exec.Cmd {
+	return p.ClientCommand("dhclient", "-4", "-1", "-v", "-lf", "dhclient4.leases", "-pf", "dhclient4.pid", iface)
+}
+
+// Udhcpc runs busybox's udhcpc, exiting after the first lease.
+func Udhcpc(p *Pair, iface string) *exec.Cmd {
+	return p.ClientCommand("udhcpc", "-i", iface, "-n", "-q", "-t", "3", "-s", "/bin/true")
+}
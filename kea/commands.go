@@ -0,0 +1,179 @@
+package kea
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// lease is a lease in the format of the lease commands.
+type lease struct {
+	IPAddress string `json:"ip-address"`
+	HWAddress string `json:"hw-address,omitempty"`
+	ClientID  string `json:"client-id,omitempty"`
+	DUID      string `json:"duid,omitempty"`
+	Hostname  string `json:"hostname"`
+	// CLTT is the client last transmission time, as a UNIX timestamp.
+	CLTT int64 `json:"cltt"`
+	// ValidLifetime is in seconds.
+	ValidLifetime int64 `json:"valid-lft"`
+	// State is 0 for leases in use, and 2 for expired leases.
+	State    int  `json:"state"`
+	FQDNFwd  bool `json:"fqdn-fwd"`
+	FQDNRev  bool `json:"fqdn-rev"`
+	SubnetID int  `json:"subnet-id"`
+}
+
+// family returns the name of the address family of a lease, as in the
+// responses of Kea.
+func family(v6 bool) string {
+	if v6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+func newLease(l *leases.Lease, v6 bool) *lease {
+	ret := lease{
+		IPAddress: l.IP.String(),
+		Hostname:  l.Hostname,
+		CLTT:      l.Starts.Unix(),
+	}
+	if l.HWAddr != nil {
+		ret.HWAddress = l.HWAddr.String()
+	}
+	if v6 {
+		ret.DUID = hexColons(l.ClientID)
+	} else {
+		ret.ClientID = hexColons(l.ClientID)
+	}
+	if !l.Ends.IsZero() {
+		ret.ValidLifetime = int64(l.Ends.Sub(l.Starts).Seconds())
+		if l.Expired(clock.Now()) {
+			ret.State = 2
+		}
+	}
+	return &ret
+}
+
+// hexColons formats a hex string like Kea, e.g. `01:02:03`.
+func hexColons(s string) string {
+	var parts []string
+	for i := 0; i+1 < len(s); i += 2 {
+		parts = append(parts, s[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// findLease looks up a lease by `ip-address`, or by `identifier-type` and
+// `identifier`. Only the `hw-address` identifier is supported.
+func (a *API) findLease(args map[string]interface{}) (*leases.Lease, error) {
+	if addr, ok := args["ip-address"].(string); ok {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, errors.New("invalid 'ip-address' parameter")
+		}
+		return a.Store.Lease(ip)
+	}
+	typ, err := stringArg(args, "identifier-type")
+	if err != nil {
+		return nil, errors.New("either 'ip-address' or 'identifier-type' and 'identifier' must be specified")
+	}
+	id, err := stringArg(args, "identifier")
+	if err != nil {
+		return nil, err
+	}
+	if typ != "hw-address" {
+		return nil, errors.New("unsupported identifier type '" + typ + "'")
+	}
+	hwaddr, err := net.ParseMAC(id)
+	if err != nil {
+		return nil, err
+	}
+	return a.Store.LeaseByHWAddr(hwaddr)
+}
+
+func (a *API) leaseGet(args map[string]interface{}) *Response {
+	l, err := a.findLease(args)
+	if err == leases.ErrNotFound {
+		return errorResponse(ResultEmpty, "Lease not found.")
+	} else if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	v6 := l.IP.To4() == nil
+	return &Response{Result: ResultSuccess, Text: family(v6) + " lease found.", Arguments: newLease(l, v6)}
+}
+
+// leaseList returns the leases of the family of a command among some leases.
+func leaseList(all []*leases.Lease, v6 bool) *Response {
+	ret := make([]*lease, 0)
+	for _, l := range all {
+		if (l.IP.To4() == nil) == v6 {
+			ret = append(ret, newLease(l, v6))
+		}
+	}
+	result := ResultSuccess
+	if len(ret) == 0 {
+		result = ResultEmpty
+	}
+	return &Response{
+		Result:    result,
+		Text:      fmt.Sprintf("%d %s lease(s) found.", len(ret), family(v6)),
+		Arguments: map[string]interface{}{"leases": ret},
+	}
+}
+
+func (a *API) leaseGetAll(v6 bool) *Response {
+	all, err := a.Store.Leases()
+	if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	return leaseList(all, v6)
+}
+
+func (a *API) leaseGetAll4(args map[string]interface{}) *Response {
+	return a.leaseGetAll(false)
+}
+
+func (a *API) leaseGetAll6(args map[string]interface{}) *Response {
+	return a.leaseGetAll(true)
+}
+
+// leaseGetByHostname looks up the leases by `hostname`, compared without case.
+func (a *API) leaseGetByHostname(v6 bool, args map[string]interface{}) *Response {
+	name, err := stringArg(args, "hostname")
+	if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	all, err := leases.LeasesByHostname(a.Store, name)
+	if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	return leaseList(all, v6)
+}
+
+func (a *API) leaseGetByHostname4(args map[string]interface{}) *Response {
+	return a.leaseGetByHostname(false, args)
+}
+
+func (a *API) leaseGetByHostname6(args map[string]interface{}) *Response {
+	return a.leaseGetByHostname(true, args)
+}
+
+func (a *API) leaseDel(args map[string]interface{}) *Response {
+	l, err := a.findLease(args)
+	if err == leases.ErrNotFound {
+		return errorResponse(ResultEmpty, "Lease not found.")
+	} else if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	if err := a.Store.DeleteLease(l.IP); err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	log.Printf("kea: deleted lease %s", l.IP)
+	return &Response{Result: ResultSuccess, Text: "Lease deleted."}
+}
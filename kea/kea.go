@@ -0,0 +1,285 @@
+// Package kea implements a command API compatible with the control channel of
+// ISC Kea, so that Stork and other tools of the Kea ecosystem can manage
+// CoreDHCP. Commands are accepted over HTTP, like the Kea Control Agent, and
+// over a UNIX socket, like the Kea servers themselves.
+package kea
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/stats"
+)
+
+var log = logger.GetLogger()
+
+// Result codes of the Kea control channel
+const (
+	ResultSuccess     = 0
+	ResultError       = 1
+	ResultUnsupported = 2
+	ResultEmpty       = 3
+)
+
+// Command is a command received on the control channel.
+type Command struct {
+	Command   string                 `json:"command"`
+	Service   []string               `json:"service,omitempty"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// Response is the answer to a Command.
+type Response struct {
+	Result    int         `json:"result"`
+	Text      string      `json:"text,omitempty"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+func errorResponse(result int, text string) *Response {
+	return &Response{Result: result, Text: text}
+}
+
+// CommandFunc implements a command.
+type CommandFunc func(args map[string]interface{}) *Response
+
+// API dispatches the commands of the control channel.
+type API struct {
+	Store leases.Store
+	Stats *stats.Registry
+	// Reload, if not nil, reloads the configuration for the config-reload
+	// command.
+	Reload func() error
+	// TLS, if not nil, is the TLS configuration of the HTTP listener, and
+	// Auth, if not nil, authenticates its requests: the read-only commands
+	// need the reader role, and the others the admin role.
+	TLS  *tls.Config
+	Auth management.Authorizer
+
+	lock      sync.Mutex
+	commands  map[string]CommandFunc
+	listeners []io.Closer
+}
+
+// NewAPI returns an API serving the leases of store, and the statistics of
+// registry.
+func NewAPI(store leases.Store, registry *stats.Registry, reload func() error) *API {
+	a := API{Store: store, Stats: registry, Reload: reload}
+	a.commands = map[string]CommandFunc{
+		"list-commands":          a.listCommands,
+		"version-get":            a.versionGet,
+		"status-get":             a.statusGet,
+		"config-reload":          a.configReload,
+		"lease4-get":             a.leaseGet,
+		"lease6-get":             a.leaseGet,
+		"lease4-get-all":         a.leaseGetAll4,
+		"lease6-get-all":         a.leaseGetAll6,
+		"lease4-get-by-hostname": a.leaseGetByHostname4,
+		"lease6-get-by-hostname": a.leaseGetByHostname6,
+		"lease4-del":             a.leaseDel,
+		"lease6-del":             a.leaseDel,
+		"statistic-get":          a.statisticGet,
+		"statistic-get-all":      a.statisticGetAll,
+		"statistic-reset":        a.statisticReset,
+		"statistic-reset-all":    a.statisticResetAll,
+	}
+	return &a
+}
+
+// readOnly are the commands that do not change the state of the server.
+var readOnly = map[string]bool{
+	"list-commands":          true,
+	"version-get":            true,
+	"status-get":             true,
+	"lease4-get":             true,
+	"lease6-get":             true,
+	"lease4-get-all":         true,
+	"lease6-get-all":         true,
+	"lease4-get-by-hostname": true,
+	"lease6-get-by-hostname": true,
+	"statistic-get":          true,
+	"statistic-get-all":      true,
+}
+
+// Version is reported by the version-get command.
+var Version = "coredhcp"
+
+var startTime = time.Now()
+
+// Handle runs a command, and returns its response.
+func (a *API) Handle(cmd *Command) *Response {
+	fn, ok := a.commands[cmd.Command]
+	if !ok {
+		return errorResponse(ResultUnsupported, "'"+cmd.Command+"' command not supported.")
+	}
+	return fn(cmd.Arguments)
+}
+
+// ServeHTTP implements the HTTP transport of the Kea Control Agent, which
+// answers with one response per service the command was addressed to.
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var cmd Command
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err == nil {
+		err = json.Unmarshal(body, &cmd)
+	}
+	role := management.RoleAdmin
+	if readOnly[cmd.Command] {
+		role = management.RoleReader
+	}
+	if !management.Authorize(a.Auth, w, r, role) {
+		return
+	}
+	var resp *Response
+	if err != nil {
+		resp = errorResponse(ResultError, "invalid command: "+err.Error())
+	} else {
+		resp = a.Handle(&cmd)
+	}
+	n := len(cmd.Service)
+	if n == 0 {
+		n = 1
+	}
+	resps := make([]*Response, n)
+	for i := range resps {
+		resps[i] = resp
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resps); err != nil {
+		log.Printf("kea: failed to write response: %v", err)
+	}
+}
+
+// ListenUnix serves the commands on a UNIX socket, one command per
+// connection, like the Kea servers.
+func (a *API) ListenUnix(path string) error {
+	// remove the socket of a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	a.addListener(ln)
+	log.Printf("Starting Kea command socket on %s", path)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("kea: stopped accepting connections: %v", err)
+				return
+			}
+			go a.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+// ListenHTTP serves the commands over HTTP on the given address, like the Kea
+// Control Agent.
+func (a *API) ListenHTTP(addr string) error {
+	ln, err := management.Listen(addr, a.TLS, a.Auth)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: a, ReadTimeout: 10 * time.Second, WriteTimeout: 30 * time.Second}
+	a.addListener(srv)
+	log.Printf("Starting Kea control agent listener on %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			log.Printf("kea: HTTP listener stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (a *API) addListener(c io.Closer) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.listeners = append(a.listeners, c)
+}
+
+// Close stops all the listeners.
+func (a *API) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var err error
+	for _, ln := range a.listeners {
+		if cerr := ln.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	a.listeners = nil
+	return err
+}
+
+func (a *API) serveConn(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	var cmd Command
+	var resp *Response
+	if err := json.NewDecoder(io.LimitReader(conn, 1<<20)).Decode(&cmd); err != nil {
+		resp = errorResponse(ResultError, "invalid command: "+err.Error())
+	} else {
+		resp = a.Handle(&cmd)
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		log.Printf("kea: failed to write response: %v", err)
+	}
+}
+
+func (a *API) listCommands(args map[string]interface{}) *Response {
+	names := make([]string, 0, len(a.commands))
+	for name := range a.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Response{Result: ResultSuccess, Arguments: names}
+}
+
+func (a *API) versionGet(args map[string]interface{}) *Response {
+	return &Response{Result: ResultSuccess, Text: Version, Arguments: map[string]string{"extended": Version}}
+}
+
+func (a *API) statusGet(args map[string]interface{}) *Response {
+	return &Response{Result: ResultSuccess, Arguments: map[string]interface{}{
+		"pid":    os.Getpid(),
+		"uptime": int64(time.Since(startTime).Seconds()),
+	}}
+}
+
+func (a *API) configReload(args map[string]interface{}) *Response {
+	if a.Reload == nil {
+		return errorResponse(ResultUnsupported, "configuration reload is not available")
+	}
+	if err := a.Reload(); err != nil {
+		return errorResponse(ResultError, "configuration reload failed: "+err.Error())
+	}
+	return &Response{Result: ResultSuccess, Text: "Configuration successful."}
+}
+
+// stringArg returns a string argument, or an error if it is missing.
+func stringArg(args map[string]interface{}, name string) (string, error) {
+	v, ok := args[name].(string)
+	if !ok || v == "" {
+		return "", errors.New("'" + name + "' parameter not specified")
+	}
+	return v, nil
+}
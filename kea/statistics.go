@@ -0,0 +1,101 @@
+package kea
+
+import (
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// statistic maps a Kea statistic to the counters it is the sum of.
+type statistic struct {
+	counter string
+	labels  []string
+}
+
+// statistics maps the names of the Kea statistics to the server counters.
+var statistics = map[string]statistic{
+	"pkt4-received":     {stats.Received, []string{"version", "4"}},
+	"pkt4-sent":         {stats.Sent, []string{"version", "4"}},
+	"pkt4-receive-drop": {stats.Dropped, []string{"version", "4"}},
+	"pkt6-received":     {stats.Received, []string{"version", "6"}},
+	"pkt6-sent":         {stats.Sent, []string{"version", "6"}},
+	"pkt6-receive-drop": {stats.Dropped, []string{"version", "6"}},
+}
+
+func init() {
+	for _, t := range []dhcpv4.MessageType{
+		dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeDecline,
+		dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeInform,
+	} {
+		statistics["pkt4-"+strings.ToLower(t.String())+"-received"] = statistic{stats.Received, []string{"version", "4", "type", t.String()}}
+	}
+	for _, t := range []dhcpv4.MessageType{dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck, dhcpv4.MessageTypeNak} {
+		statistics["pkt4-"+strings.ToLower(t.String())+"-sent"] = statistic{stats.Sent, []string{"version", "4", "type", t.String()}}
+	}
+	// Kea abbreviates the name of the information requests
+	for kea, t := range map[string]dhcpv6.MessageType{
+		"solicit":    dhcpv6.MessageTypeSolicit,
+		"request":    dhcpv6.MessageTypeRequest,
+		"renew":      dhcpv6.MessageTypeRenew,
+		"rebind":     dhcpv6.MessageTypeRebind,
+		"release":    dhcpv6.MessageTypeRelease,
+		"decline":    dhcpv6.MessageTypeDecline,
+		"infrequest": dhcpv6.MessageTypeInformationRequest,
+	} {
+		statistics["pkt6-"+kea+"-received"] = statistic{stats.Received, []string{"version", "6", "type", t.String()}}
+	}
+	for kea, t := range map[string]dhcpv6.MessageType{
+		"advertise": dhcpv6.MessageTypeAdvertise,
+		"reply":     dhcpv6.MessageTypeReply,
+	} {
+		statistics["pkt6-"+kea+"-sent"] = statistic{stats.Sent, []string{"version", "6", "type", t.String()}}
+	}
+}
+
+// sample returns the value of a statistic in the format of Kea, i.e. a list
+// of samples, each a value and a timestamp.
+func (a *API) sample(st statistic) [][]interface{} {
+	value := a.Stats.Sum(st.counter, st.labels...)
+	return [][]interface{}{{value, time.Now().Format("2006-01-02 15:04:05.000000")}}
+}
+
+func (a *API) statisticGet(args map[string]interface{}) *Response {
+	name, err := stringArg(args, "name")
+	if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	st, ok := statistics[name]
+	if !ok {
+		return &Response{Result: ResultSuccess, Arguments: map[string]interface{}{}}
+	}
+	return &Response{Result: ResultSuccess, Arguments: map[string]interface{}{name: a.sample(st)}}
+}
+
+func (a *API) statisticGetAll(args map[string]interface{}) *Response {
+	ret := make(map[string]interface{}, len(statistics))
+	for name, st := range statistics {
+		ret[name] = a.sample(st)
+	}
+	return &Response{Result: ResultSuccess, Arguments: ret}
+}
+
+func (a *API) statisticReset(args map[string]interface{}) *Response {
+	name, err := stringArg(args, "name")
+	if err != nil {
+		return errorResponse(ResultError, err.Error())
+	}
+	st, ok := statistics[name]
+	if !ok {
+		return errorResponse(ResultError, "No '"+name+"' statistic found")
+	}
+	a.Stats.ResetMatching(st.counter, st.labels...)
+	return &Response{Result: ResultSuccess, Text: "Statistic '" + name + "' reset."}
+}
+
+func (a *API) statisticResetAll(args map[string]interface{}) *Response {
+	a.Stats.Reset()
+	return &Response{Result: ResultSuccess, Text: "All statistics reset."}
+}
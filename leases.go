@@ -0,0 +1,52 @@
+package coredhcp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// registerLeaseHandlers registers the lease query endpoint: GET
+// /leases?subnet=<cidr> returns the leases of a subnet, e.g. `10.1.2.0/24`,
+// and GET /leases?hostname=<name> the leases with a host name. Both are
+// answered from the indexes of the stores that have them, without a full
+// scan.
+func registerLeaseHandlers(m *management.Server, store leases.Store) {
+	m.HandleFunc("/leases", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var (
+			found []*leases.Lease
+			err   error
+		)
+		q := r.URL.Query()
+		switch {
+		case q.Get("subnet") != "":
+			_, subnet, perr := net.ParseCIDR(q.Get("subnet"))
+			if perr != nil {
+				management.WriteError(w, http.StatusBadRequest, perr)
+				return
+			}
+			found, err = leases.LeasesInSubnet(store, subnet)
+		case q.Get("hostname") != "":
+			found, err = leases.LeasesByHostname(store, q.Get("hostname"))
+		default:
+			management.WriteError(w, http.StatusBadRequest, errors.New("need a `subnet` or `hostname` parameter"))
+			return
+		}
+		if err != nil {
+			management.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if found == nil {
+			found = []*leases.Lease{}
+		}
+		management.WriteJSON(w, http.StatusOK, found)
+	})
+}
@@ -0,0 +1,362 @@
+package leases
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxAttempts is the number of failed writes of a change to a reachable
+	// backend after which it is moved to the dead letters of the journal.
+	maxAttempts = 10
+	// compactEntries is the number of changes written to the backend that
+	// the journal keeps, since they are harmless to replay, before it is
+	// rewritten with the pending ones only.
+	compactEntries = 4096
+	// pingTimeout is the timeout of the check of the backend before a
+	// flush.
+	pingTimeout = 5 * time.Second
+)
+
+// ErrBacklogFull is returned by the changes of a BufferedStore that has
+// too many changes pending for its backend.
+var ErrBacklogFull = errors.New("leases: too many changes pending for the backend")
+
+// BufferedOptions holds the settings of a BufferedStore.
+type BufferedOptions struct {
+	// Journal is the path of the journal of the changes that are not
+	// written to the backend yet.
+	Journal string
+	Sync    SyncPolicy
+	// SyncInterval is the interval between the syncs of the journal, with
+	// SyncInterval.
+	SyncInterval time.Duration
+	// BatchSize is the number of changes that triggers a flush before
+	// FlushInterval.
+	BatchSize     int
+	FlushInterval time.Duration
+	// MaxPending is the number of pending changes beyond which the changes
+	// are refused with ErrBacklogFull, 0 for no limit.
+	MaxPending int
+}
+
+// BufferedStore is a Store that decouples the clients from the latency of a
+// backend: the changes are applied to a cache and recorded in a local journal,
+// then written to the backend in batches, in the background. The reads are
+// served by the cache. After a crash, the changes left in the journal are
+// replayed to the backend when the store is opened again. The backend must
+// not be changed by other writers, since the cache would not see it.
+type BufferedStore struct {
+	backend Store
+	cache   *MemoryStore
+	journal *journal
+	opts    BufferedOptions
+
+	lock    sync.Mutex
+	pending []*journalEntry
+	// applied is the number of changes at the start of the journal that
+	// were written to the backend
+	applied int
+	// flushing serializes the flushes
+	flushing sync.Mutex
+	kick     chan struct{}
+}
+
+// NewBufferedStore replays the journal to the backend, loads the backend into
+// the cache, and starts flushing the changes to the backend.
+func NewBufferedStore(backend Store, opts BufferedOptions) (*BufferedStore, error) {
+	if opts.BatchSize <= 0 || opts.FlushInterval <= 0 {
+		return nil, errors.New("leases: the batch size and flush interval must be positive")
+	}
+	j, entries, err := openJournal(opts.Journal, opts.Sync, opts.SyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		log.Printf("leases: replaying %d changes from the journal %s", len(entries), opts.Journal)
+		for _, e := range entries {
+			if err := e.apply(backend); err != nil {
+				j.close()
+				return nil, err
+			}
+		}
+		if err := j.checkpoint(nil); err != nil {
+			j.close()
+			return nil, err
+		}
+	}
+	snap, err := TakeSnapshot(backend)
+	if err != nil {
+		j.close()
+		return nil, err
+	}
+	s := BufferedStore{
+		backend: backend,
+		cache:   NewMemoryStore(),
+		journal: j,
+		opts:    opts,
+		kick:    make(chan struct{}, 1),
+	}
+	if err := s.cache.Restore(snap); err != nil {
+		j.close()
+		return nil, err
+	}
+	go s.run()
+	return &s, nil
+}
+
+// admit returns ErrBacklogFull if no more changes can be pending. The store
+// must be locked.
+func (s *BufferedStore) admit() error {
+	if s.opts.MaxPending > 0 && len(s.pending) >= s.opts.MaxPending {
+		return ErrBacklogFull
+	}
+	return nil
+}
+
+// record journals a change that was applied to the cache. The store must be
+// locked.
+func (s *BufferedStore) record(e *journalEntry) error {
+	if err := s.journal.append(e); err != nil {
+		return err
+	}
+	s.pending = append(s.pending, e)
+	if len(s.pending) >= s.opts.BatchSize {
+		select {
+		case s.kick <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// run flushes the changes at the flush interval, or earlier when a batch is
+// full, forever.
+func (s *BufferedStore) run() {
+	tick := time.NewTicker(s.opts.FlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-s.kick:
+		}
+		if err := s.Flush(); err != nil {
+			log.Printf("leases: cannot flush the changes to the backend, will retry: %v", err)
+		}
+	}
+}
+
+// Flush writes the pending changes to the backend. The changes that could not
+// be written stay pending, unless they failed maxAttempts times while the
+// backend was reachable: they are then moved to the dead letters of the
+// journal, and the next changes are written.
+func (s *BufferedStore) Flush() error {
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.lock.Lock()
+	batch := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	// the attempts are not counted while the backend is down
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	err := Ping(ctx, s.backend)
+	cancel()
+	kept, dead := batch, 0
+	if err == nil {
+		kept = nil
+		for i, e := range batch {
+			if err = e.apply(s.backend); err == nil {
+				continue
+			}
+			if e.attempts++; e.attempts < maxAttempts {
+				kept = batch[i:]
+				break
+			}
+			log.Printf("leases: moving a change to %s after %d attempts: %v", s.journal.deadPath(), e.attempts, err)
+			if derr := s.journal.deadLetter(e); derr != nil {
+				log.Printf("leases: cannot write the dead letter: %v", derr)
+			}
+			dead, err = dead+1, nil
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = append(kept, s.pending...)
+	s.applied += len(batch) - len(kept)
+	// the journal is rewritten when it is cheap, when the changes written
+	// to the backend pile up, or when a dead letter must not be replayed
+	if dead > 0 || (s.applied > 0 && (len(s.pending) == 0 || s.applied >= compactEntries)) {
+		if cerr := s.journal.checkpoint(s.pending); cerr != nil && err == nil {
+			err = cerr
+		} else if cerr == nil {
+			s.applied = 0
+		}
+	}
+	return err
+}
+
+// Close flushes the pending changes and closes the journal.
+func (s *BufferedStore) Close() error {
+	err := s.Flush()
+	if cerr := s.journal.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Lease returns the lease of an address.
+func (s *BufferedStore) Lease(ip net.IP) (*Lease, error) {
+	return s.cache.Lease(ip)
+}
+
+// LeaseByHWAddr returns the lease of a client, by its hardware address.
+func (s *BufferedStore) LeaseByHWAddr(hwaddr net.HardwareAddr) (*Lease, error) {
+	return s.cache.LeaseByHWAddr(hwaddr)
+}
+
+// Leases returns all the leases, ordered by address.
+func (s *BufferedStore) Leases() ([]*Lease, error) {
+	return s.cache.Leases()
+}
+
+// ExpiredLeases returns the leases expired at the given time.
+func (s *BufferedStore) ExpiredLeases(now time.Time) ([]*Lease, error) {
+	return s.cache.ExpiredLeases(now)
+}
+
+// LeasesInSubnet returns the leases of the addresses of a subnet.
+func (s *BufferedStore) LeasesInSubnet(subnet *net.IPNet) ([]*Lease, error) {
+	return s.cache.LeasesInSubnet(subnet)
+}
+
+// LeasesByHostname returns the leases with a host name.
+func (s *BufferedStore) LeasesByHostname(name string) ([]*Lease, error) {
+	return s.cache.LeasesByHostname(name)
+}
+
+// PutLease creates or replaces the lease of an address.
+func (s *BufferedStore) PutLease(lease *Lease) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.cache.PutLease(lease); err != nil {
+		return err
+	}
+	return s.record(&journalEntry{Op: opPutLease, Lease: copyLease(lease)})
+}
+
+// ClaimLease claims an address for a client, see Claimer. The claim is atomic
+// for this server only.
+func (s *BufferedStore) ClaimLease(lease *Lease, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.cache.ClaimLease(lease, now); err != nil {
+		return err
+	}
+	return s.record(&journalEntry{Op: opPutLease, Lease: copyLease(lease)})
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *BufferedStore) DeleteLease(ip net.IP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.cache.DeleteLease(ip); err != nil {
+		return err
+	}
+	return s.record(&journalEntry{Op: opDeleteLease, IP: ip})
+}
+
+// Host returns a host by name.
+func (s *BufferedStore) Host(name string) (*Host, error) {
+	return s.cache.Host(name)
+}
+
+// HostByHWAddr returns a host by hardware address.
+func (s *BufferedStore) HostByHWAddr(hwaddr net.HardwareAddr) (*Host, error) {
+	return s.cache.HostByHWAddr(hwaddr)
+}
+
+// HostByIP returns a host by reserved address.
+func (s *BufferedStore) HostByIP(ip net.IP) (*Host, error) {
+	return s.cache.HostByIP(ip)
+}
+
+// Hosts returns all the hosts, ordered by name.
+func (s *BufferedStore) Hosts() ([]*Host, error) {
+	return s.cache.Hosts()
+}
+
+// PutHost creates or replaces a host.
+func (s *BufferedStore) PutHost(host *Host) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.cache.PutHost(host); err != nil {
+		return err
+	}
+	return s.record(&journalEntry{Op: opPutHost, Host: copyHost(host)})
+}
+
+// DeleteHost deletes a host by name.
+func (s *BufferedStore) DeleteHost(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.admit(); err != nil {
+		return err
+	}
+	if err := s.cache.DeleteHost(name); err != nil {
+		return err
+	}
+	return s.record(&journalEntry{Op: opDeleteHost, Name: name})
+}
+
+// Snapshot returns a snapshot of the cache, which includes the pending
+// changes.
+func (s *BufferedStore) Snapshot() (*Snapshot, error) {
+	return s.cache.Snapshot()
+}
+
+// Restore replaces the content of the store with a snapshot. The pending
+// changes are flushed first, and the backend is restored synchronously.
+func (s *BufferedStore) Restore(snap *Snapshot) error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	s.flushing.Lock()
+	defer s.flushing.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := RestoreSnapshot(s.backend, snap); err != nil {
+		return err
+	}
+	// the changes made since the flush are overwritten by the snapshot
+	s.pending, s.applied = nil, 0
+	if err := s.journal.checkpoint(nil); err != nil {
+		return err
+	}
+	return s.cache.Restore(snap)
+}
+
+// Compact compacts the backend, if it is a Compactor.
+func (s *BufferedStore) Compact() error {
+	if c, ok := s.backend.(Compactor); ok {
+		return c.Compact()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package leases
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+)
+
+// ErrConflict is returned when claiming an address leased to another client.
+var ErrConflict = errors.New("address leased to another client")
+
+// Claimer is implemented by the stores that can claim an address atomically,
+// so that servers sharing the store cannot lease the same address to two
+// clients.
+type Claimer interface {
+	// ClaimLease creates or replaces the lease of an address, unless the
+	// address has a lease of another client that is not expired at the
+	// given time, in which case it returns ErrConflict.
+	ClaimLease(lease *Lease, now time.Time) error
+}
+
+// SameClient returns whether two leases are of the same client, by client
+// identifier if both have one, and else by hardware address.
+func SameClient(a, b *Lease) bool {
+	if a.ClientID != "" && b.ClientID != "" {
+		return a.ClientID == b.ClientID
+	}
+	return len(a.HWAddr) > 0 && a.HWAddr.String() == b.HWAddr.String()
+}
+
+// Claim claims an address for a client, see Claimer. It is atomic only if the
+// store is a Claimer.
+func Claim(store Store, lease *Lease) error {
+	now := clock.Now()
+	if c, ok := store.(Claimer); ok {
+		return c.ClaimLease(lease, now)
+	}
+	if err := checkClaim(store.Lease, lease, now); err != nil {
+		return err
+	}
+	return store.PutLease(lease)
+}
+
+// checkClaim returns ErrConflict if the address of a lease is leased to
+// another client.
+func checkClaim(get func(net.IP) (*Lease, error), lease *Lease, now time.Time) error {
+	cur, err := get(lease.IP)
+	switch {
+	case err == ErrNotFound:
+		return nil
+	case err != nil:
+		return err
+	case !cur.Expired(now) && !SameClient(cur, lease):
+		return ErrConflict
+	}
+	return nil
+}
+
+// ClaimLease claims an address for a client, see Claimer.
+func (s *MemoryStore) ClaimLease(lease *Lease, now time.Time) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	key := lease.IP.String()
+	shard := s.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	get := func(ip net.IP) (*Lease, error) {
+		if l, ok := shard.leases[key]; ok {
+			return l, nil
+		}
+		return nil, ErrNotFound
+	}
+	if err := checkClaim(get, lease, now); err != nil {
+		return err
+	}
+	shard.put(key, lease)
+	return nil
+}
@@ -0,0 +1,455 @@
+// Package dynamodb implements a lease store backed by an Amazon DynamoDB
+// table, for servers running in AWS-managed environments. Addresses are
+// claimed with conditional writes, so that servers sharing the table never
+// lease the same address twice, and the expired objects are deleted by the
+// TTL of the table.
+//
+// The leases and hosts are kept in a single table, with the string partition
+// key `pk` and two global secondary indexes, projecting all the attributes:
+// `hw-index`, with the partition key `hw`, and `addr-index`, with the
+// partition key `addr`. The TTL of the table must be enabled on the `ttl`
+// attribute.
+package dynamodb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// the partition keys of the leases and hosts start with their kind
+const (
+	leasePrefix = "lease/"
+	hostPrefix  = "host/"
+)
+
+// Options holds the settings of a Store.
+type Options struct {
+	Table  string
+	Region string
+	// Endpoint overrides the endpoint of the DynamoDB service, e.g. for
+	// DynamoDB Local or an AWS Outpost.
+	Endpoint string
+	// Retention is how long the expired leases are kept before the TTL of
+	// the table deletes them, 0 for ever.
+	Retention time.Duration
+}
+
+// Store is a leases.Store backed by a DynamoDB table.
+type Store struct {
+	db        *dynamodb.DynamoDB
+	table     *string
+	retention time.Duration
+}
+
+// Open connects to the table with the credentials of the default AWS
+// provider chain, i.e. the environment, the shared credentials file or the
+// instance role.
+func Open(opts Options) (*Store, error) {
+	cfg := aws.Config{}
+	if opts.Region != "" {
+		cfg.Region = aws.String(opts.Region)
+	}
+	if opts.Endpoint != "" {
+		cfg.Endpoint = aws.String(opts.Endpoint)
+	}
+	sess, err := session.NewSession(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := Store{db: dynamodb.New(sess), table: aws.String(opts.Table), retention: opts.Retention}
+	if _, err := s.db.DescribeTable(&dynamodb.DescribeTableInput{TableName: s.table}); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Ping checks that the table is reachable, see leases.Pinger.
+func (s *Store) Ping(ctx context.Context) error {
+	_, err := s.db.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: s.table})
+	return err
+}
+
+// attribute values
+
+func str(s string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(s)}
+}
+
+func num(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+func getStr(item map[string]*dynamodb.AttributeValue, name string) string {
+	if v, ok := item[name]; ok && v.S != nil {
+		return *v.S
+	}
+	return ""
+}
+
+// getTime returns a time stored in nanoseconds since the epoch, or the zero
+// time.
+func getTime(item map[string]*dynamodb.AttributeValue, name string) time.Time {
+	if v, ok := item[name]; ok && v.N != nil {
+		if n, err := strconv.ParseInt(*v.N, 10, 64); err == nil {
+			return time.Unix(0, n)
+		}
+	}
+	return time.Time{}
+}
+
+// getInt returns an integer, or 0.
+func getInt(item map[string]*dynamodb.AttributeValue, name string) int {
+	if v, ok := item[name]; ok && v.N != nil {
+		if n, err := strconv.Atoi(*v.N); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func putTime(item map[string]*dynamodb.AttributeValue, name string, t time.Time) {
+	if !t.IsZero() {
+		item[name] = num(t.UnixNano())
+	}
+}
+
+// putTTL sets the ttl attribute, in seconds since the epoch, after which
+// DynamoDB deletes the item.
+func putTTL(item map[string]*dynamodb.AttributeValue, t time.Time) {
+	if !t.IsZero() {
+		item["ttl"] = num(t.Unix())
+	}
+}
+
+func key(pk string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{"pk": str(pk)}
+}
+
+func leaseKey(ip net.IP) string {
+	return leasePrefix + ip.String()
+}
+
+func (s *Store) leaseItem(l *leases.Lease) map[string]*dynamodb.AttributeValue {
+	item := key(leaseKey(l.IP))
+	item["ip"] = str(l.IP.String())
+	if len(l.HWAddr) > 0 {
+		item["hw"] = str(l.HWAddr.String())
+	}
+	if l.ClientID != "" {
+		item["cid"] = str(l.ClientID)
+	}
+	if l.Hostname != "" {
+		item["hostname"] = str(l.Hostname)
+	}
+	putTime(item, "starts", l.Starts)
+	putTime(item, "ends", l.Ends)
+	if l.PrefixLen > 0 {
+		item["plen"] = num(int64(l.PrefixLen))
+		item["iaid"] = str(l.IAID)
+	}
+	if s.retention > 0 && !l.Ends.IsZero() {
+		putTTL(item, l.Ends.Add(s.retention))
+	}
+	return item
+}
+
+func leaseFromItem(item map[string]*dynamodb.AttributeValue) *leases.Lease {
+	l := leases.Lease{
+		IP:        net.ParseIP(getStr(item, "ip")),
+		ClientID:  getStr(item, "cid"),
+		Hostname:  getStr(item, "hostname"),
+		Starts:    getTime(item, "starts"),
+		Ends:      getTime(item, "ends"),
+		PrefixLen: getInt(item, "plen"),
+		IAID:      getStr(item, "iaid"),
+	}
+	if hw, err := net.ParseMAC(getStr(item, "hw")); err == nil {
+		l.HWAddr = hw
+	}
+	return &l
+}
+
+func hostItem(h *leases.Host) map[string]*dynamodb.AttributeValue {
+	item := key(hostPrefix + h.Name)
+	item["name"] = str(h.Name)
+	if len(h.HWAddr) > 0 {
+		item["hw"] = str(h.HWAddr.String())
+	}
+	if h.ClientID != "" {
+		item["cid"] = str(h.ClientID)
+	}
+	if h.IP != nil {
+		item["addr"] = str(h.IP.String())
+	}
+	putTime(item, "expires", h.Expires)
+	// pre-reservations that expired are deleted
+	putTTL(item, h.Expires)
+	return item
+}
+
+func hostFromItem(item map[string]*dynamodb.AttributeValue) *leases.Host {
+	h := leases.Host{
+		Name:     getStr(item, "name"),
+		ClientID: getStr(item, "cid"),
+		IP:       net.ParseIP(getStr(item, "addr")),
+		Expires:  getTime(item, "expires"),
+	}
+	if hw, err := net.ParseMAC(getStr(item, "hw")); err == nil {
+		h.HWAddr = hw
+	}
+	return &h
+}
+
+// conditionFailed returns whether an error is the failure of the condition
+// of a write.
+func conditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// get returns the item of a partition key, with a strongly consistent read.
+func (s *Store) get(pk string) (map[string]*dynamodb.AttributeValue, error) {
+	out, err := s.db.GetItem(&dynamodb.GetItemInput{
+		TableName:      s.table,
+		Key:            key(pk),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Item) == 0 {
+		return nil, leases.ErrNotFound
+	}
+	return out.Item, nil
+}
+
+// scan returns all the items whose partition key starts with a prefix.
+func (s *Store) scan(prefix string) ([]map[string]*dynamodb.AttributeValue, error) {
+	input := dynamodb.ScanInput{
+		TableName:                 s.table,
+		FilterExpression:          aws.String("begins_with(pk, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":prefix": str(prefix)},
+		ConsistentRead:            aws.Bool(true),
+	}
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		out, err := s.db.Scan(&input)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, out.Items...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return items, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// query returns the first item of an index with the given partition key whose
+// partition key in the table starts with a prefix.
+func (s *Store) query(index, attr, value, prefix string) (map[string]*dynamodb.AttributeValue, error) {
+	input := dynamodb.QueryInput{
+		TableName:              s.table,
+		IndexName:              aws.String(index),
+		KeyConditionExpression: aws.String(attr + " = :value"),
+		FilterExpression:       aws.String("begins_with(pk, :prefix)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":value":  str(value),
+			":prefix": str(prefix),
+		},
+	}
+	for {
+		out, err := s.db.Query(&input)
+		if err != nil {
+			return nil, err
+		}
+		if len(out.Items) > 0 {
+			return out.Items[0], nil
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil, leases.ErrNotFound
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// delete deletes the item of a partition key, or returns leases.ErrNotFound.
+func (s *Store) delete(pk string) error {
+	_, err := s.db.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           s.table,
+		Key:                 key(pk),
+		ConditionExpression: aws.String("attribute_exists(pk)"),
+	})
+	if conditionFailed(err) {
+		return leases.ErrNotFound
+	}
+	return err
+}
+
+// Lease returns the lease of an address.
+func (s *Store) Lease(ip net.IP) (*leases.Lease, error) {
+	item, err := s.get(leaseKey(ip))
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromItem(item), nil
+}
+
+// LeaseByHWAddr returns the lease of a client, by its hardware address. The
+// index is eventually consistent, so a lease that was just written may not be
+// found yet.
+func (s *Store) LeaseByHWAddr(hwaddr net.HardwareAddr) (*leases.Lease, error) {
+	item, err := s.query("hw-index", "hw", hwaddr.String(), leasePrefix)
+	if err != nil {
+		return nil, err
+	}
+	return leaseFromItem(item), nil
+}
+
+// compareIP orders addresses by length, IPv4 first, and then numerically.
+func compareIP(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		switch {
+		case a4 == nil:
+			return 1
+		case b4 == nil:
+			return -1
+		}
+		return bytes.Compare(a4, b4)
+	}
+	return bytes.Compare(a.To16(), b.To16())
+}
+
+// Leases returns all the leases, ordered by address.
+func (s *Store) Leases() ([]*leases.Lease, error) {
+	items, err := s.scan(leasePrefix)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*leases.Lease, 0, len(items))
+	for _, item := range items {
+		ret = append(ret, leaseFromItem(item))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return compareIP(ret[i].IP, ret[j].IP) < 0
+	})
+	return ret, nil
+}
+
+// PutLease creates or replaces the lease of an address.
+func (s *Store) PutLease(lease *leases.Lease) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	_, err := s.db.PutItem(&dynamodb.PutItemInput{TableName: s.table, Item: s.leaseItem(lease)})
+	return err
+}
+
+// ClaimLease claims an address for a client, see leases.Claimer, with a
+// conditional write: the lease is written only if the address has no lease,
+// an expired one, or one of the same client.
+func (s *Store) ClaimLease(lease *leases.Lease, now time.Time) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	cond := []string{"attribute_not_exists(pk)", "ends <= :now"}
+	values := map[string]*dynamodb.AttributeValue{":now": num(now.UnixNano())}
+	if lease.ClientID != "" {
+		cond = append(cond, "cid = :cid")
+		values[":cid"] = str(lease.ClientID)
+	}
+	if len(lease.HWAddr) > 0 {
+		if lease.ClientID != "" {
+			// like leases.SameClient, the hardware addresses are only
+			// compared when a lease has no client identifier
+			cond = append(cond, "(attribute_not_exists(cid) AND hw = :hw)")
+		} else {
+			cond = append(cond, "hw = :hw")
+		}
+		values[":hw"] = str(lease.HWAddr.String())
+	}
+	_, err := s.db.PutItem(&dynamodb.PutItemInput{
+		TableName:                 s.table,
+		Item:                      s.leaseItem(lease),
+		ConditionExpression:       aws.String(strings.Join(cond, " OR ")),
+		ExpressionAttributeValues: values,
+	})
+	if conditionFailed(err) {
+		return leases.ErrConflict
+	}
+	return err
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *Store) DeleteLease(ip net.IP) error {
+	return s.delete(leaseKey(ip))
+}
+
+// Host returns a host by name.
+func (s *Store) Host(name string) (*leases.Host, error) {
+	item, err := s.get(hostPrefix + name)
+	if err != nil {
+		return nil, err
+	}
+	return hostFromItem(item), nil
+}
+
+// HostByHWAddr returns a host by hardware address.
+func (s *Store) HostByHWAddr(hwaddr net.HardwareAddr) (*leases.Host, error) {
+	item, err := s.query("hw-index", "hw", hwaddr.String(), hostPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return hostFromItem(item), nil
+}
+
+// HostByIP returns a host by reserved address.
+func (s *Store) HostByIP(ip net.IP) (*leases.Host, error) {
+	item, err := s.query("addr-index", "addr", ip.String(), hostPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return hostFromItem(item), nil
+}
+
+// Hosts returns all the hosts, ordered by name.
+func (s *Store) Hosts() ([]*leases.Host, error) {
+	items, err := s.scan(hostPrefix)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*leases.Host, 0, len(items))
+	for _, item := range items {
+		ret = append(ret, hostFromItem(item))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// PutHost creates or replaces a host.
+func (s *Store) PutHost(host *leases.Host) error {
+	if host.Name == "" {
+		return errors.New("host without a name")
+	}
+	_, err := s.db.PutItem(&dynamodb.PutItemInput{TableName: s.table, Item: hostItem(host)})
+	return err
+}
+
+// DeleteHost deletes a host by name.
+func (s *Store) DeleteHost(name string) error {
+	return s.delete(hostPrefix + name)
+}
@@ -0,0 +1,439 @@
+// Package etcd implements a lease store backed by an etcd cluster, shared by
+// the servers of a deployment. The objects are stored as JSON under a key
+// prefix, and expire with etcd leases. Each server keeps a cache of the whole
+// store, kept up to date by a watch stream, so that the changes made by the
+// other servers are seen without reading from etcd on every request.
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"go.etcd.io/etcd/clientv3"
+)
+
+var log = logger.GetLogger()
+
+// requestTimeout is the timeout of the requests to etcd.
+const requestTimeout = 5 * time.Second
+
+// claimRetries is how many times a claim is retried when the lease of the
+// address changes concurrently.
+const claimRetries = 5
+
+// leaseBucket is the granularity of the expiry of the keys: the keys expiring
+// in the same bucket share one etcd lease, which expires at the end of the
+// bucket, rather than creating a lease per write.
+const leaseBucket = time.Minute
+
+// Options holds the settings of a Store.
+type Options struct {
+	Endpoints []string
+	// Prefix is the prefix of the keys of the store, e.g. `/coredhcp`.
+	Prefix   string
+	Username string
+	Password string
+	// Retention is how long the expired leases are kept before their
+	// etcd lease deletes them, 0 for ever.
+	Retention time.Duration
+}
+
+// Store is a leases.Store backed by etcd. The reads are served by the cache,
+// the writes go to etcd and then to the cache.
+type Store struct {
+	client    *clientv3.Client
+	prefix    string
+	retention time.Duration
+	cache     *leases.MemoryStore
+
+	// buckets holds the etcd leases by the end of their bucket, in Unix
+	// time
+	bucketsLock sync.Mutex
+	buckets     map[int64]clientv3.LeaseID
+}
+
+// Open connects to the etcd cluster, loads the store in the cache and starts
+// watching its changes.
+func Open(opts Options) (*Store, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		Username:    opts.Username,
+		Password:    opts.Password,
+		DialTimeout: requestTimeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := Store{
+		client:    client,
+		prefix:    strings.TrimSuffix(opts.Prefix, "/") + "/",
+		retention: opts.Retention,
+		cache:     leases.NewMemoryStore(),
+		buckets:   make(map[int64]clientv3.LeaseID),
+	}
+	rev, err := s.load()
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	go s.watch(rev)
+	return &s, nil
+}
+
+// Ping checks that the cluster is reachable and has a quorum, with a
+// linearizable read of the prefix of the store, see leases.Pinger.
+func (s *Store) Ping(ctx context.Context) error {
+	_, err := s.client.Get(ctx, s.prefix)
+	return err
+}
+
+// Close stops watching and closes the connection to etcd.
+func (s *Store) Close() error {
+	return s.client.Close()
+}
+
+func (s *Store) leaseKey(ip net.IP) string {
+	return s.prefix + "leases/" + ip.String()
+}
+
+func (s *Store) hostKey(name string) string {
+	return s.prefix + "hosts/" + name
+}
+
+// apply updates the cache with the value of a key, or deletes it if value is
+// nil.
+func (s *Store) apply(cache *leases.MemoryStore, key string, value []byte) error {
+	name := strings.TrimPrefix(key, s.prefix)
+	switch {
+	case strings.HasPrefix(name, "leases/"):
+		ip := net.ParseIP(strings.TrimPrefix(name, "leases/"))
+		if ip == nil {
+			return nil
+		}
+		if value == nil {
+			if err := cache.DeleteLease(ip); err != nil && err != leases.ErrNotFound {
+				return err
+			}
+			return nil
+		}
+		var l leases.Lease
+		if err := json.Unmarshal(value, &l); err != nil {
+			return err
+		}
+		return cache.PutLease(&l)
+	case strings.HasPrefix(name, "hosts/"):
+		if value == nil {
+			if err := cache.DeleteHost(strings.TrimPrefix(name, "hosts/")); err != nil && err != leases.ErrNotFound {
+				return err
+			}
+			return nil
+		}
+		var h leases.Host
+		if err := json.Unmarshal(value, &h); err != nil {
+			return err
+		}
+		return cache.PutHost(&h)
+	}
+	return nil
+}
+
+// load replaces the content of the cache with the whole store, and returns
+// the revision it was read at.
+func (s *Store) load() (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := s.client.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	cache := leases.NewMemoryStore()
+	for _, kv := range resp.Kvs {
+		if err := s.apply(cache, string(kv.Key), kv.Value); err != nil {
+			log.Printf("etcd: ignoring malformed key %s: %v", kv.Key, err)
+		}
+	}
+	snap, err := cache.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	if err := s.cache.Restore(snap); err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// watch applies the changes made after a revision to the cache, forever. If
+// the history of etcd was compacted meanwhile, the cache is reloaded.
+func (s *Store) watch(rev int64) {
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		for resp := range s.client.Watch(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+			if err := resp.Err(); err != nil {
+				log.Printf("etcd: watch failed: %v", err)
+				break
+			}
+			for _, ev := range resp.Events {
+				var value []byte
+				if ev.Type != clientv3.EventTypeDelete {
+					value = ev.Kv.Value
+				}
+				if err := s.apply(s.cache, string(ev.Kv.Key), value); err != nil {
+					log.Printf("etcd: ignoring malformed key %s: %v", ev.Kv.Key, err)
+				}
+				rev = ev.Kv.ModRevision
+			}
+		}
+		// release the watch stream, which is still open after an error
+		cancel()
+		if s.client.Ctx().Err() != nil {
+			// the client was closed
+			return
+		}
+		// the watch stopped, e.g. because the revision was compacted:
+		// start over from the current content
+		for {
+			var err error
+			if rev, err = s.load(); err == nil {
+				break
+			}
+			log.Printf("etcd: cannot reload the store: %v", err)
+			time.Sleep(requestTimeout)
+		}
+	}
+}
+
+// grant returns the etcd lease of the bucket of an expiry time, granting it
+// on the first use of the bucket. The keys thus expire up to leaseBucket
+// late. A bucket ending within requestTimeout is not used any more, so that
+// its lease does not expire before the write using it.
+func (s *Store) grant(expires time.Time) (clientv3.LeaseID, error) {
+	now := clock.Now()
+	if min := now.Add(requestTimeout); expires.Before(min) {
+		expires = min
+	}
+	end := expires.Truncate(leaseBucket).Add(leaseBucket)
+	s.bucketsLock.Lock()
+	defer s.bucketsLock.Unlock()
+	for e := range s.buckets {
+		if e < now.Add(requestTimeout).Unix() {
+			delete(s.buckets, e)
+		}
+	}
+	if id, ok := s.buckets[end.Unix()]; ok {
+		return id, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	grant, err := s.client.Grant(ctx, int64(end.Sub(now)/time.Second)+1)
+	if err != nil {
+		return 0, err
+	}
+	s.buckets[end.Unix()] = grant.ID
+	return grant.ID, nil
+}
+
+// forget drops an etcd lease from the buckets after a write using it failed,
+// e.g. because etcd lost it, so that the next write grants a new one.
+func (s *Store) forget(id clientv3.LeaseID) {
+	if id == 0 {
+		return
+	}
+	s.bucketsLock.Lock()
+	defer s.bucketsLock.Unlock()
+	for e, bid := range s.buckets {
+		if bid == id {
+			delete(s.buckets, e)
+		}
+	}
+}
+
+// put returns the operation writing a value, bound to the etcd lease of the
+// bucket of the given time if it is not zero, and the ID of that lease.
+func (s *Store) put(key string, value interface{}, expires time.Time) (clientv3.Op, clientv3.LeaseID, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return clientv3.Op{}, 0, err
+	}
+	if expires.IsZero() {
+		return clientv3.OpPut(key, string(data)), 0, nil
+	}
+	id, err := s.grant(expires)
+	if err != nil {
+		return clientv3.Op{}, 0, err
+	}
+	return clientv3.OpPut(key, string(data), clientv3.WithLease(id)), id, nil
+}
+
+// leaseExpiry returns when the key of a lease expires, or zero.
+func (s *Store) leaseExpiry(l *leases.Lease) time.Time {
+	if s.retention == 0 || l.Ends.IsZero() {
+		return time.Time{}
+	}
+	return l.Ends.Add(s.retention)
+}
+
+// do runs an operation against etcd.
+func (s *Store) do(op clientv3.Op) (clientv3.OpResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return s.client.Do(ctx, op)
+}
+
+// Lease returns the lease of an address.
+func (s *Store) Lease(ip net.IP) (*leases.Lease, error) {
+	return s.cache.Lease(ip)
+}
+
+// LeaseByHWAddr returns the lease of a client, by its hardware address.
+func (s *Store) LeaseByHWAddr(hwaddr net.HardwareAddr) (*leases.Lease, error) {
+	return s.cache.LeaseByHWAddr(hwaddr)
+}
+
+// Leases returns all the leases, ordered by address.
+func (s *Store) Leases() ([]*leases.Lease, error) {
+	return s.cache.Leases()
+}
+
+// LeasesInSubnet returns the leases of the addresses of a subnet, see
+// leases.SubnetIndex.
+func (s *Store) LeasesInSubnet(subnet *net.IPNet) ([]*leases.Lease, error) {
+	return s.cache.LeasesInSubnet(subnet)
+}
+
+// LeasesByHostname returns the leases with a host name, see
+// leases.HostnameIndex.
+func (s *Store) LeasesByHostname(name string) ([]*leases.Lease, error) {
+	return s.cache.LeasesByHostname(name)
+}
+
+// PutLease creates or replaces the lease of an address.
+func (s *Store) PutLease(lease *leases.Lease) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	op, id, err := s.put(s.leaseKey(lease.IP), lease, s.leaseExpiry(lease))
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(op); err != nil {
+		s.forget(id)
+		return err
+	}
+	return s.cache.PutLease(lease)
+}
+
+// ClaimLease claims an address for a client, see leases.Claimer, with a
+// transaction that fails if the lease of the address changed since it was
+// checked.
+func (s *Store) ClaimLease(lease *leases.Lease, now time.Time) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	key := s.leaseKey(lease.IP)
+	for i := 0; i < claimRetries; i++ {
+		resp, err := s.do(clientv3.OpGet(key))
+		if err != nil {
+			return err
+		}
+		// a compare on the modification revision of a missing key is
+		// true for the revision 0
+		var rev int64
+		if kvs := resp.Get().Kvs; len(kvs) > 0 {
+			var cur leases.Lease
+			if err := json.Unmarshal(kvs[0].Value, &cur); err == nil && !cur.Expired(now) && !leases.SameClient(&cur, lease) {
+				return leases.ErrConflict
+			}
+			rev = kvs[0].ModRevision
+		}
+		op, id, err := s.put(key, lease, s.leaseExpiry(lease))
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		txn, err := s.client.Txn(ctx).If(clientv3.Compare(clientv3.ModRevision(key), "=", rev)).Then(op).Commit()
+		cancel()
+		if err != nil {
+			s.forget(id)
+			return err
+		}
+		if txn.Succeeded {
+			return s.cache.PutLease(lease)
+		}
+	}
+	return leases.ErrConflict
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *Store) DeleteLease(ip net.IP) error {
+	resp, err := s.do(clientv3.OpDelete(s.leaseKey(ip)))
+	if err != nil {
+		return err
+	}
+	if err := s.cache.DeleteLease(ip); err != nil && err != leases.ErrNotFound {
+		return err
+	}
+	if resp.Del().Deleted == 0 {
+		return leases.ErrNotFound
+	}
+	return nil
+}
+
+// Host returns a host by name.
+func (s *Store) Host(name string) (*leases.Host, error) {
+	return s.cache.Host(name)
+}
+
+// HostByHWAddr returns a host by hardware address.
+func (s *Store) HostByHWAddr(hwaddr net.HardwareAddr) (*leases.Host, error) {
+	return s.cache.HostByHWAddr(hwaddr)
+}
+
+// HostByIP returns a host by reserved address.
+func (s *Store) HostByIP(ip net.IP) (*leases.Host, error) {
+	return s.cache.HostByIP(ip)
+}
+
+// Hosts returns all the hosts, ordered by name.
+func (s *Store) Hosts() ([]*leases.Host, error) {
+	return s.cache.Hosts()
+}
+
+// PutHost creates or replaces a host. Pre-reservations expire with their etcd
+// lease.
+func (s *Store) PutHost(host *leases.Host) error {
+	if host.Name == "" {
+		return errors.New("host without a name")
+	}
+	op, id, err := s.put(s.hostKey(host.Name), host, host.Expires)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do(op); err != nil {
+		s.forget(id)
+		return err
+	}
+	return s.cache.PutHost(host)
+}
+
+// DeleteHost deletes a host by name.
+func (s *Store) DeleteHost(name string) error {
+	resp, err := s.do(clientv3.OpDelete(s.hostKey(name)))
+	if err != nil {
+		return err
+	}
+	if err := s.cache.DeleteHost(name); err != nil && err != leases.ErrNotFound {
+		return err
+	}
+	if resp.Del().Deleted == 0 {
+		return leases.ErrNotFound
+	}
+	return nil
+}
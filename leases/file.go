@@ -0,0 +1,198 @@
+package leases
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// the files of a FileStore, in its directory
+const (
+	snapshotFile = "leases.snapshot"
+	walFile      = "leases.wal"
+)
+
+// FileStore is a Store kept in memory and persisted in a directory, in a way
+// that survives a power loss: every change is appended to a write-ahead log,
+// whose entries are checksummed, and the log is periodically compacted into a
+// snapshot of the store, which replaces the previous one atomically. When the
+// store is opened, the log is replayed over the snapshot, up to its first
+// truncated or corrupted entry.
+type FileStore struct {
+	*MemoryStore
+	dir string
+	wal *journal
+	// lock serializes the changes with the compactions, so that the log
+	// holds the changes made after the snapshot
+	lock sync.Mutex
+}
+
+// OpenFileStore opens, or creates, the store persisted in a directory.
+func OpenFileStore(dir string, policy SyncPolicy, interval time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := FileStore{MemoryStore: NewMemoryStore(), dir: dir}
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotFile))
+	switch {
+	case err == nil:
+		var snap Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, err
+		}
+		if err := s.MemoryStore.Restore(&snap); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	wal, entries, err := openJournal(filepath.Join(dir, walFile), policy, interval)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if err := e.apply(s.MemoryStore); err != nil {
+			wal.close()
+			return nil, err
+		}
+	}
+	s.wal = wal
+	log.Printf("leases: loaded the store from %s, with %d changes since the snapshot", dir, len(entries))
+	return &s, nil
+}
+
+// Close syncs and closes the log.
+func (s *FileStore) Close() error {
+	return s.wal.close()
+}
+
+// PutLease creates or replaces the lease of an address. The changes are
+// appended to the log before they are applied, so that a failed write leaves
+// the store as it is on disk.
+func (s *FileStore) PutLease(lease *Lease) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.wal.append(&journalEntry{Op: opPutLease, Lease: lease}); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutLease(lease)
+}
+
+// ClaimLease claims an address for a client, see Claimer. The claim is atomic
+// since the changes of the store are serialized.
+func (s *FileStore) ClaimLease(lease *Lease, now time.Time) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := checkClaim(s.MemoryStore.Lease, lease, now); err != nil {
+		return err
+	}
+	if err := s.wal.append(&journalEntry{Op: opPutLease, Lease: lease}); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutLease(lease)
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *FileStore) DeleteLease(ip net.IP) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.MemoryStore.Lease(ip); err != nil {
+		return err
+	}
+	if err := s.wal.append(&journalEntry{Op: opDeleteLease, IP: ip}); err != nil {
+		return err
+	}
+	return s.MemoryStore.DeleteLease(ip)
+}
+
+// PutHost creates or replaces a host.
+func (s *FileStore) PutHost(host *Host) error {
+	if host.Name == "" {
+		return errors.New("host without a name")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.wal.append(&journalEntry{Op: opPutHost, Host: host}); err != nil {
+		return err
+	}
+	return s.MemoryStore.PutHost(host)
+}
+
+// DeleteHost deletes a host by name.
+func (s *FileStore) DeleteHost(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, err := s.MemoryStore.Host(name); err != nil {
+		return err
+	}
+	if err := s.wal.append(&journalEntry{Op: opDeleteHost, Name: name}); err != nil {
+		return err
+	}
+	return s.MemoryStore.DeleteHost(name)
+}
+
+// writeSnapshot replaces the snapshot file atomically. The store must be
+// locked.
+func (s *FileStore) writeSnapshot(snap *Snapshot) error {
+	tmp, err := ioutil.TempFile(s.dir, snapshotFile+".tmp")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(tmp).Encode(snap)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(s.dir, snapshotFile))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Compact writes a snapshot of the store and empties the log, see Compactor.
+// A crash in between replays the log over the new snapshot, which is
+// harmless since the changes are idempotent.
+func (s *FileStore) Compact() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	snap, err := s.MemoryStore.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := s.writeSnapshot(snap); err != nil {
+		return err
+	}
+	return s.wal.checkpoint(nil)
+}
+
+// Restore replaces the content of the store with a snapshot, see Snapshotter.
+func (s *FileStore) Restore(snap *Snapshot) error {
+	if err := snap.validate(); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.writeSnapshot(snap); err != nil {
+		return err
+	}
+	if err := s.wal.checkpoint(nil); err != nil {
+		return err
+	}
+	return s.MemoryStore.Restore(snap)
+}
@@ -0,0 +1,222 @@
+package leases
+
+import (
+	"net"
+	"strings"
+)
+
+// SubnetIndex is implemented by the stores that index the leases by address
+// range, so that the leases of a subnet are found without a full scan.
+type SubnetIndex interface {
+	// LeasesInSubnet returns the leases of the addresses of a subnet,
+	// ordered by address.
+	LeasesInSubnet(subnet *net.IPNet) ([]*Lease, error)
+}
+
+// HostnameIndex is implemented by the stores that index the leases by host
+// name.
+type HostnameIndex interface {
+	// LeasesByHostname returns the leases with a host name, compared
+	// without case, ordered by address.
+	LeasesByHostname(name string) ([]*Lease, error)
+}
+
+// LeasesInSubnet returns the leases of the addresses of a subnet, without a
+// full scan if the store is a SubnetIndex.
+func LeasesInSubnet(store Store, subnet *net.IPNet) ([]*Lease, error) {
+	if idx, ok := store.(SubnetIndex); ok {
+		return idx.LeasesInSubnet(subnet)
+	}
+	all, err := store.Leases()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Lease
+	for _, l := range all {
+		if subnet.Contains(l.IP) {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
+
+// LeasesByHostname returns the leases with a host name, without a full scan
+// if the store is a HostnameIndex.
+func LeasesByHostname(store Store, name string) ([]*Lease, error) {
+	if idx, ok := store.(HostnameIndex); ok {
+		return idx.LeasesByHostname(name)
+	}
+	all, err := store.Leases()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Lease
+	for _, l := range all {
+		if strings.EqualFold(l.Hostname, name) {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
+
+// ClientIDIndex is implemented by the stores that look up the hosts by client
+// identifier without listing them all.
+type ClientIDIndex interface {
+	HostByClientID(id string) (*Host, error)
+}
+
+// HostByClientID returns the host reserved for a client identifier, or the
+// DUID of a DHCPv6 client, in hex, compared without case.
+func HostByClientID(store Store, id string) (*Host, error) {
+	if id == "" {
+		return nil, ErrNotFound
+	}
+	if idx, ok := store.(ClientIDIndex); ok {
+		return idx.HostByClientID(id)
+	}
+	hosts, err := store.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(h.ClientID, id) {
+			return h, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// the prefix lengths of the networks of the subnet index
+const (
+	networkBits4 = 24
+	networkBits6 = 64
+)
+
+// network returns the network of an address in the subnet index, as a
+// string of its bytes.
+func network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(net.CIDRMask(networkBits4, 32)))
+	}
+	return string(ip.To16().Mask(net.CIDRMask(networkBits6, 128)))
+}
+
+// keyIndex maps the values of an attribute of the leases to their keys. It is
+// guarded by the lock of its shard.
+type keyIndex struct {
+	sets map[string]map[string]struct{}
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{sets: make(map[string]map[string]struct{})}
+}
+
+// add indexes a key by value. Empty values are not indexed.
+func (x *keyIndex) add(value, key string) {
+	if value == "" {
+		return
+	}
+	set, ok := x.sets[value]
+	if !ok {
+		set = make(map[string]struct{})
+		x.sets[value] = set
+	}
+	set[key] = struct{}{}
+}
+
+// remove removes a key indexed by value.
+func (x *keyIndex) remove(value, key string) {
+	if set, ok := x.sets[value]; ok {
+		delete(set, key)
+		if len(set) == 0 {
+			delete(x.sets, value)
+		}
+	}
+}
+
+// keys returns the keys indexed by the values that match.
+func (x *keyIndex) keys(match func(value string) bool) []string {
+	var keys []string
+	for value, set := range x.sets {
+		if match(value) {
+			for key := range set {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// get returns the keys indexed by a value.
+func (x *keyIndex) get(value string) []string {
+	keys := make([]string, 0, len(x.sets[value]))
+	for key := range x.sets[value] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// index indexes a lease stored under a key in a locked shard, by expiry
+// time, network, host name and hardware address.
+func (sh *leaseShard) index(key string, l *Lease) {
+	sh.expiry.add(key, l.Ends)
+	sh.networks.add(network(l.IP), key)
+	sh.hostnames.add(strings.ToLower(l.Hostname), key)
+	sh.hwaddrs.add(string(l.HWAddr), key)
+}
+
+// unindex removes a lease from the indexes of index.
+func (sh *leaseShard) unindex(key string, l *Lease) {
+	sh.expiry.remove(key, l.Ends)
+	sh.networks.remove(network(l.IP), key)
+	sh.hostnames.remove(strings.ToLower(l.Hostname), key)
+	sh.hwaddrs.remove(string(l.HWAddr), key)
+}
+
+// leasesOf returns the leases found in the index of each shard, that pass a
+// filter, ordered by address.
+func (s *MemoryStore) leasesOf(lookup func(sh *leaseShard) []string, filter func(*Lease) bool) []*Lease {
+	var ret []*Lease
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		for _, key := range lookup(shard) {
+			if l, ok := shard.leases[key]; ok && filter(l) {
+				ret = append(ret, copyLease(l))
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	sortLeases(ret)
+	return ret
+}
+
+// LeasesInSubnet returns the leases of the addresses of a subnet, see
+// SubnetIndex. Only the leases of the indexed networks that overlap the
+// subnet are looked at.
+func (s *MemoryStore) LeasesInSubnet(subnet *net.IPNet) ([]*Lease, error) {
+	ones, bits := subnet.Mask.Size()
+	lookup := func(sh *leaseShard) []string {
+		return sh.networks.keys(func(value string) bool {
+			return subnet.Contains(net.IP(value))
+		})
+	}
+	if (bits == 32 && ones >= networkBits4) || (bits == 128 && ones >= networkBits6) {
+		lookup = func(sh *leaseShard) []string {
+			return sh.networks.get(network(subnet.IP))
+		}
+	}
+	return s.leasesOf(lookup, func(l *Lease) bool {
+		return subnet.Contains(l.IP)
+	}), nil
+}
+
+// LeasesByHostname returns the leases with a host name, see HostnameIndex.
+func (s *MemoryStore) LeasesByHostname(name string) ([]*Lease, error) {
+	value := strings.ToLower(name)
+	return s.leasesOf(func(sh *leaseShard) []string {
+		return sh.hostnames.get(value)
+	}, func(l *Lease) bool {
+		return strings.EqualFold(l.Hostname, name)
+	}), nil
+}
@@ -0,0 +1,278 @@
+package leases
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SyncPolicy is when the journal is synced to disk.
+type SyncPolicy int
+
+// The sync policies of the journal: after every change, at an interval, or
+// never, leaving it to the operating system.
+const (
+	SyncAlways SyncPolicy = iota
+	SyncInterval
+	SyncNever
+)
+
+// ParseSyncPolicy parses the name of a sync policy.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown sync policy `%s`, must be always, interval or never", name)
+}
+
+// the operations of the journal entries
+const (
+	opPutLease    = "put-lease"
+	opDeleteLease = "delete-lease"
+	opPutHost     = "put-host"
+	opDeleteHost  = "delete-host"
+)
+
+// journalEntry is a change of a store.
+type journalEntry struct {
+	Op    string `json:"op"`
+	Lease *Lease `json:"lease,omitempty"`
+	Host  *Host  `json:"host,omitempty"`
+	IP    net.IP `json:"ip,omitempty"`
+	Name  string `json:"name,omitempty"`
+	// attempts is the number of failed writes to the backend
+	attempts int
+}
+
+// apply applies a change to a store. Deleting an object that does not exist
+// is not an error, so that entries can be replayed.
+func (e *journalEntry) apply(store Store) error {
+	var err error
+	switch e.Op {
+	case opPutLease:
+		err = store.PutLease(e.Lease)
+	case opDeleteLease:
+		err = store.DeleteLease(e.IP)
+	case opPutHost:
+		err = store.PutHost(e.Host)
+	case opDeleteHost:
+		err = store.DeleteHost(e.Name)
+	default:
+		return fmt.Errorf("unknown journal operation `%s`", e.Op)
+	}
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// castagnoli is the CRC-32C table of the checksums of the journal entries.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeEntry returns the line of an entry in the journal: its CRC-32C
+// checksum in hex, a space, and the entry in JSON.
+func encodeEntry(e *journalEntry) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.Checksum(data, castagnoli), data)), nil
+}
+
+// decodeEntry parses and verifies a line of the journal.
+func decodeEntry(line []byte) (*journalEntry, error) {
+	sep := bytes.IndexByte(line, ' ')
+	if sep < 0 {
+		return nil, errors.New("malformed entry")
+	}
+	sum, err := strconv.ParseUint(string(line[:sep]), 16, 32)
+	if err != nil {
+		return nil, errors.New("malformed checksum")
+	}
+	data := line[sep+1:]
+	if crc32.Checksum(data, castagnoli) != uint32(sum) {
+		return nil, errors.New("checksum mismatch")
+	}
+	var e journalEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// journal is an append-only file of changes, one checksummed JSON object per
+// line.
+type journal struct {
+	lock   sync.Mutex
+	path   string
+	file   *os.File
+	w      *bufio.Writer
+	policy SyncPolicy
+}
+
+// openJournal opens a journal, creating it if needed, and returns the entries
+// it holds. The entries are read up to the first one that is truncated or
+// corrupted, e.g. by a crash while writing it, and the rest is discarded.
+func openJournal(path string, policy SyncPolicy, interval time.Duration) (*journal, []*journalEntry, error) {
+	var entries []*journalEntry
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			e, err := decodeEntry(scanner.Bytes())
+			if err != nil {
+				log.Printf("leases: discarding the end of the journal %s after %d entries: %v", path, len(entries), err)
+				break
+			}
+			entries = append(entries, e)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	j := journal{path: path, policy: policy}
+	if err := j.rewrite(entries); err != nil {
+		return nil, nil, err
+	}
+	if policy == SyncInterval {
+		go j.syncEvery(interval)
+	}
+	return &j, entries, nil
+}
+
+// append writes an entry to the journal, and syncs it if the policy says so.
+func (j *journal) append(e *journalEntry) error {
+	data, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+	if j.policy == SyncAlways {
+		return j.sync()
+	}
+	return nil
+}
+
+// sync flushes the buffered entries and syncs the file. The journal must be
+// locked.
+func (j *journal) sync() error {
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) syncEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		j.lock.Lock()
+		if j.file == nil {
+			j.lock.Unlock()
+			return
+		}
+		if err := j.sync(); err != nil {
+			log.Printf("leases: cannot sync the journal %s: %v", j.path, err)
+		}
+		j.lock.Unlock()
+	}
+}
+
+// checkpoint replaces the content of the journal with the entries that are
+// not applied to the backend yet.
+func (j *journal) checkpoint(entries []*journalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.rewrite(entries)
+}
+
+// rewrite replaces the content of the journal with the given entries,
+// atomically. The journal must be locked.
+func (j *journal) rewrite(entries []*journalEntry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, e := range entries {
+		data, err := encodeEntry(e)
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), j.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, j.w = tmp, bufio.NewWriter(tmp)
+	return nil
+}
+
+// deadPath returns the path of the dead letters of the journal, the changes
+// given up on.
+func (j *journal) deadPath() string {
+	return j.path + ".dead"
+}
+
+// deadLetter appends a change to the dead letters, in the format of the
+// journal, so that it can be inspected or replayed by hand.
+func (j *journal) deadLetter(e *journalEntry) error {
+	data, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.deadPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// close syncs and closes the journal.
+func (j *journal) close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	err := j.sync()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	j.file = nil
+	return err
+}
@@ -0,0 +1,388 @@
+// Package leases implements the store of the lease and host objects, i.e. the
+// addresses bound to clients and the static reservations. It is shared by the
+// plugins that assign addresses and by the management interfaces.
+package leases
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when looking up an object that does not exist.
+var ErrNotFound = errors.New("object not found")
+
+// Lease is an address bound to a client.
+type Lease struct {
+	IP     net.IP           `json:"ip-address"`
+	HWAddr net.HardwareAddr `json:"hw-address,omitempty"`
+	// ClientID is the client identifier for DHCPv4, or the DUID for
+	// DHCPv6, in hex.
+	ClientID string    `json:"client-id,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Starts   time.Time `json:"starts"`
+	Ends     time.Time `json:"ends"`
+	// PrefixLen is the length of a delegated prefix (IA_PD), whose first
+	// address is IP, or 0 for a lease of an address.
+	PrefixLen int `json:"prefix-length,omitempty"`
+	// IAID is the identifier of the IA_PD of a delegated prefix, in hex.
+	IAID string `json:"iaid,omitempty"`
+}
+
+// Expired returns whether the lease is expired at the given time.
+func (l *Lease) Expired(now time.Time) bool {
+	return !l.Ends.IsZero() && !now.Before(l.Ends)
+}
+
+// Host is a static reservation of an address for a client, identified by its
+// hardware address or its client identifier.
+type Host struct {
+	Name     string           `json:"name"`
+	HWAddr   net.HardwareAddr `json:"hw-address,omitempty"`
+	ClientID string           `json:"client-id,omitempty"`
+	IP       net.IP           `json:"ip-address,omitempty"`
+	// Expires is the time when a pre-reservation is removed if the client
+	// has not taken its address, or zero for permanent reservations.
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Expired returns whether the host is a pre-reservation that expired at the
+// given time.
+func (h *Host) Expired(now time.Time) bool {
+	return !h.Expires.IsZero() && !now.Before(h.Expires)
+}
+
+// Store holds the lease and host objects. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	Lease(ip net.IP) (*Lease, error)
+	LeaseByHWAddr(hwaddr net.HardwareAddr) (*Lease, error)
+	// Leases returns all the leases, ordered by address.
+	Leases() ([]*Lease, error)
+	PutLease(lease *Lease) error
+	DeleteLease(ip net.IP) error
+
+	Host(name string) (*Host, error)
+	HostByHWAddr(hwaddr net.HardwareAddr) (*Host, error)
+	HostByIP(ip net.IP) (*Host, error)
+	// Hosts returns all the hosts, ordered by name.
+	Hosts() ([]*Host, error)
+	PutHost(host *Host) error
+	DeleteHost(name string) error
+}
+
+// Pinger is implemented by the stores backed by a remote service, whose
+// connectivity is part of the readiness of the server.
+type Pinger interface {
+	// Ping returns an error if the backend cannot be reached before the
+	// context is done.
+	Ping(ctx context.Context) error
+}
+
+// Ping checks the connectivity of a store, if it is a Pinger. The stores
+// that are not, e.g. the ones kept in memory or in local files, are always
+// reachable.
+func Ping(ctx context.Context, store Store) error {
+	if p, ok := store.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// shardCount is the number of shards of the leases of a MemoryStore.
+const shardCount = 64
+
+// leaseShard holds the leases of the addresses that hash to it, and their
+// indexes, which are guarded by the lock of the shard: a write only locks its
+// shard.
+type leaseShard struct {
+	lock      sync.RWMutex
+	leases    map[string]*Lease
+	expiry    *expiryWheel
+	networks  *keyIndex
+	hostnames *keyIndex
+	hwaddrs   *keyIndex
+}
+
+// reset empties the shard.
+func (sh *leaseShard) reset() {
+	sh.leases = make(map[string]*Lease)
+	sh.expiry = newExpiryWheel()
+	sh.networks = newKeyIndex()
+	sh.hostnames = newKeyIndex()
+	sh.hwaddrs = newKeyIndex()
+}
+
+// MemoryStore is a Store keeping the objects in memory. The leases are split
+// in shards, each with its own lock, so that concurrent clients rarely wait
+// for each other, and indexed by expiry time for the maintenance runs, by
+// hardware address for the lookups of the clients, and by network and host
+// name for the management queries. The hosts, which change rarely, share a
+// single lock.
+type MemoryStore struct {
+	shards [shardCount]leaseShard
+
+	hostLock sync.RWMutex
+	hosts    map[string]*Host
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	s := MemoryStore{hosts: make(map[string]*Host)}
+	for i := range s.shards {
+		s.shards[i].reset()
+	}
+	return &s
+}
+
+// Default is the store used by the server, the plugins and the management
+// interfaces.
+var Default Store = NewMemoryStore()
+
+// the objects are copied in and out of the store, so that callers can not
+// modify them without locking
+
+func copyLease(l *Lease) *Lease {
+	c := *l
+	return &c
+}
+
+func copyHost(h *Host) *Host {
+	c := *h
+	return &c
+}
+
+// shard returns the shard of the lease of an address, given as a string.
+func (s *MemoryStore) shard(key string) *leaseShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.shards[h.Sum32()%shardCount]
+}
+
+// lockAll locks all the shards, in order, for the atomic operations on the
+// whole store.
+func (s *MemoryStore) lockAll() {
+	for i := range s.shards {
+		s.shards[i].lock.Lock()
+	}
+}
+
+func (s *MemoryStore) unlockAll() {
+	for i := range s.shards {
+		s.shards[i].lock.Unlock()
+	}
+}
+
+// Lease returns the lease of an address.
+func (s *MemoryStore) Lease(ip net.IP) (*Lease, error) {
+	key := ip.String()
+	shard := s.shard(key)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
+	l, ok := shard.leases[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyLease(l), nil
+}
+
+// LeaseByHWAddr returns the lease of a client, by its hardware address. Each
+// shard is looked up in its index, since the leases are sharded by address.
+func (s *MemoryStore) LeaseByHWAddr(hwaddr net.HardwareAddr) (*Lease, error) {
+	value := string(hwaddr)
+	if value == "" {
+		return nil, ErrNotFound
+	}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		for _, key := range shard.hwaddrs.get(value) {
+			if l, ok := shard.leases[key]; ok {
+				shard.lock.RUnlock()
+				return copyLease(l), nil
+			}
+		}
+		shard.lock.RUnlock()
+	}
+	return nil, ErrNotFound
+}
+
+// Leases returns all the leases, ordered by address.
+func (s *MemoryStore) Leases() ([]*Lease, error) {
+	var ret []*Lease
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.RLock()
+		for _, l := range shard.leases {
+			ret = append(ret, copyLease(l))
+		}
+		shard.lock.RUnlock()
+	}
+	sortLeases(ret)
+	return ret, nil
+}
+
+// sortLeases orders leases by address.
+func sortLeases(leases []*Lease) {
+	sort.Slice(leases, func(i, j int) bool {
+		return compareIP(leases[i].IP, leases[j].IP) < 0
+	})
+}
+
+// put stores a lease in a locked shard, and indexes it.
+func (sh *leaseShard) put(key string, lease *Lease) {
+	if old, ok := sh.leases[key]; ok {
+		sh.unindex(key, old)
+	}
+	sh.leases[key] = copyLease(lease)
+	sh.index(key, lease)
+}
+
+// PutLease creates or replaces the lease of an address.
+func (s *MemoryStore) PutLease(lease *Lease) error {
+	if lease.IP == nil {
+		return errors.New("lease without an address")
+	}
+	key := lease.IP.String()
+	shard := s.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	shard.put(key, lease)
+	return nil
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *MemoryStore) DeleteLease(ip net.IP) error {
+	key := ip.String()
+	shard := s.shard(key)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	l, ok := shard.leases[key]
+	if !ok {
+		return ErrNotFound
+	}
+	shard.unindex(key, l)
+	delete(shard.leases, key)
+	return nil
+}
+
+// ExpiredLeases returns the leases expired at the given time, without
+// scanning the leases that are not, see ExpiryIndex.
+func (s *MemoryStore) ExpiredLeases(now time.Time) ([]*Lease, error) {
+	var ret []*Lease
+	for i := range s.shards {
+		shard := &s.shards[i]
+		// the wheel skips its empty buckets as it goes
+		shard.lock.Lock()
+		for _, key := range shard.expiry.before(now) {
+			if l, ok := shard.leases[key]; ok && l.Expired(now) {
+				ret = append(ret, copyLease(l))
+			}
+		}
+		shard.lock.Unlock()
+	}
+	sortLeases(ret)
+	return ret, nil
+}
+
+// Host returns a host by name.
+func (s *MemoryStore) Host(name string) (*Host, error) {
+	s.hostLock.RLock()
+	defer s.hostLock.RUnlock()
+	h, ok := s.hosts[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyHost(h), nil
+}
+
+// HostByHWAddr returns a host by hardware address.
+func (s *MemoryStore) HostByHWAddr(hwaddr net.HardwareAddr) (*Host, error) {
+	s.hostLock.RLock()
+	defer s.hostLock.RUnlock()
+	for _, h := range s.hosts {
+		if h.HWAddr != nil && h.HWAddr.String() == hwaddr.String() {
+			return copyHost(h), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// HostByClientID returns a host by client identifier, see ClientIDIndex.
+func (s *MemoryStore) HostByClientID(id string) (*Host, error) {
+	s.hostLock.RLock()
+	defer s.hostLock.RUnlock()
+	for _, h := range s.hosts {
+		if h.ClientID != "" && strings.EqualFold(h.ClientID, id) {
+			return copyHost(h), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// HostByIP returns a host by reserved address.
+func (s *MemoryStore) HostByIP(ip net.IP) (*Host, error) {
+	s.hostLock.RLock()
+	defer s.hostLock.RUnlock()
+	for _, h := range s.hosts {
+		if h.IP.Equal(ip) {
+			return copyHost(h), nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Hosts returns all the hosts, ordered by name.
+func (s *MemoryStore) Hosts() ([]*Host, error) {
+	s.hostLock.RLock()
+	ret := make([]*Host, 0, len(s.hosts))
+	for _, h := range s.hosts {
+		ret = append(ret, copyHost(h))
+	}
+	s.hostLock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// PutHost creates or replaces a host.
+func (s *MemoryStore) PutHost(host *Host) error {
+	if host.Name == "" {
+		return errors.New("host without a name")
+	}
+	s.hostLock.Lock()
+	defer s.hostLock.Unlock()
+	s.hosts[host.Name] = copyHost(host)
+	return nil
+}
+
+// DeleteHost deletes a host by name.
+func (s *MemoryStore) DeleteHost(name string) error {
+	s.hostLock.Lock()
+	defer s.hostLock.Unlock()
+	if _, ok := s.hosts[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.hosts, name)
+	return nil
+}
+
+// compareIP orders addresses numerically, IPv4 before IPv6.
+func compareIP(a, b net.IP) int {
+	a4, b4 := a.To4(), b.To4()
+	switch {
+	case a4 != nil && b4 != nil:
+		return strings.Compare(string(a4), string(b4))
+	case a4 != nil:
+		return -1
+	case b4 != nil:
+		return 1
+	}
+	return strings.Compare(string(a.To16()), string(b.To16()))
+}
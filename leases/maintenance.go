@@ -0,0 +1,75 @@
+package leases
+
+import (
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+// Compactor is implemented by the stores that keep an append-only
+// representation, e.g. a journal, which grows with every change until it is
+// compacted to the current content of the store.
+type Compactor interface {
+	Compact() error
+}
+
+// ExpiryIndex is implemented by the stores that index the leases by expiry
+// time, so that the expired leases are found without a full scan.
+type ExpiryIndex interface {
+	// ExpiredLeases returns the leases expired at the given time.
+	ExpiredLeases(now time.Time) ([]*Lease, error)
+}
+
+// Prune deletes the leases that expired, or were released, before the given
+// time, and returns how many it deleted.
+func Prune(store Store, before time.Time) (int, error) {
+	var (
+		leases []*Lease
+		err    error
+	)
+	if idx, ok := store.(ExpiryIndex); ok {
+		leases, err = idx.ExpiredLeases(before)
+	} else {
+		leases, err = store.Leases()
+	}
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, l := range leases {
+		if !l.Expired(before) {
+			continue
+		}
+		if err := store.DeleteLease(l.IP); err != nil && err != ErrNotFound {
+			return pruned, err
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// Maintain runs the maintenance of a store at the given interval, forever: the
+// leases that expired more than retention ago are deleted, unless retention is
+// 0, and the store is compacted if it is a Compactor.
+func Maintain(store Store, retention, interval time.Duration) {
+	tick := clock.Default.NewTicker(interval)
+	defer tick.Stop()
+	for now := range tick.C() {
+		if retention > 0 {
+			pruned, err := Prune(store, now.Add(-retention))
+			if err != nil {
+				log.Printf("leases: cannot delete the old leases: %v", err)
+			} else if pruned > 0 {
+				log.Printf("leases: deleted %d leases expired for more than %s", pruned, retention)
+			}
+		}
+		if c, ok := store.(Compactor); ok {
+			if err := c.Compact(); err != nil {
+				log.Printf("leases: cannot compact the store: %v", err)
+			}
+		}
+	}
+}
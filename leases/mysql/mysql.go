@@ -0,0 +1,463 @@
+// Package mysql implements a lease store backed by a MySQL or MariaDB
+// database, so that the leases survive restarts and can be shared by several
+// servers. The schema is created and upgraded when the store is opened.
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	driver "github.com/go-sql-driver/mysql"
+)
+
+var log = logger.GetLogger()
+
+// migrations are the successive changes of the schema. The version of the
+// schema is the number of migrations applied, which are never modified once
+// released: changes are new migrations.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS leases (
+		ip VARBINARY(16) NOT NULL PRIMARY KEY,
+		hw_address VARBINARY(20) NULL,
+		client_id VARCHAR(255) NOT NULL DEFAULT '',
+		hostname VARCHAR(255) NOT NULL DEFAULT '',
+		starts DATETIME(6) NULL,
+		ends DATETIME(6) NULL,
+		INDEX (hw_address)
+	)`,
+	`CREATE TABLE IF NOT EXISTS hosts (
+		name VARCHAR(255) NOT NULL PRIMARY KEY,
+		hw_address VARBINARY(20) NULL,
+		client_id VARCHAR(255) NOT NULL DEFAULT '',
+		ip VARBINARY(16) NULL,
+		expires DATETIME(6) NULL,
+		INDEX (hw_address),
+		INDEX (ip)
+	)`,
+	`ALTER TABLE leases ADD INDEX (hostname)`,
+	`ALTER TABLE leases
+		ADD COLUMN prefix_length TINYINT UNSIGNED NOT NULL DEFAULT 0,
+		ADD COLUMN iaid VARCHAR(8) NOT NULL DEFAULT ''`,
+}
+
+// migrationLock is the name of the advisory lock that serializes the
+// migrations of the servers sharing a database.
+const migrationLock = "coredhcp-migrations"
+
+// Store is a leases.Store backed by a MySQL or MariaDB database.
+type Store struct {
+	db *sql.DB
+}
+
+// Options holds the settings of the connection pool of a Store.
+type Options struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Open connects to the database with the given data source name, and
+// migrates its schema to the current version.
+func Open(dsn string, opts Options) (*Store, error) {
+	cfg, err := driver.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// the times are stored in UTC
+	cfg.ParseTime = true
+	cfg.Loc = time.UTC
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	db.SetMaxIdleConns(opts.MaxIdleConns)
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// migrate applies the migrations that the database lacks, under an advisory
+// lock. DDL statements are not transactional in MySQL, so each migration is
+// recorded as soon as it is applied.
+func migrate(db *sql.DB) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLock).Scan(&locked); err != nil {
+		return err
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("mysql: cannot get the lock of the migrations")
+	}
+	defer conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", migrationLock)
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL)"); err != nil {
+		return err
+	}
+	var version int
+	switch err := conn.QueryRowContext(ctx, "SELECT version FROM schema_version").Scan(&version); err {
+	case nil:
+	case sql.ErrNoRows:
+		if _, err := conn.ExecContext(ctx, "INSERT INTO schema_version (version) VALUES (0)"); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("mysql: schema version %d is newer than this server, which supports up to %d", version, len(migrations))
+	}
+	for ; version < len(migrations); version++ {
+		log.Printf("mysql: migrating the schema to version %d", version+1)
+		if _, err := conn.ExecContext(ctx, migrations[version]); err != nil {
+			return fmt.Errorf("mysql: migration %d: %v", version+1, err)
+		}
+		if _, err := conn.ExecContext(ctx, "UPDATE schema_version SET version = ?", version+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks that the database is reachable, see leases.Pinger.
+func (s *Store) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the connections to the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// the addresses are stored in their 4-byte form for IPv4, and sorted by
+// length first, so that IPv4 comes before IPv6 like in the other stores
+
+func ipBytes(ip net.IP) []byte {
+	if ip == nil {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func hwBytes(hwaddr net.HardwareAddr) []byte {
+	if len(hwaddr) == 0 {
+		return nil
+	}
+	return hwaddr
+}
+
+// nullTime maps the zero time to NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// scanner is implemented by sql.Row and sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+const leaseColumns = "ip, hw_address, client_id, hostname, starts, ends, prefix_length, iaid"
+
+// insertLease is the statement that writes a lease, with the values returned
+// by leaseValues, after REPLACE or INSERT.
+const insertLease = " INTO leases (" + leaseColumns + ") VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+
+func leaseValues(l *leases.Lease) []interface{} {
+	return []interface{}{ipBytes(l.IP), hwBytes(l.HWAddr), l.ClientID, l.Hostname, nullTime(l.Starts), nullTime(l.Ends), l.PrefixLen, l.IAID}
+}
+
+func scanLease(row scanner) (*leases.Lease, error) {
+	var (
+		l            leases.Lease
+		ip, hwaddr   []byte
+		starts, ends *time.Time
+	)
+	if err := row.Scan(&ip, &hwaddr, &l.ClientID, &l.Hostname, &starts, &ends, &l.PrefixLen, &l.IAID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, leases.ErrNotFound
+		}
+		return nil, err
+	}
+	l.IP = net.IP(ip)
+	if len(hwaddr) > 0 {
+		l.HWAddr = net.HardwareAddr(hwaddr)
+	}
+	if starts != nil {
+		l.Starts = *starts
+	}
+	if ends != nil {
+		l.Ends = *ends
+	}
+	return &l, nil
+}
+
+const hostColumns = "name, hw_address, client_id, ip, expires"
+
+func scanHost(row scanner) (*leases.Host, error) {
+	var (
+		h          leases.Host
+		ip, hwaddr []byte
+		expires    *time.Time
+	)
+	if err := row.Scan(&h.Name, &hwaddr, &h.ClientID, &ip, &expires); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, leases.ErrNotFound
+		}
+		return nil, err
+	}
+	if len(ip) > 0 {
+		h.IP = net.IP(ip)
+	}
+	if len(hwaddr) > 0 {
+		h.HWAddr = net.HardwareAddr(hwaddr)
+	}
+	if expires != nil {
+		h.Expires = *expires
+	}
+	return &h, nil
+}
+
+// Lease returns the lease of an address.
+func (s *Store) Lease(ip net.IP) (*leases.Lease, error) {
+	return scanLease(s.db.QueryRow("SELECT "+leaseColumns+" FROM leases WHERE ip = ?", ipBytes(ip)))
+}
+
+// LeaseByHWAddr returns the lease of a client, by its hardware address.
+func (s *Store) LeaseByHWAddr(hwaddr net.HardwareAddr) (*leases.Lease, error) {
+	return scanLease(s.db.QueryRow("SELECT "+leaseColumns+" FROM leases WHERE hw_address = ? LIMIT 1", hwBytes(hwaddr)))
+}
+
+// Leases returns all the leases, ordered by address.
+func (s *Store) Leases() ([]*leases.Lease, error) {
+	return s.queryLeases("SELECT " + leaseColumns + " FROM leases ORDER BY LENGTH(ip), ip")
+}
+
+// LeasesInSubnet returns the leases of the addresses of a subnet, with a
+// range scan of the primary key, see leases.SubnetIndex.
+func (s *Store) LeasesInSubnet(subnet *net.IPNet) ([]*leases.Lease, error) {
+	first := ipBytes(subnet.IP.Mask(subnet.Mask))
+	last := make([]byte, len(first))
+	mask := subnet.Mask
+	if len(mask) != len(first) {
+		mask = mask[len(mask)-len(first):]
+	}
+	for i := range first {
+		last[i] = first[i] | ^mask[i]
+	}
+	return s.queryLeases("SELECT "+leaseColumns+" FROM leases WHERE LENGTH(ip) = ? AND ip BETWEEN ? AND ? ORDER BY ip",
+		len(first), first, last)
+}
+
+// LeasesByHostname returns the leases with a host name, compared with the
+// collation of the column, case-insensitive by default, see
+// leases.HostnameIndex.
+func (s *Store) LeasesByHostname(name string) ([]*leases.Lease, error) {
+	return s.queryLeases("SELECT "+leaseColumns+" FROM leases WHERE hostname = ? ORDER BY LENGTH(ip), ip", name)
+}
+
+// queryLeases returns the leases selected by a query.
+func (s *Store) queryLeases(query string, args ...interface{}) ([]*leases.Lease, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*leases.Lease
+	for rows.Next() {
+		l, err := scanLease(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, l)
+	}
+	return ret, rows.Err()
+}
+
+// PutLease creates or replaces the lease of an address.
+func (s *Store) PutLease(lease *leases.Lease) error {
+	if lease.IP == nil {
+		return fmt.Errorf("lease without an address")
+	}
+	_, err := s.db.Exec("REPLACE"+insertLease, leaseValues(lease)...)
+	return err
+}
+
+// DeleteLease deletes the lease of an address.
+func (s *Store) DeleteLease(ip net.IP) error {
+	return checkDeleted(s.db.Exec("DELETE FROM leases WHERE ip = ?", ipBytes(ip)))
+}
+
+// Host returns a host by name.
+func (s *Store) Host(name string) (*leases.Host, error) {
+	return scanHost(s.db.QueryRow("SELECT "+hostColumns+" FROM hosts WHERE name = ?", name))
+}
+
+// HostByHWAddr returns a host by hardware address.
+func (s *Store) HostByHWAddr(hwaddr net.HardwareAddr) (*leases.Host, error) {
+	return scanHost(s.db.QueryRow("SELECT "+hostColumns+" FROM hosts WHERE hw_address = ? LIMIT 1", hwBytes(hwaddr)))
+}
+
+// HostByIP returns a host by reserved address.
+func (s *Store) HostByIP(ip net.IP) (*leases.Host, error) {
+	return scanHost(s.db.QueryRow("SELECT "+hostColumns+" FROM hosts WHERE ip = ? LIMIT 1", ipBytes(ip)))
+}
+
+// Hosts returns all the hosts, ordered by name.
+func (s *Store) Hosts() ([]*leases.Host, error) {
+	rows, err := s.db.Query("SELECT " + hostColumns + " FROM hosts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ret []*leases.Host
+	for rows.Next() {
+		h, err := scanHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, h)
+	}
+	return ret, rows.Err()
+}
+
+// PutHost creates or replaces a host.
+func (s *Store) PutHost(host *leases.Host) error {
+	if host.Name == "" {
+		return fmt.Errorf("host without a name")
+	}
+	_, err := s.db.Exec("REPLACE INTO hosts ("+hostColumns+") VALUES (?, ?, ?, ?, ?)",
+		host.Name, hwBytes(host.HWAddr), host.ClientID, ipBytes(host.IP), nullTime(host.Expires))
+	return err
+}
+
+// DeleteHost deletes a host by name.
+func (s *Store) DeleteHost(name string) error {
+	return checkDeleted(s.db.Exec("DELETE FROM hosts WHERE name = ?", name))
+}
+
+// checkDeleted returns leases.ErrNotFound if a DELETE statement deleted
+// nothing.
+func checkDeleted(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return leases.ErrNotFound
+	}
+	return nil
+}
+
+// Snapshot returns a consistent copy of the leases and hosts, read in a
+// single transaction.
+func (s *Store) Snapshot() (*leases.Snapshot, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	snap := leases.Snapshot{Version: leases.SnapshotVersion, Created: time.Now()}
+	rows, err := tx.Query("SELECT " + leaseColumns + " FROM leases ORDER BY LENGTH(ip), ip")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		l, err := scanLease(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snap.Leases = append(snap.Leases, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows, err = tx.Query("SELECT " + hostColumns + " FROM hosts ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		h, err := scanHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		snap.Hosts = append(snap.Hosts, h)
+	}
+	return &snap, rows.Err()
+}
+
+// Restore replaces the content of the store with a snapshot, in a single
+// transaction.
+func (s *Store) Restore(snap *leases.Snapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// DELETE rather than TRUNCATE, which commits the transaction
+	for _, stmt := range []string{"DELETE FROM leases", "DELETE FROM hosts"} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	for _, l := range snap.Leases {
+		if _, err := tx.Exec("INSERT"+insertLease, leaseValues(l)...); err != nil {
+			return err
+		}
+	}
+	for _, h := range snap.Hosts {
+		if _, err := tx.Exec("INSERT INTO hosts ("+hostColumns+") VALUES (?, ?, ?, ?, ?)",
+			h.Name, hwBytes(h.HWAddr), h.ClientID, ipBytes(h.IP), nullTime(h.Expires)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ClaimLease claims an address for a client, see leases.Claimer. The current
+// lease of the address is locked until the new one is written.
+func (s *Store) ClaimLease(lease *leases.Lease, now time.Time) error {
+	if lease.IP == nil {
+		return fmt.Errorf("lease without an address")
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	cur, err := scanLease(tx.QueryRow("SELECT "+leaseColumns+" FROM leases WHERE ip = ? FOR UPDATE", ipBytes(lease.IP)))
+	switch {
+	case err == leases.ErrNotFound:
+	case err != nil:
+		return err
+	case !cur.Expired(now) && !leases.SameClient(cur, lease):
+		return leases.ErrConflict
+	}
+	if _, err := tx.Exec("REPLACE"+insertLease, leaseValues(lease)...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
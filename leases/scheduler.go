@@ -0,0 +1,227 @@
+package leases
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+)
+
+// ExpiryHook is called when a lease expires, e.g. to remove its DNS records
+// or to notify an inventory system. Hooks are called sequentially, from the
+// scheduler, and should not block: slow work belongs in a queue of the hook.
+type ExpiryHook func(lease *Lease)
+
+var (
+	hooksLock sync.RWMutex
+	hooks     = make(map[string]ExpiryHook)
+)
+
+// RegisterExpiryHook registers a hook called on the expiry of the leases,
+// replacing the hook registered with the same name, e.g. when the
+// configuration is reloaded. A nil hook unregisters it.
+func RegisterExpiryHook(name string, hook ExpiryHook) {
+	hooksLock.Lock()
+	defer hooksLock.Unlock()
+	if hook == nil {
+		delete(hooks, name)
+		return
+	}
+	hooks[name] = hook
+}
+
+// expiryHooks returns the registered hooks, ordered by name.
+func expiryHooks() []ExpiryHook {
+	hooksLock.RLock()
+	defer hooksLock.RUnlock()
+	names := make([]string, 0, len(hooks))
+	for name := range hooks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]ExpiryHook, 0, len(names))
+	for _, name := range names {
+		ret = append(ret, hooks[name])
+	}
+	return ret
+}
+
+// the periods of the expiry scheduler: the store is scanned for the leases
+// expiring from the last scan to the next horizon every scanInterval, and the
+// leases are fired from a wheel of one slot per second.
+const (
+	scanInterval = time.Minute
+	scanHorizon  = 2 * scanInterval
+)
+
+// ExpiryScheduler fires the expiry hooks when the leases of a store expire.
+// The leases about to expire are put in a timing wheel, with one slot per
+// second, and each is checked again against the store when its slot comes, so
+// that renewed or deleted leases are not fired. Each expiry can be delayed
+// by a random jitter, so that a mass expiry, e.g. at the start of the server
+// after an outage, does not hit the hook backends all at once.
+//
+// Each scan starts from the time of the previous one rather than from its
+// horizon, so that the leases written since with an earlier end, e.g. short
+// leases or decline holds, are not missed: those that already expired are
+// fired late, by up to scanInterval. The leases that several scans find are
+// only put in the wheel once.
+//
+// The scheduler does not remember which leases it fired across restarts: the
+// leases that expired up to catchUp before it starts are fired again, so the
+// hooks must be idempotent.
+type ExpiryScheduler struct {
+	store   Store
+	jitter  time.Duration
+	catchUp time.Duration
+
+	lock sync.Mutex
+	// slots holds the leases to fire by Unix second
+	slots map[int64][]*Lease
+	// next is the next slot to fire
+	next int64
+	// last is the time of the last scan, from which the next one starts
+	last time.Time
+	// scheduled holds the end times of the leases put in the wheel, or
+	// fired, by address and end time, until the scans are past them
+	scheduled map[string]time.Time
+}
+
+// NewExpiryScheduler returns a scheduler of the expiry of the leases of a
+// store. Each expiry is delayed by up to jitter, if not zero.
+func NewExpiryScheduler(store Store, jitter, catchUp time.Duration) *ExpiryScheduler {
+	return &ExpiryScheduler{
+		store:     store,
+		jitter:    jitter,
+		catchUp:   catchUp,
+		slots:     make(map[int64][]*Lease),
+		scheduled: make(map[string]time.Time),
+	}
+}
+
+// Run fires the expiries, forever.
+func (s *ExpiryScheduler) Run() {
+	now := clock.Now()
+	s.lock.Lock()
+	s.last = now.Add(-s.catchUp)
+	s.next = now.Unix()
+	s.lock.Unlock()
+	s.scan(now)
+	tick := clock.Default.NewTicker(time.Second)
+	defer tick.Stop()
+	lastScan := now
+	for now := range tick.C() {
+		if now.Sub(lastScan) >= scanInterval {
+			s.scan(now)
+			lastScan = now
+		}
+		s.fire(now)
+	}
+}
+
+// scheduleKey returns the key of a lease in the scheduled set.
+func scheduleKey(l *Lease) string {
+	return fmt.Sprintf("%s/%d", l.IP, l.Ends.UnixNano())
+}
+
+// scan puts in the wheel the leases expiring between the last scan and the
+// horizon of this one, that are not in it yet.
+func (s *ExpiryScheduler) scan(now time.Time) {
+	if len(expiryHooks()) == 0 {
+		// nothing to fire: skip the leases, until a hook shows up
+		s.lock.Lock()
+		s.last = now
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Lock()
+	from := s.last
+	s.lock.Unlock()
+	to := now.Add(scanHorizon)
+	found, err := expiringLeases(s.store, from, to)
+	if err != nil {
+		log.Printf("leases: cannot scan the leases about to expire: %v", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	// the leases ending before this scan starts are not found again
+	for key, ends := range s.scheduled {
+		if !ends.After(from) {
+			delete(s.scheduled, key)
+		}
+	}
+	for _, l := range found {
+		key := scheduleKey(l)
+		if _, ok := s.scheduled[key]; ok {
+			continue
+		}
+		s.scheduled[key] = l.Ends
+		at := l.Ends
+		if at.Before(now) {
+			// expired while the server was down
+			at = now
+		}
+		if s.jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+		}
+		slot := at.Unix()
+		if slot < s.next {
+			slot = s.next
+		}
+		s.slots[slot] = append(s.slots[slot], l)
+	}
+	s.last = now
+}
+
+// expiringLeases returns the leases expiring after from and up to to, without
+// a full scan if the store is an ExpiryIndex.
+func expiringLeases(store Store, from, to time.Time) ([]*Lease, error) {
+	var (
+		all []*Lease
+		err error
+	)
+	if idx, ok := store.(ExpiryIndex); ok {
+		all, err = idx.ExpiredLeases(to)
+	} else {
+		all, err = store.Leases()
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Lease
+	for _, l := range all {
+		if l.Ends.After(from) && !l.Ends.After(to) {
+			ret = append(ret, l)
+		}
+	}
+	return ret, nil
+}
+
+// fire calls the hooks for the leases of the slots up to now that are still
+// expired with the same end time.
+func (s *ExpiryScheduler) fire(now time.Time) {
+	s.lock.Lock()
+	var due []*Lease
+	for ; s.next <= now.Unix(); s.next++ {
+		due = append(due, s.slots[s.next]...)
+		delete(s.slots, s.next)
+	}
+	s.lock.Unlock()
+	if len(due) == 0 {
+		return
+	}
+	hooks := expiryHooks()
+	for _, l := range due {
+		cur, err := s.store.Lease(l.IP)
+		if err != nil || !cur.Ends.Equal(l.Ends) || !cur.Expired(now) {
+			continue
+		}
+		for _, hook := range hooks {
+			hook(cur)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package leases
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+)
+
+// advanceUntil advances a fake clock by a second at a time, giving the
+// scheduler some time to take each tick, until a lease is fired or the clock
+// reaches the deadline.
+func advanceUntil(fake *clock.Fake, fired <-chan *Lease, deadline time.Time) *Lease {
+	for fake.Now().Before(deadline) {
+		select {
+		case l := <-fired:
+			return l
+		case <-time.After(10 * time.Millisecond):
+			fake.Advance(time.Second)
+		}
+	}
+	select {
+	case l := <-fired:
+		return l
+	case <-time.After(50 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestExpirySchedulerFakeClock(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	defer func(c clock.Clock) { clock.Default = c }(clock.Default)
+	clock.Default = fake
+
+	store := NewMemoryStore()
+	expiring := &Lease{IP: net.ParseIP("192.0.2.10"), ClientID: "a", Starts: start, Ends: start.Add(30 * time.Second)}
+	renewed := &Lease{IP: net.ParseIP("192.0.2.11"), ClientID: "b", Starts: start, Ends: start.Add(40 * time.Second)}
+	for _, l := range []*Lease{expiring, renewed} {
+		if err := store.PutLease(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fired := make(chan *Lease, 4)
+	RegisterExpiryHook("test", func(l *Lease) { fired <- l })
+	defer RegisterExpiryHook("test", nil)
+
+	go NewExpiryScheduler(store, 0, time.Minute).Run()
+
+	if l := advanceUntil(fake, fired, start.Add(29*time.Second)); l != nil {
+		t.Fatalf("%s fired at %v, before its expiry", l.IP, fake.Now())
+	}
+	l := advanceUntil(fake, fired, start.Add(time.Minute))
+	if l == nil || !l.IP.Equal(expiring.IP) {
+		t.Fatalf("got %v, want the expiry of %s", l, expiring.IP)
+	}
+	if now := fake.Now(); now.Before(expiring.Ends) {
+		t.Fatalf("%s fired at %v, before its expiry", l.IP, now)
+	}
+
+	// renewed while in the wheel: not fired
+	renewal := *renewed
+	renewal.Ends = start.Add(time.Hour)
+	if err := store.PutLease(&renewal); err != nil {
+		t.Fatal(err)
+	}
+	if l := advanceUntil(fake, fired, start.Add(time.Minute)); l != nil {
+		t.Fatalf("%s fired, although it was renewed", l.IP)
+	}
+}
+
+func TestExpirySchedulerLeaseInScannedWindow(t *testing.T) {
+	start := time.Date(2020, time.January, 1, 12, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(start)
+	defer func(c clock.Clock) { clock.Default = c }(clock.Default)
+	clock.Default = fake
+
+	store := NewMemoryStore()
+	fired := make(chan *Lease, 4)
+	RegisterExpiryHook("test", func(l *Lease) { fired <- l })
+	defer RegisterExpiryHook("test", nil)
+
+	s := NewExpiryScheduler(store, 0, 0)
+	go s.Run()
+	// wait for the first scan, which covers up to start+2m
+	for {
+		s.lock.Lock()
+		scanned := !s.last.IsZero()
+		s.lock.Unlock()
+		if scanned {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// written after the scan, ending before its horizon, e.g. a short lease
+	short := &Lease{IP: net.ParseIP("192.0.2.20"), ClientID: "c", Starts: start, Ends: start.Add(30 * time.Second)}
+	if err := store.PutLease(short); err != nil {
+		t.Fatal(err)
+	}
+	l := advanceUntil(fake, fired, start.Add(2*scanInterval))
+	if l == nil || !l.IP.Equal(short.IP) {
+		t.Fatalf("got %v, want the expiry of %s", l, short.IP)
+	}
+	if now := fake.Now(); now.Before(short.Ends) || now.After(short.Ends.Add(scanInterval+time.Second)) {
+		t.Fatalf("%s fired at %v, want between %v and a scan later", l.IP, now, short.Ends)
+	}
+	// found again by the next scans, but fired once
+	if l := advanceUntil(fake, fired, start.Add(3*scanInterval)); l != nil {
+		t.Fatalf("%s fired twice", l.IP)
+	}
+}
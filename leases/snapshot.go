@@ -0,0 +1,164 @@
+package leases
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot format.
+const SnapshotVersion = 1
+
+// Snapshot is a portable copy of the content of a store, for backups.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Leases  []*Lease  `json:"leases"`
+	Hosts   []*Host   `json:"hosts"`
+}
+
+// Snapshotter is implemented by the stores that can take and restore
+// snapshots atomically, i.e. without the changes made by concurrent writers
+// while copying.
+type Snapshotter interface {
+	Snapshot() (*Snapshot, error)
+	// Restore replaces the content of the store with the snapshot.
+	Restore(snap *Snapshot) error
+}
+
+// TakeSnapshot returns a snapshot of a store, atomic if the store is a
+// Snapshotter.
+func TakeSnapshot(store Store) (*Snapshot, error) {
+	if s, ok := store.(Snapshotter); ok {
+		return s.Snapshot()
+	}
+	leases, err := store.Leases()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := store.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{Version: SnapshotVersion, Created: time.Now(), Leases: leases, Hosts: hosts}, nil
+}
+
+// validate checks that a snapshot can be restored.
+func (snap *Snapshot) validate() error {
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", snap.Version)
+	}
+	for _, l := range snap.Leases {
+		if l.IP == nil {
+			return errors.New("lease without an address in the snapshot")
+		}
+	}
+	for _, h := range snap.Hosts {
+		if h.Name == "" {
+			return errors.New("host without a name in the snapshot")
+		}
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the content of a store with a snapshot, atomically
+// if the store is a Snapshotter. Otherwise, the objects of the snapshot are
+// put first, and the other objects are deleted afterwards, so that a failure
+// partway leaves the objects of the snapshot, and possibly some leftovers, in
+// the store rather than a partial content: restoring the snapshot again
+// completes it.
+func RestoreSnapshot(store Store, snap *Snapshot) error {
+	if err := snap.validate(); err != nil {
+		return err
+	}
+	if s, ok := store.(Snapshotter); ok {
+		return s.Restore(snap)
+	}
+	leases, err := store.Leases()
+	if err != nil {
+		return err
+	}
+	hosts, err := store.Hosts()
+	if err != nil {
+		return err
+	}
+	keepLeases := make(map[string]bool, len(snap.Leases))
+	for _, l := range snap.Leases {
+		if err := store.PutLease(l); err != nil {
+			return err
+		}
+		keepLeases[l.IP.String()] = true
+	}
+	keepHosts := make(map[string]bool, len(snap.Hosts))
+	for _, h := range snap.Hosts {
+		if err := store.PutHost(h); err != nil {
+			return err
+		}
+		keepHosts[h.Name] = true
+	}
+	for _, l := range leases {
+		if keepLeases[l.IP.String()] {
+			continue
+		}
+		if err := store.DeleteLease(l.IP); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	for _, h := range hosts {
+		if keepHosts[h.Name] {
+			continue
+		}
+		if err := store.DeleteHost(h.Name); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns a snapshot of the store.
+func (s *MemoryStore) Snapshot() (*Snapshot, error) {
+	snap := Snapshot{Version: SnapshotVersion}
+	s.lockAll()
+	s.hostLock.RLock()
+	snap.Created = time.Now()
+	for i := range s.shards {
+		for _, l := range s.shards[i].leases {
+			snap.Leases = append(snap.Leases, copyLease(l))
+		}
+	}
+	for _, h := range s.hosts {
+		snap.Hosts = append(snap.Hosts, copyHost(h))
+	}
+	s.hostLock.RUnlock()
+	s.unlockAll()
+	sortLeases(snap.Leases)
+	sort.Slice(snap.Hosts, func(i, j int) bool {
+		return snap.Hosts[i].Name < snap.Hosts[j].Name
+	})
+	return &snap, nil
+}
+
+// Restore replaces the content of the store with a snapshot.
+func (s *MemoryStore) Restore(snap *Snapshot) error {
+	if err := snap.validate(); err != nil {
+		return err
+	}
+	hosts := make(map[string]*Host, len(snap.Hosts))
+	for _, h := range snap.Hosts {
+		hosts[h.Name] = copyHost(h)
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	s.hostLock.Lock()
+	defer s.hostLock.Unlock()
+	for i := range s.shards {
+		s.shards[i].reset()
+	}
+	for _, l := range snap.Leases {
+		key := l.IP.String()
+		s.shard(key).put(key, l)
+	}
+	s.hosts = hosts
+	return nil
+}
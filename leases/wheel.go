@@ -0,0 +1,85 @@
+package leases
+
+import (
+	"time"
+)
+
+// wheelTick is the granularity of the expiry wheel.
+const wheelTick = time.Minute
+
+// expiryWheel indexes the leases by expiry time, in buckets of wheelTick, so
+// that the expired leases are found without scanning the whole store. It is
+// guarded by the lock of its shard.
+type expiryWheel struct {
+	buckets map[int64]map[string]struct{}
+	// first is at most the lowest non-empty bucket.
+	first int64
+}
+
+func newExpiryWheel() *expiryWheel {
+	return &expiryWheel{buckets: make(map[int64]map[string]struct{})}
+}
+
+func wheelBucket(t time.Time) int64 {
+	return t.Unix() / int64(wheelTick/time.Second)
+}
+
+// add indexes a key by expiry time. Leases that never expire are not indexed.
+func (w *expiryWheel) add(key string, ends time.Time) {
+	if ends.IsZero() {
+		return
+	}
+	b := wheelBucket(ends)
+	bucket, ok := w.buckets[b]
+	if !ok {
+		bucket = make(map[string]struct{})
+		w.buckets[b] = bucket
+		if len(w.buckets) == 1 || b < w.first {
+			w.first = b
+		}
+	}
+	bucket[key] = struct{}{}
+}
+
+// remove removes a key indexed with the given expiry time.
+func (w *expiryWheel) remove(key string, ends time.Time) {
+	if ends.IsZero() {
+		return
+	}
+	b := wheelBucket(ends)
+	if bucket, ok := w.buckets[b]; ok {
+		delete(bucket, key)
+		if len(bucket) == 0 {
+			delete(w.buckets, b)
+		}
+	}
+}
+
+// before returns the keys indexed in the buckets up to the one of the given
+// time, which includes keys expiring slightly after it.
+func (w *expiryWheel) before(t time.Time) []string {
+	limit := wheelBucket(t)
+	var keys []string
+	collect := func(b int64) {
+		for key := range w.buckets[b] {
+			keys = append(keys, key)
+		}
+	}
+	if limit-w.first > int64(len(w.buckets)) {
+		// sparse wheel: walking the buckets is cheaper than the ticks
+		for b := range w.buckets {
+			if b <= limit {
+				collect(b)
+			}
+		}
+		return keys
+	}
+	for b := w.first; b <= limit; b++ {
+		collect(b)
+	}
+	// skip the empty buckets at the start of the wheel
+	for w.first < limit && len(w.buckets[w.first]) == 0 {
+		w.first++
+	}
+	return keys
+}
@@ -0,0 +1,79 @@
+package coredhcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// maxPacketSize is the size of the receive buffer of the listeners, the
+// largest UDP payload.
+const maxPacketSize = 65535
+
+// packetHandler handles a packet received on a listener, as received.
+type packetHandler func(conn net.PacketConn, peer net.Addr, packet []byte)
+
+// listener is a UDP listener of the server. It reads the packets itself,
+// rather than with the servers of the dhcpv6 and dhcpv4 packages, so that the
+// handlers get the packets as received, e.g. to check their authentication or
+// to quarantine the malformed ones.
+type listener struct {
+	conn *net.UDPConn
+}
+
+// listen returns a listener on a UDP address, of the network "udp6" or
+// "udp4".
+func listen(network string, addr *net.UDPAddr) (*listener, error) {
+	conn, err := net.ListenUDP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{conn: conn}, nil
+}
+
+// serve reads the packets of the listener, and runs a handler for each in its
+// own goroutine, until the listener is closed or fails.
+func (l *listener) serve(handle packetHandler) error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, peer, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("Error reading from %v: %v", l.conn.LocalAddr(), err)
+				continue
+			}
+			return err
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		go handle(l.conn, peer, packet)
+	}
+}
+
+// Close closes the listener, which makes serve return.
+func (l *listener) Close() error {
+	return l.conn.Close()
+}
+
+// handlePacket6 parses a DHCPv6 packet and serves it. The packets that
+// cannot be parsed are quarantined as received.
+func (s *Server) handlePacket6(conn net.PacketConn, peer net.Addr, packet []byte) {
+	req, err := dhcpv6.FromBytes(packet)
+	if err != nil {
+		s.quarantine(context.Background(), "6", conn, peer, rejectMalformed, packet)
+		return
+	}
+	s.serve6(conn, peer, req, packet)
+}
+
+// handlePacket4 is like handlePacket6, for DHCPv4.
+func (s *Server) handlePacket4(conn net.PacketConn, peer net.Addr, packet []byte) {
+	req, err := dhcpv4.FromBytes(packet)
+	if err != nil {
+		s.quarantine(context.Background(), "4", conn, peer, rejectMalformed, packet)
+		return
+	}
+	s.serve4(conn, peer, req, packet)
+}
@@ -0,0 +1,49 @@
+package logger
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of the context carrying the correlation ID
+// of a transaction.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, or an empty
+// string.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+type labelsKey struct{}
+
+// WithLabels returns a copy of the context carrying the labels of the pool of
+// a transaction, which override the labels of the server in its log entries.
+func WithLabels(ctx context.Context, labels map[string]string) context.Context {
+	return context.WithValue(ctx, labelsKey{}, labels)
+}
+
+// FromContext returns a log entry of the global logger that includes the
+// correlation ID and the labels carried by the context, if any. Use it to log
+// anything related to the processing of a request, so that the log lines of
+// concurrent transactions can be told apart.
+func FromContext(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(GetLogger())
+	if labels, _ := ctx.Value(labelsKey{}).(map[string]string); len(labels) > 0 {
+		fields := make(logrus.Fields, len(labels))
+		for k, v := range labels {
+			fields[k] = v
+		}
+		entry = entry.WithFields(fields)
+	}
+	if id := CorrelationID(ctx); id != "" {
+		entry = entry.WithField("cid", id)
+	}
+	return entry
+}
@@ -0,0 +1,57 @@
+//go:build windows
+// +build windows
+
+package logger
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the identifier of all the events, whose text is the log entry.
+const eventID = 1
+
+// EventLogHook is a logrus hook that writes every log entry to the Windows
+// event log, e.g. when the server runs as a service, without a console.
+type EventLogHook struct {
+	log *eventlog.Log
+}
+
+// NewEventLogHook returns an EventLogHook writing the events of a source,
+// which must be registered, see eventlog.InstallAsEventCreate.
+func NewEventLogHook(source string) (*EventLogHook, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("logger: cannot open the event log of `%s`: %v", source, err)
+	}
+	return &EventLogHook{log: l}, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *EventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *EventLogHook) Fire(e *logrus.Entry) error {
+	msg := e.Message
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, e.Data[k])
+	}
+	switch e.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.log.Error(eventID, msg)
+	case logrus.WarnLevel:
+		return h.log.Warning(eventID, msg)
+	default:
+		return h.log.Info(eventID, msg)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
@@ -20,7 +21,64 @@ func GetLogger() *logrus.Logger {
 		logger.SetFormatter(&logrus.TextFormatter{
 			FullTimestamp: true,
 		})
+		// first, so that the other hooks see the labels
+		logger.AddHook(labels)
 		globalLogger = logger
 	}
 	return globalLogger
 }
+
+// SetRotatingFile makes the global logger write to the specified file instead
+// of the standard error, rotating it when it reaches maxSize megabytes. Rotated
+// files older than maxAge days are removed, and at most maxBackups of them are
+// kept. Zero values disable the respective limit, except maxSize which
+// defaults to 100 megabytes.
+func SetRotatingFile(path string, maxSize, maxAge, maxBackups int, compress bool) {
+	GetLogger().SetOutput(&lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+		Compress:   compress,
+	})
+}
+
+// labelHook adds the labels of the server to all the log entries.
+type labelHook struct {
+	lock   sync.RWMutex
+	fields logrus.Fields
+}
+
+var labels = &labelHook{}
+
+// Levels implements logrus.Hook.
+func (h *labelHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *labelHook) Fire(e *logrus.Entry) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if e.Data == nil && len(h.fields) > 0 {
+		e.Data = make(logrus.Fields, len(h.fields))
+	}
+	for k, v := range h.fields {
+		if _, ok := e.Data[k]; !ok {
+			e.Data[k] = v
+		}
+	}
+	return nil
+}
+
+// SetLabels sets the fields added to all the entries of the global logger,
+// e.g. the site of the server, unless an entry has a field with the same key.
+func SetLabels(l map[string]string) {
+	fields := make(logrus.Fields, len(l))
+	for k, v := range l {
+		fields[k] = v
+	}
+	labels.lock.Lock()
+	labels.fields = fields
+	labels.lock.Unlock()
+}
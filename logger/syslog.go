@@ -0,0 +1,210 @@
+package logger
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SyslogFacilities maps the syslog facility names to their codes, as defined
+// in RFC 5424.
+var SyslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// syslogSeverity maps logrus levels to syslog severities.
+var syslogSeverity = map[logrus.Level]int{
+	logrus.PanicLevel: 0,
+	logrus.FatalLevel: 2,
+	logrus.ErrorLevel: 3,
+	logrus.WarnLevel:  4,
+	logrus.InfoLevel:  6,
+	logrus.DebugLevel: 7,
+	logrus.TraceLevel: 7,
+}
+
+// the limits of the syslog hook: the entries waiting to be sent, the time to
+// connect to the collector or to write an entry to it, and the time between
+// the connection attempts while the collector is unreachable.
+const (
+	syslogQueueSize    = 1024
+	syslogTimeout      = 5 * time.Second
+	syslogRetryBackoff = 10 * time.Second
+)
+
+// SyslogHook is a logrus hook that sends every log entry to a local or
+// remote syslog collector, formatted as per RFC 5424. Stream transports (tcp
+// and tls) use octet-counting framing as per RFC 6587.
+//
+// The entries are sent from a goroutine of the hook, so that a slow or dead
+// collector never blocks the logging: they are queued, and dropped when the
+// queue is full or while the collector is unreachable. The number of dropped
+// entries is sent once the collector is reachable again.
+type SyslogHook struct {
+	// Network is one of udp, tcp, tls, unix or unixgram.
+	Network   string
+	Address   string
+	Facility  int
+	TLSConfig *tls.Config
+
+	hostname string
+	appName  string
+	queue    chan []byte
+	// dropped counts the entries dropped since the last one sent, and is
+	// accessed atomically.
+	dropped uint64
+	// conn and retryAt, the time of the next connection attempt, are only
+	// used by the goroutine of the hook.
+	conn    net.Conn
+	retryAt time.Time
+}
+
+// NewSyslogHook returns a SyslogHook for the given transport and facility
+// name. The connection is established lazily, and re-established after write
+// errors.
+func NewSyslogHook(network, address, facility string, tlsConfig *tls.Config) (*SyslogHook, error) {
+	code, ok := SyslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("logger: unknown syslog facility `%s`", facility)
+	}
+	switch network {
+	case "udp", "tcp", "tls", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("logger: unsupported syslog transport `%s`", network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	h := SyslogHook{
+		Network:   network,
+		Address:   address,
+		Facility:  code,
+		TLSConfig: tlsConfig,
+		hostname:  hostname,
+		appName:   filepath.Base(os.Args[0]),
+		queue:     make(chan []byte, syslogQueueSize),
+	}
+	go h.run()
+	return &h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *SyslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *SyslogHook) format(e *logrus.Entry) []byte {
+	sev, ok := syslogSeverity[e.Level]
+	if !ok {
+		sev = 6
+	}
+	return h.line(sev, e.Time, e.Message, e.Data)
+}
+
+// line returns an RFC 5424 line, with the fields appended to the message.
+func (h *SyslogHook) line(sev int, t time.Time, msg string, data logrus.Fields) []byte {
+	if len(data) > 0 {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msg += fmt.Sprintf(" %s=%v", k, data[k])
+		}
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		h.Facility*8+sev, t.Format(time.RFC3339Nano), h.hostname, h.appName, os.Getpid(), msg)
+	if h.Network == "tcp" || h.Network == "tls" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	return []byte(line)
+}
+
+func (h *SyslogHook) dial() (net.Conn, error) {
+	dialer := net.Dialer{Timeout: syslogTimeout}
+	if h.Network == "tls" {
+		return tls.DialWithDialer(&dialer, "tcp", h.Address, h.TLSConfig)
+	}
+	return dialer.Dial(h.Network, h.Address)
+}
+
+// Fire implements logrus.Hook. It queues the entry, or drops it if the queue
+// is full.
+func (h *SyslogHook) Fire(e *logrus.Entry) error {
+	select {
+	case h.queue <- h.format(e):
+	default:
+		atomic.AddUint64(&h.dropped, 1)
+	}
+	return nil
+}
+
+// run sends the queued entries, forever.
+func (h *SyslogHook) run() {
+	for msg := range h.queue {
+		if !h.send(msg) {
+			atomic.AddUint64(&h.dropped, 1)
+			continue
+		}
+		if n := atomic.SwapUint64(&h.dropped, 0); n > 0 {
+			h.send(h.line(syslogSeverity[logrus.WarnLevel], time.Now(), fmt.Sprintf("logger: dropped %d log entries", n), nil))
+		}
+	}
+}
+
+// send writes an entry to the collector, connecting first if needed, and
+// returns whether it was sent. While the collector is unreachable, the
+// connection is attempted at most once per syslogRetryBackoff.
+func (h *SyslogHook) send(msg []byte) bool {
+	// try twice, reconnecting if the first write fails
+	for i := 0; i < 2; i++ {
+		if h.conn == nil {
+			if time.Now().Before(h.retryAt) {
+				return false
+			}
+			conn, err := h.dial()
+			if err != nil {
+				h.retryAt = time.Now().Add(syslogRetryBackoff)
+				return false
+			}
+			h.conn = conn
+		}
+		h.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := h.conn.Write(msg); err == nil {
+			return true
+		}
+		h.conn.Close()
+		h.conn = nil
+	}
+	return false
+}
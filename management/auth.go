@@ -0,0 +1,180 @@
+package management
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is the level of access of a principal.
+type Role int
+
+// The roles, by increasing access: RoleNone is for the public endpoints,
+// e.g. the health checks, RoleReader can read, and RoleAdmin can also
+// change the state of the server.
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleAdmin
+)
+
+// ParseRole parses the name of a role, `read-only` or `admin`.
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "read-only":
+		return RoleReader, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleNone, fmt.Errorf("unknown role `%s`, must be read-only or admin", name)
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleReader:
+		return "read-only"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// Principal is an authenticated client of the management API.
+type Principal struct {
+	Name string
+	Role Role
+}
+
+// Authorizer authenticates the requests to the management listeners. It
+// returns the principal of a request, nil if the request carries no
+// credentials it knows of, or an error if its credentials are invalid.
+type Authorizer interface {
+	Authorize(r *http.Request) (*Principal, error)
+}
+
+// ErrInvalidCredentials is returned by the authorizers for credentials they
+// do not accept.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// TokenAuthorizer authenticates the requests by bearer token, in the
+// `Authorization: Bearer <token>` header.
+type TokenAuthorizer struct {
+	tokens map[string]*Principal
+}
+
+// NewTokenAuthorizer returns an authorizer accepting the given tokens.
+func NewTokenAuthorizer(tokens map[string]*Principal) *TokenAuthorizer {
+	return &TokenAuthorizer{tokens: tokens}
+}
+
+// Authorize implements Authorizer.
+func (a *TokenAuthorizer) Authorize(r *http.Request) (*Principal, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+	token := []byte(strings.TrimPrefix(h, "Bearer "))
+	// compare with all the tokens in constant time, not to leak them
+	var found *Principal
+	for t, p := range a.tokens {
+		if subtle.ConstantTimeCompare(token, []byte(t)) == 1 {
+			found = p
+		}
+	}
+	if found == nil {
+		return nil, ErrInvalidCredentials
+	}
+	return found, nil
+}
+
+// CertAuthorizer authenticates the requests by the common name of their
+// client certificate, verified by the TLS listener.
+type CertAuthorizer struct {
+	clients map[string]*Principal
+}
+
+// NewCertAuthorizer returns an authorizer mapping the common names of the
+// client certificates to principals.
+func NewCertAuthorizer(clients map[string]*Principal) *CertAuthorizer {
+	return &CertAuthorizer{clients: clients}
+}
+
+// Authorize implements Authorizer.
+func (a *CertAuthorizer) Authorize(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if p, ok := a.clients[cn]; ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown client certificate `%s`", cn)
+}
+
+// Authorizers tries a list of authorizers in order, and returns the principal
+// of the first one that knows of the credentials of a request.
+type Authorizers []Authorizer
+
+// Authorize implements Authorizer.
+func (as Authorizers) Authorize(r *http.Request) (*Principal, error) {
+	for _, a := range as {
+		p, err := a.Authorize(r)
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+// MethodRole is the default role required by a request: RoleReader for the
+// methods that do not change anything, and RoleAdmin for the others.
+func MethodRole(r *http.Request) Role {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return RoleReader
+	}
+	return RoleAdmin
+}
+
+// Authorize checks that a request is made by a principal with at least the
+// given role, and writes an error response if it is not. Without authorizer,
+// all the requests are allowed.
+func Authorize(auth Authorizer, w http.ResponseWriter, r *http.Request, role Role) bool {
+	_, ok := authorize(auth, w, r, role)
+	return ok
+}
+
+// authorize is like Authorize, and also returns the principal of the request,
+// which is nil if no authentication is required.
+func authorize(auth Authorizer, w http.ResponseWriter, r *http.Request, role Role) (*Principal, bool) {
+	if auth == nil || role == RoleNone {
+		return nil, true
+	}
+	p, err := auth.Authorize(r)
+	switch {
+	case err != nil:
+		log.Printf("management: rejected request from %s to %s: %v", r.RemoteAddr, r.URL.Path, err)
+		WriteError(w, http.StatusUnauthorized, ErrInvalidCredentials)
+		return nil, false
+	case p == nil:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="coredhcp"`)
+		WriteError(w, http.StatusUnauthorized, errors.New("authentication required"))
+		return nil, false
+	case p.Role < role:
+		log.Printf("management: denied %s %s to %s, which is %s", r.Method, r.URL.Path, p.Name, p.Role)
+		WriteError(w, http.StatusForbidden, fmt.Errorf("%s access required", role))
+		return nil, false
+	}
+	return p, true
+}
+
+type principalKey struct{}
+
+// RequestPrincipal returns the principal of a request authorized by the
+// management server, or nil if it was not authenticated.
+func RequestPrincipal(r *http.Request) *Principal {
+	p, _ := r.Context().Value(principalKey{}).(*Principal)
+	return p
+}
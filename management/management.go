@@ -0,0 +1,175 @@
+// Package management implements the HTTP listener used to supervise and
+// manage a running CoreDHCP server. Other packages register their endpoints
+// on it with Handle.
+package management
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+// Server is the management HTTP server.
+type Server struct {
+	Addr string
+	// TLS, if not nil, is the configuration of the TLS listener, which
+	// verifies the client certificates if it has a ClientCAs pool.
+	TLS *tls.Config
+	// Auth, if not nil, authenticates the requests, which need the role
+	// set with Require for their path, or else the MethodRole.
+	Auth Authorizer
+	// OnAction, if not nil, records the administrative actions that the
+	// handlers report with RecordAction, e.g. in the audit log.
+	OnAction func(*Action)
+	mux      *http.ServeMux
+	srv      *http.Server
+
+	lock  sync.RWMutex
+	roles map[string]Role
+}
+
+// NewServer returns a management Server that will listen on the specified
+// address once started.
+func NewServer(addr string) *Server {
+	s := Server{
+		Addr:  addr,
+		mux:   http.NewServeMux(),
+		roles: make(map[string]Role),
+	}
+	s.srv = &http.Server{
+		Addr:         addr,
+		Handler:      &s,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+	}
+	return &s
+}
+
+// Require sets the role required by the requests to a path, instead of the
+// MethodRole, e.g. RoleNone for the public endpoints.
+func (s *Server) Require(path string, role Role) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.roles[path] = role
+}
+
+// ServeHTTP authorizes the requests, and serves them with the registered
+// handlers.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.RLock()
+	role, ok := s.roles[r.URL.Path]
+	s.lock.RUnlock()
+	if !ok {
+		role = MethodRole(r)
+	}
+	p, ok := authorize(s.Auth, w, r, role)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	if p != nil {
+		ctx = context.WithValue(ctx, principalKey{}, p)
+	}
+	if s.OnAction != nil {
+		ctx = context.WithValue(ctx, actionKey{}, s.OnAction)
+	}
+	s.mux.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// Action is an administrative action taken through the management server,
+// e.g. putting the server in maintenance.
+type Action struct {
+	Action string
+	// Principal is the authenticated client that took the action, if any.
+	Principal string
+	Plugin    string
+	Reason    string
+}
+
+type actionKey struct{}
+
+// RecordAction reports an action taken by a request to the OnAction function
+// of the management server, if any, with the principal of the request.
+func RecordAction(r *http.Request, a Action) {
+	record, ok := r.Context().Value(actionKey{}).(func(*Action))
+	if !ok {
+		return
+	}
+	if p := RequestPrincipal(r); p != nil {
+		a.Principal = p.Name
+	}
+	record(&a)
+}
+
+// Handle registers the handler for the given pattern, see http.ServeMux.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// HandleFunc registers the handler function for the given pattern, see
+// http.ServeMux.
+func (s *Server) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// Start starts listening, and serves the requests asynchronously. Serving
+// errors are sent to the errors channel.
+func (s *Server) Start(errors chan<- error) error {
+	ln, err := Listen(s.Addr, s.TLS, s.Auth)
+	if err != nil {
+		return err
+	}
+	log.Printf("Starting management listener on %s", ln.Addr())
+	go func() {
+		errors <- s.srv.Serve(ln)
+	}()
+	return nil
+}
+
+// Listen listens on a TCP address, with TLS if the configuration is not nil,
+// and warns about a listener reachable beyond the local host without
+// authentication.
+func Listen(addr string, conf *tls.Config, auth Authorizer) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if a, ok := ln.Addr().(*net.TCPAddr); ok && !a.IP.IsLoopback() && (auth == nil || conf == nil) {
+		log.Printf("management: WARNING: %s is reachable beyond the local host without TLS and authentication", ln.Addr())
+	}
+	if conf != nil {
+		ln = tls.NewListener(ln, conf)
+	}
+	return ln, nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// WriteJSON writes the JSON encoding of v as response, with the given HTTP
+// status code.
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("management: failed to write response: %v", err)
+	}
+}
+
+// WriteError writes an error response as JSON, with the given HTTP status
+// code.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	WriteJSON(w, status, map[string]string{"error": err.Error()})
+}
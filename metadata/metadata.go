@@ -0,0 +1,71 @@
+// Package metadata holds the labels of the servers, shared networks and
+// subnets of the running configuration, e.g. their site, rack or zone, so
+// that the metrics, the logs and the events of a fleet can be sliced by them
+// without an external enrichment.
+package metadata
+
+import (
+	"net"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/stats"
+)
+
+var (
+	lock             sync.RWMutex
+	server6, server4 *config.ServerConfig
+)
+
+// Set sets the labels from the server configurations, which can be nil. The
+// labels of both servers, the DHCPv4 ones taking precedence, are attached to
+// all the metrics of the Default registry and to all the log entries, and
+// the ones of the pools, see Of, to the metrics and the log entries of their
+// clients.
+func Set(s6, s4 *config.ServerConfig) {
+	lock.Lock()
+	server6, server4 = s6, s4
+	lock.Unlock()
+	labels := Server()
+	stats.Default.SetConstLabels(labels.Pairs()...)
+	logger.SetLabels(labels)
+}
+
+// Server returns the labels of both servers, the DHCPv4 ones taking
+// precedence.
+func Server() config.Labels {
+	lock.RLock()
+	defer lock.RUnlock()
+	labels := config.Labels{}
+	for _, sc := range []*config.ServerConfig{server6, server4} {
+		if sc != nil {
+			labels = sc.Labels.Inherit(labels)
+		}
+	}
+	return labels
+}
+
+// Of returns the labels of an address: the ones of the server of its family,
+// overridden by the ones of its shared network and subnet.
+func Of(ip net.IP) config.Labels {
+	return OfServer(ip.To4() == nil, ip)
+}
+
+// OfServer is like Of, for an address of the DHCPv6 server if v6 is true, or
+// else of the DHCPv4 server, which can be nil.
+func OfServer(v6 bool, ip net.IP) config.Labels {
+	lock.RLock()
+	defer lock.RUnlock()
+	sc := server4
+	if v6 {
+		sc = server6
+	}
+	if sc == nil {
+		return config.Labels{}
+	}
+	if ip == nil {
+		return config.Labels{}.Inherit(sc.Labels)
+	}
+	return sc.LabelsOf(ip)
+}
@@ -0,0 +1,303 @@
+package omapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// hardware types, as in ARP
+const (
+	hwTypeEthernet = 1
+)
+
+// lease states, as in ISC dhcpd
+const (
+	stateActive  = 2
+	stateExpired = 3
+)
+
+func uint32Value(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// boolValue interprets a boolean value, which clients send as a 4 or 1 byte
+// integer.
+func boolValue(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func ipValue(b []byte) (net.IP, error) {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return nil, fmt.Errorf("invalid address of %d bytes", len(b))
+	}
+	return net.IP(b), nil
+}
+
+func timeValue(b []byte) (time.Time, error) {
+	if len(b) != 4 {
+		return time.Time{}, errors.New("invalid time value")
+	}
+	return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+}
+
+// lookup finds the object of the given type matching the lookup key in obj:
+// the name, hardware address or reserved address for hosts, and the address
+// or hardware address for leases.
+func (s *Server) lookup(typ string, obj map[string][]byte) (*object, error) {
+	switch typ {
+	case "host":
+		var (
+			host *leases.Host
+			err  error
+		)
+		if name, ok := obj["name"]; ok {
+			host, err = s.Store.Host(string(name))
+		} else if hwaddr, ok := obj["hardware-address"]; ok {
+			host, err = s.Store.HostByHWAddr(net.HardwareAddr(hwaddr))
+		} else if value, ok := obj["ip-address"]; ok {
+			var ip net.IP
+			if ip, err = ipValue(value); err == nil {
+				host, err = s.Store.HostByIP(ip)
+			}
+		} else {
+			return nil, errors.New("no lookup key for host")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &object{typ: typ, key: host.Name}, nil
+	case "lease":
+		var (
+			lease *leases.Lease
+			err   error
+		)
+		if value, ok := obj["ip-address"]; ok {
+			var ip net.IP
+			if ip, err = ipValue(value); err == nil {
+				lease, err = s.Store.Lease(ip)
+			}
+		} else if hwaddr, ok := obj["hardware-address"]; ok {
+			lease, err = s.Store.LeaseByHWAddr(net.HardwareAddr(hwaddr))
+		} else {
+			return nil, errors.New("no lookup key for lease")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &object{typ: typ, key: lease.IP.String()}, nil
+	}
+	return nil, fmt.Errorf("unsupported object type `%s`", typ)
+}
+
+// create creates an object from the attributes in obj. Hosts without a name,
+// as created by some clients, are named after their hardware address.
+func (s *Server) create(typ string, obj map[string][]byte) (*object, error) {
+	switch typ {
+	case "host":
+		var host leases.Host
+		if err := applyHost(&host, obj); err != nil {
+			return nil, err
+		}
+		if host.Name == "" {
+			if host.HWAddr == nil {
+				return nil, errors.New("a host needs a name or a hardware address")
+			}
+			host.Name = "omapi-" + strings.Replace(host.HWAddr.String(), ":", "", -1)
+		}
+		if err := s.Store.PutHost(&host); err != nil {
+			return nil, err
+		}
+		log.Printf("omapi: created host %s", host.Name)
+		return &object{typ: typ, key: host.Name}, nil
+	case "lease":
+		lease := leases.Lease{Starts: clock.Now()}
+		if err := applyLease(&lease, obj); err != nil {
+			return nil, err
+		}
+		if lease.IP == nil {
+			return nil, errors.New("a lease needs an address")
+		}
+		if err := s.Store.PutLease(&lease); err != nil {
+			return nil, err
+		}
+		log.Printf("omapi: created lease %s", lease.IP)
+		return &object{typ: typ, key: lease.IP.String()}, nil
+	}
+	return nil, fmt.Errorf("unsupported object type `%s`", typ)
+}
+
+// applyHost sets the attributes of a host from obj.
+func applyHost(host *leases.Host, obj map[string][]byte) error {
+	for name, value := range obj {
+		switch name {
+		case "name":
+			host.Name = string(value)
+		case "hardware-address":
+			host.HWAddr = net.HardwareAddr(value)
+		case "hardware-type":
+			if len(value) != 4 || binary.BigEndian.Uint32(value) != hwTypeEthernet {
+				return errors.New("only ethernet hardware addresses are supported")
+			}
+		case "dhcp-client-identifier":
+			host.ClientID = fmt.Sprintf("%x", value)
+		case "ip-address":
+			ip, err := ipValue(value)
+			if err != nil {
+				return err
+			}
+			host.IP = ip
+		default:
+			return fmt.Errorf("unsupported host attribute `%s`", name)
+		}
+	}
+	return nil
+}
+
+// applyLease sets the attributes of a lease from obj.
+func applyLease(lease *leases.Lease, obj map[string][]byte) error {
+	for name, value := range obj {
+		var err error
+		switch name {
+		case "ip-address":
+			lease.IP, err = ipValue(value)
+		case "hardware-address":
+			lease.HWAddr = net.HardwareAddr(value)
+		case "hardware-type":
+			if len(value) != 4 || binary.BigEndian.Uint32(value) != hwTypeEthernet {
+				err = errors.New("only ethernet hardware addresses are supported")
+			}
+		case "dhcp-client-identifier":
+			lease.ClientID = fmt.Sprintf("%x", value)
+		case "client-hostname":
+			lease.Hostname = string(value)
+		case "starts":
+			lease.Starts, err = timeValue(value)
+		case "ends":
+			lease.Ends, err = timeValue(value)
+		case "state":
+			// the state follows from the end time
+		default:
+			err = fmt.Errorf("unsupported lease attribute `%s`", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// update sets the attributes of an existing object from obj. The lookup key
+// of an object can not be changed.
+func (s *Server) update(o *object, obj map[string][]byte) error {
+	switch o.typ {
+	case "host":
+		host, err := s.Store.Host(o.key)
+		if err != nil {
+			return err
+		}
+		if err := applyHost(host, obj); err != nil {
+			return err
+		}
+		if host.Name != o.key {
+			return errors.New("cannot rename a host")
+		}
+		return s.Store.PutHost(host)
+	case "lease":
+		lease, err := s.Store.Lease(net.ParseIP(o.key))
+		if err != nil {
+			return err
+		}
+		if err := applyLease(lease, obj); err != nil {
+			return err
+		}
+		if lease.IP.String() != o.key {
+			return errors.New("cannot change the address of a lease")
+		}
+		return s.Store.PutLease(lease)
+	}
+	return fmt.Errorf("unsupported object type `%s`", o.typ)
+}
+
+func (s *Server) delete(o *object) error {
+	switch o.typ {
+	case "host":
+		if err := s.Store.DeleteHost(o.key); err != nil {
+			return err
+		}
+		log.Printf("omapi: deleted host %s", o.key)
+		return nil
+	case "lease":
+		if err := s.Store.DeleteLease(net.ParseIP(o.key)); err != nil {
+			return err
+		}
+		log.Printf("omapi: deleted lease %s", o.key)
+		return nil
+	}
+	return fmt.Errorf("unsupported object type `%s`", o.typ)
+}
+
+// values returns the attributes of an object, encoded as ISC dhcpd does.
+func (s *Server) values(o *object) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	switch o.typ {
+	case "host":
+		host, err := s.Store.Host(o.key)
+		if err != nil {
+			return nil, err
+		}
+		values["name"] = []byte(host.Name)
+		if host.HWAddr != nil {
+			values["hardware-address"] = host.HWAddr
+			values["hardware-type"] = uint32Value(hwTypeEthernet)
+		}
+		if host.IP != nil {
+			values["ip-address"] = ipBytes(host.IP)
+		}
+	case "lease":
+		lease, err := s.Store.Lease(net.ParseIP(o.key))
+		if err != nil {
+			return nil, err
+		}
+		values["ip-address"] = ipBytes(lease.IP)
+		if lease.HWAddr != nil {
+			values["hardware-address"] = lease.HWAddr
+			values["hardware-type"] = uint32Value(hwTypeEthernet)
+		}
+		if lease.Hostname != "" {
+			values["client-hostname"] = []byte(lease.Hostname)
+		}
+		values["starts"] = uint32Value(uint32(lease.Starts.Unix()))
+		state := uint32(stateActive)
+		if !lease.Ends.IsZero() {
+			values["ends"] = uint32Value(uint32(lease.Ends.Unix()))
+			if lease.Expired(clock.Now()) {
+				state = stateExpired
+			}
+		}
+		values["state"] = uint32Value(state)
+	default:
+		return nil, fmt.Errorf("unsupported object type `%s`", o.typ)
+	}
+	return values, nil
+}
+
+func ipBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
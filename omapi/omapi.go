@@ -0,0 +1,434 @@
+// Package omapi implements enough of ISC's Object Management API (OMAPI) to
+// look up, create and delete host and lease objects in the lease store, so that
+// tools written against ISC dhcpd, like omshell or pypureomapi, keep working.
+package omapi
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+const (
+	protocolVersion = 100
+	headerSize      = 24
+	// maxValueLen bounds the size of a single value, and maxMessageLen the
+	// size of a whole message, to protect from malicious clients.
+	maxValueLen   = 64 * 1024
+	maxMessageLen = 256 * 1024
+)
+
+// OMAPI operations
+const (
+	opOpen    = 1
+	opRefresh = 2
+	opUpdate  = 3
+	opNotify  = 4
+	opStatus  = 5
+	opDelete  = 6
+)
+
+// Result codes, as defined by ISC's libisc. Clients mostly only tell success
+// from failure, and display the message.
+const (
+	resultSuccess    = 0
+	resultNoPerm     = 6
+	resultExists     = 18
+	resultNotFound   = 23
+	resultFailure    = 25
+	resultNotImpl    = 27
+	resultUnexpected = 34
+)
+
+// Key is a TSIG-style shared key, used to authenticate OMAPI clients with
+// HMAC-MD5.
+type Key struct {
+	Name   string
+	Secret []byte
+}
+
+const algorithmHMACMD5 = "hmac-md5.SIG-ALG.REG.INT."
+
+// Server is an OMAPI server operating on a lease store.
+type Server struct {
+	Addr  string
+	Store leases.Store
+	// Key, if not nil, is required to authenticate every request.
+	Key *Key
+
+	lock     sync.Mutex
+	listener net.Listener
+}
+
+// NewServer returns an OMAPI Server, that will listen on the specified address
+// once started.
+func NewServer(addr string, store leases.Store, key *Key) *Server {
+	return &Server{Addr: addr, Store: store, Key: key}
+}
+
+// Start starts listening, and serves the connections asynchronously.
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = ln
+	s.lock.Unlock()
+	log.Printf("Starting OMAPI listener on %s", ln.Addr())
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("omapi: stopped accepting connections: %v", err)
+				return
+			}
+			go s.serveConn(conn)
+		}
+	}()
+	return nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// message is an OMAPI message. Values are kept as raw bytes, and interpreted
+// according to the object type.
+type message struct {
+	authID    uint32
+	op        uint32
+	handle    uint32
+	id        uint32
+	rid       uint32
+	msg       map[string][]byte
+	obj       map[string][]byte
+	signature []byte
+	// signed holds the bytes covered by the signature of a received
+	// message, as the dictionaries can not be re-encoded in the same order.
+	signed []byte
+}
+
+// encodeSigned returns the part of the wire format of a message covered by
+// the signature, i.e. all but the authenticator id and the signature itself.
+// sigLen is the length of the signature.
+func (m *message) encodeSigned(sigLen int) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(sigLen))
+	for _, v := range []uint32{m.op, m.handle, m.id, m.rid} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	for _, dict := range []map[string][]byte{m.msg, m.obj} {
+		names := make([]string, 0, len(dict))
+		for name := range dict {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+			buf.WriteString(name)
+			binary.Write(&buf, binary.BigEndian, uint32(len(dict[name])))
+			buf.Write(dict[name])
+		}
+		buf.Write([]byte{0, 0})
+	}
+	return buf.Bytes()
+}
+
+// conn is the state of a client connection.
+type conn struct {
+	s *Server
+	r *bufio.Reader
+	w io.Writer
+	// raw holds the bytes of the message being read
+	raw    []byte
+	nextID uint32
+	// authenticated is true once the client opened an authenticator
+	// object with the right key.
+	authenticated bool
+	authHandle    uint32
+	handles       map[uint32]*object
+}
+
+// object is a reference to an object of the store, by its key, so that it
+// can be refreshed, updated or deleted by handle.
+type object struct {
+	typ string
+	// key is the host name, or the lease address
+	key string
+}
+
+func (c *conn) next(n int) ([]byte, error) {
+	if len(c.raw)+n > maxMessageLen {
+		return nil, errors.New("message too large")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	c.raw = append(c.raw, b...)
+	return b, nil
+}
+
+func (c *conn) uint32() (uint32, error) {
+	b, err := c.next(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (c *conn) dict() (map[string][]byte, error) {
+	d := make(map[string][]byte)
+	for {
+		b, err := c.next(2)
+		if err != nil {
+			return nil, err
+		}
+		nameLen := binary.BigEndian.Uint16(b)
+		if nameLen == 0 {
+			return d, nil
+		}
+		name, err := c.next(int(nameLen))
+		if err != nil {
+			return nil, err
+		}
+		valueLen, err := c.uint32()
+		if err != nil {
+			return nil, err
+		}
+		if valueLen > maxValueLen {
+			return nil, fmt.Errorf("value of `%s` too large", name)
+		}
+		value, err := c.next(int(valueLen))
+		if err != nil {
+			return nil, err
+		}
+		d[string(name)] = value
+	}
+}
+
+func (c *conn) readMessage() (*message, error) {
+	var (
+		m       message
+		authLen uint32
+		err     error
+	)
+	c.raw = c.raw[:0]
+	if m.authID, err = c.uint32(); err != nil {
+		return nil, err
+	}
+	// the authenticator id is not signed
+	c.raw = c.raw[:0]
+	for _, v := range []*uint32{&authLen, &m.op, &m.handle, &m.id, &m.rid} {
+		if *v, err = c.uint32(); err != nil {
+			return nil, err
+		}
+	}
+	if m.msg, err = c.dict(); err != nil {
+		return nil, err
+	}
+	if m.obj, err = c.dict(); err != nil {
+		return nil, err
+	}
+	if authLen > maxValueLen {
+		return nil, errors.New("signature too large")
+	}
+	m.signed = append([]byte(nil), c.raw...)
+	if m.signature, err = c.next(int(authLen)); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *Server) sign(data []byte) []byte {
+	mac := hmac.New(md5.New, s.Key.Secret)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (c *conn) send(m *message) error {
+	c.nextID++
+	m.id = c.nextID
+	var buf bytes.Buffer
+	if c.authenticated {
+		binary.Write(&buf, binary.BigEndian, c.authHandle)
+		signed := m.encodeSigned(md5.Size)
+		buf.Write(signed)
+		buf.Write(c.s.sign(signed))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint32(0))
+		buf.Write(m.encodeSigned(0))
+	}
+	_, err := c.w.Write(buf.Bytes())
+	return err
+}
+
+func (c *conn) status(req *message, result uint32, text string) error {
+	resp := message{op: opStatus, rid: req.id, msg: map[string][]byte{"result": uint32Value(result)}, obj: map[string][]byte{}}
+	if text != "" {
+		resp.msg["message"] = []byte(text)
+	}
+	resp.handle = req.handle
+	return c.send(&resp)
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	defer nc.Close()
+	c := conn{s: s, r: bufio.NewReader(nc), w: nc, handles: make(map[uint32]*object)}
+	// startup messages: protocol version and header size
+	var startup [8]byte
+	binary.BigEndian.PutUint32(startup[:], protocolVersion)
+	binary.BigEndian.PutUint32(startup[4:], headerSize)
+	if _, err := nc.Write(startup[:]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c.r, startup[:]); err != nil {
+		return
+	}
+	if binary.BigEndian.Uint32(startup[:]) != protocolVersion || binary.BigEndian.Uint32(startup[4:]) != headerSize {
+		log.Printf("omapi: %s: unsupported protocol version or header size", nc.RemoteAddr())
+		return
+	}
+	for {
+		nc.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		m, err := c.readMessage()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("omapi: %s: %v", nc.RemoteAddr(), err)
+			}
+			return
+		}
+		if err := c.handle(m); err != nil {
+			log.Printf("omapi: %s: %v", nc.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+func (c *conn) handle(m *message) error {
+	if c.s.Key != nil && c.authenticated {
+		if m.authID != c.authHandle || !hmac.Equal(m.signature, c.s.sign(m.signed)) {
+			return c.status(m, resultNoPerm, "invalid signature")
+		}
+	}
+	if m.op == opOpen && string(m.msg["type"]) == "authenticator" {
+		return c.openAuthenticator(m)
+	}
+	if c.s.Key != nil && !c.authenticated {
+		return c.status(m, resultNoPerm, "not authenticated")
+	}
+	switch m.op {
+	case opOpen:
+		return c.open(m)
+	case opRefresh:
+		obj, ok := c.handles[m.handle]
+		if !ok {
+			return c.status(m, resultNotFound, "unknown handle")
+		}
+		return c.reply(m, m.handle, obj)
+	case opUpdate:
+		obj, ok := c.handles[m.handle]
+		if !ok {
+			return c.status(m, resultNotFound, "unknown handle")
+		}
+		if err := c.s.update(obj, m.obj); err != nil {
+			return c.status(m, resultFailure, err.Error())
+		}
+		return c.status(m, resultSuccess, "")
+	case opDelete:
+		obj, ok := c.handles[m.handle]
+		if !ok {
+			return c.status(m, resultNotFound, "unknown handle")
+		}
+		if err := c.s.delete(obj); err != nil {
+			return c.status(m, resultNotFound, err.Error())
+		}
+		delete(c.handles, m.handle)
+		return c.status(m, resultSuccess, "")
+	case opNotify:
+		return c.status(m, resultNotImpl, "notifications are not supported")
+	default:
+		return c.status(m, resultUnexpected, fmt.Sprintf("unexpected operation %d", m.op))
+	}
+}
+
+func (c *conn) openAuthenticator(m *message) error {
+	if c.s.Key == nil {
+		return c.status(m, resultNoPerm, "no key configured")
+	}
+	if string(m.obj["name"]) != c.s.Key.Name || string(m.obj["algorithm"]) != algorithmHMACMD5 {
+		return c.status(m, resultNoPerm, "unknown key")
+	}
+	c.nextID++
+	handle := c.nextID
+	// the reply is not signed yet, the client installs the authenticator
+	// when it receives it
+	resp := message{op: opUpdate, handle: handle, rid: m.id, msg: map[string][]byte{}, obj: map[string][]byte{}}
+	if err := c.send(&resp); err != nil {
+		return err
+	}
+	c.authenticated = true
+	c.authHandle = handle
+	return nil
+}
+
+func (c *conn) reply(req *message, handle uint32, obj *object) error {
+	values, err := c.s.values(obj)
+	if err == leases.ErrNotFound {
+		return c.status(req, resultNotFound, "object not found")
+	} else if err != nil {
+		return c.status(req, resultUnexpected, err.Error())
+	}
+	resp := message{op: opUpdate, handle: handle, rid: req.id, msg: map[string][]byte{}, obj: values}
+	return c.send(&resp)
+}
+
+func (c *conn) open(m *message) error {
+	typ := string(m.msg["type"])
+	if typ != "host" && typ != "lease" {
+		return c.status(m, resultNotImpl, fmt.Sprintf("unsupported object type `%s`", typ))
+	}
+	create, exclusive := boolValue(m.msg["create"]), boolValue(m.msg["exclusive"])
+	obj, err := c.s.lookup(typ, m.obj)
+	switch {
+	case err == leases.ErrNotFound && !create:
+		return c.status(m, resultNotFound, "no object matches the lookup key")
+	case err == leases.ErrNotFound:
+		if obj, err = c.s.create(typ, m.obj); err != nil {
+			return c.status(m, resultFailure, err.Error())
+		}
+	case err != nil:
+		return c.status(m, resultFailure, err.Error())
+	case create && exclusive:
+		return c.status(m, resultExists, "object already exists")
+	case boolValue(m.msg["update"]):
+		if err := c.s.update(obj, m.obj); err != nil {
+			return c.status(m, resultFailure, err.Error())
+		}
+	}
+	c.nextID++
+	handle := c.nextID
+	c.handles[handle] = obj
+	return c.reply(m, handle, obj)
+}
@@ -0,0 +1,102 @@
+package coredhcp
+
+import (
+	"context"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// subnetArgs returns the arguments of a plugin for each subnet of a server
+// configuration that overrides them, directly or through its network. The
+// subnets without overrides of the plugin are left out. The plugins that do
+// not keep their state per instance, see plugins.RegisterOverridable, cannot
+// be overridden.
+func subnetArgs(sc *config.ServerConfig, plugin *config.PluginConfig, p *plugins.Plugin) (map[*config.SubnetConfig][]string, error) {
+	if sc.Options == nil {
+		return nil, nil
+	}
+	ret := make(map[*config.SubnetConfig][]string)
+	for _, n := range sc.Options.Networks {
+		for _, s := range n.Subnets {
+			overrides := s.Plugins.Inherit(n.Plugins)
+			if args, ok := overrides[plugin.Name]; ok {
+				if !p.Overridable {
+					return nil, config.ConfigErrorFromString("%s overrides the plugin `%s`, whose instances share their state", s.Prefix, plugin.Name)
+				}
+				ret[s] = config.MergeArgs(plugin.Args, args)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// overrideHandler6 returns a DHCPv6 handler that runs, for the clients of the
+// subnets that override the arguments of a plugin, an instance of the plugin
+// set up with their arguments, and the default handler for the other clients.
+// The subnet of a client is selected by its link address.
+func overrideHandler6(sc *config.ServerConfig, pc *config.PluginConfig, p *plugins.Plugin, h handler.Handler6) (handler.Handler6, error) {
+	bySubnet := make(map[*config.SubnetConfig]handler.Handler6)
+	overrides, err := subnetArgs(sc, pc, p)
+	if err != nil {
+		return nil, err
+	}
+	for subnet, args := range overrides {
+		log.Printf("Loading plugin `%s` for DHCPv6 with the overrides of %s: %v", pc.Name, subnet.Prefix, args)
+		sh, err := p.Setup6(args...)
+		if err != nil {
+			return nil, config.ConfigErrorFromString("plugin `%s` with the overrides of %s: %v", pc.Name, subnet.Prefix, err)
+		}
+		if sh == nil {
+			return nil, config.ConfigErrorFromString("no DHCPv6 handler for plugin %s with the overrides of %s", pc.Name, subnet.Prefix)
+		}
+		bySubnet[subnet] = sh
+	}
+	if len(bySubnet) == 0 {
+		return h, nil
+	}
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if _, subnet := handler.Subnet(ctx, dhcputil.LinkAddress6(req)); subnet != nil {
+			if sh, ok := bySubnet[subnet]; ok {
+				return sh(ctx, req, resp)
+			}
+		}
+		return h(ctx, req, resp)
+	}, nil
+}
+
+// overrideHandler4 is like overrideHandler6, for DHCPv4. The subnet of a
+// client is selected by its address, or by the address of its link.
+func overrideHandler4(sc *config.ServerConfig, pc *config.PluginConfig, p *plugins.Plugin, h handler.Handler4) (handler.Handler4, error) {
+	bySubnet := make(map[*config.SubnetConfig]handler.Handler4)
+	overrides, err := subnetArgs(sc, pc, p)
+	if err != nil {
+		return nil, err
+	}
+	for subnet, args := range overrides {
+		log.Printf("Loading plugin `%s` for DHCPv4 with the overrides of %s: %v", pc.Name, subnet.Prefix, args)
+		sh, err := p.Setup4(args...)
+		if err != nil {
+			return nil, config.ConfigErrorFromString("plugin `%s` with the overrides of %s: %v", pc.Name, subnet.Prefix, err)
+		}
+		if sh == nil {
+			return nil, config.ConfigErrorFromString("no DHCPv4 handler for plugin %s with the overrides of %s", pc.Name, subnet.Prefix)
+		}
+		bySubnet[subnet] = sh
+	}
+	if len(bySubnet) == 0 {
+		return h, nil
+	}
+	return func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if _, subnet := handler.Subnet(ctx, handler.Address4(ctx, req, resp)); subnet != nil {
+			if sh, ok := bySubnet[subnet]; ok {
+				return sh(ctx, req, resp)
+			}
+		}
+		return h(ctx, req, resp)
+	}, nil
+}
@@ -0,0 +1,190 @@
+// Package pcap writes UDP datagrams to files in the libpcap format, wrapping
+// them in synthetic IP and UDP headers so that they can be inspected with
+// tcpdump or Wireshark.
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// linkTypeRaw is the LINKTYPE_RAW link type: packets start with an IPv4 or
+// IPv6 header.
+const linkTypeRaw = 101
+
+const snapLen = 65535
+
+// RotatingWriter writes packets to a pcap file, and rotates it when it reaches
+// MaxSize bytes, keeping at most MaxFiles old files named `<name>.1`,
+// `<name>.2`, etc. It is safe for concurrent use.
+type RotatingWriter struct {
+	Name     string
+	MaxSize  int64
+	MaxFiles int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewRotatingWriter creates a RotatingWriter and opens its first file,
+// truncating it if it exists.
+func NewRotatingWriter(name string, maxSize int64, maxFiles int) (*RotatingWriter, error) {
+	w := RotatingWriter{Name: name, MaxSize: maxSize, MaxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return &w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.Name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	// global header: magic, version 2.4, GMT offset, accuracy, snaplen,
+	// link type
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return err
+	}
+	w.file = f
+	w.size = int64(len(hdr))
+	return nil
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	for i := w.MaxFiles - 1; i > 0; i-- {
+		// errors are ignored, old files may not exist yet
+		_ = os.Rename(fmt.Sprintf("%s.%d", w.Name, i), fmt.Sprintf("%s.%d", w.Name, i+1))
+	}
+	if w.MaxFiles > 0 {
+		if err := os.Rename(w.Name, w.Name+".1"); err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+// WriteUDP writes a UDP datagram sent from src to dst. Both addresses must
+// be of the same family.
+func (w *RotatingWriter) WriteUDP(ts time.Time, src, dst *net.UDPAddr, payload []byte) error {
+	pkt, err := encapsulate(src, dst, payload)
+	if err != nil {
+		return err
+	}
+	if len(pkt) > snapLen {
+		pkt = pkt[:snapLen]
+	}
+	rec := make([]byte, 16, 16+len(pkt))
+	binary.LittleEndian.PutUint32(rec[0:], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(pkt)))
+	rec = append(rec, pkt...)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return os.ErrClosed
+	}
+	if w.MaxSize > 0 && w.size+int64(len(rec)) > w.MaxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.file.Write(rec)
+	w.size += int64(n)
+	return err
+}
+
+// Close closes the current file.
+func (w *RotatingWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// encapsulate builds an IPv4 or IPv6 packet carrying a UDP datagram.
+func encapsulate(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	udp = append(udp, payload...)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ^checksum(0, ip))
+		pseudo := make([]byte, 12)
+		copy(pseudo, ip[12:20])
+		pseudo[9] = 17
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(udp)))
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+		return append(ip, udp...), nil
+	}
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	if src16 == nil || dst16 == nil || src.IP.To4() != nil || dst.IP.To4() != nil {
+		return nil, fmt.Errorf("pcap: addresses %v and %v are not of the same family", src, dst)
+	}
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], src16)
+	copy(ip[24:], dst16)
+	pseudo := make([]byte, 40)
+	copy(pseudo, ip[8:40])
+	binary.BigEndian.PutUint32(pseudo[32:], uint32(len(udp)))
+	pseudo[39] = 17
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+	return append(ip, udp...), nil
+}
+
+func checksum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return uint16(sum)
+}
+
+func udpChecksum(pseudo, udp []byte) uint16 {
+	sum := uint32(checksum(0, pseudo))
+	cs := ^checksum(sum, udp)
+	if cs == 0 {
+		// RFC 768: a computed checksum of zero is transmitted as all ones
+		cs = 0xffff
+	}
+	return cs
+}
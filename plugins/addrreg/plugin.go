@@ -0,0 +1,320 @@
+package addrreg
+
+// This plugin implements the registration of self-assigned addresses (RFC
+// 9686): SLAAC hosts inform the server of their addresses with an
+// ADDR-REG-INFORM message, and the server records them in the lease store and
+// acknowledges them with an ADDR-REG-REPLY. The plugin also advertises the
+// support of the registration to the clients that request the ADDR-REG-ENABLE
+// option. It should come after the server_id plugin.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - server_id: LL 00:de:ad:be:ef:00
+//	        - addrreg: 2001:db8:1::/64 2001:db8:2::/64 notify=http://inventory.example.org/events
+//
+// The prefixes, if any, restrict the addresses that can be registered. The
+// `notify` argument is a URL to which each registration is POSTed as a JSON
+// event, for inventory systems. Events are sent asynchronously, and dropped
+// if they cannot be delivered.
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dualstack"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metadata"
+	"github.com/coredhcp/coredhcp/plugins"
+	serverid "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Address registration message types and options (RFC 9686)
+const (
+	MessageTypeAddrRegInform dhcpv6.MessageType = 36
+	MessageTypeAddrRegReply  dhcpv6.MessageType = 37
+	OptionAddrRegEnable      dhcpv6.OptionCode  = 148
+)
+
+func init() {
+	plugins.RegisterPlugin("addrreg", setupAddrReg6, nil)
+	plugins.RegisterConstraints("addrreg", plugins.Constraints{After: []string{"server_id"}})
+	plugins.RegisterOverridable("addrreg")
+	plugins.RegisterCommit("addrreg", commit, discard)
+}
+
+// Event is the notification of a registration.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Address string    `json:"address"`
+	DUID    string    `json:"duid"`
+	HWAddr  string    `json:"hw-address,omitempty"`
+	// ValidLifetime is in seconds.
+	ValidLifetime uint32 `json:"valid-lifetime"`
+	// Host is the identity of the client in both protocols, if the
+	// dualstack plugin correlated it.
+	Host *dualstack.Host `json:"host,omitempty"`
+	// Labels are the labels of the server and of the pool of the address.
+	Labels config.Labels `json:"labels,omitempty"`
+}
+
+// notifier POSTs the events to a URL.
+type notifier struct {
+	url    string
+	client *http.Client
+	queue  chan *Event
+	// done is closed to stop the notifier.
+	done chan struct{}
+}
+
+// notifiers holds the running notifiers by URL, so that reloading the
+// configuration does not start a new one. pending holds the notifiers used by the configuration being loaded,
+// which are started, and the others stopped, when it is committed.
+var (
+	notifiersLock sync.Mutex
+	notifiers     = make(map[string]*notifier)
+	pending       = make(map[string]*notifier)
+)
+
+func getNotifier(url string) *notifier {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	n, ok := notifiers[url]
+	if !ok {
+		n, ok = pending[url]
+	}
+	if !ok {
+		n = &notifier{
+			url:    url,
+			client: &http.Client{Timeout: 10 * time.Second},
+			queue:  make(chan *Event, 1000),
+			done:   make(chan struct{}),
+		}
+	}
+	pending[url] = n
+	return n
+}
+
+// commit starts the notifiers of the committed configuration, and stops the
+// others.
+func commit(loaded bool) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	if !loaded {
+		pending = make(map[string]*notifier)
+	}
+	for url, n := range notifiers {
+		if _, ok := pending[url]; !ok {
+			close(n.done)
+			delete(notifiers, url)
+		}
+	}
+	for url, n := range pending {
+		if _, ok := notifiers[url]; !ok {
+			notifiers[url] = n
+			go n.run()
+		}
+	}
+	pending = make(map[string]*notifier)
+}
+
+// discard drops the notifiers of a configuration that was not committed.
+func discard() {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	pending = make(map[string]*notifier)
+}
+
+func (n *notifier) notify(ev *Event) {
+	select {
+	case n.queue <- ev:
+	default:
+		log.Printf("plugins/addrreg: event queue full, dropping the registration of %s", ev.Address)
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		var ev *Event
+		select {
+		case ev = <-n.queue:
+		case <-n.done:
+			return
+		}
+		if err := n.send(ev); err != nil {
+			log.Printf("plugins/addrreg: failed to notify the registration of %s: %v", ev.Address, err)
+		}
+	}
+}
+
+func (n *notifier) send(ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// registrar records the registrations of the clients.
+type registrar struct {
+	prefixes []*net.IPNet
+	notifier *notifier
+}
+
+func setupAddrReg6(args ...string) (handler.Handler6, error) {
+	var r registrar
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "notify=") {
+			r.notifier = getNotifier(strings.TrimPrefix(arg, "notify="))
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(arg)
+		if err != nil || prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("plugins/addrreg: invalid prefix `%s`", arg)
+		}
+		r.prefixes = append(r.prefixes, prefix)
+	}
+	log.Printf("plugins/addrreg: accepting registrations in %d prefix(es)", len(r.prefixes))
+	return r.Handler6, nil
+}
+
+// allowed returns whether an address can be registered.
+func (r *registrar) allowed(ip net.IP) bool {
+	if len(r.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range r.prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler6 answers the ADDR-REG-INFORM messages, and advertises the support
+// of the registration in the other responses.
+func (r *registrar) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	if msg.Type() != MessageTypeAddrRegInform {
+		if resp != nil && dhcputil.Requested6(msg, OptionAddrRegEnable) {
+			resp.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionAddrRegEnable})
+		}
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	reply, err := r.register(ctx, req, msg)
+	if err != nil {
+		log.Printf("plugins/addrreg: dropping registration: %v", err)
+		return nil, true
+	}
+	if req.IsRelay() {
+		if reply, err = dhcpv6.NewRelayReplFromRelayForw(req, reply); err != nil {
+			log.Printf("plugins/addrreg: cannot relay the reply: %v", err)
+			return nil, true
+		}
+	}
+	return reply, true
+}
+
+// register validates and records a registration, and returns the reply.
+func (r *registrar) register(ctx context.Context, req, msg dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return nil, errors.New("no client identifier")
+	}
+	if msg.GetOneOption(dhcpv6.OptionServerID) != nil {
+		return nil, errors.New("unexpected server identifier")
+	}
+	iaaddr, ok := msg.GetOneOption(dhcpv6.OptionIAAddr).(*dhcpv6.OptIAAddress)
+	if !ok || len(msg.GetOption(dhcpv6.OptionIAAddr)) != 1 {
+		return nil, errors.New("need exactly one IA Address option")
+	}
+	ip := iaaddr.IPv6Addr
+	// the address being registered must be the source address of the
+	// message, as seen by the relay or by the server
+	source := dhcputil.PeerAddress6(req)
+	if source == nil {
+		if peer, ok := handler.Peer(ctx).(*net.UDPAddr); ok {
+			source = peer.IP
+		}
+	}
+	if !ip.Equal(source) {
+		return nil, fmt.Errorf("address %s is not the source address %s", ip, source)
+	}
+	if !r.allowed(ip) || ip.IsLinkLocalUnicast() {
+		return nil, fmt.Errorf("address %s is not allowed", ip)
+	}
+	now := clock.Now()
+	lease := leases.Lease{
+		IP:       ip,
+		ClientID: hex.EncodeToString(cid.Cid.ToBytes()),
+		Starts:   now,
+		Ends:     now.Add(time.Duration(iaaddr.ValidLifetime) * time.Second),
+	}
+	if mac, err := dhcpv6.ExtractMAC(req); err == nil {
+		lease.HWAddr = mac
+	}
+	if iaaddr.ValidLifetime == 0 {
+		// a null lifetime removes the registration
+		if err := leases.Default.DeleteLease(ip); err != nil && err != leases.ErrNotFound {
+			return nil, err
+		}
+	} else if err := leases.Claim(leases.Default, &lease); err != nil {
+		return nil, err
+	}
+	logger.FromContext(ctx).Printf("plugins/addrreg: registered %s for %s (valid lifetime %ds)", ip, cid.Cid.String(), iaaddr.ValidLifetime)
+	if r.notifier != nil {
+		ev := Event{Time: now, Address: ip.String(), DUID: cid.Cid.String(), ValidLifetime: iaaddr.ValidLifetime}
+		ev.Host = dualstack.Default.Lookup(&lease)
+		ev.Labels = metadata.Of(ip)
+		if lease.HWAddr != nil {
+			ev.HWAddr = lease.HWAddr.String()
+		}
+		r.notifier.notify(&ev)
+	}
+
+	reply, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	m := reply.(*dhcpv6.DHCPv6Message)
+	m.SetMessage(MessageTypeAddrRegReply)
+	if inform, ok := msg.(*dhcpv6.DHCPv6Message); ok {
+		m.SetTransactionID(inform.TransactionID())
+	}
+	opts := []dhcpv6.Option{cid, iaaddr}
+	if sid := serverid.ServerID6(); sid != nil {
+		opts = append(opts, &dhcpv6.OptServerId{Sid: *sid})
+	}
+	m.SetOptions(opts)
+	return m, nil
+}
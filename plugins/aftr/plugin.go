@@ -0,0 +1,81 @@
+package aftr
+
+// This plugin provides DS-Lite CPEs with the name of their AFTR (Address Family
+// Transition Router) in the DHCPv6 AFTR-Name option (RFC 6334). It only adds
+// the option to responses to clients that requested it.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - aftr: aftr.example.net
+//
+// The name can be overridden per network, subnet, class or host with the
+// `aftr` option, see the options section of the configuration. An empty name
+// disables the option.
+
+import (
+	"context"
+	"errors"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dnsname"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// OptionAFTRName is the DHCPv6 AFTR-Name option code.
+const OptionAFTRName dhcpv6.OptionCode = 64
+
+func init() {
+	plugins.RegisterPlugin("aftr", setupAFTR6, nil)
+	plugins.RegisterConstraints("aftr", plugins.Constraints{Uses: plugins.OptionTags})
+}
+
+// defaultName is the AFTR name used when no option definition overrides it.
+var defaultName string
+
+func setupAFTR6(args ...string) (handler.Handler6, error) {
+	if len(args) < 1 {
+		return nil, errors.New("plugins/aftr: need an AFTR name")
+	}
+	if _, err := dnsname.Encode(args[0]); err != nil {
+		return nil, err
+	}
+	defaultName = args[0]
+	log.Printf("plugins/aftr: using AFTR %s", defaultName)
+	return Handler6, nil
+}
+
+// Handler6 adds the AFTR-Name option to the response.
+func Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || !dhcputil.Requested6(msg, OptionAFTRName) {
+		return resp, false
+	}
+	name := defaultName
+	mac, _ := dhcpv6.ExtractMAC(req)
+	if values, ok := handler.Options(ctx, dhcputil.LinkAddress6(req), mac)["aftr"]; ok {
+		name = ""
+		if len(values) > 0 {
+			name = values[0]
+		}
+	}
+	if name == "" {
+		return resp, false
+	}
+	data, err := dnsname.Encode(name)
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/aftr: %v", err)
+		return resp, false
+	}
+	resp.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionAFTRName, OptionData: data})
+	return resp, false
+}
@@ -0,0 +1,267 @@
+package auth
+
+// This plugin implements the delayed authentication protocol of RFC 3118 for
+// DHCPv4: clients request it in their DHCPDISCOVER, and then sign their
+// messages with a key shared with the server, which signs its responses with
+// the same key. It is made of two plugins: `auth` validates the requests and
+// should be the first plugin of the chain, and `auth_sign` signs the responses
+// and should be the last one.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - auth: key=1,00112233445566778899aabbccddeeff key=2,ffeeddccbbaa99887766554433221100 client=00:11:22:33:44:55,2 default=1 require
+//	        - ...
+//	        - auth_sign:
+//
+// The arguments are:
+//   - key=<id>,<hex secret>: a key and its 32-bit identifier;
+//   - client=<hwaddr>,<id>: the key of a client. Clients without a key of
+//     their own use the default key;
+//   - default=<id>: the default key, if any;
+//   - require: drop the unauthenticated requests. By default, they are
+//     answered without authentication.
+//
+// Requests failing the validation are always dropped. The digests of the
+// requests are checked over the packets as received, and the responses are
+// signed once encoded, after their options are overloaded or trimmed. When the
+// server is embedded, and gets the requests already parsed, the digests are
+// checked over their encoding by the server, which orders the options by code,
+// and only matches the packets of the clients that use the same order.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/dhcpauth"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// keyValue is the key of the transaction state holding the key selected for
+// the client, for auth_sign.
+const keyValue = "auth/key"
+
+// secretIDSize is the size of the secret identifier, which precedes the
+// digest in the authentication information.
+const secretIDSize = 4
+
+func init() {
+	plugins.RegisterPlugin("auth", nil, setupAuth4)
+	plugins.RegisterPlugin("auth_sign", nil, setupSign4)
+	plugins.RegisterConstraints("auth", plugins.Constraints{Provides: []string{keyValue}})
+	plugins.RegisterOverridable("auth")
+	plugins.RegisterConstraints("auth_sign", plugins.Constraints{Requires: []string{keyValue}})
+	plugins.RegisterOverridable("auth_sign")
+}
+
+// key is a shared secret.
+type key struct {
+	id     uint32
+	secret []byte
+}
+
+// authenticator validates the requests with the configured keys.
+type authenticator struct {
+	keys       map[uint32]*key
+	clients    map[string]uint32
+	defaultKey *key
+	require    bool
+}
+
+// lastReplay holds the replay detection value of the last valid request of
+// each client. It is kept across configuration reloads.
+var (
+	replayLock sync.Mutex
+	lastReplay = make(map[string]uint64)
+)
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid key identifier `%s`", s)
+	}
+	return uint32(id), nil
+}
+
+func parseArgs(args []string) (*authenticator, error) {
+	a := authenticator{keys: make(map[uint32]*key), clients: make(map[string]uint32)}
+	var defaultID *uint32
+	for _, arg := range args {
+		if arg == "require" {
+			a.require = true
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed argument `%s`", arg)
+		}
+		fields := strings.Split(kv[1], ",")
+		switch kv[0] {
+		case "key":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("malformed key `%s`", kv[1])
+			}
+			id, err := parseID(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			secret, err := hex.DecodeString(fields[1])
+			if err != nil || len(secret) == 0 {
+				return nil, fmt.Errorf("invalid secret for key %d", id)
+			}
+			a.keys[id] = &key{id: id, secret: secret}
+		case "client":
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("malformed client `%s`", kv[1])
+			}
+			hwaddr, err := net.ParseMAC(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			id, err := parseID(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			a.clients[hwaddr.String()] = id
+		case "default":
+			id, err := parseID(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			defaultID = &id
+		default:
+			return nil, fmt.Errorf("unknown argument `%s`", kv[0])
+		}
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.New("need at least one key")
+	}
+	for hwaddr, id := range a.clients {
+		if _, ok := a.keys[id]; !ok {
+			return nil, fmt.Errorf("unknown key %d for client %s", id, hwaddr)
+		}
+	}
+	if defaultID != nil {
+		var ok bool
+		if a.defaultKey, ok = a.keys[*defaultID]; !ok {
+			return nil, fmt.Errorf("unknown default key %d", *defaultID)
+		}
+	}
+	return &a, nil
+}
+
+func setupAuth4(args ...string) (handler.Handler4, error) {
+	a, err := parseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/auth: %v", err)
+	}
+	log.Printf("plugins/auth: loaded %d key(s)", len(a.keys))
+	return a.Handler4, nil
+}
+
+// clientKey returns the key of a client, or nil if it has none.
+func (a *authenticator) clientKey(hwaddr net.HardwareAddr) *key {
+	if id, ok := a.clients[hwaddr.String()]; ok {
+		return a.keys[id]
+	}
+	return a.defaultKey
+}
+
+// validate validates the authentication option of a request, received as
+// packet, and returns the key of the client.
+func (a *authenticator) validate(req *dhcpv4.DHCPv4, packet []byte, auth *dhcpauth.Option) (*key, error) {
+	if auth.Protocol != dhcpauth.ProtocolDelayed || auth.Algorithm != dhcpauth.AlgorithmHMACMD5 || auth.RDM != dhcpauth.RDMMonotonic {
+		return nil, fmt.Errorf("unsupported authentication protocol %d, algorithm %d, RDM %d", auth.Protocol, auth.Algorithm, auth.RDM)
+	}
+	k := a.clientKey(req.ClientHWAddr)
+	if k == nil {
+		return nil, errors.New("no key for the client")
+	}
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		// the client requests the authentication, and has no key yet
+		return k, nil
+	}
+	if len(auth.Info) != secretIDSize+dhcpauth.DigestSize {
+		return nil, errors.New("malformed authentication information")
+	}
+	if id := binary.BigEndian.Uint32(auth.Info); id != k.id {
+		return nil, fmt.Errorf("unexpected key %d", id)
+	}
+	if err := dhcpauth.Verify4(k.secret, packet); err != nil {
+		return nil, err
+	}
+	replayLock.Lock()
+	defer replayLock.Unlock()
+	client := req.ClientHWAddr.String()
+	if auth.Replay <= lastReplay[client] {
+		return nil, errors.New("replayed message")
+	}
+	lastReplay[client] = auth.Replay
+	return k, nil
+}
+
+// Handler4 validates the requests, and drops the ones failing the validation.
+func (a *authenticator) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	log := logger.FromContext(ctx)
+	data := req.GetOneOption(dhcpauth.OptionAuthentication4)
+	if data == nil {
+		if a.require {
+			log.Printf("plugins/auth: dropping unauthenticated request from %s", req.ClientHWAddr)
+			return nil, true
+		}
+		return resp, false
+	}
+	auth, err := dhcpauth.Parse(data)
+	if err == nil {
+		var k *key
+		packet := handler.Packet(ctx)
+		if packet == nil {
+			packet = dhcputil.Encode4(req)
+		}
+		if k, err = a.validate(req, packet, auth); err == nil {
+			handler.SetValue(ctx, keyValue, k)
+			return resp, false
+		}
+	}
+	log.Printf("plugins/auth: dropping request from %s: %v", req.ClientHWAddr, err)
+	return nil, true
+}
+
+func setupSign4(args ...string) (handler.Handler4, error) {
+	return Sign4, nil
+}
+
+// Sign4 adds an authentication option to the responses to the authenticated
+// requests, and has the server sign them once encoded.
+func Sign4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	k, ok := handler.Value(ctx, keyValue).(*key)
+	if !ok || resp == nil {
+		return resp, false
+	}
+	auth := dhcpauth.Option{
+		Protocol:  dhcpauth.ProtocolDelayed,
+		Algorithm: dhcpauth.AlgorithmHMACMD5,
+		RDM:       dhcpauth.RDMMonotonic,
+		Replay:    dhcpauth.NextReplay(),
+		Info:      make([]byte, secretIDSize+dhcpauth.DigestSize),
+	}
+	binary.BigEndian.PutUint32(auth.Info, k.id)
+	secret := k.secret
+	handler.SetSigner(ctx, func(packet []byte) error { return dhcpauth.Sign4(secret, packet) })
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpauth.OptionAuthentication4, auth.ToBytes()))
+	return resp, false
+}
@@ -0,0 +1,129 @@
+package authoritative
+
+// This plugin decides, per subnet, what happens to the DHCPREQUESTs that no
+// plugin acknowledged, e.g. from clients that moved from another network or
+// whose lease is unknown. On authoritative subnets they are answered with a
+// DHCPNAK, so that the clients restart their configuration at once, while on
+// the other subnets they are ignored, as another server may know the clients.
+// This mirrors the `authoritative` statement of ISC dhcpd, and matters when
+// coredhcp coexists with other servers, e.g. during a migration. It should be
+// the last plugin of the chain that builds the responses.
+//
+// Usage:
+//
+//	server4:
+//	    networks:
+//	        - name: legacy
+//	          options:
+//	              authoritative: off
+//	          subnets:
+//	              - prefix: 10.1.0.0/16
+//	    plugins:
+//	        - server_id: 192.0.2.1
+//	        - ...
+//	        - authoritative: on
+//
+// The argument is the default for the subnets that do not set the
+// `authoritative` option, `off` if omitted. The option can also be set per
+// network, class or host. DHCPREQUESTs that select another server are never
+// answered.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("authoritative", nil, setupAuthoritative4)
+	plugins.RegisterOverridable("authoritative")
+}
+
+// parseSwitch parses an on/off value.
+func parseSwitch(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid value `%s`, must be `on` or `off`", s)
+}
+
+type policy struct {
+	defaultOn bool
+}
+
+func setupAuthoritative4(args ...string) (handler.Handler4, error) {
+	var p policy
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if p.defaultOn, err = parseSwitch(args[0]); err != nil {
+			return nil, fmt.Errorf("plugins/authoritative: %v", err)
+		}
+	default:
+		return nil, errors.New("plugins/authoritative: too many arguments")
+	}
+	log.Printf("plugins/authoritative: authoritative by default: %v", p.defaultOn)
+	return p.Handler4, nil
+}
+
+// authoritative returns whether the server is authoritative for the client.
+func (p *policy) authoritative(ctx context.Context, req *dhcpv4.DHCPv4) bool {
+	values, ok := handler.Options(ctx, handler.Address4(ctx, req, nil), req.ClientHWAddr)["authoritative"]
+	if !ok || len(values) == 0 {
+		return p.defaultOn
+	}
+	on, err := parseSwitch(values[0])
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/authoritative: %v", err)
+		return p.defaultOn
+	}
+	return on
+}
+
+// acknowledged returns whether a response acknowledges an address.
+func acknowledged(resp *dhcpv4.DHCPv4) bool {
+	return resp != nil && resp.MessageType() == dhcpv4.MessageTypeAck &&
+		resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified()
+}
+
+// Handler4 answers the DHCPREQUESTs that were not acknowledged with a DHCPNAK
+// on authoritative subnets, or drops them.
+func (p *policy) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() != dhcpv4.MessageTypeRequest || acknowledged(resp) {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	var serverID net.IP
+	if resp != nil {
+		serverID = resp.ServerIdentifier()
+	}
+	if sid := req.ServerIdentifier(); sid != nil && !sid.Equal(serverID) {
+		// the client selected another server
+		return nil, true
+	}
+	if !p.authoritative(ctx, req) {
+		log.Printf("plugins/authoritative: ignoring unknown DHCPREQUEST from %s", req.ClientHWAddr)
+		return nil, true
+	}
+	nak, err := dhcputil.Nak4(req, serverID, "unknown lease")
+	if err != nil {
+		log.Printf("plugins/authoritative: NewReplyFromRequest failed: %v", err)
+		return nil, true
+	}
+	log.Printf("plugins/authoritative: sending DHCPNAK to %s", req.ClientHWAddr)
+	return nak, true
+}
@@ -0,0 +1,150 @@
+package autohostname
+
+// This plugin generates host names for the clients that do not send one, from
+// a template, so that the addresses of the dynamic ranges get meaningful,
+// deterministic names. The names are stored on the leases and set as the host
+// name of the transaction, for the plugins that register them in the DNS. It
+// should come after the plugins that assign the addresses.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - autohostname: host-{ip-dashed}.guest.example.com
+//
+// The template can contain the following placeholders:
+//   - {ip}: the address of the client, e.g. 192.0.2.1;
+//   - {ip-dashed}: the same, with dashes, e.g. 192-0-2-1;
+//   - {mac}: the hardware address of the client, e.g. 001122334455;
+//   - {mac-dashed}: the same, with dashes, e.g. 00-11-22-33-44-55.
+//
+// DHCPv4 clients that request the host name option get the first label of the
+// name.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Client FQDN option codes (RFC 4702 and RFC 4704)
+const (
+	OptionClientFQDN4 = dhcpv4.GenericOptionCode(81)
+	OptionClientFQDN6 = dhcpv6.OptionCode(39)
+)
+
+func init() {
+	plugins.RegisterPlugin("autohostname", setupAutoHostname6, setupAutoHostname4)
+	plugins.RegisterConstraints("autohostname", plugins.Constraints{Provides: []string{plugins.TagHostname}})
+	plugins.RegisterOverridable("autohostname")
+}
+
+type generator struct {
+	template string
+}
+
+func setup(args []string) (*generator, error) {
+	if len(args) != 1 || args[0] == "" {
+		return nil, errors.New("plugins/autohostname: need a host name template")
+	}
+	if !strings.Contains(args[0], "{ip") && !strings.Contains(args[0], "{mac") {
+		return nil, fmt.Errorf("plugins/autohostname: template `%s` would give the same name to all the clients", args[0])
+	}
+	log.Printf("plugins/autohostname: generating host names from %s", args[0])
+	return &generator{template: args[0]}, nil
+}
+
+func setupAutoHostname6(args ...string) (handler.Handler6, error) {
+	g, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return g.Handler6, nil
+}
+
+func setupAutoHostname4(args ...string) (handler.Handler4, error) {
+	g, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return g.Handler4, nil
+}
+
+// Expand returns the host name of a client from a template, see the
+// placeholders above.
+func Expand(template string, ip net.IP, hwaddr net.HardwareAddr) string {
+	mac := strings.Replace(hwaddr.String(), ":", "", -1)
+	dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip.String())
+	return strings.NewReplacer(
+		"{ip}", ip.String(),
+		"{ip-dashed}", dashed,
+		"{mac}", mac,
+		"{mac-dashed}", strings.Replace(hwaddr.String(), ":", "-", -1),
+	).Replace(template)
+}
+
+// Assign sets the host name of the transaction, and stores it on the lease of
+// the address, if any.
+func Assign(ctx context.Context, ip net.IP, name string) {
+	handler.SetHostname(ctx, name)
+	lease, err := leases.Default.Lease(ip)
+	if err != nil {
+		return
+	}
+	lease.Hostname = name
+	if err := leases.Default.PutLease(lease); err != nil {
+		logger.FromContext(ctx).Printf("plugins/autohostname: cannot store the host name of %s: %v", ip, err)
+	}
+}
+
+// Handler6 names the DHCPv6 clients that send no FQDN.
+func (g *generator) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil || handler.Hostname(ctx) != "" {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || msg.GetOneOption(OptionClientFQDN6) != nil {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	ip := dhcputil.FirstAddress6(reply)
+	// the hardware address is only known for some DUID types
+	mac, err := dhcpv6.ExtractMAC(req)
+	if ip == nil || (err != nil && strings.Contains(g.template, "{mac")) {
+		return resp, false
+	}
+	Assign(ctx, ip, Expand(g.template, ip, mac))
+	return resp, false
+}
+
+// Handler4 names the DHCPv4 clients that send no host name.
+func (g *generator) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() || handler.Hostname(ctx) != "" {
+		return resp, false
+	}
+	if req.HostName() != "" || req.GetOneOption(OptionClientFQDN4) != nil {
+		return resp, false
+	}
+	name := Expand(g.template, resp.YourIPAddr, req.ClientHWAddr)
+	Assign(ctx, resp.YourIPAddr, name)
+	if req.IsOptionRequested(dhcpv4.OptionHostName) {
+		resp.UpdateOption(dhcpv4.OptHostName(strings.SplitN(name, ".", 2)[0]))
+	}
+	return resp, false
+}
@@ -0,0 +1,206 @@
+package bootp
+
+// This plugin answers the plain BOOTP requests (RFC 951), i.e. the requests
+// without a DHCP message type, as sent by old lab instruments and industrial
+// controllers. BOOTP clients only get static reservations, which are bound to
+// them with an infinite lease. The DHCP requests are left to the next plugins,
+// while the BOOTP requests are not, so it can be anywhere in the chain.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - bootp: bootp.txt mask=255.255.255.0 router=192.0.2.1 dns=192.0.2.53 next-server=192.0.2.10 bootfile=boot.bin
+//
+// The first argument is a file of reservations, a hardware address and an IPv4
+// address per line. Clients that are not in the file can also be reserved in
+// the host store, e.g. via OMAPI. The other arguments are optional: the subnet
+// mask, routers and DNS servers sent in the vendor extensions, and the server
+// and file to boot from. BOOTP requests from other clients are dropped.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("bootp", nil, setupBOOTP4)
+	plugins.RegisterConstraints("bootp", plugins.Constraints{Provides: []string{plugins.TagAddress}})
+	plugins.RegisterOverridable("bootp")
+}
+
+// server holds the reservations and the parameters sent to the clients.
+type server struct {
+	records    map[string]net.IP
+	mask       net.IPMask
+	routers    []net.IP
+	dns        []net.IP
+	nextServer net.IP
+	bootFile   string
+}
+
+// loadRecords loads the reservations from a file, a hardware address and an
+// IPv4 address per line.
+func loadRecords(filename string) (map[string]net.IP, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]net.IP)
+	for _, lineBytes := range bytes.Split(data, []byte{'\n'}) {
+		line := strings.TrimSpace(string(lineBytes))
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("malformed line: %s", line)
+		}
+		hwaddr, err := net.ParseMAC(tokens[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed hardware address: %s", tokens[0])
+		}
+		ip := net.ParseIP(tokens[1])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("expected an IPv4 address, got: %s", tokens[1])
+		}
+		records[hwaddr.String()] = ip.To4()
+	}
+	return records, nil
+}
+
+// parseIPs parses a comma-separated list of IPv4 addresses.
+func parseIPs(s string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, v := range strings.Split(s, ",") {
+		ip := net.ParseIP(v)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address `%s`", v)
+		}
+		ips = append(ips, ip.To4())
+	}
+	return ips, nil
+}
+
+func parseArgs(args []string) (*server, error) {
+	if len(args) < 1 || args[0] == "" {
+		return nil, errors.New("need a reservations file name")
+	}
+	records, err := loadRecords(args[0])
+	if err != nil {
+		return nil, err
+	}
+	s := server{records: records}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed argument `%s`", arg)
+		}
+		var ips []net.IP
+		switch kv[0] {
+		case "bootfile":
+			s.bootFile = kv[1]
+			continue
+		case "mask", "router", "dns", "next-server":
+			if ips, err = parseIPs(kv[1]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown argument `%s`", kv[0])
+		}
+		switch kv[0] {
+		case "mask":
+			s.mask = net.IPMask(ips[0])
+		case "router":
+			s.routers = ips
+		case "dns":
+			s.dns = ips
+		case "next-server":
+			s.nextServer = ips[0]
+		}
+	}
+	return &s, nil
+}
+
+func setupBOOTP4(args ...string) (handler.Handler4, error) {
+	s, err := parseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/bootp: %v", err)
+	}
+	log.Printf("plugins/bootp: loaded %d reservations from %s", len(s.records), args[0])
+	return s.Handler4, nil
+}
+
+// IsBOOTP returns whether a request is a plain BOOTP request.
+func IsBOOTP(req *dhcpv4.DHCPv4) bool {
+	return req.OpCode == dhcpv4.OpcodeBootRequest && req.GetOneOption(dhcpv4.OptionDHCPMessageType) == nil
+}
+
+// reservation returns the address reserved for a client, or nil.
+func (s *server) reservation(hwaddr net.HardwareAddr) net.IP {
+	if ip, ok := s.records[hwaddr.String()]; ok {
+		return ip
+	}
+	host, err := leases.Default.HostByHWAddr(hwaddr)
+	if err != nil || host.IP == nil || host.IP.To4() == nil {
+		return nil
+	}
+	return host.IP.To4()
+}
+
+// Handler4 answers the BOOTP requests of the reserved clients.
+func (s *server) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if !IsBOOTP(req) {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	ip := s.reservation(req.ClientHWAddr)
+	if ip == nil {
+		log.Printf("plugins/bootp: dropping request from %s, which has no reservation", req.ClientHWAddr)
+		return nil, true
+	}
+	reply, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		log.Printf("plugins/bootp: cannot build the reply: %v", err)
+		return nil, true
+	}
+	// BOOTP replies only carry the vendor extensions
+	reply.Options = make(dhcpv4.Options)
+	reply.YourIPAddr = ip
+	if s.nextServer != nil {
+		reply.ServerIPAddr = s.nextServer
+	}
+	if s.bootFile != "" {
+		reply.BootFileName = s.bootFile
+	}
+	if s.mask != nil {
+		reply.UpdateOption(dhcpv4.OptSubnetMask(s.mask))
+	}
+	if len(s.routers) > 0 {
+		reply.UpdateOption(dhcpv4.OptRouter(s.routers...))
+	}
+	if len(s.dns) > 0 {
+		reply.UpdateOption(dhcpv4.OptDNS(s.dns...))
+	}
+	// BOOTP addresses are bound until the reservation is removed
+	lease := leases.Lease{IP: ip, HWAddr: req.ClientHWAddr, Starts: clock.Now()}
+	if err := leases.Default.PutLease(&lease); err != nil {
+		log.Printf("plugins/bootp: cannot store the lease of %s: %v", ip, err)
+	}
+	log.Printf("plugins/bootp: assigning %s to %s", ip, req.ClientHWAddr)
+	return reply, true
+}
@@ -0,0 +1,310 @@
+package churn
+
+// This plugin detects the clients that request many different addresses in a
+// short window, which are usually several hosts sharing a spoofed or cloned
+// identifier, or broken supplicants, and optionally rejects them. The clients
+// are identified by their client identifier (option 61), or else their
+// hardware address, for DHCPv4, and by their DUID for DHCPv6; their addresses
+// are the ones they request and the ones assigned to them.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ...
+//	        - churn: window=10m max=4 reject class=guests,2,reject class=lab,0
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - churn: window=10m max=4
+//
+// A client is flagged when it used more than `max` different addresses in the
+// last `window` (10 minutes by default). Flagged clients are logged and
+// counted in `dhcp_client_churn_total`, and with `reject` their requests are
+// dropped, or NAKed for the DHCPREQUESTs, until they stay within the limit
+// for a window. `class=<class>,<max>[,reject|log]` sets the limit and the
+// action of the clients of a class, the later classes of a client taking
+// precedence, and a limit of 0 disables the detection. The plugin must come
+// after the classification plugins and the plugins that assign the addresses.
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// statChurn counts the requests of the flagged clients.
+const statChurn = "dhcp_client_churn_total"
+
+// sweepInterval is the minimum interval between the removals of the clients
+// not seen for a window.
+const sweepInterval = time.Minute
+
+func init() {
+	plugins.RegisterPlugin("churn", setupChurn6, setupChurn4)
+	plugins.RegisterConstraints("churn", plugins.Constraints{After: []string{"oui", "userclass"}})
+	plugins.RegisterOverridable("churn")
+}
+
+// policy is the limit and the action of a client.
+type policy struct {
+	max    int
+	reject bool
+}
+
+type detector struct {
+	window  time.Duration
+	policy  policy
+	classes map[string]policy
+
+	lock sync.Mutex
+	// clients holds the last times each client used its addresses
+	clients map[string]map[string]time.Time
+	swept   time.Time
+}
+
+// parsePolicy parses a `<max>[,reject|log]` value.
+func parsePolicy(fields []string) (policy, error) {
+	var p policy
+	max, err := strconv.Atoi(fields[0])
+	if err != nil || max < 0 {
+		return p, fmt.Errorf("invalid limit `%s`", fields[0])
+	}
+	p.max = max
+	if len(fields) > 1 {
+		switch fields[1] {
+		case "reject":
+			p.reject = true
+		case "log":
+		default:
+			return p, fmt.Errorf("invalid action `%s`, must be reject or log", fields[1])
+		}
+	}
+	return p, nil
+}
+
+func setup(args []string) (*detector, error) {
+	d := detector{
+		window:  10 * time.Minute,
+		policy:  policy{max: 4},
+		classes: make(map[string]policy),
+		clients: make(map[string]map[string]time.Time),
+	}
+	for _, arg := range args {
+		if arg == "reject" {
+			d.policy.reject = true
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/churn: unknown argument `%s`", arg)
+		}
+		var err error
+		switch kv[0] {
+		case "window":
+			if d.window, err = time.ParseDuration(kv[1]); err == nil && d.window <= 0 {
+				err = errors.New("must be positive")
+			}
+		case "max":
+			var p policy
+			if p, err = parsePolicy([]string{kv[1]}); err == nil {
+				d.policy.max = p.max
+			}
+		case "class":
+			fields := strings.Split(kv[1], ",")
+			if len(fields) < 2 || len(fields) > 3 {
+				err = errors.New("need a class, a limit and an optional action")
+				break
+			}
+			var p policy
+			if p, err = parsePolicy(fields[1:]); err == nil {
+				if len(fields) == 2 {
+					p.reject = d.policy.reject
+				}
+				d.classes[fields[0]] = p
+			}
+		default:
+			return nil, fmt.Errorf("plugins/churn: unknown argument `%s`", arg)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("plugins/churn: invalid %s `%s`: %v", kv[0], kv[1], err)
+		}
+	}
+	log.Printf("plugins/churn: flagging clients with more than %d addresses in %s, reject=%v, with %d class policies", d.policy.max, d.window, d.policy.reject, len(d.classes))
+	return &d, nil
+}
+
+func setupChurn6(args ...string) (handler.Handler6, error) {
+	d, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return d.Handler6, nil
+}
+
+func setupChurn4(args ...string) (handler.Handler4, error) {
+	d, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return d.Handler4, nil
+}
+
+// policyOf returns the policy of a client.
+func (d *detector) policyOf(ctx context.Context) policy {
+	p := d.policy
+	for _, class := range handler.Classes(ctx) {
+		if cp, ok := d.classes[class]; ok {
+			p = cp
+		}
+	}
+	return p
+}
+
+// observe records that a client used addresses, and returns the number of
+// different addresses it used in the window.
+func (d *detector) observe(client string, addrs []net.IP, now time.Time) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if now.Sub(d.swept) > sweepInterval {
+		d.sweep(now)
+	}
+	seen := d.clients[client]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		d.clients[client] = seen
+	}
+	for _, ip := range addrs {
+		seen[ip.String()] = now
+	}
+	for addr, last := range seen {
+		if now.Sub(last) > d.window {
+			delete(seen, addr)
+		}
+	}
+	return len(seen)
+}
+
+// sweep removes the addresses not used for a window. The lock must be held.
+func (d *detector) sweep(now time.Time) {
+	d.swept = now
+	for client, seen := range d.clients {
+		for addr, last := range seen {
+			if now.Sub(last) > d.window {
+				delete(seen, addr)
+			}
+		}
+		if len(seen) == 0 {
+			delete(d.clients, client)
+		}
+	}
+}
+
+// check records the addresses of a client, and returns whether its request
+// must be rejected.
+func (d *detector) check(ctx context.Context, version, client string, addrs []net.IP) bool {
+	if len(addrs) == 0 {
+		return false
+	}
+	p := d.policyOf(ctx)
+	if p.max == 0 {
+		return false
+	}
+	n := d.observe(client, addrs, clock.Now())
+	if n <= p.max {
+		return false
+	}
+	action := "log"
+	if p.reject {
+		action = "reject"
+	}
+	stats.Inc(statChurn, "version", version, "action", action)
+	logger.FromContext(ctx).Printf("plugins/churn: client %s used %d addresses in %s, more than its limit of %d (%s)", client, n, d.window, p.max, action)
+	return p.reject
+}
+
+// addresses6 returns the IA_NA addresses of a DHCPv6 message.
+func addresses6(msg dhcpv6.DHCPv6) []net.IP {
+	var ret []net.IP
+	for _, addr := range dhcputil.IAAddresses6(msg) {
+		if addr.ValidLifetime > 0 {
+			ret = append(ret, addr.IPv6Addr)
+		}
+	}
+	return ret
+}
+
+// Handler6 flags the DHCPv6 clients using too many addresses.
+func (d *detector) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok || msg.Type() == dhcpv6.MessageTypeRelease {
+		return resp, false
+	}
+	addrs := addresses6(msg)
+	if resp != nil {
+		if reply, err := dhcputil.InnerMessage6(resp); err == nil {
+			addrs = append(addrs, addresses6(reply)...)
+		}
+	}
+	if d.check(ctx, "6", hex.EncodeToString(cid.Cid.ToBytes()), addrs) {
+		return nil, true
+	}
+	return resp, false
+}
+
+// Handler4 flags the DHCPv4 clients using too many addresses.
+func (d *detector) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() == dhcpv4.MessageTypeRelease {
+		return resp, false
+	}
+	client := req.ClientHWAddr.String()
+	if cid := req.GetOneOption(dhcpv4.OptionClientIdentifier); len(cid) > 0 {
+		client = hex.EncodeToString(cid)
+	}
+	var addrs []net.IP
+	for _, ip := range []net.IP{req.RequestedIPAddress(), req.ClientIPAddr} {
+		if ip != nil && !ip.IsUnspecified() {
+			addrs = append(addrs, ip)
+		}
+	}
+	if resp != nil && resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified() {
+		addrs = append(addrs, resp.YourIPAddr)
+	}
+	if !d.check(ctx, "4", client, addrs) {
+		return resp, false
+	}
+	if req.MessageType() != dhcpv4.MessageTypeRequest {
+		return nil, true
+	}
+	var serverID net.IP
+	if resp != nil {
+		serverID = resp.ServerIdentifier()
+	}
+	nak, err := dhcputil.Nak4(req, serverID, "too many addresses")
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/churn: NewReplyFromRequest failed: %v", err)
+		return nil, true
+	}
+	return nak, true
+}
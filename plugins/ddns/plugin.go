@@ -0,0 +1,590 @@
+package ddns
+
+// This plugin registers the host names of the clients in the DNS with dynamic
+// updates (RFC 2136), signed with TSIG (RFC 8945): the address assigned to a
+// client replaces the A, or AAAA, records of its host name, as set by the
+// plugins providing the host names (hostname, autohostname, dualstack), and
+// optionally its PTR record in a reverse zone. It should come after those
+// plugins, and after the plugins that assign the addresses.
+//
+// The names are registered with the conflict detection of RFC 4703: a name is
+// added with a DHCID record (RFC 4701) identifying the client, if it is not in
+// use, and its records are only replaced if it holds the DHCID of the same
+// client. The names in use by another client, or holding records that the
+// server did not add, are left untouched. The DUIDs identify the clients, so
+// that the dual-stack clients sending an RFC 4361 identifier can register the
+// same name in both protocols.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - autohostname: host-{ip-dashed}
+//	        - ddns: server=192.0.2.53:53 zone=guest.example.com key=dhcp,hmac-sha256,c2VjcmV0 ttl=300 reverse4=2.0.192.in-addr.arpa
+//
+// The host names without a dot are in the zone, and the ones outside of it are
+// not registered. The key is the name of the TSIG key, its algorithm, which
+// must be hmac-sha256, and its secret, in base64. The reverse6= argument is the
+// reverse zone of the DHCPv6 addresses.
+//
+// The updates are sent asynchronously, in the order of the transactions, and
+// dropped when the queue is full rather than slowing down the server. The
+// records are not removed when the leases expire or are released, and the
+// signatures of the responses of the DNS server are not verified.
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("ddns", setup6, setup4)
+	plugins.RegisterConstraints("ddns", plugins.Constraints{
+		After:    []string{"hostname", "autohostname", "dualstack"},
+		Requires: []string{plugins.TagHostname},
+	})
+	plugins.RegisterHealthCheck("ddns", health)
+	plugins.RegisterOverridable("ddns")
+	plugins.RegisterCommit("ddns", commit, discard)
+}
+
+const (
+	queueSize  = 1000
+	timeout    = 5 * time.Second
+	defaultTTL = 300
+	// fudge is the clock skew allowed by the DNS server for the signatures.
+	fudge = 300
+)
+
+// DNS protocol constants
+const (
+	opcodeUpdate  = 5
+	rcodeYXDomain = 6
+	rcodeNXRRSet  = 8
+	typeA         = 1
+	typePTR       = 12
+	typeSOA       = 6
+	typeAAAA      = 28
+	typeDHCID     = 49
+	typeTSIG      = 250
+	typeANY       = 255
+	classIN       = 1
+	classNONE     = 254
+	classANY      = 255
+)
+
+// DHCID identifier types (RFC 4701, section 3.3)
+const (
+	idHWAddr   = 0
+	idClientID = 1
+	idDUID     = 2
+	// digestSHA256 is the digest type of the DHCID records.
+	digestSHA256 = 1
+)
+
+// duidClientID is the type of the RFC 4361 client identifiers, which are
+// followed by an IAID and a DUID.
+const duidClientID = 255
+
+// errConflict is returned for the updates of the names in use by another
+// client, or by records not added by the server.
+var errConflict = errors.New("the name is in use by another client")
+
+const algorithm = "hmac-sha256."
+
+// key is a TSIG key.
+type key struct {
+	name   string
+	secret []byte
+}
+
+// updater sends the updates of a zone to a DNS server.
+type updater struct {
+	server   string
+	zone     string
+	key      key
+	ttl      uint32
+	reverse4 string
+	reverse6 string
+	queue    chan *update
+	// done is closed to stop the updater.
+	done chan struct{}
+	// lastErr is the error of the last update sent, protected by
+	// updatersLock.
+	lastErr error
+}
+
+// update is an update of the records of a name in a zone.
+type update struct {
+	zone string
+	name string
+	// rtype is the type of the records replaced by rdata.
+	rtype uint16
+	rdata []byte
+	// dhcid is the DHCID record of the client, for the conflict
+	// detection, or nil for the PTR records, which belong to the
+	// address.
+	dhcid []byte
+}
+
+// client is the identifier of a client in its DHCID records.
+type client struct {
+	idType uint16
+	id     []byte
+}
+
+// dhcid returns the RDATA of the DHCID record of a client for a name (RFC
+// 4701, section 3.3).
+func (c client) dhcid(name string) []byte {
+	h := sha256.New()
+	h.Write(c.id)
+	h.Write(encodeName(name))
+	b := append16(nil, c.idType)
+	b = append(b, digestSHA256)
+	return h.Sum(b)
+}
+
+// client4 returns the identifier of a DHCPv4 client: the DUID of its RFC 4361
+// client identifier, or else its client identifier, or else its hardware
+// address (RFC 4701, section 3.5).
+func client4(req *dhcpv4.DHCPv4) client {
+	cid := req.GetOneOption(dhcpv4.OptionClientIdentifier)
+	switch {
+	case len(cid) > 5 && cid[0] == duidClientID:
+		return client{idType: idDUID, id: cid[5:]}
+	case len(cid) > 0:
+		return client{idType: idClientID, id: cid}
+	}
+	return client{idType: idHWAddr, id: append([]byte{byte(req.HWType)}, req.ClientHWAddr...)}
+}
+
+// updaters holds the running updaters by their arguments, so that loading the
+// plugin for both protocols, or reloading the configuration, does not start a
+// new one. pending holds the updaters used by the configuration being loaded,
+// which are started, and the others stopped, when it is committed.
+var (
+	updatersLock sync.Mutex
+	updaters     = make(map[string]*updater)
+	pending      = make(map[string]*updater)
+)
+
+func fqdn(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+func parseKey(s string) (key, error) {
+	parts := strings.SplitN(s, ",", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return key{}, errors.New("malformed key, need name,hmac-sha256,secret")
+	}
+	if fqdn(parts[1]) != algorithm {
+		return key{}, fmt.Errorf("unsupported key algorithm `%s`", parts[1])
+	}
+	secret, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil || len(secret) == 0 {
+		return key{}, errors.New("malformed key secret")
+	}
+	return key{name: fqdn(parts[0]), secret: secret}, nil
+}
+
+func getUpdater(args []string) (*updater, error) {
+	u := &updater{ttl: defaultTTL}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/ddns: malformed argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "server":
+			if _, _, err := net.SplitHostPort(kv[1]); err != nil {
+				u.server = net.JoinHostPort(kv[1], "53")
+			} else {
+				u.server = kv[1]
+			}
+		case "zone":
+			u.zone = fqdn(kv[1])
+		case "key":
+			k, err := parseKey(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("plugins/ddns: %v", err)
+			}
+			u.key = k
+		case "ttl":
+			ttl, err := strconv.ParseUint(kv[1], 10, 31)
+			if err != nil {
+				return nil, fmt.Errorf("plugins/ddns: invalid TTL `%s`", kv[1])
+			}
+			u.ttl = uint32(ttl)
+		case "reverse4":
+			u.reverse4 = fqdn(kv[1])
+		case "reverse6":
+			u.reverse6 = fqdn(kv[1])
+		default:
+			return nil, fmt.Errorf("plugins/ddns: unknown argument `%s`", kv[0])
+		}
+	}
+	if u.server == "" || u.zone == "" || u.key.name == "" {
+		return nil, errors.New("plugins/ddns: need a server=, a zone= and a key=")
+	}
+	id := strings.Join([]string{u.server, u.zone, u.key.name, string(u.key.secret), strconv.Itoa(int(u.ttl)), u.reverse4, u.reverse6}, " ")
+	updatersLock.Lock()
+	defer updatersLock.Unlock()
+	if running, ok := updaters[id]; ok {
+		pending[id] = running
+		return running, nil
+	}
+	if staged, ok := pending[id]; ok {
+		return staged, nil
+	}
+	u.queue = make(chan *update, queueSize)
+	u.done = make(chan struct{})
+	pending[id] = u
+	return u, nil
+}
+
+// commit starts the updaters of the committed configuration, and stops the
+// others.
+func commit(loaded bool) {
+	updatersLock.Lock()
+	defer updatersLock.Unlock()
+	if !loaded {
+		pending = make(map[string]*updater)
+	}
+	for id, u := range updaters {
+		if _, ok := pending[id]; !ok {
+			log.Printf("plugins/ddns: no longer registering the host names in %s at %s", u.zone, u.server)
+			close(u.done)
+			delete(updaters, id)
+		}
+	}
+	for id, u := range pending {
+		if _, ok := updaters[id]; !ok {
+			log.Printf("plugins/ddns: registering the host names in %s at %s", u.zone, u.server)
+			updaters[id] = u
+			go u.run()
+		}
+	}
+	pending = make(map[string]*updater)
+}
+
+// discard drops the updaters of a configuration that was not committed.
+func discard() {
+	updatersLock.Lock()
+	defer updatersLock.Unlock()
+	pending = make(map[string]*updater)
+}
+
+// name returns the fully qualified name of a host name in the zone, or an
+// empty string if it is outside of the zone.
+func (u *updater) name(hostname string) string {
+	if !strings.Contains(strings.TrimSuffix(hostname, "."), ".") {
+		return fqdn(hostname + "." + u.zone)
+	}
+	name := fqdn(hostname)
+	if name != u.zone && !strings.HasSuffix(name, "."+u.zone) {
+		return ""
+	}
+	return name
+}
+
+// register enqueues the updates of the records of a host name and address,
+// for a client.
+func (u *updater) register(ctx context.Context, c client, hostname string, ip net.IP) {
+	name := u.name(hostname)
+	if name == "" {
+		logger.FromContext(ctx).Printf("plugins/ddns: %s is not in the zone %s, not registering it", hostname, u.zone)
+		return
+	}
+	updates := []*update{{zone: u.zone, name: name, dhcid: c.dhcid(name)}}
+	if ip4 := ip.To4(); ip4 != nil {
+		updates[0].rtype, updates[0].rdata = typeA, ip4
+		if u.reverse4 != "" {
+			updates = append(updates, &update{zone: u.reverse4, name: reverseName(ip), rtype: typePTR, rdata: encodeName(name)})
+		}
+	} else {
+		updates[0].rtype, updates[0].rdata = typeAAAA, ip.To16()
+		if u.reverse6 != "" {
+			updates = append(updates, &update{zone: u.reverse6, name: reverseName(ip), rtype: typePTR, rdata: encodeName(name)})
+		}
+	}
+	for _, upd := range updates {
+		select {
+		case u.queue <- upd:
+		default:
+			logger.FromContext(ctx).Printf("plugins/ddns: queue full, dropping the update of %s", upd.name)
+		}
+	}
+}
+
+func (u *updater) run() {
+	for {
+		var upd *update
+		select {
+		case upd = <-u.queue:
+		case <-u.done:
+			return
+		}
+		err := u.send(upd)
+		if err == errConflict {
+			// not a failure of the DNS server
+			log.Printf("plugins/ddns: not updating %s in %s: %v", upd.name, upd.zone, err)
+			err = nil
+		} else if err != nil {
+			log.Printf("plugins/ddns: updating %s in %s failed: %v", upd.name, upd.zone, err)
+		}
+		updatersLock.Lock()
+		u.lastErr = err
+		updatersLock.Unlock()
+	}
+}
+
+// reverseName returns the name of the PTR record of an address.
+func reverseName(ip net.IP) string {
+	var b strings.Builder
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			fmt.Fprintf(&b, "%d.", ip4[i])
+		}
+		return b.String() + "in-addr.arpa."
+	}
+	ip16 := ip.To16()
+	for i := len(ip16) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip16[i]&0xf, ip16[i]>>4)
+	}
+	return b.String() + "ip6.arpa."
+}
+
+// encodeName encodes a fully qualified name in the DNS wire format, without
+// compression.
+func encodeName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func append16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func append32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendRR(b []byte, name string, rtype, class uint16, ttl uint32, rdata []byte) []byte {
+	b = append(b, encodeName(name)...)
+	b = append16(b, rtype)
+	b = append16(b, class)
+	b = append32(b, ttl)
+	b = append16(b, uint16(len(rdata)))
+	return append(b, rdata...)
+}
+
+// message returns the signed UPDATE message of an update, in the zone (RFC
+// 4703, section 5.3). Without DHCID, delete the records of the name with the
+// type of the update, and add the new one. With a DHCID, if the name is not in
+// use, add the new record and the DHCID, or else, if inUse is set and the name
+// holds the DHCID, replace its records with the type of the update by the new
+// one.
+func (u *updater) message(id uint16, upd *update, inUse bool, now time.Time) []byte {
+	b := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(b[0:], id)
+	binary.BigEndian.PutUint16(b[2:], opcodeUpdate<<11)
+	binary.BigEndian.PutUint16(b[4:], 1) // zone
+	binary.BigEndian.PutUint16(b[8:], 2) // updates
+	b = append(b, encodeName(upd.zone)...)
+	b = append16(b, typeSOA)
+	b = append16(b, classIN)
+	switch {
+	case upd.dhcid == nil:
+		b = appendRR(b, upd.name, upd.rtype, classANY, 0, nil)
+		b = appendRR(b, upd.name, upd.rtype, classIN, u.ttl, upd.rdata)
+	case !inUse:
+		binary.BigEndian.PutUint16(b[6:], 1) // prerequisites
+		binary.BigEndian.PutUint16(b[8:], 3) // updates
+		// the name is not in use (RFC 2136, section 2.4.5)
+		b = appendRR(b, upd.name, typeANY, classNONE, 0, nil)
+		b = appendRR(b, upd.name, upd.rtype, classIN, u.ttl, upd.rdata)
+		b = appendRR(b, upd.name, typeDHCID, classIN, u.ttl, upd.dhcid)
+	default:
+		binary.BigEndian.PutUint16(b[6:], 1) // prerequisites
+		// the name holds the DHCID (RFC 2136, section 2.4.2)
+		b = appendRR(b, upd.name, typeDHCID, classIN, 0, upd.dhcid)
+		b = appendRR(b, upd.name, upd.rtype, classANY, 0, nil)
+		b = appendRR(b, upd.name, upd.rtype, classIN, u.ttl, upd.rdata)
+	}
+	return u.sign(b, id, now)
+}
+
+// sign appends the TSIG record of a message, computed over the message and
+// the TSIG variables (RFC 8945, section 4.3.3).
+func (u *updater) sign(msg []byte, id uint16, now time.Time) []byte {
+	var timers []byte
+	signed := uint64(now.Unix())
+	timers = append16(timers, uint16(signed>>32))
+	timers = append32(timers, uint32(signed))
+	timers = append16(timers, fudge)
+
+	mac := hmac.New(sha256.New, u.key.secret)
+	mac.Write(msg)
+	mac.Write(encodeName(u.key.name))
+	var vars []byte
+	vars = append16(vars, classANY)
+	vars = append32(vars, 0)
+	vars = append(vars, encodeName(algorithm)...)
+	vars = append(vars, timers...)
+	vars = append16(vars, 0) // error
+	vars = append16(vars, 0) // other len
+	mac.Write(vars)
+	sum := mac.Sum(nil)
+
+	rdata := encodeName(algorithm)
+	rdata = append(rdata, timers...)
+	rdata = append16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append16(rdata, id)
+	rdata = append16(rdata, 0) // error
+	rdata = append16(rdata, 0) // other len
+	msg = appendRR(msg, u.key.name, typeTSIG, classANY, 0, rdata)
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return msg
+}
+
+// send sends an update, and checks the response code of the DNS server: the
+// records of a name in use are only replaced if it holds the DHCID of the
+// update, or else errConflict is returned.
+func (u *updater) send(upd *update) error {
+	rcode, err := u.exchange(upd, false)
+	if err == nil && rcode == rcodeYXDomain && upd.dhcid != nil {
+		rcode, err = u.exchange(upd, true)
+	}
+	switch {
+	case err != nil:
+		return err
+	case rcode == rcodeNXRRSet && upd.dhcid != nil:
+		return errConflict
+	case rcode != 0:
+		return fmt.Errorf("DNS server returned rcode %d", rcode)
+	}
+	return nil
+}
+
+// exchange sends the message of an update, and returns the response code of
+// the DNS server.
+func (u *updater) exchange(upd *update, inUse bool) (int, error) {
+	var b [2]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	id := binary.BigEndian.Uint16(b[:])
+	conn, err := net.DialTimeout("udp", u.server, timeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(u.message(id, upd, inUse, time.Now())); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n < 12 || binary.BigEndian.Uint16(buf) != id || buf[2]&0x80 == 0 {
+			continue
+		}
+		return int(buf[3] & 0xf), nil
+	}
+}
+
+// health reports the error of the last update sent by any running updater.
+func health() error {
+	updatersLock.Lock()
+	defer updatersLock.Unlock()
+	for _, u := range updaters {
+		if u.lastErr != nil {
+			return u.lastErr
+		}
+	}
+	return nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	u, err := getUpdater(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		hostname := handler.Hostname(ctx)
+		if resp == nil || hostname == "" {
+			return resp, false
+		}
+		reply, err := dhcputil.InnerMessage6(resp)
+		if err != nil || reply.Type() != dhcpv6.MessageTypeReply {
+			return resp, false
+		}
+		msg, err := dhcputil.InnerMessage6(req)
+		if err != nil {
+			return resp, false
+		}
+		cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+		if !ok {
+			return resp, false
+		}
+		c := client{idType: idDUID, id: cid.Cid.ToBytes()}
+		for _, addr := range dhcputil.IAAddresses6(reply) {
+			if addr.ValidLifetime > 0 {
+				u.register(ctx, c, hostname, addr.IPv6Addr)
+				break
+			}
+		}
+		return resp, false
+	}, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	u, err := getUpdater(args)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		hostname := handler.Hostname(ctx)
+		if resp == nil || hostname == "" || resp.MessageType() != dhcpv4.MessageTypeAck {
+			return resp, false
+		}
+		if ip := resp.YourIPAddr; ip != nil && !ip.IsUnspecified() {
+			u.register(ctx, client4(req), hostname, ip)
+		}
+		return resp, false
+	}, nil
+}
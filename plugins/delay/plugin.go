@@ -0,0 +1,197 @@
+package delay
+
+// This plugin slows down or sheds the answers to the clients looking for a
+// server, i.e. DHCPDISCOVERs and Solicits. Delaying the DHCPOFFERs and
+// Advertises lets a backup server leave the clients to a primary one, which
+// answers first, and ignoring a fraction of the requests, possibly per class,
+// stages the rollout of a new server next to an existing one. It should be the
+// last plugin of the chain, so that the delay applies to the final response.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - delay: offer=2s secs=5 ignore=lab:0 ignore=0.5
+//
+// The arguments are all optional:
+//   - offer=<duration>: the delay of the DHCPOFFERs and Advertises, which are
+//     dropped if the deadline of the transaction expires first;
+//   - secs=<seconds>: ignore the DHCPDISCOVERs of the clients that have
+//     been trying for less than this, from their `secs` field. This is the
+//     classic way to make a DHCPv4 server a backup;
+//   - ignore=[<class>:]<fraction>: the fraction, between 0 and 1, of the
+//     DHCPDISCOVERs and Solicits that are ignored, for the clients of a class
+//     or for all of them. The first matching class applies, in the order of
+//     the arguments.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("delay", setupDelay6, setupDelay4)
+	plugins.RegisterConstraints("delay", plugins.Constraints{After: []string{"oui", "userclass"}})
+	plugins.RegisterOverridable("delay")
+}
+
+// shedding is the fraction of the requests to ignore for the clients of a
+// class, or for all the clients if class is empty.
+type shedding struct {
+	class    string
+	fraction float64
+}
+
+type policy struct {
+	offer    time.Duration
+	minSecs  uint16
+	shedding []shedding
+
+	randLock sync.Mutex
+	rand     *rand.Rand
+}
+
+func parseArgs(args []string) (*policy, error) {
+	p := policy{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "offer":
+			d, err := time.ParseDuration(kv[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid delay `%s`", kv[1])
+			}
+			p.offer = d
+		case "secs":
+			secs, err := strconv.ParseUint(kv[1], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number of seconds `%s`", kv[1])
+			}
+			p.minSecs = uint16(secs)
+		case "ignore":
+			var s shedding
+			value := kv[1]
+			if idx := strings.LastIndex(value, ":"); idx >= 0 {
+				s.class, value = value[:idx], value[idx+1:]
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil || f < 0 || f > 1 {
+				return nil, fmt.Errorf("invalid fraction `%s`, must be between 0 and 1", value)
+			}
+			s.fraction = f
+			p.shedding = append(p.shedding, s)
+		default:
+			return nil, fmt.Errorf("unknown argument `%s`", kv[0])
+		}
+	}
+	if p.offer == 0 && p.minSecs == 0 && len(p.shedding) == 0 {
+		return nil, errors.New("need at least one of offer=, secs= or ignore=")
+	}
+	return &p, nil
+}
+
+func setupDelay6(args ...string) (handler.Handler6, error) {
+	p, err := parseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/delay: %v", err)
+	}
+	if p.minSecs != 0 {
+		return nil, errors.New("plugins/delay: `secs` is not supported for DHCPv6")
+	}
+	log.Printf("plugins/delay: delaying Advertises by %s", p.offer)
+	return p.Handler6, nil
+}
+
+func setupDelay4(args ...string) (handler.Handler4, error) {
+	p, err := parseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/delay: %v", err)
+	}
+	log.Printf("plugins/delay: delaying DHCPOFFERs by %s", p.offer)
+	return p.Handler4, nil
+}
+
+// ignore returns whether to ignore a request of the client of the
+// transaction, as per the shedding policy.
+func (p *policy) ignore(ctx context.Context) bool {
+	for _, s := range p.shedding {
+		if s.class != "" && !handler.InClass(ctx, s.class) {
+			continue
+		}
+		p.randLock.Lock()
+		r := p.rand.Float64()
+		p.randLock.Unlock()
+		return r < s.fraction
+	}
+	return false
+}
+
+// wait waits for the offer delay, and returns false if the transaction is
+// abandoned first, e.g. when its deadline expires.
+func (p *policy) wait(ctx context.Context) bool {
+	timer := time.NewTimer(p.offer)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Handler6 ignores a fraction of the Solicits, and delays the Advertises.
+func (p *policy) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || msg.Type() != dhcpv6.MessageTypeSolicit {
+		return resp, false
+	}
+	if p.ignore(ctx) {
+		logger.FromContext(ctx).Debug("plugins/delay: ignoring Solicit")
+		return nil, true
+	}
+	if resp != nil && p.offer > 0 {
+		if reply, err := dhcputil.InnerMessage6(resp); err == nil && reply.Type() == dhcpv6.MessageTypeAdvertise && !p.wait(ctx) {
+			return nil, true
+		}
+	}
+	return resp, false
+}
+
+// Handler4 ignores a fraction of the DHCPDISCOVERs, and delays the
+// DHCPOFFERs.
+func (p *policy) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() != dhcpv4.MessageTypeDiscover {
+		return resp, false
+	}
+	if req.NumSeconds < p.minSecs {
+		logger.FromContext(ctx).Debugf("plugins/delay: ignoring DHCPDISCOVER after %d seconds", req.NumSeconds)
+		return nil, true
+	}
+	if p.ignore(ctx) {
+		logger.FromContext(ctx).Debug("plugins/delay: ignoring DHCPDISCOVER")
+		return nil, true
+	}
+	if resp != nil && p.offer > 0 && resp.MessageType() == dhcpv4.MessageTypeOffer && !p.wait(ctx) {
+		return nil, true
+	}
+	return resp, false
+}
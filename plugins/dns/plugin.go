@@ -0,0 +1,205 @@
+package dns
+
+// This plugin provides the clients with their DNS resolvers and domain search
+// list: options 23 and 24 for DHCPv6, and options 6, 15 and 119 (RFC 3397)
+// for DHCPv4. The DHCPv6 options are only added to the responses to clients
+// that requested them.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ...
+//	        - dns: 2001:4860:4860::8888 2001:4860:4860::8844 search=example.org,corp.example.org
+//	server4:
+//	    plugins:
+//	        - dns: 8.8.8.8 8.8.4.4 search=example.org
+//
+// The arguments are the resolvers, of either family, and the domain search
+// list. They can be overridden per network, subnet, class or host with the
+// `dns` and `domain` options, see the options section of the configuration,
+// and an empty value disables an option. DHCPv4 clients get the first domain
+// as their domain name (option 15), and the list in option 119 if they
+// request it.
+//
+// The subnet of a DHCPv6 client is the one of the address assigned to it, or
+// else of the prefix delegated to it, or else of its link, so that the
+// subnets of the pools of addresses and of delegated prefixes can give their
+// clients different resolvers and domains. The plugin should therefore come
+// after the plugins that assign the addresses and prefixes.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dnsname"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// OptionDomainSearch4 is the DHCPv4 domain search option (RFC 3397).
+const OptionDomainSearch4 = dhcpv4.GenericOptionCode(119)
+
+func init() {
+	plugins.RegisterPlugin("dns", setupDNS6, setupDNS4)
+	plugins.RegisterConstraints("dns", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("dns")
+}
+
+// settings are the resolvers and domains of a plugin, which the options of
+// the client override.
+type settings struct {
+	servers []net.IP
+	domains []string
+}
+
+// parseServers parses the addresses of resolvers, and returns the ones of the
+// protocol: the lists can mix both families, e.g. in the global options shared
+// by the servers.
+func parseServers(values []string, v6 bool) ([]net.IP, error) {
+	var ret []net.IP
+	for _, v := range values {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid resolver address `%s`", v)
+		}
+		if (ip.To4() == nil) == v6 {
+			ret = append(ret, ip)
+		}
+	}
+	return ret, nil
+}
+
+func setup(args []string, v6 bool) (*settings, error) {
+	var (
+		s       settings
+		servers []string
+	)
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "search=") {
+			s.domains = strings.Split(strings.TrimPrefix(arg, "search="), ",")
+			if _, err := dnsname.Encode(s.domains...); err != nil {
+				return nil, fmt.Errorf("plugins/dns: %v", err)
+			}
+			continue
+		}
+		servers = append(servers, arg)
+	}
+	var err error
+	if s.servers, err = parseServers(servers, v6); err != nil {
+		return nil, fmt.Errorf("plugins/dns: %v", err)
+	}
+	if len(s.servers) == 0 && len(s.domains) == 0 {
+		return nil, errors.New("plugins/dns: need at least one resolver or search domain")
+	}
+	log.Printf("plugins/dns: using resolvers %v and search list %v", s.servers, s.domains)
+	return &s, nil
+}
+
+func setupDNS6(args ...string) (handler.Handler6, error) {
+	s, err := setup(args, true)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handler6, nil
+}
+
+func setupDNS4(args ...string) (handler.Handler4, error) {
+	s, err := setup(args, false)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handler4, nil
+}
+
+// resolve returns the resolvers and domains of a client, given its options.
+func (s *settings) resolve(opts map[string][]string, v6 bool) ([]net.IP, []string, error) {
+	servers, domains := s.servers, s.domains
+	if values, ok := opts["dns"]; ok {
+		var err error
+		if servers, err = parseServers(values, v6); err != nil {
+			return nil, nil, err
+		}
+	}
+	if values, ok := opts["domain"]; ok {
+		domains = values
+	}
+	return servers, domains, nil
+}
+
+// Handler6 adds the DNS options to the response.
+func (s *settings) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	wantServers, wantDomains := dhcputil.Requested6(msg, dhcpv6.OptionDNSRecursiveNameServer), dhcputil.Requested6(msg, dhcpv6.OptionDomainSearchList)
+	if !wantServers && !wantDomains {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	servers, domains, err := s.resolve(handler.Options(ctx, handler.Address6(ctx, req, resp), mac), true)
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/dns: invalid dns option: %v", err)
+		return resp, false
+	}
+	if wantServers && len(servers) > 0 {
+		var data []byte
+		for _, ip := range servers {
+			data = append(data, ip.To16()...)
+		}
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionDNSRecursiveNameServer, OptionData: data})
+	}
+	if wantDomains && len(domains) > 0 {
+		data, err := dnsname.Encode(domains...)
+		if err != nil {
+			logger.FromContext(ctx).Printf("plugins/dns: invalid domain option: %v", err)
+			return resp, false
+		}
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionDomainSearchList, OptionData: data})
+	}
+	return resp, false
+}
+
+// Handler4 adds the DNS options to the response.
+func (s *settings) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	servers, domains, err := s.resolve(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr), false)
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/dns: invalid dns option: %v", err)
+		return resp, false
+	}
+	if len(servers) > 0 {
+		resp.UpdateOption(dhcpv4.OptDNS(servers...))
+	}
+	if len(domains) > 0 {
+		resp.UpdateOption(dhcpv4.OptDomainName(domains[0]))
+		if req.IsOptionRequested(OptionDomainSearch4) {
+			data, err := dnsname.Encode(domains...)
+			if err != nil {
+				logger.FromContext(ctx).Printf("plugins/dns: invalid domain option: %v", err)
+				return resp, false
+			}
+			resp.UpdateOption(dhcpv4.OptGeneric(OptionDomainSearch4, data))
+		}
+	}
+	return resp, false
+}
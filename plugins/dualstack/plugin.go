@@ -0,0 +1,129 @@
+package dualstack
+
+// This plugin correlates the DHCPv4 and DHCPv6 identities of the clients in
+// the dual-stack table (see the dualstack package): the hardware addresses,
+// the DUIDs and the host names of the transactions. The table then gives a
+// single view of each host to the lease events and to the management API. It
+// should come after the `hostname` plugin, which sets the host names of the
+// transactions, and before `autohostname`.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ...
+//	        - hostname:
+//	        - dualstack: share-hostname
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - hostname:
+//	        - dualstack: share-hostname
+//
+// The DHCPv6 clients are linked to their hardware address when their DUID
+// contains it, or when their relay sends it (RFC 6939), and the DHCPv4
+// clients to their DUID when their client identifier contains it (RFC 4361).
+// Clients that are not linked otherwise are linked by their host name. With
+// `share-hostname`, the clients that do not send a host name get the one
+// their host has in the other protocol, so that the plugins registering them
+// in the DNS use the same name for both families of addresses.
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dualstack"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("dualstack", setup6, setup4)
+	plugins.RegisterConstraints("dualstack", plugins.Constraints{
+		After:    []string{"hostname"},
+		Before:   []string{"autohostname"},
+		Provides: []string{plugins.TagHostname},
+	})
+	plugins.RegisterOverridable("dualstack")
+}
+
+// duidClientID is the type of the RFC 4361 client identifiers, which are
+// followed by an IAID and a DUID.
+const duidClientID = 255
+
+type correlator struct {
+	shareHostname bool
+}
+
+func setup(args []string) (*correlator, error) {
+	var c correlator
+	for _, arg := range args {
+		switch arg {
+		case "share-hostname":
+			c.shareHostname = true
+		default:
+			return nil, fmt.Errorf("plugins/dualstack: unknown argument `%s`", arg)
+		}
+	}
+	log.Printf("plugins/dualstack: loaded, share-hostname=%v", c.shareHostname)
+	return &c, nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler6, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler4, nil
+}
+
+// share sets the host name of the transaction to the one of the host, if the
+// client has none.
+func (c *correlator) share(ctx context.Context, h *dualstack.Host) {
+	if c.shareHostname && h.FQDN != "" && handler.Hostname(ctx) == "" {
+		handler.SetHostname(ctx, h.FQDN)
+	}
+}
+
+// Handler6 records the identities of the DHCPv6 clients.
+func (c *correlator) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return resp, false
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	h := dualstack.Default.Learn6(hex.EncodeToString(cid.Cid.ToBytes()), mac, handler.Hostname(ctx), clock.Now())
+	c.share(ctx, h)
+	return resp, false
+}
+
+// Handler4 records the identities of the DHCPv4 clients.
+func (c *correlator) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	var duid string
+	if cid := req.GetOneOption(dhcpv4.OptionClientIdentifier); len(cid) > 5 && cid[0] == duidClientID {
+		duid = hex.EncodeToString(cid[5:])
+	}
+	h := dualstack.Default.Learn4(req.ClientHWAddr, duid, handler.Hostname(ctx), clock.Now())
+	c.share(ctx, h)
+	return resp, false
+}
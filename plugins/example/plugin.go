@@ -6,6 +6,8 @@ package example
 // Feedback is welcome!
 
 import (
+	"context"
+
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
@@ -68,9 +70,9 @@ func setupExample4(args ...string) (handler.Handler4, error) {
 }
 
 // exampleHandler6 handles DHCPv6 packets for the example plugin. It implements
-// the `handler.Handler6` interface. The input arguments are the request packet
-// that the server received from a client, and the response packet that has been
-// computed so far. This function returns the response packet to be sent back to
+// the `handler.Handler6` interface. The input arguments are a context specific
+// to this transaction, the request packet that the server received from a
+// client, and the response packet that has been computed so far. This function returns the response packet to be sent back to
 // the client, and a boolean.
 // The response can be either the same response packet received as input, a
 // modified response packet, or nil. If nil, the server will not reply to the
@@ -80,8 +82,11 @@ func setupExample4(args ...string) (handler.Handler4, error) {
 // respond to the client (or drop the response, if nil). If `false`, the server
 // will call the next plugin in the chan, using the returned response packet as
 // input for the next plugin.
-func exampleHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	log.Printf("plugins/example: received DHCPv6 packet: %s", req.Summary())
+// Use `logger.FromContext(ctx)` to log anything specific to this transaction:
+// the log lines will include its correlation ID, so that they can be told
+// apart from the ones of other transactions processed concurrently.
+func exampleHandler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	logger.FromContext(ctx).Printf("plugins/example: received DHCPv6 packet: %s", req.Summary())
 	// return the unmodified response, and false. This means that the next
 	// plugin in the chain will be called, and the unmodified response packet
 	// will be used as its input.
@@ -90,7 +95,7 @@ func exampleHandler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 
 // exampleHandler4 behaves like exampleHandler6, but for DHCPv4 packets. It
 // implements the `handler.Handler4` interface.
-func exampleHandler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+func exampleHandler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
 	// TODO check the MAC address in the request
 	//      if it is present in StaticRecords, forge a response
 	//      and stop processing.
@@ -0,0 +1,213 @@
+package expiryhook
+
+// This plugin POSTs a JSON event to a URL when a lease of the lease store
+// expires, e.g. to remove the DNS records of the client, or to update an
+// inventory system. The expiries are scheduled by the server, and delayed by
+// the `expiry-jitter` of the `leases` section. The plugin does not change the
+// responses, so it can be anywhere in the chain.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - expiryhook: http://dns-updater.example.org/expired
+//
+// Events are sent asynchronously, and dropped if they cannot be delivered.
+// The leases that expired shortly before the start of the server are sent
+// again, so the receiver must handle duplicates.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dualstack"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/metadata"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("expiryhook", setup6, setup4)
+	plugins.RegisterOverridable("expiryhook")
+	plugins.RegisterCommit("expiryhook", commit, discard)
+}
+
+// Event is the notification of the expiry of a lease.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Address  string    `json:"address"`
+	HWAddr   string    `json:"hw-address,omitempty"`
+	ClientID string    `json:"client-id,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Ends     time.Time `json:"ends"`
+	// Host is the identity of the client in both protocols, if the
+	// dualstack plugin correlated it.
+	Host *dualstack.Host `json:"host,omitempty"`
+	// Labels are the labels of the server and of the pool of the address.
+	Labels config.Labels `json:"labels,omitempty"`
+}
+
+// notifier POSTs the events to a URL.
+type notifier struct {
+	url    string
+	client *http.Client
+	queue  chan *Event
+	// done is closed to stop the notifier.
+	done chan struct{}
+}
+
+// notifiers holds the running notifiers by URL, so that reloading the
+// configuration, or using the plugin for both protocols, does not start a new
+// one. pending holds the notifiers used by the configuration being loaded,
+// which are started, and the others stopped, when it is committed.
+var (
+	notifiersLock sync.Mutex
+	notifiers     = make(map[string]*notifier)
+	pending       = make(map[string]*notifier)
+)
+
+func getNotifier(url string) *notifier {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	n, ok := notifiers[url]
+	if !ok {
+		n, ok = pending[url]
+	}
+	if !ok {
+		n = &notifier{
+			url:    url,
+			client: &http.Client{Timeout: 10 * time.Second},
+			queue:  make(chan *Event, 1000),
+			done:   make(chan struct{}),
+		}
+	}
+	pending[url] = n
+	return n
+}
+
+// commit starts the notifiers of the committed configuration, and stops the
+// others.
+func commit(loaded bool) {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	if !loaded {
+		pending = make(map[string]*notifier)
+	}
+	for url, n := range notifiers {
+		if _, ok := pending[url]; !ok {
+			leases.RegisterExpiryHook("expiryhook "+url, nil)
+			close(n.done)
+			delete(notifiers, url)
+		}
+	}
+	for url, n := range pending {
+		if _, ok := notifiers[url]; !ok {
+			notifiers[url] = n
+			go n.run()
+			leases.RegisterExpiryHook("expiryhook "+url, n.expired)
+		}
+	}
+	pending = make(map[string]*notifier)
+}
+
+// discard drops the notifiers of a configuration that was not committed.
+func discard() {
+	notifiersLock.Lock()
+	defer notifiersLock.Unlock()
+	pending = make(map[string]*notifier)
+}
+
+func (n *notifier) expired(l *leases.Lease) {
+	ev := Event{
+		Time:     clock.Now(),
+		Address:  l.IP.String(),
+		ClientID: l.ClientID,
+		Hostname: l.Hostname,
+		Ends:     l.Ends,
+		Host:     dualstack.Default.Lookup(l),
+		Labels:   metadata.Of(l.IP),
+	}
+	if l.HWAddr != nil {
+		ev.HWAddr = l.HWAddr.String()
+	}
+	select {
+	case n.queue <- &ev:
+	default:
+		log.Printf("plugins/expiryhook: event queue full, dropping the expiry of %s", ev.Address)
+	}
+}
+
+func (n *notifier) run() {
+	for {
+		var ev *Event
+		select {
+		case ev = <-n.queue:
+		case <-n.done:
+			return
+		}
+		if err := n.send(ev); err != nil {
+			log.Printf("plugins/expiryhook: failed to notify the expiry of %s: %v", ev.Address, err)
+		}
+	}
+}
+
+func (n *notifier) send(ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+func setup(args []string) error {
+	if len(args) != 1 {
+		return errors.New("plugins/expiryhook: need exactly one argument, the URL of the events")
+	}
+	if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("plugins/expiryhook: invalid URL `%s`", args[0])
+	}
+	getNotifier(args[0])
+	log.Printf("plugins/expiryhook: posting lease expiries to %s", args[0])
+	return nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	if err := setup(args); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		return resp, false
+	}, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	if err := setup(args); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		return resp, false
+	}, nil
+}
@@ -1,14 +1,37 @@
 package clientport
 
+// This plugin assigns the addresses reserved for the clients: the ones listed
+// in a file, one `<hardware address> <address>` per line, and the hosts of
+// the lease store, by client identifier (the DUID for DHCPv6) or hardware
+// address, such as the pre-reservations of the management API. The clients
+// without a reservation are left to the next plugins.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - server_id: LL 00:de:ad:be:ef:00
+//	        - file: leases.txt 12h
+//
+// The second argument is the lease time, one hour by default. The addresses
+// are bound in the lease store when the clients request them.
+
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
 	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
@@ -19,6 +42,24 @@ var log = logger.GetLogger()
 
 func init() {
 	plugins.RegisterPlugin("file", setupFile6, setupFile4)
+	plugins.RegisterConstraints("file", plugins.Constraints{Provides: []string{plugins.TagAddress}})
+	plugins.RegisterHealthCheck("file", health)
+}
+
+// leasesFile is the file the records were loaded from.
+var leasesFile string
+
+// health reports the plugin as unhealthy if the leases file is not readable
+// anymore.
+func health() error {
+	if leasesFile == "" {
+		return errors.New("plugins/file: no leases loaded")
+	}
+	f, err := os.Open(leasesFile)
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 // StaticRecords holds a MAC -> IP address mapping
@@ -34,7 +75,7 @@ var serverID *dhcpv6.OptServerId
 
 // LoadDHCPv6Records loads the DHCPv6Records global map with records stored on
 // the specified file. The records have to be one per line, a mac address and an
-// IPv6 address.
+// IP address, IPv6 for the DHCPv6 clients and IPv4 for the DHCPv4 ones.
 func LoadDHCPv6Records(filename string) (map[string]net.IP, error) {
 	log.Printf("plugins/file: reading leases from %s", filename)
 	data, err := ioutil.ReadFile(filename)
@@ -57,68 +98,242 @@ func LoadDHCPv6Records(filename string) (map[string]net.IP, error) {
 			return nil, fmt.Errorf("plugins/file: malformed hardware address: %s", tokens[0])
 		}
 		ipaddr := net.ParseIP(tokens[1])
-		if ipaddr.To16() == nil {
-			return nil, fmt.Errorf("plugins/file: expected an IPv6 address, got: %v", ipaddr)
+		if ipaddr == nil {
+			return nil, fmt.Errorf("plugins/file: expected an IP address, got: %s", tokens[1])
 		}
 		records[hwaddr.String()] = ipaddr
 	}
 	return records, nil
 }
 
-// Handler6 handles DHCPv6 packets for the file plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	mac, err := dhcpv6.ExtractMAC(req)
-	if err != nil {
-		return nil, false
+// defaultLeaseTime is the lease time of the reserved addresses when none is
+// configured.
+const defaultLeaseTime = time.Hour
+
+// assigner assigns the reserved addresses: the ones of the records of the
+// file, and the hosts of the lease store, e.g. the pre-reservations of the
+// management API or the hosts created through OMAPI.
+type assigner struct {
+	records   map[string]net.IP
+	leaseTime time.Duration
+}
+
+// reserved returns the address of the given family reserved for a client,
+// by hardware address, which can be nil, or by client identifier, which is
+// the DUID for DHCPv6, in hex, or nil if there is none.
+func (a *assigner) reserved(hwaddr net.HardwareAddr, clientID string, v4 bool) net.IP {
+	family := func(ip net.IP) net.IP {
+		if ip == nil || (ip.To4() != nil) != v4 {
+			return nil
+		}
+		if v4 {
+			return ip.To4()
+		}
+		return ip
+	}
+	if hwaddr != nil {
+		if ip := family(a.records[hwaddr.String()]); ip != nil {
+			return ip
+		}
+	}
+	now := clock.Now()
+	if host, err := leases.HostByClientID(leases.Default, clientID); err == nil && !host.Expired(now) {
+		if ip := family(host.IP); ip != nil {
+			return ip
+		}
 	}
+	if hwaddr != nil {
+		if host, err := leases.Default.HostByHWAddr(hwaddr); err == nil && !host.Expired(now) {
+			return family(host.IP)
+		}
+	}
+	return nil
+}
+
+// bind stores the lease of a reserved address, unless it is leased to
+// another client.
+func (a *assigner) bind(ip net.IP, hwaddr net.HardwareAddr, clientID string) error {
+	now := clock.Now()
+	return leases.Claim(leases.Default, &leases.Lease{
+		IP:       ip,
+		HWAddr:   hwaddr,
+		ClientID: clientID,
+		Starts:   now,
+		Ends:     now.Add(a.leaseTime),
+	})
+}
 
-	ipaddr, ok := StaticRecords[mac.String()]
-	if !ok {
-		return nil, false
+// release removes the lease of an address, if it is the one of the client.
+func release(ip net.IP, hwaddr net.HardwareAddr, clientID string) {
+	lease, err := leases.Default.Lease(ip)
+	if err != nil || !leases.SameClient(lease, &leases.Lease{HWAddr: hwaddr, ClientID: clientID}) {
+		return
+	}
+	if err := leases.Default.DeleteLease(ip); err != nil {
+		log.Printf("plugins/file: cannot release %s: %v", ip, err)
 	}
-	log.Printf("Found IP address %s for MAC %s", ipaddr, mac)
+}
+
+// Handler6 assigns the reserved addresses in the IA_NA options of the
+// DHCPv6 clients.
+func (a *assigner) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	if resp == nil {
-		resp, err = dhcpv6.NewAdvertiseFromSolicit(req)
-		if err != nil {
-			return nil, false
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	var duid string
+	if cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId); ok {
+		duid = hex.EncodeToString(cid.Cid.ToBytes())
+	}
+	// the hardware address is only known for some DUID types
+	mac, _ := dhcpv6.ExtractMAC(req)
+	ipaddr := a.reserved(mac, duid, false)
+	if ipaddr == nil {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		if err := a.bind(ipaddr, mac, duid); err != nil {
+			logger.FromContext(ctx).Printf("plugins/file: cannot bind %s to %s: %v", ipaddr, duid, err)
+			return resp, false
+		}
+	case dhcpv6.MessageTypeRelease:
+		release(ipaddr, mac, duid)
+		return resp, false
+	default:
+		return resp, false
+	}
+	// the reservation is one address, for the first IA_NA the client asks
+	for _, opt := range msg.GetOption(dhcpv6.OptionIANA) {
+		iana, ok := opt.(*dhcpv6.OptIANA)
+		if !ok {
+			continue
 		}
+		lifetime := uint32(a.leaseTime / time.Second)
+		reply.AddOption(&dhcpv6.OptIANA{
+			IaId: iana.IaId,
+			T1:   lifetime / 2,
+			T2:   lifetime * 4 / 5,
+			Options: []dhcpv6.Option{&dhcpv6.OptIAAddress{
+				IPv6Addr:          ipaddr,
+				PreferredLifetime: lifetime,
+				ValidLifetime:     lifetime,
+			}},
+		})
+		logger.FromContext(ctx).Printf("plugins/file: assigning %s to %s", ipaddr, duid)
+		break
 	}
-	// TODO add an OptIANA based on the above data
-	return resp, true
+	return resp, false
 }
 
-// Handler4 handles DHCPv4 packets for the file plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	// TODO check the MAC address in the request
-	//      if it is present in StaticRecords, forge a response
-	//      and stop processing.
-	return resp, true
+// Handler4 assigns the reserved addresses to the DHCPv4 clients, and NAKs the
+// DHCPREQUESTs of the clients for other addresses.
+func (a *assigner) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	var clientID string
+	if id := req.GetOneOption(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		clientID = hex.EncodeToString(id)
+	}
+	ipaddr := a.reserved(req.ClientHWAddr, clientID, true)
+	if ipaddr == nil {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+	case dhcpv4.MessageTypeRequest:
+		requested := req.RequestedIPAddress()
+		if requested == nil || requested.IsUnspecified() {
+			requested = req.ClientIPAddr
+		}
+		if requested != nil && !requested.IsUnspecified() && !requested.Equal(ipaddr) {
+			log.Printf("plugins/file: %s requested %s, but %s is reserved for it", req.ClientHWAddr, requested, ipaddr)
+			var serverID net.IP
+			if resp != nil {
+				serverID = resp.ServerIdentifier()
+			}
+			nak, err := dhcputil.Nak4(req, serverID, "address not reserved for the client")
+			if err != nil {
+				log.Printf("plugins/file: cannot build the DHCPNAK: %v", err)
+				return nil, true
+			}
+			return nak, true
+		}
+		if err := a.bind(ipaddr, req.ClientHWAddr, clientID); err != nil {
+			log.Printf("plugins/file: cannot bind %s to %s: %v", ipaddr, req.ClientHWAddr, err)
+			return nil, true
+		}
+	case dhcpv4.MessageTypeRelease:
+		release(ipaddr, req.ClientHWAddr, clientID)
+		return resp, false
+	default:
+		return resp, false
+	}
+	if resp == nil {
+		mt := dhcpv4.MessageTypeOffer
+		if req.MessageType() == dhcpv4.MessageTypeRequest {
+			mt = dhcpv4.MessageTypeAck
+		}
+		tmp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+		if err != nil {
+			log.Printf("plugins/file: NewReplyFromRequest failed: %v", err)
+			return resp, false
+		}
+		resp = tmp
+	}
+	resp.YourIPAddr = ipaddr
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(a.leaseTime))
+	log.Printf("plugins/file: assigning %s to %s", ipaddr, req.ClientHWAddr)
+	return resp, false
 }
 
 func setupFile6(args ...string) (handler.Handler6, error) {
-	h6, _, err := setupFile(true, args...)
-	return h6, err
+	a, err := setupFile(args...)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handler6, nil
 }
 
 func setupFile4(args ...string) (handler.Handler4, error) {
-	log.Print("plugins/file: loading `file` plugin for DHCPv4")
-	return nil, nil
+	a, err := setupFile(args...)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handler4, nil
 }
 
-func setupFile(v6 bool, args ...string) (handler.Handler6, handler.Handler4, error) {
+func setupFile(args ...string) (*assigner, error) {
 	if len(args) < 1 {
-		return nil, nil, errors.New("plugins/file: need a file name")
+		return nil, errors.New("plugins/file: need a file name")
 	}
 	filename := args[0]
 	if filename == "" {
-		return nil, nil, errors.New("plugins/file: got empty file name")
+		return nil, errors.New("plugins/file: got empty file name")
+	}
+	a := assigner{leaseTime: defaultLeaseTime}
+	if len(args) > 1 {
+		d, err := time.ParseDuration(args[1])
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("plugins/file: invalid lease time `%s`", args[1])
+		}
+		a.leaseTime = d
 	}
 	records, err := LoadDHCPv6Records(filename)
 	if err != nil {
-		return nil, nil, fmt.Errorf("plugins/file: failed to load DHCPv6 records: %v", err)
+		return nil, fmt.Errorf("plugins/file: failed to load records: %v", err)
 	}
 	log.Printf("plugins/file: loaded %d leases from %s", len(records), filename)
+	a.records = records
 	StaticRecords = records
+	leasesFile = filename
 
-	return Handler6, Handler4, nil
+	return &a, nil
 }
@@ -0,0 +1,218 @@
+package forcerenew
+
+// This plugin lets the server push configuration changes to the DHCPv4
+// clients, by sending them a DHCPFORCERENEW message (RFC 3203) that makes them
+// renew their lease. The messages are authenticated with the Forcerenew Nonce
+// Authentication protocol (RFC 6704), so only the clients that advertise their
+// support of it in the FORCERENEW_NONCE_CAPABLE option are reachable: the
+// plugin gives them a nonce in every DHCPACK, and keeps it to sign the
+// DHCPFORCERENEW messages. It should be the last plugin of the chain, so that it
+// sees the final response.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - forcerenew:
+//
+// The messages are sent with the management API, which must be enabled:
+//
+//	curl -X POST 'http://localhost:8053/forcerenew?client=00:11:22:33:44:55'
+//
+// Without the `client` parameter, all the known clients are sent one. The
+// clients are forgotten when their lease expires, and at most
+// dhcpauth.MaxClients are kept, the least recently seen ones being evicted.
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcpauth"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// Forcerenew message type and options (RFC 3203 and RFC 6704)
+const (
+	MessageTypeForceRenew        dhcpv4.MessageType = 9
+	OptionForcerenewNonceCapable                    = dhcpv4.GenericOptionCode(145)
+)
+
+// Types of the authentication information of the Forcerenew Nonce protocol
+const (
+	infoNonce  = 1
+	infoDigest = 2
+)
+
+// clientPort is the DHCPv4 client port.
+const clientPort = 68
+
+func init() {
+	plugins.RegisterPlugin("forcerenew", nil, setupForceRenew4)
+	plugins.RegisterEndpoint("forcerenew", "/forcerenew", http.HandlerFunc(serveForceRenew))
+}
+
+// client is the state of a client that can be sent a DHCPFORCERENEW, in
+// addition to its nonce.
+type client struct {
+	hwaddr   net.HardwareAddr
+	serverID net.IP
+}
+
+// clients holds the clients given a nonce, by hardware address. It is kept
+// across configuration reloads.
+var clients = dhcpauth.NewClients(dhcpauth.MaxClients)
+
+func setupForceRenew4(args ...string) (handler.Handler4, error) {
+	log.Print("plugins/forcerenew: giving nonces to the clients")
+	return Handler4, nil
+}
+
+// nonceCapable returns whether a client supports the Forcerenew Nonce
+// Authentication with HMAC-MD5.
+func nonceCapable(req *dhcpv4.DHCPv4) bool {
+	for _, alg := range req.GetOneOption(OptionForcerenewNonceCapable) {
+		if alg == dhcpauth.AlgorithmHMACMD5 {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler4 adds a nonce to the DHCPACKs sent to capable clients.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || resp.MessageType() != dhcpv4.MessageTypeAck || !nonceCapable(req) {
+		return resp, false
+	}
+	ip := resp.YourIPAddr
+	if ip == nil || ip.IsUnspecified() {
+		ip = req.ClientIPAddr
+	}
+	conn := handler.Conn(ctx)
+	if ip == nil || ip.IsUnspecified() || conn == nil {
+		return resp, false
+	}
+	if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && local.IP.To4() == nil && !local.IP.IsUnspecified() {
+		// DHCPv4-over-DHCPv6 clients cannot be reached
+		return resp, false
+	}
+	nonce, err := dhcpauth.NewKey()
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/forcerenew: cannot generate a nonce: %v", err)
+		return resp, false
+	}
+	auth := dhcpauth.Option{
+		Protocol:  dhcpauth.ProtocolForcerenewNonce,
+		Algorithm: dhcpauth.AlgorithmHMACMD5,
+		RDM:       dhcpauth.RDMMonotonic,
+		Replay:    dhcpauth.NextReplay(),
+		Info:      append([]byte{infoNonce}, nonce...),
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpauth.OptionAuthentication4, auth.ToBytes()))
+	clients.Add(&dhcpauth.Client{
+		ID:      req.ClientHWAddr.String(),
+		IP:      ip,
+		Key:     nonce,
+		Conn:    conn,
+		Expires: clock.Now().Add(resp.IPAddressLeaseTime(dhcpauth.DefaultClientTTL)),
+		Data:    &client{hwaddr: req.ClientHWAddr, serverID: resp.ServerIdentifier()},
+	})
+	return resp, false
+}
+
+// message returns the encoding of a signed DHCPFORCERENEW for a client.
+func message(c *dhcpauth.Client) ([]byte, error) {
+	state := c.Data.(*client)
+	msg, err := dhcpv4.New(
+		dhcpv4.WithHwAddr(state.hwaddr),
+		dhcpv4.WithMessageType(MessageTypeForceRenew),
+	)
+	if err != nil {
+		return nil, err
+	}
+	msg.OpCode = dhcpv4.OpcodeBootReply
+	if msg.TransactionID, err = dhcputil.TransactionID4(); err != nil {
+		return nil, err
+	}
+	if state.serverID != nil {
+		msg.UpdateOption(dhcpv4.OptServerIdentifier(state.serverID))
+	}
+	auth := dhcpauth.Option{
+		Protocol:  dhcpauth.ProtocolForcerenewNonce,
+		Algorithm: dhcpauth.AlgorithmHMACMD5,
+		RDM:       dhcpauth.RDMMonotonic,
+		Replay:    dhcpauth.NextReplay(),
+		Info:      make([]byte, 1+dhcpauth.DigestSize),
+	}
+	auth.Info[0] = infoDigest
+	msg.UpdateOption(dhcpv4.OptGeneric(dhcpauth.OptionAuthentication4, auth.ToBytes()))
+	b := dhcputil.Encode4(msg)
+	if err := dhcpauth.Sign4(c.Key, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// send sends a DHCPFORCERENEW to a client.
+func send(c *dhcpauth.Client) error {
+	b, err := message(c)
+	if err == nil {
+		_, err = c.Conn.WriteTo(b, &net.UDPAddr{IP: c.IP, Port: clientPort})
+	}
+	if err != nil {
+		log.Printf("plugins/forcerenew: cannot send DHCPFORCERENEW to %s (%s): %v", c.ID, c.IP, err)
+		return err
+	}
+	log.Printf("plugins/forcerenew: sent DHCPFORCERENEW to %s (%s)", c.ID, c.IP)
+	return nil
+}
+
+// ErrUnknownClient is returned by ForceRenew for a client that never got a
+// nonce, either because it did not get a lease or because it does not support
+// the Forcerenew Nonce Authentication, or whose lease expired.
+var ErrUnknownClient = dhcpauth.ErrUnknownClient
+
+// ForceRenew sends a DHCPFORCERENEW to the client with the given hardware
+// address, or to all the known clients if hwaddr is nil. It returns the
+// number of messages sent.
+func ForceRenew(hwaddr net.HardwareAddr) (int, error) {
+	var id string
+	if hwaddr != nil {
+		id = hwaddr.String()
+	}
+	return clients.Send(id, send)
+}
+
+// serveForceRenew implements POST /forcerenew?client=<hwaddr>.
+func serveForceRenew(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var hwaddr net.HardwareAddr
+	if c := r.URL.Query().Get("client"); c != "" {
+		var err error
+		if hwaddr, err = net.ParseMAC(c); err != nil {
+			management.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	sent, err := ForceRenew(hwaddr)
+	if err == ErrUnknownClient {
+		management.WriteError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil && sent == 0 {
+		management.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	management.WriteJSON(w, http.StatusOK, map[string]int{"sent": sent})
+}
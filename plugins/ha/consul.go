@@ -0,0 +1,174 @@
+package ha
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+)
+
+// checkTTL is the TTL of the Consul health check of the server, which is
+// renewed every third of it.
+const checkTTL = 30 * time.Second
+
+// deregisterAfter is how long a failed server stays registered in Consul.
+const deregisterAfter = 5 * time.Minute
+
+// discovery registers the server as an instance of a Consul service, and
+// keeps the list of the healthy instances, i.e. of the peers.
+type discovery struct {
+	endpoint string
+	service  string
+	id       string
+	address  string
+	client   *http.Client
+	// ctx is done when the discovery is stopped, which cancel does, and
+	// stopped is closed when run returns.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped chan struct{}
+
+	lock  sync.Mutex
+	peers []string
+	// err is the last error talking to Consul, if any.
+	err error
+}
+
+// same returns whether two discoveries have the same settings.
+func (d *discovery) same(o *discovery) bool {
+	return d.endpoint == o.endpoint && d.service == o.service && d.id == o.id && d.address == o.address
+}
+
+// start starts the discovery.
+func (d *discovery) start() {
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.stopped = make(chan struct{})
+	go d.run()
+}
+
+// stop stops the discovery, and deregisters the service instance of the
+// server, so that the peers take over its clients.
+func (d *discovery) stop() {
+	d.cancel()
+	<-d.stopped
+	log.Printf("plugins/ha: deregistering %s from %s", d.id, d.service)
+	if err := d.do(context.Background(), http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(d.id), nil, nil); err != nil {
+		log.Printf("plugins/ha: cannot deregister from Consul: %v", err)
+	}
+}
+
+// do sends a request to the Consul agent, and decodes the JSON response into
+// out, if not nil.
+func (d *discovery) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, d.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// register registers the service instance of the server, with a TTL check.
+func (d *discovery) register() error {
+	return d.do(d.ctx, http.MethodPut, "/v1/agent/service/register", map[string]interface{}{
+		"ID":      d.id,
+		"Name":    d.service,
+		"Address": d.address,
+		"Check": map[string]string{
+			"TTL":                            checkTTL.String(),
+			"DeregisterCriticalServiceAfter": deregisterAfter.String(),
+		},
+	}, nil)
+}
+
+// refresh renews the health check of the server, and fetches the healthy
+// instances of the service.
+func (d *discovery) refresh() ([]string, error) {
+	if err := d.do(d.ctx, http.MethodPut, "/v1/agent/check/pass/service:"+url.PathEscape(d.id), nil, nil); err != nil {
+		// the agent forgets the services when it restarts
+		if err := d.register(); err != nil {
+			return nil, err
+		}
+	}
+	var entries []struct {
+		Service struct {
+			ID string
+		}
+	}
+	if err := d.do(d.ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(d.service)+"?passing=1", nil, &entries); err != nil {
+		return nil, err
+	}
+	peers := make([]string, 0, len(entries))
+	for _, e := range entries {
+		peers = append(peers, e.Service.ID)
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+// run keeps the list of the peers up to date, until the context of the
+// discovery is done.
+func (d *discovery) run() {
+	defer close(d.stopped)
+	if err := d.register(); err != nil {
+		log.Printf("plugins/ha: cannot register in Consul: %v", err)
+	}
+	tick := clock.Default.NewTicker(checkTTL / 3)
+	defer tick.Stop()
+	for {
+		peers, err := d.refresh()
+		if d.ctx.Err() != nil {
+			return
+		}
+		d.lock.Lock()
+		if err != nil {
+			if d.err == nil {
+				log.Printf("plugins/ha: cannot refresh the peers: %v", err)
+			}
+		} else {
+			if fmt.Sprint(peers) != fmt.Sprint(d.peers) {
+				log.Printf("plugins/ha: peers are now %v", peers)
+			}
+			d.peers = peers
+		}
+		d.err = err
+		d.lock.Unlock()
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-tick.C():
+		}
+	}
+}
+
+// membership returns the sorted list of the peers, and the error of the last
+// refresh.
+func (d *discovery) membership() ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.peers, d.err
+}
@@ -0,0 +1,268 @@
+package ha
+
+// This plugin lets several servers share the clients of the same networks,
+// without listing the peers in their configuration: each server registers
+// itself as an instance of a Consul service, and the healthy instances of the
+// service are the peers. The clients are split between the peers by a hash of
+// their hardware address (DHCPv4) or DUID (DHCPv6) into 256 buckets, each
+// bucket served by the peer with the highest hash of its ID and the bucket
+// (rendezvous hashing), so that the peers agree on the split without talking
+// to each other, and a peer joining or leaving only moves its own share of
+// the buckets. It should be the first plugin of the chain.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ha: consul=http://127.0.0.1:8500 service=coredhcp id=dhcp1 address=192.0.2.1
+//
+// `consul` is the URL of the local Consul agent, `service` the name of the
+// service shared by the peers, `coredhcp` by default, `id` the unique name of
+// the server, its host name by default, and `address` the address registered
+// for it. Only the DHCPDISCOVERs and SOLICITs of the clients of other peers
+// are ignored: the clients keep renewing with the server that answered them.
+// If Consul cannot be reached, the server keeps the last known peers, and
+// serves all the clients if it never knew them. GET /ha shows the peers and
+// the buckets of the server. The discovery starts once the configuration is
+// committed: a reload with other arguments replaces it, and a reload without
+// the plugin stops it and deregisters the server.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// buckets is the number of hash buckets the clients are split into.
+const buckets = 256
+
+func init() {
+	plugins.RegisterPlugin("ha", setupHA6, setupHA4)
+	plugins.RegisterHealthCheck("ha", health)
+	plugins.RegisterEndpoint("ha", "/ha", http.HandlerFunc(serveHA))
+	plugins.RegisterCommit("ha", commit, discard)
+}
+
+// The discovery of the peers, shared by both protocols, and replaced when the
+// committed configuration changes its settings. pending is the discovery of
+// the configuration being loaded.
+var (
+	lock    sync.Mutex
+	current *discovery
+	pending *discovery
+)
+
+func setup(args []string) error {
+	d := discovery{service: "coredhcp", client: &http.Client{Timeout: 5 * time.Second}}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("plugins/ha: malformed argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "consul":
+			d.endpoint = strings.TrimSuffix(kv[1], "/")
+		case "service":
+			d.service = kv[1]
+		case "id":
+			d.id = kv[1]
+		case "address":
+			d.address = kv[1]
+		default:
+			return fmt.Errorf("plugins/ha: unknown argument `%s`", kv[0])
+		}
+	}
+	if d.endpoint == "" {
+		return errors.New("plugins/ha: need the URL of the Consul agent")
+	}
+	if d.id == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("plugins/ha: need an id: %v", err)
+		}
+		d.id = hostname
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	switch {
+	case pending != nil && pending.same(&d):
+	case current != nil && current.same(&d):
+		pending = current
+	default:
+		pending = &d
+	}
+	return nil
+}
+
+// commit starts the discovery of the committed configuration, if it changed,
+// once the previous one is stopped. The previous one keeps serving the
+// handlers until then, and is stopped out of the lock, as deregistering the
+// server can take a while.
+func commit(loaded bool) {
+	lock.Lock()
+	if !loaded {
+		pending = nil
+	}
+	next, prev := pending, current
+	pending = nil
+	lock.Unlock()
+	if next == prev {
+		return
+	}
+	if prev != nil {
+		prev.stop()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if next != nil {
+		log.Printf("plugins/ha: discovering the peers of %s as %s with %s", next.service, next.id, next.endpoint)
+		next.start()
+	}
+	current = next
+}
+
+// discard drops the discovery of a configuration that was not committed.
+func discard() {
+	lock.Lock()
+	defer lock.Unlock()
+	pending = nil
+}
+
+func setupHA6(args ...string) (handler.Handler6, error) {
+	if err := setup(args); err != nil {
+		return nil, err
+	}
+	return Handler6, nil
+}
+
+func setupHA4(args ...string) (handler.Handler4, error) {
+	if err := setup(args); err != nil {
+		return nil, err
+	}
+	return Handler4, nil
+}
+
+// bucket returns the hash bucket of a client.
+func bucket(clientID []byte) int {
+	h := fnv.New32a()
+	h.Write(clientID)
+	return int(h.Sum32() % buckets)
+}
+
+// owner returns the peer serving a bucket: the one with the highest hash of
+// its ID and the bucket.
+func owner(peers []string, b int) string {
+	var best string
+	var max uint64
+	for _, peer := range peers {
+		h := fnv.New64a()
+		h.Write([]byte(peer))
+		h.Write([]byte{byte(b)})
+		if sum := h.Sum64(); best == "" || sum > max {
+			best, max = peer, sum
+		}
+	}
+	return best
+}
+
+// serves returns whether the server serves a bucket. It serves all of them if
+// it is not among the peers, i.e. alone.
+func serves(d *discovery, b int) bool {
+	peers, _ := d.membership()
+	for _, peer := range peers {
+		if peer == d.id {
+			return owner(peers, b) == d.id
+		}
+	}
+	return true
+}
+
+// inScope returns whether the server serves a client.
+func inScope(clientID []byte) bool {
+	lock.Lock()
+	d := current
+	lock.Unlock()
+	if d == nil {
+		return true
+	}
+	return serves(d, bucket(clientID))
+}
+
+func health() error {
+	lock.Lock()
+	d := current
+	lock.Unlock()
+	if d == nil {
+		return nil
+	}
+	_, err := d.membership()
+	return err
+}
+
+// Status is the response of the /ha endpoint.
+type Status struct {
+	ID      string   `json:"id"`
+	Peers   []string `json:"peers"`
+	Buckets []int    `json:"buckets"`
+	Error   string   `json:"error,omitempty"`
+}
+
+func serveHA(w http.ResponseWriter, r *http.Request) {
+	lock.Lock()
+	d := current
+	lock.Unlock()
+	if d == nil {
+		management.WriteError(w, http.StatusServiceUnavailable, errors.New("peer discovery not started"))
+		return
+	}
+	peers, err := d.membership()
+	status := Status{ID: d.id, Peers: peers, Buckets: []int{}}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	for b := 0; b < buckets; b++ {
+		if serves(d, b) {
+			status.Buckets = append(status.Buckets, b)
+		}
+	}
+	management.WriteJSON(w, http.StatusOK, status)
+}
+
+// Handler6 ignores the SOLICITs of the clients of the other peers.
+func Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || msg.Type() != dhcpv6.MessageTypeSolicit {
+		return resp, false
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok || inScope(cid.Cid.ToBytes()) {
+		return resp, false
+	}
+	logger.FromContext(ctx).Debugf("plugins/ha: ignoring SOLICIT of a client of another peer")
+	return nil, true
+}
+
+// Handler4 ignores the DHCPDISCOVERs of the clients of the other peers.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() != dhcpv4.MessageTypeDiscover || inScope(req.ClientHWAddr) {
+		return resp, false
+	}
+	logger.FromContext(ctx).Debugf("plugins/ha: ignoring DHCPDISCOVER of a client of another peer")
+	return nil, true
+}
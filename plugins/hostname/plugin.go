@@ -0,0 +1,309 @@
+package hostname
+
+// This plugin applies a policy to the host names that the clients send (option
+// 12 or 81 for DHCPv4, option 39 for DHCPv6), before they are stored on the
+// leases and registered in the DNS: the characters that are invalid in host
+// names are stripped, and the names can be lowercased and made unique. The
+// resulting name is set as the host name of the transaction, so the
+// `autohostname` plugin does not name these clients. It should come after the
+// plugins that assign the addresses.
+//
+// Usage:
+//
+//	server4:
+//	    classes:
+//	        kiosks:
+//	            hostname: kiosk-{mac}
+//	    plugins:
+//	        - ...
+//	        - hostname: lowercase dedupe
+//
+// Only the letters, digits and hyphens of each label are kept, and labels are
+// cut at 63 characters. With `lowercase` the names are lowercased, and with
+// `dedupe` a name that another client holds a lease for gets a `-2`, `-3`, ...
+// suffix on its first label. The `hostname` option, set per network, subnet,
+// class or host, overrides the names that the clients send, with a template
+// that takes the placeholders of the `autohostname` plugin. DHCPv4 clients
+// that request the host name option get the first label of the name.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/autohostname"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Limits of the host names (RFC 1035)
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+// maxSuffix is the highest suffix that dedupe tries before giving up.
+const maxSuffix = 100
+
+func init() {
+	plugins.RegisterPlugin("hostname", setupHostname6, setupHostname4)
+	plugins.RegisterConstraints("hostname", plugins.Constraints{
+		Before:   []string{"autohostname"},
+		Provides: []string{plugins.TagHostname},
+	})
+	plugins.RegisterOverridable("hostname")
+}
+
+type policy struct {
+	lowercase bool
+	dedupe    bool
+}
+
+func setup(args []string) (*policy, error) {
+	var p policy
+	for _, arg := range args {
+		switch arg {
+		case "lowercase":
+			p.lowercase = true
+		case "dedupe":
+			p.dedupe = true
+		default:
+			return nil, fmt.Errorf("plugins/hostname: unknown argument `%s`", arg)
+		}
+	}
+	log.Printf("plugins/hostname: loaded policy, lowercase=%v dedupe=%v", p.lowercase, p.dedupe)
+	return &p, nil
+}
+
+func setupHostname6(args ...string) (handler.Handler6, error) {
+	p, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handler6, nil
+}
+
+func setupHostname4(args ...string) (handler.Handler4, error) {
+	p, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return p.Handler4, nil
+}
+
+// decodeName decodes a domain name in the DNS wire format, as in the client
+// FQDN options. A partial name ends without the root label.
+func decodeName(data []byte) string {
+	var labels []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if n == 0 || n+1 > len(data) {
+			break
+		}
+		labels = append(labels, string(data[1:n+1]))
+		data = data[n+1:]
+	}
+	return strings.Join(labels, ".")
+}
+
+// sanitize strips the invalid characters from a host name, and lowercases it
+// if configured.
+func (p *policy) sanitize(name string) string {
+	if p.lowercase {
+		name = strings.ToLower(name)
+	}
+	var labels []string
+	length := 0
+	for _, label := range strings.Split(name, ".") {
+		label = strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+				return r
+			}
+			return -1
+		}, label)
+		if len(label) > maxLabelLength {
+			label = label[:maxLabelLength]
+		}
+		label = strings.Trim(label, "-")
+		if label == "" {
+			continue
+		}
+		if length+len(label) > maxNameLength {
+			break
+		}
+		length += len(label) + 1
+		labels = append(labels, label)
+	}
+	return strings.Join(labels, ".")
+}
+
+// reserveTTL is how long a name stays reserved for the client it was given
+// to, until it is stored on its lease.
+const reserveTTL = time.Minute
+
+type reservation struct {
+	ip      net.IP
+	expires time.Time
+}
+
+var (
+	namesLock sync.Mutex
+	// reserved holds the names given by dedupe in the last reserveTTL, by
+	// their lowercase form, so that two concurrent clients do not get the
+	// same name before it is stored on the lease of either.
+	reserved = make(map[string]reservation)
+)
+
+// taken returns whether another client holds a lease with the given host
+// name, or was just given it.
+func taken(name string, ip net.IP, hwaddr net.HardwareAddr, now time.Time) (bool, error) {
+	if r, ok := reserved[strings.ToLower(name)]; ok && !r.ip.Equal(ip) {
+		return true, nil
+	}
+	held, err := leases.LeasesByHostname(leases.Default, name)
+	if err != nil {
+		return false, err
+	}
+	for _, lease := range held {
+		if lease.IP.Equal(ip) || lease.Expired(now) {
+			continue
+		}
+		if len(hwaddr) > 0 && bytes.Equal(lease.HWAddr, hwaddr) {
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// unique returns the host name, with a suffix on its first label if another
+// client holds it, and reserves it for the client.
+func unique(ctx context.Context, name string, ip net.IP, hwaddr net.HardwareAddr) string {
+	namesLock.Lock()
+	defer namesLock.Unlock()
+	now := clock.Now()
+	for n, r := range reserved {
+		if now.After(r.expires) {
+			delete(reserved, n)
+		}
+	}
+	parts := strings.SplitN(name, ".", 2)
+	candidate := name
+	for i := 1; i <= maxSuffix; i++ {
+		if i > 1 {
+			candidate = fmt.Sprintf("%s-%d", parts[0], i)
+			if len(parts) == 2 {
+				candidate += "." + parts[1]
+			}
+		}
+		held, err := taken(candidate, ip, hwaddr, now)
+		if err != nil {
+			logger.FromContext(ctx).Printf("plugins/hostname: cannot look up the leases of %s: %v", candidate, err)
+			return name
+		}
+		if !held {
+			reserved[strings.ToLower(candidate)] = reservation{ip: ip, expires: now.Add(reserveTTL)}
+			return candidate
+		}
+	}
+	logger.FromContext(ctx).Printf("plugins/hostname: no free name for %s", name)
+	return name
+}
+
+// apply applies the policy to the host name sent by a client, or to the one
+// of the `hostname` option, and assigns the result. It returns the assigned
+// name, or an empty string.
+func (p *policy) apply(ctx context.Context, sent string, ip net.IP, hwaddr net.HardwareAddr, opts map[string][]string) string {
+	name := sent
+	if values, ok := opts["hostname"]; ok && len(values) > 0 {
+		name = autohostname.Expand(values[0], ip, hwaddr)
+	}
+	name = p.sanitize(name)
+	if name == "" {
+		return ""
+	}
+	if p.dedupe {
+		name = unique(ctx, name, ip, hwaddr)
+	}
+	if name != sent {
+		logger.FromContext(ctx).Debugf("plugins/hostname: assigning %s instead of `%s` to %s", name, sent, ip)
+	}
+	autohostname.Assign(ctx, ip, name)
+	return name
+}
+
+// Handler6 applies the policy to the names of the DHCPv6 clients.
+func (p *policy) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	var sent string
+	if opt := msg.GetOneOption(autohostname.OptionClientFQDN6); opt != nil {
+		// flags, then the name
+		if data := dhcputil.OptionData6(opt); len(data) > 1 {
+			sent = decodeName(data[1:])
+		}
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	ip := dhcputil.FirstAddress6(reply)
+	if ip == nil {
+		return resp, false
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	opts := handler.Options(ctx, dhcputil.LinkAddress6(req), mac)
+	if _, ok := opts["hostname"]; sent == "" && !ok {
+		return resp, false
+	}
+	p.apply(ctx, sent, ip, mac, opts)
+	return resp, false
+}
+
+// sent4 returns the host name sent by a DHCPv4 client, from the client FQDN
+// option or the host name option.
+func sent4(req *dhcpv4.DHCPv4) string {
+	// flags, two obsolete rcode fields, then the name, in the wire format if
+	// the E flag is set
+	if data := req.GetOneOption(autohostname.OptionClientFQDN4); len(data) > 3 {
+		if data[0]&0x04 != 0 {
+			return decodeName(data[3:])
+		}
+		return string(data[3:])
+	}
+	return req.HostName()
+}
+
+// Handler4 applies the policy to the names of the DHCPv4 clients.
+func (p *policy) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() {
+		return resp, false
+	}
+	sent := sent4(req)
+	opts := handler.Options(ctx, resp.YourIPAddr, req.ClientHWAddr)
+	if _, ok := opts["hostname"]; sent == "" && !ok {
+		return resp, false
+	}
+	name := p.apply(ctx, sent, resp.YourIPAddr, req.ClientHWAddr, opts)
+	if name != "" && name != sent && req.IsOptionRequested(dhcpv4.OptionHostName) {
+		resp.UpdateOption(dhcpv4.OptHostName(strings.SplitN(name, ".", 2)[0]))
+	}
+	return resp, false
+}
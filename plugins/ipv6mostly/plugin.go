@@ -0,0 +1,231 @@
+package ipv6mostly
+
+// This plugin supports the rollout of IPv6-mostly networks, where the clients
+// that can live without IPv4 use NAT64 and DNS64 to reach the IPv4 internet.
+// DHCPv6 clients get the DNS64 resolvers in the DNS Recursive Name Server
+// option (23), and DHCPv4 clients that request the IPv6-Only Preferred option
+// (108, RFC 8925) get it, so that they disable IPv4. The clients that do not
+// request the option keep their IPv4 address.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ipv6mostly: prefix=64:ff9b::/96 dns=2001:db8::64,192.0.2.53
+//	server4:
+//	    plugins:
+//	        - ipv6mostly: wait=1800
+//
+// For DHCPv6, `dns` is a comma-separated list of resolvers. IPv4 resolvers are
+// embedded in the NAT64 prefix given by `prefix` (RFC 6052), so that the
+// resolvers are reached through the same prefix as the one the network
+// advertises with PREF64. The `dns64` option gives the DNS64 resolvers to
+// the classes of clients that take part in the rollout only. For DHCPv4,
+// `wait` is the number of seconds that the clients wait before trying IPv4
+// again, and the `v6only-wait` option changes it for a subnet or a class, or
+// keeps its clients on IPv4 when empty.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// OptionIPv6OnlyPreferred is the DHCPv4 IPv6-Only Preferred option code.
+const OptionIPv6OnlyPreferred = dhcpv4.GenericOptionCode(108)
+
+// minWait is the smallest V6ONLY_WAIT value (RFC 8925).
+const minWait = 300
+
+func init() {
+	plugins.RegisterPlugin("ipv6mostly", setupIPv6Mostly6, setupIPv6Mostly4)
+	plugins.RegisterConstraints("ipv6mostly", plugins.Constraints{Uses: plugins.OptionTags})
+}
+
+// Defaults used when no option definition overrides them.
+var (
+	prefix      *net.IPNet
+	defaultDNS  []byte
+	defaultWait uint32
+)
+
+// embed returns the IPv4-embedded IPv6 address of ip in the NAT64 prefix
+// (RFC 6052, section 2.2). Bits 64 to 71 are reserved and left zero.
+func embed(pfx *net.IPNet, ip net.IP) net.IP {
+	ones, _ := pfx.Mask.Size()
+	out := make(net.IP, net.IPv6len)
+	copy(out, pfx.IP.To16())
+	v4 := ip.To4()
+	pos := ones / 8
+	for _, b := range v4 {
+		if pos == 8 {
+			pos++
+		}
+		out[pos] = b
+		pos++
+	}
+	return out
+}
+
+// parsePrefix parses a NAT64 prefix, whose length must be one of those of RFC
+// 6052.
+func parsePrefix(s string) (*net.IPNet, error) {
+	_, pfx, err := net.ParseCIDR(s)
+	if err != nil || pfx.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix `%s`", s)
+	}
+	switch ones, _ := pfx.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("NAT64 prefix `%s` must be a /32, /40, /48, /56, /64 or /96", s)
+	}
+	return pfx, nil
+}
+
+// encodeDNS returns the payload of the DNS Recursive Name Server option for
+// the given resolvers.
+func encodeDNS(servers []string) ([]byte, error) {
+	var data []byte
+	for _, s := range servers {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid resolver address `%s`", s)
+		case ip.To4() != nil:
+			if prefix == nil {
+				return nil, fmt.Errorf("need a NAT64 prefix for the IPv4 resolver %s", s)
+			}
+			ip = embed(prefix, ip)
+		}
+		data = append(data, ip.To16()...)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("need at least one resolver")
+	}
+	return data, nil
+}
+
+// parseWait parses a V6ONLY_WAIT value.
+func parseWait(s string) (uint32, error) {
+	wait, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || wait < minWait {
+		return 0, fmt.Errorf("invalid wait `%s`, must be at least %d seconds", s, minWait)
+	}
+	return uint32(wait), nil
+}
+
+func setupIPv6Mostly6(args ...string) (handler.Handler6, error) {
+	var servers []string
+	prefix = nil
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/ipv6mostly: malformed argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "prefix":
+			pfx, err := parsePrefix(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("plugins/ipv6mostly: %v", err)
+			}
+			prefix = pfx
+		case "dns":
+			servers = strings.Split(kv[1], ",")
+		default:
+			return nil, fmt.Errorf("plugins/ipv6mostly: unknown argument `%s`", kv[0])
+		}
+	}
+	defaultDNS = nil
+	if len(servers) > 0 {
+		data, err := encodeDNS(servers)
+		if err != nil {
+			return nil, fmt.Errorf("plugins/ipv6mostly: %v", err)
+		}
+		defaultDNS = data
+	}
+	log.Printf("plugins/ipv6mostly: using DNS64 resolvers %v", servers)
+	return Handler6, nil
+}
+
+func setupIPv6Mostly4(args ...string) (handler.Handler4, error) {
+	if len(args) != 1 || !strings.HasPrefix(args[0], "wait=") {
+		return nil, errors.New("plugins/ipv6mostly: need a wait= value")
+	}
+	wait, err := parseWait(strings.TrimPrefix(args[0], "wait="))
+	if err != nil {
+		return nil, fmt.Errorf("plugins/ipv6mostly: %v", err)
+	}
+	defaultWait = wait
+	log.Printf("plugins/ipv6mostly: sending IPv6-Only Preferred with a wait of %d seconds", defaultWait)
+	return Handler4, nil
+}
+
+// Handler6 adds the DNS64 resolvers to the response.
+func Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || !dhcputil.Requested6(msg, dhcpv6.OptionDNSRecursiveNameServer) {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	data := defaultDNS
+	mac, _ := dhcpv6.ExtractMAC(req)
+	if err := handler.Override(handler.Options(ctx, dhcputil.LinkAddress6(req), mac), "dns64", func(values []string) (err error) {
+		data = nil
+		if len(values) > 0 {
+			data, err = encodeDNS(values)
+		}
+		return err
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/ipv6mostly: %v", err)
+		return resp, false
+	}
+	if data == nil {
+		return resp, false
+	}
+	reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionDNSRecursiveNameServer, OptionData: data})
+	return resp, false
+}
+
+// Handler4 adds the IPv6-Only Preferred option to the response.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || !req.IsOptionRequested(OptionIPv6OnlyPreferred) {
+		return resp, false
+	}
+	wait := defaultWait
+	if err := handler.Override(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr), "v6only-wait", func(values []string) (err error) {
+		wait = 0
+		if len(values) > 0 {
+			wait, err = parseWait(values[0])
+		}
+		return err
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/ipv6mostly: %v", err)
+		return resp, false
+	}
+	if wait == 0 {
+		return resp, false
+	}
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, wait)
+	resp.UpdateOption(dhcpv4.OptGeneric(OptionIPv6OnlyPreferred, data))
+	return resp, false
+}
@@ -0,0 +1,257 @@
+package leaselimit
+
+// This plugin limits the number of clients that hold a lease at the same time
+// behind each subscriber port, identified by the remote-id or the circuit-id
+// of the relay agent information option (option 82), e.g. to stop a customer
+// from bridging a hub on their port and draining the pool. Beyond the limit,
+// the DHCPDISCOVERs of new clients are dropped and their DHCPREQUESTs are
+// NAKed, while the clients that already hold a lease keep renewing it.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - relayinfo:
+//	        - ...
+//	        - leaselimit: max=4 key=remote-id
+//	        - relayinfo_echo:
+//
+// The key is `remote-id` (the default) or `circuit-id`. The circuit-ids are
+// only unique per relay, so they are counted per relay address (giaddr). The
+// limit can be overridden per network, subnet, class or host with the
+// `lease-limit` option, see the options section of the configuration, and 0
+// or an empty value disables it. A client counts against its port from its
+// DHCPACK until the lease expires or is released. The plugin must come after
+// the plugins that assign the addresses, whose responses it counts, and after
+// `relayinfo`, which drops the malformed options. Its DHCPNAKs echo option 82,
+// although they stop the chain before `relayinfo_echo`.
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/relayinfo"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// statRejected counts the clients refused beyond the limit of their port.
+const statRejected = "dhcp_lease_limit_rejected_total"
+
+// defaultLeaseTime is the lifetime assumed for a lease whose DHCPACK does not
+// carry one.
+const defaultLeaseTime = time.Hour
+
+// sweepInterval is the minimum interval between the removals of the expired
+// leases.
+const sweepInterval = time.Minute
+
+func init() {
+	plugins.RegisterPlugin("leaselimit", nil, setupLeaseLimit4)
+	plugins.RegisterConstraints("leaselimit", plugins.Constraints{
+		After:    []string{"relayinfo"},
+		Before:   []string{"relayinfo_echo"},
+		Requires: []string{plugins.TagAddress},
+		Uses:     []string{plugins.TagAddress},
+	})
+	plugins.RegisterOverridable("leaselimit")
+}
+
+type limiter struct {
+	max     int
+	circuit bool
+	lock    sync.Mutex
+	// ports holds the expiry of the leases of the clients, by hardware
+	// address, per subscriber port
+	ports map[string]map[string]time.Time
+	swept time.Time
+}
+
+// parse parses a limit.
+func parse(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid lease limit `%s`", s)
+	}
+	return n, nil
+}
+
+func setupLeaseLimit4(args ...string) (handler.Handler4, error) {
+	l := limiter{ports: make(map[string]map[string]time.Time)}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/leaselimit: unknown argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "max":
+			var err error
+			if l.max, err = parse(kv[1]); err != nil {
+				return nil, fmt.Errorf("plugins/leaselimit: %v", err)
+			}
+		case "key":
+			switch kv[1] {
+			case "remote-id":
+				l.circuit = false
+			case "circuit-id":
+				l.circuit = true
+			default:
+				return nil, fmt.Errorf("plugins/leaselimit: invalid key `%s`, must be remote-id or circuit-id", kv[1])
+			}
+		default:
+			return nil, fmt.Errorf("plugins/leaselimit: unknown argument `%s`", arg)
+		}
+	}
+	if l.max == 0 {
+		return nil, errors.New("plugins/leaselimit: need a limit, e.g. max=4")
+	}
+	log.Printf("plugins/leaselimit: limiting the leases to %d per %s", l.max, l.keyName())
+	return l.Handler4, nil
+}
+
+func (l *limiter) keyName() string {
+	if l.circuit {
+		return "circuit-id"
+	}
+	return "remote-id"
+}
+
+// port returns the subscriber port of a request, or an empty string if its
+// relay does not identify it.
+func (l *limiter) port(req *dhcpv4.DHCPv4) string {
+	if !l.circuit {
+		if id := relayinfo.Suboption(req, relayinfo.SuboptionRemoteID); len(id) > 0 {
+			return hex.EncodeToString(id)
+		}
+		return ""
+	}
+	if id := relayinfo.Suboption(req, relayinfo.SuboptionCircuitID); len(id) > 0 {
+		return req.GatewayIPAddr.String() + "/" + hex.EncodeToString(id)
+	}
+	return ""
+}
+
+// limit returns the limit of a client, given its options.
+func (l *limiter) limit(opts map[string][]string) (int, error) {
+	values, ok := opts["lease-limit"]
+	if !ok {
+		return l.max, nil
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+	return parse(values[0])
+}
+
+// admit returns whether a client can hold a lease behind a port, and records
+// the lease until its expiry if set.
+func (l *limiter) admit(port, client string, max int, expiry time.Time, now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	clients := l.ports[port]
+	if until, ok := clients[client]; !ok || !until.After(now) {
+		active := 0
+		for _, until := range clients {
+			if until.After(now) {
+				active++
+			}
+		}
+		if active >= max {
+			return false
+		}
+	}
+	if !expiry.IsZero() {
+		if clients == nil {
+			clients = make(map[string]time.Time)
+			l.ports[port] = clients
+		}
+		clients[client] = expiry
+	}
+	return true
+}
+
+// release forgets the lease of a client behind a port.
+func (l *limiter) release(port, client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.ports[port], client)
+	if len(l.ports[port]) == 0 {
+		delete(l.ports, port)
+	}
+}
+
+// sweep removes the expired leases. The lock must be held.
+func (l *limiter) sweep(now time.Time) {
+	l.swept = now
+	for port, clients := range l.ports {
+		for client, until := range clients {
+			if !until.After(now) {
+				delete(clients, client)
+			}
+		}
+		if len(clients) == 0 {
+			delete(l.ports, port)
+		}
+	}
+}
+
+// Handler4 refuses the new clients of the ports that reached their limit.
+func (l *limiter) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	port := l.port(req)
+	if port == "" {
+		return resp, false
+	}
+	client := req.ClientHWAddr.String()
+	if req.MessageType() == dhcpv4.MessageTypeRelease {
+		l.release(port, client)
+		return resp, false
+	}
+	if resp == nil || resp.YourIPAddr == nil || resp.YourIPAddr.IsUnspecified() {
+		return resp, false
+	}
+	max, err := l.limit(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr))
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/leaselimit: invalid lease-limit option: %v", err)
+		return resp, false
+	}
+	if max == 0 {
+		return resp, false
+	}
+	now := clock.Now()
+	var expiry time.Time
+	if resp.MessageType() == dhcpv4.MessageTypeAck {
+		expiry = now.Add(resp.IPAddressLeaseTime(defaultLeaseTime))
+	}
+	if l.admit(port, client, max, expiry, now) {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	stats.Inc(statRejected, "key", l.keyName())
+	if req.MessageType() != dhcpv4.MessageTypeRequest {
+		log.Printf("plugins/leaselimit: dropping %s from %s, %s %s reached its limit of %d leases", req.MessageType(), client, l.keyName(), port, max)
+		return nil, true
+	}
+	log.Printf("plugins/leaselimit: NAKing %s from %s, %s %s reached its limit of %d leases", req.MessageType(), client, l.keyName(), port, max)
+	nak, err := dhcputil.Nak4(req, resp.ServerIdentifier(), "lease limit reached")
+	if err != nil {
+		log.Printf("plugins/leaselimit: NewReplyFromRequest failed: %v", err)
+		return nil, true
+	}
+	return nak, true
+}
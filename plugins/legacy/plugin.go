@@ -0,0 +1,152 @@
+package legacy
+
+// This plugin provides the options of the legacy Unix infrastructure services
+// (RFC 2132), such as NIS and NIS+, mail, news and printing, for the networks
+// that still depend on them. The old clients list them in their parameter
+// request lists, and the others never see them.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - legacy: nis-domain=corp nis-servers=10.0.0.5,10.0.0.6 smtp-servers=10.0.0.25
+//
+// Each `<name>=<value>` argument sets an option, with a comma-separated list
+// of addresses for the server options. The options are:
+//   - lpr-servers (9), nis-servers (41), ntp-servers (42), nisplus-servers
+//     (65), smtp-servers (69), pop3-servers (70), nntp-servers (71),
+//     www-servers (72), finger-servers (73) and irc-servers (74), as IPv4
+//     addresses;
+//   - nis-domain (40) and nisplus-domain (64), as strings.
+//
+// The option definitions of the same names, with space-separated addresses,
+// set them for the old networks only, e.g. on their subnets, and an empty one
+// withholds an option set by the arguments.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// option is a legacy option, with its code and whether it holds addresses or
+// a string.
+type option struct {
+	code      dhcpv4.OptionCode
+	addresses bool
+}
+
+// options are the legacy options, by name.
+var options = map[string]option{
+	"lpr-servers":     {dhcpv4.GenericOptionCode(9), true},
+	"nis-domain":      {dhcpv4.GenericOptionCode(40), false},
+	"nis-servers":     {dhcpv4.GenericOptionCode(41), true},
+	"ntp-servers":     {dhcpv4.GenericOptionCode(42), true},
+	"nisplus-domain":  {dhcpv4.GenericOptionCode(64), false},
+	"nisplus-servers": {dhcpv4.GenericOptionCode(65), true},
+	"smtp-servers":    {dhcpv4.GenericOptionCode(69), true},
+	"pop3-servers":    {dhcpv4.GenericOptionCode(70), true},
+	"nntp-servers":    {dhcpv4.GenericOptionCode(71), true},
+	"www-servers":     {dhcpv4.GenericOptionCode(72), true},
+	"finger-servers":  {dhcpv4.GenericOptionCode(73), true},
+	"irc-servers":     {dhcpv4.GenericOptionCode(74), true},
+}
+
+func init() {
+	plugins.RegisterPlugin("legacy", nil, setupLegacy4)
+	plugins.RegisterConstraints("legacy", plugins.Constraints{Uses: plugins.OptionTags})
+}
+
+// defaults are the payloads of the options set by the arguments, by name.
+var defaults map[string][]byte
+
+// encode returns the payload of an option.
+func encode(opt option, values []string) ([]byte, error) {
+	if !opt.addresses {
+		s := strings.Join(values, " ")
+		if s == "" {
+			return nil, errors.New("empty value")
+		}
+		return []byte(s), nil
+	}
+	var data []byte
+	for _, v := range values {
+		ip := net.ParseIP(v)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address `%s`", v)
+		}
+		data = append(data, ip.To4()...)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("need at least one address")
+	}
+	return data, nil
+}
+
+func setupLegacy4(args ...string) (handler.Handler4, error) {
+	d := make(map[string][]byte, len(args))
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/legacy: malformed argument `%s`", arg)
+		}
+		opt, ok := options[kv[0]]
+		if !ok {
+			return nil, fmt.Errorf("plugins/legacy: unknown option `%s`", kv[0])
+		}
+		data, err := encode(opt, strings.Split(kv[1], ","))
+		if err != nil {
+			return nil, fmt.Errorf("plugins/legacy: %s: %v", kv[0], err)
+		}
+		d[kv[0]] = data
+	}
+	defaults = d
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("plugins/legacy: providing options %v", names)
+	return Handler4, nil
+}
+
+// Handler4 adds the requested legacy options to the response.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	var opts map[string][]string
+	for name, opt := range options {
+		if !req.IsOptionRequested(opt.code) {
+			continue
+		}
+		if opts == nil {
+			opts = handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr)
+		}
+		data := defaults[name]
+		if err := handler.Override(opts, name, func(values []string) (err error) {
+			data = nil
+			if len(values) > 0 {
+				data, err = encode(opt, values)
+			}
+			return err
+		}); err != nil {
+			logger.FromContext(ctx).Printf("plugins/legacy: %v", err)
+			continue
+		}
+		if data != nil {
+			resp.UpdateOption(dhcpv4.OptGeneric(opt.code, data))
+		}
+	}
+	return resp, false
+}
@@ -0,0 +1,140 @@
+package linksel
+
+// This plugin selects the link of the DHCPv4 clients from the subnet
+// selection option (RFC 3011) or the link selection suboption of the relay
+// agent information (RFC 3527), rather than from the address of the relay.
+// This is required when the relay cannot use an address of the link of the
+// client as giaddr, e.g. in MPLS/VRF topologies. Later plugins choose the
+// subnet, and so the pool and options, from the selected link. It is made of
+// two plugins: `linksel` selects the link and should be the first plugin of
+// the chain, and `linksel_echo` echoes the selection in the responses, as the
+// RFCs require, and should be the last one.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - linksel: 10.255.0.0/24 10.255.1.1/32
+//	        - ...
+//	        - linksel_echo:
+//
+// The arguments are the prefixes of the relays allowed to select the link,
+// matched against the source address of the requests, not against their
+// giaddr, which is set by the client's side: the options are ignored in the
+// requests of other relays, and of the clients that are not relayed. The subnet
+// selection option takes precedence over the link selection suboption.
+//
+// The subnet selection option is echoed in the responses if it selected the
+// link. The link selection suboption is echoed within the relay agent
+// information, which `linksel_echo` copies into the responses that do not have
+// it yet, e.g. if `relayinfo_echo` is not in the chain.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// Link selection option codes
+const (
+	OptionSubnetSelection = dhcpv4.GenericOptionCode(118)
+	// SubOptionLinkSelection is a suboption of the relay agent information.
+	SubOptionLinkSelection = dhcpv4.GenericOptionCode(5)
+)
+
+func init() {
+	plugins.RegisterPlugin("linksel", nil, setupLinkSel4)
+	plugins.RegisterPlugin("linksel_echo", nil, setupEcho4)
+	plugins.RegisterConstraints("linksel", plugins.Constraints{Provides: []string{plugins.TagLinkAddress}})
+	plugins.RegisterOverridable("linksel")
+	plugins.RegisterConstraints("linksel_echo", plugins.Constraints{After: []string{"linksel"}})
+	plugins.RegisterOverridable("linksel_echo")
+}
+
+type selector struct {
+	trusted []*net.IPNet
+}
+
+func setupLinkSel4(args ...string) (handler.Handler4, error) {
+	var s selector
+	for _, arg := range args {
+		_, prefix, err := net.ParseCIDR(arg)
+		if err != nil || prefix.IP.To4() == nil {
+			return nil, fmt.Errorf("plugins/linksel: invalid relay prefix `%s`", arg)
+		}
+		s.trusted = append(s.trusted, prefix)
+	}
+	if len(s.trusted) == 0 {
+		return nil, errors.New("plugins/linksel: need at least one trusted relay prefix")
+	}
+	log.Printf("plugins/linksel: trusting %d relay prefix(es)", len(s.trusted))
+	return s.Handler4, nil
+}
+
+func setupEcho4(args ...string) (handler.Handler4, error) {
+	log.Print("plugins/linksel: echoing the link selection")
+	return Echo4, nil
+}
+
+// trust returns whether the relay that sent a request can select the link of
+// its clients.
+func (s *selector) trust(peer net.Addr) bool {
+	addr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range s.trusted {
+		if prefix.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler4 selects the link of the client.
+func (s *selector) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified() || !s.trust(handler.Peer(ctx)) {
+		return resp, false
+	}
+	var link []byte
+	if data := req.GetOneOption(OptionSubnetSelection); data != nil {
+		link = data
+	} else if info := req.RelayAgentInfo(); info != nil {
+		link = info.Get(SubOptionLinkSelection)
+	}
+	if link == nil {
+		return resp, false
+	}
+	if len(link) != net.IPv4len {
+		logger.FromContext(ctx).Printf("plugins/linksel: ignoring malformed link selection from %v", handler.Peer(ctx))
+		return resp, false
+	}
+	handler.SetLinkAddress(ctx, net.IP(link))
+	return resp, false
+}
+
+// Echo4 echoes the link selection of the request in the response: the subnet
+// selection option if it selected the link (RFC 3011, section 3), and the
+// relay agent information with the link selection suboption (RFC 3527,
+// section 4.1) if the response does not have one yet.
+func Echo4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	if data := req.GetOneOption(OptionSubnetSelection); data != nil && net.IP(data).Equal(handler.LinkAddress(ctx)) {
+		resp.UpdateOption(dhcpv4.OptGeneric(OptionSubnetSelection, data))
+	}
+	if info := req.RelayAgentInfo(); info != nil && info.Get(SubOptionLinkSelection) != nil &&
+		resp.GetOneOption(dhcpv4.OptionRelayAgentInformation) == nil {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, req.GetOneOption(dhcpv4.OptionRelayAgentInformation)))
+	}
+	return resp, false
+}
@@ -0,0 +1,379 @@
+package logship
+
+// This plugin forwards a structured record of every transaction to
+// Elasticsearch, through the bulk API, or to Loki, through the push API. It
+// should be the last plugin of the chain, so that it sees the final response.
+// Records are sent in batches, asynchronously: if the backend is unreachable,
+// sending is retried with exponential backoff, and records are dropped when
+// the queue is full rather than slowing down the server.
+//
+// Usage:
+//
+//	plugins:
+//	    - logship: elasticsearch http://localhost:9200 coredhcp
+//	    - logship: loki http://localhost:3100
+//
+// The third argument is the index name for Elasticsearch, and the value of
+// the `job` label for Loki. It defaults to `coredhcp`.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("logship", setup6, setup4)
+	plugins.RegisterHealthCheck("logship", health)
+	plugins.RegisterCommit("logship", commit, discard)
+	plugins.RegisterOverridable("logship")
+}
+
+const (
+	queueSize     = 10000
+	batchSize     = 500
+	flushInterval = time.Second
+	maxAttempts   = 5
+	maxBackoff    = time.Minute
+)
+
+// Record is the structured record of a transaction.
+type Record struct {
+	Time time.Time `json:"@timestamp"`
+	// Version is either 4 or 6.
+	Version       int    `json:"version"`
+	CorrelationID string `json:"cid,omitempty"`
+	// Client is the client hardware address for DHCPv4, and the client DUID
+	// for DHCPv6.
+	Client  string `json:"client,omitempty"`
+	Request string `json:"request"`
+	// Response is the message type of the response, or empty if there is
+	// no response yet.
+	Response  string   `json:"response,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// backend encodes a batch of records into the body of a request to a log
+// store.
+type backend interface {
+	newRequest(records []*Record) (*http.Request, error)
+}
+
+type elasticsearch struct {
+	url, index string
+}
+
+func (e *elasticsearch) newRequest(records []*Record) (*http.Request, error) {
+	var body bytes.Buffer
+	action, err := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": e.index}})
+	if err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		doc, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	return req, nil
+}
+
+type loki struct {
+	url, job string
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (l *loki) newRequest(records []*Record) (*http.Request, error) {
+	stream := lokiStream{Stream: map[string]string{"job": l.job}}
+	for _, rec := range records {
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return nil, err
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(rec.Time.UnixNano(), 10), string(line)})
+	}
+	body, err := json.Marshal(map[string][]lokiStream{"streams": {stream}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, l.url+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// shipper batches the records and sends them to a backend.
+type shipper struct {
+	backend backend
+	client  *http.Client
+	queue   chan *Record
+	// done is closed to stop the shipper.
+	done chan struct{}
+
+	lock    sync.Mutex
+	lastErr error
+	dropped uint64
+}
+
+// shippers holds the running shippers by their arguments, so that loading the
+// plugin for both protocols, or reloading the configuration, does not start a
+// new one. pending holds the shippers used by the configuration being loaded,
+// which are started, and the others stopped, when it is committed.
+var (
+	shippersLock sync.Mutex
+	shippers     = make(map[string]*shipper)
+	pending      = make(map[string]*shipper)
+)
+
+func getShipper(args []string) (*shipper, error) {
+	if len(args) < 2 {
+		return nil, errors.New("plugins/logship: need a backend type and URL")
+	}
+	name := "coredhcp"
+	if len(args) > 2 {
+		name = args[2]
+	}
+	url := strings.TrimRight(args[1], "/")
+	var b backend
+	switch strings.ToLower(args[0]) {
+	case "elasticsearch":
+		b = &elasticsearch{url: url, index: name}
+	case "loki":
+		b = &loki{url: url, job: name}
+	default:
+		return nil, fmt.Errorf("plugins/logship: unknown backend `%s`", args[0])
+	}
+	key := strings.Join([]string{strings.ToLower(args[0]), url, name}, " ")
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	s, ok := shippers[key]
+	if !ok {
+		s, ok = pending[key]
+	}
+	if !ok {
+		s = &shipper{
+			backend: b,
+			client:  &http.Client{Timeout: 10 * time.Second},
+			queue:   make(chan *Record, queueSize),
+			done:    make(chan struct{}),
+		}
+	}
+	pending[key] = s
+	return s, nil
+}
+
+// commit starts the shippers of the committed configuration, and stops the
+// others.
+func commit(loaded bool) {
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	if !loaded {
+		pending = make(map[string]*shipper)
+	}
+	for key, s := range shippers {
+		if _, ok := pending[key]; !ok {
+			close(s.done)
+			delete(shippers, key)
+		}
+	}
+	for key, s := range pending {
+		if _, ok := shippers[key]; !ok {
+			shippers[key] = s
+			go s.run()
+		}
+	}
+	pending = make(map[string]*shipper)
+}
+
+// discard drops the shippers of a configuration that was not committed.
+func discard() {
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	pending = make(map[string]*shipper)
+}
+
+// ship enqueues a record, or drops it if the queue is full.
+func (s *shipper) ship(rec *Record) {
+	select {
+	case s.queue <- rec:
+	default:
+		s.lock.Lock()
+		s.dropped++
+		s.lock.Unlock()
+	}
+}
+
+func (s *shipper) run() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Record, 0, batchSize)
+	for {
+		select {
+		case rec := <-s.queue:
+			batch = append(batch, rec)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.done:
+			if len(batch) > 0 {
+				s.flush(batch)
+			}
+			return
+		}
+		s.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush sends a batch, retrying with exponential backoff on failure. The
+// batch is dropped after maxAttempts failures.
+func (s *shipper) flush(batch []*Record) {
+	backoff := time.Second
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = s.send(batch); err == nil {
+			break
+		}
+		log.Printf("plugins/logship: sending %d records failed (attempt %d/%d): %v", len(batch), attempt, maxAttempts, err)
+		if attempt < maxAttempts {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastErr = err
+	if err != nil {
+		s.dropped += uint64(len(batch))
+	}
+	if s.dropped > 0 {
+		log.Printf("plugins/logship: dropped %d records so far", s.dropped)
+	}
+}
+
+func (s *shipper) send(batch []*Record) error {
+	req, err := s.backend.newRequest(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return nil
+}
+
+// health reports the error of the last batch sent by any running shipper.
+func health() error {
+	shippersLock.Lock()
+	defer shippersLock.Unlock()
+	for _, s := range shippers {
+		s.lock.Lock()
+		err := s.lastErr
+		s.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	s, err := getShipper(args)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("plugins/logship: shipping DHCPv6 transactions to %s", args[1])
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		msg, err := dhcputil.InnerMessage6(req)
+		if err != nil {
+			logger.FromContext(ctx).Printf("plugins/logship: cannot decapsulate request: %v", err)
+			return resp, false
+		}
+		rec := Record{
+			Time:          time.Now(),
+			Version:       6,
+			CorrelationID: logger.CorrelationID(ctx),
+			Request:       msg.Type().String(),
+		}
+		if opt, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId); ok {
+			rec.Client = opt.Cid.String()
+		}
+		if resp != nil {
+			if msg, err := dhcputil.InnerMessage6(resp); err == nil {
+				rec.Response = msg.Type().String()
+				for _, addr := range dhcputil.IAAddresses6(msg) {
+					rec.Addresses = append(rec.Addresses, addr.IPv6Addr.String())
+				}
+			}
+		}
+		s.ship(&rec)
+		return resp, false
+	}, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	s, err := getShipper(args)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("plugins/logship: shipping DHCPv4 transactions to %s", args[1])
+	return func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		rec := Record{
+			Time:          time.Now(),
+			Version:       4,
+			CorrelationID: logger.CorrelationID(ctx),
+			Client:        req.ClientHWAddr.String(),
+			Request:       req.MessageType().String(),
+		}
+		if resp != nil {
+			rec.Response = resp.MessageType().String()
+			if resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified() {
+				rec.Addresses = []string{resp.YourIPAddr.String()}
+			}
+		}
+		s.ship(&rec)
+		return resp, false
+	}, nil
+}
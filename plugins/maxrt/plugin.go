@@ -0,0 +1,99 @@
+package maxrt
+
+// This plugin sets the maximum retransmission timeouts of the DHCPv6 clients,
+// with the SOL_MAX_RT and INF_MAX_RT options (RFC 8415). Raising them slows
+// down the clients that do not get an answer, e.g. to calm down the storm of
+// Solicits that follows an outage of the head-end. The options are only added
+// to responses to clients that requested them.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - maxrt: sol=3600 inf=3600
+//
+// The values are in seconds, between 60 and 86400. Either can be omitted.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// DHCPv6 option codes (RFC 8415)
+const (
+	OptionSolMaxRT dhcpv6.OptionCode = 82
+	OptionInfMaxRT dhcpv6.OptionCode = 83
+)
+
+// Bounds of the timeouts, in seconds
+const (
+	minTimeout = 60
+	maxTimeout = 86400
+)
+
+func init() {
+	plugins.RegisterPlugin("maxrt", setupMaxRT6, nil)
+	plugins.RegisterOverridable("maxrt")
+}
+
+func setupMaxRT6(args ...string) (handler.Handler6, error) {
+	if len(args) == 0 {
+		return nil, errors.New("plugins/maxrt: need at least one of sol=<seconds> or inf=<seconds>")
+	}
+	opts := make(map[dhcpv6.OptionCode][]byte)
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/maxrt: malformed argument `%s`", arg)
+		}
+		var code dhcpv6.OptionCode
+		switch kv[0] {
+		case "sol":
+			code = OptionSolMaxRT
+		case "inf":
+			code = OptionInfMaxRT
+		default:
+			return nil, fmt.Errorf("plugins/maxrt: unknown argument `%s`", kv[0])
+		}
+		secs, err := strconv.ParseUint(kv[1], 10, 32)
+		if err != nil || secs < minTimeout || secs > maxTimeout {
+			return nil, fmt.Errorf("plugins/maxrt: %s timeout `%s` not between %d and %d seconds", kv[0], kv[1], minTimeout, maxTimeout)
+		}
+		data := make([]byte, 4)
+		binary.BigEndian.PutUint32(data, uint32(secs))
+		opts[code] = data
+	}
+	log.Printf("plugins/maxrt: loaded %d timeout(s)", len(opts))
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if resp == nil {
+			return resp, false
+		}
+		msg, err := dhcputil.InnerMessage6(req)
+		if err != nil {
+			return resp, false
+		}
+		for code, data := range opts {
+			// INF_MAX_RT only applies to Information-requests, and SOL_MAX_RT
+			// to the other messages
+			if (code == OptionInfMaxRT) != (msg.Type() == dhcpv6.MessageTypeInformationRequest) {
+				continue
+			}
+			if dhcputil.Requested6(msg, code) {
+				resp.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: code, OptionData: data})
+			}
+		}
+		return resp, false
+	}, nil
+}
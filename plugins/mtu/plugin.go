@@ -0,0 +1,90 @@
+package mtu
+
+// This plugin provides the clients with the MTU of their interface, in DHCPv4
+// option 26, e.g. for the jumbo frames of a storage network or the smaller
+// MTU of a tunnel overlay. Clients that do not request it keep the MTU of
+// their driver.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - mtu: 1500
+//
+// The `mtu` option sets the MTU of the links that differ, typically on their
+// subnets, and an empty one leaves their clients alone. Not to be confused
+// with the `mtu` setting of the server, which limits the size of the
+// responses.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// minMTU is the smallest MTU that a client accepts (RFC 2132).
+const minMTU = 68
+
+func init() {
+	plugins.RegisterPlugin("mtu", nil, setupMTU4)
+	plugins.RegisterConstraints("mtu", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("mtu")
+}
+
+// parse parses an MTU.
+func parse(s string) (uint16, error) {
+	mtu, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || mtu < minMTU {
+		return 0, fmt.Errorf("invalid MTU `%s`, must be between %d and 65535", s, minMTU)
+	}
+	return uint16(mtu), nil
+}
+
+func setupMTU4(args ...string) (handler.Handler4, error) {
+	if len(args) != 1 {
+		return nil, errors.New("plugins/mtu: need an MTU")
+	}
+	mtu, err := parse(args[0])
+	if err != nil {
+		return nil, fmt.Errorf("plugins/mtu: %v", err)
+	}
+	log.Printf("plugins/mtu: using interface MTU %d", mtu)
+	return (&instance{mtu: mtu}).Handler4, nil
+}
+
+// instance holds the MTU of an instance of the plugin, used when no option
+// definition overrides it.
+type instance struct {
+	mtu uint16
+}
+
+// Handler4 adds the interface MTU option to the response.
+func (i *instance) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || !req.IsOptionRequested(dhcpv4.OptionInterfaceMTU) {
+		return resp, false
+	}
+	mtu := i.mtu
+	if err := handler.Override(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr), "mtu", func(values []string) (err error) {
+		mtu = 0
+		if len(values) > 0 {
+			mtu, err = parse(values[0])
+		}
+		return err
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/mtu: %v", err)
+		return resp, false
+	}
+	if mtu == 0 {
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, []byte{byte(mtu >> 8), byte(mtu)}))
+	return resp, false
+}
@@ -0,0 +1,274 @@
+package netboot
+
+// This plugin provides the network boot parameters to the PXE and UEFI HTTP
+// boot clients, identified by their vendor class (`PXEClient` or
+// `HTTPClient`) and architecture (option 93 for DHCPv4, 61 for DHCPv6). PXE
+// clients get a TFTP server and boot file, and HTTP boot clients the URL of
+// their boot file in option 67, or in the bootfile-url option for DHCPv6,
+// along with the echo of their vendor class that UEFI firmwares require. It
+// should come after the plugins that build the responses.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - netboot: bios=tftp://192.0.2.10/pxelinux.0 efi=tftp://192.0.2.10/bootx64.efi http=https://boot.example.com/bootx64.efi
+//
+// The `bios` URL is for BIOS PXE clients, `efi` for UEFI PXE clients and
+// `http` for UEFI HTTP boot clients; each is optional. The PXE URLs are TFTP
+// URLs, whose host is sent as the TFTP server and whose path is sent as the
+// boot file for DHCPv4. The URL can be overridden per network, subnet, class or
+// host with the `bootfile` option, e.g. for the clients of a `userclass`
+// class.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Network boot option codes (RFC 4578 and RFC 5970)
+const (
+	OptionClientArch4  = dhcpv4.GenericOptionCode(93)
+	OptionClientArch6  = dhcpv6.OptionCode(61)
+	OptionBootfileURL6 = dhcpv6.OptionCode(59)
+)
+
+// Vendor classes of the network boot clients
+const (
+	VendorPXE  = "PXEClient"
+	VendorHTTP = "HTTPClient"
+)
+
+// enterpriseUEFI is the enterprise number of the vendor class option of the
+// DHCPv6 UEFI boot clients.
+const enterpriseUEFI = 343
+
+// httpArchs are the client architectures of the UEFI HTTP boot clients.
+var httpArchs = map[uint16]bool{15: true, 16: true, 18: true, 19: true}
+
+func init() {
+	plugins.RegisterPlugin("netboot", setupNetboot6, setupNetboot4)
+	plugins.RegisterConstraints("netboot", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("netboot")
+}
+
+// Config holds the boot file URLs of the network boot clients.
+type Config struct {
+	BIOS *url.URL
+	EFI  *url.URL
+	HTTP *url.URL
+}
+
+// ParseArgs parses the plugin arguments.
+func ParseArgs(args []string) (*Config, error) {
+	var c Config
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed argument `%s`", arg)
+		}
+		u, err := url.Parse(kv[1])
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL `%s`", kv[1])
+		}
+		switch kv[0] {
+		case "bios", "efi":
+			if u.Scheme != "tftp" {
+				return nil, fmt.Errorf("`%s` must be a tftp:// URL", kv[0])
+			}
+			if kv[0] == "bios" {
+				c.BIOS = u
+			} else {
+				c.EFI = u
+			}
+		case "http":
+			if u.Scheme != "http" && u.Scheme != "https" {
+				return nil, errors.New("`http` must be an http:// or https:// URL")
+			}
+			c.HTTP = u
+		default:
+			return nil, fmt.Errorf("unknown argument `%s`", kv[0])
+		}
+	}
+	if c.BIOS == nil && c.EFI == nil && c.HTTP == nil {
+		return nil, errors.New("need at least one of bios=, efi= or http=")
+	}
+	return &c, nil
+}
+
+func setupNetboot6(args ...string) (handler.Handler6, error) {
+	c, err := ParseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/netboot: %v", err)
+	}
+	log.Print("plugins/netboot: providing network boot parameters to DHCPv6 clients")
+	return c.Handler6, nil
+}
+
+func setupNetboot4(args ...string) (handler.Handler4, error) {
+	c, err := ParseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/netboot: %v", err)
+	}
+	log.Print("plugins/netboot: providing network boot parameters to DHCPv4 clients")
+	return c.Handler4, nil
+}
+
+// bootURL returns the boot file URL for a client of the given vendor and
+// architecture, or nil. The `bootfile` option overrides it.
+func (c *Config) bootURL(ctx context.Context, vendor string, arch uint16, opts map[string][]string) *url.URL {
+	if values, ok := opts["bootfile"]; ok {
+		if len(values) == 0 {
+			return nil
+		}
+		u, err := url.Parse(values[0])
+		if err != nil {
+			logger.FromContext(ctx).Printf("plugins/netboot: invalid bootfile option: %v", err)
+			return nil
+		}
+		return u
+	}
+	switch {
+	case vendor == VendorHTTP || httpArchs[arch]:
+		return c.HTTP
+	case arch == 0:
+		return c.BIOS
+	default:
+		return c.EFI
+	}
+}
+
+// Vendor4 returns the network boot vendor class of a DHCPv4 client, or an
+// empty string if it is not a network boot client.
+func Vendor4(req *dhcpv4.DHCPv4) string {
+	class := req.ClassIdentifier()
+	for _, vendor := range []string{VendorPXE, VendorHTTP} {
+		if strings.HasPrefix(class, vendor) {
+			return vendor
+		}
+	}
+	return ""
+}
+
+// Arch4 returns the first architecture of a DHCPv4 client.
+func Arch4(req *dhcpv4.DHCPv4) uint16 {
+	if data := req.GetOneOption(OptionClientArch4); len(data) >= 2 {
+		return binary.BigEndian.Uint16(data)
+	}
+	return 0
+}
+
+// Apply4 adds the network boot parameters of a network boot client, if any,
+// to a DHCPv4 response.
+func (c *Config) Apply4(ctx context.Context, req, resp *dhcpv4.DHCPv4) {
+	vendor := Vendor4(req)
+	if vendor == "" {
+		return
+	}
+	opts := handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr)
+	u := c.bootURL(ctx, vendor, Arch4(req), opts)
+	if u == nil {
+		return
+	}
+	// UEFI firmwares ignore the responses that do not echo their vendor class
+	resp.UpdateOption(dhcpv4.OptClassIdentifier(vendor))
+	if u.Scheme != "tftp" {
+		resp.UpdateOption(dhcpv4.OptBootFileName(u.String()))
+		return
+	}
+	file := strings.TrimPrefix(u.Path, "/")
+	resp.UpdateOption(dhcpv4.OptTFTPServerName(u.Hostname()))
+	resp.UpdateOption(dhcpv4.OptBootFileName(file))
+	resp.BootFileName = file
+	if ip := net.ParseIP(u.Hostname()); ip != nil && ip.To4() != nil {
+		resp.ServerIPAddr = ip.To4()
+	}
+}
+
+// Handler4 adds the network boot parameters to the responses.
+func (c *Config) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp != nil {
+		c.Apply4(ctx, req, resp)
+	}
+	return resp, false
+}
+
+// vendor6 returns the network boot vendor class of a DHCPv6 client, from its
+// vendor class option, or an empty string.
+func vendor6(msg dhcpv6.DHCPv6) string {
+	for _, opt := range msg.GetOption(dhcpv6.OptionVendorClass) {
+		data := dhcputil.OptionData6(opt)
+		if len(data) < 4 || binary.BigEndian.Uint32(data) != enterpriseUEFI {
+			continue
+		}
+		for _, instance := range dhcputil.Instances6(data[4:]) {
+			for _, vendor := range []string{VendorPXE, VendorHTTP} {
+				if strings.HasPrefix(string(instance), vendor) {
+					return vendor
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// arch6 returns the first architecture of a DHCPv6 client, and whether it
+// has one.
+func arch6(msg dhcpv6.DHCPv6) (uint16, bool) {
+	if opt := msg.GetOneOption(OptionClientArch6); opt != nil {
+		if data := dhcputil.OptionData6(opt); len(data) >= 2 {
+			return binary.BigEndian.Uint16(data), true
+		}
+	}
+	return 0, false
+}
+
+// Handler6 adds the boot file URL to the responses to the network boot
+// clients.
+func (c *Config) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	vendor := vendor6(msg)
+	arch, hasArch := arch6(msg)
+	if vendor == "" && !hasArch {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	u := c.bootURL(ctx, vendor, arch, handler.Options(ctx, dhcputil.LinkAddress6(req), mac))
+	if u == nil {
+		return resp, false
+	}
+	reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionBootfileURL6, OptionData: []byte(u.String())})
+	if vendor != "" {
+		data := make([]byte, 6, 6+len(vendor))
+		binary.BigEndian.PutUint32(data, enterpriseUEFI)
+		binary.BigEndian.PutUint16(data[4:], uint16(len(vendor)))
+		data = append(data, vendor...)
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionVendorClass, OptionData: data})
+	}
+	return resp, false
+}
@@ -0,0 +1,125 @@
+package nextserver
+
+// This plugin sets the BOOTP fields of the DHCPv4 responses: the next server
+// address (siaddr), the boot file name (file) and the server host name
+// (sname), for the devices that read them directly rather than the options,
+// like some IP phones and thin clients. It is independent of the `netboot`
+// plugin, which handles the PXE clients, and should come after the plugins
+// that build the responses.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - nextserver: next-server=192.0.2.10 file=phones/config.bin sname=tftp.example.com
+//
+// Each argument is optional. The `next-server`, `file` and `sname` options
+// point the devices of a subnet or a class to their own server and file, and
+// an empty one leaves the field unset.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// Sizes of the BOOTP fields, including the terminating NUL
+const (
+	snameSize = 64
+	fileSize  = 128
+)
+
+func init() {
+	plugins.RegisterPlugin("nextserver", nil, setupNextServer4)
+	plugins.RegisterConstraints("nextserver", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("nextserver")
+}
+
+// fields are the values of the BOOTP fields. An empty value leaves the field
+// unset.
+type fields struct {
+	nextServer net.IP
+	file       string
+	sname      string
+}
+
+// set parses the value of a field.
+func (f *fields) set(name, value string) error {
+	switch name {
+	case "next-server":
+		f.nextServer = nil
+		if value == "" {
+			return nil
+		}
+		ip := net.ParseIP(value)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid next server address `%s`", value)
+		}
+		f.nextServer = ip.To4()
+	case "file":
+		if len(value) >= fileSize {
+			return fmt.Errorf("boot file name `%s` longer than %d characters", value, fileSize-1)
+		}
+		f.file = value
+	case "sname":
+		if len(value) >= snameSize {
+			return fmt.Errorf("server host name `%s` longer than %d characters", value, snameSize-1)
+		}
+		f.sname = value
+	default:
+		return fmt.Errorf("unknown field `%s`", name)
+	}
+	return nil
+}
+
+func setupNextServer4(args ...string) (handler.Handler4, error) {
+	var f fields
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/nextserver: malformed argument `%s`", arg)
+		}
+		if err := f.set(kv[0], kv[1]); err != nil {
+			return nil, fmt.Errorf("plugins/nextserver: %v", err)
+		}
+	}
+	log.Printf("plugins/nextserver: using next-server=%v file=%s sname=%s", f.nextServer, f.file, f.sname)
+	return f.Handler4, nil
+}
+
+// Handler4 sets the BOOTP fields of the response, to the fields of the
+// instance unless an option definition overrides them.
+func (defaults fields) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	f := defaults
+	opts := handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr)
+	for _, name := range []string{"next-server", "file", "sname"} {
+		name := name
+		if err := handler.Override(opts, name, func(values []string) error {
+			return f.set(name, strings.Join(values, " "))
+		}); err != nil {
+			logger.FromContext(ctx).Printf("plugins/nextserver: %v", err)
+		}
+	}
+	if f.nextServer != nil {
+		resp.ServerIPAddr = f.nextServer
+	}
+	if f.file != "" {
+		resp.BootFileName = f.file
+	}
+	if f.sname != "" {
+		resp.ServerHostName = f.sname
+	}
+	return resp, false
+}
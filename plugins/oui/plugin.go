@@ -0,0 +1,211 @@
+package oui
+
+// This plugin assigns the clients to classes from the vendor of their network
+// interface, as identified by the OUI of their hardware address. The classes
+// then select the options of the clients, and the pools of the plugins that
+// honor them, e.g. to send the voice VLAN options to the IP phones, or to keep
+// the cameras in a locked-down pool. It should come before the plugins that
+// resolve the options.
+//
+// Usage:
+//
+//	server4:
+//	    classes:
+//	        phones:
+//	            ...
+//	    plugins:
+//	        - oui: db=/usr/share/ieee-data/oui.csv phones=polycom,yealink,00:0b:82 cameras=axis
+//
+// Each `<class>=<matches>` argument defines a class, with a comma-separated
+// list of OUIs (e.g. `00:0b:82`) or of vendor names, which match any vendor
+// whose name contains them, case-insensitively. A client can be in several
+// classes. The vendor names come from a small bundled database, extended with
+// the `db` argument by the IEEE MA-L registry, in its CSV (`oui.csv`) or text
+// (`oui.txt`) format. The registry is read again when the configuration is
+// reloaded, so it can be updated without restarting the server.
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("oui", setupOUI6, setupOUI4)
+	plugins.RegisterConstraints("oui", plugins.Constraints{Provides: []string{plugins.TagClasses}})
+	plugins.RegisterOverridable("oui")
+}
+
+// class is a class and the OUIs and vendor names of its clients.
+type class struct {
+	name    string
+	ouis    map[string]bool
+	vendors []string
+}
+
+type classifier struct {
+	// vendors maps the OUIs, as aa:bb:cc, to the vendor names.
+	vendors map[string]string
+	classes []*class
+}
+
+// parseOUI parses an OUI as aa:bb:cc, aa-bb-cc or aabbcc, and returns it as
+// aa:bb:cc, or an empty string if it is malformed.
+func parseOUI(s string) string {
+	s = strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(strings.TrimSpace(s)))
+	if len(s) != 6 {
+		return ""
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return ""
+		}
+	}
+	return s[0:2] + ":" + s[2:4] + ":" + s[4:6]
+}
+
+// loadRegistry adds the entries of an IEEE MA-L registry file to vendors.
+func loadRegistry(filename string, vendors map[string]string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if strings.HasSuffix(filename, ".csv") {
+		r := csv.NewReader(f)
+		r.FieldsPerRecord = -1
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			// Registry,Assignment,Organization Name,Organization Address
+			if len(record) < 3 {
+				continue
+			}
+			if oui := parseOUI(record[1]); oui != "" {
+				vendors[oui] = strings.TrimSpace(record[2])
+			}
+		}
+	}
+	// the text format has lines like `00-22-72   (hex)		Vendor`
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "(hex)", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		if oui := parseOUI(fields[0]); oui != "" {
+			vendors[oui] = strings.TrimSpace(fields[1])
+		}
+	}
+	return scanner.Err()
+}
+
+func parseArgs(args []string) (*classifier, error) {
+	c := classifier{vendors: make(map[string]string, len(bundledVendors))}
+	for oui, vendor := range bundledVendors {
+		c.vendors[oui] = vendor
+	}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("malformed argument `%s`", arg)
+		}
+		if kv[0] == "db" {
+			if err := loadRegistry(kv[1], c.vendors); err != nil {
+				return nil, fmt.Errorf("cannot load the OUI registry: %v", err)
+			}
+			continue
+		}
+		cl := class{name: kv[0], ouis: make(map[string]bool)}
+		for _, match := range strings.Split(kv[1], ",") {
+			if oui := parseOUI(match); oui != "" {
+				cl.ouis[oui] = true
+			} else if match != "" {
+				cl.vendors = append(cl.vendors, strings.ToLower(match))
+			}
+		}
+		c.classes = append(c.classes, &cl)
+	}
+	if len(c.classes) == 0 {
+		return nil, errors.New("need at least one class")
+	}
+	return &c, nil
+}
+
+func setup(args []string) (*classifier, error) {
+	c, err := parseArgs(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/oui: %v", err)
+	}
+	log.Printf("plugins/oui: loaded %d classes and %d vendors", len(c.classes), len(c.vendors))
+	return c, nil
+}
+
+func setupOUI6(args ...string) (handler.Handler6, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler6, nil
+}
+
+func setupOUI4(args ...string) (handler.Handler4, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler4, nil
+}
+
+// classify assigns the client with the given hardware address to the classes
+// of its vendor.
+func (c *classifier) classify(ctx context.Context, hwaddr net.HardwareAddr) {
+	if len(hwaddr) < 3 {
+		return
+	}
+	oui := hwaddr[:3].String()
+	vendor := strings.ToLower(c.vendors[oui])
+	for _, cl := range c.classes {
+		match := cl.ouis[oui]
+		for _, v := range cl.vendors {
+			if vendor != "" && strings.Contains(vendor, v) {
+				match = true
+			}
+		}
+		if match {
+			handler.AddClass(ctx, cl.name)
+		}
+	}
+}
+
+// Handler6 classifies the DHCPv6 clients.
+func (c *classifier) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if mac, err := dhcpv6.ExtractMAC(req); err == nil {
+		c.classify(ctx, mac)
+	}
+	return resp, false
+}
+
+// Handler4 classifies the DHCPv4 clients.
+func (c *classifier) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	c.classify(ctx, req.ClientHWAddr)
+	return resp, false
+}
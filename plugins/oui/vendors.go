@@ -0,0 +1,31 @@
+package oui
+
+// bundledVendors is the built-in vendor database, a small subset of the IEEE
+// MA-L registry covering the vendors of the devices that commonly get their own
+// pools or options: IP phones, cameras, single-board computers and virtual
+// machines. The full registry can be loaded with the `db` argument.
+var bundledVendors = map[string]string{
+	// IP phones
+	"00:04:13": "snom technology AG",
+	"00:04:f2": "Polycom",
+	"64:16:7f": "Polycom",
+	"00:0b:82": "Grandstream Networks, Inc.",
+	"00:15:65": "Xiamen Yealink Network Technology Co.,Ltd",
+	"80:5e:c0": "Yealink (Xiamen) Network Technology Co.,Ltd.",
+	"08:00:0f": "Mitel Corporation",
+	"00:00:0c": "Cisco Systems, Inc",
+	// cameras
+	"00:40:8c": "Axis Communications AB",
+	"ac:cc:8e": "Axis Communications AB",
+	"b8:a4:4f": "Axis Communications AB",
+	// single-board computers
+	"b8:27:eb": "Raspberry Pi Foundation",
+	"dc:a6:32": "Raspberry Pi Trading Ltd",
+	"e4:5f:01": "Raspberry Pi Trading Ltd",
+	// virtual machines
+	"00:05:69": "VMware, Inc.",
+	"00:0c:29": "VMware, Inc.",
+	"00:50:56": "VMware, Inc.",
+	"00:15:5d": "Microsoft Corporation",
+	"00:16:3e": "Xensource, Inc.",
+}
@@ -2,6 +2,7 @@ package plugins
 
 import (
 	"fmt"
+	"net/http"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -12,10 +13,64 @@ var log = logger.GetLogger()
 // Plugin represents a plugin object.
 // Setup6 and Setup4 are the setup functions for DHCPv6 and DHCPv4 handlers
 // respectively. Both setup functions can be nil.
+// Health is an optional function reporting whether the plugin is able to
+// serve requests, see RegisterHealthCheck.
+// Endpoints maps URL patterns to the handlers the plugin serves on the
+// management listener, see RegisterEndpoint.
+// Constraints are the ordering constraints of the plugin in a chain, see
+// RegisterConstraints.
+// Commit and Discard apply or drop the side effects staged by the setup
+// functions, see RegisterCommit.
 type Plugin struct {
-	Name   string
-	Setup6 SetupFunc6
-	Setup4 SetupFunc4
+	Name        string
+	Setup6      SetupFunc6
+	Setup4      SetupFunc4
+	Health      HealthFunc
+	Endpoints   map[string]http.Handler
+	Constraints Constraints
+	// Overridable is set for the plugins whose instances keep their own
+	// state, which can be overridden per network or subnet, see
+	// RegisterOverridable.
+	Overridable bool
+	Commit      CommitFunc
+	Discard     func()
+}
+
+// The metadata tags of the state of the transactions, see handler.State,
+// provided and required by the plugins.
+const (
+	// TagClasses is provided by the plugins that assign the clients to
+	// classes, see handler.AddClass.
+	TagClasses = "classes"
+	// TagHostname is provided by the plugins that set the host name of the
+	// transactions, see handler.SetHostname.
+	TagHostname = "hostname"
+	// TagLinkAddress is provided by the plugins that select the link of
+	// the clients, see handler.SetLinkAddress.
+	TagLinkAddress = "link-address"
+	// TagAddress is provided by the plugins that assign addresses or
+	// prefixes to the clients, which select their subnet.
+	TagAddress = "address"
+)
+
+// OptionTags are the tags that the options resolved for a client depend on,
+// see handler.Options: the plugins that resolve them use these tags.
+var OptionTags = []string{TagClasses, TagLinkAddress, TagAddress}
+
+// Constraints are the ordering constraints of a plugin in a chain.
+type Constraints struct {
+	// Before and After list the plugins that this one must run before and
+	// after, when they are in the same chain.
+	Before []string
+	After  []string
+	// Provides lists the metadata tags that the plugin sets in the state of
+	// the transactions, and Requires the ones that an earlier plugin of the
+	// chain must provide.
+	Provides []string
+	Requires []string
+	// Uses lists the tags that the plugin reads if they are provided: it
+	// must run after all the plugins of the chain that provide them.
+	Uses []string
 }
 
 // RegisteredPlugins maps a plugin name to a Plugin instance.
@@ -27,6 +82,142 @@ type SetupFunc6 func(args ...string) (handler.Handler6, error)
 // SetupFunc4 defines a plugin setup function for DHCPv6
 type SetupFunc4 func(args ...string) (handler.Handler4, error)
 
+// HealthFunc defines a plugin health check. It returns nil if the plugin is
+// healthy, e.g. if the backends it depends on are reachable, and an error
+// describing the problem otherwise. It must not block for long.
+type HealthFunc func() error
+
+// RegisterHealthCheck sets the health check function of a registered plugin.
+// It is normally called at plugin import time, right after RegisterPlugin.
+func RegisterHealthCheck(name string, health HealthFunc) error {
+	plugin, ok := RegisteredPlugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin \"%s\" not registered", name)
+	}
+	plugin.Health = health
+	return nil
+}
+
+// RegisterEndpoint adds a handler to the management listener for the given
+// pattern (see http.ServeMux), when a registered plugin is loaded. It is
+// normally called at plugin import time, right after RegisterPlugin.
+func RegisterEndpoint(name, pattern string, h http.Handler) error {
+	plugin, ok := RegisteredPlugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin \"%s\" not registered", name)
+	}
+	if plugin.Endpoints == nil {
+		plugin.Endpoints = make(map[string]http.Handler)
+	}
+	plugin.Endpoints[pattern] = h
+	return nil
+}
+
+// RegisterConstraints sets the ordering constraints of a registered plugin.
+// It is normally called at plugin import time, right after RegisterPlugin.
+func RegisterConstraints(name string, c Constraints) error {
+	plugin, ok := RegisteredPlugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin \"%s\" not registered", name)
+	}
+	plugin.Constraints = c
+	return nil
+}
+
+// CommitFunc defines a plugin commit function. It is called once the
+// configuration that the plugin was set up for is in use, with loaded set if
+// the plugin is in one of its chains: the plugin then starts what its setup
+// functions staged, and stops what they no longer use. If loaded is not set,
+// the plugin stops everything it started.
+type CommitFunc func(loaded bool)
+
+// RegisterCommit sets the commit and discard functions of a registered
+// plugin. The setup functions must not have side effects, such as binding a
+// port, registering with a service, writing a file or starting a goroutine:
+// the configurations are also loaded to be checked, simulated or replayed,
+// and a reload can fail after the plugin was set up. They stage them instead,
+// for commit to apply, and discard, if not nil, drops what was staged and
+// not committed before the plugins are set up again.
+// It is normally called at plugin import time, right after RegisterPlugin.
+func RegisterCommit(name string, commit CommitFunc, discard func()) error {
+	plugin, ok := RegisteredPlugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin \"%s\" not registered", name)
+	}
+	plugin.Commit = commit
+	plugin.Discard = discard
+	return nil
+}
+
+// RegisterOverridable declares that the instances of a registered plugin keep
+// their own state, rather than package globals, so that the plugin can be set
+// up again with the arguments of the networks and subnets that override them.
+// It is normally called at plugin import time, right after RegisterPlugin.
+func RegisterOverridable(name string) error {
+	plugin, ok := RegisteredPlugins[name]
+	if !ok {
+		return fmt.Errorf("Plugin \"%s\" not registered", name)
+	}
+	plugin.Overridable = true
+	return nil
+}
+
+// ValidateChain checks the order of the plugins of a chain, by name, against
+// their constraints, and returns an error describing the first violation.
+func ValidateChain(names []string) error {
+	first := make(map[string]int, len(names))
+	last := make(map[string]int, len(names))
+	for i, name := range names {
+		if _, ok := first[name]; !ok {
+			first[name] = i
+		}
+		last[name] = i
+	}
+	provided := make(map[string]bool)
+	for i, name := range names {
+		plugin, ok := RegisteredPlugins[name]
+		if !ok {
+			continue
+		}
+		c := plugin.Constraints
+		for _, other := range c.Before {
+			if j, ok := first[other]; ok && j < i {
+				return fmt.Errorf("plugin `%s` must run before `%s`, which comes earlier in the chain", name, other)
+			}
+		}
+		for _, other := range c.After {
+			if j, ok := last[other]; ok && j > i {
+				return fmt.Errorf("plugin `%s` must run after `%s`, which comes later in the chain", name, other)
+			}
+		}
+		for _, tag := range c.Uses {
+			for _, other := range names[i+1:] {
+				if p, ok := RegisteredPlugins[other]; ok && contains(p.Constraints.Provides, tag) {
+					return fmt.Errorf("plugin `%s` uses `%s`, which `%s` provides later in the chain", name, tag, other)
+				}
+			}
+		}
+		for _, tag := range c.Requires {
+			if !provided[tag] {
+				return fmt.Errorf("plugin `%s` requires `%s`, which no earlier plugin of the chain provides", name, tag)
+			}
+		}
+		for _, tag := range c.Provides {
+			provided[tag] = true
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
 // RegisterPlugin registers a plugin by its name and setup functions.
 func RegisterPlugin(name string, setup6 SetupFunc6, setup4 SetupFunc4) error {
 	log.Printf("Registering plugin \"%s\"", name)
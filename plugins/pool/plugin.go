@@ -0,0 +1,372 @@
+package pool
+
+// This plugin assigns dynamic addresses from the pools of the subnets, i.e.
+// the share of their `range` served by this server, see the `split` setting
+// of the subnets: two servers splitting a range never assign the same
+// address. The subnet of a client is selected like the subnet of its
+// options, by its address or the address of its relay. It should come after
+// the plugins that assign the reserved addresses, e.g. `file`, and leaves
+// the clients that already got an address to them.
+//
+// Usage:
+//
+//	server4:
+//	    networks:
+//	        - name: campus
+//	          subnets:
+//	              - prefix: 192.0.2.0/24
+//	                range: 192.0.2.10-192.0.2.250
+//	                split: lower 80%
+//	    plugins:
+//	        - server_id: 192.0.2.1
+//	        - file: leases.txt
+//	        - pool: 12h
+//
+// The argument is the lease time, one hour by default. The DHCPDISCOVERs and
+// SOLICITs hold the offered address for a minute. A DHCPREQUEST for an address
+// of the range of the subnet that is in the share of the other server is
+// dropped, so that the other server answers it, and one for an address out of
+// the range is NAKed. Declined addresses are not assigned for declineTTL.
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("pool", setup6, setup4)
+	plugins.RegisterConstraints("pool", plugins.Constraints{
+		After:    []string{"server_id", "file"},
+		Provides: []string{plugins.TagAddress},
+		Uses:     []string{plugins.TagLinkAddress},
+	})
+	plugins.RegisterOverridable("pool")
+}
+
+const (
+	defaultLeaseTime = time.Hour
+	// offerTTL is how long an offered address is held for the client.
+	offerTTL = time.Minute
+	// declineTTL is how long a declined address is not assigned.
+	declineTTL = 10 * time.Minute
+	// maxProbes is the number of addresses of a pool tried for a new client,
+	// for the pools too large to scan.
+	maxProbes = 65536
+)
+
+// Errors of the assignment of an address
+var (
+	ErrPoolFull    = errors.New("no free address in the pool")
+	ErrUnavailable = errors.New("address leased or reserved to another client")
+)
+
+type allocator struct {
+	leaseTime time.Duration
+}
+
+func setup(args []string) (*allocator, error) {
+	a := allocator{leaseTime: defaultLeaseTime}
+	if len(args) > 1 {
+		return nil, errors.New("plugins/pool: too many arguments")
+	}
+	if len(args) == 1 {
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < time.Second {
+			return nil, fmt.Errorf("plugins/pool: invalid lease time `%s`", args[0])
+		}
+		a.leaseTime = d
+	}
+	log.Printf("plugins/pool: assigning the addresses of the pools for %s", a.leaseTime)
+	return &a, nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	a, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handler6, nil
+}
+
+func setup4(args ...string) (handler.Handler4, error) {
+	a, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return a.Handler4, nil
+}
+
+// free returns whether an address can be assigned to a client: it is not
+// leased to another client, nor reserved for another one.
+func free(ip net.IP, client *leases.Lease, now time.Time) bool {
+	if lease, err := leases.Default.Lease(ip); err == nil && !lease.Expired(now) && !leases.SameClient(lease, client) {
+		return false
+	}
+	if host, err := leases.Default.HostByIP(ip); err == nil && !host.Expired(now) {
+		return leases.SameClient(&leases.Lease{HWAddr: host.HWAddr, ClientID: host.ClientID}, client)
+	}
+	return true
+}
+
+// current returns the address of the lease of a client in a pool, or nil.
+func current(subnet *config.SubnetConfig, pool *config.AddressRange, client *leases.Lease, now time.Time) net.IP {
+	if len(client.HWAddr) > 0 {
+		if lease, err := leases.Default.LeaseByHWAddr(client.HWAddr); err == nil && !lease.Expired(now) && pool.Contains(lease.IP) && leases.SameClient(lease, client) {
+			return lease.IP
+		}
+	}
+	if client.ClientID == "" {
+		return nil
+	}
+	inSubnet, err := leases.LeasesInSubnet(leases.Default, subnet.Prefix)
+	if err != nil {
+		return nil
+	}
+	for _, lease := range inSubnet {
+		if !lease.Expired(now) && lease.ClientID == client.ClientID && pool.Contains(lease.IP) {
+			return lease.IP
+		}
+	}
+	return nil
+}
+
+// choose returns the address to offer to a client: its current one, else the
+// one it asks for, if free, else a free address, probed from an offset
+// derived from the client so that it tends to get the same address again.
+func choose(subnet *config.SubnetConfig, pool *config.AddressRange, client *leases.Lease, hint net.IP, now time.Time) (net.IP, error) {
+	if ip := current(subnet, pool, client, now); ip != nil {
+		return ip, nil
+	}
+	if hint != nil && !hint.IsUnspecified() && pool.Contains(hint) && free(hint, client, now) {
+		return hint, nil
+	}
+	size := pool.Size()
+	h := fnv.New64a()
+	h.Write(client.HWAddr)
+	h.Write([]byte(client.ClientID))
+	offset := new(big.Int).Mod(new(big.Int).SetUint64(h.Sum64()), size)
+	one := big.NewInt(1)
+	for i := 0; i < maxProbes && big.NewInt(int64(i)).Cmp(size) < 0; i++ {
+		if ip := pool.At(offset); free(ip, client, now) {
+			return ip, nil
+		}
+		if offset.Add(offset, one).Cmp(size) >= 0 {
+			offset.SetInt64(0)
+		}
+	}
+	return nil, ErrPoolFull
+}
+
+// bind holds an address for a client, until now plus ttl.
+func bind(ip net.IP, client *leases.Lease, now time.Time, ttl time.Duration) error {
+	lease := *client
+	lease.IP, lease.Starts, lease.Ends = ip, now, now.Add(ttl)
+	return leases.Claim(leases.Default, &lease)
+}
+
+// release removes the lease of an address, if it is the one of the client.
+func release(ip net.IP, client *leases.Lease) {
+	lease, err := leases.Default.Lease(ip)
+	if err != nil || !leases.SameClient(lease, client) {
+		return
+	}
+	if err := leases.Default.DeleteLease(ip); err != nil {
+		log.Printf("plugins/pool: cannot release %s: %v", ip, err)
+	}
+}
+
+// decline holds a declined address for nobody, for declineTTL.
+func decline(ip net.IP, now time.Time) {
+	lease := leases.Lease{IP: ip, Starts: now, Ends: now.Add(declineTTL)}
+	if err := leases.Default.PutLease(&lease); err != nil {
+		log.Printf("plugins/pool: cannot hold the declined %s: %v", ip, err)
+	}
+}
+
+// Handler4 assigns the addresses of the pools to the DHCPv4 clients.
+func (a *allocator) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || (resp.YourIPAddr != nil && !resp.YourIPAddr.IsUnspecified()) {
+		return resp, false
+	}
+	_, subnet := handler.Subnet(ctx, handler.Address4(ctx, req, nil))
+	if subnet == nil || subnet.Range == nil {
+		return resp, false
+	}
+	pool := subnet.Pool()
+	client := &leases.Lease{HWAddr: req.ClientHWAddr}
+	if id := req.GetOneOption(dhcpv4.OptionClientIdentifier); len(id) > 0 {
+		client.ClientID = hex.EncodeToString(id)
+	}
+	log := logger.FromContext(ctx)
+	now := clock.Now()
+	requested := req.RequestedIPAddress()
+	if requested == nil || requested.IsUnspecified() {
+		requested = req.ClientIPAddr
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		if pool == nil {
+			return resp, false
+		}
+		ip, err := choose(subnet, pool, client, requested, now)
+		if err == nil {
+			err = bind(ip, client, now, offerTTL)
+		}
+		if err != nil {
+			log.Printf("plugins/pool: cannot offer an address of %s to %s: %v", pool, req.ClientHWAddr, err)
+			return nil, true
+		}
+		resp.YourIPAddr = ip
+	case dhcpv4.MessageTypeRequest:
+		if requested == nil || requested.IsUnspecified() {
+			return resp, false
+		}
+		if pool == nil || !pool.Contains(requested) {
+			if subnet.Range.Contains(requested) {
+				// in the share of the other server
+				return nil, true
+			}
+			nak, err := dhcputil.Nak4(req, resp.ServerIdentifier(), "address not in the pool")
+			if err != nil {
+				log.Printf("plugins/pool: cannot build the DHCPNAK: %v", err)
+				return nil, true
+			}
+			return nak, true
+		}
+		err := ErrUnavailable
+		if free(requested, client, now) {
+			err = bind(requested, client, now, a.leaseTime)
+		}
+		if err != nil {
+			log.Printf("plugins/pool: cannot bind %s to %s: %v", requested, req.ClientHWAddr, err)
+			nak, nerr := dhcputil.Nak4(req, resp.ServerIdentifier(), "address not available")
+			if nerr != nil {
+				return nil, true
+			}
+			return nak, true
+		}
+		resp.YourIPAddr = requested
+	case dhcpv4.MessageTypeRelease:
+		if pool != nil && pool.Contains(req.ClientIPAddr) {
+			release(req.ClientIPAddr, client)
+		}
+		return resp, false
+	case dhcpv4.MessageTypeDecline:
+		if ip := req.RequestedIPAddress(); pool != nil && ip != nil && pool.Contains(ip) {
+			log.Printf("plugins/pool: %s declined %s", req.ClientHWAddr, ip)
+			decline(ip, now)
+		}
+		return resp, false
+	default:
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(a.leaseTime))
+	log.Printf("plugins/pool: assigning %s to %s", resp.YourIPAddr, req.ClientHWAddr)
+	return resp, false
+}
+
+// Handler6 assigns the addresses of the pools in the IA_NA options of the
+// DHCPv6 clients.
+func (a *allocator) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil || len(dhcputil.IAAddresses6(reply)) > 0 {
+		return resp, false
+	}
+	link := handler.LinkAddress(ctx)
+	if link == nil {
+		link = dhcputil.LinkAddress6(req)
+	}
+	_, subnet := handler.Subnet(ctx, link)
+	if subnet == nil || subnet.Pool() == nil {
+		return resp, false
+	}
+	pool := subnet.Pool()
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return resp, false
+	}
+	client := &leases.Lease{ClientID: hex.EncodeToString(cid.Cid.ToBytes())}
+	client.HWAddr, _ = dhcpv6.ExtractMAC(req)
+	now := clock.Now()
+	// one address, for the first IA_NA of the client
+	var iana *dhcpv6.OptIANA
+	for _, opt := range msg.GetOption(dhcpv6.OptionIANA) {
+		if iana, ok = opt.(*dhcpv6.OptIANA); ok {
+			break
+		}
+	}
+	if iana == nil {
+		return resp, false
+	}
+	var hint net.IP
+	for _, opt := range iana.Options {
+		if addr, ok := opt.(*dhcpv6.OptIAAddress); ok {
+			hint = addr.IPv6Addr
+			break
+		}
+	}
+	ttl := a.leaseTime
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit:
+		ttl = offerTTL
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+	case dhcpv6.MessageTypeRelease:
+		if hint != nil && pool.Contains(hint) {
+			release(hint, client)
+		}
+		return resp, false
+	case dhcpv6.MessageTypeDecline:
+		if hint != nil && pool.Contains(hint) {
+			decline(hint, now)
+		}
+		return resp, false
+	default:
+		return resp, false
+	}
+	ip, err := choose(subnet, pool, client, hint, now)
+	if err == nil {
+		err = bind(ip, client, now, ttl)
+	}
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/pool: cannot assign an address of %s to %s: %v", pool, client.ClientID, err)
+		return resp, false
+	}
+	lifetime := uint32(a.leaseTime / time.Second)
+	reply.AddOption(&dhcpv6.OptIANA{
+		IaId: iana.IaId,
+		T1:   lifetime / 2,
+		T2:   lifetime * 4 / 5,
+		Options: []dhcpv6.Option{&dhcpv6.OptIAAddress{
+			IPv6Addr:          ip,
+			PreferredLifetime: lifetime,
+			ValidLifetime:     lifetime,
+		}},
+	})
+	logger.FromContext(ctx).Printf("plugins/pool: assigning %s to %s", ip, client.ClientID)
+	return resp, false
+}
@@ -0,0 +1,193 @@
+package prefix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// units returns the size of a prefix of a length, in /64 prefixes.
+func units(length int) uint64 {
+	return 1 << uint(64-length)
+}
+
+// pool allocates the prefixes of a pool with a buddy allocator: the free space
+// is kept as aligned blocks, by prefix length, and a delegation takes the
+// smallest free block that can hold it, i.e. the best fit, so that the large
+// blocks are only split when no smaller one is left. Freed prefixes are merged
+// back with their free buddies. The offsets of the blocks are counted in /64
+// prefixes from the start of the pool, so delegations are between the length
+// of the pool and /64.
+type pool struct {
+	prefix *net.IPNet
+	length int
+	base   uint64
+	// free holds the offsets of the free blocks, by prefix length
+	free map[int]map[uint64]bool
+	// used is the number of /64 prefixes delegated
+	used uint64
+}
+
+func newPool(prefix *net.IPNet) (*pool, error) {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 || ones < 1 || ones > 64 {
+		return nil, fmt.Errorf("invalid pool %s, must be an IPv6 prefix between /1 and /64", prefix)
+	}
+	p := pool{
+		prefix: prefix,
+		length: ones,
+		base:   binary.BigEndian.Uint64(prefix.IP.To16()[:8]),
+		free:   make(map[int]map[uint64]bool),
+	}
+	for l := ones; l <= 64; l++ {
+		p.free[l] = make(map[uint64]bool)
+	}
+	p.free[ones][0] = true
+	return &p, nil
+}
+
+// size returns the size of the pool, in /64 prefixes.
+func (p *pool) size() uint64 {
+	return units(p.length)
+}
+
+// minOffset returns the lowest offset of a set, so that the allocations are
+// deterministic.
+func minOffset(set map[uint64]bool) uint64 {
+	first := true
+	var ret uint64
+	for off := range set {
+		if first || off < ret {
+			ret, first = off, false
+		}
+	}
+	return ret
+}
+
+// allocate delegates a free prefix of a length, and returns its offset. It
+// returns false if no block is large enough.
+func (p *pool) allocate(length int) (uint64, bool) {
+	if length < p.length || length > 64 {
+		return 0, false
+	}
+	for l := length; l >= p.length; l-- {
+		if len(p.free[l]) == 0 {
+			continue
+		}
+		off := minOffset(p.free[l])
+		delete(p.free[l], off)
+		// keep the lower half of each split, and free the upper one
+		for ; l < length; l++ {
+			p.free[l+1][off+units(l+1)] = true
+		}
+		p.used += units(length)
+		return off, true
+	}
+	return 0, false
+}
+
+// claim delegates a given prefix, e.g. the one that a client asks to keep,
+// if it is free.
+func (p *pool) claim(off uint64, length int) bool {
+	if length < p.length || length > 64 || off%units(length) != 0 || off >= p.size() {
+		return false
+	}
+	for l := length; l >= p.length; l-- {
+		start := off &^ (units(l) - 1)
+		if !p.free[l][start] {
+			continue
+		}
+		delete(p.free[l], start)
+		// split toward the claimed prefix, freeing the other halves
+		for ; l < length; l++ {
+			half := units(l + 1)
+			if off >= start+half {
+				p.free[l+1][start] = true
+				start += half
+			} else {
+				p.free[l+1][start+half] = true
+			}
+		}
+		p.used += units(length)
+		return true
+	}
+	return false
+}
+
+// release frees a delegated prefix, and merges it with its free buddies.
+func (p *pool) release(off uint64, length int) {
+	p.used -= units(length)
+	for l := length; l > p.length; l-- {
+		buddy := off ^ units(l)
+		if !p.free[l][buddy] {
+			p.free[l][off] = true
+			return
+		}
+		delete(p.free[l], buddy)
+		off &^= units(l)
+	}
+	p.free[p.length][off] = true
+}
+
+// ip returns the first address of the prefix at an offset.
+func (p *pool) ip(off uint64) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip, p.base+off)
+	return ip
+}
+
+// offset returns the offset of a prefix of the pool, and false if the pool
+// does not contain it.
+func (p *pool) offset(ip net.IP) (uint64, bool) {
+	if ip = ip.To16(); ip == nil || ip.To4() != nil || !p.prefix.Contains(ip) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(ip[:8]) - p.base, true
+}
+
+// PoolStats are the utilization and the fragmentation of a pool. The sizes
+// are counted in /64 prefixes.
+type PoolStats struct {
+	Pool      string `json:"pool"`
+	Size      uint64 `json:"size"`
+	Delegated uint64 `json:"delegated"`
+	Free      uint64 `json:"free"`
+	// Utilization is the delegated share of the pool, in percent.
+	Utilization float64 `json:"utilization"`
+	// LargestFree is the length of the largest free prefix, or 0 if the
+	// pool is full, and LargestFreeSize its size.
+	LargestFree     int    `json:"largest-free"`
+	LargestFreeSize uint64 `json:"largest-free-size"`
+	// Fragmentation is the share of the free space outside of the largest
+	// free prefix, in percent: 0 when the free space is a single prefix.
+	Fragmentation float64 `json:"fragmentation"`
+	// FreeBlocks counts the free prefixes by length.
+	FreeBlocks map[int]int `json:"free-blocks"`
+}
+
+// stats returns the statistics of the pool.
+func (p *pool) stats() *PoolStats {
+	s := PoolStats{
+		Pool:       p.prefix.String(),
+		Size:       p.size(),
+		Delegated:  p.used,
+		Free:       p.size() - p.used,
+		FreeBlocks: make(map[int]int),
+	}
+	s.Utilization = 100 * float64(s.Delegated) / float64(s.Size)
+	lengths := make([]int, 0, len(p.free))
+	for l, set := range p.free {
+		if len(set) > 0 {
+			s.FreeBlocks[l] = len(set)
+			lengths = append(lengths, l)
+		}
+	}
+	sort.Ints(lengths)
+	if len(lengths) > 0 {
+		s.LargestFree = lengths[0]
+		s.LargestFreeSize = units(lengths[0])
+		s.Fragmentation = 100 * (1 - float64(s.LargestFreeSize)/float64(s.Free))
+	}
+	return &s
+}
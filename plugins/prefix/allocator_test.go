@@ -0,0 +1,297 @@
+package prefix
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func newTestPool(t *testing.T, prefix string) *pool {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newPool(ipnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// freeBlocks returns the free blocks of a pool, by prefix length.
+func freeBlocks(p *pool) map[int][]uint64 {
+	ret := make(map[int][]uint64)
+	for l, set := range p.free {
+		for off := range set {
+			ret[l] = append(ret[l], off)
+		}
+	}
+	return ret
+}
+
+// checkPool fails the test if the free blocks and the delegated prefixes of a
+// pool overlap, or do not add up to the size of the pool.
+func checkPool(t *testing.T, p *pool, delegated map[uint64]int) {
+	t.Helper()
+	covered := make([]bool, p.size())
+	mark := func(what string, off uint64, length int) {
+		for i := off; i < off+units(length); i++ {
+			if covered[i] {
+				t.Fatalf("%s %d/%d overlaps another block", what, off, length)
+			}
+			covered[i] = true
+		}
+	}
+	var used uint64
+	for off, length := range delegated {
+		mark("the delegated prefix", off, length)
+		used += units(length)
+	}
+	for l, set := range p.free {
+		for off := range set {
+			mark("the free block", off, l)
+		}
+	}
+	for i, c := range covered {
+		if !c {
+			t.Fatalf("the /64 at offset %d is neither free nor delegated", i)
+		}
+	}
+	if p.used != used {
+		t.Fatalf("%d /64 prefixes used, want %d", p.used, used)
+	}
+}
+
+func TestNewPoolInvalid(t *testing.T) {
+	for _, prefix := range []string{"192.0.2.0/24", "2001:db8::/80", "::/0"} {
+		_, ipnet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newPool(ipnet); err == nil {
+			t.Errorf("%s: no error", prefix)
+		}
+	}
+}
+
+func TestPoolAllocateSplit(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	for _, tt := range []struct {
+		length int
+		want   uint64
+		free   map[int][]uint64
+	}{
+		// the /56 is split down to a /60, keeping the lower halves
+		{60, 0, map[int][]uint64{57: {128}, 58: {64}, 59: {32}, 60: {16}}},
+		// the best fit is the free /60, not a split of a larger block
+		{60, 16, map[int][]uint64{57: {128}, 58: {64}, 59: {32}}},
+		// the smallest block that holds a /64 is the /59
+		{64, 32, map[int][]uint64{57: {128}, 58: {64}, 60: {48}, 61: {40}, 62: {36}, 63: {34}, 64: {33}}},
+	} {
+		off, ok := p.allocate(tt.length)
+		if !ok || off != tt.want {
+			t.Fatalf("/%d: got %d, %v, want %d", tt.length, off, ok, tt.want)
+		}
+		if got := freeBlocks(p); !reflect.DeepEqual(got, tt.free) {
+			t.Fatalf("/%d: got the free blocks %v, want %v", tt.length, got, tt.free)
+		}
+	}
+	checkPool(t, p, map[uint64]int{0: 60, 16: 60, 32: 64})
+}
+
+func TestPoolAllocateInvalid(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	for _, length := range []int{48, 55, 65} {
+		if _, ok := p.allocate(length); ok {
+			t.Errorf("/%d: allocated", length)
+		}
+	}
+	if _, ok := p.allocate(56); !ok {
+		t.Fatal("a free pool cannot delegate itself")
+	}
+	if _, ok := p.allocate(64); ok {
+		t.Error("a full pool delegated a prefix")
+	}
+}
+
+func TestPoolReleaseMerge(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	delegated := make(map[uint64]int)
+	for _, length := range []int{60, 64, 58, 62, 64, 57} {
+		off, ok := p.allocate(length)
+		if !ok {
+			t.Fatalf("/%d: not allocated", length)
+		}
+		delegated[off] = length
+	}
+	checkPool(t, p, delegated)
+	for off, length := range delegated {
+		p.release(off, length)
+		delete(delegated, off)
+		checkPool(t, p, delegated)
+	}
+	want := map[int][]uint64{56: {0}}
+	if got := freeBlocks(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the free blocks %v, want %v", got, want)
+	}
+}
+
+func TestPoolReleaseBuddyInUse(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/62")
+	a, _ := p.allocate(63)
+	b, _ := p.allocate(63)
+	p.release(a, 63)
+	// the buddy is still delegated, so the released half is not merged
+	want := map[int][]uint64{63: {a}}
+	if got := freeBlocks(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the free blocks %v, want %v", got, want)
+	}
+	p.release(b, 63)
+	want = map[int][]uint64{62: {0}}
+	if got := freeBlocks(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the free blocks %v, want %v", got, want)
+	}
+}
+
+func TestPoolClaim(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	// 160 is the 11th /60: the /56 is split toward it, freeing the others
+	if !p.claim(160, 60) {
+		t.Fatal("the free /60 at 160 cannot be claimed")
+	}
+	want := map[int][]uint64{57: {0}, 58: {192}, 59: {128}, 60: {176}}
+	if got := freeBlocks(p); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got the free blocks %v, want %v", got, want)
+	}
+	for _, tt := range []struct {
+		off    uint64
+		length int
+	}{
+		// already delegated, whole or in part
+		{160, 60},
+		{164, 62},
+		{128, 58},
+		// not aligned on its length
+		{161, 60},
+		// out of the pool
+		{256, 64},
+		// longer than the pool allows
+		{0, 55},
+	} {
+		if p.claim(tt.off, tt.length) {
+			t.Errorf("%d/%d: claimed", tt.off, tt.length)
+		}
+	}
+	// a whole free block
+	if !p.claim(0, 57) {
+		t.Fatal("the free /57 at 0 cannot be claimed")
+	}
+	// the allocations take the best fit of what remains
+	if off, ok := p.allocate(60); !ok || off != 176 {
+		t.Errorf("got %d, %v, want 176", off, ok)
+	}
+	checkPool(t, p, map[uint64]int{160: 60, 0: 57, 176: 60})
+	p.release(160, 60)
+	p.release(0, 57)
+	p.release(176, 60)
+	want = map[int][]uint64{56: {0}}
+	if got := freeBlocks(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got the free blocks %v, want %v", got, want)
+	}
+}
+
+func TestPoolRandom(t *testing.T) {
+	p := newTestPool(t, "2001:db8::/52")
+	r := rand.New(rand.NewSource(1))
+	delegated := make(map[uint64]int)
+	for i := 0; i < 2000; i++ {
+		if len(delegated) > 0 && r.Intn(3) == 0 {
+			for off, length := range delegated {
+				p.release(off, length)
+				delete(delegated, off)
+				break
+			}
+		} else {
+			length := 52 + r.Intn(13)
+			off := uint64(r.Int63n(int64(p.size()))) &^ (units(length) - 1)
+			if r.Intn(2) == 0 {
+				if p.claim(off, length) {
+					delegated[off] = length
+				}
+			} else if off, ok := p.allocate(length); ok {
+				delegated[off] = length
+			}
+		}
+		checkPool(t, p, delegated)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	off, _ := p.allocate(58)
+	s := p.stats()
+	want := PoolStats{
+		Pool:            "2001:db8:0:100::/56",
+		Size:            256,
+		Delegated:       64,
+		Free:            192,
+		Utilization:     25,
+		LargestFree:     57,
+		LargestFreeSize: 128,
+		Fragmentation:   100 * (1 - 128.0/192),
+		FreeBlocks:      map[int]int{57: 1, 58: 1},
+	}
+	if !reflect.DeepEqual(*s, want) {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+
+	// the release merges the free space back into a single prefix
+	p.release(off, 58)
+	want = PoolStats{
+		Pool:            "2001:db8:0:100::/56",
+		Size:            256,
+		Free:            256,
+		LargestFree:     56,
+		LargestFreeSize: 256,
+		FreeBlocks:      map[int]int{56: 1},
+	}
+	if s := p.stats(); !reflect.DeepEqual(*s, want) {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+
+	p.allocate(56)
+	want = PoolStats{
+		Pool:        "2001:db8:0:100::/56",
+		Size:        256,
+		Delegated:   256,
+		Utilization: 100,
+		FreeBlocks:  map[int]int{},
+	}
+	if s := p.stats(); !reflect.DeepEqual(*s, want) {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+}
+
+func TestPoolOffset(t *testing.T) {
+	p := newTestPool(t, "2001:db8:0:100::/56")
+	if ip := p.ip(160); !ip.Equal(net.ParseIP("2001:db8:0:1a0::")) {
+		t.Errorf("got %s, want 2001:db8:0:1a0::", ip)
+	}
+	for _, tt := range []struct {
+		ip   string
+		off  uint64
+		want bool
+	}{
+		{"2001:db8:0:1a0::", 160, true},
+		{"2001:db8:0:1ff::1", 255, true},
+		{"2001:db8:0:200::", 0, false},
+		{"192.0.2.1", 0, false},
+	} {
+		off, ok := p.offset(net.ParseIP(tt.ip))
+		if ok != tt.want || off != tt.off {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.ip, off, ok, tt.off, tt.want)
+		}
+	}
+}
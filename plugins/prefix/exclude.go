@@ -0,0 +1,68 @@
+package prefix
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// OptionPDExclude is the prefix exclude option (RFC 6603), in the IA prefix
+// options.
+const OptionPDExclude = dhcpv6.OptionCode(67)
+
+// links returns the prefixes of the links that a router may have its WAN
+// address on: the subnet of its link, as configured, or else the /64 of the
+// link address, and the /64 of the address assigned to it in the reply, if
+// any.
+func links(ctx context.Context, req, reply dhcpv6.DHCPv6) []*net.IPNet {
+	var ret []*net.IPNet
+	slash64 := net.CIDRMask(64, 128)
+	link := handler.LinkAddress(ctx)
+	if link == nil {
+		link = dhcputil.LinkAddress6(req)
+	}
+	if link != nil && link.To4() == nil {
+		if _, s := handler.Subnet(ctx, link); s != nil {
+			ret = append(ret, s.Prefix)
+		} else {
+			ret = append(ret, &net.IPNet{IP: link.Mask(slash64), Mask: slash64})
+		}
+	}
+	for _, addr := range dhcputil.IAAddresses6(reply) {
+		ret = append(ret, &net.IPNet{IP: addr.IPv6Addr.Mask(slash64), Mask: slash64})
+	}
+	return ret
+}
+
+// excluded returns the prefix of the link of a router that a delegated prefix
+// contains, or nil.
+func excluded(delegated *net.IPNet, links []*net.IPNet) *net.IPNet {
+	dlen, _ := delegated.Mask.Size()
+	for _, link := range links {
+		if l, _ := link.Mask.Size(); l > dlen && delegated.Contains(link.IP) {
+			return link
+		}
+	}
+	return nil
+}
+
+// encodeExclude returns the payload of the prefix exclude option for a prefix
+// excluded from a delegated prefix: the length of the excluded prefix, and
+// its bits after the delegated prefix, the subnet ID, padded to octets.
+func encodeExclude(dlen int, excluded *net.IPNet) []byte {
+	elen, _ := excluded.Mask.Size()
+	bits := elen - dlen
+	data := make([]byte, 1+(bits+7)/8)
+	data[0] = byte(elen)
+	ip := excluded.IP.To16()
+	for i := 0; i < bits; i++ {
+		pos := dlen + i
+		if ip[pos/8]&(0x80>>uint(pos%8)) != 0 {
+			data[1+i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return data
+}
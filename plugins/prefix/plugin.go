@@ -0,0 +1,652 @@
+package prefix
+
+// This plugin delegates prefixes to the requesting routers (IA_PD, RFC 8415)
+// from pools, e.g. to the CPEs of a residential network. It should come after
+// the server_id plugin.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - server_id: LL 00:de:ad:be:ef:00
+//	        - prefix: 2001:db8:100::/40 2001:db8:200::/40 length=56 lifetime=24h class=business,48 duids=/etc/coredhcp/business.txt,48 stable=remote-id
+//
+// The arguments are the pools, which are used in order, the length of the
+// delegated prefixes (56 by default, at most 64), and their valid lifetime (1
+// hour by default). The prefixes are allocated by best fit: each delegation
+// takes the smallest free block that can hold it, so that the large free
+// blocks are kept for the large delegations, and the released prefixes are
+// merged back into larger blocks.
+//
+// The length can depend on the client: `class=<class>,<length>` sets the
+// length for the clients of a class, the later classes of a client taking
+// precedence, and `duids=<file>,<length>` for the DUIDs listed in a file, one
+// per line in hex, which take precedence over the classes. The plugin should
+// then come after the classification plugins.
+//
+// With `stable`, each client gets the same prefix as long as it is free, even
+// after its delegation expired, or on another server with the same pools: the
+// prefix is derived from a hash of the customer identifier, which is the DUID
+// (`stable` or `stable=duid`), or the Remote-ID or Interface-ID added by the
+// relay (`stable=remote-id`, `stable=interface-id`), e.g. to follow the
+// subscriber line rather than the CPE. Stable prefixes are taken anywhere in
+// the pools, so they fragment them more than the best fit does.
+//
+// When a router requests it, the delegated prefix that contains the link of
+// the router, i.e. the configured subnet of its link, or the /64 of its link
+// address or of the address assigned to it, is sent with the prefix exclude
+// option (RFC 6603), so that the router does not route the link away.
+//
+// The pools cannot overlap. The delegations are stored as leases in the lease
+// store, with the length of their prefix and the IAID of their IA_PD, so that
+// they are restored after a restart, and shared with the servers and the
+// tools using the same store; a prefix leased to another router in the store
+// is not delegated. A router that renews a prefix unknown to the server keeps
+// it if it is still free. The utilization and the fragmentation of the pools
+// are exported as metrics, and by GET /prefix/pools on the management API.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/metadata"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// The gauges of the pools, with the `pool` label and the labels of the subnet
+// of the pool, if configured. The sizes are counted in /64 prefixes, and the
+// shares in percent.
+const (
+	statPoolSize          = "dhcp_pd_pool_size"
+	statPoolDelegated     = "dhcp_pd_pool_delegated"
+	statPoolUtilization   = "dhcp_pd_pool_utilization_percent"
+	statPoolLargestFree   = "dhcp_pd_pool_largest_free_length"
+	statPoolFragmentation = "dhcp_pd_pool_fragmentation_percent"
+)
+
+// statusNoPrefixAvail is the status code of the IA_PDs that cannot be served.
+const statusNoPrefixAvail = 6
+
+// offerTTL is the time the prefixes advertised to the routers are held for
+// them, until they request them.
+const offerTTL = time.Minute
+
+// sweepInterval is the minimum interval between the removals of the expired
+// delegations.
+const sweepInterval = time.Minute
+
+// stableProbes is the number of prefixes tried after the stable prefix of a
+// client, when it is taken, before falling back to the best fit.
+const stableProbes = 16
+
+// claimAttempts is the number of prefixes tried for a delegation when the
+// prefixes found free are leased to other routers in the lease store.
+const claimAttempts = 4
+
+// The customer identifiers the stable prefixes are derived from
+const (
+	stableDUID        = "duid"
+	stableRemoteID    = "remote-id"
+	stableInterfaceID = "interface-id"
+)
+
+func init() {
+	plugins.RegisterPlugin("prefix", setup6, nil)
+	plugins.RegisterConstraints("prefix", plugins.Constraints{
+		After:    []string{"server_id", "oui", "userclass"},
+		Provides: []string{plugins.TagAddress},
+	})
+	plugins.RegisterEndpoint("prefix", "/prefix/pools", http.HandlerFunc(servePools))
+}
+
+// binding is a prefix delegated to an IA_PD of a router.
+type binding struct {
+	pool    *pool
+	offset  uint64
+	length  int
+	expires time.Time
+}
+
+// bindingKey returns the key of the delegation of an IA_PD, from the DUID and
+// the IAID, in hex.
+func bindingKey(duid, iaid string) string {
+	return duid + "/" + iaid
+}
+
+// the pools, by prefix, and the delegations, by bindingKey, are shared by the
+// instances of the plugin, and kept across reloads
+var (
+	lock     sync.Mutex
+	pools    = make(map[string]*pool)
+	bindings = make(map[string]*binding)
+	swept    time.Time
+)
+
+// usePools returns the pools of prefixes, which must not overlap: the pools
+// already known are kept with their delegations, the new ones restore their
+// delegations from the lease store, and the pools that are no longer
+// configured are forgotten.
+func usePools(prefixes []*net.IPNet) ([]*pool, error) {
+	for i, a := range prefixes {
+		for _, b := range prefixes[:i] {
+			if a.Contains(b.IP) || b.Contains(a.IP) {
+				return nil, fmt.Errorf("the pool %s overlaps the pool %s", a, b)
+			}
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	used := make(map[string]*pool, len(prefixes))
+	ret := make([]*pool, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		p, ok := pools[prefix.String()]
+		if !ok {
+			var err error
+			if p, err = newPool(prefix); err != nil {
+				return nil, err
+			}
+		}
+		used[prefix.String()] = p
+		ret = append(ret, p)
+	}
+	old := pools
+	pools = used
+	for key, p := range used {
+		if _, ok := old[key]; !ok {
+			if err := restore(p, clock.Now()); err != nil {
+				log.Printf("plugins/prefix: cannot restore the delegations of %s: %v", p.prefix, err)
+			}
+		}
+		report(p)
+	}
+	return ret, nil
+}
+
+// restore claims the prefixes of a new pool that are delegated in the lease
+// store, and binds them to their IA_PDs. The lock must be held.
+func restore(p *pool, now time.Time) error {
+	stored, err := leases.LeasesInSubnet(leases.Default, p.prefix)
+	if err != nil {
+		return err
+	}
+	for _, l := range stored {
+		adopt(p, l, now)
+	}
+	return nil
+}
+
+// adopt binds a prefix delegated in the lease store to its IA_PD, if it is
+// of the pool, not expired and free, replacing the delegation that the IA_PD
+// has in another pool. The lock must be held.
+func adopt(p *pool, l *leases.Lease, now time.Time) bool {
+	if l.PrefixLen == 0 || l.Expired(now) {
+		return false
+	}
+	off, ok := p.offset(l.IP)
+	if !ok || !p.claim(off, l.PrefixLen) {
+		return false
+	}
+	key := bindingKey(l.ClientID, l.IAID)
+	if b, ok := bindings[key]; ok {
+		b.pool.release(b.offset, b.length)
+		report(b.pool)
+	}
+	bindings[key] = &binding{pool: p, offset: off, length: l.PrefixLen, expires: l.Ends}
+	return true
+}
+
+// report updates the gauges of a pool, with the labels of its subnet. The
+// lock must be held.
+func report(p *pool) {
+	s := p.stats()
+	labels := metadata.OfServer(true, p.prefix.IP).With("pool", s.Pool)
+	stats.Set(s.Size, statPoolSize, labels...)
+	stats.Set(s.Delegated, statPoolDelegated, labels...)
+	stats.Set(uint64(s.Utilization), statPoolUtilization, labels...)
+	stats.Set(uint64(s.LargestFree), statPoolLargestFree, labels...)
+	stats.Set(uint64(s.Fragmentation), statPoolFragmentation, labels...)
+}
+
+// sweep releases the expired delegations. The lock must be held.
+func sweep(now time.Time) {
+	swept = now
+	changed := make(map[*pool]bool)
+	for key, b := range bindings {
+		if now.After(b.expires) {
+			b.pool.release(b.offset, b.length)
+			delete(bindings, key)
+			changed[b.pool] = true
+		}
+	}
+	for p := range changed {
+		report(p)
+	}
+}
+
+// delegator delegates the prefixes of its pools.
+type delegator struct {
+	pools  []*pool
+	length int
+	// classes maps the client classes to the lengths of their prefixes
+	classes map[string]int
+	// hosts maps the DUIDs, in hex, to the lengths of their prefixes
+	hosts map[string]int
+	// stable is the customer identifier the stable prefixes are derived
+	// from, or empty
+	stable   string
+	lifetime time.Duration
+}
+
+// request is the delegation requested for an IA_PD.
+type request struct {
+	// duid and iaid are in hex
+	duid, iaid string
+	hint       net.IP
+	length     int
+	// stable is the customer identifier, or nil
+	stable []byte
+}
+
+// parseLength parses a `<name>,<length>` value.
+func parseLength(value string) (string, int, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 2 {
+		return "", 0, errors.New("need a name and a length")
+	}
+	length, err := strconv.Atoi(fields[1])
+	return fields[0], length, err
+}
+
+// loadDUIDs reads a file of DUIDs, one per line in hex, with optional colons.
+// Empty lines and lines starting with `#` are ignored.
+func loadDUIDs(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var ret []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		duid := strings.ToLower(strings.Replace(line, ":", "", -1))
+		if _, err := hex.DecodeString(duid); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid DUID `%s`", filename, i+1, line)
+		}
+		ret = append(ret, duid)
+	}
+	return ret, nil
+}
+
+func setup6(args ...string) (handler.Handler6, error) {
+	d := delegator{length: 56, lifetime: time.Hour, classes: make(map[string]int), hosts: make(map[string]int)}
+	var prefixes []*net.IPNet
+	for _, arg := range args {
+		if arg == "stable" {
+			d.stable = stableDUID
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) == 1 {
+			_, prefix, err := net.ParseCIDR(arg)
+			if err != nil {
+				return nil, fmt.Errorf("plugins/prefix: invalid pool `%s`: %v", arg, err)
+			}
+			prefixes = append(prefixes, prefix)
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "length":
+			d.length, err = strconv.Atoi(kv[1])
+		case "lifetime":
+			d.lifetime, err = time.ParseDuration(kv[1])
+		case "class":
+			var class string
+			var length int
+			if class, length, err = parseLength(kv[1]); err == nil {
+				d.classes[class] = length
+			}
+		case "duids":
+			var (
+				filename string
+				length   int
+				duids    []string
+			)
+			if filename, length, err = parseLength(kv[1]); err == nil {
+				if duids, err = loadDUIDs(filename); err == nil {
+					for _, duid := range duids {
+						d.hosts[duid] = length
+					}
+				}
+			}
+		case "stable":
+			d.stable = kv[1]
+			if d.stable != stableDUID && d.stable != stableRemoteID && d.stable != stableInterfaceID {
+				err = errors.New("unknown customer identifier")
+			}
+		default:
+			err = errors.New("unknown argument")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("plugins/prefix: invalid argument `%s`: %v", arg, err)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errors.New("plugins/prefix: need at least one pool")
+	}
+	lengths := []int{d.length}
+	for _, l := range d.classes {
+		lengths = append(lengths, l)
+	}
+	for _, l := range d.hosts {
+		lengths = append(lengths, l)
+	}
+	for _, prefix := range prefixes {
+		ones, _ := prefix.Mask.Size()
+		for _, l := range lengths {
+			if l < ones || l > 64 {
+				return nil, fmt.Errorf("plugins/prefix: invalid length %d for the pool %s", l, prefix)
+			}
+		}
+	}
+	var err error
+	if d.pools, err = usePools(prefixes); err != nil {
+		return nil, fmt.Errorf("plugins/prefix: %v", err)
+	}
+	log.Printf("plugins/prefix: delegating /%d prefixes from %d pool(s), with %d class and %d DUID length(s)", d.length, len(d.pools), len(d.classes), len(d.hosts))
+	return d.Handler6, nil
+}
+
+// lengthOf returns the length of the prefixes of a client.
+func (d *delegator) lengthOf(ctx context.Context, duid string) int {
+	if l, ok := d.hosts[duid]; ok {
+		return l
+	}
+	length := d.length
+	for _, class := range handler.Classes(ctx) {
+		if l, ok := d.classes[class]; ok {
+			length = l
+		}
+	}
+	return length
+}
+
+// stableID returns the customer identifier of a request, or nil.
+func (d *delegator) stableID(req dhcpv6.DHCPv6, duid string) []byte {
+	switch d.stable {
+	case stableDUID:
+		return []byte(duid)
+	case stableRemoteID:
+		return dhcputil.RelayOption6(req, dhcpv6.OptionRemoteID)
+	case stableInterfaceID:
+		return dhcputil.RelayOption6(req, dhcpv6.OptionInterfaceID)
+	}
+	return nil
+}
+
+// claimStable claims the stable prefix of a customer identifier in a pool,
+// or one of the next ones. The lock must be held.
+func claimStable(p *pool, id []byte, length int) (uint64, bool) {
+	h := fnv.New64a()
+	h.Write(id)
+	slots := p.size() / units(length)
+	slot := h.Sum64() % slots
+	for i := uint64(0); i < stableProbes && i < slots; i++ {
+		off := ((slot + i) % slots) * units(length)
+		if p.claim(off, length) {
+			return off, true
+		}
+	}
+	return 0, false
+}
+
+// delegate returns the prefix delegated to an IA_PD: its current delegation,
+// or else the prefix it asks for if it is free, or else its stable prefix if
+// enabled, or else a new one, and stores it in the lease store. It returns nil
+// if the pools are full, or the lease store fails.
+func (d *delegator) delegate(r *request, ttl time.Duration, now time.Time) *binding {
+	lock.Lock()
+	defer lock.Unlock()
+	if now.Sub(swept) > sweepInterval {
+		sweep(now)
+	}
+	key := bindingKey(r.duid, r.iaid)
+	if b, ok := bindings[key]; ok && !d.serves(b, r.length) {
+		// the pool or the length changed with the configuration or the
+		// classes of the client
+		unbind(key, b)
+	}
+	for i := 0; i < claimAttempts; i++ {
+		b, fresh := d.bind(key, r)
+		if b == nil {
+			return nil
+		}
+		// a solicit does not shorten a delegation
+		expires := b.expires
+		if e := now.Add(ttl); e.After(expires) {
+			expires = e
+		}
+		lease := leases.Lease{
+			IP:        b.pool.ip(b.offset),
+			ClientID:  r.duid,
+			Starts:    now,
+			Ends:      expires,
+			PrefixLen: b.length,
+			IAID:      r.iaid,
+		}
+		switch err := leases.Claim(leases.Default, &lease); err {
+		case nil:
+			b.expires = expires
+			bindings[key] = b
+			report(b.pool)
+			c := *b
+			return &c
+		case leases.ErrConflict:
+			// the prefix is delegated to another router in the store,
+			// which it is bound to before trying another one
+			b.pool.release(b.offset, b.length)
+			delete(bindings, key)
+			if cur, err := leases.Default.Lease(lease.IP); err == nil {
+				adopt(b.pool, cur, now)
+			}
+			report(b.pool)
+		default:
+			log.Printf("plugins/prefix: cannot store the delegation of %s/%d: %v", lease.IP, b.length, err)
+			if fresh {
+				b.pool.release(b.offset, b.length)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// bind returns the current delegation of an IA_PD, or else claims a prefix
+// for it, which is not bound yet, and returns true. The lock must be held.
+func (d *delegator) bind(key string, r *request) (*binding, bool) {
+	if b, ok := bindings[key]; ok {
+		return b, false
+	}
+	if r.hint != nil {
+		for _, p := range d.pools {
+			if off, ok := p.offset(r.hint); ok && p.claim(off, r.length) {
+				return &binding{pool: p, offset: off, length: r.length}, true
+			}
+		}
+	}
+	if r.stable != nil {
+		for _, p := range d.pools {
+			if off, ok := claimStable(p, r.stable, r.length); ok {
+				return &binding{pool: p, offset: off, length: r.length}, true
+			}
+		}
+	}
+	for _, p := range d.pools {
+		if off, ok := p.allocate(r.length); ok {
+			return &binding{pool: p, offset: off, length: r.length}, true
+		}
+	}
+	return nil, false
+}
+
+// unbind releases a delegation, and deletes its lease if the lease store
+// still has it. The lock must be held.
+func unbind(key string, b *binding) {
+	b.pool.release(b.offset, b.length)
+	delete(bindings, key)
+	report(b.pool)
+	ip := b.pool.ip(b.offset)
+	if cur, err := leases.Default.Lease(ip); err == nil && cur.PrefixLen > 0 && bindingKey(cur.ClientID, cur.IAID) == key {
+		if err := leases.Default.DeleteLease(ip); err != nil {
+			log.Printf("plugins/prefix: cannot delete the delegation of %s/%d: %v", ip, b.length, err)
+		}
+	}
+}
+
+// serves returns whether a delegation is still valid for the configuration,
+// given the length of the prefixes of the client.
+func (d *delegator) serves(b *binding, length int) bool {
+	for _, p := range d.pools {
+		if p == b.pool {
+			return b.length == length
+		}
+	}
+	return false
+}
+
+// release releases the prefix delegated to an IA_PD, if any.
+func release(key string) {
+	lock.Lock()
+	defer lock.Unlock()
+	if b, ok := bindings[key]; ok {
+		unbind(key, b)
+	}
+}
+
+// hint returns the prefix that an IA_PD asks for, or nil.
+func hint(iapd *dhcpv6.OptIAForPrefixDelegation) net.IP {
+	for _, opt := range iapd.Options {
+		if p, ok := opt.(*dhcpv6.OptIAPrefix); ok && p.Prefix() != nil && !p.Prefix().IsUnspecified() {
+			return p.Prefix()
+		}
+	}
+	return nil
+}
+
+// Handler6 delegates the prefixes requested in the IA_PD options.
+func (d *delegator) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return resp, false
+	}
+	duid := hex.EncodeToString(cid.Cid.ToBytes())
+	length, stable := d.lengthOf(ctx, duid), d.stableID(req, duid)
+	now := clock.Now()
+	for _, opt := range msg.GetOption(dhcpv6.OptionIAPD) {
+		iapd, ok := opt.(*dhcpv6.OptIAForPrefixDelegation)
+		if !ok {
+			continue
+		}
+		iaid := hex.EncodeToString(iapd.IaId[:])
+		key := bindingKey(duid, iaid)
+		ttl := d.lifetime
+		switch msg.Type() {
+		case dhcpv6.MessageTypeRelease:
+			release(key)
+			continue
+		case dhcpv6.MessageTypeSolicit:
+			ttl = offerTTL
+		case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		default:
+			continue
+		}
+		b := d.delegate(&request{duid: duid, iaid: iaid, hint: hint(iapd), length: length, stable: stable}, ttl, now)
+		if b == nil {
+			logger.FromContext(ctx).Printf("plugins/prefix: no prefix available for %s", key)
+			status := make([]byte, 2, 2+len("no prefix available"))
+			binary.BigEndian.PutUint16(status, statusNoPrefixAvail)
+			status = append(status, "no prefix available"...)
+			reply.AddOption(&dhcpv6.OptIAForPrefixDelegation{
+				IaId:    iapd.IaId,
+				Options: []dhcpv6.Option{&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionStatusCode, OptionData: status}},
+			})
+			continue
+		}
+		lifetime := uint32(d.lifetime / time.Second)
+		p := dhcpv6.OptIAPrefix{PreferredLifetime: lifetime, ValidLifetime: lifetime}
+		p.SetPrefix(b.pool.ip(b.offset))
+		p.SetPrefixLength(byte(b.length))
+		if dhcputil.Requested6(msg, OptionPDExclude) {
+			delegated := &net.IPNet{IP: b.pool.ip(b.offset), Mask: net.CIDRMask(b.length, 128)}
+			if ex := excluded(delegated, links(ctx, req, reply)); ex != nil {
+				p.Options = append(p.Options, &dhcpv6.OptionGeneric{OptionCode: OptionPDExclude, OptionData: encodeExclude(b.length, ex)})
+				logger.FromContext(ctx).Printf("plugins/prefix: excluding %s from %s for %s", ex, delegated, key)
+			}
+		}
+		reply.AddOption(&dhcpv6.OptIAForPrefixDelegation{
+			IaId:    iapd.IaId,
+			T1:      lifetime / 2,
+			T2:      lifetime * 4 / 5,
+			Options: []dhcpv6.Option{&p},
+		})
+		logger.FromContext(ctx).Printf("plugins/prefix: delegated %s/%d to %s", b.pool.ip(b.offset), b.length, key)
+	}
+	return resp, false
+}
+
+// Pools returns the statistics of the pools, ordered by prefix.
+func Pools() []*PoolStats {
+	lock.Lock()
+	defer lock.Unlock()
+	ret := make([]*PoolStats, 0, len(pools))
+	for _, p := range pools {
+		ret = append(ret, p.stats())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Pool < ret[j].Pool })
+	return ret
+}
+
+// servePools serves the statistics of the pools.
+func servePools(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	management.WriteJSON(w, http.StatusOK, Pools())
+}
@@ -0,0 +1,187 @@
+package prl
+
+// This plugin strips from the responses the options that the client did not
+// request, in the Parameter Request List (option 55) of DHCPv4 requests or in
+// the Option Request Option of DHCPv6 requests. This reduces the size of the
+// responses, and matches the behavior of servers that only send requested
+// options. It should be the last plugin of the chain, before `auth_sign` if
+// any, so that it sees the final response.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ...
+//	        - prl: always=23 order
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - prl: always=3,6,15
+//
+// The options that the protocols require, or that the clients cannot request,
+// are always sent: for DHCPv4 the subnet mask, lease times, message type,
+// server identifier, relay agent information, subnet selection and
+// authentication options, and for DHCPv6 the client and server identifiers,
+// the IAs, preference, relay, authentication, unicast, status code, rapid
+// commit, interface-id and reconfigure options. The `always` argument lists
+// additional option codes that are sent whether they were requested or not.
+// With `order`, the DHCPv6 options are also sorted in the order the client
+// requested them, after the ones that are always sent; DHCPv4 options are
+// always encoded in the order of their codes.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("prl", setupPRL6, setupPRL4)
+	plugins.RegisterConstraints("prl", plugins.Constraints{Before: []string{"auth_sign"}})
+	plugins.RegisterOverridable("prl")
+}
+
+// required4 are the DHCPv4 options that are sent whether they were requested
+// or not.
+var required4 = []uint8{1, 51, 53, 54, 58, 59, 82, 90, 118}
+
+// required6 are the DHCPv6 options that are sent whether they were requested
+// or not.
+var required6 = []uint16{1, 2, 3, 4, 7, 9, 11, 12, 13, 14, 18, 19, 20, 25}
+
+// filter holds the option codes that are always sent.
+type filter struct {
+	always map[uint16]bool
+	order  bool
+}
+
+func parseArgs(args []string, required []uint16, maxCode uint64) (*filter, error) {
+	f := filter{always: make(map[uint16]bool)}
+	for _, code := range required {
+		f.always[code] = true
+	}
+	for _, arg := range args {
+		if arg == "order" {
+			f.order = true
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] != "always" {
+			return nil, fmt.Errorf("unknown argument `%s`", arg)
+		}
+		for _, c := range strings.Split(kv[1], ",") {
+			code, err := strconv.ParseUint(c, 10, 16)
+			if err != nil || code == 0 || code > maxCode {
+				return nil, fmt.Errorf("invalid option code `%s`", c)
+			}
+			f.always[uint16(code)] = true
+		}
+	}
+	return &f, nil
+}
+
+func setupPRL6(args ...string) (handler.Handler6, error) {
+	f, err := parseArgs(args, required6, 65535)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/prl: %v", err)
+	}
+	log.Print("plugins/prl: stripping the DHCPv6 options that were not requested")
+	return f.Handler6, nil
+}
+
+func setupPRL4(args ...string) (handler.Handler4, error) {
+	var required []uint16
+	for _, code := range required4 {
+		required = append(required, uint16(code))
+	}
+	f, err := parseArgs(args, required, 254)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/prl: %v", err)
+	}
+	if f.order {
+		return nil, errors.New("plugins/prl: `order` is not supported for DHCPv4")
+	}
+	log.Print("plugins/prl: stripping the DHCPv4 options that were not requested")
+	return f.Handler4, nil
+}
+
+// Handler6 strips the options that the client did not request from the
+// response.
+func (f *filter) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	// rank is the position of the options in the ORO, starting at 1
+	rank := make(map[dhcpv6.OptionCode]int)
+	if oro, ok := msg.GetOneOption(dhcpv6.OptionORO).(*dhcpv6.OptRequestedOption); ok {
+		for i, code := range oro.RequestedOptions() {
+			if _, ok := rank[code]; !ok {
+				rank[code] = i + 1
+			}
+		}
+	}
+	var kept, stripped []dhcpv6.Option
+	for _, opt := range reply.Options() {
+		if f.always[uint16(opt.Code())] || rank[opt.Code()] > 0 {
+			kept = append(kept, opt)
+		} else {
+			stripped = append(stripped, opt)
+		}
+	}
+	if f.order {
+		// stable, so that the instances of an option keep their order
+		sort.SliceStable(kept, func(i, j int) bool {
+			return rank[kept[i].Code()] < rank[kept[j].Code()]
+		})
+	}
+	if len(stripped) > 0 {
+		logger.FromContext(ctx).Debugf("plugins/prl: stripped %d option(s) that were not requested", len(stripped))
+	}
+	reply.SetOptions(kept)
+	return resp, false
+}
+
+// Handler4 strips the options that the client did not request from the
+// response.
+func (f *filter) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	requested := make(map[uint8]bool)
+	for _, code := range req.ParameterRequestList() {
+		requested[code.Code()] = true
+	}
+	var stripped []uint8
+	for code := range resp.Options {
+		if !f.always[uint16(code)] && !requested[code] {
+			stripped = append(stripped, code)
+		}
+	}
+	for _, code := range stripped {
+		delete(resp.Options, code)
+	}
+	if len(stripped) > 0 {
+		logger.FromContext(ctx).Debugf("plugins/prl: stripped options %v that were not requested", stripped)
+	}
+	return resp, false
+}
@@ -0,0 +1,269 @@
+package proxydhcp
+
+// This plugin turns the DHCPv4 server into a proxyDHCP server, as per the PXE
+// specification: it provides the network boot parameters to the PXE and UEFI
+// HTTP boot clients, next to an existing DHCP server that assigns their
+// addresses and that cannot be changed. The DHCPDISCOVERs of the network boot
+// clients are answered with DHCPOFFERs with the boot parameters but no
+// address, and the DHCPREQUESTs that the clients then send to port 4011 of the
+// server are acknowledged with the same parameters. All the other requests
+// are ignored, so it should be the only plugin of the chain.
+//
+// Usage:
+//
+//	server4:
+//	    listen: '0.0.0.0:67'
+//	    plugins:
+//	        - proxydhcp: server=192.0.2.10 bios=tftp://192.0.2.10/pxelinux.0 efi=tftp://192.0.2.10/bootx64.efi
+//
+// The `server` argument is the address of the server, sent as its server
+// identifier, and `listen` optionally sets the address of the PXE listener,
+// `0.0.0.0:4011` by default. The other arguments are the boot file URLs of the
+// `netboot` plugin. The PXE listener belongs to the instance of the plugin,
+// and is started once its configuration is committed: a reload hands the
+// listener over to the new instance if its address did not change, or else
+// closes it and opens one on the new address, and closes it if the plugin is
+// no longer configured.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/plugins/netboot"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// defaultListen is the address of the PXE listener.
+const defaultListen = "0.0.0.0:4011"
+
+// pxeDiscoveryControl is the PXE vendor option that makes the clients boot
+// the file of the DHCPOFFER, rather than discover boot servers.
+var pxeDiscoveryControl = []byte{6, 1, 8, 255}
+
+func init() {
+	plugins.RegisterPlugin("proxydhcp", nil, setupProxyDHCP4)
+	plugins.RegisterCommit("proxydhcp", commit, discard)
+}
+
+type proxy struct {
+	serverID net.IP
+	boot     *netboot.Config
+}
+
+// pxeListener is the PXE listener, which answers with the configuration of
+// the instance of the plugin it belongs to.
+type pxeListener struct {
+	// addr is the configured address of the listener.
+	addr  string
+	conn  *net.UDPConn
+	lock  sync.Mutex
+	proxy *proxy
+}
+
+// staged is an instance set up, and the address of its PXE listener.
+type staged struct {
+	addr  *net.UDPAddr
+	proxy *proxy
+}
+
+// active is the PXE listener of the committed instance, and pending the
+// instance of the configuration being loaded.
+var (
+	activeLock sync.Mutex
+	active     *pxeListener
+	pending    *staged
+)
+
+// startListener starts a PXE listener for an instance.
+func startListener(addr *net.UDPAddr, p *proxy) (*pxeListener, error) {
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &pxeListener{addr: addr.String(), conn: conn, proxy: p}
+	go l.serve()
+	return l, nil
+}
+
+// attach hands the PXE listener at an address over to a new instance, and
+// closes the listener of the previous instance if its address changed. It is
+// called with activeLock held.
+func attach(addr *net.UDPAddr, p *proxy) error {
+	if active != nil && active.addr == addr.String() {
+		active.lock.Lock()
+		active.proxy = p
+		active.lock.Unlock()
+		return nil
+	}
+	log.Printf("plugins/proxydhcp: starting the PXE listener on %s", addr)
+	l, err := startListener(addr, p)
+	if err != nil && active != nil {
+		// the previous listener can hold the port, e.g. on the wildcard
+		// address
+		active.conn.Close()
+		active = nil
+		l, err = startListener(addr, p)
+	}
+	if err != nil {
+		return err
+	}
+	if active != nil {
+		log.Printf("plugins/proxydhcp: closing the PXE listener on %s", active.conn.LocalAddr())
+		active.conn.Close()
+	}
+	active = l
+	return nil
+}
+
+// commit attaches the PXE listener to the instance of the committed
+// configuration, or closes it if the plugin is no longer loaded.
+func commit(loaded bool) {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+	if !loaded {
+		pending = nil
+	}
+	if pending == nil {
+		if active != nil {
+			log.Printf("plugins/proxydhcp: closing the PXE listener on %s", active.conn.LocalAddr())
+			active.conn.Close()
+			active = nil
+		}
+		return
+	}
+	if err := attach(pending.addr, pending.proxy); err != nil {
+		log.Printf("plugins/proxydhcp: cannot start the PXE listener: %v", err)
+	}
+	pending = nil
+}
+
+// discard drops the instance of a configuration that was not committed.
+func discard() {
+	activeLock.Lock()
+	defer activeLock.Unlock()
+	pending = nil
+}
+
+func setupProxyDHCP4(args ...string) (handler.Handler4, error) {
+	var (
+		p          proxy
+		listen     = defaultListen
+		bootArgs   []string
+		err        error
+		listenAddr *net.UDPAddr
+	)
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "server="):
+			p.serverID = net.ParseIP(strings.TrimPrefix(arg, "server="))
+			if p.serverID == nil || p.serverID.To4() == nil {
+				return nil, fmt.Errorf("plugins/proxydhcp: invalid server address `%s`", arg)
+			}
+			p.serverID = p.serverID.To4()
+		case strings.HasPrefix(arg, "listen="):
+			listen = strings.TrimPrefix(arg, "listen=")
+		default:
+			bootArgs = append(bootArgs, arg)
+		}
+	}
+	if p.serverID == nil {
+		return nil, errors.New("plugins/proxydhcp: need the server address")
+	}
+	if listenAddr, err = net.ResolveUDPAddr("udp4", listen); err != nil {
+		return nil, fmt.Errorf("plugins/proxydhcp: invalid listen address: %v", err)
+	}
+	if p.boot, err = netboot.ParseArgs(bootArgs); err != nil {
+		return nil, fmt.Errorf("plugins/proxydhcp: %v", err)
+	}
+	activeLock.Lock()
+	pending = &staged{addr: listenAddr, proxy: &p}
+	activeLock.Unlock()
+	return p.Handler4, nil
+}
+
+// reply returns a response to a network boot client, with its boot
+// parameters but no address.
+func (p *proxy) reply(ctx context.Context, req *dhcpv4.DHCPv4, mt dhcpv4.MessageType) (*dhcpv4.DHCPv4, error) {
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+	if err != nil {
+		return nil, err
+	}
+	resp.Options = make(dhcpv4.Options)
+	resp.UpdateOption(dhcpv4.OptMessageType(mt))
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(p.serverID))
+	resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, pxeDiscoveryControl))
+	resp.YourIPAddr = net.IPv4zero
+	p.boot.Apply4(ctx, req, resp)
+	return resp, nil
+}
+
+// Handler4 answers the DHCPDISCOVERs of the network boot clients with proxy
+// DHCPOFFERs, and ignores the other requests.
+func (p *proxy) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if req.MessageType() != dhcpv4.MessageTypeDiscover || netboot.Vendor4(req) == "" {
+		return nil, true
+	}
+	offer, err := p.reply(ctx, req, dhcpv4.MessageTypeOffer)
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/proxydhcp: cannot build the DHCPOFFER: %v", err)
+		return nil, true
+	}
+	return offer, true
+}
+
+// serve reads the requests of the PXE listener until it is closed.
+func (l *pxeListener) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, peer, err := l.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.Printf("plugins/proxydhcp: PXE listener on %s stopped: %v", l.conn.LocalAddr(), err)
+			return
+		}
+		req, err := dhcpv4.FromBytes(buf[:n])
+		if err != nil {
+			log.Printf("plugins/proxydhcp: ignoring malformed request from %s: %v", peer, err)
+			continue
+		}
+		l.lock.Lock()
+		p := l.proxy
+		l.lock.Unlock()
+		go p.handlePXE(l.conn, peer, req)
+	}
+}
+
+// handlePXE acknowledges the DHCPREQUESTs that the network boot clients send
+// to the PXE listener.
+func (p *proxy) handlePXE(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
+	if req.OpCode != dhcpv4.OpcodeBootRequest || netboot.Vendor4(req) == "" {
+		return
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform:
+	default:
+		return
+	}
+	ctx := handler.WithConn(handler.WithPeer(context.Background(), peer), conn)
+	log := logger.FromContext(ctx)
+	ack, err := p.reply(ctx, req, dhcpv4.MessageTypeAck)
+	if err != nil {
+		log.Printf("plugins/proxydhcp: cannot build the DHCPACK: %v", err)
+		return
+	}
+	if _, err := conn.WriteTo(dhcputil.Encode4(ack), peer); err != nil {
+		log.Printf("plugins/proxydhcp: cannot send the DHCPACK to %s: %v", peer, err)
+	}
+}
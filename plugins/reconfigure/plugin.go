@@ -0,0 +1,248 @@
+package reconfigure
+
+// This plugin lets the server push configuration changes to the DHCPv6
+// clients, by sending them a Reconfigure message (RFC 8415) that makes them
+// renew their bindings or request their configuration again. The messages
+// are authenticated with the Reconfigure Key Authentication Protocol: clients
+// that accept Reconfigure messages, as advertised by the Reconfigure Accept
+// option, are given a key in the Reply to their Request, Renew, Rebind or
+// Information-request, which the server keeps to sign the Reconfigure
+// messages. It should come after the server_id plugin, and be the last plugin
+// of the chain, so that it sees the final response.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - server_id: LL 00:de:ad:be:ef:00
+//	        - reconfigure:
+//
+// The messages are sent with the management API, which must be enabled:
+//
+//	curl -X POST 'http://localhost:8053/reconfigure?client=<DUID>&type=renew'
+//
+// The client is identified by its DUID, as in the history. The type is either
+// `renew` (the default) or `information-request`. Without the `client`
+// parameter, all the known clients are sent one. The clients are forgotten
+// when their bindings expire, and at most dhcpauth.MaxClients are kept, the
+// least recently seen ones being evicted.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcpauth"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/plugins"
+	serverid "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Types of the authentication information of the Reconfigure Key
+// Authentication Protocol
+const (
+	infoKey    = 1
+	infoDigest = 2
+)
+
+// clientPort is the DHCPv6 client port.
+const clientPort = 546
+
+func init() {
+	plugins.RegisterPlugin("reconfigure", setupReconfigure6, nil)
+	plugins.RegisterConstraints("reconfigure", plugins.Constraints{After: []string{"server_id"}})
+	plugins.RegisterEndpoint("reconfigure", "/reconfigure", http.HandlerFunc(serveReconfigure))
+}
+
+// clients holds the clients given a reconfigure key, by DUID, with the DUID as
+// their data. It is kept across configuration reloads.
+var clients = dhcpauth.NewClients(dhcpauth.MaxClients)
+
+func setupReconfigure6(args ...string) (handler.Handler6, error) {
+	log.Print("plugins/reconfigure: giving reconfigure keys to the clients")
+	return Handler6, nil
+}
+
+// clientAddress returns the address to send the Reconfigure messages to: the
+// first address assigned to the client in the response, or else its source
+// address if it is not relayed.
+func clientAddress(ctx context.Context, req, resp dhcpv6.DHCPv6) net.IP {
+	if ip := dhcputil.FirstAddress6(resp); ip != nil {
+		return ip
+	}
+	if req.IsRelay() {
+		return nil
+	}
+	if peer, ok := handler.Peer(ctx).(*net.UDPAddr); ok {
+		return peer.IP
+	}
+	return nil
+}
+
+// validLifetime returns the longest valid lifetime of the addresses assigned
+// in a response, or DefaultClientTTL if there is none.
+func validLifetime(resp dhcpv6.DHCPv6) time.Duration {
+	var valid uint32
+	for _, addr := range dhcputil.IAAddresses6(resp) {
+		if addr.ValidLifetime > valid {
+			valid = addr.ValidLifetime
+		}
+	}
+	if valid == 0 {
+		return dhcpauth.DefaultClientTTL
+	}
+	return time.Duration(valid) * time.Second
+}
+
+// Handler6 adds a reconfigure key to the Replies sent to clients that accept
+// Reconfigure messages.
+func Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil || msg.GetOneOption(dhcpv6.OptionReconfAccept) == nil {
+		return resp, false
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeInformationRequest:
+	default:
+		return resp, false
+	}
+	cid, ok := msg.GetOneOption(dhcpv6.OptionClientID).(*dhcpv6.OptClientId)
+	if !ok {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil || reply.Type() != dhcpv6.MessageTypeReply {
+		return resp, false
+	}
+	ip, conn := clientAddress(ctx, req, reply), handler.Conn(ctx)
+	if ip == nil || conn == nil {
+		return resp, false
+	}
+	key, err := dhcpauth.NewKey()
+	if err != nil {
+		logger.FromContext(ctx).Printf("plugins/reconfigure: cannot generate a key: %v", err)
+		return resp, false
+	}
+	auth := dhcpauth.Option{
+		Protocol:  dhcpauth.ProtocolReconfigureKey,
+		Algorithm: dhcpauth.AlgorithmHMACMD5,
+		RDM:       dhcpauth.RDMMonotonic,
+		Replay:    dhcpauth.NextReplay(),
+		Info:      append([]byte{infoKey}, key...),
+	}
+	reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionAuth, OptionData: auth.ToBytes()})
+	reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionReconfAccept})
+	clients.Add(&dhcpauth.Client{
+		ID:      strings.ToLower(cid.Cid.String()),
+		IP:      ip,
+		Key:     key,
+		Conn:    conn,
+		Expires: clock.Now().Add(validLifetime(reply)),
+		Data:    cid.Cid,
+	})
+	return resp, false
+}
+
+// message returns a signed Reconfigure message for a client.
+func message(c *dhcpauth.Client, msgType dhcpv6.MessageType) (dhcpv6.DHCPv6, error) {
+	sid := serverid.ServerID6()
+	if sid == nil {
+		return nil, errors.New("no server identifier, the server_id plugin is required")
+	}
+	d, err := dhcpv6.NewMessage()
+	if err != nil {
+		return nil, err
+	}
+	msg := d.(*dhcpv6.DHCPv6Message)
+	msg.SetMessage(dhcpv6.MessageTypeReconfigure)
+	// the transaction ID of Reconfigure messages is zero
+	msg.SetTransactionID(0)
+	auth := dhcpauth.Option{
+		Protocol:  dhcpauth.ProtocolReconfigureKey,
+		Algorithm: dhcpauth.AlgorithmHMACMD5,
+		RDM:       dhcpauth.RDMMonotonic,
+		Replay:    dhcpauth.NextReplay(),
+		Info:      make([]byte, 1+dhcpauth.DigestSize),
+	}
+	auth.Info[0] = infoDigest
+	msg.SetOptions([]dhcpv6.Option{
+		&dhcpv6.OptServerId{Sid: *sid},
+		&dhcpv6.OptClientId{Cid: c.Data.(dhcpv6.Duid)},
+		&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionReconfMessage, OptionData: []byte{byte(msgType)}},
+		&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionAuth, OptionData: auth.ToBytes()},
+	})
+	// the digest is computed over the message with a zeroed digest field
+	copy(auth.Info[1:], dhcpauth.HMACMD5(c.Key, msg.ToBytes()))
+	msg.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: dhcpv6.OptionAuth, OptionData: auth.ToBytes()})
+	return msg, nil
+}
+
+// send sends a Reconfigure message to a client.
+func send(c *dhcpauth.Client, msgType dhcpv6.MessageType) error {
+	msg, err := message(c, msgType)
+	if err == nil {
+		_, err = c.Conn.WriteTo(msg.ToBytes(), &net.UDPAddr{IP: c.IP, Port: clientPort})
+	}
+	if err != nil {
+		log.Printf("plugins/reconfigure: cannot send Reconfigure to %s (%s): %v", c.ID, c.IP, err)
+		return err
+	}
+	log.Printf("plugins/reconfigure: sent Reconfigure to %s (%s)", c.ID, c.IP)
+	return nil
+}
+
+// ErrUnknownClient is returned by Reconfigure for a client that never got a
+// reconfigure key, either because it did not get a Reply or because it does
+// not accept Reconfigure messages, or whose bindings expired.
+var ErrUnknownClient = dhcpauth.ErrUnknownClient
+
+// Reconfigure sends a Reconfigure message of the given type, either
+// dhcpv6.MessageTypeRenew or dhcpv6.MessageTypeInformationRequest, to the
+// client with the given DUID, or to all the known clients if duid is empty. It
+// returns the number of messages sent.
+func Reconfigure(duid string, msgType dhcpv6.MessageType) (int, error) {
+	return clients.Send(strings.ToLower(duid), func(c *dhcpauth.Client) error {
+		return send(c, msgType)
+	})
+}
+
+// serveReconfigure implements POST /reconfigure?client=<DUID>&type=<type>.
+func serveReconfigure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	msgType := dhcpv6.MessageTypeRenew
+	switch t := r.URL.Query().Get("type"); t {
+	case "", "renew":
+	case "information-request":
+		msgType = dhcpv6.MessageTypeInformationRequest
+	default:
+		management.WriteError(w, http.StatusBadRequest, fmt.Errorf("unknown message type `%s`", t))
+		return
+	}
+	sent, err := Reconfigure(r.URL.Query().Get("client"), msgType)
+	if err == ErrUnknownClient {
+		management.WriteError(w, http.StatusNotFound, err)
+		return
+	} else if err != nil && sent == 0 {
+		management.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+	management.WriteJSON(w, http.StatusOK, map[string]int{"sent": sent})
+}
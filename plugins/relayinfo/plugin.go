@@ -0,0 +1,151 @@
+package relayinfo
+
+// This plugin implements the server side of the relay agent information option
+// (option 82, RFC 3046). It is made of two plugins: `relayinfo` validates the
+// option in the requests and should be the first plugin of the chain, and
+// `relayinfo_echo` copies it unchanged into the responses, as the relays
+// expect, and should be the last one.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - relayinfo: trusted=10.0.0.0/24,10.0.1.5/32
+//	        - ...
+//	        - relayinfo_echo:
+//
+// The requests whose option is malformed are dropped. So are, as per section
+// 2.1 of RFC 3046, the requests with the option but no relay address (giaddr),
+// unless they come from one of the `trusted` prefixes, e.g. switches doing
+// DHCP snooping, which insert the option without relaying the requests.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("relayinfo", nil, setupRelayInfo4)
+	plugins.RegisterOverridable("relayinfo")
+	plugins.RegisterPlugin("relayinfo_echo", nil, setupEcho4)
+	plugins.RegisterConstraints("relayinfo_echo", plugins.Constraints{After: []string{"relayinfo"}})
+	plugins.RegisterOverridable("relayinfo_echo")
+}
+
+type validator struct {
+	// trusted are the prefixes of the agents allowed to send the option
+	// without a relay address.
+	trusted []*net.IPNet
+}
+
+func setupRelayInfo4(args ...string) (handler.Handler4, error) {
+	var v validator
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "trusted=") {
+			return nil, fmt.Errorf("plugins/relayinfo: unknown argument `%s`", arg)
+		}
+		for _, p := range strings.Split(strings.TrimPrefix(arg, "trusted="), ",") {
+			_, prefix, err := net.ParseCIDR(p)
+			if err != nil || prefix.IP.To4() == nil {
+				return nil, fmt.Errorf("plugins/relayinfo: invalid trusted prefix `%s`", p)
+			}
+			v.trusted = append(v.trusted, prefix)
+		}
+	}
+	log.Printf("plugins/relayinfo: trusting %d prefix(es) for unrelayed relay agent information", len(v.trusted))
+	return v.Handler4, nil
+}
+
+func setupEcho4(args ...string) (handler.Handler4, error) {
+	log.Print("plugins/relayinfo: echoing the relay agent information")
+	return Echo4, nil
+}
+
+// valid returns whether the payload of the option is a well-formed sequence
+// of suboptions.
+func valid(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for len(data) > 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return false
+		}
+		data = data[2+int(data[1]):]
+	}
+	return true
+}
+
+// trust returns whether an agent can send the option without a relay address.
+func (v *validator) trust(peer net.Addr) bool {
+	addr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range v.trusted {
+		if prefix.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler4 drops the requests with an invalid or untrusted relay agent
+// information option.
+func (v *validator) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	data := req.GetOneOption(dhcpv4.OptionRelayAgentInformation)
+	if data == nil {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	if !valid(data) {
+		log.Print("plugins/relayinfo: dropping request with malformed relay agent information")
+		return nil, true
+	}
+	if (req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified()) && !v.trust(handler.Peer(ctx)) {
+		log.Printf("plugins/relayinfo: dropping unrelayed request with relay agent information from %v", handler.Peer(ctx))
+		return nil, true
+	}
+	return resp, false
+}
+
+// Echo4 copies the relay agent information option of the request into the
+// response.
+func Echo4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	if data := req.GetOneOption(dhcpv4.OptionRelayAgentInformation); data != nil {
+		resp.UpdateOption(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, data))
+	}
+	return resp, false
+}
+
+// The suboptions of the relay agent information option (RFC 3046) that
+// identify the subscriber.
+const (
+	SuboptionCircuitID = 1
+	SuboptionRemoteID  = 2
+)
+
+// Suboption returns the payload of a suboption of the relay agent information
+// option of a request, or nil if there is none.
+func Suboption(req *dhcpv4.DHCPv4, code byte) []byte {
+	data := req.GetOneOption(dhcpv4.OptionRelayAgentInformation)
+	for len(data) >= 2 && len(data) >= 2+int(data[1]) {
+		if data[0] == code {
+			return data[2 : 2+int(data[1])]
+		}
+		data = data[2+int(data[1]):]
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package rsoo
+
+// This plugin merges the Relay-Supplied Options (RFC 6422) into the responses:
+// relays can provide options for the client in the RSOO option of their
+// Relay-Forward messages, and the permitted ones are added to the response,
+// unless an earlier plugin already set them. It should be the last plugin of
+// the chain.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - rsoo: 2001:db8:ff::/64 options=65
+//
+// The prefixes are the addresses of the relays that are trusted to supply
+// options: RSOOs received from other relays are ignored. The `options`
+// argument is the comma-separated list of the option codes that relays are
+// permitted to supply, which defaults to the ones registered as RSOO-enabled
+// (65, the ERP Local Domain Name).
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// OptionRSOO is the Relay-Supplied Options option code.
+const OptionRSOO dhcpv6.OptionCode = 66
+
+// defaultPermitted are the RSOO-enabled options of the IANA registry.
+var defaultPermitted = []dhcpv6.OptionCode{65}
+
+func init() {
+	plugins.RegisterPlugin("rsoo", setupRSOO6, nil)
+	plugins.RegisterOverridable("rsoo")
+}
+
+type merger struct {
+	trusted   []*net.IPNet
+	permitted map[dhcpv6.OptionCode]bool
+}
+
+func setupRSOO6(args ...string) (handler.Handler6, error) {
+	m := merger{permitted: make(map[dhcpv6.OptionCode]bool)}
+	codes := defaultPermitted
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "options=") {
+			codes = nil
+			for _, c := range strings.Split(strings.TrimPrefix(arg, "options="), ",") {
+				code, err := strconv.ParseUint(c, 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("plugins/rsoo: invalid option code `%s`", c)
+				}
+				codes = append(codes, dhcpv6.OptionCode(code))
+			}
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(arg)
+		if err != nil {
+			return nil, fmt.Errorf("plugins/rsoo: invalid relay prefix `%s`", arg)
+		}
+		m.trusted = append(m.trusted, prefix)
+	}
+	if len(m.trusted) == 0 {
+		return nil, errors.New("plugins/rsoo: need at least one trusted relay prefix")
+	}
+	for _, code := range codes {
+		m.permitted[code] = true
+	}
+	log.Printf("plugins/rsoo: trusting %d relay prefix(es) for %d option(s)", len(m.trusted), len(m.permitted))
+	return m.Handler6, nil
+}
+
+// trust returns whether the request was received from a trusted relay.
+func (m *merger) trust(ctx context.Context) bool {
+	peer, ok := handler.Peer(ctx).(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, prefix := range m.trusted {
+		if prefix.Contains(peer.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOptions parses the options encapsulated in an RSOO.
+func parseOptions(data []byte) ([]*dhcpv6.OptionGeneric, error) {
+	var opts []*dhcpv6.OptionGeneric
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errors.New("truncated option header")
+		}
+		code := dhcpv6.OptionCode(binary.BigEndian.Uint16(data))
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, fmt.Errorf("truncated option %d", code)
+		}
+		opts = append(opts, &dhcpv6.OptionGeneric{OptionCode: code, OptionData: data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return opts, nil
+}
+
+// supplied returns the permitted options supplied by the relays of a request.
+// When several relays supply the same option, the one closest to the client
+// takes precedence.
+func (m *merger) supplied(ctx context.Context, req dhcpv6.DHCPv6) map[dhcpv6.OptionCode]*dhcpv6.OptionGeneric {
+	ret := make(map[dhcpv6.OptionCode]*dhcpv6.OptionGeneric)
+	for d := req; d.IsRelay(); {
+		if rsoo, ok := d.GetOneOption(OptionRSOO).(*dhcpv6.OptionGeneric); ok {
+			opts, err := parseOptions(rsoo.OptionData)
+			if err != nil {
+				logger.FromContext(ctx).Printf("plugins/rsoo: malformed RSOO: %v", err)
+			}
+			for _, opt := range opts {
+				if m.permitted[opt.OptionCode] {
+					ret[opt.OptionCode] = opt
+				}
+			}
+		}
+		inner, err := dhcpv6.DecapsulateRelay(d)
+		if err != nil {
+			break
+		}
+		d = inner
+	}
+	return ret
+}
+
+// Handler6 adds the options supplied by trusted relays to the response.
+func (m *merger) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil || !req.IsRelay() || !m.trust(ctx) {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	opts := m.supplied(ctx, req)
+	codes := make([]dhcpv6.OptionCode, 0, len(opts))
+	for code := range opts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	for _, code := range codes {
+		// the options configured on the server take precedence
+		if msg.GetOneOption(code) == nil {
+			msg.AddOption(opts[code])
+		}
+	}
+	return resp, false
+}
@@ -0,0 +1,281 @@
+package s46
+
+// This plugin provisions MAP-E, MAP-T and Lightweight 4over6 CE devices, with
+// the Softwire46 container options of RFC 7598. The options are only added to
+// responses to clients that requested the container in their ORO.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - s46: map-e br=2001:db8::1 rule=192.0.2.0/24,2001:db8:100::/40,16,6,fmr
+//	        - s46: map-t dmr=2001:db8:ffff::/64 rule=198.51.100.0/24,2001:db8:200::/40,16
+//
+// The first argument is the mechanism: `map-e`, `map-t` or `lw4o6`. The other
+// arguments are:
+//   - br=<address>: a border relay, at least one for MAP-E and lw4o6;
+//   - dmr=<prefix>: the default mapping rule, exactly one for MAP-T;
+//   - rule=<IPv4 prefix>,<IPv6 prefix>,<EA-bits length>[,<PSID offset>][,fmr]:
+//     a mapping rule, at least one for MAP-E and MAP-T. The PSID offset
+//     defaults to 6, and `fmr` marks the rule as a forwarding mapping rule.
+//
+// The per-client bindings of lw4o6 are not supported, so its container only
+// carries the border relays.
+//
+// The rules are validated when the plugin is loaded, so that an inconsistent
+// configuration is rejected rather than sent to the CEs.
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Softwire46 option codes (RFC 7598)
+const (
+	OptionS46Rule       dhcpv6.OptionCode = 89
+	OptionS46BR         dhcpv6.OptionCode = 90
+	OptionS46DMR        dhcpv6.OptionCode = 91
+	OptionS46PortParams dhcpv6.OptionCode = 93
+	OptionS46ContMAPE   dhcpv6.OptionCode = 94
+	OptionS46ContMAPT   dhcpv6.OptionCode = 95
+	OptionS46ContLW     dhcpv6.OptionCode = 96
+)
+
+func init() {
+	plugins.RegisterPlugin("s46", setupS46, nil)
+	plugins.RegisterOverridable("s46")
+}
+
+// Rule is a MAP mapping rule.
+type Rule struct {
+	IPv4Prefix *net.IPNet
+	IPv6Prefix *net.IPNet
+	// EALen is the length of the embedded address bits.
+	EALen int
+	// PSIDOffset is the number of high-order bits of the ports excluded
+	// from the port sets.
+	PSIDOffset int
+	// FMR is true if the rule is a forwarding mapping rule.
+	FMR bool
+}
+
+// PSIDLen returns the length of the port set identifier of the rule, i.e.
+// the EA bits that do not encode the IPv4 address suffix.
+func (r *Rule) PSIDLen() int {
+	ones, _ := r.IPv4Prefix.Mask.Size()
+	return r.EALen - (32 - ones)
+}
+
+// Validate checks the consistency of the rule parameters, as per RFC 7597.
+func (r *Rule) Validate() error {
+	ones4, _ := r.IPv4Prefix.Mask.Size()
+	ones6, _ := r.IPv6Prefix.Mask.Size()
+	switch {
+	case r.EALen < 0 || r.EALen > 48:
+		return fmt.Errorf("EA-bits length %d out of range 0-48", r.EALen)
+	case ones6+r.EALen > 64:
+		// the end-user prefix must fit in the routing prefix of the CE
+		return fmt.Errorf("IPv6 prefix length %d plus EA-bits length %d exceeds 64", ones6, r.EALen)
+	case r.PSIDLen() < 0:
+		return fmt.Errorf("EA-bits length %d shorter than the IPv4 suffix length %d", r.EALen, 32-ones4)
+	case r.PSIDLen() > 16:
+		return fmt.Errorf("PSID length %d exceeds 16", r.PSIDLen())
+	case r.PSIDOffset < 0 || r.PSIDOffset > 15:
+		return fmt.Errorf("PSID offset %d out of range 0-15", r.PSIDOffset)
+	case r.PSIDLen() > 0 && r.PSIDOffset+r.PSIDLen() > 16:
+		return fmt.Errorf("PSID offset %d plus PSID length %d exceeds 16", r.PSIDOffset, r.PSIDLen())
+	}
+	return nil
+}
+
+// ParseRule parses a rule in the
+// `<IPv4 prefix>,<IPv6 prefix>,<EA-bits length>[,<PSID offset>][,fmr]` format.
+func ParseRule(s string) (*Rule, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("malformed rule `%s`", s)
+	}
+	rule := Rule{PSIDOffset: 6}
+	var err error
+	if _, rule.IPv4Prefix, err = net.ParseCIDR(fields[0]); err != nil || rule.IPv4Prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 prefix in rule `%s`", s)
+	}
+	if _, rule.IPv6Prefix, err = net.ParseCIDR(fields[1]); err != nil || rule.IPv6Prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 prefix in rule `%s`", s)
+	}
+	if rule.EALen, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("invalid EA-bits length in rule `%s`", s)
+	}
+	for _, f := range fields[3:] {
+		if f == "fmr" {
+			rule.FMR = true
+		} else if rule.PSIDOffset, err = strconv.Atoi(f); err != nil {
+			return nil, fmt.Errorf("invalid PSID offset in rule `%s`", s)
+		}
+	}
+	if err := rule.Validate(); err != nil {
+		return nil, fmt.Errorf("rule `%s`: %v", s, err)
+	}
+	return &rule, nil
+}
+
+func suboption(code dhcpv6.OptionCode, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+	return append(b, data...)
+}
+
+// prefixBytes returns the prefix length and the significant bytes of a
+// prefix, as encoded in the S46 options.
+func prefixBytes(prefix *net.IPNet) []byte {
+	ones, _ := prefix.Mask.Size()
+	return append([]byte{byte(ones)}, prefix.IP.To16()[:(ones+7)/8]...)
+}
+
+// encode returns the OPTION_S46_RULE encoding of the rule.
+func (r *Rule) encode() []byte {
+	var flags byte
+	if r.FMR {
+		flags = 0x01
+	}
+	ones4, _ := r.IPv4Prefix.Mask.Size()
+	data := []byte{flags, byte(r.EALen), byte(ones4)}
+	data = append(data, r.IPv4Prefix.IP.To4()...)
+	data = append(data, prefixBytes(r.IPv6Prefix)...)
+	// the port parameters, with the PSID left to the CE (its length only)
+	ports := []byte{byte(r.PSIDOffset), byte(r.PSIDLen()), 0, 0}
+	data = append(data, suboption(OptionS46PortParams, ports)...)
+	return suboption(OptionS46Rule, data)
+}
+
+// container is a configured S46 container option.
+type container struct {
+	code    dhcpv6.OptionCode
+	rules   []*Rule
+	brs     []net.IP
+	dmr     *net.IPNet
+	payload []byte
+}
+
+func parseContainer(args []string) (*container, error) {
+	if len(args) < 1 {
+		return nil, errors.New("plugins/s46: need a mechanism (map-e, map-t or lw4o6)")
+	}
+	var c container
+	switch strings.ToLower(args[0]) {
+	case "map-e":
+		c.code = OptionS46ContMAPE
+	case "map-t":
+		c.code = OptionS46ContMAPT
+	case "lw4o6":
+		c.code = OptionS46ContLW
+	default:
+		return nil, fmt.Errorf("plugins/s46: unknown mechanism `%s`", args[0])
+	}
+	for _, arg := range args[1:] {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/s46: malformed argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "br":
+			ip := net.ParseIP(kv[1])
+			if ip == nil || ip.To4() != nil {
+				return nil, fmt.Errorf("plugins/s46: invalid border relay address `%s`", kv[1])
+			}
+			c.brs = append(c.brs, ip)
+		case "dmr":
+			if c.dmr != nil {
+				return nil, errors.New("plugins/s46: only one default mapping rule is allowed")
+			}
+			_, dmr, err := net.ParseCIDR(kv[1])
+			if err != nil || dmr.IP.To4() != nil {
+				return nil, fmt.Errorf("plugins/s46: invalid default mapping rule `%s`", kv[1])
+			}
+			c.dmr = dmr
+		case "rule":
+			rule, err := ParseRule(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("plugins/s46: %v", err)
+			}
+			c.rules = append(c.rules, rule)
+		default:
+			return nil, fmt.Errorf("plugins/s46: unknown argument `%s`", kv[0])
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("plugins/s46: %v", err)
+	}
+	for _, rule := range c.rules {
+		c.payload = append(c.payload, rule.encode()...)
+	}
+	for _, br := range c.brs {
+		c.payload = append(c.payload, suboption(OptionS46BR, br.To16())...)
+	}
+	if c.dmr != nil {
+		c.payload = append(c.payload, suboption(OptionS46DMR, prefixBytes(c.dmr))...)
+	}
+	return &c, nil
+}
+
+// validate checks the options required by each mechanism.
+func (c *container) validate() error {
+	if c.code == OptionS46ContLW {
+		// the lw4o6 bindings are per client, and not supported
+		if len(c.rules) > 0 || c.dmr != nil {
+			return errors.New("only border relays are valid for lw4o6")
+		}
+	} else if len(c.rules) == 0 {
+		return errors.New("at least one mapping rule is required")
+	}
+	switch c.code {
+	case OptionS46ContMAPE, OptionS46ContLW:
+		if len(c.brs) == 0 {
+			return errors.New("at least one border relay is required")
+		}
+		if c.dmr != nil {
+			return errors.New("a default mapping rule is only valid for MAP-T")
+		}
+	case OptionS46ContMAPT:
+		if c.dmr == nil {
+			return errors.New("a default mapping rule is required for MAP-T")
+		}
+		if len(c.brs) > 0 {
+			return errors.New("border relays are not valid for MAP-T")
+		}
+	}
+	return nil
+}
+
+func setupS46(args ...string) (handler.Handler6, error) {
+	c, err := parseContainer(args)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("plugins/s46: loaded %s container with %d rule(s)", args[0], len(c.rules))
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if resp == nil {
+			return resp, false
+		}
+		msg, err := dhcputil.InnerMessage6(req)
+		if err != nil || !dhcputil.Requested6(msg, c.code) {
+			return resp, false
+		}
+		resp.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: c.code, OptionData: c.payload})
+		return resp, false
+	}, nil
+}
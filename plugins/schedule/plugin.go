@@ -0,0 +1,364 @@
+package schedule
+
+// This plugin restricts the new leases of client classes to time windows, e.g.
+// guest Wi-Fi during business hours only, and puts the server in maintenance,
+// where it keeps renewing the leases of its clients but does not give new
+// ones. Outside of the windows of their class, or in maintenance, the DHCPv4
+// clients get no offer and their DHCPREQUESTs for new leases, i.e. the ones
+// selecting an offer, are NAKed, and the DHCPv6 Solicits and Requests are
+// dropped. The renewals, the rebindings and the DHCPREQUESTs of the clients
+// rebooting with their lease (INIT-REBOOT) are answered.
+//
+// Usage:
+//
+//	server6:
+//	    plugins:
+//	        - ...
+//	        - schedule: window=guests,mon-fri,08:00-18:00 window=guests,sat,10:00-14:00 tz=Europe/Paris
+//	server4:
+//	    plugins:
+//	        - ...
+//	        - schedule: window=guests,mon-fri,08:00-18:00 maintenance
+//
+// `window=<class>,[<days>,...]<from>-<to>` opens a window for a class, on the
+// given days (`mon` to `sun`, or ranges like `mon-fri`), every day if none is
+// given. A window ending before it starts, e.g. 22:00-06:00, ends the next
+// day. The clients of a class with windows get new leases only when one of
+// them is open. The times are in the local time zone, or in the one of `tz`.
+//
+// `maintenance` starts the server in maintenance, unless the management API
+// already set it: the API toggles it, with an optional reason recorded in the
+// audit log, and the configuration reloads keep its state:
+//
+//	curl -X POST 'http://localhost:8053/schedule/maintenance?enabled=true&reason=core+upgrade'
+//
+// The plugin should come after the classification plugins.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// statRefused counts the requests for new leases that were refused.
+const statRefused = "dhcp_schedule_refused_total"
+
+func init() {
+	plugins.RegisterPlugin("schedule", setupSchedule6, setupSchedule4)
+	plugins.RegisterConstraints("schedule", plugins.Constraints{After: []string{"server_id", "oui", "userclass"}})
+	plugins.RegisterEndpoint("schedule", "/schedule/maintenance", http.HandlerFunc(serveMaintenance))
+}
+
+// maintenance is whether the server is in maintenance, and toggled whether it
+// was set through the management API. They are kept across configuration
+// reloads.
+var (
+	maintenanceLock sync.RWMutex
+	maintenance     bool
+	toggled         bool
+)
+
+// InMaintenance returns whether the server is in maintenance.
+func InMaintenance() bool {
+	maintenanceLock.RLock()
+	defer maintenanceLock.RUnlock()
+	return maintenance
+}
+
+// SetMaintenance puts the server in maintenance, or takes it out of it. The
+// `maintenance` argument of the plugins no longer applies then.
+func SetMaintenance(enabled bool) {
+	setMaintenance(enabled, true)
+}
+
+// setMaintenance sets the maintenance through the API, or else for the
+// `maintenance` argument, unless the API set it.
+func setMaintenance(enabled, api bool) {
+	maintenanceLock.Lock()
+	if !api && toggled {
+		maintenanceLock.Unlock()
+		return
+	}
+	toggled = toggled || api
+	changed := maintenance != enabled
+	maintenance = enabled
+	maintenanceLock.Unlock()
+	if changed && enabled {
+		log.Print("plugins/schedule: maintenance started, no new leases")
+	} else if changed {
+		log.Print("plugins/schedule: maintenance ended")
+	}
+}
+
+// window is a time window on some days of the week. The times are in minutes
+// since midnight.
+type window struct {
+	days     [7]bool
+	from, to int
+}
+
+// open returns whether the window is open at a time.
+func (w *window) open(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	if w.from <= w.to {
+		return w.days[t.Weekday()] && now >= w.from && now < w.to
+	}
+	// the window ends the day after it starts
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && now >= w.from) || (w.days[yesterday] && now < w.to)
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// parseDays adds a day, or a range of days, to a window.
+func (w *window) parseDays(s string) error {
+	bounds := strings.SplitN(s, "-", 2)
+	first, ok := dayNames[bounds[0]]
+	if !ok {
+		return fmt.Errorf("invalid day `%s`", bounds[0])
+	}
+	last := first
+	if len(bounds) == 2 {
+		if last, ok = dayNames[bounds[1]]; !ok {
+			return fmt.Errorf("invalid day `%s`", bounds[1])
+		}
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+// parseTime parses a `<hh>:<mm>` time, in minutes since midnight. 24:00 is
+// the end of the day.
+func parseTime(s string) (int, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) == 2 {
+		h, errh := strconv.Atoi(fields[0])
+		m, errm := strconv.Atoi(fields[1])
+		if errh == nil && errm == nil && h >= 0 && m >= 0 && m < 60 && h*60+m <= 24*60 {
+			return h*60 + m, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time `%s`", s)
+}
+
+// parseWindow parses a `<class>,[<days>,...]<from>-<to>` window.
+func parseWindow(value string) (string, *window, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) < 2 || fields[0] == "" {
+		return "", nil, errors.New("need a class and a time range")
+	}
+	var (
+		w   window
+		err error
+	)
+	days := fields[1 : len(fields)-1]
+	if len(days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, d := range days {
+		if err := w.parseDays(d); err != nil {
+			return "", nil, err
+		}
+	}
+	times := strings.Split(fields[len(fields)-1], "-")
+	if len(times) != 2 {
+		return "", nil, fmt.Errorf("invalid time range `%s`", fields[len(fields)-1])
+	}
+	if w.from, err = parseTime(times[0]); err != nil {
+		return "", nil, err
+	}
+	if w.to, err = parseTime(times[1]); err != nil {
+		return "", nil, err
+	}
+	if w.from == w.to {
+		return "", nil, fmt.Errorf("empty time range `%s`", fields[len(fields)-1])
+	}
+	return fields[0], &w, nil
+}
+
+type scheduler struct {
+	location *time.Location
+	// windows maps the classes to their windows
+	windows map[string][]*window
+}
+
+func setup(args []string) (*scheduler, error) {
+	s := scheduler{location: time.Local, windows: make(map[string][]*window)}
+	for _, arg := range args {
+		if arg == "maintenance" {
+			setMaintenance(true, false)
+			continue
+		}
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/schedule: unknown argument `%s`", arg)
+		}
+		switch kv[0] {
+		case "window":
+			class, w, err := parseWindow(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("plugins/schedule: invalid window `%s`: %v", kv[1], err)
+			}
+			s.windows[class] = append(s.windows[class], w)
+		case "tz":
+			var err error
+			if s.location, err = time.LoadLocation(kv[1]); err != nil {
+				return nil, fmt.Errorf("plugins/schedule: invalid time zone `%s`: %v", kv[1], err)
+			}
+		default:
+			return nil, fmt.Errorf("plugins/schedule: unknown argument `%s`", arg)
+		}
+	}
+	log.Printf("plugins/schedule: loaded windows for %d class(es) in %s, maintenance=%v", len(s.windows), s.location, InMaintenance())
+	return &s, nil
+}
+
+func setupSchedule6(args ...string) (handler.Handler6, error) {
+	s, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handler6, nil
+}
+
+func setupSchedule4(args ...string) (handler.Handler4, error) {
+	s, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Handler4, nil
+}
+
+// refusal returns why a client cannot get a new lease now, or an empty string
+// if it can.
+func (s *scheduler) refusal(ctx context.Context, now time.Time) string {
+	if InMaintenance() {
+		return "maintenance"
+	}
+	now = now.In(s.location)
+	for _, class := range handler.Classes(ctx) {
+		windows, ok := s.windows[class]
+		if !ok {
+			continue
+		}
+		open := false
+		for _, w := range windows {
+			if w.open(now) {
+				open = true
+				break
+			}
+		}
+		if !open {
+			return "schedule"
+		}
+	}
+	return ""
+}
+
+// Handler6 drops the Solicits and Requests of the clients that cannot get new
+// leases.
+func (s *scheduler) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	if t := msg.Type(); t != dhcpv6.MessageTypeSolicit && t != dhcpv6.MessageTypeRequest {
+		return resp, false
+	}
+	reason := s.refusal(ctx, clock.Now())
+	if reason == "" {
+		return resp, false
+	}
+	stats.Inc(statRefused, "version", "6", "reason", reason)
+	logger.FromContext(ctx).Printf("plugins/schedule: dropping %s, no new leases (%s)", msg.Type(), reason)
+	return nil, true
+}
+
+// Handler4 refuses the DHCPDISCOVERs and the DHCPREQUESTs for new leases of
+// the clients that cannot get new leases. Only the clients selecting an offer
+// send the server identifier (RFC 2131 4.3.2): the renewing and rebinding
+// clients fill in their address (ciaddr) instead, and the rebooting ones only
+// request their address.
+func (s *scheduler) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+	case dhcpv4.MessageTypeRequest:
+		if req.ServerIdentifier() == nil || (req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified()) {
+			return resp, false
+		}
+	default:
+		return resp, false
+	}
+	reason := s.refusal(ctx, clock.Now())
+	if reason == "" {
+		return resp, false
+	}
+	log := logger.FromContext(ctx)
+	stats.Inc(statRefused, "version", "4", "reason", reason)
+	if req.MessageType() == dhcpv4.MessageTypeDiscover {
+		log.Printf("plugins/schedule: dropping %s, no new leases (%s)", req.MessageType(), reason)
+		return nil, true
+	}
+	log.Printf("plugins/schedule: NAKing %s, no new leases (%s)", req.MessageType(), reason)
+	var serverID net.IP
+	if resp != nil {
+		serverID = resp.ServerIdentifier()
+	}
+	nak, err := dhcputil.Nak4(req, serverID, "no new leases")
+	if err != nil {
+		log.Printf("plugins/schedule: NewReplyFromRequest failed: %v", err)
+		return nil, true
+	}
+	return nak, true
+}
+
+// serveMaintenance returns whether the server is in maintenance, and with POST
+// sets it from the `enabled` parameter, and records the action with the
+// optional `reason` parameter.
+func serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			management.WriteError(w, http.StatusBadRequest, errors.New("invalid or missing enabled parameter"))
+			return
+		}
+		SetMaintenance(enabled)
+		action := "end-maintenance"
+		if enabled {
+			action = "start-maintenance"
+		}
+		management.RecordAction(r, management.Action{Action: action, Plugin: "schedule", Reason: r.URL.Query().Get("reason")})
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	management.WriteJSON(w, http.StatusOK, map[string]bool{"maintenance": InMaintenance()})
+}
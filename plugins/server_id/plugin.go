@@ -1,10 +1,16 @@
 package clientport
 
 import (
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -18,16 +24,67 @@ var log = logger.GetLogger()
 
 func init() {
 	plugins.RegisterPlugin("server_id", setupServerID6, setupServerID4)
+	plugins.RegisterCommit("server_id", commit, discard)
 }
 
-// V6ServerID is the DUID of the v6 server
-var V6ServerID *dhcpv6.Duid
+// The identity of the server is published when the configuration of the
+// plugin is committed: identityLock protects v6ServerID, the DUID of the
+// DHCPv6 server, and v4ServerIDs, the DHCPv4 server identifiers, for
+// ServerID6 and IsServerID4. pending6 and pending4 are the identities of the
+// configuration being loaded.
+var (
+	identityLock sync.Mutex
+	v6ServerID   *dhcpv6.Duid
+	v4ServerIDs  []net.IP
+	pending6     *identity6
+	pending4     []net.IP
+)
+
+// ServerID6 returns the DUID of the DHCPv6 server, or nil if the plugin is not
+// configured for DHCPv6.
+func ServerID6() *dhcpv6.Duid {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+	return v6ServerID
+}
+
+// identity6 is the DUID of the DHCPv6 server, and the state file it is stored
+// in, if any.
+type identity6 struct {
+	duid     *dhcpv6.Duid
+	filename string
+}
 
-// Handler6 handles DHCPv6 packets for the file plugin
-func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
-	if V6ServerID == nil {
-		return resp, false
+// commit stores the DUID of the committed configuration in its state file, and
+// publishes the identities of the server.
+func commit(loaded bool) {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+	if !loaded {
+		pending6, pending4 = nil, nil
 	}
+	v6ServerID = nil
+	if pending6 != nil {
+		if pending6.filename != "" {
+			if err := storeDUID(pending6.filename, pending6.duid); err != nil {
+				log.Printf("plugins/server_id: cannot store the DUID: %v", err)
+			}
+		}
+		v6ServerID = pending6.duid
+	}
+	v4ServerIDs = pending4
+	pending6, pending4 = nil, nil
+}
+
+// discard drops the identities of a configuration that was not committed.
+func discard() {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+	pending6, pending4 = nil, nil
+}
+
+// Handler6 handles DHCPv6 packets for the server_id plugin
+func (id *identity6) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 	if resp == nil {
 		var (
 			tmp dhcpv6.DHCPv6
@@ -45,36 +102,125 @@ func Handler6(req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
 		}
 
 		if err != nil {
-			log.Printf("plugins/server_id: NewReplyFromDHCPv6Message failed: %v", err)
+			logger.FromContext(ctx).Printf("plugins/server_id: NewReplyFromDHCPv6Message failed: %v", err)
 			return resp, false
 		}
 		resp = tmp
 	}
-	resp = dhcpv6.WithServerID(*V6ServerID)(resp)
+	resp = dhcpv6.WithServerID(*id.duid)(resp)
 	return resp, false
 }
 
-// Handler4 handles DHCPv4 packets for the file plugin
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	// do nothing
+// IsServerID4 returns whether an address is one of the configured DHCPv4
+// server identifiers, or true if the plugin is not configured for DHCPv4,
+// i.e. the identity of the server is unknown.
+func IsServerID4(ip net.IP) bool {
+	identityLock.Lock()
+	defer identityLock.Unlock()
+	if v4ServerIDs == nil {
+		return true
+	}
+	for _, id := range v4ServerIDs {
+		if id.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// identity4 is the DHCPv4 server identifier used on the links of a prefix.
+type identity4 struct {
+	prefix *net.IPNet
+	ip     net.IP
+}
+
+// identities4 holds the DHCPv4 server identifiers.
+type identities4 struct {
+	defaultIP net.IP
+	links     []identity4
+}
+
+// serverID returns the server identifier to use on the link of an address,
+// which can be nil.
+func (ids *identities4) serverID(ip net.IP) net.IP {
+	if ip != nil {
+		for _, link := range ids.links {
+			if link.prefix.Contains(ip) {
+				return link.ip
+			}
+		}
+	}
+	return ids.defaultIP
+}
+
+// replyTypes4 maps the DHCPv4 requests that get a response to the type of
+// the response.
+var replyTypes4 = map[dhcpv4.MessageType]dhcpv4.MessageType{
+	dhcpv4.MessageTypeDiscover: dhcpv4.MessageTypeOffer,
+	dhcpv4.MessageTypeRequest:  dhcpv4.MessageTypeAck,
+	dhcpv4.MessageTypeInform:   dhcpv4.MessageTypeAck,
+}
+
+// Handler4 handles DHCPv4 packets for the server_id plugin
+func (ids *identities4) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		mt, ok := replyTypes4[req.MessageType()]
+		if !ok {
+			return resp, false
+		}
+		tmp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(mt))
+		if err != nil {
+			logger.FromContext(ctx).Printf("plugins/server_id: NewReplyFromRequest failed: %v", err)
+			return resp, false
+		}
+		resp = tmp
+	}
+	// the link is the one of the address of the client, or of its relay
+	resp.UpdateOption(dhcpv4.OptServerIdentifier(ids.serverID(handler.Address4(ctx, req, nil))))
 	return resp, false
 }
 
 func setupServerID4(args ...string) (handler.Handler4, error) {
-	// TODO implement this function
-	return nil, errors.New("plugins/server_id: not implemented for DHCPv4")
+	log.Print("plugins/server_id: loading `server_id` plugin for DHCPv4")
+	if len(args) < 1 {
+		return nil, errors.New("plugins/server_id: need a server identifier address")
+	}
+	var ids identities4
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		ip := net.ParseIP(kv[len(kv)-1])
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("plugins/server_id: invalid server identifier `%s`", kv[len(kv)-1])
+		}
+		if len(kv) == 1 {
+			ids.defaultIP = ip.To4()
+			continue
+		}
+		_, prefix, err := net.ParseCIDR(kv[0])
+		if err != nil || prefix.IP.To4() == nil {
+			return nil, fmt.Errorf("plugins/server_id: invalid link prefix `%s`", kv[0])
+		}
+		ids.links = append(ids.links, identity4{prefix: prefix, ip: ip.To4()})
+	}
+	if ids.defaultIP == nil {
+		return nil, errors.New("plugins/server_id: need a default server identifier address")
+	}
+	all := []net.IP{ids.defaultIP}
+	for _, link := range ids.links {
+		all = append(all, link.ip)
+	}
+	identityLock.Lock()
+	pending4 = all
+	identityLock.Unlock()
+	log.Printf("plugins/server_id: using %s, and %d link-specific identifier(s)", ids.defaultIP, len(ids.links))
+	return ids.Handler4, nil
 }
 
-func setupServerID6(args ...string) (handler.Handler6, error) {
-	log.Print("plugins/server_id: loading `server_id` plugin")
-	if len(args) < 2 {
-		return nil, errors.New("plugins/server_id: need a DUID type and value")
-	}
-	duidType := args[0]
+// parseDUID parses a DUID type and value.
+func parseDUID(duidType, duidValue string) (*dhcpv6.Duid, error) {
 	if duidType == "" {
 		return nil, errors.New("plugins/server_id: got empty DUID type")
 	}
-	duidValue := args[1]
 	if duidValue == "" {
 		return nil, errors.New("plugins/server_id: got empty DUID value")
 	}
@@ -85,27 +231,111 @@ func setupServerID6(args ...string) (handler.Handler6, error) {
 	}
 	switch duidType {
 	case "ll", "duid-ll", "duid_ll":
-		V6ServerID = &dhcpv6.Duid{
+		return &dhcpv6.Duid{
 			Type: dhcpv6.DUID_LL,
 			// sorry, only ethernet for now
 			HwType:        iana.HwTypeEthernet,
 			LinkLayerAddr: hwaddr,
-		}
+		}, nil
 	case "llt", "duid-llt", "duid_llt":
-		V6ServerID = &dhcpv6.Duid{
+		return &dhcpv6.Duid{
 			Type: dhcpv6.DUID_LLT,
 			// sorry, zero-time for now
 			Time: 0,
 			// sorry, only ethernet for now
 			HwType:        iana.HwTypeEthernet,
 			LinkLayerAddr: hwaddr,
-		}
+		}, nil
 	case "en", "uuid":
 		return nil, errors.New("EN/UUID DUID type not supported yet")
 	default:
 		return nil, errors.New("Opaque DUID type not supported yet")
 	}
-	log.Printf("plugins/server_id: using %s %s", duidType, duidValue)
+}
+
+// duidEpoch is the origin of the time of the DUID-LLTs.
+var duidEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// generateDUID returns a new DUID-LLT, from the hardware address of the first
+// Ethernet interface of the host and the current time.
+func generateDUID() (*dhcpv6.Duid, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		return &dhcpv6.Duid{
+			Type:          dhcpv6.DUID_LLT,
+			Time:          uint32(time.Since(duidEpoch) / time.Second),
+			HwType:        iana.HwTypeEthernet,
+			LinkLayerAddr: iface.HardwareAddr,
+		}, nil
+	}
+	return nil, errors.New("no Ethernet interface to generate a DUID from")
+}
+
+// loadDUID returns the DUID to use with the state file filename: the
+// configured DUID if any, or else the DUID stored in the file, or else a new
+// one. The DUID is stored in the file by storeDUID once the configuration is
+// committed, so that the server keeps its identity across restarts.
+func loadDUID(filename string, duid *dhcpv6.Duid) (*dhcpv6.Duid, error) {
+	if duid != nil {
+		return duid, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("malformed DUID in %s: %v", filename, err)
+		}
+		return dhcpv6.DuidFromBytes(raw)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if duid, err = generateDUID(); err != nil {
+		return nil, err
+	}
+	log.Printf("plugins/server_id: generated a new DUID, to be stored in %s", filename)
+	return duid, nil
+}
+
+// storeDUID stores a DUID in the state file filename.
+func storeDUID(filename string, duid *dhcpv6.Duid) error {
+	return ioutil.WriteFile(filename, []byte(hex.EncodeToString(duid.ToBytes())+"\n"), 0644)
+}
+
+func setupServerID6(args ...string) (handler.Handler6, error) {
+	log.Print("plugins/server_id: loading `server_id` plugin")
+	var filename string
+	if len(args) > 0 && strings.HasPrefix(args[len(args)-1], "file=") {
+		filename = strings.TrimPrefix(args[len(args)-1], "file=")
+		args = args[:len(args)-1]
+	}
+	var (
+		duid *dhcpv6.Duid
+		err  error
+	)
+	switch {
+	case len(args) >= 2:
+		if duid, err = parseDUID(args[0], args[1]); err != nil {
+			return nil, err
+		}
+	case filename == "":
+		return nil, errors.New("plugins/server_id: need a DUID type and value, or a state file")
+	}
+	if filename != "" {
+		if duid, err = loadDUID(filename, duid); err != nil {
+			return nil, fmt.Errorf("plugins/server_id: %v", err)
+		}
+	}
+	id := &identity6{duid: duid, filename: filename}
+	identityLock.Lock()
+	pending6 = id
+	identityLock.Unlock()
+	log.Printf("plugins/server_id: using DUID %s", duid.String())
 
-	return Handler6, nil
+	return id.Handler6, nil
 }
@@ -0,0 +1,203 @@
+package sip
+
+// This plugin provides the clients with their SIP outbound proxy servers, e.g.
+// for the IP phones of a voice VLAN, in option 120 (RFC 3361) for DHCPv4, and
+// in the SIP Servers Domain Name List and IPv6 Address List options (21 and 22,
+// RFC 3319) for DHCPv6. The phones that need them request them, so the other
+// clients do not get them.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - sip: sip1.example.com sip2.example.com
+//
+// The arguments are the servers, as domain names or addresses. DHCPv4 option
+// 120 carries either names or IPv4 addresses, so the servers of a DHCPv4
+// plugin cannot mix both. DHCPv6 clients get the names in option 21 and the
+// IPv6 addresses in option 22. The `sip` option replaces the servers, e.g. on
+// the class of the phones of a site with its own proxies, and an empty one
+// withholds them, e.g. from the phones that are provisioned by hand.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/dnsname"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// SIP server option codes (RFC 3361 and RFC 3319)
+const (
+	OptionSIPServers4       = dhcpv4.GenericOptionCode(120)
+	OptionSIPServersDomain6 = dhcpv6.OptionCode(21)
+	OptionSIPServersAddr6   = dhcpv6.OptionCode(22)
+)
+
+// Encodings of DHCPv4 option 120
+const (
+	encodingNames     = 0
+	encodingAddresses = 1
+)
+
+func init() {
+	plugins.RegisterPlugin("sip", setupSIP6, setupSIP4)
+	plugins.RegisterConstraints("sip", plugins.Constraints{Uses: plugins.OptionTags})
+}
+
+// Default payloads of the options, used when no option definition overrides
+// them.
+var (
+	default4       []byte
+	defaultDomain6 []byte
+	defaultAddr6   []byte
+)
+
+// encode4 returns the payload of option 120 for the given servers.
+func encode4(servers []string) ([]byte, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("need at least one SIP server")
+	}
+	var names, addrs []string
+	data := []byte{encodingAddresses}
+	for _, s := range servers {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip.To4() == nil {
+				return nil, fmt.Errorf("not an IPv4 address: %s", s)
+			}
+			addrs = append(addrs, s)
+			data = append(data, ip.To4()...)
+		} else {
+			names = append(names, s)
+		}
+	}
+	if len(names) > 0 && len(addrs) > 0 {
+		return nil, errors.New("cannot mix SIP server names and addresses in DHCPv4")
+	}
+	if len(addrs) > 0 {
+		return data, nil
+	}
+	encoded, err := dnsname.Encode(names...)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{encodingNames}, encoded...), nil
+}
+
+// encode6 returns the payloads of options 21 and 22 for the given servers.
+// Either can be nil.
+func encode6(servers []string) ([]byte, []byte, error) {
+	if len(servers) == 0 {
+		return nil, nil, errors.New("need at least one SIP server")
+	}
+	var names []string
+	var addrs []byte
+	for _, s := range servers {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip.To4() != nil {
+				return nil, nil, fmt.Errorf("not an IPv6 address: %s", s)
+			}
+			addrs = append(addrs, ip.To16()...)
+		} else {
+			names = append(names, s)
+		}
+	}
+	if len(names) == 0 {
+		return nil, addrs, nil
+	}
+	domains, err := dnsname.Encode(names...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return domains, addrs, nil
+}
+
+func setupSIP6(args ...string) (handler.Handler6, error) {
+	domains, addrs, err := encode6(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/sip: %v", err)
+	}
+	defaultDomain6, defaultAddr6 = domains, addrs
+	log.Printf("plugins/sip: using SIP servers %v", args)
+	return Handler6, nil
+}
+
+func setupSIP4(args ...string) (handler.Handler4, error) {
+	data, err := encode4(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/sip: %v", err)
+	}
+	default4 = data
+	log.Printf("plugins/sip: using SIP servers %v", args)
+	return Handler4, nil
+}
+
+// Handler6 adds the SIP server options to the response.
+func Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	wantDomains, wantAddrs := dhcputil.Requested6(msg, OptionSIPServersDomain6), dhcputil.Requested6(msg, OptionSIPServersAddr6)
+	if !wantDomains && !wantAddrs {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	domains, addrs := defaultDomain6, defaultAddr6
+	mac, _ := dhcpv6.ExtractMAC(req)
+	if err := handler.Override(handler.Options(ctx, dhcputil.LinkAddress6(req), mac), "sip", func(values []string) (err error) {
+		domains, addrs = nil, nil
+		if len(values) > 0 {
+			domains, addrs, err = encode6(values)
+		}
+		return err
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/sip: %v", err)
+		return resp, false
+	}
+	if wantDomains && domains != nil {
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionSIPServersDomain6, OptionData: domains})
+	}
+	if wantAddrs && addrs != nil {
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionSIPServersAddr6, OptionData: addrs})
+	}
+	return resp, false
+}
+
+// Handler4 adds the SIP servers option to the response.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || !req.IsOptionRequested(OptionSIPServers4) {
+		return resp, false
+	}
+	data := default4
+	if err := handler.Override(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr), "sip", func(values []string) (err error) {
+		data = nil
+		if len(values) > 0 {
+			data, err = encode4(values)
+		}
+		return err
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/sip: %v", err)
+		return resp, false
+	}
+	if data == nil {
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(OptionSIPServers4, data))
+	return resp, false
+}
@@ -0,0 +1,109 @@
+package sixrd
+
+// This plugin provides 6rd CEs with the 6rd option (RFC 5969). It only adds the
+// option to responses to clients that requested it.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - 6rd: 8 2001:db8::/32 192.0.2.1 192.0.2.2
+//
+// The arguments are the number of high-order bits of the CE IPv4 addresses
+// that are common to all the CEs of the domain, the 6rd prefix, and one or
+// more border relay addresses. They can be overridden per network, subnet
+// (i.e. per pool), class or host with the `6rd` option, which takes the same
+// values, see the options section of the configuration. An empty value
+// disables the option.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// Option6RD is the DHCPv4 6rd option code.
+const Option6RD = dhcpv4.GenericOptionCode(212)
+
+func init() {
+	plugins.RegisterPlugin("6rd", nil, setup6RD4)
+	plugins.RegisterConstraints("6rd", plugins.Constraints{Uses: plugins.OptionTags})
+}
+
+// encode validates the 6rd parameters, and returns the payload of the 6rd
+// option.
+func encode(values []string) ([]byte, error) {
+	if len(values) < 3 {
+		return nil, errors.New("need an IPv4 mask length, a 6rd prefix and at least one border relay")
+	}
+	maskLen, err := strconv.Atoi(values[0])
+	if err != nil || maskLen < 0 || maskLen > 32 {
+		return nil, fmt.Errorf("invalid IPv4 mask length `%s`", values[0])
+	}
+	_, prefix, err := net.ParseCIDR(values[1])
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid 6rd prefix `%s`", values[1])
+	}
+	prefixLen, _ := prefix.Mask.Size()
+	// the delegated prefix is the 6rd prefix followed by the CE IPv4 address
+	// bits that are not common to the domain
+	if prefixLen+32-maskLen > 128 {
+		return nil, fmt.Errorf("6rd prefix `%s` too long for an IPv4 mask length of %d", values[1], maskLen)
+	}
+	data := []byte{byte(maskLen), byte(prefixLen)}
+	data = append(data, prefix.IP.To16()...)
+	for _, v := range values[2:] {
+		br := net.ParseIP(v)
+		if br == nil || br.To4() == nil {
+			return nil, fmt.Errorf("invalid border relay address `%s`", v)
+		}
+		data = append(data, br.To4()...)
+	}
+	return data, nil
+}
+
+// defaultData is the payload of the option when no option definition
+// overrides it.
+var defaultData []byte
+
+func setup6RD4(args ...string) (handler.Handler4, error) {
+	data, err := encode(args)
+	if err != nil {
+		return nil, fmt.Errorf("plugins/6rd: %v", err)
+	}
+	defaultData = data
+	log.Printf("plugins/6rd: using 6rd prefix %s", args[1])
+	return Handler4, nil
+}
+
+// Handler4 adds the 6rd option to the response.
+func Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || !req.IsOptionRequested(Option6RD) {
+		return resp, false
+	}
+	data := defaultData
+	if values, ok := handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr)["6rd"]; ok {
+		data = nil
+		if len(values) > 0 {
+			var err error
+			if data, err = encode(values); err != nil {
+				logger.FromContext(ctx).Printf("plugins/6rd: invalid 6rd option: %v", err)
+				return resp, false
+			}
+		}
+	}
+	if data == nil {
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(Option6RD, data))
+	return resp, false
+}
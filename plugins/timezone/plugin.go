@@ -0,0 +1,178 @@
+package timezone
+
+// This plugin provides the clients with their time zone (RFC 4833), as a POSIX
+// TZ string (option 100 for DHCPv4, 41 for DHCPv6) and as a name of the tz
+// database (option 101 for DHCPv4, 42 for DHCPv6), e.g. for IP phones and
+// cameras that display the local time. Most clients understand only one of
+// the formats, and request only that one, which is the only one they get.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - timezone: posix=CET-1CEST,M3.5.0,M10.5.0/3 tzdb=Europe/Paris
+//
+// Either argument can be left out, but not both. The DHCPv4 and DHCPv6
+// instances have their own zones. The `tz-posix` and `tz-tzdb` options set the
+// zone of the sites in other time zones, e.g. on their subnets, and an empty
+// one withholds that format.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+// Time zone option codes (RFC 4833)
+const (
+	OptionPosixTimezone4 = dhcpv4.GenericOptionCode(100)
+	OptionTzdbTimezone4  = dhcpv4.GenericOptionCode(101)
+	OptionPosixTimezone6 = dhcpv6.OptionCode(41)
+	OptionTzdbTimezone6  = dhcpv6.OptionCode(42)
+)
+
+func init() {
+	plugins.RegisterPlugin("timezone", setupTimezone6, setupTimezone4)
+	plugins.RegisterConstraints("timezone", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("timezone")
+}
+
+// zone is a time zone, in both formats. Either can be empty.
+type zone struct {
+	posix string
+	tzdb  string
+}
+
+// validate checks that a time zone string can be sent to the clients, which
+// expect printable ASCII without spaces.
+func validate(s string) error {
+	for _, c := range s {
+		if c <= ' ' || c > '~' {
+			return fmt.Errorf("invalid time zone `%s`", s)
+		}
+	}
+	return nil
+}
+
+func setup(args []string) (*zone, error) {
+	var z zone
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("plugins/timezone: malformed argument `%s`", arg)
+		}
+		if err := validate(kv[1]); err != nil {
+			return nil, fmt.Errorf("plugins/timezone: %v", err)
+		}
+		switch kv[0] {
+		case "posix":
+			z.posix = kv[1]
+		case "tzdb":
+			z.tzdb = kv[1]
+		default:
+			return nil, fmt.Errorf("plugins/timezone: unknown argument `%s`", kv[0])
+		}
+	}
+	if z.posix == "" && z.tzdb == "" {
+		return nil, errors.New("plugins/timezone: need a posix= or tzdb= time zone")
+	}
+	log.Printf("plugins/timezone: using time zone posix=%s tzdb=%s", z.posix, z.tzdb)
+	return &z, nil
+}
+
+func setupTimezone6(args ...string) (handler.Handler6, error) {
+	z, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return z.Handler6, nil
+}
+
+func setupTimezone4(args ...string) (handler.Handler4, error) {
+	z, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return z.Handler4, nil
+}
+
+// resolve returns the time zone of a client, given its resolved options. An
+// invalid option disables the format it overrides.
+func (z *zone) resolve(ctx context.Context, opts config.Options) zone {
+	ret := *z
+	for name, value := range map[string]*string{"tz-posix": &ret.posix, "tz-tzdb": &ret.tzdb} {
+		value := value
+		if err := handler.Override(opts, name, func(values []string) error {
+			*value = ""
+			if len(values) == 0 {
+				return nil
+			}
+			if err := validate(values[0]); err != nil {
+				return err
+			}
+			*value = values[0]
+			return nil
+		}); err != nil {
+			logger.FromContext(ctx).Printf("plugins/timezone: %v", err)
+		}
+	}
+	return ret
+}
+
+// Handler6 adds the time zone options to the response.
+func (z *zone) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	posix, tzdb := dhcputil.Requested6(msg, OptionPosixTimezone6), dhcputil.Requested6(msg, OptionTzdbTimezone6)
+	if !posix && !tzdb {
+		return resp, false
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return resp, false
+	}
+	mac, _ := dhcpv6.ExtractMAC(req)
+	tz := z.resolve(ctx, handler.Options(ctx, dhcputil.LinkAddress6(req), mac))
+	if posix && tz.posix != "" {
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionPosixTimezone6, OptionData: []byte(tz.posix)})
+	}
+	if tzdb && tz.tzdb != "" {
+		reply.UpdateOption(&dhcpv6.OptionGeneric{OptionCode: OptionTzdbTimezone6, OptionData: []byte(tz.tzdb)})
+	}
+	return resp, false
+}
+
+// Handler4 adds the time zone options to the response.
+func (z *zone) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil {
+		return resp, false
+	}
+	posix, tzdb := req.IsOptionRequested(OptionPosixTimezone4), req.IsOptionRequested(OptionTzdbTimezone4)
+	if !posix && !tzdb {
+		return resp, false
+	}
+	tz := z.resolve(ctx, handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr))
+	if posix && tz.posix != "" {
+		resp.UpdateOption(dhcpv4.OptGeneric(OptionPosixTimezone4, []byte(tz.posix)))
+	}
+	if tzdb && tz.tzdb != "" {
+		resp.UpdateOption(dhcpv4.OptGeneric(OptionTzdbTimezone4, []byte(tz.tzdb)))
+	}
+	return resp, false
+}
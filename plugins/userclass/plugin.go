@@ -0,0 +1,128 @@
+package userclass
+
+// This plugin assigns the clients to classes from the values of their user
+// class option (option 77 for DHCPv4, option 15 for DHCPv6), as set by
+// provisioning flows such as iPXE scripts or Windows deployment, so that the
+// next plugins can branch on them. It should come before the plugins that
+// resolve the options.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - userclass: ipxe=iPXE deploy=MSFT*,WDS
+//
+// Each `<class>=<values>` argument defines a class, with a comma-separated list
+// of user class values, which match exactly or, if they end with `*`, as a
+// prefix. A client is in the class if any of its user class instances
+// matches. The DHCPv4 option is decoded as per RFC 3004, or as a single string
+// for the clients that send one, like iPXE and Windows.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+var log = logger.GetLogger()
+
+func init() {
+	plugins.RegisterPlugin("userclass", setupUserClass6, setupUserClass4)
+	plugins.RegisterConstraints("userclass", plugins.Constraints{Provides: []string{plugins.TagClasses}})
+	plugins.RegisterOverridable("userclass")
+}
+
+// class is a class and the user class values of its clients.
+type class struct {
+	name   string
+	values []string
+}
+
+// match returns whether a user class instance matches the class.
+func (c *class) match(instance string) bool {
+	for _, v := range c.values {
+		if strings.HasSuffix(v, "*") {
+			if strings.HasPrefix(instance, strings.TrimSuffix(v, "*")) {
+				return true
+			}
+		} else if instance == v {
+			return true
+		}
+	}
+	return false
+}
+
+type classifier struct {
+	classes []*class
+}
+
+func setup(args []string) (*classifier, error) {
+	var c classifier
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("plugins/userclass: malformed argument `%s`", arg)
+		}
+		c.classes = append(c.classes, &class{name: kv[0], values: strings.Split(kv[1], ",")})
+	}
+	if len(c.classes) == 0 {
+		return nil, errors.New("plugins/userclass: need at least one class")
+	}
+	log.Printf("plugins/userclass: loaded %d classes", len(c.classes))
+	return &c, nil
+}
+
+func setupUserClass6(args ...string) (handler.Handler6, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler6, nil
+}
+
+func setupUserClass4(args ...string) (handler.Handler4, error) {
+	c, err := setup(args)
+	if err != nil {
+		return nil, err
+	}
+	return c.Handler4, nil
+}
+
+// classify assigns the client to the classes matching its user class
+// instances.
+func (c *classifier) classify(ctx context.Context, instances [][]byte) {
+	for _, cl := range c.classes {
+		for _, instance := range instances {
+			if cl.match(string(instance)) {
+				handler.AddClass(ctx, cl.name)
+				break
+			}
+		}
+	}
+}
+
+// Handler6 classifies the DHCPv6 clients.
+func (c *classifier) Handler6(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return resp, false
+	}
+	for _, opt := range msg.GetOption(dhcpv6.OptionUserClass) {
+		c.classify(ctx, dhcputil.Instances6(dhcputil.OptionData6(opt)))
+	}
+	return resp, false
+}
+
+// Handler4 classifies the DHCPv4 clients.
+func (c *classifier) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	c.classify(ctx, dhcputil.UserClasses4(req))
+	return resp, false
+}
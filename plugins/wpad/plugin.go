@@ -0,0 +1,117 @@
+package wpad
+
+// This plugin provides the clients with the URL of their proxy auto-config
+// file, for the Web Proxy Auto-Discovery protocol, in DHCPv4 option 252, to
+// the browsers and operating systems that request it.
+//
+// Usage:
+//
+//	server4:
+//	    plugins:
+//	        - wpad: http://wpad.example.com/wpad.dat classes=corporate,lab
+//
+// The first argument is the URL. With `classes`, only the clients in one of
+// the given classes get it. The `wpad` option points a site or a class to
+// another proxy, and an empty one lets its clients go direct, e.g. a guest
+// class.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/plugins"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var log = logger.GetLogger()
+
+// OptionWPAD is the DHCPv4 proxy auto-config option code.
+const OptionWPAD = dhcpv4.GenericOptionCode(252)
+
+func init() {
+	plugins.RegisterPlugin("wpad", nil, setupWPAD4)
+	plugins.RegisterConstraints("wpad", plugins.Constraints{Uses: plugins.OptionTags})
+	plugins.RegisterOverridable("wpad")
+}
+
+type wpad struct {
+	url string
+	// classes restricts the option to the clients of these classes, if not
+	// empty.
+	classes []string
+}
+
+// validate checks that a string is a proxy auto-config URL.
+func validate(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid proxy auto-config URL `%s`", s)
+	}
+	return nil
+}
+
+func setupWPAD4(args ...string) (handler.Handler4, error) {
+	if len(args) < 1 {
+		return nil, errors.New("plugins/wpad: need a proxy auto-config URL")
+	}
+	if err := validate(args[0]); err != nil {
+		return nil, fmt.Errorf("plugins/wpad: %v", err)
+	}
+	w := wpad{url: args[0]}
+	for _, arg := range args[1:] {
+		if !strings.HasPrefix(arg, "classes=") {
+			return nil, fmt.Errorf("plugins/wpad: unknown argument `%s`", arg)
+		}
+		w.classes = strings.Split(strings.TrimPrefix(arg, "classes="), ",")
+	}
+	log.Printf("plugins/wpad: using proxy auto-config URL %s", w.url)
+	return w.Handler4, nil
+}
+
+// allowed returns whether the client of the transaction can get the option.
+func (w *wpad) allowed(ctx context.Context) bool {
+	if len(w.classes) == 0 {
+		return true
+	}
+	for _, class := range w.classes {
+		if handler.InClass(ctx, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler4 adds the proxy auto-config option to the response.
+func (w *wpad) Handler4(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	if resp == nil || !req.IsOptionRequested(OptionWPAD) {
+		return resp, false
+	}
+	u := ""
+	if w.allowed(ctx) {
+		u = w.url
+	}
+	if err := handler.Override(handler.Options(ctx, handler.Address4(ctx, req, resp), req.ClientHWAddr), "wpad", func(values []string) error {
+		u = ""
+		if len(values) == 0 {
+			return nil
+		}
+		if err := validate(values[0]); err != nil {
+			return err
+		}
+		u = values[0]
+		return nil
+	}); err != nil {
+		logger.FromContext(ctx).Printf("plugins/wpad: %v", err)
+		return resp, false
+	}
+	if u == "" {
+		return resp, false
+	}
+	resp.UpdateOption(dhcpv4.OptGeneric(OptionWPAD, []byte(u)))
+	return resp, false
+}
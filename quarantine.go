@@ -0,0 +1,226 @@
+package coredhcp
+
+import (
+	"container/list"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/pcap"
+	"github.com/coredhcp/coredhcp/stats"
+)
+
+// quarantineSources is the maximum number of sources tracked by the
+// quarantine. The least recently seen sources are forgotten first.
+const quarantineSources = 1024
+
+// QuarantineSample is a non-conforming packet kept by the quarantine.
+type QuarantineSample struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	// Packet is the request, in hex, as received, or as re-encoded after
+	// parsing if the server is embedded and gets the requests parsed.
+	Packet string `json:"packet"`
+}
+
+// QuarantinedSource holds the non-conforming packets received from a source.
+type QuarantinedSource struct {
+	Source   string             `json:"source"`
+	Version  string             `json:"version"`
+	Count    uint64             `json:"count"`
+	Reasons  map[string]uint64  `json:"reasons"`
+	LastSeen time.Time          `json:"last-seen"`
+	Samples  []QuarantineSample `json:"samples"`
+	// lastLog is the time of the last log line about the source, and
+	// suppressed the number of packets not logged since.
+	lastLog    time.Time
+	suppressed uint64
+}
+
+// Quarantine counts and samples the malformed or non-conforming requests by
+// source, logs them at a limited rate, and optionally dumps them in hex and
+// to a pcap file. It is safe for concurrent use.
+type Quarantine struct {
+	conf *config.QuarantineConfig
+
+	lock sync.Mutex
+	// sources maps a source to its element in lru, whose value is a
+	// *QuarantinedSource. The front of lru is the most recently seen.
+	sources map[string]*list.Element
+	lru     *list.List
+	hexDump *os.File
+	pcap    *pcap.RotatingWriter
+}
+
+// NewQuarantine returns a quarantine with the given configuration, opening
+// its dump files if any.
+func NewQuarantine(conf *config.QuarantineConfig) (*Quarantine, error) {
+	q := Quarantine{conf: conf, sources: make(map[string]*list.Element), lru: list.New()}
+	var err error
+	if conf.HexDump != "" {
+		if q.hexDump, err = os.OpenFile(conf.HexDump, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return nil, err
+		}
+	}
+	if conf.Pcap != "" {
+		if q.pcap, err = pcap.NewRotatingWriter(conf.Pcap, conf.MaxSize, conf.MaxFiles); err != nil {
+			if q.hexDump != nil {
+				q.hexDump.Close()
+			}
+			return nil, err
+		}
+	}
+	return &q, nil
+}
+
+// sourceOf returns the source of a packet: the address of its peer, without
+// the port.
+func sourceOf(peer net.Addr) string {
+	if addr, ok := peer.(*net.UDPAddr); ok {
+		return addr.IP.String()
+	}
+	return peer.String()
+}
+
+// Add quarantines a request rejected for a reason. It counts it like reject,
+// but only logs the first packet of each source per log interval.
+func (q *Quarantine) Add(ctx context.Context, version string, conn net.PacketConn, peer net.Addr, reason string, packet []byte) {
+	stats.Inc(stats.Rejected, "version", version, "listener", listenerLabel(conn), "reason", reason)
+	now := time.Now()
+	source := sourceOf(peer)
+	q.lock.Lock()
+	var qs *QuarantinedSource
+	if elem, ok := q.sources[version+"/"+source]; ok {
+		q.lru.MoveToFront(elem)
+		qs = elem.Value.(*QuarantinedSource)
+	} else {
+		qs = &QuarantinedSource{Source: source, Version: version, Reasons: make(map[string]uint64)}
+		q.sources[version+"/"+source] = q.lru.PushFront(qs)
+		if q.lru.Len() > quarantineSources {
+			old := q.lru.Remove(q.lru.Back()).(*QuarantinedSource)
+			delete(q.sources, old.Version+"/"+old.Source)
+		}
+	}
+	qs.Count++
+	qs.Reasons[reason]++
+	qs.LastSeen = now
+	if q.conf.Samples > 0 {
+		if len(qs.Samples) >= q.conf.Samples {
+			qs.Samples = qs.Samples[1:]
+		}
+		qs.Samples = append(qs.Samples, QuarantineSample{Time: now, Reason: reason, Packet: hex.EncodeToString(packet)})
+	}
+	logIt := now.Sub(qs.lastLog) >= q.conf.LogInterval
+	suppressed := qs.suppressed
+	if logIt {
+		qs.lastLog, qs.suppressed = now, 0
+	} else {
+		qs.suppressed++
+	}
+	q.lock.Unlock()
+	if logIt {
+		if suppressed > 0 {
+			logger.FromContext(ctx).Printf("Rejecting DHCPv%s transaction from %s: %s (%d more rejected since the last report)", version, source, reason, suppressed)
+		} else {
+			logger.FromContext(ctx).Printf("Rejecting DHCPv%s transaction from %s: %s", version, source, reason)
+		}
+	}
+	q.dump(now, conn, peer, version, reason, packet)
+}
+
+// dump writes a packet to the dump files.
+func (q *Quarantine) dump(now time.Time, conn net.PacketConn, peer net.Addr, version, reason string, packet []byte) {
+	if q.hexDump != nil {
+		line := fmt.Sprintf("%s DHCPv%s %s %s %x\n", now.UTC().Format(time.RFC3339Nano), version, peer, reason, packet)
+		q.lock.Lock()
+		_, err := q.hexDump.WriteString(line)
+		q.lock.Unlock()
+		if err != nil {
+			log.Printf("Failed to dump quarantined packet: %v", err)
+		}
+	}
+	if q.pcap != nil {
+		local, ok1 := conn.LocalAddr().(*net.UDPAddr)
+		remote, ok2 := peer.(*net.UDPAddr)
+		if !ok1 || !ok2 {
+			return
+		}
+		if err := q.pcap.WriteUDP(now, remote, local, packet); err != nil {
+			log.Printf("Failed to capture quarantined packet: %v", err)
+		}
+	}
+}
+
+// Sources returns the quarantined sources, the most recently seen first.
+func (q *Quarantine) Sources() []*QuarantinedSource {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]*QuarantinedSource, 0, q.lru.Len())
+	for elem := q.lru.Front(); elem != nil; elem = elem.Next() {
+		qs := *elem.Value.(*QuarantinedSource)
+		qs.Reasons = make(map[string]uint64, len(qs.Reasons))
+		for reason, n := range elem.Value.(*QuarantinedSource).Reasons {
+			qs.Reasons[reason] = n
+		}
+		qs.Samples = append([]QuarantineSample(nil), qs.Samples...)
+		ret = append(ret, &qs)
+	}
+	return ret
+}
+
+// Close closes the dump files.
+func (q *Quarantine) Close() error {
+	var err error
+	if q.hexDump != nil {
+		err = q.hexDump.Close()
+	}
+	if q.pcap != nil {
+		if perr := q.pcap.Close(); err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+// received returns the request of a transaction as received, or re-encoded if
+// unknown.
+func received(ctx context.Context, req interface{ ToBytes() []byte }) []byte {
+	if packet := handler.Packet(ctx); packet != nil {
+		return packet
+	}
+	return req.ToBytes()
+}
+
+// quarantine rejects a non-conforming request, through the quarantine if
+// there is one. The requests for another server are not non-conforming, and
+// are discarded instead, see discard.
+func (s *Server) quarantine(ctx context.Context, version string, conn net.PacketConn, peer net.Addr, reason string, packet []byte) {
+	if s.Quarantine == nil {
+		reject(ctx, version, conn, reason)
+		return
+	}
+	s.Quarantine.Add(ctx, version, conn, peer, reason, packet)
+}
+
+// registerQuarantineHandlers registers the endpoint of the quarantine,
+// GET /quarantine, which returns the sources of non-conforming packets with
+// their counts by reason and their last packets.
+func registerQuarantineHandlers(m *management.Server, q *Quarantine) {
+	m.HandleFunc("/quarantine", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		management.WriteJSON(w, http.StatusOK, q.Sources())
+	})
+}
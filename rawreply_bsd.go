@@ -0,0 +1,182 @@
+//go:build freebsd || openbsd
+// +build freebsd openbsd
+
+package coredhcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// bpfDevices are the BPF devices tried in order: the cloning device, and the
+// numbered ones of the older releases.
+var bpfDevices = []string{"/dev/bpf", "/dev/bpf0", "/dev/bpf1", "/dev/bpf2", "/dev/bpf3", "/dev/bpf4", "/dev/bpf5", "/dev/bpf6", "/dev/bpf7"}
+
+// bpfWriters holds the BPF device bound to each interface, opened on the first
+// raw reply sent through it.
+var (
+	bpfLock    sync.Mutex
+	bpfWriters = make(map[string]*os.File)
+)
+
+// bpfWriter returns the BPF device bound to an interface, which writes
+// complete Ethernet frames.
+func bpfWriter(iface string) (*os.File, error) {
+	bpfLock.Lock()
+	defer bpfLock.Unlock()
+	if f, ok := bpfWriters[iface]; ok {
+		return f, nil
+	}
+	var (
+		f   *os.File
+		err error
+	)
+	for _, dev := range bpfDevices {
+		if f, err = os.OpenFile(dev, os.O_WRONLY, 0); err == nil {
+			break
+		}
+	}
+	if f == nil {
+		return nil, fmt.Errorf("cannot open a BPF device: %v", err)
+	}
+	// struct ifreq: the interface name, then a union of at most 16 bytes
+	var ifreq [32]byte
+	copy(ifreq[:syscall.IFNAMSIZ-1], iface)
+	if err := ioctl(f, syscall.BIOCSETIF, unsafe.Pointer(&ifreq[0])); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot bind the BPF device to %s: %v", iface, err)
+	}
+	// keep our source hardware address
+	complete := uint32(1)
+	if err := ioctl(f, syscall.BIOCSHDRCMPLT, unsafe.Pointer(&complete)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot set the header complete flag: %v", err)
+	}
+	bpfWriters[iface] = f
+	return f, nil
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// rawReply4 returns whether a reply must be unicast to a client that has no
+// address yet: the request is not relayed, the client has no address and did
+// not ask for broadcast replies, and the reply offers it an address (RFC 2131,
+// section 4.1). The NAKs are always broadcast.
+func rawReply4(req, resp *dhcpv4.DHCPv4) bool {
+	unspecified := func(ip net.IP) bool { return ip == nil || ip.IsUnspecified() }
+	return unspecified(req.GatewayIPAddr) && unspecified(req.ClientIPAddr) && !req.IsBroadcast() &&
+		!unspecified(resp.YourIPAddr) && len(req.ClientHWAddr) == 6 &&
+		resp.MessageType() != dhcpv4.MessageTypeNak
+}
+
+// replyInterface returns the interface on the subnet of an address, and the
+// local address on that subnet.
+func replyInterface(ip net.IP) (*net.Interface, net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil && ipnet.Contains(ip) {
+				return &ifaces[i], ipnet.IP.To4(), nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("no interface on the subnet of %v", ip)
+}
+
+// checksum returns the Internet checksum of some data, starting from a sum.
+func checksum(sum uint32, b []byte) uint16 {
+	for ; len(b) >= 2; b = b[2:] {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// frame4 returns the Ethernet frame of a UDP reply from a server to a client.
+func frame4(srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, payload []byte) []byte {
+	const ethLen, ipLen, udpLen = 14, 20, 8
+	b := make([]byte, ethLen+ipLen+udpLen+len(payload))
+	copy(b[0:6], dstMAC)
+	copy(b[6:12], srcMAC)
+	binary.BigEndian.PutUint16(b[12:14], 0x0800)
+	ip := b[ethLen : ethLen+ipLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen+len(payload)))
+	ip[8] = 64
+	ip[9] = syscall.IPPROTO_UDP
+	copy(ip[12:16], src.To4())
+	copy(ip[16:20], dst.To4())
+	binary.BigEndian.PutUint16(ip[10:12], checksum(0, ip))
+	udp := b[ethLen+ipLen:]
+	binary.BigEndian.PutUint16(udp[0:2], 67)
+	binary.BigEndian.PutUint16(udp[2:4], 68)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen+len(payload)))
+	copy(udp[udpLen:], payload)
+	// the pseudo-header: addresses, protocol and UDP length
+	var sum uint32
+	for i := 12; i < 20; i += 2 {
+		sum += uint32(ip[i])<<8 | uint32(ip[i+1])
+	}
+	sum += syscall.IPPROTO_UDP + uint32(udpLen+len(payload))
+	cs := checksum(sum, udp)
+	if cs == 0 {
+		cs = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:8], cs)
+	return b
+}
+
+// sendRaw4 sends a reply to a client without an address as a unicast frame to
+// its hardware address, through BPF: the client cannot answer ARP, and the BSDs
+// have no socket option to send an IP packet to a given hardware address. It
+// returns whether it sent the reply, which must otherwise be sent through the
+// socket, i.e. broadcast.
+func sendRaw4(req, resp *dhcpv4.DHCPv4, data []byte) (bool, error) {
+	if !rawReply4(req, resp) {
+		return false, nil
+	}
+	iface, local, err := replyInterface(resp.YourIPAddr)
+	if err != nil {
+		return false, err
+	}
+	if len(iface.HardwareAddr) != 6 {
+		return false, errors.New("not an Ethernet interface: " + iface.Name)
+	}
+	src := local
+	if sid := resp.ServerIdentifier(); sid != nil && sid.To4() != nil {
+		src = sid
+	}
+	w, err := bpfWriter(iface.Name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(frame4(iface.HardwareAddr, req.ClientHWAddr, src, resp.YourIPAddr, data)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
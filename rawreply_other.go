@@ -0,0 +1,14 @@
+//go:build !freebsd && !openbsd
+// +build !freebsd,!openbsd
+
+package coredhcp
+
+import (
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// sendRaw4 sends the replies to the clients without an address as unicast
+// frames on the BSDs, see rawreply_bsd.go. Elsewhere, the socket sends them.
+func sendRaw4(req, resp *dhcpv4.DHCPv4, data []byte) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,144 @@
+package coredhcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Record is a single request/response pair in a traffic journal. Packets are
+// stored in their wire format. Response is nil if the request was dropped.
+type Record struct {
+	Time time.Time `json:"time"`
+	// Version is either 4 or 6.
+	Version  int    `json:"version"`
+	Peer     string `json:"peer"`
+	Request  []byte `json:"request"`
+	Response []byte `json:"response"`
+}
+
+// Recorder appends request/response pairs to a journal file, one JSON-encoded
+// Record per line. It is safe for concurrent use.
+type Recorder struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewRecorder opens the journal file for appending, creating it if needed.
+func NewRecorder(filename string) (*Recorder, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{file: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (r *Recorder) write(rec *Record) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		log.Printf("Failed to record packet: %v", err)
+	}
+}
+
+// Record6 records a DHCPv6 request and its response, which may be nil.
+func (r *Recorder) Record6(peer net.Addr, req, resp dhcpv6.DHCPv6) {
+	rec := Record{Time: time.Now(), Version: 6, Peer: peer.String(), Request: req.ToBytes()}
+	if resp != nil {
+		rec.Response = resp.ToBytes()
+	}
+	r.write(&rec)
+}
+
+// Record4 records a DHCPv4 request and its response, which may be nil.
+func (r *Recorder) Record4(peer net.Addr, req, resp *dhcpv4.DHCPv4) {
+	rec := Record{Time: time.Now(), Version: 4, Peer: peer.String(), Request: req.ToBytes()}
+	if resp != nil {
+		rec.Response = dhcputil.Encode4(resp)
+	}
+	r.write(&rec)
+}
+
+// Close closes the journal file.
+func (r *Recorder) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.file.Close()
+}
+
+// ReadJournal reads all the records from a journal written by a Recorder.
+func ReadJournal(rd io.Reader) ([]*Record, error) {
+	var records []*Record
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, &rec)
+	}
+	return records, scanner.Err()
+}
+
+// ReplayResult holds the outcome of replaying a single Record.
+type ReplayResult struct {
+	Record *Record
+	// Changed lists the options that differ between the recorded response
+	// and the new one.
+	Changed []string
+	// WasDropped and IsDropped tell whether the recorded and the new
+	// responses are nil.
+	WasDropped, IsDropped bool
+}
+
+// Differs returns true if the new response differs from the recorded one.
+func (r *ReplayResult) Differs() bool {
+	return r.WasDropped != r.IsDropped || len(r.Changed) > 0
+}
+
+// Replay runs the recorded request through the loaded plugins, like Simulate6
+// and Simulate4 do, and compares the result with the recorded response.
+func (s *Server) Replay(rec *Record) (*ReplayResult, error) {
+	res := ReplayResult{Record: rec, WasDropped: rec.Response == nil}
+	switch rec.Version {
+	case 6:
+		req, err := dhcpv6.FromBytes(rec.Request)
+		if err != nil {
+			return nil, err
+		}
+		var old dhcpv6.DHCPv6
+		if rec.Response != nil {
+			if old, err = dhcpv6.FromBytes(rec.Response); err != nil {
+				return nil, err
+			}
+		}
+		resp, _ := s.Simulate6(req)
+		res.IsDropped = resp == nil
+		res.Changed = diffOptions(options6(old), options6(resp))
+	default:
+		req, err := dhcpv4.FromBytes(rec.Request)
+		if err != nil {
+			return nil, err
+		}
+		var old *dhcpv4.DHCPv4
+		if rec.Response != nil {
+			if old, err = dhcpv4.FromBytes(rec.Response); err != nil {
+				return nil, err
+			}
+		}
+		resp, _ := s.Simulate4(req)
+		res.IsDropped = resp == nil
+		res.Changed = diffOptions(options4(old), options4(resp))
+	}
+	return &res, nil
+}
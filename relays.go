@@ -0,0 +1,108 @@
+package coredhcp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// interfacesTTL is how long the addresses of the interfaces are cached for
+// the trusted interface checks.
+const interfacesTTL = time.Minute
+
+// interfaceCache holds the prefixes of the links of the local interfaces, by
+// interface name.
+var interfaceCache struct {
+	lock    sync.Mutex
+	updated time.Time
+	links   map[string][]*net.IPNet
+}
+
+// interfaceLinks returns the prefixes of the links of an interface.
+func interfaceLinks(name string) []*net.IPNet {
+	interfaceCache.lock.Lock()
+	defer interfaceCache.lock.Unlock()
+	if time.Since(interfaceCache.updated) > interfacesTTL {
+		links := make(map[string][]*net.IPNet)
+		if ifaces, err := net.Interfaces(); err == nil {
+			for _, iface := range ifaces {
+				addrs, err := iface.Addrs()
+				if err != nil {
+					continue
+				}
+				for _, addr := range addrs {
+					if ipnet, ok := addr.(*net.IPNet); ok {
+						links[iface.Name] = append(links[iface.Name], ipnet)
+					}
+				}
+			}
+		}
+		interfaceCache.links, interfaceCache.updated = links, time.Now()
+	}
+	return interfaceCache.links[name]
+}
+
+// trustedRelay returns whether a relayed request from a peer passes the relay
+// ACL of a server: the peer is a trusted relay, or is on the link of a
+// trusted interface, by the zone of its link-local address or by its prefix.
+// Without ACL, all the relays are trusted.
+func trustedRelay(peer net.Addr, relays []*net.IPNet, ifaces []string) bool {
+	if len(relays) == 0 && len(ifaces) == 0 {
+		return true
+	}
+	addr, ok := peer.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, relay := range relays {
+		if relay.Contains(addr.IP) {
+			return true
+		}
+	}
+	for _, name := range ifaces {
+		if addr.Zone != "" {
+			if addr.Zone == name {
+				return true
+			}
+			continue
+		}
+		for _, link := range interfaceLinks(name) {
+			if link.Contains(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkRelay6 returns the reason to reject a DHCPv6 request relayed by an
+// untrusted relay, or an empty string.
+func (s *Server) checkRelay6(peer net.Addr, req dhcpv6.DHCPv6) string {
+	if !req.IsRelay() {
+		return ""
+	}
+	s.handlersLock.RLock()
+	sc := s.Config.Server6
+	s.handlersLock.RUnlock()
+	if sc != nil && !trustedRelay(peer, sc.TrustedRelays, sc.TrustedInterfaces) {
+		return rejectUntrustedRelay
+	}
+	return ""
+}
+
+// checkRelay4 is like checkRelay6, for the DHCPv4 requests with a giaddr.
+func (s *Server) checkRelay4(peer net.Addr, req *dhcpv4.DHCPv4) string {
+	if req.GatewayIPAddr == nil || req.GatewayIPAddr.IsUnspecified() {
+		return ""
+	}
+	s.handlersLock.RLock()
+	sc := s.Config.Server4
+	s.handlersLock.RUnlock()
+	if sc != nil && !trustedRelay(peer, sc.TrustedRelays, sc.TrustedInterfaces) {
+		return rejectUntrustedRelay
+	}
+	return ""
+}
@@ -0,0 +1,187 @@
+package coredhcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/leases"
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// reservationSweepInterval is the interval between the removals of the
+// expired pre-reservations.
+const reservationSweepInterval = time.Minute
+
+// reservationRequest is the body of a pre-reservation request. TTL is a
+// duration, e.g. `72h`, and defaults to the configured one.
+type reservationRequest struct {
+	HWAddr   string `json:"hw-address"`
+	ClientID string `json:"client-id"`
+	IP       net.IP `json:"ip-address"`
+	TTL      string `json:"ttl"`
+}
+
+// newReservation validates a pre-reservation request, and returns the host to
+// add.
+func newReservation(req *reservationRequest, ttl time.Duration, now time.Time) (*leases.Host, error) {
+	if req.IP == nil {
+		return nil, errors.New("missing `ip-address`")
+	}
+	host := leases.Host{IP: req.IP, ClientID: strings.ToLower(strings.Replace(req.ClientID, ":", "", -1))}
+	switch {
+	case req.HWAddr != "":
+		hwaddr, err := net.ParseMAC(req.HWAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid `hw-address`: %v", err)
+		}
+		host.HWAddr = hwaddr
+		host.Name = "reserved-" + strings.Replace(hwaddr.String(), ":", "", -1)
+	case host.ClientID != "":
+		host.Name = "reserved-" + host.ClientID
+	default:
+		return nil, errors.New("need a `hw-address` or a `client-id`")
+	}
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid `ttl` %q", req.TTL)
+		}
+	}
+	host.Expires = now.Add(ttl)
+	return &host, nil
+}
+
+// checkReservation returns an error if the address of a pre-reservation is
+// reserved for, or leased to, another client.
+func checkReservation(store leases.Store, host *leases.Host, now time.Time) error {
+	if other, err := store.HostByIP(host.IP); err == nil && other.Name != host.Name {
+		return fmt.Errorf("%s is already reserved by %s", host.IP, other.Name)
+	}
+	if lease, err := store.Lease(host.IP); err == nil && !lease.Expired(now) && !ownsLease(host, lease) {
+		return fmt.Errorf("%s is leased to another client", host.IP)
+	}
+	return nil
+}
+
+// ownsLease returns whether a lease belongs to the client of a host.
+func ownsLease(host *leases.Host, lease *leases.Lease) bool {
+	if host.HWAddr != nil && bytes.Equal(host.HWAddr, lease.HWAddr) {
+		return true
+	}
+	return host.ClientID != "" && strings.EqualFold(host.ClientID, lease.ClientID)
+}
+
+// sweepReservations makes permanent the pre-reservations whose client took
+// its address, and removes the expired ones.
+func sweepReservations(store leases.Store, now time.Time) {
+	hosts, err := store.Hosts()
+	if err != nil {
+		log.Printf("Cannot list the reservations: %v", err)
+		return
+	}
+	for _, host := range hosts {
+		if host.Expires.IsZero() {
+			continue
+		}
+		if lease, err := store.Lease(host.IP); err == nil && ownsLease(host, lease) {
+			host.Expires = time.Time{}
+			if err := store.PutHost(host); err != nil {
+				log.Printf("Cannot confirm the reservation %s: %v", host.Name, err)
+			}
+			continue
+		}
+		if host.Expired(now) {
+			log.Printf("Removing unused reservation %s of %s", host.Name, host.IP)
+			if err := store.DeleteHost(host.Name); err != nil && err != leases.ErrNotFound {
+				log.Printf("Cannot remove the reservation %s: %v", host.Name, err)
+			}
+		}
+	}
+}
+
+// runReservationSweeper removes the expired pre-reservations periodically.
+func runReservationSweeper(store leases.Store) {
+	tick := clock.Default.NewTicker(reservationSweepInterval)
+	defer tick.Stop()
+	for now := range tick.C() {
+		sweepReservations(store, now)
+	}
+}
+
+// registerReservationHandlers registers the pre-reservation endpoint, used
+// by provisioning workflows to reserve an address for a device before it
+// first boots:
+//   - GET /reservations returns the pending pre-reservations;
+//   - POST /reservations with a JSON body with the `ip-address`, the
+//     `hw-address` or `client-id` (the DUID for DHCPv6) and optionally the
+//     `ttl` of the reservation adds one, returned as a host;
+//   - DELETE /reservations?name=<name> removes one.
+//
+// A pre-reservation is a host of the lease store, and so is honored by the
+// plugins that assign the reserved addresses. It becomes permanent once the
+// client takes its address, and is removed if it does not within its TTL.
+func registerReservationHandlers(m *management.Server, store leases.Store, ttl time.Duration) {
+	m.HandleFunc("/reservations", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			hosts, err := store.Hosts()
+			if err != nil {
+				management.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			pending := []*leases.Host{}
+			for _, host := range hosts {
+				if !host.Expires.IsZero() {
+					pending = append(pending, host)
+				}
+			}
+			management.WriteJSON(w, http.StatusOK, pending)
+		case http.MethodPost:
+			var req reservationRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			now := clock.Now()
+			host, err := newReservation(&req, ttl, now)
+			if err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			if err := checkReservation(store, host, now); err != nil {
+				management.WriteError(w, http.StatusConflict, err)
+				return
+			}
+			if err := store.PutHost(host); err != nil {
+				management.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			log.Printf("Reserved %s for %s until %s", host.IP, host.Name, host.Expires.Format(time.RFC3339))
+			management.WriteJSON(w, http.StatusCreated, host)
+		case http.MethodDelete:
+			name := r.URL.Query().Get("name")
+			if name == "" {
+				management.WriteError(w, http.StatusBadRequest, errors.New("missing `name` parameter"))
+				return
+			}
+			if err := store.DeleteHost(name); err == leases.ErrNotFound {
+				management.WriteError(w, http.StatusNotFound, err)
+				return
+			} else if err != nil {
+				management.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
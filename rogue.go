@@ -0,0 +1,307 @@
+package coredhcp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/management"
+	serverid "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// statRogue counts the messages of rogue servers, with the `version` label.
+// The servers are not a label: their identifiers are set by whoever sends the
+// messages.
+const statRogue = "dhcp_rogue_messages_total"
+
+// maxRogue is the number of rogue servers remembered, beyond which the least
+// recently seen one is forgotten, so that spoofed messages cannot fill the
+// memory.
+const maxRogue = 256
+
+// allDHCPServers6 is the All_DHCP_Relay_Agents_and_Servers address (RFC 8415).
+var allDHCPServers6 = net.ParseIP("ff02::1:2")
+
+// RogueServer is a DHCP server seen on the local segments that is neither
+// this one nor a trusted one.
+type RogueServer struct {
+	// Version is either 4 or 6.
+	Version int `json:"version"`
+	// ServerID is the server identifier of the DHCPv4 server, or the DUID
+	// of the DHCPv6 server, in hex.
+	ServerID string `json:"server-id"`
+	// Peer is the source address of the last message.
+	Peer      string    `json:"peer"`
+	FirstSeen time.Time `json:"first-seen"`
+	LastSeen  time.Time `json:"last-seen"`
+	Messages  uint64    `json:"messages"`
+}
+
+// Watchdog passively listens on the DHCP client ports for the OFFERs and
+// ADVERTISEs of other servers, and reports the servers that are not trusted.
+// It can also send probes, a DISCOVER and a SOLICIT, so that the servers that
+// only unicast their answers to other clients show up.
+type Watchdog struct {
+	conf *config.WatchdogConfig
+
+	lock  sync.Mutex
+	rogue map[string]*RogueServer
+	// full is set once a server was forgotten, after which the new servers
+	// are not logged any more
+	full bool
+	// conn4 and conn6 are nil if the port could not be bound
+	conn4 net.PacketConn
+	conn6 net.PacketConn
+}
+
+// NewWatchdog returns a watchdog with the given configuration.
+func NewWatchdog(conf *config.WatchdogConfig) *Watchdog {
+	return &Watchdog{conf: conf, rogue: make(map[string]*RogueServer)}
+}
+
+// Start binds the client ports and starts listening and probing. A port that
+// cannot be bound, e.g. because a DHCP client runs on the host, only disables
+// the detection for its protocol.
+func (w *Watchdog) Start() {
+	if conn, err := net.ListenPacket("udp4", ":68"); err != nil {
+		log.Printf("watchdog: cannot listen for DHCPv4 servers: %v", err)
+	} else {
+		w.conn4 = conn
+		go w.listen(conn, w.check4)
+	}
+	if conn, err := net.ListenPacket("udp6", ":546"); err != nil {
+		log.Printf("watchdog: cannot listen for DHCPv6 servers: %v", err)
+	} else {
+		w.conn6 = conn
+		go w.listen(conn, w.check6)
+	}
+	if w.conf.ProbeInterval > 0 {
+		go w.probe()
+	}
+}
+
+// listen reads the messages received on a client port, forever.
+func (w *Watchdog) listen(conn net.PacketConn, check func([]byte, net.Addr)) {
+	buf := make([]byte, 65536)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("watchdog: stopped listening on %s: %v", conn.LocalAddr(), err)
+			return
+		}
+		check(buf[:n], peer)
+	}
+}
+
+// trusted4 returns whether a DHCPv4 server identifier is an address of this
+// host, or a trusted one.
+func (w *Watchdog) trusted4(id net.IP) bool {
+	for _, ip := range w.conf.Trusted4 {
+		if ip.Equal(id) {
+			return true
+		}
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// trusted6 returns whether a DUID, in hex, is the one of this server, or a
+// trusted one.
+func (w *Watchdog) trusted6(duid string) bool {
+	if id := serverid.ServerID6(); id != nil && hex.EncodeToString(id.ToBytes()) == duid {
+		return true
+	}
+	for _, id := range w.conf.Trusted6 {
+		if id == duid {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watchdog) check4(data []byte, peer net.Addr) {
+	msg, err := dhcpv4.FromBytes(data)
+	if err != nil || msg.OpCode != dhcpv4.OpcodeBootReply {
+		return
+	}
+	switch msg.MessageType() {
+	case dhcpv4.MessageTypeOffer, dhcpv4.MessageTypeAck:
+	default:
+		return
+	}
+	id := msg.ServerIdentifier()
+	if id == nil {
+		if addr, ok := peer.(*net.UDPAddr); ok {
+			id = addr.IP
+		}
+	}
+	if id == nil || w.trusted4(id) {
+		return
+	}
+	w.report(4, id.String(), peer)
+}
+
+func (w *Watchdog) check6(data []byte, peer net.Addr) {
+	msg, err := dhcpv6.FromBytes(data)
+	if err != nil {
+		return
+	}
+	switch msg.Type() {
+	case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply:
+	default:
+		return
+	}
+	sid, ok := msg.GetOneOption(dhcpv6.OptionServerID).(*dhcpv6.OptServerId)
+	if !ok {
+		return
+	}
+	duid := hex.EncodeToString(sid.Sid.ToBytes())
+	if w.trusted6(duid) {
+		return
+	}
+	w.report(6, duid, peer)
+}
+
+// report records a message of a rogue server, and logs the servers when they
+// are first seen, until too many were.
+func (w *Watchdog) report(version int, id string, peer net.Addr) {
+	now := time.Now()
+	key := fmt.Sprintf("%d/%s", version, id)
+	stats.Inc(statRogue, "version", fmt.Sprint(version))
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	r, ok := w.rogue[key]
+	if !ok {
+		if len(w.rogue) >= maxRogue {
+			w.forgetOldest()
+		}
+		r = &RogueServer{Version: version, ServerID: id, FirstSeen: now}
+		w.rogue[key] = r
+		if !w.full {
+			log.Printf("watchdog: rogue DHCPv%d server %s seen from %s", version, id, peer)
+		}
+	}
+	r.Peer = peer.String()
+	r.LastSeen = now
+	r.Messages++
+}
+
+// forgetOldest forgets the least recently seen rogue server. The watchdog
+// must be locked.
+func (w *Watchdog) forgetOldest() {
+	var oldest string
+	for key, r := range w.rogue {
+		if oldest == "" || r.LastSeen.Before(w.rogue[oldest].LastSeen) {
+			oldest = key
+		}
+	}
+	delete(w.rogue, oldest)
+	if !w.full {
+		w.full = true
+		log.Printf("watchdog: more than %d rogue servers, forgetting the least recently seen and not logging the new ones", maxRogue)
+	}
+}
+
+// Rogue returns the rogue servers seen so far, ordered by version and
+// identifier.
+func (w *Watchdog) Rogue() []*RogueServer {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	ret := make([]*RogueServer, 0, len(w.rogue))
+	for _, r := range w.rogue {
+		c := *r
+		ret = append(ret, &c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Version != ret[j].Version {
+			return ret[i].Version < ret[j].Version
+		}
+		return ret[i].ServerID < ret[j].ServerID
+	})
+	return ret
+}
+
+// probeHWAddr returns a random, locally administered, hardware address for
+// the probes, so that they are not mistaken for a real client.
+func probeHWAddr() net.HardwareAddr {
+	hwaddr := make(net.HardwareAddr, 6)
+	rand.Read(hwaddr)
+	hwaddr[0] = hwaddr[0]&^1 | 2
+	return hwaddr
+}
+
+// probe sends the probes at the probe interval, forever: a broadcast
+// DISCOVER, whose OFFERs are broadcast back, and a SOLICIT to the
+// All_DHCP_Relay_Agents_and_Servers address of each interface.
+func (w *Watchdog) probe() {
+	for ; ; time.Sleep(w.conf.ProbeInterval) {
+		hwaddr := probeHWAddr()
+		if w.conn4 != nil {
+			if msg, err := dhcpv4.NewDiscovery(hwaddr); err != nil {
+				log.Printf("watchdog: cannot build the DISCOVER probe: %v", err)
+			} else if msg.TransactionID, err = dhcputil.TransactionID4(); err != nil {
+				log.Printf("watchdog: cannot generate the DISCOVER probe's transaction ID: %v", err)
+			} else {
+				msg.SetBroadcast()
+				if _, err := w.conn4.WriteTo(msg.ToBytes(), &net.UDPAddr{IP: net.IPv4bcast, Port: 67}); err != nil {
+					log.Printf("watchdog: cannot send the DISCOVER probe: %v", err)
+				}
+			}
+		}
+		if w.conn6 == nil {
+			continue
+		}
+		duid := dhcpv6.Duid{Type: dhcpv6.DUID_LL, HwType: iana.HwTypeEthernet, LinkLayerAddr: hwaddr}
+		msg, err := dhcpv6.NewSolicitWithCID(duid)
+		if err != nil {
+			log.Printf("watchdog: cannot build the SOLICIT probe: %v", err)
+			continue
+		}
+		if m, ok := msg.(*dhcpv6.DHCPv6Message); ok {
+			xid, err := dhcputil.TransactionID6()
+			if err != nil {
+				log.Printf("watchdog: cannot generate the SOLICIT probe's transaction ID: %v", err)
+				continue
+			}
+			m.SetTransactionID(xid)
+		}
+		for _, ifname := range w.conf.Interfaces {
+			dst := net.UDPAddr{IP: allDHCPServers6, Port: 547, Zone: ifname}
+			if _, err := w.conn6.WriteTo(msg.ToBytes(), &dst); err != nil {
+				log.Printf("watchdog: cannot send the SOLICIT probe on %s: %v", ifname, err)
+			}
+		}
+	}
+}
+
+// registerWatchdogHandlers registers the endpoint of the rogue servers,
+// GET /rogue, which returns the rogue servers seen since the start.
+func registerWatchdogHandlers(m *management.Server, w *Watchdog) {
+	m.HandleFunc("/rogue", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.Header().Set("Allow", http.MethodGet)
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		management.WriteJSON(rw, http.StatusOK, w.Rogue())
+	})
+}
@@ -0,0 +1,262 @@
+package coredhcp
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// statPluginFallback counts the calls of the plugins skipped because of their
+// limits, with the `version`, `plugin` and `reason` labels.
+const statPluginFallback = "dhcp_plugin_fallbacks_total"
+
+// Reasons for skipping a call of a plugin, used as the `reason` label of the
+// fallback counter.
+const (
+	fallbackTimeout     = "timeout"
+	fallbackConcurrency = "concurrency"
+	fallbackCircuitOpen = "circuit-open"
+)
+
+// sandbox enforces the limits of a plugin: the calls in flight are capped, and
+// consecutive failures open a circuit that skips the plugin for a while.
+type sandbox struct {
+	name    string
+	version string
+	limits  *config.PluginLimits
+	// slots is nil without concurrency cap
+	slots chan struct{}
+
+	lock      sync.Mutex
+	failures  int
+	open      bool
+	openUntil time.Time
+	// probing is set while the single call let through an open circuit
+	// after its cooldown is in flight
+	probing bool
+}
+
+func newSandbox(name, version string, limits *config.PluginLimits) *sandbox {
+	sb := sandbox{name: name, version: version, limits: limits}
+	if limits.Concurrency > 0 {
+		sb.slots = make(chan struct{}, limits.Concurrency)
+	}
+	return &sb
+}
+
+// acquire reserves a call of the plugin, and returns the reason to skip it
+// instead, or an empty string. A reserved call must be released. Once the
+// cooldown of an open circuit is over, a single call is let through, whose
+// outcome closes or reopens the circuit.
+func (sb *sandbox) acquire() string {
+	sb.lock.Lock()
+	if sb.open {
+		if sb.probing || time.Now().Before(sb.openUntil) {
+			sb.lock.Unlock()
+			return fallbackCircuitOpen
+		}
+		sb.probing = true
+	}
+	sb.lock.Unlock()
+	if sb.slots != nil {
+		select {
+		case sb.slots <- struct{}{}:
+		default:
+			sb.fail()
+			return fallbackConcurrency
+		}
+	}
+	return ""
+}
+
+func (sb *sandbox) release() {
+	if sb.slots != nil {
+		<-sb.slots
+	}
+}
+
+// fail counts a failure of the plugin, and opens the circuit after too many.
+// A failure of the call let through after the cooldown reopens the circuit.
+func (sb *sandbox) fail() {
+	if sb.limits.Failures == 0 {
+		return
+	}
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	sb.failures++
+	sb.probing = false
+	if sb.failures < sb.limits.Failures {
+		return
+	}
+	if !sb.open {
+		log.Printf("Plugin `%s` failed %d times in a row, skipping it for %v", sb.name, sb.failures, sb.limits.Cooldown)
+	}
+	sb.open, sb.openUntil = true, time.Now().Add(sb.limits.Cooldown)
+	sb.failures = sb.limits.Failures - 1
+}
+
+// succeed resets the failures of the plugin, and closes the circuit.
+func (sb *sandbox) succeed() {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if sb.open {
+		log.Printf("Plugin `%s` recovered", sb.name)
+	}
+	sb.failures, sb.open, sb.probing = 0, false, false
+}
+
+// abandon ends a call that is neither a success nor a failure of the plugin,
+// e.g. because the deadline of the whole chain expired: when it was the
+// call let through the circuit, another one will be.
+func (sb *sandbox) abandon() {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	sb.probing = false
+}
+
+// fallback counts a skipped call of the plugin, and returns whether to drop
+// the request.
+func (sb *sandbox) fallback(ctx context.Context, reason string) bool {
+	stats.Inc(statPluginFallback, "version", sb.version, "plugin", sb.name, "reason", reason)
+	logger.FromContext(ctx).Debugf("Skipping plugin `%s`: %s", sb.name, reason)
+	return sb.limits.Drop
+}
+
+// sandbox6 wraps a DHCPv6 handler with its limits. With a timeout, the
+// handler runs on copies of the request, of the response and of the state of
+// the transaction, so that a call that times out cannot change them after the
+// chain moved on. The expiry of the context of the chain is not a failure of
+// the plugin.
+func sandbox6(name string, h handler.Handler6, limits *config.PluginLimits) handler.Handler6 {
+	sb := newSandbox(name, "6", limits)
+	type result struct {
+		resp dhcpv6.DHCPv6
+		stop bool
+	}
+	fallback := func(ctx context.Context, reason string, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if sb.fallback(ctx, reason) {
+			return nil, true
+		}
+		return resp, false
+	}
+	return func(ctx context.Context, req, resp dhcpv6.DHCPv6) (dhcpv6.DHCPv6, bool) {
+		if reason := sb.acquire(); reason != "" {
+			return fallback(ctx, reason, resp)
+		}
+		var (
+			creq, cresp dhcpv6.DHCPv6
+			err, rerr   error
+		)
+		if limits.Timeout > 0 {
+			creq, err = clone6(req)
+			cresp, rerr = clone6(resp)
+		}
+		if limits.Timeout == 0 || err != nil || rerr != nil {
+			defer sb.release()
+			resp, stop := h(ctx, req, resp)
+			sb.succeed()
+			return resp, stop
+		}
+		fctx, commit := handler.Fork(ctx)
+		tctx, cancel := context.WithTimeout(fctx, limits.Timeout)
+		defer cancel()
+		done := make(chan result, 1)
+		go func() {
+			defer sb.release()
+			resp, stop := h(tctx, creq, cresp)
+			done <- result{resp, stop}
+		}()
+		select {
+		case r := <-done:
+			commit()
+			sb.succeed()
+			return r.resp, r.stop
+		case <-tctx.Done():
+			if ctx.Err() != nil {
+				sb.abandon()
+				return resp, false
+			}
+			sb.fail()
+			return fallback(ctx, fallbackTimeout, resp)
+		}
+	}
+}
+
+// sandbox4 is like sandbox6, for a DHCPv4 handler.
+func sandbox4(name string, h handler.Handler4, limits *config.PluginLimits) handler.Handler4 {
+	sb := newSandbox(name, "4", limits)
+	type result struct {
+		resp *dhcpv4.DHCPv4
+		stop bool
+	}
+	fallback := func(ctx context.Context, reason string, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if sb.fallback(ctx, reason) {
+			return nil, true
+		}
+		return resp, false
+	}
+	return func(ctx context.Context, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+		if reason := sb.acquire(); reason != "" {
+			return fallback(ctx, reason, resp)
+		}
+		var (
+			creq, cresp *dhcpv4.DHCPv4
+			err, rerr   error
+		)
+		if limits.Timeout > 0 {
+			creq, err = clone4(req)
+			cresp, rerr = clone4(resp)
+		}
+		if limits.Timeout == 0 || err != nil || rerr != nil {
+			defer sb.release()
+			resp, stop := h(ctx, req, resp)
+			sb.succeed()
+			return resp, stop
+		}
+		fctx, commit := handler.Fork(ctx)
+		tctx, cancel := context.WithTimeout(fctx, limits.Timeout)
+		defer cancel()
+		done := make(chan result, 1)
+		go func() {
+			defer sb.release()
+			resp, stop := h(tctx, creq, cresp)
+			done <- result{resp, stop}
+		}()
+		select {
+		case r := <-done:
+			commit()
+			sb.succeed()
+			return r.resp, r.stop
+		case <-tctx.Done():
+			if ctx.Err() != nil {
+				sb.abandon()
+				return resp, false
+			}
+			sb.fail()
+			return fallback(ctx, fallbackTimeout, resp)
+		}
+	}
+}
+
+// clone6 returns a copy of a DHCPv6 message, which can be nil.
+func clone6(msg dhcpv6.DHCPv6) (dhcpv6.DHCPv6, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	return dhcpv6.FromBytes(msg.ToBytes())
+}
+
+// clone4 returns a copy of a DHCPv4 message, which can be nil.
+func clone4(msg *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, error) {
+	if msg == nil {
+		return nil, nil
+	}
+	return dhcpv4.FromBytes(msg.ToBytes())
+}
@@ -0,0 +1,191 @@
+package coredhcp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// statShed counts the requests dropped by the load shedding, with the
+// `version` and `class` labels. The sources are not a label, since the
+// addresses of the relays are not bounded.
+const statShed = "dhcp_shed_total"
+
+// the classes of requests of the load shedding
+const (
+	classNew      = "new"
+	classExisting = "existing"
+)
+
+// sheddingSweep is the interval between the removals of the idle sources.
+const sheddingSweep = time.Minute
+
+// sourceRate estimates the request rate of a source with a sliding window of
+// one second: the count of the previous second, weighted by the part of the
+// window that overlaps it, plus the count of the current second.
+type sourceRate struct {
+	second int64
+	prev   float64
+	cur    float64
+}
+
+// add counts a request at a time, and returns the estimated rate.
+func (r *sourceRate) add(now time.Time) float64 {
+	sec := now.Unix()
+	switch {
+	case sec == r.second+1:
+		r.prev, r.cur = r.cur, 0
+	case sec > r.second+1:
+		r.prev, r.cur = 0, 0
+	}
+	r.second = sec
+	r.cur++
+	frac := float64(now.Nanosecond()) / float64(time.Second)
+	return r.prev*(1-frac) + r.cur
+}
+
+// loadShedder tracks the aggregate request rates of the ingress sources and
+// drops their requests adaptively, with a probability that increases with the
+// rate, like a random early drop. The requests of the existing clients are
+// only dropped at higher rates than the ones of the new clients, so that the
+// existing clients keep their leases during a flood of DISCOVERs or SOLICITs.
+// The zero value is ready to use.
+type loadShedder struct {
+	lock      sync.Mutex
+	sources   map[string]*sourceRate
+	lastSweep time.Time
+}
+
+// dropProbability returns the probability to drop a request of a class, given
+// the rate of its source.
+func dropProbability(conf *config.SheddingConfig, class string, rate float64) float64 {
+	low, high := conf.Low, conf.High
+	if class == classExisting {
+		low, high = conf.High, 2*conf.High
+	}
+	switch {
+	case rate <= low:
+		return 0
+	case rate >= high:
+		return 1
+	}
+	return (rate - low) / (high - low)
+}
+
+// shed counts a request of a source, and returns whether to drop it.
+func (ls *loadShedder) shed(conf *config.SheddingConfig, source, class string) bool {
+	now := time.Now()
+	ls.lock.Lock()
+	if ls.sources == nil {
+		ls.sources = make(map[string]*sourceRate)
+	}
+	if now.Sub(ls.lastSweep) > sheddingSweep {
+		for key, r := range ls.sources {
+			if now.Unix() > r.second+1 {
+				delete(ls.sources, key)
+			}
+		}
+		ls.lastSweep = now
+	}
+	r, ok := ls.sources[source]
+	if !ok {
+		r = &sourceRate{}
+		ls.sources[source] = r
+	}
+	rate := r.add(now)
+	ls.lock.Unlock()
+	p := dropProbability(conf, class, rate)
+	return p > 0 && rand.Float64() < p
+}
+
+// maskedSource returns the subnet of an address as a source of the load
+// shedding.
+func maskedSource(ip net.IP, ones4, ones6 int) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(ones4, 32)), ones4)
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(ones6, 128)), ones6)
+}
+
+// relaySource returns the source of a relayed request: the subnet of the
+// relay it was received from. The addresses in the request, the giaddr or the
+// link address, are not used, since any client can set them.
+func relaySource(conf *config.SheddingConfig, peer net.Addr) (string, bool) {
+	addr, ok := peer.(*net.UDPAddr)
+	if !ok || addr.IP == nil || addr.IP.IsUnspecified() {
+		return "", false
+	}
+	return maskedSource(addr.IP, conf.Prefix4, conf.Prefix6), true
+}
+
+// shed6 returns whether to drop a DHCPv6 request to shed load. The source of
+// a relayed request is the subnet of the relay, and the one of a direct
+// request is the interface it was received on, or else the listener. The
+// existing clients are the ones that renew, rebind or confirm their leases.
+func (s *Server) shed6(conn net.PacketConn, peer net.Addr, req dhcpv6.DHCPv6) bool {
+	s.handlersLock.RLock()
+	conf := s.Config.Shedding
+	s.handlersLock.RUnlock()
+	if conf == nil {
+		return false
+	}
+	source, ok := "", false
+	if req.IsRelay() {
+		source, ok = relaySource(conf, peer)
+	}
+	if !ok {
+		if addr, isUDP := peer.(*net.UDPAddr); isUDP && addr.Zone != "" {
+			source = addr.Zone
+		} else {
+			source = listenerLabel(conn)
+		}
+	}
+	class := classNew
+	if msg, err := dhcputil.InnerMessage6(req); err == nil {
+		switch msg.Type() {
+		case dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind, dhcpv6.MessageTypeConfirm:
+			class = classExisting
+		}
+	}
+	if !s.shedder.shed(conf, source, class) {
+		return false
+	}
+	stats.Inc(statShed, "version", "6", "class", class)
+	return true
+}
+
+// shed4 is like shed6, for DHCPv4: the requests with a giaddr are relayed,
+// and the existing clients are the ones that renew or rebind their leases,
+// i.e. the REQUESTs with a ciaddr and without server identifier.
+func (s *Server) shed4(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) bool {
+	s.handlersLock.RLock()
+	conf := s.Config.Shedding
+	s.handlersLock.RUnlock()
+	if conf == nil {
+		return false
+	}
+	source, ok := "", false
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		source, ok = relaySource(conf, peer)
+	}
+	if !ok {
+		source = listenerLabel(conn)
+	}
+	class := classNew
+	if req.MessageType() == dhcpv4.MessageTypeRequest && req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified() && req.ServerIdentifier() == nil {
+		class = classExisting
+	}
+	if !s.shedder.shed(conf, source, class) {
+		return false
+	}
+	stats.Inc(statShed, "version", "4", "class", class)
+	return true
+}
@@ -0,0 +1,157 @@
+package coredhcp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/coredhcp/coredhcp/logger"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// SimulationStep records what a single plugin did to the response while
+// simulating the handling of a request.
+type SimulationStep struct {
+	Plugin string
+	// Options lists the options that the plugin added, removed or modified
+	// in the response.
+	Options []string
+	// Stop is true if the plugin interrupted the handler chain.
+	Stop bool
+	// Dropped is true if the plugin returned a nil response.
+	Dropped bool
+	// Skipped is true if the plugin did not run, as it is disabled through
+	// the management API or gated by a feature flag disabled for the client.
+	Skipped bool
+}
+
+func (s SimulationStep) String() string {
+	if s.Skipped {
+		return s.Plugin + ": (skipped)"
+	}
+	ret := fmt.Sprintf("%s: options=%v", s.Plugin, s.Options)
+	if s.Dropped {
+		ret += " (dropped)"
+	}
+	if s.Stop {
+		ret += " (stop)"
+	}
+	return ret
+}
+
+// Simulate6 runs the request through the loaded DHCPv6 plugins, exactly like
+// MainHandler6 does, but without sending anything. It returns the resulting
+// response, which can be nil, and the effect that each plugin had on it. The
+// plugins that the chains would skip are skipped as well.
+func (s *Server) Simulate6(req dhcpv6.DHCPv6) (dhcpv6.DHCPv6, []SimulationStep) {
+	var (
+		resp  dhcpv6.DHCPv6
+		stop  bool
+		steps []SimulationStep
+	)
+	ctx := logger.WithCorrelationID(context.Background(), correlationID6(req))
+	s.handlersLock.RLock()
+	handlers, names := s.Handlers6, s.names6
+	ctx = handler.NewContext(ctx, optionLevels(s.Config.Server6))
+	ctx = handler.WithFeatures(ctx, s.Config.Features, featureClient6(req))
+	ctx = s.withSkips(ctx, featureGates(s.Config.Server6))
+	s.handlersLock.RUnlock()
+	for idx, handler := range handlers {
+		if skipPlugin(ctx, names[idx]) {
+			steps = append(steps, SimulationStep{Plugin: names[idx], Skipped: true})
+			continue
+		}
+		before := options6(resp)
+		resp, stop = handler(ctx, req, resp)
+		steps = append(steps, SimulationStep{
+			Plugin:  names[idx],
+			Options: diffOptions(before, options6(resp)),
+			Stop:    stop,
+			Dropped: resp == nil,
+		})
+		if stop {
+			break
+		}
+	}
+	return resp, steps
+}
+
+// Simulate4 is like Simulate6, but for DHCPv4 packets.
+func (s *Server) Simulate4(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, []SimulationStep) {
+	var (
+		resp  *dhcpv4.DHCPv4
+		stop  bool
+		steps []SimulationStep
+	)
+	ctx := logger.WithCorrelationID(context.Background(), correlationID4(req))
+	s.handlersLock.RLock()
+	handlers, names := s.Handlers4, s.names4
+	ctx = handler.NewContext(ctx, optionLevels(s.Config.Server4))
+	ctx = handler.WithFeatures(ctx, s.Config.Features, featureClient4(req))
+	ctx = s.withSkips(ctx, featureGates(s.Config.Server4))
+	s.handlersLock.RUnlock()
+	prepareRequest4(ctx, req)
+	for idx, handler := range handlers {
+		if skipPlugin(ctx, names[idx]) {
+			steps = append(steps, SimulationStep{Plugin: names[idx], Skipped: true})
+			continue
+		}
+		before := options4(resp)
+		resp, stop = handler(ctx, req, resp)
+		steps = append(steps, SimulationStep{
+			Plugin:  names[idx],
+			Options: diffOptions(before, options4(resp)),
+			Stop:    stop,
+			Dropped: resp == nil,
+		})
+		if stop {
+			break
+		}
+	}
+	return resp, steps
+}
+
+// options6 maps the name of each option in the packet to its serialized
+// value(s).
+func options6(d dhcpv6.DHCPv6) map[string][]byte {
+	ret := make(map[string][]byte)
+	if d == nil {
+		return ret
+	}
+	for _, opt := range d.Options() {
+		name := fmt.Sprintf("%v", opt.Code())
+		ret[name] = append(ret[name], opt.ToBytes()...)
+	}
+	return ret
+}
+
+// options4 is like options6, but for DHCPv4 packets.
+func options4(d *dhcpv4.DHCPv4) map[string][]byte {
+	ret := make(map[string][]byte)
+	if d == nil {
+		return ret
+	}
+	for code, value := range d.Options {
+		ret[dhcpv4.GenericOptionCode(code).String()] = value
+	}
+	return ret
+}
+
+// diffOptions returns the names of the options that differ between the two
+// maps.
+func diffOptions(before, after map[string][]byte) []string {
+	var changed []string
+	for name, value := range after {
+		if old, ok := before[name]; !ok || !bytes.Equal(old, value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
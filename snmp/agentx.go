@@ -0,0 +1,532 @@
+// Package snmp implements an AgentX (RFC 2741) subagent, which exposes the
+// server statistics to the SNMP master agent of the host, e.g. net-snmp's
+// snmpd with `master agentx` in its configuration.
+package snmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/coredhcp/coredhcp/logger"
+)
+
+var log = logger.GetLogger()
+
+// AgentX PDU types
+const (
+	pduOpen       = 1
+	pduClose      = 2
+	pduRegister   = 3
+	pduGet        = 5
+	pduGetNext    = 6
+	pduGetBulk    = 7
+	pduTestSet    = 8
+	pduCommitSet  = 9
+	pduUndoSet    = 10
+	pduCleanupSet = 11
+	pduPing       = 13
+	pduResponse   = 18
+)
+
+// AgentX header flags
+const (
+	flagNonDefaultContext = 0x08
+	flagNetworkByteOrder  = 0x10
+)
+
+// AgentX varbind types
+const (
+	typeGauge32      = 66
+	typeCounter64    = 70
+	typeNoSuchObject = 128
+	typeEndOfMibView = 130
+)
+
+// AgentX response errors
+const (
+	errNone        = 0
+	errNotWritable = 17
+)
+
+const headerLen = 20
+
+// OID is an SNMP object identifier.
+type OID []uint32
+
+// ParseOID parses a dotted OID, e.g. `1.3.6.1.4.1.8072.9999.67`.
+func ParseOID(s string) (OID, error) {
+	var oid OID
+	var cur uint64
+	digits := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			cur = cur*10 + uint64(s[i]-'0')
+			if cur > 0xffffffff {
+				return nil, fmt.Errorf("invalid OID `%s`: sub-identifier too large", s)
+			}
+			digits++
+			continue
+		}
+		if (i < len(s) && s[i] != '.') || digits == 0 {
+			return nil, fmt.Errorf("invalid OID `%s`", s)
+		}
+		oid = append(oid, uint32(cur))
+		cur, digits = 0, 0
+	}
+	return oid, nil
+}
+
+func (o OID) String() string {
+	var s string
+	for i, id := range o {
+		if i > 0 {
+			s += "."
+		}
+		s += fmt.Sprint(id)
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 depending on whether o sorts before, equal to, or
+// after other in lexicographic order.
+func (o OID) Compare(other OID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix returns whether prefix is a prefix of o.
+func (o OID) HasPrefix(prefix OID) bool {
+	return len(o) >= len(prefix) && o[:len(prefix)].Compare(prefix) == 0
+}
+
+// Variable is an SNMP variable exposed by the subagent, a Counter64, or a
+// Gauge32 if Gauge is true.
+type Variable struct {
+	Name  OID
+	Value uint64
+	Gauge bool
+}
+
+// varType returns the AgentX type of a variable.
+func (v *Variable) varType() uint16 {
+	if v.Gauge {
+		return typeGauge32
+	}
+	return typeCounter64
+}
+
+// VariableFunc returns the variables to expose, sorted by name. It is called
+// for every request from the master agent.
+type VariableFunc func() []Variable
+
+// Subagent is an AgentX subagent, exposing the variables returned by a
+// VariableFunc under a root OID.
+type Subagent struct {
+	// Address is the address of the master agent, e.g.
+	// `unix:///var/agentx/master` or `tcp://localhost:705`.
+	Address string
+	Root    OID
+	// Variables returns the variables to expose. Their names must start
+	// with Root.
+	Variables VariableFunc
+
+	start     time.Time
+	order     binary.ByteOrder
+	sessionID uint32
+	packetID  uint32
+}
+
+// NewSubagent returns a Subagent that will register the root OID with the
+// master agent at the given address, once started.
+func NewSubagent(address string, root OID, variables VariableFunc) *Subagent {
+	return &Subagent{Address: address, Root: root, Variables: variables, start: time.Now()}
+}
+
+// Run connects to the master agent and serves its requests, reconnecting
+// every retry interval if the connection fails. It never returns.
+func (s *Subagent) Run(retry time.Duration) {
+	for {
+		if err := s.serve(); err != nil {
+			log.Printf("snmp: AgentX session with %s failed: %v", s.Address, err)
+		}
+		time.Sleep(retry)
+	}
+}
+
+func (s *Subagent) dial() (net.Conn, error) {
+	u, err := url.Parse(s.Address)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "unix":
+		return net.Dial("unix", u.Path)
+	case "tcp":
+		return net.Dial("tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported AgentX transport `%s`", u.Scheme)
+	}
+}
+
+// serve runs a single AgentX session.
+func (s *Subagent) serve() error {
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// our own PDUs are always in network byte order
+	s.order = binary.BigEndian
+
+	// open the session
+	var open pduWriter
+	open.order = s.order
+	open.bytes(0, 0, 0, 0) // default timeout, reserved
+	open.oid(nil)
+	open.octetString("coredhcp")
+	s.sessionID = 0
+	if err := s.request(conn, pduOpen, open.buf); err != nil {
+		return err
+	}
+	resp, err := s.readResponse(r)
+	if err != nil {
+		return fmt.Errorf("open: %v", err)
+	}
+	s.sessionID = resp.sessionID
+
+	// register the root
+	var reg pduWriter
+	reg.order = s.order
+	reg.bytes(0, 127, 0, 0) // default timeout, default priority, no range
+	reg.oid(s.Root)
+	if err := s.request(conn, pduRegister, reg.buf); err != nil {
+		return err
+	}
+	if _, err := s.readResponse(r); err != nil {
+		return fmt.Errorf("register %s: %v", s.Root, err)
+	}
+	log.Printf("snmp: registered %s with the AgentX master agent at %s", s.Root, s.Address)
+
+	for {
+		pdu, err := readPDU(r)
+		if err != nil {
+			return err
+		}
+		if pdu.typ == pduClose {
+			return errors.New("session closed by the master agent")
+		}
+		payload, err := s.handle(pdu)
+		if err != nil {
+			return err
+		}
+		if err := s.respond(conn, pdu, payload); err != nil {
+			return err
+		}
+	}
+}
+
+type pdu struct {
+	typ           uint8
+	flags         uint8
+	sessionID     uint32
+	transactionID uint32
+	packetID      uint32
+	order         binary.ByteOrder
+	payload       []byte
+}
+
+func readPDU(r io.Reader) (*pdu, error) {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	p := pdu{typ: hdr[1], flags: hdr[2], order: binary.LittleEndian}
+	if p.flags&flagNetworkByteOrder != 0 {
+		p.order = binary.BigEndian
+	}
+	p.sessionID = p.order.Uint32(hdr[4:])
+	p.transactionID = p.order.Uint32(hdr[8:])
+	p.packetID = p.order.Uint32(hdr[12:])
+	length := p.order.Uint32(hdr[16:])
+	if length > 1<<20 {
+		return nil, fmt.Errorf("PDU too large (%d bytes)", length)
+	}
+	p.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, p.payload); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *Subagent) writePDU(w io.Writer, typ uint8, transactionID, packetID uint32, payload []byte) error {
+	hdr := make([]byte, headerLen, headerLen+len(payload))
+	hdr[0] = 1 // version
+	hdr[1] = typ
+	hdr[2] = flagNetworkByteOrder
+	s.order.PutUint32(hdr[4:], s.sessionID)
+	s.order.PutUint32(hdr[8:], transactionID)
+	s.order.PutUint32(hdr[12:], packetID)
+	s.order.PutUint32(hdr[16:], uint32(len(payload)))
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+func (s *Subagent) request(w io.Writer, typ uint8, payload []byte) error {
+	s.packetID++
+	return s.writePDU(w, typ, 0, s.packetID, payload)
+}
+
+func (s *Subagent) readResponse(r io.Reader) (*pdu, error) {
+	p, err := readPDU(r)
+	if err != nil {
+		return nil, err
+	}
+	if p.typ != pduResponse || len(p.payload) < 8 {
+		return nil, fmt.Errorf("unexpected PDU type %d", p.typ)
+	}
+	if code := p.order.Uint16(p.payload[4:]); code != errNone {
+		return nil, fmt.Errorf("master agent returned error %d", code)
+	}
+	return p, nil
+}
+
+// respond sends a Response PDU to a request. payload holds the error, index
+// and varbinds, and is prefixed with the uptime.
+func (s *Subagent) respond(w io.Writer, req *pdu, payload []byte) error {
+	uptime := make([]byte, 4, 4+len(payload))
+	s.order.PutUint32(uptime, uint32(time.Since(s.start)/(10*time.Millisecond)))
+	return s.writePDU(w, pduResponse, req.transactionID, req.packetID, append(uptime, payload...))
+}
+
+// handle processes a request from the master agent, and returns the payload
+// of the response, without the uptime.
+func (s *Subagent) handle(p *pdu) ([]byte, error) {
+	var w pduWriter
+	w.order = s.order
+	switch p.typ {
+	case pduGet, pduGetNext, pduGetBulk:
+		rd := pduReader{order: p.order, buf: p.payload}
+		if p.flags&flagNonDefaultContext != 0 {
+			rd.octetString()
+		}
+		var nonRepeaters, maxRepetitions int
+		if p.typ == pduGetBulk {
+			nonRepeaters = int(rd.uint16())
+			maxRepetitions = int(rd.uint16())
+		}
+		var ranges [][2]OID
+		var includes []bool
+		for rd.err == nil && len(rd.buf) > 0 {
+			start, include := rd.oid()
+			end, _ := rd.oid()
+			ranges = append(ranges, [2]OID{start, end})
+			includes = append(includes, include)
+		}
+		if rd.err != nil {
+			return nil, rd.err
+		}
+		w.uint16(errNone)
+		w.uint16(0)
+		vars := s.Variables()
+		for i, rng := range ranges {
+			switch p.typ {
+			case pduGet:
+				w.varbind(get(vars, rng[0]))
+			case pduGetNext:
+				w.varbind(getNext(vars, rng[0], rng[1], includes[i]))
+			case pduGetBulk:
+				start, include := rng[0], includes[i]
+				reps := 1
+				if i >= nonRepeaters {
+					reps = maxRepetitions
+				}
+				for j := 0; j < reps; j++ {
+					name, typ, value := getNext(vars, start, rng[1], include)
+					w.varbind(name, typ, value)
+					if typ == typeEndOfMibView {
+						break
+					}
+					start, include = name, false
+				}
+			}
+		}
+	case pduTestSet:
+		w.uint16(errNotWritable)
+		w.uint16(1)
+	default:
+		// commit, undo and cleanup set requests can only follow a failed
+		// test, and pings need no data
+		w.uint16(errNone)
+		w.uint16(0)
+	}
+	return w.buf, nil
+}
+
+func get(vars []Variable, name OID) (OID, uint16, uint64) {
+	for _, v := range vars {
+		if v.Name.Compare(name) == 0 {
+			return name, v.varType(), v.Value
+		}
+	}
+	return name, typeNoSuchObject, 0
+}
+
+func getNext(vars []Variable, start, end OID, include bool) (OID, uint16, uint64) {
+	for _, v := range vars {
+		cmp := v.Name.Compare(start)
+		if cmp < 0 || (cmp == 0 && !include) {
+			continue
+		}
+		if len(end) > 0 && v.Name.Compare(end) >= 0 {
+			break
+		}
+		return v.Name, v.varType(), v.Value
+	}
+	return start, typeEndOfMibView, 0
+}
+
+// pduWriter encodes the AgentX payload elements.
+type pduWriter struct {
+	order binary.ByteOrder
+	buf   []byte
+}
+
+func (w *pduWriter) bytes(b ...byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *pduWriter) uint16(v uint16) {
+	var b [2]byte
+	w.order.PutUint16(b[:], v)
+	w.bytes(b[:]...)
+}
+
+func (w *pduWriter) uint32(v uint32) {
+	var b [4]byte
+	w.order.PutUint32(b[:], v)
+	w.bytes(b[:]...)
+}
+
+func (w *pduWriter) uint64(v uint64) {
+	var b [8]byte
+	w.order.PutUint64(b[:], v)
+	w.bytes(b[:]...)
+}
+
+// oid encodes an OID, using the 1.3.6.1 prefix compression when possible.
+func (w *pduWriter) oid(o OID) {
+	var prefix byte
+	if len(o) >= 5 && o[:4].Compare(OID{1, 3, 6, 1}) == 0 && o[4] > 0 && o[4] < 256 {
+		prefix = byte(o[4])
+		o = o[5:]
+	}
+	w.bytes(byte(len(o)), prefix, 0, 0)
+	for _, id := range o {
+		w.uint32(id)
+	}
+}
+
+func (w *pduWriter) octetString(s string) {
+	w.uint32(uint32(len(s)))
+	w.bytes([]byte(s)...)
+	for len(w.buf)%4 != 0 {
+		w.bytes(0)
+	}
+}
+
+func (w *pduWriter) varbind(name OID, typ uint16, value uint64) {
+	w.uint16(typ)
+	w.uint16(0)
+	w.oid(name)
+	switch typ {
+	case typeCounter64:
+		w.uint64(value)
+	case typeGauge32:
+		w.uint32(uint32(value))
+	}
+}
+
+// pduReader decodes the AgentX payload elements. The first error is kept in
+// err, and makes the subsequent reads no-ops.
+type pduReader struct {
+	order binary.ByteOrder
+	buf   []byte
+	err   error
+}
+
+func (r *pduReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errors.New("truncated PDU")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pduReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return r.order.Uint16(b)
+	}
+	return 0
+}
+
+func (r *pduReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return r.order.Uint32(b)
+	}
+	return 0
+}
+
+// oid decodes an OID, and returns it with its include flag.
+func (r *pduReader) oid() (OID, bool) {
+	hdr := r.next(4)
+	if hdr == nil {
+		return nil, false
+	}
+	var o OID
+	if hdr[1] != 0 {
+		o = OID{1, 3, 6, 1, uint32(hdr[1])}
+	}
+	for i := 0; i < int(hdr[0]); i++ {
+		o = append(o, r.uint32())
+	}
+	return o, hdr[2] != 0
+}
+
+func (r *pduReader) octetString() string {
+	n := r.uint32()
+	if n > uint32(len(r.buf)) {
+		r.err = errors.New("truncated PDU")
+		return ""
+	}
+	padded := (int(n) + 3) &^ 3
+	if padded > len(r.buf) {
+		padded = len(r.buf)
+	}
+	b := r.next(padded)
+	return string(b[:n])
+}
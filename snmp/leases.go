@@ -0,0 +1,137 @@
+package snmp
+
+import (
+	"math"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/coredhcp/coredhcp/clock"
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/leases"
+)
+
+// leaseCacheTTL is how long the lease and pool gauges are cached: a walk of
+// the subtree gets every variable, and each get must not scan the store.
+const leaseCacheTTL = 10 * time.Second
+
+// The layout of the lease and pool gauges under the root, after the counter
+// groups of StatsVariables:
+//   - <root>.3: the number of active DHCPv4 leases (.1), active DHCPv6 leases
+//     (.2) and expired leases kept in the store (.3), with the .0 instance,
+//   - <root>.4.1: the pool table, with one row per pool, numbered from 1 in
+//     the order of the configuration, and the size (.1), active leases (.2)
+//     and free addresses (.3) columns, i.e. <root>.4.1.<column>.<row>.
+const (
+	groupLeases = 3
+	groupPools  = 4
+)
+
+// LeaseVariables returns a VariableFunc exposing the lease counts of a store,
+// and the utilization of the pools returned by pools, i.e. of the addresses
+// of their subnets served by this server, see config.SubnetConfig.Pool, under
+// root. The values are computed at most every leaseCacheTTL.
+func LeaseVariables(store leases.Store, pools func() []*config.SubnetConfig, root OID) VariableFunc {
+	var (
+		lock    sync.Mutex
+		vars    []Variable
+		expires time.Time
+	)
+	return func() []Variable {
+		lock.Lock()
+		defer lock.Unlock()
+		now := clock.Now()
+		if vars != nil && now.Before(expires) {
+			return vars
+		}
+		vars = leaseVariables(store, pools(), root, now)
+		expires = now.Add(leaseCacheTTL)
+		return vars
+	}
+}
+
+// gauge returns a Gauge32 variable, capped to its maximum value.
+func gauge(name OID, value *big.Int) Variable {
+	v := uint64(math.MaxUint32)
+	if value.IsUint64() && value.Uint64() < v {
+		v = value.Uint64()
+	}
+	return Variable{Name: name, Value: v, Gauge: true}
+}
+
+func leaseVariables(store leases.Store, pools []*config.SubnetConfig, root OID, now time.Time) []Variable {
+	oid := func(ids ...uint32) OID {
+		ret := make(OID, len(root), len(root)+len(ids))
+		copy(ret, root)
+		return append(ret, ids...)
+	}
+	var active4, active6, expired int64
+	all, err := store.Leases()
+	if err != nil {
+		log.Printf("snmp: cannot read the leases: %v", err)
+	}
+	for _, l := range all {
+		switch {
+		case l.Expired(now):
+			expired++
+		case l.IP.To4() != nil:
+			active4++
+		default:
+			active6++
+		}
+	}
+	vars := []Variable{
+		gauge(oid(groupLeases, 1, 0), big.NewInt(active4)),
+		gauge(oid(groupLeases, 2, 0), big.NewInt(active6)),
+		gauge(oid(groupLeases, 3, 0), big.NewInt(expired)),
+	}
+	sizes := make([]*big.Int, len(pools))
+	used := make([]*big.Int, len(pools))
+	for i, subnet := range pools {
+		sizes[i], used[i] = new(big.Int), new(big.Int)
+		pool := subnet.Pool()
+		if pool == nil {
+			continue
+		}
+		sizes[i] = pool.Size()
+		inSubnet, err := leases.LeasesInSubnet(store, subnet.Prefix)
+		if err != nil {
+			log.Printf("snmp: cannot read the leases of %s: %v", subnet.Prefix, err)
+			continue
+		}
+		var n int64
+		for _, l := range inSubnet {
+			if !l.Expired(now) && pool.Contains(l.IP) {
+				n++
+			}
+		}
+		used[i] = big.NewInt(n)
+	}
+	// the table is walked column by column
+	for i := range pools {
+		vars = append(vars, gauge(oid(groupPools, 1, 1, uint32(i+1)), sizes[i]))
+	}
+	for i := range pools {
+		vars = append(vars, gauge(oid(groupPools, 1, 2, uint32(i+1)), used[i]))
+	}
+	for i := range pools {
+		free := new(big.Int).Sub(sizes[i], used[i])
+		if free.Sign() < 0 {
+			free.SetInt64(0)
+		}
+		vars = append(vars, gauge(oid(groupPools, 1, 3, uint32(i+1)), free))
+	}
+	return vars
+}
+
+// Concat returns a VariableFunc exposing the variables of several ones, which
+// must be in the order of their names.
+func Concat(funcs ...VariableFunc) VariableFunc {
+	return func() []Variable {
+		var vars []Variable
+		for _, f := range funcs {
+			vars = append(vars, f()...)
+		}
+		return vars
+	}
+}
@@ -0,0 +1,72 @@
+package snmp
+
+import (
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// DefaultRoot is the default root OID of the exposed variables, in the
+// net-snmp experimental subtree (netSnmpPlaypen). Sites with their own
+// enterprise number should configure a root under it.
+var DefaultRoot = OID{1, 3, 6, 1, 4, 1, 8072, 9999, 67}
+
+// The layout of the variables under the root, modeled on the counter groups
+// of the DHCP server MIB draft. Every counter is a scalar, with the .0
+// instance: <root>.<group>.<index>.0. The message counters are summed across
+// listeners, and count each message type in the direction it can travel,
+// i.e. received for client messages and sent for server messages.
+var (
+	// <root>.1: DHCPv4 server counters
+	v4Types = []dhcpv4.MessageType{
+		dhcpv4.MessageTypeDiscover,
+		dhcpv4.MessageTypeOffer,
+		dhcpv4.MessageTypeRequest,
+		dhcpv4.MessageTypeDecline,
+		dhcpv4.MessageTypeAck,
+		dhcpv4.MessageTypeNak,
+		dhcpv4.MessageTypeRelease,
+		dhcpv4.MessageTypeInform,
+	}
+	// <root>.2: DHCPv6 server counters
+	v6Types = []dhcpv6.MessageType{
+		dhcpv6.MessageTypeSolicit,
+		dhcpv6.MessageTypeAdvertise,
+		dhcpv6.MessageTypeRequest,
+		dhcpv6.MessageTypeConfirm,
+		dhcpv6.MessageTypeRenew,
+		dhcpv6.MessageTypeRebind,
+		dhcpv6.MessageTypeReply,
+		dhcpv6.MessageTypeRelease,
+		dhcpv6.MessageTypeDecline,
+		dhcpv6.MessageTypeReconfigure,
+		dhcpv6.MessageTypeInformationRequest,
+	}
+)
+
+func messageCount(r *stats.Registry, version, typ string) uint64 {
+	return r.Sum(stats.Received, "version", version, "type", typ) + r.Sum(stats.Sent, "version", version, "type", typ)
+}
+
+// StatsVariables returns a VariableFunc exposing the message counters of a
+// stats registry under root. After the message types, each group has the
+// number of dropped requests.
+func StatsVariables(r *stats.Registry, root OID) VariableFunc {
+	scalar := func(group, index uint32) OID {
+		oid := make(OID, len(root), len(root)+3)
+		copy(oid, root)
+		return append(oid, group, index, 0)
+	}
+	return func() []Variable {
+		vars := make([]Variable, 0, len(v4Types)+len(v6Types)+2)
+		for i, t := range v4Types {
+			vars = append(vars, Variable{Name: scalar(1, uint32(i+1)), Value: messageCount(r, "4", t.String())})
+		}
+		vars = append(vars, Variable{Name: scalar(1, uint32(len(v4Types)+1)), Value: r.Sum(stats.Dropped, "version", "4")})
+		for i, t := range v6Types {
+			vars = append(vars, Variable{Name: scalar(2, uint32(i+1)), Value: messageCount(r, "6", t.String())})
+		}
+		vars = append(vars, Variable{Name: scalar(2, uint32(len(v6Types)+1)), Value: r.Sum(stats.Dropped, "version", "6")})
+		return vars
+	}
+}
@@ -0,0 +1,81 @@
+package coredhcp
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/coredhcp/coredhcp/config"
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/management"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+func listenerLabel(conn net.PacketConn) string {
+	if addr := conn.LocalAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// count6 updates the message counters for a DHCPv6 transaction, with the
+// labels of the pool of the client. Relayed messages are counted by their
+// inner message type.
+func count6(conn net.PacketConn, req, resp dhcpv6.DHCPv6, labels config.Labels) {
+	listener := listenerLabel(conn)
+	if msg, err := dhcputil.InnerMessage6(req); err == nil {
+		stats.Inc(stats.Received, labels.With("version", "6", "listener", listener, "type", msg.Type().String())...)
+	}
+	if resp == nil {
+		stats.Inc(stats.Dropped, labels.With("version", "6", "listener", listener)...)
+		return
+	}
+	if msg, err := dhcputil.InnerMessage6(resp); err == nil {
+		stats.Inc(stats.Sent, labels.With("version", "6", "listener", listener, "type", msg.Type().String())...)
+	}
+}
+
+// count4 updates the message counters for a DHCPv4 transaction.
+func count4(conn net.PacketConn, req, resp *dhcpv4.DHCPv4, labels config.Labels) {
+	listener := listenerLabel(conn)
+	stats.Inc(stats.Received, labels.With("version", "4", "listener", listener, "type", req.MessageType().String())...)
+	if resp == nil {
+		stats.Inc(stats.Dropped, labels.With("version", "4", "listener", listener)...)
+		return
+	}
+	stats.Inc(stats.Sent, labels.With("version", "4", "listener", listener, "type", resp.MessageType().String())...)
+}
+
+// StatisticsReport is the response of the statistics endpoint.
+type StatisticsReport struct {
+	Since    time.Time         `json:"since"`
+	Counters map[string]uint64 `json:"counters"`
+}
+
+// registerStatisticsHandlers registers the statistics endpoints: GET
+// /statistics returns all the counters as JSON, POST /statistics/reset resets
+// them, and /metrics exposes them in the Prometheus text format.
+func registerStatisticsHandlers(m *management.Server) {
+	m.HandleFunc("/statistics", func(w http.ResponseWriter, r *http.Request) {
+		counters, since := stats.Default.Snapshot()
+		management.WriteJSON(w, http.StatusOK, &StatisticsReport{Since: since, Counters: counters})
+	})
+	m.HandleFunc("/statistics/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		stats.Default.Reset()
+		log.Print("Statistics reset via the management API")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	m.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := stats.Default.WritePrometheus(w); err != nil {
+			log.Printf("Failed to write metrics: %v", err)
+		}
+	})
+}
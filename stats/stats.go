@@ -0,0 +1,280 @@
+// Package stats implements resettable counters and gauges, exposed via the
+// management API as JSON and in the Prometheus text format.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the message counters maintained by the server, shared with the
+// exporters of the statistics, e.g. the Kea command API and the SNMP
+// subagent. All of them have the `version` and `listener` labels, the message
+// counters also have a `type` label, and the rejection counter has a `reason`
+// label.
+const (
+	Received = "dhcp_received_total"
+	Sent     = "dhcp_sent_total"
+	Dropped  = "dhcp_dropped_total"
+	Rejected = "dhcp_rejected_total"
+)
+
+// Registry holds a set of counters and gauges, each identified by a name and
+// a set of labels. It is safe for concurrent use.
+type Registry struct {
+	lock     sync.Mutex
+	counters map[string]uint64
+	// gauges are the current values of states, e.g. of the utilization of
+	// a pool, which are not reset with the counters
+	gauges map[string]uint64
+	since  time.Time
+	// constLabels are added to all the metrics in the Prometheus format,
+	// as `key="value"` pairs
+	constLabels []string
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{counters: make(map[string]uint64), gauges: make(map[string]uint64), since: time.Now()}
+}
+
+// Default is the registry used by the server and the plugins.
+var Default = NewRegistry()
+
+// labelEscaper escapes the label values in the Prometheus text format, which
+// only escapes the backslashes, the double quotes and the line feeds.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPair returns a label in the Prometheus format, e.g. `version="6"`.
+func labelPair(k, v string) string {
+	return k + `="` + labelEscaper.Replace(v) + `"`
+}
+
+// key returns the identifier of a counter in the Prometheus format, e.g.
+// `dhcp_received_total{type="SOLICIT",version="6"}`. Labels are key/value
+// pairs, and are sorted by key.
+func key(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labelPair(labels[i], labels[i+1]))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Add adds delta to the counter with the given name and labels, creating it
+// if needed. Labels are passed as alternating keys and values.
+func (r *Registry) Add(delta uint64, name string, labels ...string) {
+	k := key(name, labels)
+	r.lock.Lock()
+	r.counters[k] += delta
+	r.lock.Unlock()
+}
+
+// Inc increments the counter with the given name and labels by one.
+func (r *Registry) Inc(name string, labels ...string) {
+	r.Add(1, name, labels...)
+}
+
+// Set sets the gauge with the given name and labels to a value, creating it
+// if needed.
+func (r *Registry) Set(value uint64, name string, labels ...string) {
+	k := key(name, labels)
+	r.lock.Lock()
+	r.gauges[k] = value
+	r.lock.Unlock()
+}
+
+// Get returns the value of the counter or gauge with the given name and
+// labels.
+func (r *Registry) Get(name string, labels ...string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	k := key(name, labels)
+	if v, ok := r.gauges[k]; ok {
+		return v
+	}
+	return r.counters[k]
+}
+
+// Sum returns the sum of all the counters with the given name whose labels
+// include the given ones, e.g. the total of a counter across all listeners.
+func (r *Registry) Sum(name string, labels ...string) uint64 {
+	var matchers []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		matchers = append(matchers, labelPair(labels[i], labels[i+1]))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var sum uint64
+	for k, v := range r.counters {
+		if metricName(k) != name {
+			continue
+		}
+		pairs := strings.Split(strings.TrimSuffix(k[len(name):], "}"), ",")
+		if hasAll(pairs, matchers) {
+			sum += v
+		}
+	}
+	return sum
+}
+
+// ResetMatching sets back to zero all the counters with the given name whose
+// labels include the given ones.
+func (r *Registry) ResetMatching(name string, labels ...string) {
+	var matchers []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		matchers = append(matchers, labelPair(labels[i], labels[i+1]))
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k := range r.counters {
+		if metricName(k) != name {
+			continue
+		}
+		pairs := strings.Split(strings.TrimSuffix(k[len(name):], "}"), ",")
+		if hasAll(pairs, matchers) {
+			delete(r.counters, k)
+		}
+	}
+}
+
+func hasAll(pairs, matchers []string) bool {
+	for _, m := range matchers {
+		found := false
+		for _, p := range pairs {
+			if strings.TrimPrefix(p, "{") == m {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns a copy of all the counters and gauges, and the time when
+// the counters were last reset.
+func (r *Registry) Snapshot() (map[string]uint64, time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ret := make(map[string]uint64, len(r.counters)+len(r.gauges))
+	for k, v := range r.counters {
+		ret[k] = v
+	}
+	for k, v := range r.gauges {
+		ret[k] = v
+	}
+	return ret, r.since
+}
+
+// Reset sets all the counters back to zero. The gauges are kept.
+func (r *Registry) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counters = make(map[string]uint64)
+	r.since = time.Now()
+}
+
+// SetConstLabels sets the labels added to all the metrics in the Prometheus
+// format, e.g. the site of the server, except to the metrics that have a label
+// with the same key. Labels are passed as alternating keys and values.
+func (r *Registry) SetConstLabels(labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labelPair(labels[i], labels[i+1]))
+	}
+	r.lock.Lock()
+	r.constLabels = pairs
+	r.lock.Unlock()
+}
+
+// withConstLabels returns the identifier of a metric with the constant labels
+// that it does not have.
+func withConstLabels(k string, constLabels []string) string {
+	name := metricName(k)
+	var pairs []string
+	if len(k) > len(name) {
+		pairs = append(pairs, k[len(name)+1:len(k)-1])
+	}
+	for _, pair := range constLabels {
+		prefix := pair[:strings.IndexByte(pair, '=')+2]
+		if !strings.HasPrefix(k, name+"{"+prefix) && !strings.Contains(k, ","+prefix) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if len(pairs) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// WritePrometheus writes all the counters and gauges in the Prometheus text
+// exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	counters, _ := r.Snapshot()
+	r.lock.Lock()
+	gauges := make(map[string]bool)
+	for k := range r.gauges {
+		gauges[metricName(k)] = true
+	}
+	constLabels := r.constLabels
+	r.lock.Unlock()
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	// sort by metric name first, so that all the counters of a metric are
+	// grouped under its TYPE line
+	sort.Slice(keys, func(i, j int) bool {
+		ni, nj := metricName(keys[i]), metricName(keys[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return keys[i] < keys[j]
+	})
+	var lastName string
+	for _, k := range keys {
+		name := metricName(k)
+		if name != lastName {
+			kind := "counter"
+			if gauges[name] {
+				kind = "gauge"
+			}
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, kind); err != nil {
+				return err
+			}
+			lastName = name
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", withConstLabels(k, constLabels), counters[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func metricName(k string) string {
+	if idx := strings.IndexByte(k, '{'); idx >= 0 {
+		return k[:idx]
+	}
+	return k
+}
+
+// Inc increments a counter of the Default registry.
+func Inc(name string, labels ...string) {
+	Default.Inc(name, labels...)
+}
+
+// Set sets a gauge of the Default registry.
+func Set(value uint64, name string, labels ...string) {
+	Default.Set(value, name, labels...)
+}
@@ -0,0 +1,221 @@
+package coredhcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredhcp/coredhcp/management"
+)
+
+// DisabledPlugin describes a plugin disabled at runtime through the management
+// API. The disabled plugins are skipped in the chains, until they are enabled
+// again, their time is up, or the server restarts.
+type DisabledPlugin struct {
+	Since time.Time `json:"since"`
+	// Until is zero if the plugin is disabled until it is enabled again.
+	Until     time.Time `json:"until,omitempty"`
+	Reason    string    `json:"reason"`
+	Principal string    `json:"principal,omitempty"`
+}
+
+// active returns whether a plugin is still disabled at a time.
+func (d *DisabledPlugin) active(now time.Time) bool {
+	return d.Until.IsZero() || now.Before(d.Until)
+}
+
+// pluginToggles holds the plugins disabled at runtime, as an immutable map of
+// names to *DisabledPlugin that is replaced on every change, so that the chains
+// read it without locking. The zero value has no disabled plugin.
+type pluginToggles struct {
+	lock     sync.Mutex
+	disabled atomic.Value
+}
+
+// get returns the disabled plugins. The map must not be modified.
+func (t *pluginToggles) get() map[string]*DisabledPlugin {
+	m, _ := t.disabled.Load().(map[string]*DisabledPlugin)
+	return m
+}
+
+// set disables a plugin, or enables it if d is nil.
+func (t *pluginToggles) set(name string, d *DisabledPlugin) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	old := t.get()
+	m := make(map[string]*DisabledPlugin, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if d == nil {
+		delete(m, name)
+	} else {
+		m[name] = d
+	}
+	t.disabled.Store(m)
+}
+
+// disabled returns whether a plugin is disabled, given the map returned by
+// get.
+func disabled(m map[string]*DisabledPlugin, name string, now time.Time) bool {
+	d, ok := m[name]
+	return ok && d.active(now)
+}
+
+// PluginStatus is the status of a plugin of a chain.
+type PluginStatus struct {
+	Name string `json:"name"`
+	// Version is either 4 or 6.
+	Version  int             `json:"version"`
+	Enabled  bool            `json:"enabled"`
+	Disabled *DisabledPlugin `json:"disabled,omitempty"`
+}
+
+// PluginStatuses returns the status of the plugins of the chains, in order.
+func (s *Server) PluginStatuses() []*PluginStatus {
+	s.handlersLock.RLock()
+	names6, names4 := s.names6, s.names4
+	s.handlersLock.RUnlock()
+	now := time.Now()
+	m := s.toggles.get()
+	var ret []*PluginStatus
+	add := func(version int, names []string) {
+		for _, name := range names {
+			st := PluginStatus{Name: name, Version: version, Enabled: true}
+			if d, ok := m[name]; ok && d.active(now) {
+				st.Enabled, st.Disabled = false, d
+			}
+			ret = append(ret, &st)
+		}
+	}
+	add(6, names6)
+	add(4, names4)
+	return ret
+}
+
+// inChain returns whether a plugin is in one of the chains.
+func (s *Server) inChain(name string) bool {
+	s.handlersLock.RLock()
+	defer s.handlersLock.RUnlock()
+	for _, names := range [][]string{s.names6, s.names4} {
+		for _, n := range names {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetPluginEnabled disables or enables a plugin of the chains at runtime, and
+// records the action in the logs and in the audit log. A disabled plugin is
+// enabled again after duration, if not zero.
+func (s *Server) SetPluginEnabled(name string, enabled bool, reason, principal string, duration time.Duration) error {
+	if !s.inChain(name) {
+		return fmt.Errorf("no plugin `%s` in the chains", name)
+	}
+	action := AuditAction{Time: time.Now(), Action: "enable-plugin", Principal: principal, Plugin: name, Reason: reason}
+	if enabled {
+		s.toggles.set(name, nil)
+		log.Printf("Plugin `%s` enabled by %s: %s", name, principalName(principal), reason)
+	} else {
+		if reason == "" {
+			return errors.New("a reason is required to disable a plugin")
+		}
+		d := DisabledPlugin{Since: action.Time, Reason: reason, Principal: principal}
+		if duration > 0 {
+			d.Until = d.Since.Add(duration)
+		}
+		s.toggles.set(name, &d)
+		action.Action = "disable-plugin"
+		if duration > 0 {
+			log.Printf("Plugin `%s` disabled for %v by %s: %s", name, duration, principalName(principal), reason)
+		} else {
+			log.Printf("Plugin `%s` disabled by %s: %s", name, principalName(principal), reason)
+		}
+	}
+	if s.AuditLog != nil {
+		s.AuditLog.LogAction(&action)
+	}
+	return nil
+}
+
+// logAction records in the audit log, if any, an action reported by a
+// management endpoint with management.RecordAction.
+func (s *Server) logAction(a *management.Action) {
+	if s.AuditLog != nil {
+		s.AuditLog.LogAction(&AuditAction{Time: time.Now(), Action: a.Action, Principal: a.Principal, Plugin: a.Plugin, Reason: a.Reason})
+	}
+}
+
+func principalName(principal string) string {
+	if principal == "" {
+		return "an unauthenticated client"
+	}
+	return principal
+}
+
+// pluginToggleRequest is the body of the requests to disable or enable a
+// plugin.
+type pluginToggleRequest struct {
+	Plugin string `json:"plugin"`
+	Reason string `json:"reason"`
+	// Duration, e.g. `1h`, is how long the plugin is disabled for, or until
+	// it is enabled again if empty.
+	Duration string `json:"duration"`
+}
+
+// registerPluginHandlers registers the endpoints of the plugins: GET /plugins
+// returns the status of the plugins of the chains, and POST /plugins/disable
+// and /plugins/enable disable and enable a plugin, with a reason.
+func (s *Server) registerPluginHandlers(m *management.Server) {
+	m.HandleFunc("/plugins", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		management.WriteJSON(w, http.StatusOK, s.PluginStatuses())
+	})
+	toggle := func(enabled bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req pluginToggleRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				management.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+				return
+			}
+			var duration time.Duration
+			if req.Duration != "" {
+				var err error
+				if duration, err = time.ParseDuration(req.Duration); err != nil || duration < 0 {
+					management.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid duration `%s`", req.Duration))
+					return
+				}
+			}
+			var principal string
+			if p := management.RequestPrincipal(r); p != nil {
+				principal = p.Name
+			}
+			if !s.inChain(req.Plugin) {
+				management.WriteError(w, http.StatusNotFound, fmt.Errorf("no plugin `%s` in the chains", req.Plugin))
+				return
+			}
+			if err := s.SetPluginEnabled(req.Plugin, enabled, req.Reason, principal, duration); err != nil {
+				management.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+	m.HandleFunc("/plugins/disable", toggle(false))
+	m.HandleFunc("/plugins/enable", toggle(true))
+}
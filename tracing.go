@@ -0,0 +1,67 @@
+package coredhcp
+
+import (
+	"context"
+	"net"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/tracing"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startTransaction6 starts the span covering the handling of a DHCPv6
+// request.
+func startTransaction6(peer net.Addr, req dhcpv6.DHCPv6) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("net.peer", peer.String()),
+		attribute.String("dhcp.request", req.Type().String()),
+	}
+	if msg, err := dhcputil.InnerMessage6(req); err == nil {
+		attrs = append(attrs, attribute.String("dhcp.inner_request", msg.Type().String()))
+	}
+	attrs = append(attrs, attribute.String("dhcp.correlation_id", correlationID6(req)))
+	return tracing.Tracer().Start(context.Background(), "dhcpv6", trace.WithAttributes(attrs...))
+}
+
+// startTransaction4 starts the span covering the handling of a DHCPv4
+// request.
+func startTransaction4(peer net.Addr, req *dhcpv4.DHCPv4) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(context.Background(), "dhcpv4", trace.WithAttributes(
+		attribute.String("net.peer", peer.String()),
+		attribute.String("dhcp.request", req.MessageType().String()),
+		attribute.String("dhcp.client", req.ClientHWAddr.String()),
+		attribute.String("dhcp.correlation_id", correlationID4(req)),
+	))
+}
+
+// startPluginSpan starts a child span of the transaction for a plugin. The
+// returned context should be passed to the plugin handler, so that the spans
+// it creates are children of the plugin span.
+func startPluginSpan(ctx context.Context, plugin string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "plugin/"+plugin)
+}
+
+func endTransaction6(span trace.Span, resp dhcpv6.DHCPv6, stopper string) {
+	if resp == nil {
+		span.SetAttributes(attribute.String("dhcp.response", "drop"))
+	} else {
+		span.SetAttributes(attribute.String("dhcp.response", resp.Type().String()))
+	}
+	if stopper != "" {
+		span.SetAttributes(attribute.String("dhcp.stopped_by", stopper))
+	}
+}
+
+func endTransaction4(span trace.Span, resp *dhcpv4.DHCPv4, stopper string) {
+	if resp == nil {
+		span.SetAttributes(attribute.String("dhcp.response", "drop"))
+	} else {
+		span.SetAttributes(attribute.String("dhcp.response", resp.MessageType().String()))
+	}
+	if stopper != "" {
+		span.SetAttributes(attribute.String("dhcp.stopped_by", stopper))
+	}
+}
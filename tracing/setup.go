@@ -0,0 +1,37 @@
+//go:build !minimal || with_tracing
+// +build !minimal with_tracing
+
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup exports the spans to the OTLP/gRPC collector at the given endpoint
+// (e.g. `localhost:4317`), sampling the specified ratio of the transactions.
+// The returned function flushes the pending spans and stops the exporter.
+func Setup(endpoint string, insecure bool, sampleRatio float64) (func(), error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "coredhcp"))),
+	)
+	otel.SetTracerProvider(tp)
+	return func() {
+		_ = tp.Shutdown(context.Background())
+	}, nil
+}
@@ -0,0 +1,14 @@
+//go:build minimal && !with_tracing
+// +build minimal,!with_tracing
+
+package tracing
+
+import (
+	"errors"
+)
+
+// Setup fails: the OTLP exporter, and its gRPC dependencies, are left out of
+// the minimal builds without the `with_tracing` tag.
+func Setup(endpoint string, insecure bool, sampleRatio float64) (func(), error) {
+	return nil, errors.New("tracing is not compiled in, build with the `with_tracing` tag")
+}
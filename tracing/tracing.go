@@ -0,0 +1,16 @@
+// Package tracing sets up OpenTelemetry tracing of the request handling, and
+// exports the spans via OTLP. Until Setup is called, all the spans are no-ops.
+package tracing
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/coredhcp/coredhcp"
+
+// Tracer returns the tracer used for all CoreDHCP spans. Plugins can use it
+// to create spans for their own backend calls.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
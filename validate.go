@@ -0,0 +1,167 @@
+package coredhcp
+
+import (
+	"bytes"
+	"context"
+	"net"
+
+	"github.com/coredhcp/coredhcp/dhcputil"
+	"github.com/coredhcp/coredhcp/logger"
+	serverid "github.com/coredhcp/coredhcp/plugins/server_id"
+	"github.com/coredhcp/coredhcp/stats"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/dhcpv6"
+)
+
+// Reasons for rejecting a transaction, used as the `reason` label of the
+// rejection counter.
+const (
+	rejectMalformed          = "malformed"
+	rejectUnexpectedType     = "unexpected-type"
+	rejectMissingClientID    = "missing-client-id"
+	rejectMissingServerID    = "missing-server-id"
+	rejectUnexpectedServerID = "unexpected-server-id"
+	rejectXIDMismatch        = "xid-mismatch"
+	rejectClientMismatch     = "client-mismatch"
+	rejectUntrustedRelay     = "untrusted-relay"
+)
+
+// discardOtherServer is the `reason` label of the rejection counter for the
+// requests discarded because they are for another server. They are not
+// errors: on a segment with several servers, the clients send their
+// DHCPREQUESTs and DHCPv6 Requests to all of them, naming the one they chose.
+const discardOtherServer = "other-server"
+
+// discard silently discards a request for another server, counting it with
+// the rejected ones, see forOtherServer6 and forOtherServer4.
+func discard(ctx context.Context, version string, conn net.PacketConn) {
+	stats.Inc(stats.Rejected, "version", version, "listener", listenerLabel(conn), "reason", discardOtherServer)
+	logger.FromContext(ctx).Debugf("Discarding DHCPv%s request for another server", version)
+}
+
+// reject counts and logs a transaction rejected by the validation.
+func reject(ctx context.Context, version string, conn net.PacketConn, reason string) {
+	stats.Inc(stats.Rejected, "version", version, "listener", listenerLabel(conn), "reason", reason)
+	logger.FromContext(ctx).Printf("Rejecting DHCPv%s transaction: %s", version, reason)
+}
+
+// duid6 returns the DUID of a client or server identifier option, or nil.
+func duid6(opt dhcpv6.Option) []byte {
+	switch o := opt.(type) {
+	case *dhcpv6.OptClientId:
+		return o.Cid.ToBytes()
+	case *dhcpv6.OptServerId:
+		return o.Sid.ToBytes()
+	}
+	return nil
+}
+
+// validateRequest6 checks the identifiers of a DHCPv6 request against the
+// requirements of RFC 8415, section 16, before any plugin runs. It returns the
+// reason to reject it, or an empty string.
+func validateRequest6(req dhcpv6.DHCPv6) string {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return rejectMalformed
+	}
+	var needClientID, needServerID, noServerID bool
+	switch msg.Type() {
+	case dhcpv6.MessageTypeAdvertise, dhcpv6.MessageTypeReply, dhcpv6.MessageTypeReconfigure, dhcpv6.MessageTypeRelayReply:
+		// messages sent by servers
+		return rejectUnexpectedType
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeConfirm, dhcpv6.MessageTypeRebind:
+		needClientID, noServerID = true, true
+	case dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRelease, dhcpv6.MessageTypeDecline:
+		needClientID, needServerID = true, true
+	}
+	if needClientID && msg.GetOneOption(dhcpv6.OptionClientID) == nil {
+		return rejectMissingClientID
+	}
+	sid := msg.GetOneOption(dhcpv6.OptionServerID)
+	if needServerID && sid == nil {
+		return rejectMissingServerID
+	}
+	if noServerID && sid != nil {
+		return rejectUnexpectedServerID
+	}
+	return ""
+}
+
+// forOtherServer6 returns whether a valid DHCPv6 request names another server
+// than the one of the `server_id` plugin, which RFC 8415, section 16, says to
+// discard.
+func forOtherServer6(req dhcpv6.DHCPv6) bool {
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return false
+	}
+	sid := msg.GetOneOption(dhcpv6.OptionServerID)
+	id := serverid.ServerID6()
+	return sid != nil && id != nil && !bytes.Equal(duid6(sid), id.ToBytes())
+}
+
+// validateResponse6 checks that a DHCPv6 response answers the request: that
+// it echoes its transaction ID and client identifier. It returns the reason to
+// reject the transaction, or an empty string.
+func validateResponse6(req, resp dhcpv6.DHCPv6) string {
+	if resp == nil {
+		return ""
+	}
+	msg, err := dhcputil.InnerMessage6(req)
+	if err != nil {
+		return rejectMalformed
+	}
+	reply, err := dhcputil.InnerMessage6(resp)
+	if err != nil {
+		return rejectMalformed
+	}
+	if m, ok := msg.(*dhcpv6.DHCPv6Message); ok {
+		if r, ok := reply.(*dhcpv6.DHCPv6Message); ok && m.TransactionID() != r.TransactionID() {
+			return rejectXIDMismatch
+		}
+	}
+	if cid, rcid := msg.GetOneOption(dhcpv6.OptionClientID), reply.GetOneOption(dhcpv6.OptionClientID); cid != nil && rcid != nil {
+		if !bytes.Equal(duid6(cid), duid6(rcid)) {
+			return rejectClientMismatch
+		}
+	}
+	return ""
+}
+
+// validateRequest4 checks that a DHCPv4 message is a request, before any
+// plugin runs. It returns the reason to reject it, or an empty string.
+func validateRequest4(req *dhcpv4.DHCPv4) string {
+	if req.OpCode != dhcpv4.OpcodeBootRequest {
+		return rejectUnexpectedType
+	}
+	return ""
+}
+
+// forOtherServer4 returns whether a DHCPREQUEST, DHCPDECLINE or DHCPRELEASE
+// names another server than this one, which RFC 2131, sections 4.3.2 to
+// 4.3.4, says to discard, e.g. the DHCPREQUEST of a client selecting the
+// offer of another server.
+func forOtherServer4(req *dhcpv4.DHCPv4) bool {
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeDecline, dhcpv4.MessageTypeRelease:
+		sid := req.ServerIdentifier()
+		return sid != nil && !serverid.IsServerID4(sid)
+	}
+	return false
+}
+
+// validateResponse4 checks that a DHCPv4 response answers the request: that
+// it echoes its transaction ID and client hardware address. It returns the
+// reason to reject the transaction, or an empty string.
+func validateResponse4(req, resp *dhcpv4.DHCPv4) string {
+	if resp == nil {
+		return ""
+	}
+	if req.TransactionID != resp.TransactionID {
+		return rejectXIDMismatch
+	}
+	if !bytes.Equal(req.ClientHWAddr, resp.ClientHWAddr) {
+		return rejectClientMismatch
+	}
+	return ""
+}